@@ -0,0 +1,786 @@
+// Package adminclient is a client for the admin API of the load balancer,
+// following the OpenAPI document it serves at /openapi.json. Each method
+// corresponds to one operation of the document and is named after its
+// operationId.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the admin API at BaseURL, such as "http://127.0.0.1:8081".
+type Client struct {
+	BaseURL string
+	// Token, if set, is sent as a bearer token.
+	Token string
+	// HTTPClient sends the requests; nil means http.DefaultClient. Set its
+	// transport to authenticate with a client certificate.
+	HTTPClient *http.Client
+}
+
+// New creates a Client for the admin API at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Frontend returns a Client for the admin API of the frontend named name,
+// which the admin API of the service serves under /frontends/<name>, with
+// the same credentials.
+func (c *Client) Frontend(name string) *Client {
+	fc := *c
+	fc.BaseURL = strings.TrimSuffix(c.BaseURL, "/") + "/frontends/" + url.PathEscape(name)
+	return &fc
+}
+
+// Error is an error response of the admin API.
+type Error struct {
+	StatusCode int
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("admin API: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("admin API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Duration is a time.Duration encoded as a Go duration string.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// Backend is a server of a pool.
+type Backend struct {
+	Addr     string `json:"addr"`
+	Alive    bool   `json:"alive"`
+	Weight   int    `json:"weight"`
+	Tier     int    `json:"tier"`
+	Draining bool   `json:"draining"`
+	Disabled bool   `json:"disabled"`
+	// InWindow is set while a maintenance window of the backend is open.
+	InWindow bool `json:"in_window,omitempty"`
+	// InFlight counts the requests, or connections of layer-4 pools, being
+	// handled.
+	InFlight int64 `json:"in_flight"`
+	// Requests counts the requests, or connections, the backend was sent,
+	// and Failures those that failed.
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+}
+
+// Connection is an HTTP/2 connection to a backend.
+type Connection struct {
+	Backend string `json:"backend"`
+	Local   string `json:"local"`
+	Remote  string `json:"remote"`
+	// Protocol is h2, or h2c for cleartext.
+	Protocol string    `json:"protocol"`
+	Opened   time.Time `json:"opened"`
+	// Streams counts the requests in flight on the connection, Requests
+	// those it has carried.
+	Streams  int64 `json:"streams"`
+	Requests int64 `json:"requests"`
+}
+
+// PoolBackend is a backend with the name of its pool.
+type PoolBackend struct {
+	Pool string `json:"pool"`
+	Backend
+}
+
+// Pool is a pool and its backends.
+type Pool struct {
+	Name string `json:"name"`
+	// Protocol is empty for HTTP.
+	Protocol    string    `json:"protocol,omitempty"`
+	Maintenance bool      `json:"maintenance"`
+	Backends    []Backend `json:"backends"`
+}
+
+// ServerConfig describes a backend to add, as in the configuration file.
+type ServerConfig struct {
+	Addr   string `json:"addr"`
+	H2C    bool   `json:"h2c,omitempty"`
+	Weight int    `json:"weight,omitempty"`
+	Tier   int    `json:"tier,omitempty"`
+	// Maintenance lists recurring windows during which the backend is
+	// drained.
+	Maintenance []Window `json:"maintenance,omitempty"`
+}
+
+// Window is a recurring maintenance window opening whenever Cron fires and
+// lasting Duration, evaluated in Timezone (UTC if empty).
+type Window struct {
+	Cron     string   `json:"cron"`
+	Duration Duration `json:"duration"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// PoolConfig describes a pool to add, as in the configuration file. Extra
+// holds the fields of the configuration file not covered by this struct.
+type PoolConfig struct {
+	Name        string         `json:"name"`
+	Servers     []ServerConfig `json:"servers,omitempty"`
+	Strategy    string         `json:"strategy,omitempty"`
+	Protocol    string         `json:"protocol,omitempty"`
+	Maintenance bool           `json:"maintenance,omitempty"`
+	Extra       map[string]any `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler, merging Extra into the object.
+func (pc PoolConfig) MarshalJSON() ([]byte, error) {
+	type plain PoolConfig
+	b, err := json.Marshal(plain(pc))
+	if err != nil || len(pc.Extra) == 0 {
+		return b, err
+	}
+	m := map[string]any{}
+	for k, v := range pc.Extra {
+		m[k] = v
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// BackendChange changes a backend; nil fields are left unchanged. Ramp, if
+// set, moves the weight to Weight gradually.
+type BackendChange struct {
+	Weight *int     `json:"weight,omitempty"`
+	Tier   *int     `json:"tier,omitempty"`
+	Ramp   Duration `json:"ramp,omitempty"`
+}
+
+// Split assigns a share of a route's traffic to a pool.
+type Split struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// BlueGreen is the state of a blue/green route.
+type BlueGreen struct {
+	Blue     string `json:"blue"`
+	Green    string `json:"green"`
+	Active   string `json:"active"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// Registration registers a backend with a pool.
+type Registration struct {
+	Addr   string   `json:"addr"`
+	Weight int      `json:"weight,omitempty"`
+	Tier   int      `json:"tier,omitempty"`
+	TTL    Duration `json:"ttl,omitempty"`
+}
+
+// RegistrationResult is the TTL granted to a registration, within which the
+// next heartbeat must arrive.
+type RegistrationResult struct {
+	Addr string   `json:"addr"`
+	TTL  Duration `json:"ttl"`
+}
+
+// Maintenance is the state of the maintenance switches.
+type Maintenance struct {
+	Enabled bool `json:"enabled"`
+	// Routes covered by the global switch; empty covers every request.
+	Routes []string `json:"routes"`
+	// Pools in maintenance.
+	Pools []string `json:"pools"`
+}
+
+// Ban is a client banned by abuse detection.
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+	// Reason is velocity, errors or manual.
+	Reason string `json:"reason"`
+	// Offenses counts the bans of the client, this one included, that the
+	// length of its next ban follows from.
+	Offenses int `json:"offenses"`
+}
+
+// HAStatus is the HA role of an instance, active or standby, and what it
+// knows of its peer.
+type HAStatus struct {
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	Priority int       `json:"priority"`
+	Since    time.Time `json:"since"`
+	Peer     *HAPeer   `json:"peer"`
+}
+
+// HAPeer is the peer of an HA instance as of its last heartbeat. Error is
+// why the last one failed, if it did.
+type HAPeer struct {
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	LastSeen time.Time `json:"last_seen"`
+	Error    string    `json:"error"`
+}
+
+// Cluster is the view a replica has of its cluster: the members it heard
+// from recently and the health of the servers, by address.
+type Cluster struct {
+	Name    string          `json:"name"`
+	Members []ClusterMember `json:"members"`
+	Health  []ClusterHealth `json:"health"`
+}
+
+// ClusterMember is a replica, at the address it gossips from.
+type ClusterMember struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ClusterHealth is the health of a server as Origin last observed it.
+type ClusterHealth struct {
+	Addr    string    `json:"addr"`
+	Alive   bool      `json:"alive"`
+	Version uint64    `json:"version"`
+	Origin  string    `json:"origin"`
+	Time    time.Time `json:"time"`
+}
+
+// Fleet is what an instance knows of its fleet: its leader and the version
+// of the configuration last published or applied.
+type Fleet struct {
+	Name    string `json:"name"`
+	Leader  string `json:"leader"`
+	Version uint64 `json:"version"`
+	Error   string `json:"error"`
+}
+
+// ExplainRequest describes a request to explain. Headers are "Name: value".
+type ExplainRequest struct {
+	Method  string
+	Host    string
+	URI     string
+	Headers []string
+	Client  string
+}
+
+// Explanation is how the load balancer would serve a request.
+type Explanation struct {
+	Middleware []string     `json:"middleware"`
+	Routes     []RouteMatch `json:"routes"`
+	Route      string       `json:"route"`
+	Path       string       `json:"path"`
+	Status     int          `json:"status"`
+	Redirect   string       `json:"redirect"`
+	Mirror     string       `json:"mirror"`
+	Pools      []PoolChoice `json:"pools"`
+}
+
+// RouteMatch is a route tried for a request and the first of its
+// conditions the request does not satisfy, or "" if it matched.
+type RouteMatch struct {
+	Name     string `json:"name"`
+	Mismatch string `json:"mismatch"`
+}
+
+// PoolChoice is a pool that may serve a request, why, and its servers that
+// may. Server is set when affinity or the servers available decide it.
+type PoolChoice struct {
+	Name        string   `json:"name"`
+	Reason      string   `json:"reason"`
+	Bucket      string   `json:"bucket"`
+	Weight      int      `json:"weight"`
+	Maintenance bool     `json:"maintenance"`
+	Affinity    string   `json:"affinity"`
+	Pinned      bool     `json:"pinned"`
+	Server      string   `json:"server"`
+	Servers     []string `json:"servers"`
+	Datacenters []string `json:"datacenters"`
+	Error       string   `json:"error"`
+}
+
+// ProbeResult is what a synthetic probe sent through the listener found:
+// whether its last request succeeded, with the status and latency in
+// milliseconds of its response or why it failed.
+type ProbeResult struct {
+	Name        string    `json:"name"`
+	Up          bool      `json:"up"`
+	Time        time.Time `json:"time"`
+	Status      int       `json:"status"`
+	Latency     float64   `json:"latency_ms"`
+	Error       string    `json:"error"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// Frontend is a frontend of the service besides the main one.
+type Frontend struct {
+	Name string `json:"name"`
+	Port string `json:"port"`
+}
+
+// Datacenter is a data center of a pool routing by data center: its
+// servers, the latency to it in milliseconds and the weight it routes
+// with, Override if set through the admin API.
+type Datacenter struct {
+	Name     string   `json:"name"`
+	Servers  []string `json:"servers"`
+	Healthy  bool     `json:"healthy"`
+	Latency  float64  `json:"latency_ms"`
+	Error    string   `json:"error"`
+	Weight   int      `json:"weight"`
+	Override *int     `json:"override"`
+}
+
+// BanRequest bans a client. Without a Duration, the ban lasts as long as
+// the client's next offense would.
+type BanRequest struct {
+	IP       string   `json:"ip"`
+	Duration Duration `json:"duration,omitempty"`
+}
+
+// Logging is the log level and access log sampling.
+type Logging struct {
+	// Level is debug, info, warn or error.
+	Level string `json:"level"`
+	// AccessLogSample is the fraction of the requests written to the access
+	// log, from 0 to 1.
+	AccessLogSample float64 `json:"access_log_sample"`
+}
+
+// LoggingChange changes the logging settings; nil fields are left unchanged.
+type LoggingChange struct {
+	Level           *string  `json:"level,omitempty"`
+	AccessLogSample *float64 `json:"access_log_sample,omitempty"`
+}
+
+// Livez runs the liveness probe and returns its report.
+func (c *Client) Livez(ctx context.Context) (string, error) {
+	return c.text(ctx, "/livez?verbose")
+}
+
+// Readyz runs the readiness probe and returns its report. A load balancer
+// that is not ready is reported as an *Error with status 503.
+func (c *Client) Readyz(ctx context.Context) (string, error) {
+	return c.text(ctx, "/readyz?verbose")
+}
+
+// Metrics returns the metrics in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	return c.text(ctx, "/metrics")
+}
+
+// GetSplits returns the weighted pool splits of a route.
+func (c *Client) GetSplits(ctx context.Context, route string) ([]Split, error) {
+	var out []Split
+	err := c.do(ctx, http.MethodGet, "/routes/"+url.PathEscape(route)+"/splits", nil, nil, &out)
+	return out, err
+}
+
+// SetSplits replaces the weighted pool splits of a route.
+func (c *Client) SetSplits(ctx context.Context, route string, splits []Split) ([]Split, error) {
+	var out []Split
+	err := c.do(ctx, http.MethodPut, "/routes/"+url.PathEscape(route)+"/splits", nil, splits, &out)
+	return out, err
+}
+
+// GetBlueGreen returns the state of a blue/green route.
+func (c *Client) GetBlueGreen(ctx context.Context, route string) (*BlueGreen, error) {
+	var out BlueGreen
+	err := c.do(ctx, http.MethodGet, "/routes/"+url.PathEscape(route)+"/bluegreen", nil, nil, &out)
+	return &out, err
+}
+
+// SwitchRoute makes active, "blue" or "green", the active deployment of a
+// route; an empty active switches to the inactive one.
+func (c *Client) SwitchRoute(ctx context.Context, route, active string) (*BlueGreen, error) {
+	var body any
+	if active != "" {
+		body = map[string]string{"active": active}
+	}
+	var out BlueGreen
+	err := c.do(ctx, http.MethodPost, "/routes/"+url.PathEscape(route)+"/switch", nil, body, &out)
+	return &out, err
+}
+
+// RollbackRoute makes the previously active deployment of a route active again.
+func (c *Client) RollbackRoute(ctx context.Context, route string) (*BlueGreen, error) {
+	var out BlueGreen
+	err := c.do(ctx, http.MethodPost, "/routes/"+url.PathEscape(route)+"/rollback", nil, nil, &out)
+	return &out, err
+}
+
+// ListPools returns the pools sorted by name.
+func (c *Client) ListPools(ctx context.Context) ([]Pool, error) {
+	var out []Pool
+	err := c.do(ctx, http.MethodGet, "/pools", nil, nil, &out)
+	return out, err
+}
+
+// AddPool adds a pool.
+func (c *Client) AddPool(ctx context.Context, pool PoolConfig) (*Pool, error) {
+	var out Pool
+	err := c.do(ctx, http.MethodPost, "/pools", nil, pool, &out)
+	return &out, err
+}
+
+// GetPool returns a pool.
+func (c *Client) GetPool(ctx context.Context, name string) (*Pool, error) {
+	var out Pool
+	err := c.do(ctx, http.MethodGet, poolPath(name, ""), nil, nil, &out)
+	return &out, err
+}
+
+// RemovePool removes a pool no route or listener uses.
+func (c *Client) RemovePool(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, poolPath(name, ""), nil, nil, nil)
+}
+
+// ListBackends returns the backends of a pool.
+func (c *Client) ListBackends(ctx context.Context, pool string) ([]Backend, error) {
+	var out []Backend
+	err := c.do(ctx, http.MethodGet, poolPath(pool, "/backends"), nil, nil, &out)
+	return out, err
+}
+
+// ListConnections returns the HTTP/2 connections to the backends of a pool.
+func (c *Client) ListConnections(ctx context.Context, pool string) ([]Connection, error) {
+	var out []Connection
+	err := c.do(ctx, http.MethodGet, poolPath(pool, "/connections"), nil, nil, &out)
+	return out, err
+}
+
+// AddBackend adds a backend to a pool.
+func (c *Client) AddBackend(ctx context.Context, pool string, server ServerConfig) (*Backend, error) {
+	var out Backend
+	err := c.do(ctx, http.MethodPost, poolPath(pool, "/backends"), nil, server, &out)
+	return &out, err
+}
+
+// ModifyBackend changes the backend at addr of a pool.
+func (c *Client) ModifyBackend(ctx context.Context, pool, addr string, change BackendChange) (*Backend, error) {
+	var out Backend
+	err := c.do(ctx, http.MethodPatch, poolPath(pool, "/backends"), addrQuery(addr), change, &out)
+	return &out, err
+}
+
+// ModifyBackendEverywhere changes the backend at addr in every pool that has
+// it, or only in pool if it is not empty.
+func (c *Client) ModifyBackendEverywhere(ctx context.Context, addr, pool string, change BackendChange) ([]PoolBackend, error) {
+	var query url.Values
+	if pool != "" {
+		query = url.Values{"pool": {pool}}
+	}
+	var out []PoolBackend
+	err := c.do(ctx, http.MethodPatch, "/backends/"+url.PathEscape(addr), query, change, &out)
+	return out, err
+}
+
+// RemoveBackend removes the backend at addr from a pool.
+func (c *Client) RemoveBackend(ctx context.Context, pool, addr string) error {
+	return c.do(ctx, http.MethodDelete, poolPath(pool, "/backends"), addrQuery(addr), nil, nil)
+}
+
+// DrainBackend stops sending new requests to the backend at addr of a pool.
+// With sticky, clients pinned to it keep using it.
+func (c *Client) DrainBackend(ctx context.Context, pool, addr string, sticky bool) (*Backend, error) {
+	query := addrQuery(addr)
+	query.Set("sticky", strconv.FormatBool(sticky))
+	return c.backendAction(ctx, pool, "drain", query)
+}
+
+// UndrainBackend returns a drained backend to service.
+func (c *Client) UndrainBackend(ctx context.Context, pool, addr string) (*Backend, error) {
+	return c.backendAction(ctx, pool, "undrain", addrQuery(addr))
+}
+
+// DisableBackend takes a backend out of service, including for pinned clients.
+func (c *Client) DisableBackend(ctx context.Context, pool, addr string) (*Backend, error) {
+	return c.backendAction(ctx, pool, "disable", addrQuery(addr))
+}
+
+// EnableBackend returns a disabled backend to service.
+func (c *Client) EnableBackend(ctx context.Context, pool, addr string) (*Backend, error) {
+	return c.backendAction(ctx, pool, "enable", addrQuery(addr))
+}
+
+// Register registers a backend with a pool, or renews its registration.
+func (c *Client) Register(ctx context.Context, pool string, reg Registration) (*RegistrationResult, error) {
+	var out RegistrationResult
+	err := c.do(ctx, http.MethodPost, poolPath(pool, "/registrations"), nil, reg, &out)
+	return &out, err
+}
+
+// Deregister removes the registration of the backend at addr.
+func (c *Client) Deregister(ctx context.Context, pool, addr string) error {
+	return c.do(ctx, http.MethodDelete, poolPath(pool, "/registrations"), addrQuery(addr), nil, nil)
+}
+
+// GetMaintenance returns the maintenance switches.
+func (c *Client) GetMaintenance(ctx context.Context) (*Maintenance, error) {
+	var out Maintenance
+	err := c.do(ctx, http.MethodGet, "/maintenance", nil, nil, &out)
+	return &out, err
+}
+
+// EnableMaintenance turns the global maintenance switch on, restricted to
+// routes if any are given.
+func (c *Client) EnableMaintenance(ctx context.Context, routes ...string) (*Maintenance, error) {
+	var out Maintenance
+	err := c.do(ctx, http.MethodPost, "/maintenance/enable", url.Values{"route": routes}, nil, &out)
+	return &out, err
+}
+
+// DisableMaintenance turns the global maintenance switch off.
+func (c *Client) DisableMaintenance(ctx context.Context) (*Maintenance, error) {
+	var out Maintenance
+	err := c.do(ctx, http.MethodPost, "/maintenance/disable", nil, nil, &out)
+	return &out, err
+}
+
+// EnablePoolMaintenance puts a pool in maintenance.
+func (c *Client) EnablePoolMaintenance(ctx context.Context, pool string) (*Pool, error) {
+	var out Pool
+	err := c.do(ctx, http.MethodPost, poolPath(pool, "/maintenance/enable"), nil, nil, &out)
+	return &out, err
+}
+
+// DisablePoolMaintenance takes a pool out of maintenance.
+func (c *Client) DisablePoolMaintenance(ctx context.Context, pool string) (*Pool, error) {
+	var out Pool
+	err := c.do(ctx, http.MethodPost, poolPath(pool, "/maintenance/disable"), nil, nil, &out)
+	return &out, err
+}
+
+// GetLogging returns the log level and access log sampling.
+func (c *Client) GetLogging(ctx context.Context) (*Logging, error) {
+	var out Logging
+	err := c.do(ctx, http.MethodGet, "/logging", nil, nil, &out)
+	return &out, err
+}
+
+// ModifyLogging changes the log level or access log sampling.
+func (c *Client) ModifyLogging(ctx context.Context, change LoggingChange) (*Logging, error) {
+	var out Logging
+	err := c.do(ctx, http.MethodPatch, "/logging", nil, change, &out)
+	return &out, err
+}
+
+// GetState returns a snapshot of the runtime state, in the format of the
+// state file.
+func (c *Client) GetState(ctx context.Context) (json.RawMessage, error) {
+	var out json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/state", nil, nil, &out)
+	return out, err
+}
+
+// SaveState writes the runtime state to the state file.
+func (c *Client) SaveState(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/state/save", nil, nil, nil)
+}
+
+// ListBans lists the clients banned by abuse detection.
+func (c *Client) ListBans(ctx context.Context) ([]Ban, error) {
+	var out []Ban
+	err := c.do(ctx, http.MethodGet, "/bans", nil, nil, &out)
+	return out, err
+}
+
+// Ban bans a client.
+func (c *Client) Ban(ctx context.Context, ban BanRequest) (*Ban, error) {
+	var out Ban
+	err := c.do(ctx, http.MethodPost, "/bans", nil, ban, &out)
+	return &out, err
+}
+
+// Unban lifts the ban of the client at ip and forgets its past bans.
+func (c *Client) Unban(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, "/bans/"+url.PathEscape(ip), nil, nil, nil)
+}
+
+// GetHA returns the HA role of the instance and what it knows of its peer.
+func (c *Client) GetHA(ctx context.Context) (*HAStatus, error) {
+	var out HAStatus
+	err := c.do(ctx, http.MethodGet, "/ha", nil, nil, &out)
+	return &out, err
+}
+
+// GetCluster returns the members of the cluster and the health of the
+// servers they share.
+func (c *Client) GetCluster(ctx context.Context) (*Cluster, error) {
+	var out Cluster
+	err := c.do(ctx, http.MethodGet, "/cluster", nil, nil, &out)
+	return &out, err
+}
+
+// GetFleet returns the leader of the fleet and the version of the
+// configuration the instance runs.
+func (c *Client) GetFleet(ctx context.Context) (*Fleet, error) {
+	var out Fleet
+	err := c.do(ctx, http.MethodGet, "/fleet", nil, nil, &out)
+	return &out, err
+}
+
+// Explain reports how the load balancer would serve req, without sending
+// it.
+func (c *Client) Explain(ctx context.Context, req ExplainRequest) (*Explanation, error) {
+	query := url.Values{}
+	for name, v := range map[string]string{"method": req.Method, "host": req.Host, "uri": req.URI, "client": req.Client} {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	if len(req.Headers) > 0 {
+		query["header"] = req.Headers
+	}
+	var out Explanation
+	err := c.do(ctx, http.MethodGet, "/explain", query, nil, &out)
+	return &out, err
+}
+
+// ListProbes returns what the probes found so far.
+func (c *Client) ListProbes(ctx context.Context) ([]ProbeResult, error) {
+	var out []ProbeResult
+	err := c.do(ctx, http.MethodGet, "/probes", nil, nil, &out)
+	return out, err
+}
+
+// ListFrontends lists the frontends of the service besides the main one.
+func (c *Client) ListFrontends(ctx context.Context) ([]Frontend, error) {
+	var out []Frontend
+	err := c.do(ctx, http.MethodGet, "/frontends", nil, nil, &out)
+	return out, err
+}
+
+// ListDatacenters lists the data centers of a pool routing by data center.
+func (c *Client) ListDatacenters(ctx context.Context, pool string) ([]Datacenter, error) {
+	var out []Datacenter
+	err := c.do(ctx, http.MethodGet, "/pools/"+url.PathEscape(pool)+"/datacenters", nil, nil, &out)
+	return out, err
+}
+
+// SetDatacenterWeight overrides the weight of a data center of a pool.
+func (c *Client) SetDatacenterWeight(ctx context.Context, pool, datacenter string, weight int) ([]Datacenter, error) {
+	var out []Datacenter
+	body := map[string]int{"weight": weight}
+	err := c.do(ctx, http.MethodPut, "/pools/"+url.PathEscape(pool)+"/datacenters/"+url.PathEscape(datacenter)+"/weight", nil, body, &out)
+	return out, err
+}
+
+// ResetDatacenterWeight removes the override of the weight of a data
+// center of a pool.
+func (c *Client) ResetDatacenterWeight(ctx context.Context, pool, datacenter string) ([]Datacenter, error) {
+	var out []Datacenter
+	err := c.do(ctx, http.MethodDelete, "/pools/"+url.PathEscape(pool)+"/datacenters/"+url.PathEscape(datacenter)+"/weight", nil, nil, &out)
+	return out, err
+}
+
+func (c *Client) backendAction(ctx context.Context, pool, action string, query url.Values) (*Backend, error) {
+	var out Backend
+	err := c.do(ctx, http.MethodPost, poolPath(pool, "/backends/"+action), query, nil, &out)
+	return &out, err
+}
+
+func poolPath(name, suffix string) string {
+	return "/pools/" + url.PathEscape(name) + suffix
+}
+
+func addrQuery(addr string) url.Values {
+	return url.Values{"addr": {addr}}
+}
+
+// do sends a request with body, if not nil, encoded as JSON, and decodes the
+// JSON response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// text sends a GET request and returns the plain text response.
+func (c *Client) text(ctx context.Context, path string) (string, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		u += sep + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &Error{StatusCode: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, e) != nil {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return nil, e
+	}
+	return resp, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/loadbalancer"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+// benchResult is what a load run through one strategy measured.
+type benchResult struct {
+	strategy  string
+	requests  int
+	errors    int
+	elapsed   time.Duration
+	latencies []time.Duration
+	// served counts the requests each mock backend answered.
+	served []int64
+}
+
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[min(int(float64(len(r.latencies))*p), len(r.latencies)-1)].Round(time.Microsecond)
+}
+
+// benchBackend is a mock backend answering every request with the same
+// body after a fixed latency.
+type benchBackend struct {
+	srv    *http.Server
+	url    string
+	served atomic.Int64
+}
+
+func startBenchBackend(latency time.Duration, body []byte) (*benchBackend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &benchBackend{url: "http://" + ln.Addr().String()}
+	b.srv = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		b.served.Add(1)
+		rw.Write(body)
+	})}
+	go b.srv.Serve(ln)
+	return b, nil
+}
+
+// runBench implements the bench command: it starts mock backends, puts a
+// load balancer in front of them and drives load through it with each
+// strategy in turn, reporting throughput and latency.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	strategies := fs.String("strategies", "round_robin,least_requests,weighted_round_robin", "comma-separated strategies to measure")
+	backends := fs.Int("backends", 4, "number of mock backends")
+	concurrency := fs.Int("concurrency", 64, "number of concurrent clients")
+	duration := fs.Duration("duration", 5*time.Second, "how long to drive load through each strategy")
+	latency := fs.Duration("latency", 0, "time mock backends take to answer")
+	skew := fs.Float64("skew", 0, "how much slower each backend is than the previous one, as a fraction of -latency")
+	size := fs.Int("size", 1024, "size of the response bodies in bytes")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags]\n\nMeasures the load balancer against mock backends.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *backends <= 0 || *concurrency <= 0 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "bench: -backends, -concurrency and -duration must be positive")
+		return 2
+	}
+
+	// Proxy errors of requests cut short at the end of a run are expected.
+	log.SetOutput(io.Discard)
+	body := bytes.Repeat([]byte("x"), *size)
+	mocks := make([]*benchBackend, *backends)
+	for i := range mocks {
+		b, err := startBenchBackend(*latency+time.Duration(float64(*latency)**skew*float64(i)), body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 1
+		}
+		defer b.srv.Close()
+		mocks[i] = b
+	}
+
+	var results []*benchResult
+	for _, name := range strings.Split(*strategies, ",") {
+		res, err := benchStrategy(strings.TrimSpace(name), mocks, *concurrency, *duration)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %s: %v\n", name, err)
+			return 1
+		}
+		results = append(results, res)
+	}
+
+	fmt.Printf("%d backends, %d clients, %s per strategy, %d-byte responses\n\n", *backends, *concurrency, *duration, *size)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "strategy\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\tspread\t")
+	for _, r := range results {
+		spread := "-"
+		if lo, hi := slices.Min(r.served), slices.Max(r.served); hi > 0 {
+			spread = fmt.Sprintf("%d-%d", lo, hi)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f\t%s\t%s\t%s\t%s\t%s\t\n", r.strategy, r.requests, r.errors,
+			float64(r.requests)/r.elapsed.Seconds(), r.percentile(0.5), r.percentile(0.9), r.percentile(0.99),
+			r.percentile(1), spread)
+	}
+	tw.Flush()
+	return 0
+}
+
+// benchStrategy drives load through a load balancer balancing the mock
+// backends with the named strategy.
+func benchStrategy(name string, mocks []*benchBackend, concurrency int, duration time.Duration) (*benchResult, error) {
+	strat, err := strategy.New(name)
+	if err != nil {
+		return nil, err
+	}
+	transport := loadbalancer.NewTransport(loadbalancer.TransportOptions{MaxIdleConnsPerHost: concurrency})
+	servers := make([]backend.Server, len(mocks))
+	for i, b := range mocks {
+		if servers[i], err = loadbalancer.NewSimpleServerWithTransport(b.url, transport); err != nil {
+			return nil, err
+		}
+	}
+	lb, err := loadbalancer.NewLoadBalancer(loadbalancer.WithServers(servers...), loadbalancer.WithStrategy(strat))
+	if err != nil {
+		return nil, err
+	}
+	lb.SetAccessLog(nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: lb}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	before := make([]int64, len(mocks))
+	for i, b := range mocks {
+		before[i] = b.served.Load()
+	}
+	client := &http.Client{Transport: loadbalancer.NewTransport(loadbalancer.TransportOptions{MaxIdleConnsPerHost: concurrency})}
+	defer client.CloseIdleConnections()
+	url := "http://" + ln.Addr().String() + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	res := &benchResult{strategy: name}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Go(func() {
+			var latencies []time.Duration
+			errs := 0
+			for ctx.Err() == nil {
+				t := time.Now()
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+				resp, err := client.Do(req)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if err == nil && resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("status %d", resp.StatusCode)
+					}
+				}
+				if ctx.Err() != nil {
+					// Requests cut short by the end of the run don't count.
+					break
+				}
+				if err != nil {
+					errs++
+					continue
+				}
+				latencies = append(latencies, time.Since(t))
+			}
+			mu.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			res.errors += errs
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	res.requests = len(res.latencies)
+	slices.Sort(res.latencies)
+	for i, b := range mocks {
+		res.served = append(res.served, b.served.Load()-before[i])
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+	"github.com/javvaji888/golang-load-balancer/pkg/loadbalancer"
+)
+
+// runExplain implements the explain command: it builds the load balancer of
+// a configuration file without starting it and reports how it would serve
+// a request, to check routing without sending any traffic.
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	configPath := fs.String("config", "", "configuration file to explain, the default one if empty")
+	method := fs.String("method", http.MethodGet, "method of the request")
+	host := fs.String("host", "", "Host of the request")
+	client := fs.String("client", "", "address of the client sending the request")
+	asJSON := fs.Bool("json", false, "print the explanation as JSON, as the admin API does")
+	frontend := fs.String("frontend", "", "name of the frontend receiving the request, the main one if empty")
+	header := http.Header{}
+	fs.Func("H", "header of the request, as \"Name: value\"; repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("want \"Name: value\"")
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explain [flags] [uri]\n\nReports the routes tried, the middleware, and the pools and servers that\nwould serve a request to uri, / by default, without sending it. Servers are\nnot health checked: all of them are taken as up.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "explain: at most one uri is allowed")
+		return 2
+	}
+
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "explain: %v\n", err)
+			return 1
+		}
+	}
+	svc, err := loadbalancer.NewService(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "explain: invalid config: %v\n", err)
+		return 1
+	}
+	r, err := loadbalancer.ExplainRequest(context.Background(), *method, *host, fs.Arg(0), header, *client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "explain: %v\n", err)
+		return 2
+	}
+	lb := svc.LoadBalancer()
+	if *frontend != "" {
+		if lb = svc.Frontend(*frontend); lb == nil {
+			fmt.Fprintf(os.Stderr, "explain: no frontend %q\n", *frontend)
+			return 1
+		}
+	}
+	ex := lb.Explain(r)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(ex)
+		return 0
+	}
+	printExplanation(ex)
+	return 0
+}
+
+// printExplanation prints ex for people to read.
+func printExplanation(ex *loadbalancer.Explanation) {
+	for _, rm := range ex.Routes {
+		if rm.Mismatch != "" {
+			fmt.Printf("route %s: no match on %s\n", rm.Name, rm.Mismatch)
+		} else {
+			fmt.Printf("route %s: matched\n", rm.Name)
+		}
+	}
+	if ex.Route == "" {
+		fmt.Println("no route matched: fallback")
+	}
+	if len(ex.Middleware) > 0 {
+		fmt.Printf("middleware: %s\n", strings.Join(ex.Middleware, ", "))
+	}
+	fmt.Printf("path: %s\n", ex.Path)
+	switch {
+	case ex.Redirect != "":
+		fmt.Printf("redirect: %d to %s\n", ex.Status, ex.Redirect)
+	case ex.Status != 0:
+		fmt.Printf("response: %d %s\n", ex.Status, http.StatusText(ex.Status))
+	}
+	if ex.Mirror != "" {
+		fmt.Printf("mirrored to pool %s\n", ex.Mirror)
+	}
+	for _, pc := range ex.Pools {
+		why := pc.Reason
+		switch {
+		case pc.Bucket != "":
+			why += ", bucket " + pc.Bucket
+		case pc.Weight != 0:
+			why += fmt.Sprintf(", weight %d", pc.Weight)
+		}
+		if len(pc.Datacenters) > 0 {
+			why += ", data centers " + strings.Join(pc.Datacenters, ", ")
+		}
+		fmt.Printf("pool %s (%s): ", pc.Name, why)
+		switch {
+		case pc.Maintenance:
+			fmt.Println("maintenance page")
+		case pc.Error != "":
+			fmt.Printf("error: %s\n", pc.Error)
+		case pc.Pinned:
+			fmt.Printf("server %s, pinned by %s affinity\n", pc.Server, pc.Affinity)
+		case pc.Server != "":
+			fmt.Printf("server %s\n", pc.Server)
+		case pc.Affinity != "":
+			fmt.Printf("one of %s, then pinned by %s affinity\n", strings.Join(pc.Servers, ", "), pc.Affinity)
+		default:
+			fmt.Printf("one of %s\n", strings.Join(pc.Servers, ", "))
+		}
+	}
+}
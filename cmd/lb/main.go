@@ -0,0 +1,156 @@
+// Command lb is the load balancer. It serves the configuration given by
+// -config, or a default one, until it receives SIGINT or SIGTERM; "lb bench"
+// measures its strategies against mock backends, "lb replay" sends the
+// requests it recorded again, and "lb explain" reports how it would route a
+// request.
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+	"github.com/javvaji888/golang-load-balancer/pkg/loadbalancer"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		os.Exit(runExplain(os.Args[2:]))
+	}
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	pidPath := flag.String("pidfile", "", "write the process ID to this file while serving")
+	logPath := flag.String("logfile", "", "append the log to this file, reopened on SIGHUP")
+	background := flag.Bool("daemon", false, "run in the background, detached from the terminal")
+	flag.Parse()
+
+	var pidFile *loadbalancer.PIDFile
+	if *pidPath != "" {
+		var err error
+		if pidFile, err = loadbalancer.CreatePIDFile(*pidPath); err != nil {
+			log.Fatalf("Failed to create pid file: %v", err)
+		}
+	}
+	if *background {
+		if parent, err := loadbalancer.Daemonize(*logPath); err != nil {
+			log.Fatalf("Failed to start in the background: %v", err)
+		} else if parent {
+			return
+		}
+	}
+	var logFile *loadbalancer.LogFile
+	if *logPath != "" {
+		var err error
+		if logFile, err = loadbalancer.OpenLogFile(*logPath); err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		loadbalancer.SetupLogging(logFile)
+	} else {
+		loadbalancer.SetupLogging(os.Stderr)
+	}
+
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+	svc, err := loadbalancer.NewService(cfg)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := svc.Start(); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	if pidFile != nil {
+		if err := pidFile.Write(); err != nil {
+			log.Fatalf("Failed to write pid file: %v", err)
+		}
+		defer pidFile.Remove()
+	}
+	loadbalancer.DefaultUpgrader.Ready()
+
+	// SIGUSR2 hands the sockets over to a new process running the current
+	// executable, then shuts this one down. SIGHUP reopens the log files
+	// after they were rotated and reloads the configuration file; without
+	// any it is ignored, so that a closing terminal does not stop the
+	// process.
+	upgrade := make(chan os.Signal, 1)
+	notifyUpgrade(upgrade)
+	hangup := make(chan os.Signal, 1)
+	notifyHangup(hangup)
+wait:
+	for {
+		select {
+		case <-hangup:
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					log.Printf("Failed to reopen log file: %v", err)
+				} else {
+					log.Printf("Reopened log file")
+				}
+			}
+			if err := svc.LoadBalancer().AccessLog().Reopen(); err != nil {
+				log.Printf("Failed to reopen access log: %v", err)
+			}
+			if err := svc.LoadBalancer().Recorder().Reopen(); err != nil {
+				log.Printf("Failed to reopen recording: %v", err)
+			}
+			if *configPath != "" {
+				reload(svc, *configPath)
+			}
+		case err := <-svc.Err():
+			log.Fatalf("Failed to start server: %v", err)
+		case <-upgrade:
+			// The new process restores the state this one leaves.
+			if err := svc.LoadBalancer().SaveState(); err != nil {
+				log.Printf("Failed to save runtime state: %v", err)
+			}
+			if err := loadbalancer.DefaultUpgrader.Upgrade(); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+				continue
+			}
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	// A second signal kills the process right away.
+	stop()
+
+	timeout := cmp.Or(time.Duration(cfg.ShutdownTimeout), loadbalancer.DefaultShutdownTimeout)
+	log.Printf("Shutting down, waiting up to %v for in-flight requests\n", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	log.Printf("Stopped")
+}
+
+// reload applies the configuration file at path to svc, keeping the
+// current configuration if it cannot.
+func reload(svc *loadbalancer.Service, path string) {
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = svc.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+	"github.com/javvaji888/golang-load-balancer/pkg/loadbalancer"
+)
+
+// maxReplayLine bounds a line of a recording: a request with its body.
+const maxReplayLine = 64 << 20
+
+// replayResult is what replaying a recording measured.
+type replayResult struct {
+	mu        sync.Mutex
+	requests  int
+	errors    int
+	statuses  map[int]int
+	latencies []time.Duration
+}
+
+func (r *replayResult) add(status int, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.statuses[status]++
+	r.latencies = append(r.latencies, latency)
+}
+
+func (r *replayResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[min(int(float64(len(r.latencies))*p), len(r.latencies)-1)].Round(time.Microsecond)
+}
+
+// runReplay implements the replay command: it sends the requests recorded
+// in files again, to a URL or to the servers of a pool in turn, at a chosen
+// rate, reporting the statuses and latencies they got.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "", "comma-separated base URLs to send the requests to, in turn")
+	configPath := fs.String("config", "", "configuration file defining -pool")
+	poolName := fs.String("pool", "", "pool of -config whose servers to send the requests to, in turn")
+	rate := fs.Float64("rate", 10, "requests sent per second; 0 sends them as fast as -concurrency allows")
+	concurrency := fs.Int("concurrency", 16, "most requests in flight at once")
+	host := fs.String("host", "", "Host header to send instead of the recorded one")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed for each request")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] file...\n\nSends the requests recorded by the load balancer again. Redacted headers are\nnot sent.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 || *rate < 0 || *concurrency <= 0 || (*target == "") == (*poolName == "") {
+		fmt.Fprintln(os.Stderr, "replay: one of -target or -pool, files, a non-negative -rate and a positive -concurrency are required")
+		return 2
+	}
+	targets, err := replayTargets(*target, *configPath, *poolName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := &http.Client{
+		Timeout:       *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	var tick <-chan time.Time
+	if *rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	res := &replayResult{statuses: map[int]int{}}
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	sent := 0
+files:
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, maxReplayLine)
+		for sc.Scan() {
+			var rr loadbalancer.RecordedRequest
+			if err := json.Unmarshal(sc.Bytes(), &rr); err != nil {
+				f.Close()
+				fmt.Fprintf(os.Stderr, "replay: %s: %v\n", path, err)
+				return 1
+			}
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					break files
+				}
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break files
+			}
+			base := targets[sent%len(targets)]
+			sent++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				status, latency, err := replay(ctx, client, base, *host, &rr)
+				res.add(status, latency, err)
+			}()
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %s: %v\n", path, err)
+			return 1
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	slices.Sort(res.latencies)
+	fmt.Printf("%d requests to %s in %s, %.1f req/s, %d errors\n", res.requests,
+		strings.Join(targets, ", "), elapsed.Round(time.Millisecond), float64(res.requests)/elapsed.Seconds(), res.errors)
+	fmt.Printf("latency p50 %s, p90 %s, p99 %s, max %s\n\n", res.percentile(0.5), res.percentile(0.9), res.percentile(0.99), res.percentile(1))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "status\trequests\t")
+	for _, code := range slices.Sorted(maps.Keys(res.statuses)) {
+		fmt.Fprintf(tw, "%d\t%d\t\n", code, res.statuses[code])
+	}
+	tw.Flush()
+	return 0
+}
+
+// replayTargets returns the base URLs to send requests to: those of target,
+// or the addresses of the servers of the pool named pool in the
+// configuration file at configPath.
+func replayTargets(target, configPath, pool string) ([]string, error) {
+	if target != "" {
+		return strings.Split(target, ","), nil
+	}
+	if configPath == "" {
+		return nil, fmt.Errorf("-pool requires -config")
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, pc := range cfg.Pools {
+		if pc.Name != pool {
+			continue
+		}
+		var targets []string
+		for _, sc := range pc.Servers {
+			targets = append(targets, sc.Addr)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("pool %q has no servers in the configuration", pool)
+		}
+		return targets, nil
+	}
+	return nil, fmt.Errorf("pool %q not found", pool)
+}
+
+// replay sends rr to base, returning the status and latency of the
+// response.
+func replay(ctx context.Context, client *http.Client, base, host string, rr *loadbalancer.RecordedRequest) (int, time.Duration, error) {
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	var body io.Reader = http.NoBody
+	if len(rr.Body) > 0 {
+		body = bytes.NewReader(rr.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, rr.Method, strings.TrimSuffix(base, "/")+rr.URI, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range rr.Header {
+		for _, v := range values {
+			if v != loadbalancer.Redacted {
+				req.Header.Add(name, v)
+			}
+		}
+	}
+	// The recorded body may be truncated: the transport sets the length of
+	// the one sent.
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.Host = rr.Host
+	if host != "" {
+		req.Host = host
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
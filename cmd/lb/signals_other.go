@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyUpgrade relays nothing to c: there is no SIGUSR2 to upgrade on.
+func notifyUpgrade(c chan<- os.Signal) {}
+
+// notifyHangup relays nothing to c: there is no SIGHUP to reopen the logs
+// and reload on.
+func notifyHangup(c chan<- os.Signal) {}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade relays SIGUSR2 to c.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// notifyHangup relays SIGHUP to c.
+func notifyHangup(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
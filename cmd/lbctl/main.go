@@ -0,0 +1,526 @@
+// Command lbctl operates a running load balancer through its admin API.
+//
+// Usage:
+//
+//	lbctl [-addr URL] [-token TOKEN] [-cert FILE -key FILE] [-cacert FILE] [-frontend NAME] <command> [arguments]
+//
+// The commands are:
+//
+//	status                        summarize the pools and their backends
+//	backends list [pool]          list the backends of all pools or one pool
+//	backends add <pool> <addr>    add a backend to a pool
+//	backends remove <addr>        remove a backend
+//	drain [-sticky] <addr>        stop sending new requests to a backend
+//	undrain <addr>                return a drained backend to service
+//	disable <addr>                take a backend out of service
+//	enable <addr>                 return a disabled backend to service
+//	weight [-ramp D] <addr> <w>   set the weight of a backend, gradually over D
+//	maintenance [on|off] [route]  show or switch maintenance mode
+//	bans                          list the clients banned by abuse detection
+//	ban <ip> [duration]           ban a client
+//	unban <ip>                    lift the ban of a client
+//	logging [-level L] [-sample F]
+//	                              show or change the log level and the
+//	                              fraction of requests in the access log
+//
+// Backends are named by address; -pool selects the pool if several pools
+// have a backend with that address. With -pool, maintenance switches the
+// maintenance mode of that pool; otherwise the global one, restricted to the
+// given routes if any. With -frontend, the commands operate the frontend
+// of that name instead of the main one. The admin API address and token
+// default to $LBCTL_ADDR and $LBCTL_TOKEN.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type backend struct {
+	Addr     string `json:"addr"`
+	Alive    bool   `json:"alive"`
+	Weight   int    `json:"weight"`
+	Tier     int    `json:"tier"`
+	Draining bool   `json:"draining"`
+	Disabled bool   `json:"disabled"`
+	InFlight int64  `json:"in_flight"`
+}
+
+type pool struct {
+	Name        string    `json:"name"`
+	Protocol    string    `json:"protocol"`
+	Maintenance bool      `json:"maintenance"`
+	Backends    []backend `json:"backends"`
+}
+
+type logging struct {
+	Level           string  `json:"level"`
+	AccessLogSample float64 `json:"access_log_sample"`
+}
+
+type ban struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason"`
+	Offenses int       `json:"offenses"`
+}
+
+type maintenance struct {
+	Enabled bool     `json:"enabled"`
+	Routes  []string `json:"routes"`
+	Pools   []string `json:"pools"`
+}
+
+// client calls the admin API.
+type client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func (c *client) do(method, path string, query url.Values, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := strings.TrimSuffix(c.addr, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *client) pools() ([]pool, error) {
+	var pools []pool
+	err := c.do(http.MethodGet, "/pools", nil, nil, &pools)
+	return pools, err
+}
+
+// poolOf returns the pool that has a backend at addr, or name if set.
+func (c *client) poolOf(name, addr string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	pools, err := c.pools()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, p := range pools {
+		for _, b := range p.Backends {
+			if b.Addr == addr {
+				found = append(found, p.Name)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no backend %q", addr)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("backend %q is in pools %s; select one with -pool", addr, strings.Join(found, ", "))
+}
+
+// backendAction posts to the backend action endpoint of the backend at addr.
+func (c *client) backendAction(poolName, addr, action string, query url.Values) error {
+	name, err := c.poolOf(poolName, addr)
+	if err != nil {
+		return err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("addr", addr)
+	var b backend
+	if err := c.do(http.MethodPost, "/pools/"+url.PathEscape(name)+"/backends/"+action, query, nil, &b); err != nil {
+		return err
+	}
+	printBackends(name, []backend{b})
+	return nil
+}
+
+func state(b backend) string {
+	switch {
+	case b.Disabled:
+		return "disabled"
+	case b.Draining && b.InFlight == 0:
+		return "drained"
+	case b.Draining:
+		return "draining"
+	case b.Alive:
+		return "up"
+	}
+	return "down"
+}
+
+func printBackends(poolName string, backends []backend) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tADDR\tSTATE\tWEIGHT\tTIER\tIN FLIGHT")
+	for _, b := range backends {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", poolName, b.Addr, state(b), b.Weight, b.Tier, b.InFlight)
+	}
+	tw.Flush()
+}
+
+func printBans(bans []ban) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tREASON\tOFFENSES\tUNTIL")
+	for _, b := range bans {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", b.IP, b.Reason, b.Offenses, b.Until.Local().Format(time.DateTime))
+	}
+	tw.Flush()
+}
+
+func main() {
+	addr := flag.String("addr", envOr("LBCTL_ADDR", "http://127.0.0.1:8081"), "admin API `URL`")
+	token := flag.String("token", os.Getenv("LBCTL_TOKEN"), "admin API bearer `token`")
+	poolName := flag.String("pool", "", "pool of the backend")
+	certFile := flag.String("cert", os.Getenv("LBCTL_CERT"), "client certificate `file`")
+	keyFile := flag.String("key", os.Getenv("LBCTL_KEY"), "client key `file`")
+	caFile := flag.String("cacert", os.Getenv("LBCTL_CACERT"), "CA certificate `file` of the admin API server")
+	frontend := flag.String("frontend", "", "`name` of the frontend to operate instead of the main one")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: lbctl [flags] status | backends list [pool] | backends add <pool> <addr> | backends remove <addr> |")
+		fmt.Fprintln(os.Stderr, "             drain [-sticky] <addr> | undrain <addr> | disable <addr> | enable <addr> | weight [-ramp D] <addr> <weight> |")
+		fmt.Fprintln(os.Stderr, "             maintenance [on|off] [route...] | logging [-level L] [-sample F] | bans | ban <ip> [duration] | unban <ip>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	transport, err := newTransport(*certFile, *keyFile, *caFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lbctl:", err)
+		os.Exit(1)
+	}
+	c := &client{addr: *addr, token: *token, http: &http.Client{Timeout: 30 * time.Second, Transport: transport}}
+	if *frontend != "" {
+		c.addr = strings.TrimSuffix(c.addr, "/") + "/frontends/" + url.PathEscape(*frontend)
+	}
+	if err := run(c, *poolName, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "lbctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client, poolName string, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	need := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s: expected %d arguments", cmd, n)
+		}
+		return nil
+	}
+	switch cmd {
+	case "status":
+		pools, err := c.pools()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "POOL\tUP\tDOWN\tDRAINING\tDISABLED\tIN FLIGHT")
+		for _, p := range pools {
+			var up, down, draining, disabled int
+			var n int64
+			for _, b := range p.Backends {
+				switch state(b) {
+				case "up":
+					up++
+				case "down":
+					down++
+				case "draining", "drained":
+					draining++
+				case "disabled":
+					disabled++
+				}
+				n += b.InFlight
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", p.Name, up, down, draining, disabled, n)
+		}
+		return tw.Flush()
+	case "backends":
+		if len(args) == 0 {
+			return fmt.Errorf("backends: expected list, add or remove")
+		}
+		sub, args := args[0], args[1:]
+		switch sub {
+		case "list":
+			pools, err := c.pools()
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "POOL\tADDR\tSTATE\tWEIGHT\tTIER\tIN FLIGHT")
+			for _, p := range pools {
+				if len(args) > 0 && p.Name != args[0] {
+					continue
+				}
+				for _, b := range p.Backends {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", p.Name, b.Addr, state(b), b.Weight, b.Tier, b.InFlight)
+				}
+			}
+			return tw.Flush()
+		case "add":
+			if len(args) != 2 {
+				return fmt.Errorf("backends add: expected <pool> <addr>")
+			}
+			var b backend
+			if err := c.do(http.MethodPost, "/pools/"+url.PathEscape(args[0])+"/backends", nil, map[string]string{"addr": args[1]}, &b); err != nil {
+				return err
+			}
+			printBackends(args[0], []backend{b})
+			return nil
+		case "remove":
+			if len(args) != 1 {
+				return fmt.Errorf("backends remove: expected <addr>")
+			}
+			name, err := c.poolOf(poolName, args[0])
+			if err != nil {
+				return err
+			}
+			return c.do(http.MethodDelete, "/pools/"+url.PathEscape(name)+"/backends", url.Values{"addr": {args[0]}}, nil, nil)
+		}
+		return fmt.Errorf("backends: unknown command %q", sub)
+	case "drain":
+		fs := flag.NewFlagSet("drain", flag.ExitOnError)
+		sticky := fs.Bool("sticky", false, "let clients pinned to the backend keep using it")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("drain: expected <addr>")
+		}
+		return c.backendAction(poolName, fs.Arg(0), "drain", url.Values{"sticky": {strconv.FormatBool(*sticky)}})
+	case "undrain", "disable", "enable":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.backendAction(poolName, args[0], cmd, nil)
+	case "weight":
+		fs := flag.NewFlagSet("weight", flag.ExitOnError)
+		ramp := fs.Duration("ramp", 0, "move the weight there gradually over this `duration`")
+		fs.Parse(args)
+		if fs.NArg() != 2 {
+			return fmt.Errorf("weight: expected <addr> <weight>")
+		}
+		weight, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("weight: invalid weight %q", fs.Arg(1))
+		}
+		name, err := c.poolOf(poolName, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		body := map[string]any{"weight": weight}
+		if *ramp > 0 {
+			body["ramp"] = ramp.String()
+		}
+		var b backend
+		if err := c.do(http.MethodPatch, "/pools/"+url.PathEscape(name)+"/backends", url.Values{"addr": {fs.Arg(0)}}, body, &b); err != nil {
+			return err
+		}
+		printBackends(name, []backend{b})
+		return nil
+	case "maintenance":
+		return c.maintenance(poolName, args)
+	case "bans":
+		var bans []ban
+		if err := c.do(http.MethodGet, "/bans", nil, nil, &bans); err != nil {
+			return err
+		}
+		printBans(bans)
+		return nil
+	case "ban":
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("ban: expected <ip> [duration]")
+		}
+		body := map[string]any{"ip": args[0]}
+		if len(args) == 2 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil {
+				return fmt.Errorf("ban: invalid duration %q", args[1])
+			}
+			body["duration"] = d.String()
+		}
+		var b ban
+		if err := c.do(http.MethodPost, "/bans", nil, body, &b); err != nil {
+			return err
+		}
+		printBans([]ban{b})
+		return nil
+	case "unban":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.do(http.MethodDelete, "/bans/"+url.PathEscape(args[0]), nil, nil, nil)
+	case "logging":
+		fs := flag.NewFlagSet("logging", flag.ExitOnError)
+		level := fs.String("level", "", "log level: debug, info, warn or error")
+		sample := fs.Float64("sample", -1, "fraction of requests written to the access log, from 0 to 1")
+		fs.Parse(args)
+		body := map[string]any{}
+		if *level != "" {
+			body["level"] = *level
+		}
+		if *sample >= 0 {
+			body["access_log_sample"] = *sample
+		}
+		var l logging
+		var err error
+		if len(body) == 0 {
+			err = c.do(http.MethodGet, "/logging", nil, nil, &l)
+		} else {
+			err = c.do(http.MethodPatch, "/logging", nil, body, &l)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("log level %s, access log sample %v\n", l.Level, l.AccessLogSample)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// maintenance shows or switches the maintenance mode of the load balancer,
+// or of a pool if poolName is set.
+func (c *client) maintenance(poolName string, args []string) error {
+	var action string
+	if len(args) > 0 {
+		switch args[0] {
+		case "on":
+			action = "enable"
+		case "off":
+			action = "disable"
+		default:
+			return fmt.Errorf("maintenance: expected on or off")
+		}
+		args = args[1:]
+	}
+	if poolName != "" {
+		if len(args) > 0 {
+			return fmt.Errorf("maintenance: routes cannot be given with -pool")
+		}
+		var p pool
+		var err error
+		if action == "" {
+			err = c.do(http.MethodGet, "/pools/"+url.PathEscape(poolName), nil, nil, &p)
+		} else {
+			err = c.do(http.MethodPost, "/pools/"+url.PathEscape(poolName)+"/maintenance/"+action, nil, nil, &p)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pool %s: maintenance %s\n", p.Name, onOff(p.Maintenance))
+		return nil
+	}
+	var m maintenance
+	var err error
+	switch {
+	case action == "disable" && len(args) > 0:
+		return fmt.Errorf("maintenance: routes require on")
+	case action == "":
+		err = c.do(http.MethodGet, "/maintenance", nil, nil, &m)
+	default:
+		err = c.do(http.MethodPost, "/maintenance/"+action, url.Values{"route": args}, nil, &m)
+	}
+	if err != nil {
+		return err
+	}
+	routes := "all routes"
+	if len(m.Routes) > 0 {
+		routes = "routes " + strings.Join(m.Routes, ", ")
+	}
+	fmt.Printf("maintenance %s (%s)\n", onOff(m.Enabled), routes)
+	if len(m.Pools) > 0 {
+		fmt.Printf("pools in maintenance: %s\n", strings.Join(m.Pools, ", "))
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// newTransport returns the transport to the admin API, presenting the client
+// certificate and trusting the CA if given.
+func newTransport(certFile, keyFile, caFile string) (http.RoundTripper, error) {
+	if certFile == "" && caFile == "" {
+		return http.DefaultTransport, nil
+	}
+	tlsConfig := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,16 @@
+module github.com/javvaji888/golang-load-balancer
+
+go 1.26.0
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/quic-go/quic-go v0.63.0
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
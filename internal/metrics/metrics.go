@@ -0,0 +1,170 @@
+// Package metrics implements the Prometheus metrics of the load balancer,
+// which the admin listener exports at /metrics. Its API is not covered by
+// the compatibility promise of the module.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the package-level functions register with.
+var Default = &Registry{}
+
+// NewCounterVec registers a counter family with Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewGaugeVec registers a gauge family with Default.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// WriteTo writes the metric families of Default.
+func WriteTo(w io.Writer) (int64, error) {
+	return Default.WriteTo(w)
+}
+
+// Registry holds metric families and renders them in the Prometheus text format.
+type Registry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       atomic.Int64
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) *metricFamily {
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (f *metricFamily) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", f.name, len(labelValues), len(f.labels)))
+	}
+	// The key of existing series is built on the stack, for metrics
+	// updated on every request not to allocate.
+	var buf [128]byte
+	key := buf[:0]
+	for i, v := range labelValues {
+		if i > 0 {
+			key = append(key, '\xff')
+		}
+		key = append(key, v...)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[string(key)]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		f.series[string(key)] = s
+	}
+	return s
+}
+
+// CounterVec is a monotonically increasing metric partitioned by label values.
+type CounterVec struct {
+	family *metricFamily
+}
+
+// NewCounterVec registers a counter family.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, "counter", labels)}
+}
+
+// Inc increments the counter for the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.family.get(labelValues).value.Add(1)
+}
+
+// Add increases the counter for the given label values by n.
+func (c *CounterVec) Add(n int64, labelValues ...string) {
+	c.family.get(labelValues).value.Add(n)
+}
+
+// GaugeVec is a metric that can go up and down, partitioned by label values.
+type GaugeVec struct {
+	family *metricFamily
+}
+
+// NewGaugeVec registers a gauge family.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(name, help, "gauge", labels)}
+}
+
+// Inc increments the gauge for the given label values.
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.family.get(labelValues).value.Add(1)
+}
+
+// Dec decrements the gauge for the given label values.
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.family.get(labelValues).value.Add(-1)
+}
+
+// Add adds n, which may be negative, to the gauge for the given label values.
+func (g *GaugeVec) Add(n int64, labelValues ...string) {
+	g.family.get(labelValues).value.Add(n)
+}
+
+// Set sets the gauge for the given label values to v.
+func (g *GaugeVec) Set(v int64, labelValues ...string) {
+	g.family.get(labelValues).value.Store(v)
+}
+
+// WriteTo writes every metric family in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			b.WriteString(f.name)
+			if len(f.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range f.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=%q", l, s.labelValues[i])
+				}
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(&b, " %d\n", s.value.Load())
+		}
+		f.mu.Unlock()
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
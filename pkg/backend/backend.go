@@ -0,0 +1,114 @@
+// Package backend defines the servers a load balancer sends requests to:
+// the Server interface every backend implements, with its weight and
+// traffic counters, the optional interfaces of those carrying a tier or
+// that can be drained and disabled, and helpers reading them from any
+// Server.
+package backend
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Server defines the behavior of proxy servers. Embedding Weighting and
+// Counters provides Weight, ActiveConnections and Stats.
+type Server interface {
+	Address() string
+	IsAlive() bool
+	SetAlive(alive bool)
+	Serve(rw http.ResponseWriter, r *http.Request)
+	// Weight returns the balancing weight of the server. Weight-aware
+	// strategies send each server a share of traffic proportional to it.
+	Weight() int
+	// ActiveConnections returns the requests, or connections of layer-4
+	// servers, the server is handling.
+	ActiveConnections() int64
+	// Stats returns a snapshot of the traffic the server handled.
+	Stats() Stats
+}
+
+// Weighted is implemented by servers that carry a tier besides their
+// weight. Pools only use the lowest tier with a live server, so higher
+// tiers act as standbys.
+type Weighted interface {
+	Weight() int
+	Tier() int
+}
+
+// WeightSetter is implemented by servers whose weight and tier can be set.
+type WeightSetter interface {
+	SetWeight(weight int)
+	SetTier(tier int)
+	RampWeight(weight int, over time.Duration)
+}
+
+// Disableable is implemented by servers that can be disabled.
+type Disableable interface {
+	Disabled() bool
+	SetDisabled(disabled bool)
+}
+
+// Drainable is implemented by servers that can be drained.
+type Drainable interface {
+	Draining() bool
+	DrainSticky() bool
+	Drain(sticky bool)
+	Undrain()
+}
+
+// Available reports whether s may receive new requests.
+func Available(s Server) bool {
+	if d, ok := s.(Disableable); ok && d.Disabled() {
+		return false
+	}
+	if d, ok := s.(Drainable); ok && d.Draining() {
+		return false
+	}
+	return s.IsAlive()
+}
+
+// AvailableSticky reports whether s may receive requests of clients pinned
+// to it.
+func AvailableSticky(s Server) bool {
+	if d, ok := s.(Disableable); ok && d.Disabled() {
+		return false
+	}
+	if d, ok := s.(Drainable); ok && d.Draining() && !d.DrainSticky() {
+		return false
+	}
+	return s.IsAlive()
+}
+
+// TierOf returns the tier of s, 0 for servers without one.
+func TierOf(s Server) int {
+	if w, ok := s.(Weighted); ok {
+		return w.Tier()
+	}
+	return 0
+}
+
+// Tiers groups servers by tier, lowest first. It returns nil if all servers
+// are in the same tier.
+func Tiers(servers []Server) [][]Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	first := TierOf(servers[0])
+	if !slices.ContainsFunc(servers, func(s Server) bool { return TierOf(s) != first }) {
+		return nil
+	}
+	sorted := slices.Clone(servers)
+	slices.SortStableFunc(sorted, func(a, b Server) int { return cmp.Compare(TierOf(a), TierOf(b)) })
+	var groups [][]Server
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && TierOf(sorted[j]) == TierOf(sorted[i]) {
+			j++
+		}
+		groups = append(groups, sorted[i:j:j])
+		i = j
+	}
+	return groups
+}
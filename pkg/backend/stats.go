@@ -0,0 +1,50 @@
+package backend
+
+import "sync/atomic"
+
+// Stats is a snapshot of the traffic a server handled since it was created.
+type Stats struct {
+	// Active counts the requests, or connections and flows of layer-4
+	// servers, the server is handling.
+	Active int64
+	// Total counts those it was sent, including the active ones.
+	Total int64
+	// Failures counts those that failed: proxy errors and 5xx responses of
+	// HTTP servers, and failed dials of layer-4 ones.
+	Failures int64
+}
+
+// Counters counts the traffic of a server. Embedders call Start and Done
+// around every request or connection, and Fail when one fails.
+type Counters struct {
+	active   atomic.Int64
+	total    atomic.Int64
+	failures atomic.Int64
+}
+
+// Start counts a request or connection the server starts handling.
+func (c *Counters) Start() {
+	c.active.Add(1)
+	c.total.Add(1)
+}
+
+// Done counts the end of a request or connection counted by Start.
+func (c *Counters) Done() {
+	c.active.Add(-1)
+}
+
+// Fail counts a failed request or connection.
+func (c *Counters) Fail() {
+	c.failures.Add(1)
+}
+
+// ActiveConnections returns the requests or connections the server is
+// handling.
+func (c *Counters) ActiveConnections() int64 {
+	return c.active.Load()
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Counters) Stats() Stats {
+	return Stats{Active: c.active.Load(), Total: c.total.Load(), Failures: c.failures.Load()}
+}
@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rampInterval is how often a weight ramp adjusts the weight.
+const rampInterval = time.Second
+
+// Weighting holds the weight and tier of a server. Embedders must set the
+// weight, which defaults to 1.
+type Weighting struct {
+	weight atomic.Int64
+	tier   atomic.Int64
+
+	rampMu   sync.Mutex
+	stopRamp chan struct{}
+}
+
+// Weight returns the server's balancing weight.
+func (w *Weighting) Weight() int {
+	return int(w.weight.Load())
+}
+
+// SetWeight sets the server's balancing weight.
+func (w *Weighting) SetWeight(weight int) {
+	w.weight.Store(int64(weight))
+}
+
+// RampWeight moves the server's weight linearly to weight over the given
+// duration, so that traffic shifts gradually. It returns immediately and
+// replaces any ramp in progress; a zero duration sets the weight at once.
+func (w *Weighting) RampWeight(weight int, over time.Duration) {
+	w.rampMu.Lock()
+	defer w.rampMu.Unlock()
+	if w.stopRamp != nil {
+		close(w.stopRamp)
+		w.stopRamp = nil
+	}
+	from := w.Weight()
+	if over <= 0 || from == weight {
+		w.SetWeight(weight)
+		return
+	}
+	stop := make(chan struct{})
+	w.stopRamp = stop
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(rampInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			elapsed := time.Since(start)
+			if elapsed >= over {
+				break
+			}
+			w.SetWeight(from + int(math.Round(float64(weight-from)*float64(elapsed)/float64(over))))
+		}
+		w.rampMu.Lock()
+		defer w.rampMu.Unlock()
+		if w.stopRamp == stop {
+			w.SetWeight(weight)
+			w.stopRamp = nil
+		}
+	}()
+}
+
+// Tier returns the server's tier; lower tiers are preferred.
+func (w *Weighting) Tier() int {
+	return int(w.tier.Load())
+}
+
+// SetTier sets the server's tier.
+func (w *Weighting) SetTier(tier int) {
+	w.tier.Store(int64(tier))
+}
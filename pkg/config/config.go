@@ -0,0 +1,1394 @@
+// Package config describes the configuration file of the load balancer,
+// a JSON document whose fields are documented on the types below.
+// loadbalancer.Build builds a load balancer from it; the types the fields
+// are described in terms of, such as SocketOptions, are those of package
+// loadbalancer.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the JSON configuration of the load balancer.
+type Config struct {
+	Port     string          `json:"port"`
+	Pools    []PoolConfig    `json:"pools"`
+	Routes   []RouteConfig   `json:"routes"`
+	Fallback *FallbackConfig `json:"fallback"`
+	Admin    *AdminConfig    `json:"admin"`
+	GeoIP    *GeoIPConfig    `json:"geoip"`
+
+	Maintenance *MaintenanceConfig `json:"maintenance"`
+
+	// LogLevel is the minimum level of the messages logged: debug, info
+	// (the default), warn or error.
+	LogLevel  string           `json:"log_level"`
+	AccessLog *AccessLogConfig `json:"access_log"`
+	// Record records a sample of the requests forwarded, for "lb replay"
+	// to send them again.
+	Record *RecordConfig `json:"record"`
+	// Tags attach tags to requests, by route, header, API key or
+	// experiment bucket, which label the lb_tagged_* metrics and are
+	// fields of the access log.
+	Tags *TagsConfig `json:"tags"`
+	// AnonymizeIPs truncates or hashes the client addresses in the access
+	// log and other logs.
+	AnonymizeIPs *AnonymizeIPsConfig `json:"anonymize_ips"`
+	// Probes send synthetic requests through the listener periodically,
+	// recording whether the whole path to the backends serves them.
+	Probes []ProbeConfig `json:"probes"`
+
+	// StateFile keeps the changes made at runtime, such as servers added
+	// or drained through the admin API, across restarts, those made to the
+	// other frontends included.
+	StateFile string `json:"state_file"`
+	// HA pairs the instance with another in active-passive mode, the
+	// standby taking over when the active fails.
+	HA *HAConfig `json:"ha"`
+	// Cluster shares the health of servers between the replicas of the
+	// load balancer by gossip.
+	Cluster *ClusterConfig `json:"cluster"`
+	// Fleet runs the configuration of the leader the instances of a fleet
+	// elect, so that they are managed as one.
+	Fleet *FleetConfig `json:"fleet"`
+
+	// Compression compresses the responses of every route; a route's own
+	// compression takes precedence.
+	Compression *CompressionConfig `json:"compression"`
+
+	// CORS is the CORS policy of the routes without one of their own.
+	CORS *CORSConfig `json:"cors"`
+
+	// IPFilter refuses requests to the frontend listener from denied
+	// clients; routes, TCP and UDP proxies may have their own.
+	IPFilter *IPFilterConfig `json:"ip_filter"`
+
+	// Transport tunes the connections to the servers of the pools without
+	// a transport of their own, which share it.
+	Transport *TransportConfig `json:"transport"`
+
+	// WAF blocks or logs requests matching the rules of a rule file before
+	// they are routed.
+	WAF *WAFConfig `json:"waf"`
+
+	// Bots blocks, limits or routes apart known bad bots and scrapers
+	// before requests are routed.
+	Bots *BotsConfig `json:"bots"`
+
+	// TLSFingerprints allows, denies or limits the rate of clients by the
+	// JA3 and JA4 fingerprints of their TLS handshakes.
+	TLSFingerprints *TLSFingerprintsConfig `json:"tls_fingerprints"`
+
+	// GeoBlock blocks or challenges the clients of some countries or
+	// autonomous systems.
+	GeoBlock *GeoBlockConfig `json:"geo_block"`
+
+	// Abuse temporarily bans clients sending requests too fast or whose
+	// requests mostly fail.
+	Abuse *AbuseConfig `json:"abuse"`
+
+	// Bandwidth limits the bytes per second each client downloads and
+	// uploads; routes may have their own, which applies as well.
+	Bandwidth *BandwidthConfig `json:"bandwidth"`
+
+	// Plugins transform every request and response, in order, before they
+	// are routed; routes may have their own.
+	Plugins []PluginConfig `json:"plugins"`
+
+	// Middleware names middleware for routes to list in their own
+	// middleware, each route building its own.
+	Middleware map[string]MiddlewareConfig `json:"middleware"`
+
+	// Extensions are the paths of Go plugins loaded before the rest of the
+	// configuration is built, which register strategies, health checkers,
+	// discoverers and transformations that it may then refer to by name.
+	Extensions []string `json:"extensions"`
+
+	// MaxBodySize is the largest request body accepted, in bytes; a route's
+	// own limit replaces it. Zero means no limit.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// Timeouts of the frontend listener. WebSocket connections are exempt
+	// from the read and write timeouts once upgraded.
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	// ReadHeaderTimeout bounds reading the headers of a request; zero means
+	// the read timeout, or 10 seconds without one. BodyIdleTimeout answers
+	// 408 to requests whose body stalls for longer.
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	BodyIdleTimeout   Duration `json:"body_idle_timeout"`
+	// MaxConnsPerClient limits the connections a client address may hold
+	// to the frontend listener at once; zero means no limit.
+	MaxConnsPerClient int `json:"max_conns_per_client"`
+	// MaxConns limits the connections the frontend listener holds at once;
+	// zero means no limit. Past it, new connections wait for up to
+	// MaxConnsQueueTimeout in the listen backlog, and are then closed
+	// until one of those held closes.
+	MaxConns             int      `json:"max_conns"`
+	MaxConnsQueueTimeout Duration `json:"max_conns_queue_timeout"`
+	// Socket tunes the sockets of the frontend listener's connections.
+	Socket *SocketConfig `json:"socket"`
+	// Egress caps the bandwidth the frontend listener's connections send
+	// at, together.
+	Egress *EgressConfig `json:"egress"`
+	// StrictParsing rejects requests to the frontend listener that peers
+	// may frame differently, against request smuggling.
+	StrictParsing *StrictParsingConfig `json:"strict_parsing"`
+	// ShutdownTimeout bounds how long in-flight requests and connections may
+	// take to finish once a shutdown is signaled; zero means 30 seconds.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// ReloadDrain tunes how a reload drains the configuration it replaces.
+	ReloadDrain *ReloadDrainConfig `json:"reload_drain"`
+
+	// ReusePort opens the frontend listener with SO_REUSEPORT, so that
+	// several processes may serve the port, and Listeners sockets of it in
+	// this process to spread accepting connections; zero means one. It is
+	// supported on Linux and the BSDs.
+	ReusePort bool `json:"reuse_port"`
+	Listeners int  `json:"listeners"`
+
+	TLS   *TLSConfig   `json:"tls"`
+	HTTP2 *HTTP2Config `json:"http2"`
+	HTTP3 *HTTP3Config `json:"http3"`
+
+	TCP []TCPProxyConfig `json:"tcp"`
+	UDP []UDPProxyConfig `json:"udp"`
+
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol"`
+
+	TLSPassthrough []PassthroughConfig `json:"tls_passthrough"`
+
+	Forwarded *ForwardedConfig `json:"forwarded"`
+
+	// SensitiveHeaders are the names, or prefixes ending in "*", of the
+	// headers removed from every client request before it is handled, such
+	// as X-Internal-Auth, so that clients cannot inject them. Hop-by-hop
+	// headers are always removed.
+	SensitiveHeaders []string `json:"sensitive_headers"`
+
+	// Frontends are served besides the main frontend the settings above
+	// describe, each on a port of its own with its own pools, routes and
+	// middleware, such as a public one with TLS and a WAF and an internal
+	// one in plain HTTP.
+	Frontends []FrontendConfig `json:"frontends"`
+}
+
+// FrontendConfig describes a frontend named Name, as loadbalancer.Service
+// runs it, with the settings of the main frontend, none of which it
+// inherits. The process-wide ones are not allowed: admin, state_file, ha,
+// cluster, fleet, log_level, anonymize_ips, extensions, shutdown_timeout,
+// and http3, tcp, udp and tls_passthrough, which only the main frontend
+// serves, nor are frontends of its own. The names of its pools and routes
+// are unique among all frontends.
+type FrontendConfig struct {
+	Name string `json:"name"`
+	Config
+}
+
+// AccessLogConfig describes the access log, written to File or, if empty,
+// to the standard output. Sample is the fraction of the requests logged,
+// from 0 to 1; it defaults to 1.
+type AccessLogConfig struct {
+	File   string   `json:"file"`
+	Sample *float64 `json:"sample"`
+}
+
+// ReloadDrainConfig tunes the draining of a configuration a reload
+// replaces, whose routes and backends keep serving the requests in flight
+// while new ones follow the new configuration: they have Grace to finish,
+// the shutdown timeout by default, before they are canceled. With
+// KeepAlive, the requests of the client connections accepted before the
+// reload keep being served by the replaced configuration too, for Grace,
+// before they follow the new one.
+type ReloadDrainConfig struct {
+	Grace     Duration `json:"grace"`
+	KeepAlive bool     `json:"keep_alive"`
+}
+
+// TagsConfig attaches tags to requests, as loadbalancer.Tagger: rules are
+// tried in order, the first of those giving a tag a value setting it.
+// MaxValues bounds the values of each tag labeling metrics, 100 by
+// default; the others are counted as "other".
+type TagsConfig struct {
+	Rules     []TagRuleConfig `json:"rules"`
+	MaxValues int             `json:"max_values"`
+}
+
+// TagRuleConfig gives the tag Name to the requests of Routes, or of all of
+// them if empty, including those no route matches. Its value is Value, or
+// else that of the header Header, the name of the consumer of the API key
+// if APIKey is set, or the bucket of the experiment of the route if
+// Experiment is set; exactly one of them is.
+type TagRuleConfig struct {
+	Name       string   `json:"name"`
+	Routes     []string `json:"routes"`
+	Value      string   `json:"value"`
+	Header     string   `json:"header"`
+	APIKey     bool     `json:"api_key"`
+	Experiment bool     `json:"experiment"`
+}
+
+// RecordConfig describes the recording of requests, as
+// loadbalancer.Recorder, to File: the fraction Sample of them, all by
+// default, with up to MaxBody bytes of their bodies, 64 KiB by default.
+// RedactHeaders names the headers whose values are redacted, Authorization,
+// Proxy-Authorization and Cookie if unset, RedactQuery the query parameters,
+// and RedactBody regular expressions whose matches in bodies are.
+type RecordConfig struct {
+	File          string   `json:"file"`
+	Sample        *float64 `json:"sample"`
+	MaxBody       int64    `json:"max_body"`
+	RedactHeaders []string `json:"redact_headers"`
+	RedactQuery   []string `json:"redact_query"`
+	RedactBody    []string `json:"redact_body"`
+}
+
+// ProbeConfig describes a synthetic request, as loadbalancer.Probe, sent
+// every Interval, 30s by default, to the listener of the instance, or to
+// Addr if set, through the routes and middleware to a backend: Method, GET
+// by default, URI, / by default, Host, Headers and Body. It fails if it
+// takes longer than Timeout, 5s by default, if the status of the response
+// is not one of ExpectStatus, any below 400 if unset, or if ExpectBody, a
+// regular expression, matches nothing in the first MiB of its body.
+type ProbeConfig struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	URI          string            `json:"uri"`
+	Host         string            `json:"host"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	Addr         string            `json:"addr"`
+	Interval     Duration          `json:"interval"`
+	Timeout      Duration          `json:"timeout"`
+	ExpectStatus []int             `json:"expect_status"`
+	ExpectBody   string            `json:"expect_body"`
+}
+
+// AnonymizeIPsConfig describes the anonymization of logged client
+// addresses, as loadbalancer.IPAnonymizer: IPv4 addresses are truncated to
+// their first IPv4Prefix bits, 24 by default, and IPv6 ones to IPv6Prefix,
+// 48 by default. Hash also replaces them with their HMAC keyed with Salt,
+// random if empty, which changes the hashes of each run.
+type AnonymizeIPsConfig struct {
+	IPv4Prefix int    `json:"ipv4_prefix"`
+	IPv6Prefix int    `json:"ipv6_prefix"`
+	Hash       bool   `json:"hash"`
+	Salt       string `json:"salt"`
+}
+
+// HAConfig pairs the instance with the one whose admin API is at Peer, as
+// loadbalancer.HA: they heartbeat each other every Interval, 1s by default,
+// and the standby takes over once the active did not answer for DeadAfter,
+// 3s by default. PeerToken authenticates the heartbeats to the peer's admin
+// API, which requires the read role. Name tells the instances apart, the
+// hostname by default; of two instances both active or both standby, the
+// one with the higher Priority is active. OnActive and OnStandby are
+// commands run when the instance becomes active or standby, for instance to
+// move a floating IP, and Webhook is a URL notified of it, for instance to
+// update a DNS record.
+type HAConfig struct {
+	Name      string   `json:"name"`
+	Peer      string   `json:"peer"`
+	PeerToken string   `json:"peer_token"`
+	Priority  int      `json:"priority"`
+	Interval  Duration `json:"interval"`
+	DeadAfter Duration `json:"dead_after"`
+	OnActive  []string `json:"on_active"`
+	OnStandby []string `json:"on_standby"`
+	Webhook   string   `json:"webhook"`
+}
+
+// ClusterConfig makes the instance a replica gossiping the health of
+// servers over UDP from Bind with the others, as loadbalancer.Cluster,
+// starting from Peers, the addresses they gossip from. Every Interval,
+// 500ms by default, it sends what it knows to Fanout replicas, 3 by
+// default. Name tells the replicas apart, the hostname by default. Key,
+// required, authenticates the messages. FailureThreshold, if set, ejects servers
+// the replicas together failed to proxy requests to that many times within
+// FailureWindow, 10s by default, for EjectFor, 30s by default.
+type ClusterConfig struct {
+	Name             string   `json:"name"`
+	Bind             string   `json:"bind"`
+	Peers            []string `json:"peers"`
+	Key              string   `json:"key"`
+	Interval         Duration `json:"interval"`
+	Fanout           int      `json:"fanout"`
+	FailureThreshold int      `json:"failure_threshold"`
+	FailureWindow    Duration `json:"failure_window"`
+	EjectFor         Duration `json:"eject_for"`
+}
+
+// FleetConfig makes the instance a member of a fleet, as
+// loadbalancer.Fleet, whose leader is elected, and publishes its
+// configuration, in etcd or Consul: either Etcd, whose prefix holds the
+// keys of the fleet, or Consul. The leader renews its leadership every
+// Interval, a third of TTL by default, and loses it once it did not for
+// TTL, 10s by default. Name tells the instances apart, the hostname by
+// default.
+type FleetConfig struct {
+	Name     string               `json:"name"`
+	TTL      Duration             `json:"ttl"`
+	Interval Duration             `json:"interval"`
+	Etcd     *EtcdDiscoveryConfig `json:"etcd"`
+	Consul   *FleetConsulConfig   `json:"consul"`
+}
+
+// FleetConsulConfig keeps the keys of a fleet under Prefix in the KV store
+// of the Consul agent at Addr, the local one by default.
+type FleetConsulConfig struct {
+	Addr       string `json:"addr"`
+	Prefix     string `json:"prefix"`
+	Datacenter string `json:"datacenter"`
+	Token      string `json:"token"`
+}
+
+// ForwardedConfig describes the handling of X-Forwarded-* headers.
+// TrustedProxies lists the CIDRs of proxies in front of the LB whose
+// forwarding headers are kept; Header also emits the RFC 7239 Forwarded
+// header.
+type ForwardedConfig struct {
+	TrustedProxies []string `json:"trusted_proxies"`
+	Header         bool     `json:"header"`
+}
+
+// PassthroughConfig forwards TLS connections for Hosts, matched by SNI on the
+// frontend TLS listener, to a tcp pool without terminating them.
+type PassthroughConfig struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+	Pool  string   `json:"pool"`
+}
+
+// ProxyProtocolConfig enables PROXY protocol v1/v2 on inbound connections.
+// Trusted lists the CIDRs of the upstream balancers allowed to send it, and
+// is required.
+type ProxyProtocolConfig struct {
+	Trusted []string `json:"trusted"`
+	Timeout Duration `json:"timeout"`
+}
+
+// UDPProxyConfig describes a UDP listener forwarding datagrams to a udp pool.
+// IdleTimeout is how long a client flow stays pinned to its server without
+// traffic.
+type UDPProxyConfig struct {
+	Name        string   `json:"name"`
+	Addr        string   `json:"addr"`
+	Pool        string   `json:"pool"`
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	IPFilter *IPFilterConfig `json:"ip_filter"`
+}
+
+// TCPProxyConfig describes a layer-4 listener forwarding connections to a
+// tcp pool.
+type TCPProxyConfig struct {
+	Name        string   `json:"name"`
+	Addr        string   `json:"addr"`
+	Pool        string   `json:"pool"`
+	DialTimeout Duration `json:"dial_timeout"`
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol"`
+	IPFilter      *IPFilterConfig      `json:"ip_filter"`
+	// Socket tunes the sockets of client and server connections.
+	Socket *SocketConfig `json:"socket"`
+	// Egress caps the bandwidth sent to the clients, together.
+	Egress *EgressConfig `json:"egress"`
+}
+
+// EgressConfig caps outbound bandwidth, as loadbalancer.Shaper, to Rate
+// bytes per second shared evenly by what sends at once, with bursts of Burst
+// bytes, a tenth of a second of the rate by default.
+type EgressConfig struct {
+	Rate  int64 `json:"rate"`
+	Burst int64 `json:"burst"`
+}
+
+// StrictParsingConfig describes strict request parsing, as
+// loadbalancer.StrictParsing: the largest request head accepted, in bytes,
+// 64 KiB by default, and the most headers, 100 by default.
+type StrictParsingConfig struct {
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	MaxHeaders     int `json:"max_headers"`
+}
+
+// SocketConfig tunes TCP sockets, as SocketOptions. NoDelay unset keeps
+// Nagle's algorithm off.
+type SocketConfig struct {
+	NoDelay           *bool    `json:"no_delay"`
+	KeepAliveIdle     Duration `json:"keep_alive_idle"`
+	KeepAliveInterval Duration `json:"keep_alive_interval"`
+	KeepAliveCount    int      `json:"keep_alive_count"`
+	DisableKeepAlive  bool     `json:"disable_keep_alive"`
+	ReadBuffer        int      `json:"read_buffer"`
+	WriteBuffer       int      `json:"write_buffer"`
+}
+
+// IPFilterConfig lists the CIDRs, or single addresses, of the clients
+// allowed and denied. Deny wins; a non-empty Allow denies every other
+// client.
+type IPFilterConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// WAFConfig describes a WAF: the JSON file of its rules, read with
+// LoadWAFRules, and how much of request bodies they inspect, 64 KiB by
+// default.
+type WAFConfig struct {
+	RulesFile string `json:"rules_file"`
+	MaxBody   int64  `json:"max_body"`
+}
+
+// BotsConfig describes a bot filter: its rules, tried in order, and the
+// header naming the rule a request matched for the route action, X-Bot by
+// default. MaxClients bounds the clients whose rate each limit rule
+// tracks, 100000 by default.
+type BotsConfig struct {
+	Header     string          `json:"header"`
+	Rules      []BotRuleConfig `json:"rules"`
+	MaxClients int             `json:"max_clients"`
+}
+
+// AbuseConfig describes abuse detection, as loadbalancer.AbuseGuard: a
+// client sending more than MaxRequests requests within Window, or whose
+// requests within Window fail at a rate of MaxErrorRate, between 0 and 1,
+// once it sent MinRequests, is banned for BanDuration, doubled on every
+// further ban up to MaxBanDuration. Status is 429, the default, or 403.
+type AbuseConfig struct {
+	Window         Duration `json:"window"`
+	MaxRequests    int      `json:"max_requests"`
+	MaxErrorRate   float64  `json:"max_error_rate"`
+	MinRequests    int      `json:"min_requests"`
+	BanDuration    Duration `json:"ban_duration"`
+	MaxBanDuration Duration `json:"max_ban_duration"`
+	Status         int      `json:"status"`
+	MaxClients     int      `json:"max_clients"`
+	// Store shares the bans with the LB instances using the same one.
+	Store *AffinityStoreConfig `json:"store"`
+}
+
+// BandwidthConfig describes per-client bandwidth limits, as
+// loadbalancer.Bandwidth: Download and Upload bytes per second, with bursts
+// of Burst bytes, one second of the rate by default. Clients are told apart
+// by the value of Header, such as that of their API key, or by address.
+type BandwidthConfig struct {
+	Download   int64  `json:"download"`
+	Upload     int64  `json:"upload"`
+	Burst      int64  `json:"burst"`
+	Header     string `json:"header"`
+	MaxClients int    `json:"max_clients"`
+}
+
+// BotRuleConfig describes a bot filter rule. UserAgents are regular
+// expressions; Action is allow, block, limit or route, and Rate and Burst
+// are the requests a second and the burst a client is allowed under limit.
+type BotRuleConfig struct {
+	Name           string   `json:"name"`
+	UserAgents     []string `json:"user_agents"`
+	MissingHeaders []string `json:"missing_headers"`
+	Action         string   `json:"action"`
+	Rate           float64  `json:"rate"`
+	Burst          int      `json:"burst"`
+}
+
+// HTTP3Config enables the experimental HTTP/3 (QUIC) frontend on the UDP
+// address Addr. It requires TLS and a build with the quic tag.
+type HTTP3Config struct {
+	Addr string `json:"addr"`
+	// MaxAge is how long clients may remember the Alt-Svc advertisement.
+	MaxAge Duration `json:"max_age"`
+}
+
+// TLSConfig enables TLS on the frontend listener. Clients negotiate HTTP/2 or
+// HTTP/1.1 through ALPN.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// HTTP2Config tunes HTTP/2 on the frontend listener. Zero values keep the
+// defaults of net/http.
+type HTTP2Config struct {
+	// Disable serves HTTP/1.1 only.
+	Disable              bool `json:"disable"`
+	MaxConcurrentStreams int  `json:"max_concurrent_streams"`
+	// Flow-control windows, in bytes.
+	MaxReceiveBufferPerConnection int `json:"max_receive_buffer_per_connection"`
+	MaxReceiveBufferPerStream     int `json:"max_receive_buffer_per_stream"`
+	// MaxReadFrameSize is the largest frame the LB accepts, in bytes.
+	MaxReadFrameSize int      `json:"max_read_frame_size"`
+	PingTimeout      Duration `json:"ping_timeout"`
+	SendPingTimeout  Duration `json:"send_ping_timeout"`
+}
+
+// GeoIPConfig describes the GeoIP database used for country-based routing.
+type GeoIPConfig struct {
+	Database string `json:"database"`
+	Header   string `json:"header"`
+}
+
+// TLSFingerprintsConfig describes a filter of clients by TLS fingerprint:
+// its rules, tried in order, and the header the JA4 fingerprint of requests
+// is forwarded in, if any. MaxTracked bounds the fingerprints whose rate
+// each limit rule tracks, 100000 by default. It requires tls.
+type TLSFingerprintsConfig struct {
+	Header     string                     `json:"header"`
+	Rules      []TLSFingerprintRuleConfig `json:"rules"`
+	MaxTracked int                        `json:"max_tracked"`
+}
+
+// TLSFingerprintRuleConfig describes a TLS fingerprint rule, matching the
+// JA3 hashes or JA4 fingerprints listed, or every request if neither is.
+// Action is allow, deny or limit, and Rate and Burst are the requests a
+// second and the burst all clients sharing a fingerprint are allowed under
+// limit.
+type TLSFingerprintRuleConfig struct {
+	Name   string   `json:"name"`
+	JA3    []string `json:"ja3"`
+	JA4    []string `json:"ja4"`
+	Action string   `json:"action"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+}
+
+// GeoBlockConfig describes GeoIP blocking, as loadbalancer.GeoFilter:
+// requests from Countries, ISO 3166-1 codes resolved with the geoip
+// database, or from autonomous systems ASNs, resolved with ASNDatabase or
+// else the geoip database, are answered 403 or, with Action "challenge",
+// must pass a JavaScript challenge lasting ChallengeTTL, an hour by
+// default. ChallengeSecret signs the challenge cookies; it is random if
+// empty.
+type GeoBlockConfig struct {
+	Countries       []string `json:"countries"`
+	ASNs            []uint   `json:"asns"`
+	ASNDatabase     string   `json:"asn_database"`
+	Action          string   `json:"action"`
+	ChallengeTTL    Duration `json:"challenge_ttl"`
+	ChallengeSecret string   `json:"challenge_secret"`
+}
+
+// MaintenanceConfig describes the page served while the load balancer or a
+// pool is in maintenance. Enabled starts with the global switch on; Routes
+// restricts it to some routes. The body is given inline or read from
+// BodyFile. Clients in Allow (CIDRs) are still forwarded.
+type MaintenanceConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Routes      []string `json:"routes"`
+	Status      int      `json:"status"`
+	Body        string   `json:"body"`
+	BodyFile    string   `json:"body_file"`
+	ContentType string   `json:"content_type"`
+	RetryAfter  Duration `json:"retry_after"`
+	Allow       []string `json:"allow"`
+}
+
+// AdminConfig describes the admin API listener. If Token is set, requests
+// must carry it as a bearer token, granting the write role; Tokens adds
+// tokens with their own roles. With TLS, clients may also authenticate with
+// a certificate. Without any of these, the API is only served on a loopback
+// address, unless Insecure is set to serve it on any to anyone.
+type AdminConfig struct {
+	Addr     string             `json:"addr"`
+	Token    string             `json:"token"`
+	Tokens   []AdminTokenConfig `json:"tokens"`
+	TLS      *AdminTLSConfig    `json:"tls"`
+	Insecure bool               `json:"insecure"`
+}
+
+// AdminTokenConfig grants Role, "read" or "write", to a bearer token.
+type AdminTokenConfig struct {
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// AdminTLSConfig serves the admin API over TLS. Client certificates signed
+// by ClientCAFile are verified; Clients grants roles to them by subject
+// common name or DNS name. Without tokens, a client certificate is required.
+type AdminTLSConfig struct {
+	CertFile     string              `json:"cert_file"`
+	KeyFile      string              `json:"key_file"`
+	ClientCAFile string              `json:"client_ca_file"`
+	Clients      []AdminClientConfig `json:"clients"`
+}
+
+// AdminClientConfig grants Role, "read" or "write", to client certificates
+// issued for Name.
+type AdminClientConfig struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// FallbackConfig describes how requests matching no route are handled: either
+// forwarded to Pool or answered with Status and Body.
+type FallbackConfig struct {
+	Pool   string `json:"pool"`
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// PoolConfig describes a named backend pool.
+type PoolConfig struct {
+	Name    string         `json:"name"`
+	Servers []ServerConfig `json:"servers"`
+	// Strategy names the strategy balancing the pool, round_robin by
+	// default, among those built in and added with strategy.Register.
+	Strategy    string            `json:"strategy"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	Affinity    *AffinityConfig   `json:"affinity"`
+	// Protocol is "http" (the default), "grpc" for gRPC backends, "fastcgi"
+	// for FastCGI application servers, or "tcp" and "udp" for servers behind
+	// layer-4 proxies.
+	Protocol string `json:"protocol"`
+	// FastCGI maps requests onto scripts for fastcgi pools.
+	FastCGI *FastCGIConfig `json:"fastcgi"`
+	// DNSRefresh, if set, resolves servers given by hostname on this
+	// interval and balances over every address returned.
+	DNSRefresh Duration `json:"dns_refresh"`
+	// ProxyProtocol is "v1" or "v2" to send PROXY protocol headers to the
+	// servers of http and tcp pools.
+	ProxyProtocol string `json:"proxy_protocol"`
+	// Discovery adds servers found in external sources.
+	Discovery *DiscoveryConfig `json:"discovery"`
+	// Maintenance starts the pool in maintenance.
+	Maintenance bool `json:"maintenance"`
+	// Transport tunes the connections to the servers; pools without one
+	// share the transport of the load balancer.
+	Transport *TransportConfig `json:"transport"`
+	// Egress caps the bandwidth of the responses of the pool's servers,
+	// or for tcp pools of what their proxies send to clients, together.
+	Egress *EgressConfig `json:"egress"`
+	// Faults injects faults into a share of the requests forwarded to the
+	// pool, for testing.
+	Faults *FaultsConfig `json:"faults"`
+	// Datacenters routes the requests by the data centers of the servers,
+	// preferring the fastest; it is implied if a server has one.
+	Datacenters *DatacentersConfig `json:"datacenters"`
+}
+
+// DatacentersConfig tunes the routing of a pool by data center, as
+// loadbalancer.Datacenters: the latency to each is probed every Interval,
+// 5s by default, within Timeout, 2s by default. Weights sets the weights
+// of data centers instead of deriving them from their latency.
+type DatacentersConfig struct {
+	Interval Duration       `json:"interval"`
+	Timeout  Duration       `json:"timeout"`
+	Weights  map[string]int `json:"weights"`
+}
+
+// TransportConfig tunes the connections to backends, as TransportOptions.
+type TransportConfig struct {
+	MaxIdleConns          int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int      `json:"max_conns_per_host"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`
+	DialTimeout           Duration `json:"dial_timeout"`
+	KeepAlive             Duration `json:"keep_alive"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	DisableKeepAlives     bool     `json:"disable_keep_alives"`
+	// DNSCacheTTL is how long the addresses of backend hostnames are
+	// cached, DNSNegativeTTL how long failures to resolve them are; zero
+	// means 30 seconds and one second, and a negative DNSCacheTTL disables
+	// the cache.
+	DNSCacheTTL    Duration `json:"dns_cache_ttl"`
+	DNSNegativeTTL Duration `json:"dns_negative_ttl"`
+	// Socket tunes the sockets of the connections to backends.
+	Socket *SocketConfig `json:"socket"`
+	// Shared makes the servers share one pool of connections, and its
+	// MaxIdleConns; by default every server has a pool of its own, the
+	// limits applying to each.
+	Shared bool `json:"shared"`
+	// HTTP2 tunes HTTP/2 to the servers.
+	HTTP2 *UpstreamHTTP2Config `json:"http2"`
+}
+
+// UpstreamHTTP2Config tunes HTTP/2 to backends, negotiated with https
+// servers and spoken with prior knowledge to h2c and grpc ones. Zero values
+// keep the defaults of net/http.
+type UpstreamHTTP2Config struct {
+	// Disable speaks HTTP/1.1 to https servers.
+	Disable bool `json:"disable"`
+	// StrictMaxConcurrentStreams makes requests wait for a stream once the
+	// connections to a server carry as many as it allows, rather than
+	// opening another connection.
+	StrictMaxConcurrentStreams bool `json:"strict_max_concurrent_streams"`
+	// Flow-control windows, in bytes.
+	MaxReceiveBufferPerConnection int `json:"max_receive_buffer_per_connection"`
+	MaxReceiveBufferPerStream     int `json:"max_receive_buffer_per_stream"`
+	// MaxReadFrameSize is the largest frame the LB accepts, in bytes.
+	MaxReadFrameSize int `json:"max_read_frame_size"`
+	// SendPingTimeout is how long a connection may be silent before it is
+	// pinged, and PingTimeout how long the ping may go unanswered before
+	// the connection is closed.
+	PingTimeout     Duration `json:"ping_timeout"`
+	SendPingTimeout Duration `json:"send_ping_timeout"`
+}
+
+// DiscoveryConfig describes where a pool discovers servers and how often.
+type DiscoveryConfig struct {
+	Interval   Duration                   `json:"interval"`
+	SRV        *SRVDiscoveryConfig        `json:"srv"`
+	Consul     *ConsulDiscoveryConfig     `json:"consul"`
+	Etcd       *EtcdDiscoveryConfig       `json:"etcd"`
+	Kubernetes *KubernetesDiscoveryConfig `json:"kubernetes"`
+	Docker     *DockerDiscoveryConfig     `json:"docker"`
+	Swarm      *SwarmDiscoveryConfig      `json:"swarm"`
+	Nomad      *NomadDiscoveryConfig      `json:"nomad"`
+	Eureka     *EurekaDiscoveryConfig     `json:"eureka"`
+	ZooKeeper  *ZooKeeperDiscoveryConfig  `json:"zookeeper"`
+	File       *FileDiscoveryConfig       `json:"file"`
+	EC2        *EC2DiscoveryConfig        `json:"ec2"`
+	MDNS       *MDNSDiscoveryConfig       `json:"mdns"`
+	// Registration lets servers register themselves through the admin API.
+	Registration *RegistrationConfig `json:"registration"`
+	// Plugins are discoverers registered with
+	// loadbalancer.RegisterDiscoverer.
+	Plugins []DiscoveryPluginConfig `json:"plugins"`
+}
+
+// DiscoveryPluginConfig describes the discoverer registered under Name,
+// which Config is passed to as is.
+type DiscoveryPluginConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+// MDNSDiscoveryConfig discovers the instances of a DNS-SD service type, such
+// as "_http._tcp", advertised over multicast DNS. Domain defaults to "local",
+// Timeout, the time answers are collected for, to one second and Scheme is
+// as for srv.
+type MDNSDiscoveryConfig struct {
+	Service string   `json:"service"`
+	Domain  string   `json:"domain"`
+	Timeout Duration `json:"timeout"`
+	Scheme  string   `json:"scheme"`
+}
+
+// RegistrationConfig describes self-registration. TTL is the longest time a
+// registration lasts without heartbeat.
+type RegistrationConfig struct {
+	TTL Duration `json:"ttl"`
+}
+
+// SRVDiscoveryConfig discovers servers from a DNS SRV record, such as
+// "_http._tcp.example.com". Scheme defaults to "http" for http and grpc
+// pools; other pools use bare host:port targets.
+type SRVDiscoveryConfig struct {
+	Name   string `json:"name"`
+	Scheme string `json:"scheme"`
+}
+
+// FastCGIConfig describes the scripts served by a fastcgi pool.
+type FastCGIConfig struct {
+	Root     string            `json:"root"`
+	Index    string            `json:"index"`
+	SplitExt string            `json:"split_ext"`
+	Params   map[string]string `json:"params"`
+}
+
+// ServerConfig describes a backend server. In JSON it is either an object or
+// just the address string.
+type ServerConfig struct {
+	Addr string `json:"addr"`
+	// H2C speaks cleartext HTTP/2 with prior knowledge to the server.
+	H2C bool `json:"h2c"`
+	// Weight is the share of traffic sent to the server by weighted
+	// strategies; zero means 1.
+	Weight int `json:"weight"`
+	// Tier ranks the server for failover: servers of a tier only receive
+	// traffic while no lower tier has a live server.
+	Tier int `json:"tier"`
+	// Datacenter names the data center the server runs in, for pools
+	// routing by data center.
+	Datacenter string `json:"datacenter"`
+	// Maintenance lists recurring windows during which the server is
+	// drained, to be returned to service when they close.
+	Maintenance []ScheduleConfig `json:"maintenance"`
+	// MaxIdleConns and IdleConnTimeout override the pool's transport for
+	// the idle connections kept to the server; DisableKeepAlives makes
+	// every request use a new connection.
+	MaxIdleConns      int      `json:"max_idle_conns"`
+	IdleConnTimeout   Duration `json:"idle_conn_timeout"`
+	DisableKeepAlives bool     `json:"disable_keep_alives"`
+}
+
+// UnmarshalJSON accepts a bare address as well as an object.
+func (sc *ServerConfig) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*sc = ServerConfig{}
+		return json.Unmarshal(b, &sc.Addr)
+	}
+	type plain ServerConfig
+	return json.Unmarshal(b, (*plain)(sc))
+}
+
+// AffinityConfig describes session affinity. Type "cookie" pins clients with
+// an LB-issued cookie, "client_ip" by their address masked to the prefix lengths
+// and "header" by the value of an existing request header.
+type AffinityConfig struct {
+	Type        string   `json:"type"`
+	CookieName  string   `json:"cookie_name"`
+	TTL         Duration `json:"ttl"`
+	IdleTimeout Duration `json:"idle_timeout"`
+	Secure      bool     `json:"secure"`
+	HTTPOnly    bool     `json:"http_only"`
+	IPv4Prefix  int      `json:"ipv4_prefix"`
+	IPv6Prefix  int      `json:"ipv6_prefix"`
+	Header      string   `json:"header"`
+	// ConsistentHash maps client_ip and header keys onto a hash ring of the
+	// pool's servers instead of remembering pins in a table.
+	ConsistentHash bool `json:"consistent_hash"`
+	// Failover is "repin" (default) or "error", answering with FailoverStatus.
+	Failover       string `json:"failover"`
+	FailoverStatus int    `json:"failover_status"`
+	// Store shares client_ip and header pins between LB instances.
+	Store *AffinityStoreConfig `json:"store"`
+}
+
+// AffinityStoreConfig describes where state shared between LB instances,
+// such as affinity pins, quota counters or bans, is kept, as
+// loadbalancer.SharedStore. Type "memory" (the default) keeps it per
+// instance, "redis" in the Redis server at Addr, and "etcd" under Prefix,
+// "/lb/" by default, of the etcd cluster at Endpoints, with Username and
+// Password. MaxEntries bounds the values of a memory store, 100000 by
+// default, which refuses new ones while full, or the API keys cached from
+// Redis, 10000 by default.
+type AffinityStoreConfig struct {
+	Type       string   `json:"type"`
+	Addr       string   `json:"addr"`
+	Endpoints  []string `json:"endpoints"`
+	Prefix     string   `json:"prefix"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	DB         int      `json:"db"`
+	MaxEntries int      `json:"max_entries"`
+}
+
+// HealthCheckConfig describes active health probing of a pool. Checker
+// names the checker probing the servers instead of an HTTP GET of Path, as
+// registered with health.Register, such as "tcp"; Config is passed to it
+// as is.
+type HealthCheckConfig struct {
+	Path     string          `json:"path"`
+	Interval Duration        `json:"interval"`
+	Timeout  Duration        `json:"timeout"`
+	Checker  string          `json:"checker"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// SplitConfig sends Weight parts of the requests of a route to Pool.
+type SplitConfig struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// RouteConfig describes a routing rule.
+type RouteConfig struct {
+	Name       string            `json:"name"`
+	Pool       string            `json:"pool"`
+	Priority   int               `json:"priority"`
+	Splits     []SplitConfig     `json:"splits"`
+	Path       *MatchConfig      `json:"path"`
+	Methods    []string          `json:"methods"`
+	Headers    []NamedMatch      `json:"headers"`
+	Query      []NamedMatch      `json:"query"`
+	Countries  []string          `json:"countries"`
+	Schedule   *ScheduleConfig   `json:"schedule"`
+	Rewrite    *RewriteConfig    `json:"rewrite"`
+	Redirect   *RedirectConfig   `json:"redirect"`
+	BlueGreen  *BlueGreenConfig  `json:"blue_green"`
+	Mirror     *MirrorConfig     `json:"mirror"`
+	Canary     *CanaryConfig     `json:"canary"`
+	Experiment *ExperimentConfig `json:"experiment"`
+	// Affinity overrides the pools' session affinity for this route;
+	// DisableAffinity turns it off.
+	Affinity        *AffinityConfig `json:"affinity"`
+	DisableAffinity bool            `json:"disable_affinity"`
+	// Stream flushes responses as they arrive, after at most FlushInterval,
+	// exempts them from the write timeout and keeps reading request bodies
+	// while they are answered. Event streams are always flushed and exempt.
+	Stream      *StreamConfig      `json:"stream"`
+	Compression *CompressionConfig `json:"compression"`
+	// RequestHeaders and ResponseHeaders edit the headers of the requests
+	// forwarded to backends and of the responses sent back.
+	RequestHeaders  *HeaderOpsConfig `json:"request_headers"`
+	ResponseHeaders *HeaderOpsConfig `json:"response_headers"`
+	Cookies         *CookiesConfig   `json:"cookies"`
+	// CORS answers preflight requests, which only reach the route if its
+	// methods, if any, include OPTIONS.
+	CORS *CORSConfig `json:"cors"`
+	// BasicAuth requires clients to authenticate as a user of an htpasswd
+	// file.
+	BasicAuth *BasicAuthConfig `json:"basic_auth"`
+	// JWT requires clients to present a valid JSON Web Token.
+	JWT *JWTConfig `json:"jwt"`
+	// APIKeys requires clients to send an API key and limits their rate.
+	APIKeys *APIKeysConfig `json:"api_keys"`
+	// Signatures requires requests to be signed with HMACs of their
+	// clients' shared secrets.
+	Signatures *SignaturesConfig `json:"signatures"`
+	// ForwardAuth lets an external authentication service decide which
+	// requests reach the route.
+	ForwardAuth *ForwardAuthConfig `json:"forward_auth"`
+	IPFilter    *IPFilterConfig    `json:"ip_filter"`
+	Bandwidth   *BandwidthConfig   `json:"bandwidth"`
+	RateLimit   *RateLimitConfig   `json:"rate_limit"`
+	MaxBodySize int64              `json:"max_body_size"`
+	Plugins     []PluginConfig     `json:"plugins"`
+	Cache       *CacheConfig       `json:"cache"`
+	// Middleware lists middleware named in the configuration's middleware,
+	// run in that order once the route's own authentication and plugins
+	// ran, and before its own header rules, cookies, compression and
+	// cache. A cache may not be listed before authentication.
+	Middleware []string `json:"middleware"`
+
+	// Faults injects latency, errors and dropped connections into a share
+	// of the route's requests, for testing.
+	Faults *FaultsConfig `json:"faults"`
+}
+
+// MiddlewareConfig describes a named middleware: exactly one of its fields
+// is set, as it would be in a route. RequestHeaders and ResponseHeaders
+// together are one middleware, applying header rules.
+type MiddlewareConfig struct {
+	IPFilter        *IPFilterConfig    `json:"ip_filter"`
+	CORS            *CORSConfig        `json:"cors"`
+	Bandwidth       *BandwidthConfig   `json:"bandwidth"`
+	RateLimit       *RateLimitConfig   `json:"rate_limit"`
+	MaxBodySize     int64              `json:"max_body_size"`
+	BasicAuth       *BasicAuthConfig   `json:"basic_auth"`
+	JWT             *JWTConfig         `json:"jwt"`
+	APIKeys         *APIKeysConfig     `json:"api_keys"`
+	Signatures      *SignaturesConfig  `json:"signatures"`
+	ForwardAuth     *ForwardAuthConfig `json:"forward_auth"`
+	Plugin          *PluginConfig      `json:"plugin"`
+	RequestHeaders  *HeaderOpsConfig   `json:"request_headers"`
+	ResponseHeaders *HeaderOpsConfig   `json:"response_headers"`
+	Cookies         *CookiesConfig     `json:"cookies"`
+	Compression     *CompressionConfig `json:"compression"`
+	Cache           *CacheConfig       `json:"cache"`
+}
+
+// RateLimitConfig limits the rate of the requests of each client of a
+// route, told apart by address, as loadbalancer.RateLimit: to Rate a
+// second, with bursts of Burst, tracking up to MaxClients clients, 100000
+// by default, those past them sharing one rate.
+type RateLimitConfig struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	MaxClients int     `json:"max_clients"`
+}
+
+// FaultsConfig describes the faults injected into requests, as
+// loadbalancer.Faults: DelayPercent percent of them are delayed by Delay
+// plus up to Jitter, AbortPercent percent answered AbortStatus, 503 by
+// default, and DropPercent percent dropped without a response. Servers and
+// Header restrict faults to the requests sent to those server addresses
+// and to those carrying the header.
+type FaultsConfig struct {
+	Delay        Duration `json:"delay"`
+	Jitter       Duration `json:"jitter"`
+	DelayPercent float64  `json:"delay_percent"`
+	AbortStatus  int      `json:"abort_status"`
+	AbortPercent float64  `json:"abort_percent"`
+	DropPercent  float64  `json:"drop_percent"`
+	Servers      []string `json:"servers"`
+	Header       string   `json:"header"`
+}
+
+// CookiesConfig describes how the cookies set by a route's backends are
+// rewritten: Domains and Paths map their Domain and Path attributes to the
+// public ones, and NamePrefix is prepended to their names.
+type CookiesConfig struct {
+	Domains    map[string]string `json:"domains"`
+	Paths      map[string]string `json:"paths"`
+	NamePrefix string            `json:"name_prefix"`
+}
+
+// CacheConfig describes the in-memory cache of a route's responses. TTL is
+// the freshness of responses that do not state theirs with Cache-Control or
+// Expires; if it is zero, they are only kept to be revalidated.
+// StaleWhileRevalidate and StaleIfError are how long stale responses may be
+// served while revalidated or when the backend fails, unless the responses
+// say otherwise.
+// MaxEntries, MaxSize and MaxEntrySize (in bytes) default to 10000
+// responses, 64 MiB and 1 MiB.
+type CacheConfig struct {
+	TTL                  Duration `json:"ttl"`
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	StaleIfError         Duration `json:"stale_if_error"`
+	MaxEntries           int      `json:"max_entries"`
+	MaxSize              int64    `json:"max_size"`
+	MaxEntrySize         int64    `json:"max_entry_size"`
+}
+
+// PluginConfig describes a request and response transformation: the Go
+// plugin at Path, or the transformation compiled in under Name if Path is
+// empty. Config is passed to it as is.
+type PluginConfig struct {
+	Name   string          `json:"name"`
+	Path   string          `json:"path"`
+	Config json.RawMessage `json:"config"`
+}
+
+// ForwardAuthConfig describes an external authentication service at
+// Address. RequestHeaders limits the client headers sent to it, all by
+// default; ResponseHeaders lists the headers of its answer forwarded to the
+// backend.
+type ForwardAuthConfig struct {
+	Address         string   `json:"address"`
+	RequestHeaders  []string `json:"request_headers"`
+	ResponseHeaders []string `json:"response_headers"`
+	Timeout         Duration `json:"timeout"`
+}
+
+// APIKeysConfig describes API key authentication. Keys are read from Header
+// (X-API-Key by default) or the query parameter Query, and looked up among
+// Keys or in Store, a Redis server. Quotas are counted in QuotaStore, and
+// rates in RateStore, stores shared with other LB instances, or else in
+// memory.
+type APIKeysConfig struct {
+	Header         string               `json:"header"`
+	Query          string               `json:"query"`
+	ConsumerHeader string               `json:"consumer_header"`
+	Keys           []APIKeyConfig       `json:"keys"`
+	Store          *AffinityStoreConfig `json:"store"`
+	QuotaStore     *AffinityStoreConfig `json:"quota_store"`
+	// RateStore counts the rates of consumers with the LB instances using
+	// the same one.
+	RateStore *AffinityStoreConfig `json:"rate_store"`
+}
+
+// APIKeyConfig describes an API key and the limits of its consumer: Rate
+// requests per second with bursts of Burst, and Quota requests and
+// ByteQuota bytes of bodies every QuotaPeriod (a day by default), or every
+// UTC day or month if QuotaCalendar is "day" or "month". Quotas are shared
+// by the keys of a Tenant, or else of a Name.
+type APIKeyConfig struct {
+	Name          string   `json:"name"`
+	Key           string   `json:"key"`
+	Tenant        string   `json:"tenant"`
+	Rate          float64  `json:"rate"`
+	Burst         int      `json:"burst"`
+	Quota         int64    `json:"quota"`
+	ByteQuota     int64    `json:"byte_quota"`
+	QuotaPeriod   Duration `json:"quota_period"`
+	QuotaCalendar string   `json:"quota_calendar"`
+}
+
+// SignaturesConfig describes HMAC request signatures, as
+// loadbalancer.SignatureAuth: the clients and their secrets, the headers of
+// their name, the time of the signature and the signature, X-Signature-Key,
+// X-Signature-Timestamp and X-Signature by default, and the header the
+// client is forwarded in. MaxSkew defaults to five minutes, MaxBody to 1 MiB
+// and MaxReplays to 100000.
+type SignaturesConfig struct {
+	Clients         []SignatureClientConfig `json:"clients"`
+	KeyHeader       string                  `json:"key_header"`
+	TimestampHeader string                  `json:"timestamp_header"`
+	SignatureHeader string                  `json:"signature_header"`
+	ClientHeader    string                  `json:"client_header"`
+	MaxSkew         Duration                `json:"max_skew"`
+	MaxBody         int64                   `json:"max_body"`
+	MaxReplays      int                     `json:"max_replays"`
+}
+
+// SignatureClientConfig describes a client signing requests with Secret.
+type SignatureClientConfig struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// JWTConfig describes JWT validation against the keys published at JWKSURL,
+// fetched again every Refresh (an hour by default). ClaimHeaders maps
+// claims to the headers they are forwarded to the backend in.
+type JWTConfig struct {
+	JWKSURL      string            `json:"jwks_url"`
+	Issuer       string            `json:"issuer"`
+	Audiences    []string          `json:"audiences"`
+	Cookie       string            `json:"cookie"`
+	Leeway       Duration          `json:"leeway"`
+	Refresh      Duration          `json:"refresh"`
+	ClaimHeaders map[string]string `json:"claim_headers"`
+}
+
+// BasicAuthConfig describes HTTP basic authentication against the htpasswd
+// file at HtpasswdFile. UserHeader, if set, forwards the user's name to the
+// backend.
+type BasicAuthConfig struct {
+	HtpasswdFile string `json:"htpasswd_file"`
+	Realm        string `json:"realm"`
+	UserHeader   string `json:"user_header"`
+}
+
+// CORSConfig describes a CORS policy. AllowedOrigins may contain "*" or
+// patterns like "*.example.com"; AllowedMethods defaults to GET, HEAD and
+// POST. AllowCredentials cannot be combined with the "*" origin. MaxAge is
+// how long browsers may cache a preflight response.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+// HeaderOpsConfig describes edits of a header, applied in the order remove,
+// set, add. A name in Remove ending in "*" removes every header with that
+// prefix.
+type HeaderOpsConfig struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+// CompressionConfig describes response compression. Encodings lists the
+// content codings offered, by preference: "br" (in builds with the brotli
+// tag), "gzip" and "deflate". Responses below MinSize bytes (1 KiB by
+// default) or of a media type not in Types are not compressed; Level is the
+// gzip and deflate level.
+type CompressionConfig struct {
+	Encodings []string `json:"encodings"`
+	MinSize   int      `json:"min_size"`
+	Types     []string `json:"types"`
+	Level     int      `json:"level"`
+}
+
+// StreamConfig describes streaming of a route's responses.
+type StreamConfig struct {
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// ExperimentConfig describes an A/B experiment with stable client bucketing.
+type ExperimentConfig struct {
+	Name      string         `json:"name"`
+	Cookie    string         `json:"cookie"`
+	Header    string         `json:"header"`
+	TagHeader string         `json:"tag_header"`
+	Buckets   []BucketConfig `json:"buckets"`
+}
+
+// BucketConfig describes a bucket of an experiment, receiving Weight parts
+// of its clients.
+type BucketConfig struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// ScheduleConfig describes a recurring time window opening whenever Cron fires
+// and lasting Duration, evaluated in Timezone (an IANA name, UTC if empty).
+type ScheduleConfig struct {
+	Cron     string   `json:"cron"`
+	Duration Duration `json:"duration"`
+	Timezone string   `json:"timezone"`
+}
+
+// CanaryConfig describes a header or cookie forcing requests onto a pool.
+type CanaryConfig struct {
+	Pool   string `json:"pool"`
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+	Value  string `json:"value"`
+}
+
+// MirrorConfig describes traffic shadowing to a pool.
+type MirrorConfig struct {
+	Pool        string   `json:"pool"`
+	Percent     float64  `json:"percent"`
+	MaxBody     int64    `json:"max_body"`
+	Timeout     Duration `json:"timeout"`
+	MaxInFlight int      `json:"max_in_flight"`
+}
+
+// BlueGreenConfig describes a pair of pools of which one is active.
+type BlueGreenConfig struct {
+	Blue   string `json:"blue"`
+	Green  string `json:"green"`
+	Active string `json:"active"`
+}
+
+// MatchConfig describes a StringMatch. Type is one of "exact", "prefix" or "regex".
+type MatchConfig struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NamedMatch describes a header or query parameter match.
+type NamedMatch struct {
+	Name string `json:"name"`
+	MatchConfig
+}
+
+// RewriteConfig describes a path Rewrite. StripPrefix strips whole path
+// segments only.
+type RewriteConfig struct {
+	StripPrefix string `json:"strip_prefix"`
+	AddPrefix   string `json:"add_prefix"`
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+// RedirectConfig describes a Redirect.
+type RedirectConfig struct {
+	Code   int    `json:"code"`
+	Target string `json:"target"`
+}
+
+// Duration is a time.Duration that unmarshals from a JSON string such as "5s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load reads a JSON configuration file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Default returns the configuration used when no config file is given.
+func Default() *Config {
+	return &Config{
+		Port: "8000",
+		Pools: []PoolConfig{{
+			Name: "default",
+			Servers: []ServerConfig{
+				{Addr: "https://www.amazon.com"},
+				{Addr: "http://www.yahoo.com"},
+				{Addr: "http://www.instagram.com"},
+			},
+		}},
+		Fallback: &FallbackConfig{Pool: "default"},
+	}
+}
+
+// ConsulDiscoveryConfig discovers the healthy instances of a Consul
+// service. Addr defaults to the local agent and Scheme as for srv.
+type ConsulDiscoveryConfig struct {
+	Addr         string   `json:"addr"`
+	Service      string   `json:"service"`
+	Tags         []string `json:"tags"`
+	Datacenter   string   `json:"datacenter"`
+	Token        string   `json:"token"`
+	AllowWarning bool     `json:"allow_warning"`
+	Scheme       string   `json:"scheme"`
+}
+
+// EtcdDiscoveryConfig reads servers from the keys under an etcd prefix.
+type EtcdDiscoveryConfig struct {
+	Endpoints []string `json:"endpoints"`
+	Prefix    string   `json:"prefix"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+}
+
+// KubernetesDiscoveryConfig discovers the ready endpoints of a Kubernetes
+// Service. Without Kubeconfig, the API server of the cluster the LB runs in
+// is used. Port names the service port and Scheme is as for srv.
+type KubernetesDiscoveryConfig struct {
+	Kubeconfig string `json:"kubeconfig"`
+	Namespace  string `json:"namespace"`
+	Service    string `json:"service"`
+	Port       string `json:"port"`
+	Scheme     string `json:"scheme"`
+}
+
+// DockerDiscoveryConfig discovers the containers of the Docker daemon at
+// Host labeled "<label_prefix>.pool=<pool>". Pool defaults to the name of the
+// pool, LabelPrefix to "lb" and Scheme as for srv.
+type DockerDiscoveryConfig struct {
+	Host        string `json:"host"`
+	Pool        string `json:"pool"`
+	LabelPrefix string `json:"label_prefix"`
+	Network     string `json:"network"`
+	Scheme      string `json:"scheme"`
+}
+
+// SwarmDiscoveryConfig discovers the tasks of a Docker Swarm service
+// listening on Port. With DNS set, tasks are resolved through the
+// tasks.<service> name of Swarm's embedded DNS instead of the manager's API
+// at Host; Network is ignored then. Scheme is as for srv.
+type SwarmDiscoveryConfig struct {
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Port    int    `json:"port"`
+	Network string `json:"network"`
+	DNS     bool   `json:"dns"`
+	Scheme  string `json:"scheme"`
+}
+
+// NomadDiscoveryConfig discovers the allocations of a service in Nomad's
+// service catalog. Addr defaults to the local agent and Scheme as for srv.
+type NomadDiscoveryConfig struct {
+	Addr      string   `json:"addr"`
+	Service   string   `json:"service"`
+	Namespace string   `json:"namespace"`
+	Tags      []string `json:"tags"`
+	Token     string   `json:"token"`
+	Scheme    string   `json:"scheme"`
+}
+
+// EurekaDiscoveryConfig discovers the UP instances of an application in a
+// Eureka registry. Scheme is as for srv.
+type EurekaDiscoveryConfig struct {
+	URLs        []string `json:"urls"`
+	App         string   `json:"app"`
+	UseHostname bool     `json:"use_hostname"`
+	Secure      bool     `json:"secure"`
+	Scheme      string   `json:"scheme"`
+}
+
+// ZooKeeperDiscoveryConfig discovers the servers registered as children of
+// a znode. Scheme is as for srv and applies to Curator registrations.
+type ZooKeeperDiscoveryConfig struct {
+	Servers        []string `json:"servers"`
+	Path           string   `json:"path"`
+	SessionTimeout Duration `json:"session_timeout"`
+	Scheme         string   `json:"scheme"`
+}
+
+// FileDiscoveryConfig reads servers from a file that is watched for changes.
+type FileDiscoveryConfig struct {
+	Path         string   `json:"path"`
+	PollInterval Duration `json:"poll_interval"`
+}
+
+// EC2DiscoveryConfig discovers the running EC2 instances carrying Tags in
+// Regions, reached on their private IP and Port. Scheme is as for srv.
+type EC2DiscoveryConfig struct {
+	Regions  []string          `json:"regions"`
+	Tags     map[string]string `json:"tags"`
+	Port     int               `json:"port"`
+	Scheme   string            `json:"scheme"`
+	Endpoint string            `json:"endpoint"`
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// Checker probes servers in place of the HTTP GET and Prober probes of a
+// Check. Check returns nil if server is alive, giving up when ctx is done.
+type Checker interface {
+	Check(ctx context.Context, server backend.Server) error
+}
+
+// CheckerFunc adapts a function to a Checker.
+type CheckerFunc func(ctx context.Context, server backend.Server) error
+
+// Check implements Checker.
+func (f CheckerFunc) Check(ctx context.Context, server backend.Server) error {
+	return f(ctx, server)
+}
+
+// Factory creates a checker from its JSON configuration, which is empty if
+// none is given.
+type Factory func(config json.RawMessage) (Checker, error)
+
+var (
+	checkersMu sync.RWMutex
+	checkers   = map[string]Factory{
+		"tcp": newTCPChecker,
+	}
+)
+
+// Register makes a checker available under name to NewChecker and the
+// checker setting of health checks, usually from an init function. It
+// panics if name is empty, "http" or already registered.
+func Register(name string, factory Factory) {
+	checkersMu.Lock()
+	defer checkersMu.Unlock()
+	if name == "" || name == "http" || factory == nil {
+		panic("health: Register with a reserved name or nil factory")
+	}
+	if _, dup := checkers[name]; dup {
+		panic("health checker " + name + " registered twice")
+	}
+	checkers[name] = factory
+}
+
+// Names returns the names of the registered checkers, sorted.
+func Names() []string {
+	checkersMu.RLock()
+	defer checkersMu.RUnlock()
+	return slices.Sorted(maps.Keys(checkers))
+}
+
+// NewChecker returns the checker registered under name, configured with
+// config. The empty name and "http" return nil, which a Check takes for its
+// built-in probes.
+func NewChecker(name string, config json.RawMessage) (Checker, error) {
+	if name == "" || name == "http" {
+		return nil, nil
+	}
+	checkersMu.RLock()
+	factory := checkers[name]
+	checkersMu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown health checker %q", name)
+	}
+	return factory(config)
+}
+
+// newTCPChecker returns the "tcp" checker: servers are alive if they accept
+// TCP connections at the host and port of their address, be it a URL or
+// host:port.
+func newTCPChecker(json.RawMessage) (Checker, error) {
+	return CheckerFunc(func(ctx context.Context, server backend.Server) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", hostPort(server.Address()))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}), nil
+}
+
+// hostPort returns the host:port of addr, defaulting the port of URLs by
+// scheme.
+func hostPort(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "grpcs" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
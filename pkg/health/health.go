@@ -0,0 +1,174 @@
+// Package health probes the servers of a pool and records whether they are
+// alive.
+package health
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// Check configures active health probing of a pool's servers.
+// A zero Interval disables probing and servers are always considered alive.
+type Check struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Transport performs the probes; nil means the transport each server is
+	// proxied through.
+	Transport http.RoundTripper
+	// Checker, if set, probes the servers instead.
+	Checker Checker
+	// OnChange, if set, is called after a probe changed the liveness of
+	// server.
+	OnChange func(server backend.Server, alive bool)
+	// Clock paces the probes; nil means the system clock. Probe timeouts
+	// always run on the system clock.
+	Clock Clock
+}
+
+// Clock is the time source pacing probes, which tests replace to run
+// rounds on demand.
+type Clock interface {
+	// NewTicker returns a channel receiving ticks every d, and a function
+	// stopping them.
+	NewTicker(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+type systemClock struct{}
+
+func (systemClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// Prober is implemented by servers not probed over HTTP, such as TCP
+// servers, which are alive if they accept connections. Probe returns nil
+// if the server is alive, giving up when ctx is done.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// Proxied is implemented by servers proxied to over HTTP through a
+// transport of their own, which probes them too unless Transport is set,
+// at the URL their paths are relative to.
+type Proxied interface {
+	Transport() http.RoundTripper
+	URL() string
+}
+
+// Start probes the servers servers returns, every Interval in the
+// background, and updates their liveness until ctx is done, which also
+// abandons the probes under way. name names them in the log. It returns
+// immediately.
+func (c Check) Start(ctx context.Context, name string, servers func() []backend.Server) {
+	if c.Interval <= 0 {
+		return
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = c.Interval
+	}
+	go func() {
+		clock := c.Clock
+		if clock == nil {
+			clock = systemClock{}
+		}
+		ticks, stop := clock.NewTicker(c.Interval)
+		defer stop()
+		clients := map[backend.Server]*http.Client{}
+		for {
+			// The pool's servers may change between rounds.
+			servers := servers()
+			current := make(map[backend.Server]*http.Client, len(servers))
+			for _, server := range servers {
+				client := clients[server]
+				if client == nil {
+					transport := c.Transport
+					if s, ok := server.(Proxied); ok && transport == nil {
+						transport = s.Transport()
+					}
+					client = &http.Client{Transport: transport}
+				}
+				current[server] = client
+				c.probe(ctx, name, timeout, client, server)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+			clients = current
+			select {
+			case <-ticks:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// probe checks a single server within timeout and logs liveness
+// transitions. A probe abandoned because ctx is done leaves the server's
+// liveness as it was.
+func (c Check) probe(ctx context.Context, name string, timeout time.Duration, client *http.Client, server backend.Server) {
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	alive := false
+	var result any
+	if c.Checker != nil {
+		err := c.Checker.Check(pctx, server)
+		alive = err == nil
+		result = err
+	} else if p, ok := server.(Prober); ok {
+		err := p.Probe(pctx)
+		alive = err == nil
+		result = err
+	} else if resp, err := get(pctx, client, probeURL(server, c.Path)); err == nil {
+		resp.Body.Close()
+		alive = resp.StatusCode < http.StatusInternalServerError
+		result = resp.Status
+	} else {
+		result = err
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	slog.Debug("Health check", "pool", name, "server", server.Address(), "alive", alive, "result", result)
+	changed := alive != server.IsAlive()
+	if changed {
+		log.Printf("Pool %q: server %q is now %s", name, server.Address(), aliveString(alive))
+	}
+	server.SetAlive(alive)
+	if changed && c.OnChange != nil {
+		c.OnChange(server, alive)
+	}
+}
+
+// get sends a GET request for url with client, until ctx is done.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// probeURL returns the URL of path on server.
+func probeURL(server backend.Server, path string) string {
+	base := server.Address()
+	if s, ok := server.(Proxied); ok {
+		base = s.URL()
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func aliveString(alive bool) string {
+	if alive {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,124 @@
+// Package lbtest helps testing load balancer configurations and custom
+// strategies: mock backends with configurable latency, errors and
+// flakiness, a fake clock running health checks on demand, and helpers
+// sending traffic and asserting how it was distributed.
+package lbtest
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BackendHeader is the response header mock backends and servers set to
+// their name, which Distribute counts responses by.
+const BackendHeader = "X-Lbtest-Backend"
+
+// Backend is a mock HTTP backend answering every request with its name,
+// after its latency, unless it injects an error. Its URL is that of the
+// embedded test server. The behavior can be changed while it serves.
+type Backend struct {
+	*httptest.Server
+	Name string
+
+	latency   atomic.Int64
+	jitter    atomic.Int64
+	errorRate atomic.Uint64
+	dropRate  atomic.Uint64
+	down      atomic.Bool
+	requests  atomic.Int64
+	failures  atomic.Int64
+}
+
+// NewBackend starts a mock backend named name, closed when t's test ends.
+func NewBackend(t testing.TB, name string) *Backend {
+	t.Helper()
+	b := &Backend{Name: name}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// SetLatency delays every response by latency, plus a uniformly random
+// duration up to jitter.
+func (b *Backend) SetLatency(latency, jitter time.Duration) {
+	b.latency.Store(int64(latency))
+	b.jitter.Store(int64(jitter))
+}
+
+// SetErrorRate makes the backend answer the given fraction of requests,
+// between 0 and 1, with 500 Internal Server Error.
+func (b *Backend) SetErrorRate(rate float64) {
+	b.errorRate.Store(math.Float64bits(rate))
+}
+
+// SetDropRate makes the backend close the connection of the given fraction
+// of requests without answering, as a flaky server would.
+func (b *Backend) SetDropRate(rate float64) {
+	b.dropRate.Store(math.Float64bits(rate))
+}
+
+// SetDown makes the backend answer every request, health checks included,
+// with 503 Service Unavailable until it is set up again.
+func (b *Backend) SetDown(down bool) {
+	b.down.Store(down)
+}
+
+// Requests returns the number of requests the backend received.
+func (b *Backend) Requests() int64 {
+	return b.requests.Load()
+}
+
+// Failures returns the number of requests the backend failed, by answering
+// them with an error or dropping them.
+func (b *Backend) Failures() int64 {
+	return b.failures.Load()
+}
+
+// Reset zeroes the request and failure counts.
+func (b *Backend) Reset() {
+	b.requests.Store(0)
+	b.failures.Store(0)
+}
+
+func (b *Backend) serve(rw http.ResponseWriter, r *http.Request) {
+	b.requests.Add(1)
+	if d := time.Duration(b.latency.Load()); d > 0 || b.jitter.Load() > 0 {
+		if j := b.jitter.Load(); j > 0 {
+			d += time.Duration(rand.Int64N(j))
+		}
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	rw.Header().Set(BackendHeader, b.Name)
+	switch {
+	case b.down.Load():
+		b.failures.Add(1)
+		http.Error(rw, b.Name+" is down", http.StatusServiceUnavailable)
+	case hit(&b.dropRate):
+		b.failures.Add(1)
+		if conn, _, err := http.NewResponseController(rw).Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+		panic(http.ErrAbortHandler)
+	case hit(&b.errorRate):
+		b.failures.Add(1)
+		http.Error(rw, "injected error", http.StatusInternalServerError)
+	default:
+		rw.Write([]byte(b.Name))
+	}
+}
+
+// hit reports whether a random draw falls within the rate stored in r.
+func hit(r *atomic.Uint64) bool {
+	rate := math.Float64frombits(r.Load())
+	return rate > 0 && rand.Float64() < rate
+}
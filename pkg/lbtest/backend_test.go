@@ -0,0 +1,84 @@
+package lbtest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// post sends a request to b, which the client does not retry once
+// dropped, and returns the status of its response and its body, or the
+// error getting it.
+func post(t *testing.T, b *Backend) (int, string, error) {
+	t.Helper()
+	resp, err := b.Client().Post(b.URL, "text/plain", nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if got := resp.Header.Get(BackendHeader); got != b.Name {
+		t.Errorf("%s header %q, want %q", BackendHeader, got, b.Name)
+	}
+	return resp.StatusCode, string(body), err
+}
+
+func TestBackend(t *testing.T) {
+	b := NewBackend(t, "a")
+	if code, body, err := post(t, b); err != nil || code != http.StatusOK || body != "a" {
+		t.Errorf("got %d %q, %v; want 200 \"a\"", code, body, err)
+	}
+	b.SetErrorRate(1)
+	if code, _, _ := post(t, b); code != http.StatusInternalServerError {
+		t.Errorf("with errors: got %d, want 500", code)
+	}
+	b.SetErrorRate(0)
+	b.SetDown(true)
+	if code, _, _ := post(t, b); code != http.StatusServiceUnavailable {
+		t.Errorf("down: got %d, want 503", code)
+	}
+	b.SetDown(false)
+	b.SetDropRate(1)
+	if _, _, err := post(t, b); err == nil {
+		t.Error("dropped request answered")
+	}
+	if got := b.Requests(); got != 4 {
+		t.Errorf("Requests %d, want 4", got)
+	}
+	if got := b.Failures(); got != 3 {
+		t.Errorf("Failures %d, want 3", got)
+	}
+	b.Reset()
+	if b.Requests() != 0 || b.Failures() != 0 {
+		t.Error("counts not reset")
+	}
+}
+
+func TestBackendLatency(t *testing.T) {
+	b := NewBackend(t, "a")
+	b.SetLatency(50*time.Millisecond, 10*time.Millisecond)
+	start := time.Now()
+	if code, _, err := post(t, b); err != nil || code != http.StatusOK {
+		t.Fatalf("got %d, %v", code, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("answered after %v, want 50ms at least", d)
+	}
+}
+
+// TestBackendRates checks that error rates fail about their share of
+// requests.
+func TestBackendRates(t *testing.T) {
+	b := NewBackend(t, "a")
+	b.SetErrorRate(0.25)
+	codes := map[string]int{}
+	for range 400 {
+		code, _, err := post(t, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes[http.StatusText(code)]++
+	}
+	AssertDistribution(t, codes, map[string]float64{"OK": 3, "Internal Server Error": 1}, 0.1)
+}
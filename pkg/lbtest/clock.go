@@ -0,0 +1,111 @@
+package lbtest
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is a fake health.Clock whose time only moves when advanced, so that
+// tests run health check rounds when they choose to.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*ticker
+	added   chan struct{}
+}
+
+type ticker struct {
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+// NewClock returns a clock reading now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, added: make(chan struct{}, 1)}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker implements health.Clock. Its ticks are delivered by Advance.
+func (c *Clock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &ticker{c: make(chan time.Time), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+	return t.c, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.tickers = slices.DeleteFunc(c.tickers, func(o *ticker) bool { return o == t })
+	}
+}
+
+// WaitForTicker waits until a ticker was created, such as that of a health
+// check being started, or timeout passed. It reports whether there is one.
+func (c *Clock) WaitForTicker(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.mu.Lock()
+		n := len(c.tickers)
+		c.mu.Unlock()
+		if n > 0 {
+			return true
+		}
+		select {
+		case <-c.added:
+		case <-time.After(time.Until(deadline)):
+			return false
+		}
+	}
+}
+
+// Advance moves the clock forward by d and delivers the ticks that became
+// due, at most one per ticker as time.Ticker does. Ticks are delivered
+// synchronously: Advance returns once each was received, so for a health
+// check the round it started is under way, and advancing again waits for
+// that round to complete. Tickers stopped meanwhile are skipped.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*ticker
+	for _, t := range c.tickers {
+		if !t.next.After(now) {
+			due = append(due, t)
+			for !t.next.After(now) {
+				t.next = t.next.Add(t.period)
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		c.deliver(t, now)
+	}
+}
+
+// deliver sends the tick now to t, until it is received or t is stopped.
+func (c *Clock) deliver(t *ticker, now time.Time) {
+	for {
+		select {
+		case t.c <- now:
+			return
+		case <-time.After(10 * time.Millisecond):
+			c.mu.Lock()
+			stopped := !slices.Contains(c.tickers, t)
+			c.mu.Unlock()
+			if stopped {
+				return
+			}
+		}
+	}
+}
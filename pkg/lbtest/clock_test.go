@@ -0,0 +1,93 @@
+package lbtest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+)
+
+func TestClockTicks(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClock(start)
+	ticks, stop := c.NewTicker(time.Second)
+	if !c.WaitForTicker(time.Second) {
+		t.Fatal("no ticker")
+	}
+	got := make(chan time.Time, 10)
+	go func() {
+		for tick := range ticks {
+			got <- tick
+		}
+	}()
+	c.Advance(500 * time.Millisecond)
+	c.Advance(500 * time.Millisecond)
+	// Ticks missed are dropped, as time.Ticker does.
+	c.Advance(3 * time.Second)
+	if want := start.Add(4 * time.Second); !c.Now().Equal(want) {
+		t.Errorf("Now %v, want %v", c.Now(), want)
+	}
+	stop()
+	c.Advance(time.Second)
+	for _, want := range []time.Time{start.Add(time.Second), start.Add(4 * time.Second)} {
+		select {
+		case tick := <-got:
+			if !tick.Equal(want) {
+				t.Errorf("tick %v, want %v", tick, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no tick at %v", want)
+		}
+	}
+	select {
+	case tick := <-got:
+		t.Errorf("tick %v after stopping", tick)
+	default:
+	}
+}
+
+func TestClockWaitForTickerTimeout(t *testing.T) {
+	if NewClock(time.Now()).WaitForTicker(10 * time.Millisecond) {
+		t.Error("found a ticker none created")
+	}
+}
+
+// TestClockHealthCheck checks that health checks paced by a clock run
+// their rounds as it is advanced.
+func TestClockHealthCheck(t *testing.T) {
+	c := NewClock(time.Now())
+	server := NewServer("a", 1)
+	var rounds atomic.Int32
+	var down atomic.Bool
+	check := health.Check{
+		Interval: 10 * time.Second,
+		Clock:    c,
+		Checker: health.CheckerFunc(func(context.Context, backend.Server) error {
+			rounds.Add(1)
+			if down.Load() {
+				return errors.New("down")
+			}
+			return nil
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	check.Start(ctx, "pool", func() []backend.Server { return []backend.Server{server} })
+	if !c.WaitForTicker(time.Second) {
+		t.Fatal("health check not started")
+	}
+	down.Store(true)
+	c.Advance(10 * time.Second)
+	// Advancing again waits for the round under way.
+	c.Advance(10 * time.Second)
+	if server.IsAlive() {
+		t.Error("server alive after failing a round")
+	}
+	if n := rounds.Load(); n < 2 {
+		t.Errorf("%d rounds, want 2 at least", n)
+	}
+}
@@ -0,0 +1,125 @@
+package lbtest
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+// Server is a fake backend.Server for testing strategies without a
+// network, answering requests with its address in BackendHeader.
+type Server struct {
+	backend.Weighting
+	backend.Counters
+	addr  string
+	alive atomic.Bool
+}
+
+// NewServer returns a live server with the given address and weight.
+func NewServer(addr string, weight int) *Server {
+	s := &Server{addr: addr}
+	s.SetWeight(weight)
+	s.alive.Store(true)
+	return s
+}
+
+// Servers returns live servers of weight 1 with the given addresses.
+func Servers(addrs ...string) []backend.Server {
+	servers := make([]backend.Server, len(addrs))
+	for i, addr := range addrs {
+		servers[i] = NewServer(addr, 1)
+	}
+	return servers
+}
+
+func (s *Server) Address() string     { return s.addr }
+func (s *Server) IsAlive() bool       { return s.alive.Load() }
+func (s *Server) SetAlive(alive bool) { s.alive.Store(alive) }
+func (s *Server) Serve(rw http.ResponseWriter, r *http.Request) {
+	s.Start()
+	defer s.Done()
+	rw.Header().Set(BackendHeader, s.addr)
+}
+
+// Pick calls s.Next n times over servers and returns how many times each
+// server was picked, by address. Picks of no server count under "".
+func Pick(s strategy.Strategy, servers []backend.Server, n int) map[string]int {
+	counts := map[string]int{}
+	for range n {
+		addr := ""
+		if server := s.Next(servers); server != nil {
+			addr = server.Address()
+		}
+		counts[addr]++
+	}
+	return counts
+}
+
+// Distribute sends n requests made by newRequest to h, one after the other,
+// and returns how many each backend answered, by the name in BackendHeader.
+// Responses without one count under "". A nil newRequest sends GET /.
+func Distribute(h http.Handler, n int, newRequest func() *http.Request) map[string]int {
+	if newRequest == nil {
+		newRequest = func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) }
+	}
+	counts := map[string]int{}
+	for range n {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newRequest())
+		counts[rec.Result().Header.Get(BackendHeader)]++
+	}
+	return counts
+}
+
+// AssertDistribution fails t unless the share of counts of each key is
+// within tolerance of its share of want, both normalized to fractions of
+// their totals: want may hold weights. Keys missing from want have a share
+// of zero. For example, with a tolerance of 0.05 and want {"a": 1, "b": 3},
+// a must have between 20% and 30% of the counts.
+func AssertDistribution(t testing.TB, counts map[string]int, want map[string]float64, tolerance float64) {
+	t.Helper()
+	if err := CheckDistribution(counts, want, tolerance); err != nil {
+		t.Error(err)
+	}
+}
+
+// CheckDistribution is AssertDistribution returning the mismatch as an
+// error.
+func CheckDistribution(counts map[string]int, want map[string]float64, tolerance float64) error {
+	var total, wantTotal float64
+	for _, n := range counts {
+		total += float64(n)
+	}
+	for _, w := range want {
+		wantTotal += w
+	}
+	if total == 0 || wantTotal == 0 {
+		return fmt.Errorf("distribution: got %d requests, want shares %v", int(total), want)
+	}
+	keys := slices.Sorted(maps.Keys(counts))
+	for k := range want {
+		if _, ok := counts[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	var bad []string
+	for _, k := range keys {
+		got, exp := float64(counts[k])/total, want[k]/wantTotal
+		if math.Abs(got-exp) > tolerance {
+			bad = append(bad, fmt.Sprintf("%q got %.1f%%, want %.1f%%", k, got*100, exp*100))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("distribution of %d requests off by more than %.1f%%: %s", int(total), tolerance*100, strings.Join(bad, ", "))
+	}
+	return nil
+}
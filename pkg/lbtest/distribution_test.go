@@ -0,0 +1,73 @@
+package lbtest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+func TestPick(t *testing.T) {
+	servers := Servers("a", "b", "c")
+	counts := Pick(&strategy.RoundRobin{}, servers, 300)
+	AssertDistribution(t, counts, map[string]float64{"a": 1, "b": 1, "c": 1}, 0.01)
+	servers[2].SetAlive(false)
+	if counts := Pick(&strategy.RoundRobin{}, servers, 300); counts["c"] != 0 || counts[""] != 0 {
+		t.Errorf("with c down, got %v", counts)
+	}
+
+	for _, s := range servers {
+		s.SetAlive(false)
+	}
+	if counts := Pick(&strategy.RoundRobin{}, servers, 10); counts[""] != 10 {
+		t.Errorf("with no server alive, got %v", counts)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	servers := []backend.Server{NewServer("a", 1), NewServer("b", 3)}
+	counts := Pick(&strategy.WeightedRoundRobin{}, servers, 400)
+	if counts["a"] != 100 || counts["b"] != 300 {
+		t.Errorf("got %v, want a 100 and b 300", counts)
+	}
+}
+
+func TestDistribute(t *testing.T) {
+	servers := Servers("a", "b")
+	rr := &strategy.RoundRobin{}
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rr.Next(servers).Serve(rw, r)
+	})
+	counts := Distribute(h, 100, nil)
+	if counts["a"] != 50 || counts["b"] != 50 {
+		t.Errorf("got %v, want 50 each", counts)
+	}
+	if counts := Distribute(http.NotFoundHandler(), 3, nil); counts[""] != 3 {
+		t.Errorf("without the header, got %v", counts)
+	}
+}
+
+func TestCheckDistribution(t *testing.T) {
+	for _, tc := range []struct {
+		counts map[string]int
+		want   map[string]float64
+		err    string
+	}{
+		{map[string]int{"a": 25, "b": 75}, map[string]float64{"a": 1, "b": 3}, ""},
+		{map[string]int{"a": 28, "b": 72}, map[string]float64{"a": 0.25, "b": 0.75}, ""},
+		{map[string]int{"a": 50, "b": 50}, map[string]float64{"a": 1, "b": 3}, `"a" got 50.0%, want 25.0%`},
+		{map[string]int{"a": 90, "c": 10}, map[string]float64{"a": 1}, `"c" got 10.0%, want 0.0%`},
+		{map[string]int{"a": 100}, map[string]float64{"a": 1, "b": 1}, `"b" got 0.0%, want 50.0%`},
+		{map[string]int{}, map[string]float64{"a": 1}, "got 0 requests"},
+	} {
+		err := CheckDistribution(tc.counts, tc.want, 0.05)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%v against %v: %v", tc.counts, tc.want, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%v against %v: got %v, want %q", tc.counts, tc.want, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	abuseBans = metrics.NewCounterVec("lb_abuse_bans_total",
+		"Clients banned by abuse detection, by reason: velocity, errors or manual.", "reason")
+	abuseRefused = metrics.NewCounterVec("lb_abuse_refused_total",
+		"Requests refused because their client is banned.")
+)
+
+// Reasons of bans.
+const (
+	BanVelocity = "velocity"
+	BanErrors   = "errors"
+	BanManual   = "manual"
+)
+
+// Defaults of the AbuseGuard fields.
+const (
+	defaultAbuseWindow      = time.Minute
+	defaultAbuseMinRequests = 20
+	defaultBanDuration      = time.Minute
+	defaultMaxBanDuration   = 24 * time.Hour
+	defaultAbuseMaxClients  = 100000
+	// abuseStoreRefresh is how often the bans of a client are read from
+	// the Store of an AbuseGuard, so that not every request queries it.
+	abuseStoreRefresh = time.Second
+	// abuseStoreTimeout bounds the writes of bans to the Store.
+	abuseStoreTimeout = 2 * time.Second
+	// sharedBanPrefix prefixes the keys of the bans in the Store.
+	sharedBanPrefix = "ban:"
+)
+
+// AbuseGuard bans clients, by address, that send more than MaxRequests
+// requests within a Window, or whose responses within a Window are errors,
+// with a status of 400 or more, at a rate of MaxErrorRate or more once they
+// sent MinRequests. Requests of banned clients are answered with Status,
+// 429 Too Many Requests or 403 Forbidden, and a Retry-After header.
+//
+// A first ban lasts BanDuration, and every further one twice as long as the
+// previous, up to MaxBanDuration; a client that went MaxBanDuration without
+// a ban starts over. Up to MaxClients clients are tracked; past it, clients
+// not banned are forgotten first.
+//
+// With a Store, bans are shared with the load balancers using the same one,
+// under "ban:<address>": a client banned by one is banned by all of them
+// within a second. Unban deletes the ban from the Store, but the load
+// balancers that read it already keep it. Requests and errors are still
+// counted per load balancer.
+//
+// Zero fields take their defaults: a one minute Window and BanDuration, a
+// MinRequests of 20, a MaxBanDuration of 24 hours, 429 and 100000 clients.
+// A zero MaxRequests or MaxErrorRate disables that check.
+type AbuseGuard struct {
+	Window         time.Duration
+	MaxRequests    int
+	MaxErrorRate   float64
+	MinRequests    int
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+	Status         int
+	MaxClients     int
+	Store          SharedStore
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*abuseClient
+	lastSweep time.Time
+}
+
+// abuseClient is the activity of a client in its current window, and its
+// ban history.
+type abuseClient struct {
+	start    time.Time
+	requests int
+	errors   int
+
+	until    time.Time
+	reason   string
+	offenses int
+	// checked is when the bans of the client were last read from the
+	// Store.
+	checked time.Time
+}
+
+// Ban is a banned client.
+type Ban struct {
+	IP     netip.Addr `json:"ip"`
+	Until  time.Time  `json:"until"`
+	Reason string     `json:"reason"`
+	// Offenses counts the bans of the client, this one included, that
+	// the length of its next ban follows from.
+	Offenses int `json:"offenses"`
+}
+
+// Middleware returns the middleware refusing the requests of banned
+// clients, identified by their address after the forwarding headers of
+// trusted proxies are resolved, and banning the clients found abusive.
+func (g *AbuseGuard) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if !ip.IsValid() {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			if g.Store != nil {
+				g.fetch(r.Context(), ip, time.Now())
+			}
+			if retry, banned := g.request(ip, time.Now()); banned {
+				abuseRefused.Inc()
+				status := cmp.Or(g.Status, http.StatusTooManyRequests)
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				httpError(rw, r, strconv.Itoa(status)+" "+http.StatusText(status), status)
+				return
+			}
+			aw := &abuseWriter{ResponseWriter: rw, status: http.StatusOK}
+			next.ServeHTTP(aw, r)
+			g.response(ip, aw.status >= http.StatusBadRequest, time.Now())
+		})
+	}
+}
+
+// request counts a request of the client at ip and reports whether it is
+// banned, and if so for how long.
+func (g *AbuseGuard) request(ip netip.Addr, now time.Time) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.client(ip, now)
+	if now.Before(c.until) {
+		return c.until.Sub(now), true
+	}
+	if now.Sub(c.start) >= cmp.Or(g.Window, defaultAbuseWindow) {
+		c.start, c.requests, c.errors = now, 0, 0
+	}
+	c.requests++
+	if g.MaxRequests > 0 && c.requests > g.MaxRequests {
+		g.ban(ip, c, BanVelocity, 0, now)
+		return c.until.Sub(now), true
+	}
+	return 0, false
+}
+
+// response records whether the response to a request of the client at ip
+// was an error.
+func (g *AbuseGuard) response(ip netip.Addr, failed bool, now time.Time) {
+	if !failed || g.MaxErrorRate <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.clients[ip]
+	if c == nil || now.Before(c.until) {
+		return
+	}
+	c.errors++
+	if c.requests >= cmp.Or(g.MinRequests, defaultAbuseMinRequests) && float64(c.errors)/float64(c.requests) >= g.MaxErrorRate {
+		g.ban(ip, c, BanErrors, 0, now)
+	}
+}
+
+// client returns the entry of the client at ip, creating it if needed, and
+// forgets the clients gone quiet first. g.mu must be held.
+func (g *AbuseGuard) client(ip netip.Addr, now time.Time) *abuseClient {
+	window := cmp.Or(g.Window, defaultAbuseWindow)
+	if g.clients == nil {
+		g.clients = map[netip.Addr]*abuseClient{}
+	}
+	if now.Sub(g.lastSweep) >= window {
+		for addr, c := range g.clients {
+			if now.Sub(c.start) >= window && g.forgiven(c, now) {
+				g.forget(addr)
+				tableEvictions.Inc("abuse_clients", "expired")
+			}
+		}
+		g.lastSweep = now
+	}
+	c := g.clients[ip]
+	if c == nil {
+		if len(g.clients) >= cmp.Or(g.MaxClients, defaultAbuseMaxClients) {
+			g.evict(now)
+		}
+		c = &abuseClient{start: now}
+		g.clients[ip] = c
+		tableEntries.Inc("abuse_clients")
+	}
+	return c
+}
+
+// forgiven reports whether c is neither banned nor remembered for its past
+// bans.
+func (g *AbuseGuard) forgiven(c *abuseClient, now time.Time) bool {
+	return c.offenses == 0 || now.Sub(c.until) >= cmp.Or(g.MaxBanDuration, defaultMaxBanDuration)
+}
+
+// evict forgets a client to make room for another, preferring one that is
+// not banned.
+func (g *AbuseGuard) evict(now time.Time) {
+	var victim netip.Addr
+	for addr, c := range g.clients {
+		victim = addr
+		if !now.Before(c.until) {
+			break
+		}
+	}
+	g.forget(victim)
+	tableEvictions.Inc("abuse_clients", "capacity")
+}
+
+func (g *AbuseGuard) forget(ip netip.Addr) {
+	delete(g.clients, ip)
+	tableEntries.Dec("abuse_clients")
+}
+
+// ban bans the client c at ip for d, or for the length its offenses call
+// for if d is zero. g.mu must be held.
+func (g *AbuseGuard) ban(ip netip.Addr, c *abuseClient, reason string, d time.Duration, now time.Time) {
+	maxBan := cmp.Or(g.MaxBanDuration, defaultMaxBanDuration)
+	if g.forgiven(c, now) {
+		c.offenses = 0
+	}
+	if d <= 0 {
+		d = cmp.Or(g.BanDuration, defaultBanDuration)
+		for i := 0; i < c.offenses && d < maxBan; i++ {
+			d *= 2
+		}
+		d = min(d, maxBan)
+	}
+	c.offenses++
+	c.until, c.reason = now.Add(d), reason
+	c.start, c.requests, c.errors = now, 0, 0
+	abuseBans.Inc(reason)
+	logf("Abuse: banned %s for %v (%s, offense %d)", logIP(ip), d, reason, c.offenses)
+	if g.Store != nil {
+		go g.share(Ban{IP: ip, Until: c.until, Reason: reason, Offenses: c.offenses})
+	}
+}
+
+// fetch reads the ban of the client at ip from the Store, unless it is
+// banned already or was read within abuseStoreRefresh, and bans it if the
+// ban is longer than its own.
+func (g *AbuseGuard) fetch(ctx context.Context, ip netip.Addr, now time.Time) {
+	g.mu.Lock()
+	c := g.client(ip, now)
+	if now.Before(c.until) || now.Sub(c.checked) < abuseStoreRefresh {
+		g.mu.Unlock()
+		return
+	}
+	c.checked = now
+	g.mu.Unlock()
+	v, ok, err := g.Store.Get(ctx, sharedBanPrefix+ip.String())
+	if err != nil {
+		if ctx.Err() == nil {
+			logf("Abuse: reading the ban of %s: %v", logIP(ip), err)
+		}
+		return
+	}
+	if !ok {
+		return
+	}
+	b, err := decodeBan(ip, string(v))
+	if err != nil {
+		logf("Abuse: %v", err)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c := g.client(ip, now); b.Until.After(c.until) {
+		c.until, c.reason, c.offenses = b.Until, b.Reason, max(c.offenses, b.Offenses)
+		c.start, c.requests, c.errors = now, 0, 0
+	}
+}
+
+// share writes b to the Store, until it ends.
+func (g *AbuseGuard) share(b Ban) {
+	ctx, cancel := context.WithTimeout(context.Background(), abuseStoreTimeout)
+	defer cancel()
+	v := strconv.FormatInt(b.Until.UnixMilli(), 10) + "|" + b.Reason + "|" + strconv.Itoa(b.Offenses)
+	if err := g.Store.Set(ctx, sharedBanPrefix+b.IP.String(), []byte(v), time.Until(b.Until)); err != nil {
+		logf("Abuse: sharing the ban of %s: %v", logIP(b.IP), err)
+	}
+}
+
+// decodeBan parses a ban of the client at ip as share writes it:
+// "<until>|<reason>|<offenses>", with until in Unix milliseconds.
+func decodeBan(ip netip.Addr, s string) (Ban, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 3 {
+		return Ban{}, fmt.Errorf("malformed ban of %s: %q", logIP(ip), s)
+	}
+	until, err1 := strconv.ParseInt(parts[0], 10, 64)
+	offenses, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return Ban{}, fmt.Errorf("malformed ban of %s: %q", logIP(ip), s)
+	}
+	return Ban{IP: ip, Until: time.UnixMilli(until), Reason: parts[1], Offenses: offenses}, nil
+}
+
+// Ban bans the client at ip for d, or for as long as it would be banned
+// for its next offense if d is zero, and returns the ban.
+func (g *AbuseGuard) Ban(ip netip.Addr, d time.Duration) Ban {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.client(ip, now)
+	g.ban(ip, c, BanManual, d, now)
+	return Ban{IP: ip, Until: c.until, Reason: c.reason, Offenses: c.offenses}
+}
+
+// Unban lifts the ban of the client at ip and forgets its past bans, and
+// deletes it from the Store. It reports whether the client was banned here.
+func (g *AbuseGuard) Unban(ip netip.Addr) bool {
+	if g.Store != nil {
+		go g.unshare(ip)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.clients[ip]
+	if c == nil {
+		return false
+	}
+	banned := time.Now().Before(c.until)
+	g.forget(ip)
+	return banned
+}
+
+// unshare deletes the ban of the client at ip from the Store.
+func (g *AbuseGuard) unshare(ip netip.Addr) {
+	ctx, cancel := context.WithTimeout(context.Background(), abuseStoreTimeout)
+	defer cancel()
+	if err := g.Store.Delete(ctx, sharedBanPrefix+ip.String()); err != nil {
+		logf("Abuse: deleting the ban of %s: %v", logIP(ip), err)
+	}
+}
+
+// Bans returns the clients banned, by address.
+func (g *AbuseGuard) Bans() []Ban {
+	now := time.Now()
+	g.mu.Lock()
+	bans := []Ban{}
+	for ip, c := range g.clients {
+		if now.Before(c.until) {
+			bans = append(bans, Ban{IP: ip, Until: c.until, Reason: c.reason, Offenses: c.offenses})
+		}
+	}
+	g.mu.Unlock()
+	slices.SortFunc(bans, func(a, b Ban) int { return a.IP.Compare(b.IP) })
+	return bans
+}
+
+// restore bans the clients of bans, as returned by Bans, that are still
+// due to be banned.
+func (g *AbuseGuard) restore(bans []Ban) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, b := range bans {
+		if !b.IP.IsValid() || !now.Before(b.Until) {
+			continue
+		}
+		c := g.client(b.IP, now)
+		c.until, c.reason, c.offenses = b.Until, b.Reason, b.Offenses
+	}
+}
+
+// abuseWriter records the status of a response.
+type abuseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *abuseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *abuseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *abuseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
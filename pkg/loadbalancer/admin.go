@@ -0,0 +1,1099 @@
+package loadbalancer
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+// AdminHandler serves the runtime administration API of a LoadBalancer.
+// Once tokens or clients are added, every request must authenticate with
+// one of them and is limited to the role granted.
+type AdminHandler struct {
+	lb  *LoadBalancer
+	mux *http.ServeMux
+	// state is the load balancer whose state file keeps the runtime state
+	// of lb: lb itself, or the main one for a frontend.
+	state *LoadBalancer
+
+	tokens  map[string]AdminRole
+	clients map[string]AdminRole
+	// frontends holds the admin APIs of the other frontends of the
+	// service, served under /frontends/<name>/ with the same credentials.
+	frontends map[string]*AdminHandler
+}
+
+// NewAdminHandler creates the admin API for lb.
+func NewAdminHandler(lb *LoadBalancer) *AdminHandler {
+	h := &AdminHandler{lb: lb, mux: http.NewServeMux(), state: lb}
+	h.mux.HandleFunc("GET /{$}", h.handleUI)
+	h.mux.HandleFunc("GET /ui", h.handleUI)
+	h.mux.HandleFunc("GET /openapi.json", h.handleOpenAPI)
+	h.mux.HandleFunc("GET /metrics", h.handleMetrics)
+	h.mux.HandleFunc("GET /livez", h.handleLivez)
+	h.mux.HandleFunc("GET /readyz", h.handleReadyz)
+	h.mux.HandleFunc("GET /routes/{name}/splits", h.handleGetSplits)
+	h.mux.HandleFunc("PUT /routes/{name}/splits", h.handleSetSplits)
+	h.mux.HandleFunc("GET /routes/{name}/bluegreen", h.handleGetBlueGreen)
+	h.mux.HandleFunc("POST /routes/{name}/switch", h.handleSwitch)
+	h.mux.HandleFunc("POST /routes/{name}/rollback", h.handleRollback)
+	h.mux.HandleFunc("POST /pools/{name}/registrations", h.handleRegister)
+	h.mux.HandleFunc("DELETE /pools/{name}/registrations", h.handleDeregister)
+	h.mux.HandleFunc("GET /pools", h.handleListPools)
+	h.mux.HandleFunc("POST /pools", h.handleAddPool)
+	h.mux.HandleFunc("GET /pools/{name}", h.handleGetPool)
+	h.mux.HandleFunc("DELETE /pools/{name}", h.handleRemovePool)
+	h.mux.HandleFunc("GET /pools/{name}/backends", h.handleListBackends)
+	h.mux.HandleFunc("POST /pools/{name}/backends", h.handleAddBackend)
+	h.mux.HandleFunc("PATCH /pools/{name}/backends", h.handleModifyBackend)
+	h.mux.HandleFunc("DELETE /pools/{name}/backends", h.handleRemoveBackend)
+	h.mux.HandleFunc("GET /pools/{name}/connections", h.handleListConnections)
+	h.mux.HandleFunc("PATCH /backends/{addr}", h.handleModifyAddr)
+	h.mux.HandleFunc("POST /pools/{name}/backends/drain", h.handleDrain)
+	h.mux.HandleFunc("POST /pools/{name}/backends/undrain", h.handleUndrain)
+	h.mux.HandleFunc("POST /pools/{name}/backends/disable", h.handleSetDisabled(true))
+	h.mux.HandleFunc("POST /pools/{name}/backends/enable", h.handleSetDisabled(false))
+	h.mux.HandleFunc("GET /maintenance", h.handleGetMaintenance)
+	h.mux.HandleFunc("POST /maintenance/enable", h.handleSetMaintenance(true))
+	h.mux.HandleFunc("POST /maintenance/disable", h.handleSetMaintenance(false))
+	h.mux.HandleFunc("POST /pools/{name}/maintenance/enable", h.handleSetPoolMaintenance(true))
+	h.mux.HandleFunc("POST /pools/{name}/maintenance/disable", h.handleSetPoolMaintenance(false))
+	h.mux.HandleFunc("GET /pools/{name}/datacenters", h.handleListDatacenters)
+	h.mux.HandleFunc("PUT /pools/{name}/datacenters/{datacenter}/weight", h.handleSetDatacenterWeight)
+	h.mux.HandleFunc("DELETE /pools/{name}/datacenters/{datacenter}/weight", h.handleResetDatacenterWeight)
+	h.mux.HandleFunc("GET /logging", h.handleGetLogging)
+	h.mux.HandleFunc("PATCH /logging", h.handleModifyLogging)
+	h.mux.HandleFunc("GET /state", h.handleGetState)
+	h.mux.HandleFunc("POST /state/save", h.handleSaveState)
+	h.mux.HandleFunc("GET /bans", h.handleListBans)
+	h.mux.HandleFunc("POST /bans", h.handleBan)
+	h.mux.HandleFunc("DELETE /bans/{ip}", h.handleUnban)
+	h.mux.HandleFunc("GET /ha", h.handleGetHA)
+	h.mux.HandleFunc("GET /cluster", h.handleGetCluster)
+	h.mux.HandleFunc("GET /fleet", h.handleGetFleet)
+	h.mux.HandleFunc("GET /explain", h.handleExplain)
+	h.mux.HandleFunc("GET /probes", h.handleListProbes)
+	h.mux.HandleFunc("GET /frontends", h.handleListFrontends)
+	h.mux.HandleFunc("/frontends/{frontend}/", h.handleFrontend)
+	return h
+}
+
+// ServeHTTP implements http.Handler. The probe endpoints need no
+// credentials, as orchestrators do not send any, nor do the web UI page,
+// which holds no data and sends the token the operator enters, and the API
+// description.
+func (h *AdminHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/livez", "/readyz", "/", "/ui", "/openapi.json":
+		h.mux.ServeHTTP(rw, r)
+		return
+	}
+	if !h.authorize(rw, r) {
+		return
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || strings.HasSuffix(r.URL.Path, "/state/save") {
+		h.mux.ServeHTTP(rw, r)
+		return
+	}
+	w := &adminWriter{ResponseWriter: rw}
+	h.mux.ServeHTTP(w, r)
+	if w.status < 300 {
+		// Keep the changes made through the API across restarts, those
+		// to the frontends included.
+		if err := h.lb.SaveState(); err != nil {
+			h.lb.logf("Failed to save runtime state: %v", err)
+		}
+	}
+}
+
+// adminWriter records the status of a response of the admin API.
+type adminWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *adminWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *adminWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *adminWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//go:embed admin_ui.html
+var adminUI []byte
+
+//go:embed admin_openapi.json
+var adminOpenAPI []byte
+
+// AddFrontend serves the admin API of lb, the load balancer of the frontend
+// named name, under /frontends/<name>/, as that of the main one is under /.
+func (h *AdminHandler) AddFrontend(name string, lb *LoadBalancer) {
+	if h.frontends == nil {
+		h.frontends = map[string]*AdminHandler{}
+	}
+	fh := NewAdminHandler(lb)
+	fh.state = h.lb
+	h.frontends[name] = fh
+}
+
+// handleListFrontends returns the names and ports of the other frontends.
+func (h *AdminHandler) handleListFrontends(rw http.ResponseWriter, r *http.Request) {
+	type frontend struct {
+		Name string `json:"name"`
+		Port string `json:"port"`
+	}
+	out := []frontend{}
+	for name, fh := range h.frontends {
+		out = append(out, frontend{Name: name, Port: fh.lb.Port()})
+	}
+	slices.SortFunc(out, func(a, b frontend) int { return strings.Compare(a.Name, b.Name) })
+	writeJSON(rw, http.StatusOK, out)
+}
+
+// handleFrontend serves a request of the admin API of a frontend, once
+// ServeHTTP authorized it.
+func (h *AdminHandler) handleFrontend(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("frontend")
+	fh, ok := h.frontends[name]
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Sprintf("frontend %q not found", name))
+		return
+	}
+	http.StripPrefix("/frontends/"+name, fh.mux).ServeHTTP(rw, r)
+}
+
+// handleOpenAPI serves the OpenAPI description of the admin API.
+func (h *AdminHandler) handleOpenAPI(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(adminOpenAPI)
+}
+
+// handleUI serves the web UI, a single page calling the admin API.
+func (h *AdminHandler) handleUI(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.Write(adminUI)
+}
+
+// handleLivez answers the liveness probe: the process is up and serving the
+// admin API.
+func (h *AdminHandler) handleLivez(rw http.ResponseWriter, r *http.Request) {
+	writeProbe(rw, r, "livez", []probeCheck{{"ping", nil}})
+}
+
+// handleReadyz answers the readiness probe: the load balancer serves its
+// listeners, is not shutting down, and has a backend to send requests to.
+func (h *AdminHandler) handleReadyz(rw http.ResponseWriter, r *http.Request) {
+	var serving, backends error
+	if !h.lb.Ready() {
+		serving = errors.New("not serving")
+	}
+	if !slices.ContainsFunc(h.lb.Pools(), func(p *Pool) bool { return slices.ContainsFunc(p.Servers(), backend.Available) }) {
+		backends = errors.New("no available backend")
+	}
+	writeProbe(rw, r, "readyz", []probeCheck{{"serving", serving}, {"backends", backends}})
+}
+
+type probeCheck struct {
+	name string
+	err  error
+}
+
+// writeProbe writes the result of a probe in the plain text format of the
+// Kubernetes API server: "ok", or every check with the verbose query
+// parameter or when one fails.
+func writeProbe(rw http.ResponseWriter, r *http.Request, name string, checks []probeCheck) {
+	failed := slices.ContainsFunc(checks, func(c probeCheck) bool { return c.err != nil })
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if failed {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if !failed && !r.URL.Query().Has("verbose") {
+		fmt.Fprintln(rw, "ok")
+		return
+	}
+	for _, c := range checks {
+		if c.err != nil {
+			fmt.Fprintf(rw, "[-]%s failed: %v\n", c.name, c.err)
+		} else {
+			fmt.Fprintf(rw, "[+]%s ok\n", c.name)
+		}
+	}
+	if failed {
+		fmt.Fprintf(rw, "%s check failed\n", name)
+	} else {
+		fmt.Fprintf(rw, "%s check passed\n", name)
+	}
+}
+
+func (h *AdminHandler) handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(rw)
+}
+
+func (h *AdminHandler) handleGetSplits(rw http.ResponseWriter, r *http.Request) {
+	rt := h.lb.Route(r.PathValue("name"))
+	if rt == nil {
+		writeError(rw, http.StatusNotFound, "unknown route")
+		return
+	}
+	splits := rt.Splits()
+	if splits == nil {
+		splits = []Split{}
+	}
+	writeJSON(rw, http.StatusOK, splits)
+}
+
+func (h *AdminHandler) handleSetSplits(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if h.lb.Route(name) == nil {
+		writeError(rw, http.StatusNotFound, "unknown route")
+		return
+	}
+	var splits []Split
+	if err := json.NewDecoder(r.Body).Decode(&splits); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if err := h.lb.SetRouteSplits(name, splits); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, h.lb.Route(name).Splits())
+}
+
+func (h *AdminHandler) handleGetBlueGreen(rw http.ResponseWriter, r *http.Request) {
+	bg, err := h.lb.blueGreen(r.PathValue("name"))
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, bg.Status())
+}
+
+// handleSwitch accepts an optional {"active": "blue"|"green"} body; without
+// one the inactive deployment becomes active.
+func (h *AdminHandler) handleSwitch(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	bg, err := h.lb.blueGreen(name)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	var body struct {
+		Active string `json:"active"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	if err := h.lb.SwitchRoute(name, body.Active); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, bg.Status())
+}
+
+func (h *AdminHandler) handleRollback(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	bg, err := h.lb.blueGreen(name)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := h.lb.RollbackRoute(name); err != nil {
+		writeError(rw, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, bg.Status())
+}
+
+// backendStatus is the admin API representation of a server.
+type backendStatus struct {
+	Addr     string `json:"addr"`
+	Alive    bool   `json:"alive"`
+	Weight   int    `json:"weight"`
+	Tier     int    `json:"tier"`
+	Draining bool   `json:"draining"`
+	Disabled bool   `json:"disabled"`
+	// InWindow is set while a maintenance window of the backend is open.
+	InWindow bool `json:"in_window,omitempty"`
+	// InFlight counts the requests, or connections of layer-4 pools, the
+	// backend is handling; a draining backend is drained once it is zero.
+	InFlight int64 `json:"in_flight"`
+	// Requests counts the requests, or connections, the backend was sent,
+	// and Failures those that failed.
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+}
+
+// poolStatus is the admin API representation of a pool.
+type poolStatus struct {
+	Name        string          `json:"name"`
+	Protocol    string          `json:"protocol,omitempty"`
+	Maintenance bool            `json:"maintenance"`
+	Backends    []backendStatus `json:"backends"`
+}
+
+func newBackendStatus(s backend.Server) backendStatus {
+	st := s.Stats()
+	bs := backendStatus{
+		Addr:     s.Address(),
+		Alive:    s.IsAlive(),
+		Weight:   s.Weight(),
+		Tier:     backend.TierOf(s),
+		InFlight: st.Active,
+		Requests: st.Total,
+		Failures: st.Failures,
+	}
+	if d, ok := s.(backend.Drainable); ok {
+		bs.Draining = d.Draining()
+	}
+	if d, ok := s.(backend.Disableable); ok {
+		bs.Disabled = d.Disabled()
+	}
+	if w, ok := s.(Windowed); ok {
+		bs.InWindow = w.InMaintenanceWindow()
+	}
+	return bs
+}
+
+func newPoolStatus(p *Pool) poolStatus {
+	ps := poolStatus{Name: p.Name, Protocol: p.Protocol, Maintenance: p.InMaintenance(), Backends: []backendStatus{}}
+	for _, s := range p.Servers() {
+		ps.Backends = append(ps.Backends, newBackendStatus(s))
+	}
+	return ps
+}
+
+func (h *AdminHandler) handleListPools(rw http.ResponseWriter, r *http.Request) {
+	pools := []poolStatus{}
+	for _, p := range h.lb.Pools() {
+		pools = append(pools, newPoolStatus(p))
+	}
+	writeJSON(rw, http.StatusOK, pools)
+}
+
+func (h *AdminHandler) handleGetPool(rw http.ResponseWriter, r *http.Request) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return
+	}
+	writeJSON(rw, http.StatusOK, newPoolStatus(pool))
+}
+
+// handleAddPool adds a pool described like a pool of the config file.
+func (h *AdminHandler) handleAddPool(rw http.ResponseWriter, r *http.Request) {
+	var pc config.PoolConfig
+	if err := json.NewDecoder(r.Body).Decode(&pc); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	pool, err := buildPool(pc, h.lb.upstream)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.lb.AddPool(pool); err != nil {
+		writeError(rw, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusCreated, newPoolStatus(pool))
+}
+
+func (h *AdminHandler) handleRemovePool(rw http.ResponseWriter, r *http.Request) {
+	switch err := h.lb.RemovePool(r.PathValue("name")); {
+	case errors.Is(err, ErrPoolNotFound):
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return
+	case err != nil:
+		writeError(rw, http.StatusConflict, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) handleListBackends(rw http.ResponseWriter, r *http.Request) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return
+	}
+	writeJSON(rw, http.StatusOK, newPoolStatus(pool).Backends)
+}
+
+// handleAddBackend adds a server described like a server of the config file.
+func (h *AdminHandler) handleAddBackend(rw http.ResponseWriter, r *http.Request) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return
+	}
+	var sc config.ServerConfig
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if pool.Server(sc.Addr) != nil {
+		writeError(rw, http.StatusConflict, "backend already exists")
+		return
+	}
+	s, err := pool.AddServerConfig(sc)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusCreated, newBackendStatus(s))
+}
+
+// backend returns the pool and server given by the name path value and the
+// addr query parameter.
+func (h *AdminHandler) backend(rw http.ResponseWriter, r *http.Request) (*Pool, backend.Server, bool) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return nil, nil, false
+	}
+	s := pool.Server(r.URL.Query().Get("addr"))
+	if s == nil {
+		writeError(rw, http.StatusNotFound, "unknown backend")
+		return nil, nil, false
+	}
+	return pool, s, true
+}
+
+// backendChange is the body of a backend modification; omitted fields are
+// left unchanged. Ramp, if set, moves the weight there gradually.
+type backendChange struct {
+	Weight *int            `json:"weight"`
+	Tier   *int            `json:"tier"`
+	Ramp   config.Duration `json:"ramp"`
+}
+
+func (c backendChange) validate() error {
+	if c.Weight != nil && *c.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if c.Ramp < 0 {
+		return fmt.Errorf("ramp must not be negative")
+	}
+	return nil
+}
+
+// apply applies the validated change to s, a server of pool.
+func (c backendChange) apply(pool *Pool, s backend.Server) error {
+	w, ok := s.(backend.WeightSetter)
+	if !ok {
+		return fmt.Errorf("backend has no weight")
+	}
+	if c.Weight != nil {
+		w.RampWeight(*c.Weight, time.Duration(c.Ramp))
+	}
+	if c.Tier != nil {
+		w.SetTier(*c.Tier)
+		pool.retier()
+	}
+	if c.Weight != nil && c.Ramp > 0 {
+		pool.logf("server %q ramping to weight %d over %v, tier %d", s.Address(), *c.Weight, time.Duration(c.Ramp), backend.TierOf(s))
+	} else {
+		pool.logf("server %q set to weight %d, tier %d", s.Address(), s.Weight(), backend.TierOf(s))
+	}
+	return nil
+}
+
+// handleModifyBackend changes the weight and tier of a server from a
+// {"weight": ..., "tier": ..., "ramp": ...} body.
+func (h *AdminHandler) handleModifyBackend(rw http.ResponseWriter, r *http.Request) {
+	pool, s, ok := h.backend(rw, r)
+	if !ok {
+		return
+	}
+	var c backendChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.apply(pool, s); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, newBackendStatus(s))
+}
+
+// poolBackendStatus is a backend status naming its pool.
+type poolBackendStatus struct {
+	Pool string `json:"pool"`
+	backendStatus
+}
+
+// handleModifyAddr changes the backend at the address in the path, escaped,
+// in every pool that has it or in the pool given by the pool query
+// parameter, as handleModifyBackend.
+func (h *AdminHandler) handleModifyAddr(rw http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	var c backendChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := r.URL.Query().Get("pool")
+	changed := []poolBackendStatus{}
+	for _, pool := range h.lb.Pools() {
+		if name != "" && pool.Name != name {
+			continue
+		}
+		s := pool.Server(addr)
+		if s == nil {
+			continue
+		}
+		if err := c.apply(pool, s); err != nil {
+			writeError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		changed = append(changed, poolBackendStatus{pool.Name, newBackendStatus(s)})
+	}
+	if len(changed) == 0 {
+		writeError(rw, http.StatusNotFound, "unknown backend")
+		return
+	}
+	writeJSON(rw, http.StatusOK, changed)
+}
+
+func (h *AdminHandler) handleRemoveBackend(rw http.ResponseWriter, r *http.Request) {
+	pool, s, ok := h.backend(rw, r)
+	if !ok {
+		return
+	}
+	pool.RemoveServer(s.Address())
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// connectionStatus is the admin API representation of an HTTP/2
+// connection to a backend.
+type connectionStatus struct {
+	Backend  string    `json:"backend"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	Protocol string    `json:"protocol"`
+	Opened   time.Time `json:"opened"`
+	Streams  int64     `json:"streams"`
+	Requests int64     `json:"requests"`
+}
+
+// handleListConnections lists the HTTP/2 connections to the backends of a
+// pool, with the streams multiplexed on each.
+func (h *AdminHandler) handleListConnections(rw http.ResponseWriter, r *http.Request) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return
+	}
+	conns := []connectionStatus{}
+	for _, s := range pool.Servers() {
+		hs, ok := s.(interface{ HTTP2Conns() []HTTP2Conn })
+		if !ok {
+			continue
+		}
+		for _, c := range hs.HTTP2Conns() {
+			conns = append(conns, connectionStatus{
+				Backend:  s.Address(),
+				Local:    c.Local,
+				Remote:   c.Remote,
+				Protocol: c.Protocol,
+				Opened:   c.Opened,
+				Streams:  c.Streams,
+				Requests: c.Requests,
+			})
+		}
+	}
+	writeJSON(rw, http.StatusOK, conns)
+}
+
+// handleDrain drains the backend given by the addr query parameter. With
+// sticky=true, clients pinned to it keep using it.
+func (h *AdminHandler) handleDrain(rw http.ResponseWriter, r *http.Request) {
+	pool, s, ok := h.backend(rw, r)
+	if !ok {
+		return
+	}
+	d, ok := s.(backend.Drainable)
+	if !ok {
+		writeError(rw, http.StatusBadRequest, "backend cannot be drained")
+		return
+	}
+	sticky := r.URL.Query().Get("sticky") == "true"
+	d.Drain(sticky)
+	pool.logf("server %q draining (sticky %t, %d in flight)", s.Address(), sticky, s.ActiveConnections())
+	writeJSON(rw, http.StatusOK, newBackendStatus(s))
+}
+
+func (h *AdminHandler) handleUndrain(rw http.ResponseWriter, r *http.Request) {
+	pool, s, ok := h.backend(rw, r)
+	if !ok {
+		return
+	}
+	d, ok := s.(backend.Drainable)
+	if !ok {
+		writeError(rw, http.StatusBadRequest, "backend cannot be drained")
+		return
+	}
+	d.Undrain()
+	pool.logf("server %q back in service", s.Address())
+	writeJSON(rw, http.StatusOK, newBackendStatus(s))
+}
+
+// handleSetDisabled disables or enables the backend given by the addr query
+// parameter.
+func (h *AdminHandler) handleSetDisabled(disabled bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		pool, s, ok := h.backend(rw, r)
+		if !ok {
+			return
+		}
+		d, ok := s.(backend.Disableable)
+		if !ok {
+			writeError(rw, http.StatusBadRequest, "backend cannot be disabled")
+			return
+		}
+		d.SetDisabled(disabled)
+		if disabled {
+			pool.logf("server %q disabled", s.Address())
+		} else {
+			pool.logf("server %q enabled", s.Address())
+		}
+		writeJSON(rw, http.StatusOK, newBackendStatus(s))
+	}
+}
+
+// maintenanceStatus is the admin API representation of the maintenance
+// switches.
+type maintenanceStatus struct {
+	Enabled bool     `json:"enabled"`
+	Routes  []string `json:"routes"`
+	Pools   []string `json:"pools"`
+}
+
+func (h *AdminHandler) maintenanceStatus() maintenanceStatus {
+	m := h.lb.Maintenance()
+	ms := maintenanceStatus{Enabled: m.Enabled(), Routes: m.Routes(), Pools: []string{}}
+	if ms.Routes == nil {
+		ms.Routes = []string{}
+	}
+	for _, p := range h.lb.Pools() {
+		if p.InMaintenance() {
+			ms.Pools = append(ms.Pools, p.Name)
+		}
+	}
+	return ms
+}
+
+func (h *AdminHandler) handleGetMaintenance(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, h.maintenanceStatus())
+}
+
+// handleSetMaintenance turns the global maintenance switch on or off.
+// Enabling it with route query parameters restricts it to those routes.
+func (h *AdminHandler) handleSetMaintenance(enabled bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		m := h.lb.Maintenance()
+		if routes := r.URL.Query()["route"]; enabled && len(routes) > 0 {
+			for _, name := range routes {
+				if h.lb.Route(name) == nil {
+					writeError(rw, http.StatusNotFound, fmt.Sprintf("unknown route %q", name))
+					return
+				}
+			}
+			m.SetRoutes(routes)
+		}
+		m.SetEnabled(enabled)
+		if enabled {
+			h.lb.logf("Maintenance enabled (routes %q)", m.Routes())
+		} else {
+			h.lb.logf("Maintenance disabled")
+		}
+		writeJSON(rw, http.StatusOK, h.maintenanceStatus())
+	}
+}
+
+func (h *AdminHandler) handleSetPoolMaintenance(enabled bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		pool := h.lb.Pool(r.PathValue("name"))
+		if pool == nil {
+			writeError(rw, http.StatusNotFound, "unknown pool")
+			return
+		}
+		pool.SetMaintenance(enabled)
+		if enabled {
+			pool.logf("maintenance enabled")
+		} else {
+			pool.logf("maintenance disabled")
+		}
+		writeJSON(rw, http.StatusOK, newPoolStatus(pool))
+	}
+}
+
+// datacenters returns the pool named in the path and its data center
+// routing, or writes an error.
+func (h *AdminHandler) datacenters(rw http.ResponseWriter, r *http.Request) (*Pool, *Datacenters, bool) {
+	pool := h.lb.Pool(r.PathValue("name"))
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, "unknown pool")
+		return nil, nil, false
+	}
+	d := pool.Datacenters()
+	if d == nil {
+		writeError(rw, http.StatusNotFound, "pool does not route by data center")
+		return nil, nil, false
+	}
+	return pool, d, true
+}
+
+func (h *AdminHandler) handleListDatacenters(rw http.ResponseWriter, r *http.Request) {
+	pool, d, ok := h.datacenters(rw, r)
+	if !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, d.Status(pool.Servers()))
+}
+
+// handleSetDatacenterWeight overrides the weight of a data center from a
+// {"weight": 50} body.
+func (h *AdminHandler) handleSetDatacenterWeight(rw http.ResponseWriter, r *http.Request) {
+	pool, d, ok := h.datacenters(rw, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if body.Weight == nil || *body.Weight < 0 {
+		writeError(rw, http.StatusBadRequest, "weight must be set and not be negative")
+		return
+	}
+	name := r.PathValue("datacenter")
+	if !d.SetWeight(name, body.Weight) {
+		writeError(rw, http.StatusNotFound, "unknown data center")
+		return
+	}
+	pool.logf("weight of data center %q set to %d", name, *body.Weight)
+	writeJSON(rw, http.StatusOK, d.Status(pool.Servers()))
+}
+
+// handleResetDatacenterWeight removes the override of the weight of a data
+// center.
+func (h *AdminHandler) handleResetDatacenterWeight(rw http.ResponseWriter, r *http.Request) {
+	pool, d, ok := h.datacenters(rw, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("datacenter")
+	if !d.SetWeight(name, nil) {
+		writeError(rw, http.StatusNotFound, "unknown data center")
+		return
+	}
+	pool.logf("weight of data center %q reset", name)
+	writeJSON(rw, http.StatusOK, d.Status(pool.Servers()))
+}
+
+// loggingStatus is the admin API representation of the logging settings.
+type loggingStatus struct {
+	Level           string  `json:"level"`
+	AccessLogSample float64 `json:"access_log_sample"`
+}
+
+func (h *AdminHandler) loggingStatus() loggingStatus {
+	return loggingStatus{
+		Level:           strings.ToLower(logLevel.Level().String()),
+		AccessLogSample: h.lb.AccessLog().Sample(),
+	}
+}
+
+func (h *AdminHandler) handleGetLogging(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, h.loggingStatus())
+}
+
+// handleModifyLogging changes the log level or the access log sampling from
+// a {"level": "debug", "access_log_sample": 0.1} body; absent fields are left
+// unchanged.
+func (h *AdminHandler) handleModifyLogging(rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level           *string  `json:"level"`
+		AccessLogSample *float64 `json:"access_log_sample"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	var level slog.Level
+	if body.Level != nil {
+		var err error
+		if level, err = ParseLogLevel(*body.Level); err != nil {
+			writeError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if s := body.AccessLogSample; s != nil && (*s < 0 || *s > 1) {
+		writeError(rw, http.StatusBadRequest, fmt.Sprintf("access_log_sample %v out of range 0-1", *s))
+		return
+	}
+	if body.Level != nil {
+		logLevel.Set(level)
+		h.lb.logf("Log level set to %s", level)
+	}
+	if s := body.AccessLogSample; s != nil {
+		h.lb.AccessLog().SetSample(*s)
+		h.lb.logf("Access log sample set to %v", *s)
+	}
+	writeJSON(rw, http.StatusOK, h.loggingStatus())
+}
+
+func (h *AdminHandler) handleGetState(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, h.lb.Snapshot())
+}
+
+// handleGetHA returns the HA status of the instance and, with ?state=1,
+// the runtime state of the active one, which its peer heartbeats with.
+func (h *AdminHandler) handleGetHA(rw http.ResponseWriter, r *http.Request) {
+	ha := h.lb.HA()
+	if ha == nil {
+		writeError(rw, http.StatusNotFound, "no ha configured")
+		return
+	}
+	st := ha.Status()
+	if st.Role == HAActive && r.URL.Query().Get("state") == "1" {
+		st.State = h.lb.Snapshot()
+	}
+	writeJSON(rw, http.StatusOK, st)
+}
+
+// handleGetCluster returns the members of the cluster and the shared
+// health of the servers.
+func (h *AdminHandler) handleGetCluster(rw http.ResponseWriter, r *http.Request) {
+	c := h.lb.Cluster()
+	if c == nil {
+		writeError(rw, http.StatusNotFound, "no cluster configured")
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]any{"name": c.Name, "members": c.Members(), "health": c.Health()})
+}
+
+// handleGetFleet returns the leader of the fleet and the version of the
+// configuration the instance runs.
+func (h *AdminHandler) handleGetFleet(rw http.ResponseWriter, r *http.Request) {
+	f := h.lb.Fleet()
+	if f == nil {
+		writeError(rw, http.StatusNotFound, "no fleet configured")
+		return
+	}
+	writeJSON(rw, http.StatusOK, f.Status())
+}
+
+// handleListProbes returns what the probes found so far.
+func (h *AdminHandler) handleListProbes(rw http.ResponseWriter, r *http.Request) {
+	pr := h.lb.Prober()
+	if pr == nil {
+		writeError(rw, http.StatusNotFound, "no probes configured")
+		return
+	}
+	writeJSON(rw, http.StatusOK, pr.Results())
+}
+
+// handleExplain reports how the load balancer would serve the request the
+// query describes, without sending it: its method, host, uri, headers, as
+// "Name: value", and client address.
+func (h *AdminHandler) handleExplain(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	header := http.Header{}
+	for _, hv := range q["header"] {
+		name, value, ok := strings.Cut(hv, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			writeError(rw, http.StatusBadRequest, fmt.Sprintf("header %q: want \"Name: value\"", hv))
+			return
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	req, err := ExplainRequest(r.Context(), q.Get("method"), q.Get("host"), q.Get("uri"), header, q.Get("client"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, h.lb.Explain(req))
+}
+
+// handleSaveState writes the runtime state to the state file.
+func (h *AdminHandler) handleSaveState(rw http.ResponseWriter, r *http.Request) {
+	if h.state.StateFile() == "" {
+		writeError(rw, http.StatusConflict, "no state_file configured")
+		return
+	}
+	if err := h.state.SaveState(); err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// registrar returns the registrar of the named pool.
+func (h *AdminHandler) registrar(name string) (*Registrar, error) {
+	pool := h.lb.Pool(name)
+	if pool == nil {
+		return nil, ErrPoolNotFound
+	}
+	reg := pool.Registrar()
+	if reg == nil {
+		return nil, fmt.Errorf("pool does not accept registrations")
+	}
+	return reg, nil
+}
+
+// handleRegister registers a server, or renews its registration, from a
+// {"addr": ..., "weight": ..., "tier": ..., "ttl": "10s"} body. It answers
+// with the TTL granted, within which the next heartbeat must arrive.
+func (h *AdminHandler) handleRegister(rw http.ResponseWriter, r *http.Request) {
+	reg, err := h.registrar(r.PathValue("name"))
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	var body struct {
+		Addr   string          `json:"addr"`
+		Weight int             `json:"weight"`
+		Tier   int             `json:"tier"`
+		TTL    config.Duration `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	t := Target{Addr: body.Addr, Weight: max(body.Weight, 1), Tier: body.Tier}
+	ttl, err := reg.Register(t, time.Duration(body.TTL))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]string{"addr": t.Addr, "ttl": ttl.String()})
+}
+
+// handleDeregister removes the registration of the server given by the addr
+// query parameter.
+func (h *AdminHandler) handleDeregister(rw http.ResponseWriter, r *http.Request) {
+	reg, err := h.registrar(r.PathValue("name"))
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	if !reg.Deregister(r.URL.Query().Get("addr")) {
+		writeError(rw, http.StatusNotFound, "unknown registration")
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// abuseGuard returns the abuse detection of the load balancer, answering
+// 404 if it has none.
+func (h *AdminHandler) abuseGuard(rw http.ResponseWriter) *AbuseGuard {
+	g := h.lb.AbuseGuard()
+	if g == nil {
+		writeError(rw, http.StatusNotFound, "abuse detection is not enabled")
+	}
+	return g
+}
+
+func (h *AdminHandler) handleListBans(rw http.ResponseWriter, r *http.Request) {
+	if g := h.abuseGuard(rw); g != nil {
+		writeJSON(rw, http.StatusOK, g.Bans())
+	}
+}
+
+// handleBan bans a client from an {"ip": ..., "duration": "1h"} body; without
+// a duration the ban lasts as long as the client's next offense would.
+func (h *AdminHandler) handleBan(rw http.ResponseWriter, r *http.Request) {
+	g := h.abuseGuard(rw)
+	if g == nil {
+		return
+	}
+	var body struct {
+		IP       string          `json:"ip"`
+		Duration config.Duration `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	ip, err := netip.ParseAddr(body.IP)
+	if err != nil || body.Duration < 0 {
+		writeError(rw, http.StatusBadRequest, "invalid ip or duration")
+		return
+	}
+	writeJSON(rw, http.StatusOK, g.Ban(ip.Unmap(), time.Duration(body.Duration)))
+}
+
+// handleUnban lifts the ban of a client and forgets its past bans.
+func (h *AdminHandler) handleUnban(rw http.ResponseWriter, r *http.Request) {
+	g := h.abuseGuard(rw)
+	if g == nil {
+		return
+	}
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid ip")
+		return
+	}
+	if !g.Unban(ip.Unmap()) {
+		writeError(rw, http.StatusNotFound, "client not banned")
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// writeError writes a JSON error response.
+func writeError(rw http.ResponseWriter, status int, msg string) {
+	writeJSON(rw, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdminRole is the access an admin API client is granted.
+type AdminRole int
+
+const (
+	// RoleNone grants no access.
+	RoleNone AdminRole = iota
+	// RoleRead grants the GET endpoints, which do not change anything.
+	RoleRead
+	// RoleWrite grants every endpoint.
+	RoleWrite
+)
+
+// ParseAdminRole parses "read" or "write".
+func ParseAdminRole(s string) (AdminRole, error) {
+	switch s {
+	case "read":
+		return RoleRead, nil
+	case "write":
+		return RoleWrite, nil
+	}
+	return RoleNone, fmt.Errorf("unknown role %q (want read or write)", s)
+}
+
+// String implements fmt.Stringer.
+func (r AdminRole) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleWrite:
+		return "write"
+	}
+	return "none"
+}
+
+// AddToken grants role to clients sending token as a bearer token.
+func (h *AdminHandler) AddToken(token string, role AdminRole) {
+	if h.tokens == nil {
+		h.tokens = map[string]AdminRole{}
+	}
+	h.tokens[token] = role
+}
+
+// AddClient grants role to clients presenting a verified TLS certificate
+// for name, its subject common name or one of its DNS names.
+func (h *AdminHandler) AddClient(name string, role AdminRole) {
+	if h.clients == nil {
+		h.clients = map[string]AdminRole{}
+	}
+	h.clients[name] = role
+}
+
+// authenticates reports whether the admin API requires credentials, which
+// it does once a token or client is registered.
+func (h *AdminHandler) authenticates() bool {
+	return len(h.tokens) > 0 || len(h.clients) > 0
+}
+
+// role returns the role granted to the client sending r, the highest of its
+// bearer token and certificate.
+func (h *AdminHandler) role(r *http.Request) AdminRole {
+	role := RoleNone
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		// Compare with every token so the time taken does not tell which
+		// one a guess came closest to.
+		for t, tr := range h.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				role = max(role, tr)
+			}
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+			role = max(role, h.clients[name])
+		}
+	}
+	return role
+}
+
+// authorize checks that the client sending r may call its endpoint,
+// answering 401 or 403 if not.
+func (h *AdminHandler) authorize(rw http.ResponseWriter, r *http.Request) bool {
+	if !h.authenticates() {
+		return true
+	}
+	need := RoleWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		need = RoleRead
+	}
+	switch role := h.role(r); {
+	case role == RoleNone:
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(rw, http.StatusUnauthorized, "unauthorized")
+		return false
+	case role < need:
+		writeError(rw, http.StatusForbidden, fmt.Sprintf("role %s may not %s %s", role, r.Method, r.URL.Path))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+)
+
+// TestAdminSavesState checks that the runtime state is saved after the
+// changes the admin API made, and only then.
+func TestAdminSavesState(t *testing.T) {
+	lb, err := NewLoadBalancer(WithPools(NewPool("web", lbtest.Servers("a"), nil, health.Check{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(t.TempDir(), "state.json")
+	lb.SetStateFile(state)
+	h := NewAdminHandler(lb)
+	h.AddToken("reader", RoleRead)
+	h.AddToken("writer", RoleWrite)
+	for _, tc := range []struct {
+		path, token string
+		code        int
+		saved       bool
+	}{
+		{"/livez", "", http.StatusMethodNotAllowed, false},
+		{"/maintenance/enable", "", http.StatusUnauthorized, false},
+		{"/maintenance/enable", "reader", http.StatusForbidden, false},
+		{"/pools/none/maintenance/enable", "writer", http.StatusNotFound, false},
+		{"/pools/web/maintenance/enable", "writer", http.StatusOK, true},
+	} {
+		r := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Code != tc.code {
+			t.Errorf("POST %s with %q: status %d, want %d", tc.path, tc.token, rw.Code, tc.code)
+		}
+		_, err := os.Stat(state)
+		if saved := err == nil; saved != tc.saved {
+			t.Errorf("POST %s with %q: state saved %t, want %t", tc.path, tc.token, saved, tc.saved)
+		}
+	}
+}
+
+// TestAdminSavesFrontendState checks that the changes made to a frontend
+// through the admin API are kept in the state file of the main load
+// balancer, and restored from it.
+func TestAdminSavesFrontendState(t *testing.T) {
+	newLBs := func() (*LoadBalancer, *LoadBalancer) {
+		lb, err := NewLoadBalancer(WithPools(NewPool("web", lbtest.Servers("a"), nil, health.Check{})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fe, err := NewLoadBalancer(WithPools(NewPool("internal", lbtest.Servers("b"), nil, health.Check{})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.keepFrontendState([]*frontend{{name: "admin", lb: fe}})
+		return lb, fe
+	}
+	state := filepath.Join(t.TempDir(), "state.json")
+	lb, fe := newLBs()
+	lb.SetStateFile(state)
+	h := NewAdminHandler(lb)
+	h.AddToken("writer", RoleWrite)
+	h.AddFrontend("admin", fe)
+	for _, path := range []string{"/frontends/admin/pools/internal/maintenance/enable", "/frontends/admin/state/save"} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("Authorization", "Bearer writer")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Code >= 300 {
+			t.Fatalf("POST %s: status %d: %s", path, rw.Code, rw.Body)
+		}
+	}
+
+	lb, fe = newLBs()
+	lb.SetStateFile(state)
+	if err := lb.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if !fe.Pool("internal").InMaintenance() {
+		t.Error("frontend pool maintenance not restored")
+	}
+	if lb.Pool("web").InMaintenance() {
+		t.Error("main pool put in maintenance")
+	}
+}
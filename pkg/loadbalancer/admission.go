@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	admittedConns = metrics.NewGaugeVec("lb_admitted_connections",
+		"Connections currently held open by a listener under its connection limit.", "listener")
+	rejectedConns = metrics.NewCounterVec("lb_rejected_connections_total",
+		"Connections closed on arrival because a listener held its maximum for longer than its queue timeout.", "listener")
+)
+
+// Admission caps the connections its listeners hold open at once to Max,
+// so that a flood of connections degrades service gracefully rather than
+// spawning a goroutine and buffers for each. Once Max are open, accepting
+// pauses for up to QueueTimeout for one of them to close, new connections
+// queueing meanwhile in the kernel's listen backlog; past it, the next
+// connection is closed as soon as it is accepted, and so on until one
+// closes.
+type Admission struct {
+	Max          int
+	QueueTimeout time.Duration
+	name         string
+
+	slots chan struct{}
+}
+
+// NewAdmission creates an Admission of max connections, counted in the
+// metrics under name.
+func NewAdmission(name string, max int, queueTimeout time.Duration) *Admission {
+	return &Admission{Max: max, QueueTimeout: queueTimeout, name: name, slots: make(chan struct{}, max)}
+}
+
+// Listen wraps ln so that its connections count against the limit.
+func (a *Admission) Listen(ln net.Listener) net.Listener {
+	return &admissionListener{Listener: ln, admission: a}
+}
+
+// acquire waits for a free slot for up to wait and reports whether it got
+// one.
+func (a *Admission) acquire(wait time.Duration) bool {
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (a *Admission) release() {
+	<-a.slots
+}
+
+// admissionListener is used by a single accepting goroutine, as
+// http.Server does.
+type admissionListener struct {
+	net.Listener
+	admission *Admission
+	// rejecting is set once the queue timeout ran out, until a slot frees.
+	rejecting bool
+}
+
+func (l *admissionListener) Accept() (net.Conn, error) {
+	for {
+		// Waiting before accepting leaves the queue to the kernel, which
+		// keeps connections cheaper than an accepted one.
+		ok := !l.rejecting && l.admission.acquire(l.admission.QueueTimeout)
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ok {
+				l.admission.release()
+			}
+			return nil, err
+		}
+		if !ok {
+			ok = l.admission.acquire(0)
+		}
+		if l.rejecting = !ok; !ok {
+			rejectedConns.Inc(l.admission.name)
+			conn.Close()
+			continue
+		}
+		admittedConns.Inc(l.admission.name)
+		return &admittedConn{Conn: conn, admission: l.admission}, nil
+	}
+}
+
+// admittedConn holds its slot until it is closed.
+type admittedConn struct {
+	net.Conn
+	admission *Admission
+	once      sync.Once
+}
+
+func (c *admittedConn) Close() error {
+	c.once.Do(func() {
+		admittedConns.Dec(c.admission.name)
+		c.admission.release()
+	})
+	return c.Conn.Close()
+}
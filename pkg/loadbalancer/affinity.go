@@ -0,0 +1,385 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+const defaultAffinityCookie = "lb_affinity"
+
+// Sticky-session failover policies.
+const (
+	FailoverRepin = "repin"
+	FailoverError = "error"
+)
+
+// errAffinityBroken is returned by Pool.Pick when a client's pinned server is
+// unavailable and the affinity is configured to fail rather than re-pin.
+var errAffinityBroken = errors.New("pinned server unavailable")
+
+var affinityRepins = metrics.NewCounterVec("lb_affinity_repins_total",
+	"Clients re-pinned because their pinned server was unavailable.", "pool")
+
+// Affinity modes.
+const (
+	// AffinityCookie pins clients with an LB-issued cookie naming the server.
+	AffinityCookie = "cookie"
+	// AffinityClientIP pins clients by their (optionally masked) IP address.
+	AffinityClientIP = "client_ip"
+	// AffinityHeader pins clients by the value of an application header.
+	AffinityHeader = "header"
+)
+
+// Affinity pins clients to a server of a pool across requests.
+//
+// In cookie mode the LB issues a cookie carrying an opaque server ID, never
+// the backend address. In client IP mode the pool remembers which server
+// each client address was sent to; addresses are masked to IPv4Prefix and
+// IPv6Prefix bits first so that clients behind the same NAT range share a pin.
+// In header mode the pool remembers a hash of the Header value the
+// application already sends, such as Authorization or X-Session-ID; raw
+// values are never stored.
+//
+// With Consistent set, client IP and header modes keep no table at all: the
+// key is placed on a consistent hash ring of the pool's servers, so pool
+// resizes only remap a minimal fraction of clients and no state needs to be
+// shared. TTL and IdleTimeout do not apply to consistent hashing.
+//
+// A pin expires TTL after it was created and, if IdleTimeout is set, after
+// the client has been idle that long; every request refreshes the idle timer
+// (re-issuing the cookie in cookie mode). Zero values never expire.
+type Affinity struct {
+	Mode string
+
+	TTL         time.Duration
+	IdleTimeout time.Duration
+
+	CookieName string
+	Secure     bool
+	HTTPOnly   bool
+
+	IPv4Prefix int
+	IPv6Prefix int
+
+	Header string
+
+	Consistent bool
+
+	// Failover selects what happens when a client's pinned server is down or
+	// gone: FailoverRepin (the default) balances the request to another server
+	// and pins the client to it, FailoverError answers with FailoverStatus.
+	Failover       string
+	FailoverStatus int
+
+	// Store holds the pins of client IP and header modes. It defaults to
+	// an in-memory table; a shared store lets several LB instances agree.
+	Store AffinityStore
+
+	// namespace separates the pins of a route-level affinity from those of
+	// the pools' own affinities. Keys are always qualified by pool as well.
+	namespace string
+}
+
+// NewCookieAffinity creates a cookie-based Affinity. An empty name defaults
+// to lb_affinity; a zero ttl issues a session cookie unless IdleTimeout is set.
+func NewCookieAffinity(name string, ttl time.Duration, secure, httpOnly bool) *Affinity {
+	if name == "" {
+		name = defaultAffinityCookie
+	}
+	return &Affinity{Mode: AffinityCookie, CookieName: name, TTL: ttl, Secure: secure, HTTPOnly: httpOnly, Failover: FailoverRepin}
+}
+
+// NewClientIPAffinity creates an Affinity keyed on the client address masked
+// to the given prefix lengths. Zero prefixes keep the full address.
+func NewClientIPAffinity(ipv4Prefix, ipv6Prefix int) (*Affinity, error) {
+	if ipv4Prefix == 0 {
+		ipv4Prefix = 32
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = 128
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid affinity prefix lengths /%d and /%d", ipv4Prefix, ipv6Prefix)
+	}
+	return &Affinity{
+		Mode:       AffinityClientIP,
+		IPv4Prefix: ipv4Prefix,
+		IPv6Prefix: ipv6Prefix,
+		Failover:   FailoverRepin,
+		Store:      NewMemoryAffinityStore(),
+	}, nil
+}
+
+// NewHeaderAffinity creates an Affinity keyed on the value of header.
+func NewHeaderAffinity(header string) (*Affinity, error) {
+	if header == "" {
+		return nil, fmt.Errorf("header affinity requires a header name")
+	}
+	return &Affinity{
+		Mode:     AffinityHeader,
+		Header:   http.CanonicalHeaderKey(header),
+		Failover: FailoverRepin,
+		Store:    NewMemoryAffinityStore(),
+	}, nil
+}
+
+// SetFailover configures the failover policy. An empty policy means
+// FailoverRepin; a zero status for FailoverError means 503 Service Unavailable.
+func (a *Affinity) SetFailover(policy string, status int) error {
+	switch policy {
+	case "", FailoverRepin:
+		policy = FailoverRepin
+	case FailoverError:
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		if status < 400 || status > 599 {
+			return fmt.Errorf("failover status %d is not an error status", status)
+		}
+	default:
+		return fmt.Errorf("unknown failover policy %q", policy)
+	}
+	a.Failover = policy
+	a.FailoverStatus = status
+	return nil
+}
+
+// tableKey returns the key identifying the client of r in the pin table.
+func (a *Affinity) tableKey(r *http.Request) (string, bool) {
+	if a.Mode == AffinityHeader {
+		v := r.Header.Get(a.Header)
+		if v == "" {
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:16]), true
+	}
+	ip := clientIP(r)
+	if !ip.IsValid() {
+		return "", false
+	}
+	bits := a.IPv6Prefix
+	if ip.Is4() {
+		bits = a.IPv4Prefix
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return "", false
+	}
+	return prefix.String(), true
+}
+
+// expired reports whether a pin has lapsed at now.
+func (a *Affinity) expired(pin Pin, now time.Time) bool {
+	return a.TTL > 0 && now.Sub(pin.Created) >= a.TTL ||
+		a.IdleTimeout > 0 && now.Sub(pin.LastSeen) >= a.IdleTimeout
+}
+
+// lifetime returns how much longer pin stays valid at now, or zero if it
+// never expires.
+func (a *Affinity) lifetime(pin Pin, now time.Time) time.Duration {
+	var d time.Duration
+	if a.TTL > 0 {
+		d = max(a.TTL-now.Sub(pin.Created), time.Second)
+	}
+	if a.IdleTimeout > 0 && (d == 0 || a.IdleTimeout < d) {
+		d = a.IdleTimeout
+	}
+	return d
+}
+
+// pinned returns the pin of the client sending r, if any, and refreshes its
+// idle timer.
+func (a *Affinity) pinned(r *http.Request, pool string) (Pin, bool) {
+	now := time.Now()
+	pin, key, ok := a.peek(r, pool)
+	if !ok {
+		return Pin{}, false
+	}
+	if a.expired(pin, now) {
+		if key != "" {
+			a.Store.Delete(r.Context(), key)
+		}
+		return Pin{}, false
+	}
+	if key != "" && a.IdleTimeout > 0 {
+		pin.LastSeen = now
+		if err := a.Store.Save(r.Context(), key, pin, a.lifetime(pin, now)); err != nil {
+			logf("Affinity store: save %q: %v", key, err)
+		}
+	}
+	return pin, true
+}
+
+// peek returns the pin of the client sending r to pool, expired or not,
+// and the key of the store it is kept under, or "" for a cookie, without
+// renewing or deleting it.
+func (a *Affinity) peek(r *http.Request, pool string) (Pin, string, bool) {
+	now := time.Now()
+	if a.Mode == AffinityCookie {
+		c, err := r.Cookie(a.CookieName)
+		if err != nil || c.Value == "" {
+			return Pin{}, "", false
+		}
+		// The cookie carries "<server id>.<creation time>"; the browser
+		// enforces the idle timeout through Max-Age.
+		id, created, _ := strings.Cut(c.Value, ".")
+		pin := Pin{ServerID: id, Created: now, LastSeen: now}
+		if sec, err := strconv.ParseInt(created, 36, 64); err == nil {
+			pin.Created = time.Unix(sec, 0)
+		}
+		return pin, "", true
+	}
+	key, ok := a.tableKey(r)
+	if !ok {
+		return Pin{}, "", false
+	}
+	key = a.namespace + pool + ":" + key
+	pin, ok, err := a.Store.Load(r.Context(), key)
+	if err != nil {
+		logf("Affinity store: load %q: %v", key, err)
+		return Pin{}, "", false
+	}
+	return pin, key, ok
+}
+
+// pin records that the client sending r is served by server. created is the
+// creation time of the pin, preserved when an existing pin is renewed.
+func (a *Affinity) pin(rw http.ResponseWriter, r *http.Request, pool string, server backend.Server, created time.Time) {
+	now := time.Now()
+	pin := Pin{ServerID: serverID(server), Created: created, LastSeen: now}
+	if a.Mode != AffinityCookie {
+		key, ok := a.tableKey(r)
+		if !ok {
+			return
+		}
+		key = a.namespace + pool + ":" + key
+		if err := a.Store.Save(r.Context(), key, pin, a.lifetime(pin, now)); err != nil {
+			logf("Affinity store: save %q: %v", key, err)
+		}
+		return
+	}
+	c := &http.Cookie{
+		Name:     a.CookieName,
+		Value:    pin.ServerID + "." + strconv.FormatInt(created.Unix(), 36),
+		Path:     "/",
+		Secure:   a.Secure,
+		HttpOnly: a.HTTPOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if d := a.lifetime(pin, now); d > 0 {
+		c.MaxAge = max(int(d/time.Second), 1)
+	}
+	http.SetCookie(rw, c)
+}
+
+// serverID returns a stable opaque identifier for server.
+func serverID(server backend.Server) string {
+	h := fnv.New64a()
+	h.Write([]byte(server.Address()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// serverByID returns the server of the pool with the given ID, or nil.
+func (p *Pool) serverByID(id string) backend.Server {
+	for _, s := range p.Servers() {
+		if serverID(s) == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// pickConsistent picks the server owning r's affinity key on the pool's hash ring.
+func (p *Pool) pickConsistent(a *Affinity, r *http.Request) (backend.Server, error) {
+	key, ok := a.tableKey(r)
+	if !ok {
+		return p.GetNextAvailableServer(), nil
+	}
+	owner, live := p.hashRing().lookup(key)
+	if owner != nil && owner != live {
+		if a.Failover == FailoverError {
+			return nil, errAffinityBroken
+		}
+		affinityRepins.Inc(p.Name)
+	}
+	return live, nil
+}
+
+// hashRing returns the consistent hash ring of the pool's current servers.
+func (p *Pool) hashRing() *hashRing {
+	servers := p.Servers()
+	ring := p.ring.Load()
+	if ring == nil || !slices.Equal(ring.servers, servers) {
+		ring = newHashRing(servers)
+		p.ring.Store(ring)
+	}
+	return ring
+}
+
+// SetAffinity enables session affinity for the pool. A nil affinity disables it.
+func (p *Pool) SetAffinity(a *Affinity) {
+	p.affinity = a
+}
+
+// Affinity returns the pool's session affinity, or nil if it has none.
+func (p *Pool) Affinity() *Affinity {
+	return p.affinity
+}
+
+// Pick selects the server for r, honoring the pool's session affinity: a
+// client pinned to a live server keeps using it, any other client is balanced
+// by the pool's strategy and pinned to the result. If the pinned server is
+// unavailable, the affinity's failover policy either re-pins the client or
+// makes Pick return errAffinityBroken. If no server is available, Pick
+// returns ErrNoHealthyBackends.
+func (p *Pool) Pick(rw http.ResponseWriter, r *http.Request) (backend.Server, error) {
+	return p.PickWithAffinity(p.affinity, rw, r)
+}
+
+// PickWithAffinity is like Pick but applies a instead of the pool's own
+// affinity; a nil a balances statelessly.
+func (p *Pool) PickWithAffinity(a *Affinity, rw http.ResponseWriter, r *http.Request) (backend.Server, error) {
+	s, err := p.pickWithAffinity(a, rw, r)
+	if s == nil && err == nil {
+		return nil, fmt.Errorf("pool %q: %w", p.Name, ErrNoHealthyBackends)
+	}
+	return s, err
+}
+
+func (p *Pool) pickWithAffinity(a *Affinity, rw http.ResponseWriter, r *http.Request) (backend.Server, error) {
+	if a == nil {
+		return p.GetNextAvailableServer(), nil
+	}
+	if a.Consistent {
+		return p.pickConsistent(a, r)
+	}
+	if pin, ok := a.pinned(r, p.Name); ok {
+		if s := p.serverByID(pin.ServerID); s != nil && backend.AvailableSticky(s) {
+			if a.Mode == AffinityCookie && a.IdleTimeout > 0 {
+				a.pin(rw, r, p.Name, s, pin.Created)
+			}
+			return s, nil
+		}
+		if a.Failover == FailoverError {
+			return nil, errAffinityBroken
+		}
+		affinityRepins.Inc(p.Name)
+	}
+	s := p.GetNextAvailableServer()
+	if s != nil {
+		a.pin(rw, r, p.Name, s, time.Now())
+	}
+	return s, nil
+}
@@ -0,0 +1,249 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pin records the server a client is pinned to.
+type Pin struct {
+	ServerID string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+// AffinityStore persists the pins of client IP and header affinity. Keys are
+// namespaced per pool by the caller.
+type AffinityStore interface {
+	// Load returns the pin stored under key and whether one exists.
+	Load(ctx context.Context, key string) (Pin, bool, error)
+	// Save stores pin under key. The store may discard it after ttl; a zero
+	// ttl keeps it until it is deleted.
+	Save(ctx context.Context, key string, pin Pin, ttl time.Duration) error
+	// Delete removes the pin stored under key.
+	Delete(ctx context.Context, key string) error
+}
+
+// memoryStoreSweepInterval is how often expired pins are purged from a MemoryAffinityStore.
+const memoryStoreSweepInterval = time.Minute
+
+// defaultAffinityMaxEntries bounds the pins of a MemoryAffinityStore by
+// default.
+const defaultAffinityMaxEntries = 100000
+
+// MemoryAffinityStore is an AffinityStore local to one LB instance. It
+// keeps at most MaxEntries pins, evicting the least recently used past it.
+type MemoryAffinityStore struct {
+	MaxEntries int
+
+	mu sync.Mutex
+	// pins holds the elements of lru, most recently used first.
+	pins      map[string]*list.Element
+	lru       *list.List
+	lastSweep time.Time
+}
+
+type memoryPin struct {
+	key      string
+	pin      Pin
+	deadline time.Time
+}
+
+// NewMemoryAffinityStore creates an empty in-memory store of up to 100000
+// pins.
+func NewMemoryAffinityStore() *MemoryAffinityStore {
+	return &MemoryAffinityStore{MaxEntries: defaultAffinityMaxEntries, pins: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (e *memoryPin) expired(now time.Time) bool {
+	return !e.deadline.IsZero() && now.After(e.deadline)
+}
+
+// Load implements AffinityStore.
+func (s *MemoryAffinityStore) Load(_ context.Context, key string) (Pin, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.pins[key]
+	if !ok {
+		return Pin{}, false, nil
+	}
+	e := el.Value.(*memoryPin)
+	if e.expired(time.Now()) {
+		return Pin{}, false, nil
+	}
+	s.lru.MoveToFront(el)
+	return e.pin, true, nil
+}
+
+// Save implements AffinityStore.
+func (s *MemoryAffinityStore) Save(_ context.Context, key string, pin Pin, ttl time.Duration) error {
+	now := time.Now()
+	e := &memoryPin{key: key, pin: pin}
+	if ttl > 0 {
+		e.deadline = now.Add(ttl)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= memoryStoreSweepInterval {
+		for el := s.lru.Front(); el != nil; {
+			next := el.Next()
+			if el.Value.(*memoryPin).expired(now) {
+				s.remove(el, "expired")
+			}
+			el = next
+		}
+		s.lastSweep = now
+	}
+	s.put(e)
+	return nil
+}
+
+// put adds or replaces a pin. Its caller holds mu.
+func (s *MemoryAffinityStore) put(e *memoryPin) {
+	if el, ok := s.pins[e.key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.pins[e.key] = s.lru.PushFront(e)
+	tableEntries.Inc("affinity_pins")
+	for s.MaxEntries > 0 && s.lru.Len() > s.MaxEntries {
+		s.remove(s.lru.Back(), "capacity")
+	}
+}
+
+// remove removes a pin. Its caller holds mu.
+func (s *MemoryAffinityStore) remove(el *list.Element, reason string) {
+	e := s.lru.Remove(el).(*memoryPin)
+	delete(s.pins, e.key)
+	tableEntries.Dec("affinity_pins")
+	if reason != "" {
+		tableEvictions.Inc("affinity_pins", reason)
+	}
+}
+
+// Delete implements AffinityStore.
+func (s *MemoryAffinityStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.pins[key]; ok {
+		s.remove(el, "")
+	}
+	return nil
+}
+
+// StoredPin is a pin of a MemoryAffinityStore in a state snapshot.
+type StoredPin struct {
+	Key      string    `json:"key"`
+	ServerID string    `json:"server"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	// Expires is zero for pins kept until they are deleted.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Pins returns the pins of the store that have not expired, most recently
+// used first.
+func (s *MemoryAffinityStore) Pins() []StoredPin {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := make([]StoredPin, 0, len(s.pins))
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*memoryPin)
+		if e.expired(now) {
+			continue
+		}
+		pins = append(pins, StoredPin{Key: e.key, ServerID: e.pin.ServerID, Created: e.pin.Created, LastSeen: e.pin.LastSeen, Expires: e.deadline})
+	}
+	return pins
+}
+
+// RestorePins adds pins, most recently used first as Pins returns them, to
+// the store, skipping those that have expired.
+func (s *MemoryAffinityStore) RestorePins(pins []StoredPin) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range slices.Backward(pins) {
+		if !p.Expires.IsZero() && now.After(p.Expires) {
+			continue
+		}
+		s.put(&memoryPin{key: p.Key, pin: Pin{ServerID: p.ServerID, Created: p.Created, LastSeen: p.LastSeen}, deadline: p.Expires})
+	}
+}
+
+// sharedAffinityPrefix prefixes the keys of the pins of a
+// SharedAffinityStore.
+const sharedAffinityPrefix = "affinity:"
+
+// SharedAffinityStore is an AffinityStore keeping the pins in a SharedStore
+// under "affinity:<key>", so that all the LB instances using it pin a
+// client to the same backend.
+type SharedAffinityStore struct {
+	store SharedStore
+}
+
+// NewSharedAffinityStore creates a store keeping the pins in store.
+func NewSharedAffinityStore(store SharedStore) *SharedAffinityStore {
+	return &SharedAffinityStore{store: store}
+}
+
+// RedisAffinityStore is a SharedAffinityStore backed by Redis.
+//
+// Deprecated: use NewSharedAffinityStore with a RedisSharedStore.
+type RedisAffinityStore = SharedAffinityStore
+
+// NewRedisAffinityStore creates a store backed by client, keeping the pins
+// under "lb:affinity:<key>".
+func NewRedisAffinityStore(client *RedisClient) *RedisAffinityStore {
+	return NewSharedAffinityStore(NewRedisSharedStore(client))
+}
+
+// Load implements AffinityStore.
+func (s *SharedAffinityStore) Load(ctx context.Context, key string) (Pin, bool, error) {
+	v, ok, err := s.store.Get(ctx, sharedAffinityPrefix+key)
+	if err != nil || !ok {
+		return Pin{}, false, err
+	}
+	pin, err := decodePin(string(v))
+	if err != nil {
+		return Pin{}, false, err
+	}
+	return pin, true, nil
+}
+
+// Save implements AffinityStore.
+func (s *SharedAffinityStore) Save(ctx context.Context, key string, pin Pin, ttl time.Duration) error {
+	return s.store.Set(ctx, sharedAffinityPrefix+key, []byte(encodePin(pin)), ttl)
+}
+
+// Delete implements AffinityStore.
+func (s *SharedAffinityStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, sharedAffinityPrefix+key)
+}
+
+// encodePin serializes a pin as "<server id>|<created>|<last seen>" with Unix
+// millisecond timestamps.
+func encodePin(pin Pin) string {
+	return pin.ServerID + "|" + strconv.FormatInt(pin.Created.UnixMilli(), 10) + "|" + strconv.FormatInt(pin.LastSeen.UnixMilli(), 10)
+}
+
+func decodePin(s string) (Pin, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 3 {
+		return Pin{}, fmt.Errorf("malformed pin %q", s)
+	}
+	created, err1 := strconv.ParseInt(parts[1], 10, 64)
+	lastSeen, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Pin{}, fmt.Errorf("malformed pin %q", s)
+	}
+	return Pin{ServerID: parts[0], Created: time.UnixMilli(created), LastSeen: time.UnixMilli(lastSeen)}, nil
+}
@@ -0,0 +1,393 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	// apiKeyCacheTTL is how long keys looked up in an external store are
+	// remembered, so that not every request queries it.
+	apiKeyCacheTTL = 30 * time.Second
+	// defaultAPIKeyMaxCached bounds the keys a RedisAPIKeyStore caches by
+	// default.
+	defaultAPIKeyMaxCached = 10000
+	// redisAPIKeyPrefix prefixes the keys of the hashes describing API keys
+	// in a RedisAPIKeyStore.
+	redisAPIKeyPrefix = "lb:apikey:"
+	// sharedAPIKeyRatePrefix prefixes the keys of the rate counters of API
+	// keys in the Rates of an APIKeyAuth.
+	sharedAPIKeyRatePrefix = "rate:apikey:"
+)
+
+var apiKeyRequests = metrics.NewCounterVec("lb_api_key_requests_total",
+	"Requests authenticated by API key, by consumer and result.", "consumer", "result")
+
+// APIKey is an API key and the limits of its consumer. Rate is the rate of
+// requests allowed per second, with bursts of up to Burst requests; Quota is
+// the number of requests allowed every QuotaPeriod, and ByteQuota the number
+// of bytes of request and response bodies. Zero means no limit. If
+// QuotaCalendar is QuotaDaily or QuotaMonthly, quotas are reset every UTC
+// day or month instead. Quotas are shared by the keys of a Tenant, or else
+// of a Name.
+type APIKey struct {
+	Key           string
+	Name          string
+	Tenant        string
+	Rate          float64
+	Burst         int
+	Quota         int64
+	ByteQuota     int64
+	QuotaPeriod   time.Duration
+	QuotaCalendar string
+}
+
+// APIKeyStore looks API keys up.
+type APIKeyStore interface {
+	// Lookup returns the API key key and whether it exists.
+	Lookup(ctx context.Context, key string) (*APIKey, bool, error)
+}
+
+// StaticAPIKeyStore is an APIKeyStore holding a fixed set of keys.
+type StaticAPIKeyStore map[string]*APIKey
+
+// NewStaticAPIKeyStore creates a store holding keys.
+func NewStaticAPIKeyStore(keys []*APIKey) (StaticAPIKeyStore, error) {
+	s := StaticAPIKeyStore{}
+	for _, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("key %q: empty key", k.Name)
+		}
+		if _, dup := s[k.Key]; dup {
+			return nil, fmt.Errorf("key %q: duplicate key", k.Name)
+		}
+		s[k.Key] = k
+	}
+	return s, nil
+}
+
+// Lookup implements APIKeyStore.
+func (s StaticAPIKeyStore) Lookup(_ context.Context, key string) (*APIKey, bool, error) {
+	k, ok := s[key]
+	return k, ok, nil
+}
+
+// RedisAPIKeyStore is an APIKeyStore reading keys from a Redis server, where
+// each key is a hash stored under "lb:apikey:<key>" with the fields name,
+// tenant, rate, burst, quota, byte_quota, quota_period (a duration like
+// "24h") and quota_calendar ("day" or "month"), all optional:
+//
+//	HSET lb:apikey:s3cr3t name acme rate 10 burst 20 quota 100000 quota_calendar month
+//
+// Keys are cached for 30 seconds, so changes take up to that long to apply,
+// and unknown keys too, up to MaxCached keys; arbitrary ones are evicted
+// past it.
+type RedisAPIKeyStore struct {
+	MaxCached int
+	client    *RedisClient
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// NewRedisAPIKeyStore creates a store backed by client, caching up to 10000
+// keys.
+func NewRedisAPIKeyStore(client *RedisClient) *RedisAPIKeyStore {
+	return &RedisAPIKeyStore{MaxCached: defaultAPIKeyMaxCached, client: client, cache: map[string]cachedAPIKey{}}
+}
+
+// Lookup implements APIKeyStore.
+func (s *RedisAPIKeyStore) Lookup(ctx context.Context, key string) (*APIKey, bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	c, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.key, c.key != nil, nil
+	}
+	v, err := s.client.Do(ctx, "HGETALL", redisAPIKeyPrefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	fields, _ := v.([]any)
+	var k *APIKey
+	if len(fields) > 0 {
+		if k, err = parseRedisAPIKey(key, fields); err != nil {
+			return nil, false, err
+		}
+	}
+	s.mu.Lock()
+	for ck, c := range s.cache {
+		if now.After(c.expires) {
+			delete(s.cache, ck)
+			tableEvictions.Inc("api_key_cache", "expired")
+			tableEntries.Dec("api_key_cache")
+		}
+	}
+	if _, ok := s.cache[key]; !ok {
+		for ck := range s.cache {
+			if s.MaxCached <= 0 || len(s.cache) < s.MaxCached {
+				break
+			}
+			delete(s.cache, ck)
+			tableEvictions.Inc("api_key_cache", "capacity")
+			tableEntries.Dec("api_key_cache")
+		}
+		tableEntries.Inc("api_key_cache")
+	}
+	s.cache[key] = cachedAPIKey{key: k, expires: now.Add(apiKeyCacheTTL)}
+	s.mu.Unlock()
+	return k, k != nil, nil
+}
+
+func parseRedisAPIKey(key string, fields []any) (*APIKey, error) {
+	k := &APIKey{Key: key}
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		var err error
+		switch name {
+		case "name":
+			k.Name = value
+		case "tenant":
+			k.Tenant = value
+		case "rate":
+			k.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			k.Burst, err = strconv.Atoi(value)
+		case "quota":
+			k.Quota, err = strconv.ParseInt(value, 10, 64)
+		case "byte_quota":
+			k.ByteQuota, err = strconv.ParseInt(value, 10, 64)
+		case "quota_period":
+			k.QuotaPeriod, err = time.ParseDuration(value)
+		case "quota_calendar":
+			if value != QuotaDaily && value != QuotaMonthly {
+				err = fmt.Errorf("unknown calendar %q", value)
+			}
+			k.QuotaCalendar = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("API key %q: field %s: %w", k.Name, name, err)
+		}
+	}
+	return k, nil
+}
+
+// APIKeyAuth requires requests to carry a known API key, in the header
+// Header or, if Query is set, in that query parameter, and enforces the
+// rate limit and quotas of its consumer. Rates are counted per load
+// balancer instance, or in Rates if set, and quotas in Quotas, which load
+// balancers may share. In Rates, the requests of a consumer are counted in
+// fixed windows of Burst/Rate seconds allowing Burst requests each, under
+// "rate:apikey:<name>:<window start>"; if Rates fails, rates are counted per
+// instance.
+// Responses to requests of keys with quotas carry X-Quota-Limit,
+// X-Quota-Remaining, X-Quota-Bytes-Limit and X-Quota-Bytes-Remaining for
+// the quotas set, and X-Quota-Reset, the seconds until they are reset. Bytes
+// are counted once requests are done, so requests started before the byte
+// quota is used up go through. If Quotas fails, requests go through
+// uncounted. The key is not forwarded to backends; if ConsumerHeader is
+// set, the consumer's name is sent in that header instead.
+type APIKeyAuth struct {
+	Store          APIKeyStore
+	Quotas         QuotaStore
+	Rates          SharedStore
+	Header         string
+	Query          string
+	ConsumerHeader string
+
+	mu     sync.Mutex
+	limits map[string]*apiKeyLimits
+}
+
+// NewAPIKeyAuth creates an APIKeyAuth looking keys up in store and counting
+// quotas in memory. The key is read from the X-API-Key header.
+func NewAPIKeyAuth(store APIKeyStore) *APIKeyAuth {
+	return &APIKeyAuth{Store: store, Quotas: NewMemoryQuotaStore(), Header: defaultAPIKeyHeader, limits: map[string]*apiKeyLimits{}}
+}
+
+// apiKeyLimits is the token bucket for the rate of an API key.
+type apiKeyLimits struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a request with k is allowed now by its rate and,
+// if it is not, when to retry.
+func (l *apiKeyLimits) allow(k *APIKey, now time.Time) (ok bool, retry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if k.Rate > 0 {
+		burst := float64(max(k.Burst, 1))
+		if l.last.IsZero() {
+			l.tokens = burst
+		} else {
+			l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*k.Rate)
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return false, time.Duration((1 - l.tokens) / k.Rate * float64(time.Second))
+		}
+		l.tokens--
+	}
+	return true, 0
+}
+
+// allow reports whether a request with key, k, is allowed now by its rate
+// and, if it is not, when to retry.
+func (a *APIKeyAuth) allow(ctx context.Context, key string, k *APIKey, now time.Time) (bool, time.Duration) {
+	if a.Rates == nil || k.Rate <= 0 {
+		return a.limitsFor(key).allow(k, now)
+	}
+	burst := max(k.Burst, 1)
+	window := max(time.Duration(float64(burst)/k.Rate*float64(time.Second)), time.Millisecond)
+	start := now.Truncate(window)
+	n, err := a.Rates.Incr(ctx, sharedAPIKeyRatePrefix+k.Name+":"+strconv.FormatInt(start.UnixMilli(), 10), 1, 2*window)
+	if err != nil {
+		logf("API key rate of %q: %v", k.Name, err)
+		return a.limitsFor(key).allow(k, now)
+	}
+	if n > int64(burst) {
+		return false, start.Add(window).Sub(now)
+	}
+	return true, 0
+}
+
+func (a *APIKeyAuth) limitsFor(key string) *apiKeyLimits {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l := a.limits[key]
+	if l == nil {
+		l = &apiKeyLimits{}
+		a.limits[key] = l
+	}
+	return l
+}
+
+// key returns the API key r carries.
+func (a *APIKeyAuth) key(r *http.Request) string {
+	if key := r.Header.Get(a.Header); key != "" {
+		return key
+	}
+	if a.Query != "" {
+		return r.URL.Query().Get(a.Query)
+	}
+	return ""
+}
+
+// Middleware returns the middleware rejecting requests without a known key
+// with 401 and those over their limits with 429.
+func (a *APIKeyAuth) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := a.key(r)
+			if key == "" {
+				apiKeyRequests.Inc("", "missing")
+				httpError(rw, r, "401 unauthorized: API key required", http.StatusUnauthorized)
+				return
+			}
+			k, ok, err := a.Store.Lookup(r.Context(), key)
+			if err != nil {
+				logf("API key lookup: %v", err)
+				httpError(rw, r, "API key store unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if !ok {
+				apiKeyRequests.Inc("", "unknown")
+				httpError(rw, r, "401 unauthorized: unknown API key", http.StatusUnauthorized)
+				return
+			}
+			if t := tagsOf(r); t != nil {
+				t.consumer = k.Name
+			}
+			now := time.Now()
+			if allowed, retry := a.allow(r.Context(), key, k, now); !allowed {
+				apiKeyRequests.Inc(k.Name, "limited")
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				httpError(rw, r, "429 too many requests", http.StatusTooManyRequests)
+				return
+			}
+			var start, end time.Time
+			counted := k.Quota > 0 || k.ByteQuota > 0
+			if counted {
+				start, end = k.quotaPeriod(now)
+				usage, err := a.Quotas.Add(r.Context(), k.tenant(), start, end, 1, 0)
+				if err != nil {
+					logf("API key quota of %q: %v", k.tenant(), err)
+					counted = false
+				} else {
+					reset := k.setQuotaHeaders(rw.Header(), usage, end, now)
+					if (k.Quota > 0 && usage.Requests > k.Quota) || (k.ByteQuota > 0 && usage.Bytes >= k.ByteQuota) {
+						apiKeyRequests.Inc(k.Name, "over_quota")
+						rw.Header().Set("Retry-After", strconv.Itoa(reset))
+						httpError(rw, r, "429 too many requests: quota exceeded", http.StatusTooManyRequests)
+						return
+					}
+				}
+			}
+			apiKeyRequests.Inc(k.Name, "allowed")
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			r.Header.Del(a.Header)
+			if a.Query != "" && r.URL.RawQuery != "" {
+				u := *r.URL
+				u.RawQuery = removeQueryParam(u.RawQuery, a.Query)
+				r.URL = &u
+			}
+			if a.ConsumerHeader != "" {
+				r.Header.Set(a.ConsumerHeader, k.Name)
+			}
+			if !counted || k.ByteQuota <= 0 {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			qw := &quotaWriter{ResponseWriter: rw}
+			var qb *quotaBody
+			if r.Body != nil && r.Body != http.NoBody {
+				qb = &quotaBody{ReadCloser: r.Body}
+				r.Body = qb
+			}
+			next.ServeHTTP(qw, r)
+			n := qw.n
+			if qb != nil {
+				n += qb.n
+			}
+			// The request is done: its context may be canceled.
+			if _, err := a.Quotas.Add(context.WithoutCancel(r.Context()), k.tenant(), start, end, 0, n); err != nil {
+				logf("API key quota of %q: %v", k.tenant(), err)
+			}
+		})
+	}
+}
+
+// removeQueryParam returns the query raw without the parameter name,
+// leaving the other parameters as they were sent: re-encoding the query
+// would reorder and re-escape them, and drop those url.ParseQuery rejects.
+func removeQueryParam(raw, name string) string {
+	params := strings.Split(raw, "&")
+	kept := params[:0]
+	for _, p := range params {
+		n, _, _ := strings.Cut(p, "=")
+		if n, err := url.QueryUnescape(n); err != nil || n != name {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAPIKeyAuth(t *testing.T, keys ...*APIKey) *APIKeyAuth {
+	t.Helper()
+	store, err := NewStaticAPIKeyStore(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPIKeyAuth(store)
+}
+
+// TestAPIKeyQueryRemoved checks that the key is removed from the query
+// forwarded, and the rest of the query is forwarded as it was sent.
+func TestAPIKeyQueryRemoved(t *testing.T) {
+	a := newTestAPIKeyAuth(t, &APIKey{Key: "secret", Name: "acme"})
+	a.Query = "key"
+	var got string
+	h := a.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r.URL.RawQuery
+	}))
+	for query, want := range map[string]string{
+		"key=secret":                    "",
+		"z=1&key=secret&a=2":            "z=1&a=2",
+		"key=secret&q=a%2Fb+c&p=%7e":    "q=a%2Fb+c&p=%7e",
+		"key=secret&a=1;b=2&key=other":  "a=1;b=2",
+		"k%65y=secret&x=%zz&flag":       "x=%zz&flag",
+		"key=secret&keys=1&key2=2&=key": "keys=1&key2=2&=key",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d", query, rec.Code)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: forwarded %q, want %q", query, got, want)
+		}
+	}
+}
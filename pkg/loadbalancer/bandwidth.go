@@ -0,0 +1,289 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var bandwidthThrottled = metrics.NewCounterVec("lb_bandwidth_throttled_total",
+	"Requests slowed down by a bandwidth limit, by limit and direction: download or upload.", "limit", "direction")
+
+// Defaults of the Bandwidth fields.
+const (
+	defaultBandwidthMaxClients = 100000
+	bandwidthSweepInterval     = time.Minute
+	// bandwidthChunk bounds the bytes written or read at once, so that
+	// throttled transfers flow steadily rather than in bursts.
+	bandwidthChunk = 16 << 10
+)
+
+// Bandwidth limits the bytes per second each client downloads, in response
+// bodies, and uploads, in request bodies, so that one heavy client cannot
+// saturate the uplink of the load balancer. Download and Upload are the
+// rates, zero meaning no limit, and Burst the bytes a client idle for a
+// while may transfer at once, one second of the rate by default. The
+// requests of a client at once share its rates.
+//
+// Clients are identified by the value of the Header of their requests,
+// such as that of their API key, or by their address without one. The
+// header is chosen by clients: only requests whose key is checked, such as
+// by API keys, should be limited by it. Up to MaxClients clients are
+// tracked, 100000 by default; past it, clients without requests under way
+// are forgotten first.
+type Bandwidth struct {
+	Download   int64
+	Upload     int64
+	Burst      int64
+	Header     string
+	MaxClients int
+	name       string
+
+	mu        sync.Mutex
+	clients   map[string]*bandwidthClient
+	lastSweep time.Time
+}
+
+// bandwidthClient holds the token buckets of a client, in bytes.
+type bandwidthClient struct {
+	download bandwidthBucket
+	upload   bandwidthBucket
+	active   int
+}
+
+// NewBandwidth creates a Bandwidth of download and upload bytes per second
+// per client, counted in the metrics under name.
+func NewBandwidth(name string, download, upload int64) (*Bandwidth, error) {
+	if download < 0 || upload < 0 || download == 0 && upload == 0 {
+		return nil, fmt.Errorf("download or upload must be positive")
+	}
+	return &Bandwidth{Download: download, Upload: upload, name: name}, nil
+}
+
+// Middleware returns the middleware throttling the bodies of requests and
+// responses. Responses are throttled as written to the client, after any
+// compression run before it.
+func (b *Bandwidth) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := b.key(r)
+			if key == "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			c := b.acquire(key, time.Now())
+			defer b.release(c)
+			if b.Upload > 0 && r.Body != nil && r.Body != http.NoBody {
+				r = r.WithContext(r.Context())
+				r.Body = &bandwidthBody{ReadCloser: r.Body, limit: b, bucket: &c.upload, r: r}
+			}
+			if b.Download > 0 {
+				rw = &bandwidthWriter{ResponseWriter: rw, limit: b, bucket: &c.download, r: r}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// key returns the key of the client sending r, or "" if it has none.
+func (b *Bandwidth) key(r *http.Request) string {
+	if b.Header != "" {
+		if v := r.Header.Get(b.Header); v != "" {
+			return "key:" + v
+		}
+	}
+	if ip := clientIP(r); ip.IsValid() {
+		return ip.String()
+	}
+	return ""
+}
+
+// burst returns the burst of a rate.
+func (b *Bandwidth) burst(rate int64) int64 {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return rate
+}
+
+// acquire returns the entry of the client with key for a request, creating
+// it if needed, and forgets the clients whose buckets refilled, which a new
+// entry would be equal to.
+func (b *Bandwidth) acquire(key string, now time.Time) *bandwidthClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients == nil {
+		b.clients = map[string]*bandwidthClient{}
+	}
+	if now.Sub(b.lastSweep) >= bandwidthSweepInterval {
+		for k, c := range b.clients {
+			if b.idle(c, now) {
+				b.forget(k)
+				tableEvictions.Inc("bandwidth_clients", "expired")
+			}
+		}
+		b.lastSweep = now
+	}
+	c := b.clients[key]
+	if c == nil {
+		if len(b.clients) >= cmp.Or(b.MaxClients, defaultBandwidthMaxClients) {
+			b.evict()
+		}
+		c = &bandwidthClient{}
+		b.clients[key] = c
+		tableEntries.Inc("bandwidth_clients")
+	}
+	c.active++
+	return c
+}
+
+func (b *Bandwidth) release(c *bandwidthClient) {
+	b.mu.Lock()
+	c.active--
+	b.mu.Unlock()
+}
+
+// idle reports whether c has no request under way and its buckets are
+// full. b.mu must be held.
+func (b *Bandwidth) idle(c *bandwidthClient, now time.Time) bool {
+	return c.active == 0 &&
+		c.download.full(b.Download, b.burst(b.Download), now) &&
+		c.upload.full(b.Upload, b.burst(b.Upload), now)
+}
+
+// evict forgets a client to make room for another, preferring one without
+// requests under way.
+func (b *Bandwidth) evict() {
+	var victim string
+	for k, c := range b.clients {
+		victim = k
+		if c.active == 0 {
+			break
+		}
+	}
+	b.forget(victim)
+	tableEvictions.Inc("bandwidth_clients", "capacity")
+}
+
+func (b *Bandwidth) forget(key string) {
+	delete(b.clients, key)
+	tableEntries.Dec("bandwidth_clients")
+}
+
+// bandwidthBucket is a token bucket of bytes. Taking more than it holds
+// leaves it in debt, which the taker waits out, so that the requests of a
+// client share its rate in the order they asked.
+type bandwidthBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes n bytes from the bucket and returns how long to wait before
+// sending them.
+func (k *bandwidthBucket) take(n int, rate, burst int64, now time.Time) time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.last.IsZero() {
+		k.tokens = float64(burst)
+	} else {
+		k.tokens = min(float64(burst), k.tokens+now.Sub(k.last).Seconds()*float64(rate))
+	}
+	k.last = now
+	k.tokens -= float64(n)
+	if k.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-k.tokens / float64(rate) * float64(time.Second))
+}
+
+// full reports whether the bucket refilled to burst by now.
+func (k *bandwidthBucket) full(rate, burst int64, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return rate == 0 || k.last.IsZero() || k.tokens+now.Sub(k.last).Seconds()*float64(rate) >= float64(burst)
+}
+
+// wait takes n bytes from bucket at rate and waits until they may be sent,
+// or until the request r is canceled. throttled is set the first time it
+// has to wait, counted in direction.
+func (b *Bandwidth) wait(r *http.Request, bucket *bandwidthBucket, rate int64, n int, direction string, throttled *bool) error {
+	d := bucket.take(n, rate, b.burst(rate), time.Now())
+	if d <= 0 {
+		return nil
+	}
+	if !*throttled {
+		*throttled = true
+		bandwidthThrottled.Inc(b.name, direction)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// chunk returns the bytes of a rate to write or read at once.
+func (b *Bandwidth) chunk(rate int64) int {
+	return int(min(b.burst(rate), bandwidthChunk))
+}
+
+// bandwidthWriter throttles the body of a response.
+type bandwidthWriter struct {
+	http.ResponseWriter
+	limit     *Bandwidth
+	bucket    *bandwidthBucket
+	r         *http.Request
+	throttled bool
+}
+
+func (w *bandwidthWriter) Write(p []byte) (int, error) {
+	written := 0
+	size := w.limit.chunk(w.limit.Download)
+	for len(p) > 0 {
+		n := min(len(p), size)
+		if err := w.limit.wait(w.r, w.bucket, w.limit.Download, n, "download", &w.throttled); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *bandwidthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bandwidthBody throttles the body of a request.
+type bandwidthBody struct {
+	io.ReadCloser
+	limit     *Bandwidth
+	bucket    *bandwidthBucket
+	r         *http.Request
+	throttled bool
+}
+
+func (b *bandwidthBody) Read(p []byte) (int, error) {
+	p = p[:min(len(p), b.limit.chunk(b.limit.Upload))]
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.limit.wait(b.r, b.bucket, b.limit.Upload, n, "upload", &b.throttled); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
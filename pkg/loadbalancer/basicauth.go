@@ -0,0 +1,217 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// htpasswdCheckInterval is how often BasicAuth checks its file for changes.
+const htpasswdCheckInterval = 5 * time.Second
+
+// passwordHashes verifies passwords against the hashes of an htpasswd file,
+// by hash prefix. The bcrypt build tag adds "$2y$", "$2a$" and "$2b$".
+var passwordHashes = map[string]func(hash, password string) bool{
+	"{SHA}":  verifySHA,
+	"$apr1$": verifyAPR1,
+}
+
+// BasicAuth requires the users listed in an htpasswd file to authenticate
+// with HTTP basic authentication. Passwords hashed with SHA-1 ("htpasswd
+// -s") and Apache MD5 ("htpasswd -m") are understood, and bcrypt ("htpasswd
+// -B") in builds with the bcrypt tag. The file is read again when it
+// changes.
+//
+// The Authorization header is not forwarded to backends; if UserHeader is
+// set, the authenticated user is sent in that header instead.
+type BasicAuth struct {
+	Realm      string
+	UserHeader string
+	path       string
+
+	mu      sync.Mutex
+	users   map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// NewBasicAuth creates a BasicAuth for the htpasswd file at path.
+func NewBasicAuth(path, realm string) (*BasicAuth, error) {
+	if realm == "" {
+		realm = "Restricted"
+	}
+	a := &BasicAuth{Realm: realm, path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the file if it changed since it was last read.
+func (a *BasicAuth) load() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(a.modTime) && a.users != nil {
+		return nil
+	}
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.users, a.modTime = users, fi.ModTime()
+	return nil
+}
+
+func parseHtpasswd(b []byte) (map[string]string, error) {
+	users := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if hashVerifier(hash) == nil {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %q", n, user)
+		}
+		users[user] = hash
+	}
+	return users, sc.Err()
+}
+
+func hashVerifier(hash string) func(hash, password string) bool {
+	for prefix, verify := range passwordHashes {
+		if strings.HasPrefix(hash, prefix) {
+			return verify
+		}
+	}
+	return nil
+}
+
+// check reports whether password is that of user.
+func (a *BasicAuth) check(user, password string) bool {
+	a.mu.Lock()
+	if now := time.Now(); now.Sub(a.checked) >= htpasswdCheckInterval {
+		a.checked = now
+		if err := a.load(); err != nil {
+			logf("Basic auth: keeping the users read before: %v", err)
+		}
+	}
+	hash, ok := a.users[user]
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return hashVerifier(hash)(hash, password)
+}
+
+// Middleware returns the middleware authenticating requests.
+func (a *BasicAuth) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !a.check(user, password) {
+				rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+				httpError(rw, r, "401 unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			r.Header.Del("Authorization")
+			if a.UserHeader != "" {
+				r.Header.Set(a.UserHeader, user)
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func verifySHA(hash, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+func verifyAPR1(hash, password string) bool {
+	salt, _, ok := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+}
+
+// apr1 hashes password with salt by Apache's variant of the MD5-based crypt.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := range 1000 {
+		h := md5.New()
+		if i&1 == 1 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 == 1 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		for v := uint(a)<<16 | uint(b)<<8 | uint(c); n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return magic + salt + "$" + string(out)
+}
@@ -0,0 +1,15 @@
+//go:build bcrypt
+
+package loadbalancer
+
+import "golang.org/x/crypto/bcrypt"
+
+func init() {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$"} {
+		passwordHashes[prefix] = verifyBcrypt
+	}
+}
+
+func verifyBcrypt(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Hashes made with openssl passwd -apr1 and htpasswd -s.
+func TestPasswordHashes(t *testing.T) {
+	for _, tc := range []struct {
+		hash, password string
+		ok             bool
+	}{
+		{"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1", "password", true},
+		{"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1", "Password", false},
+		{"$apr1$abcdefgh$IshqA7ZB4xfH4moRYs9vx/", "password", false},
+		{"$apr1$abcdefgh$6W8QabQbtenjmlmLIbpBU0", "a-very-long-password-past-sixteen-bytes", true},
+		{"$apr1$x.Y/1z$YsF.mVIiettuDOMR5bSHf1", "pa:ss wörd", true},
+		{"$apr1$abcdefgh", "password", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret ", false},
+	} {
+		verify := hashVerifier(tc.hash)
+		if verify == nil {
+			t.Errorf("%s: no verifier", tc.hash)
+			continue
+		}
+		if got := verify(tc.hash, tc.password); got != tc.ok {
+			t.Errorf("%s with %q: got %t, want %t", tc.hash, tc.password, got, tc.ok)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	htpasswd := "# staging\nalice:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	if err := os.WriteFile(path, []byte(htpasswd), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewBasicAuth(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.UserHeader = "X-User"
+	var user, authorization string
+	h := a.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, authorization = r.Header.Get("X-User"), r.Header.Get("Authorization")
+	}))
+	for _, tc := range []struct {
+		user, password string
+		want           int
+	}{
+		{"alice", "password", http.StatusOK},
+		{"bob", "secret", http.StatusOK},
+		{"alice", "secret", http.StatusUnauthorized},
+		{"carol", "password", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		user, authorization = "", ""
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("%s:%s: got %d, want %d", tc.user, tc.password, rec.Code, tc.want)
+			continue
+		}
+		if tc.want != http.StatusOK {
+			if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="Restricted", charset="UTF-8"` {
+				t.Errorf("%s:%s: WWW-Authenticate %q", tc.user, tc.password, got)
+			}
+			continue
+		}
+		if user != tc.user || authorization != "" {
+			t.Errorf("%s: backend got user %q, Authorization %q", tc.user, user, authorization)
+		}
+	}
+}
+
+func TestParseHtpasswdErrors(t *testing.T) {
+	for name, file := range map[string]string{
+		"no hash":          "alice\n",
+		"no user":          ":{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+		"unsupported hash": "alice:plaintext\n",
+	} {
+		if _, err := parseHtpasswd([]byte(file)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
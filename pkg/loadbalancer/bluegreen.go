@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Deployment colors of a BlueGreen route.
+const (
+	Blue  = "blue"
+	Green = "green"
+)
+
+// BlueGreen sends a route's traffic to one of two pools and lets operators
+// switch the active one atomically, keeping the previous choice for rollback.
+type BlueGreen struct {
+	BluePool  string
+	GreenPool string
+
+	state atomic.Pointer[blueGreenState]
+}
+
+type blueGreenState struct {
+	active   string
+	previous string
+}
+
+// BlueGreenStatus is a snapshot of a BlueGreen's state.
+type BlueGreenStatus struct {
+	Blue     string `json:"blue"`
+	Green    string `json:"green"`
+	Active   string `json:"active"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// NewBlueGreen creates a BlueGreen with the given active color.
+func NewBlueGreen(bluePool, greenPool, active string) (*BlueGreen, error) {
+	if active == "" {
+		active = Blue
+	}
+	if active != Blue && active != Green {
+		return nil, fmt.Errorf("active must be %q or %q, got %q", Blue, Green, active)
+	}
+	bg := &BlueGreen{BluePool: bluePool, GreenPool: greenPool}
+	bg.state.Store(&blueGreenState{active: active})
+	return bg, nil
+}
+
+// ActivePool returns the name of the pool currently receiving traffic.
+func (bg *BlueGreen) ActivePool() string {
+	if bg.state.Load().active == Green {
+		return bg.GreenPool
+	}
+	return bg.BluePool
+}
+
+// Status returns a snapshot of the current state.
+func (bg *BlueGreen) Status() BlueGreenStatus {
+	st := bg.state.Load()
+	return BlueGreenStatus{Blue: bg.BluePool, Green: bg.GreenPool, Active: st.active, Previous: st.previous}
+}
+
+// Switch makes color the active one. An empty color switches to the inactive one.
+func (bg *BlueGreen) Switch(color string) error {
+	if color != "" && color != Blue && color != Green {
+		return fmt.Errorf("color must be %q or %q, got %q", Blue, Green, color)
+	}
+	for {
+		old := bg.state.Load()
+		next := color
+		if next == "" {
+			next = otherColor(old.active)
+		}
+		if bg.state.CompareAndSwap(old, &blueGreenState{active: next, previous: old.active}) {
+			return nil
+		}
+	}
+}
+
+// Rollback restores the color that was active before the last switch.
+func (bg *BlueGreen) Rollback() error {
+	for {
+		old := bg.state.Load()
+		if old.previous == "" {
+			return fmt.Errorf("no previous deployment to roll back to")
+		}
+		if bg.state.CompareAndSwap(old, &blueGreenState{active: old.previous, previous: old.active}) {
+			return nil
+		}
+	}
+}
+
+// restore sets the state to a status obtained from Status.
+func (bg *BlueGreen) restore(st BlueGreenStatus) error {
+	for _, color := range []string{st.Active, st.Previous} {
+		if color != Blue && color != Green && color != "" {
+			return fmt.Errorf("color must be %q or %q, got %q", Blue, Green, color)
+		}
+	}
+	if st.Active == "" {
+		return fmt.Errorf("no active color")
+	}
+	bg.state.Store(&blueGreenState{active: st.Active, previous: st.Previous})
+	return nil
+}
+
+func otherColor(color string) string {
+	if color == Green {
+		return Blue
+	}
+	return Green
+}
@@ -0,0 +1,142 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var bodyLimitExceeded = metrics.NewCounterVec("lb_body_limit_exceeded_total",
+	"Requests refused for a body larger than allowed, by limit.", "limit")
+
+// BodyLimit refuses requests whose body is larger than Max bytes with 413.
+// A request declaring a larger Content-Length is refused before any of its
+// body is forwarded; any other is cut off once it exceeds Max. A limit run
+// further in, that of a route, replaces one run before it rather than adding
+// to it, so routes may allow larger uploads than the rest. Final limits,
+// which none replaces, refuse requests declaring a larger Content-Length
+// without forwarding them at all.
+type BodyLimit struct {
+	Max   int64
+	Final bool
+	name  string
+}
+
+// NewBodyLimit creates a BodyLimit of max bytes, counted in the metrics
+// under name.
+func NewBodyLimit(name string, max int64, final bool) (*BodyLimit, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("body limit must be positive")
+	}
+	return &BodyLimit{Max: max, Final: final, name: name}, nil
+}
+
+// Middleware returns the middleware enforcing the limit.
+func (l *BodyLimit) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if l.Final && r.ContentLength > l.Max {
+				bodyLimitExceeded.Inc(l.name)
+				rw.Header().Set("Connection", "close")
+				httpError(rw, r, "413 request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			if b, ok := r.Body.(*limitedBody); ok {
+				b.setLimit(l)
+				next.ServeHTTP(rw, r)
+				return
+			}
+			b := &limitedBody{ReadCloser: r.Body, declared: r.ContentLength}
+			b.setLimit(l)
+			r = r.WithContext(r.Context())
+			r.Body = b
+			next.ServeHTTP(&bodyLimitWriter{ResponseWriter: rw, body: b}, r)
+		})
+	}
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reads past the limit of a BodyLimit.
+type limitedBody struct {
+	io.ReadCloser
+
+	declared int64
+
+	mu       sync.Mutex
+	limit    *BodyLimit
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) setLimit(l *BodyLimit) {
+	b.mu.Lock()
+	b.limit = l
+	b.mu.Unlock()
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	left := b.limit.Max - b.read
+	if b.declared > b.limit.Max {
+		b.exceed()
+		left = -1
+	}
+	b.mu.Unlock()
+	if left < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one byte more than allowed to tell a body of exactly the limit
+	// from a larger one.
+	n, err := b.ReadCloser.Read(p[:min(int64(len(p)), left+1)])
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += int64(n)
+	if b.read > b.limit.Max {
+		b.exceed()
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// exceed records that the body is too large. Its caller holds mu.
+func (b *limitedBody) exceed() {
+	if !b.exceeded {
+		b.exceeded = true
+		bodyLimitExceeded.Inc(b.limit.name)
+	}
+}
+
+func (b *limitedBody) tooLarge() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+// bodyLimitWriter turns the 502 the proxy answers when it fails to read the
+// request body into a 413 once the body was cut off.
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+}
+
+func (w *bodyLimitWriter) WriteHeader(code int) {
+	if code == http.StatusBadGateway && w.body.tooLarge() {
+		w.Header().Set("Connection", "close")
+		code = http.StatusRequestEntityTooLarge
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *bodyLimitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,192 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var botRequests = metrics.NewCounterVec("lb_bot_requests_total",
+	"Requests matched by a bot filter rule, by rule and action taken.", "rule", "action")
+
+// Bot rule actions.
+const (
+	BotAllow = "allow"
+	BotBlock = "block"
+	BotLimit = "limit"
+	BotRoute = "route"
+)
+
+// defaultBotHeader is the header naming the rule a request matched for the
+// route action.
+const defaultBotHeader = "X-Bot"
+
+// botSweepInterval is how often the rate limits of clients gone quiet are
+// forgotten.
+const botSweepInterval = time.Minute
+
+// defaultBotMaxClients bounds the clients whose rate a limit rule tracks by
+// default.
+const defaultBotMaxClients = 100000
+
+// BotRule matches requests by their User-Agent and the headers they lack,
+// which browsers send and most scrapers do not. A rule matches a request
+// whose User-Agent matches one of UserAgents, or which lacks one of
+// MissingHeaders; "User-Agent" among them matches requests without one. A
+// rule with neither matches every request, to limit the rate of every
+// client.
+//
+// Action is what is done with a matching request: BotAllow lets it through
+// without trying further rules, for well-behaved crawlers; BotBlock answers
+// 403; BotLimit answers 429 once its client, by address, sends more than Rate
+// requests a second, with bursts of Burst; BotRoute names the rule in the
+// filter's Header, for routes to send the request to a pool of its own.
+//
+// A limit rule tracks the rates of up to MaxClients clients, 100000 if
+// zero; past it, arbitrary clients are forgotten, and start over with a
+// full burst.
+type BotRule struct {
+	Name           string
+	UserAgents     []*regexp.Regexp
+	MissingHeaders []string
+	Action         string
+	Rate           float64
+	Burst          int
+	MaxClients     int
+
+	limit     *APIKey
+	mu        sync.Mutex
+	clients   map[netip.Addr]*apiKeyLimits
+	lastSweep time.Time
+}
+
+// matches reports whether r matches the rule.
+func (br *BotRule) matches(r *http.Request) bool {
+	if len(br.UserAgents) == 0 && len(br.MissingHeaders) == 0 {
+		return true
+	}
+	ua := r.UserAgent()
+	if slices.ContainsFunc(br.UserAgents, func(re *regexp.Regexp) bool { return re.MatchString(ua) }) {
+		return true
+	}
+	return slices.ContainsFunc(br.MissingHeaders, func(name string) bool { return r.Header.Get(name) == "" })
+}
+
+// allow reports whether the client at ip may send a request now under the
+// rule's rate, and if it may not, when to retry.
+func (br *BotRule) allow(ip netip.Addr, now time.Time) (bool, time.Duration) {
+	br.mu.Lock()
+	if now.Sub(br.lastSweep) >= botSweepInterval {
+		// A client idle long enough to have refilled its burst is as
+		// good as new.
+		idle := time.Duration(float64(br.limit.Burst) / br.Rate * float64(time.Second))
+		for addr, l := range br.clients {
+			l.mu.Lock()
+			if now.Sub(l.last) > idle {
+				delete(br.clients, addr)
+				tableEntries.Dec("bot_clients")
+				tableEvictions.Inc("bot_clients", "expired")
+			}
+			l.mu.Unlock()
+		}
+		br.lastSweep = now
+	}
+	l := br.clients[ip]
+	if l == nil {
+		for addr := range br.clients {
+			if len(br.clients) < br.MaxClients {
+				break
+			}
+			delete(br.clients, addr)
+			tableEntries.Dec("bot_clients")
+			tableEvictions.Inc("bot_clients", "capacity")
+		}
+		l = &apiKeyLimits{}
+		br.clients[ip] = l
+		tableEntries.Inc("bot_clients")
+	}
+	br.mu.Unlock()
+	ok, retry := l.allow(br.limit, now)
+	return ok, retry
+}
+
+// BotFilter applies the first of its rules matching each request. The
+// Header naming the rule of the route action is removed from every request
+// first, so that clients cannot set it themselves.
+type BotFilter struct {
+	Rules  []*BotRule
+	Header string
+}
+
+// NewBotFilter creates a BotFilter, checking its rules.
+func NewBotFilter(rules []*BotRule, header string) (*BotFilter, error) {
+	for _, br := range rules {
+		switch br.Action {
+		case BotAllow, BotBlock, BotRoute:
+		case BotLimit:
+			if br.Rate <= 0 {
+				return nil, fmt.Errorf("rule %q: limit requires a positive rate", br.Name)
+			}
+			br.limit = &APIKey{Rate: br.Rate, Burst: max(br.Burst, 1)}
+			br.clients = map[netip.Addr]*apiKeyLimits{}
+			if br.MaxClients <= 0 {
+				br.MaxClients = defaultBotMaxClients
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q", br.Name, br.Action)
+		}
+	}
+	if header == "" {
+		header = defaultBotHeader
+	}
+	return &BotFilter{Rules: rules, Header: header}, nil
+}
+
+// Middleware returns the middleware filtering bots.
+func (f *BotFilter) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(f.Header) != "" {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				r.Header.Del(f.Header)
+			}
+			for _, br := range f.Rules {
+				if !br.matches(r) {
+					continue
+				}
+				switch br.Action {
+				case BotBlock:
+					botRequests.Inc(br.Name, "blocked")
+					httpError(rw, r, "403 forbidden", http.StatusForbidden)
+					return
+				case BotLimit:
+					if ok, retry := br.allow(clientIP(r), time.Now()); !ok {
+						botRequests.Inc(br.Name, "limited")
+						rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+						httpError(rw, r, "429 too many requests", http.StatusTooManyRequests)
+						return
+					}
+					botRequests.Inc(br.Name, "allowed")
+				case BotRoute:
+					botRequests.Inc(br.Name, "routed")
+					r = r.WithContext(r.Context())
+					r.Header = r.Header.Clone()
+					r.Header.Set(f.Header, br.Name)
+				case BotAllow:
+					botRequests.Inc(br.Name, "allowed")
+				}
+				break
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package loadbalancer
+
+import "sync"
+
+// copyBufferSize is the size of the buffers bodies and connections are
+// copied through, that of io.Copy.
+const copyBufferSize = 32 << 10
+
+// copyBuffers lends the buffers of the reverse proxies, the layer-4 proxies
+// and the FastCGI client, so that copying does not allocate a buffer for
+// every request or connection.
+var copyBuffers = &bufferPool{size: copyBufferSize}
+
+// bufferPool is an httputil.BufferPool of buffers of size bytes.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// Get returns a buffer of the pool's size.
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+// Put returns b to the pool. Buffers of another size are dropped.
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
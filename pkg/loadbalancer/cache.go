@@ -0,0 +1,694 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+const (
+	defaultCacheMaxEntries   = 10000
+	defaultCacheMaxSize      = 64 << 20
+	defaultCacheMaxEntrySize = 1 << 20
+	// cacheRevalidateTimeout bounds a revalidation in the background.
+	cacheRevalidateTimeout = 30 * time.Second
+)
+
+var (
+	cacheRequests = metrics.NewCounterVec("lb_cache_requests_total",
+		"Requests to cached routes, by route and result (hit, stale, revalidated, coalesced, miss or bypass).", "route", "result")
+	cacheEntries = metrics.NewGaugeVec("lb_cache_entries",
+		"Responses held in the cache of a route.", "route")
+)
+
+// cacheableStatus lists the statuses of the responses cached.
+var cacheableStatus = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+	http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone,
+}
+
+// Cache serves GET and HEAD requests from memory while the response a
+// backend gave to an earlier one is fresh, following HTTP caching (RFC
+// 9111) as a shared cache. Responses are keyed by host and URL, and by the
+// request headers they vary on; the least recently used are evicted once
+// the cache holds MaxEntries responses or MaxSize bytes.
+//
+// How long a response stays fresh is given by its s-maxage or max-age
+// Cache-Control directive, or its Expires header, or else TTL. A stale
+// response with an ETag or a Last-Modified date is revalidated with a
+// conditional request, and an answer of 304 makes it fresh again. For
+// StaleWhileRevalidate past its freshness, or its stale-while-revalidate
+// directive, a stale response is served at once while it is revalidated in
+// the background; for StaleIfError, or its stale-if-error directive, it is
+// served when the backend fails with 500, 502, 503 or 504. must-revalidate
+// and proxy-revalidate forbid either.
+//
+// Responses larger than MaxEntrySize, setting cookies, marked private or
+// no-store, or with a status other than 200, 203, 204, 301, 404 and 410
+// are not cached, nor are the responses to requests with credentials.
+// Requests with "Cache-Control: no-cache" or "max-age=0" are revalidated.
+//
+// GET requests arriving while an identical one is forwarded to the backend,
+// as happens to popular responses once they expire, wait for its response
+// instead of being forwarded too, and are answered from the cache once it
+// is stored. They are forwarded in turn if it is not cacheable for them.
+//
+// Responses carry an X-Cache header: HIT, STALE, REVALIDATED or MISS. Those
+// from the cache also carry an Age header.
+type Cache struct {
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	MaxEntries           int
+	MaxSize              int64
+	MaxEntrySize         int64
+	name                 string
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	bases   map[string]*cacheBase
+	size    int64
+	// flights holds the requests forwarded to the backend for a key, closed
+	// once answered, for identical requests to wait on.
+	flights map[string]chan struct{}
+}
+
+// cacheBase records the headers the responses to a URL vary on, kept while
+// entries of the URL are cached.
+type cacheBase struct {
+	vary    []string
+	entries int
+}
+
+type cacheEntry struct {
+	key    string
+	base   string
+	vary   []string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+
+	// lifetime is how long the entry is fresh after stored; stale entries
+	// may be served for swr while revalidated, or for sie on errors.
+	lifetime time.Duration
+	swr, sie time.Duration
+
+	revalidating atomic.Bool
+}
+
+// NewCache creates a Cache for the route name. ttl is the freshness of the
+// responses that do not state theirs; zero caches only those that do. Zero
+// limits mean 10000 entries, 64 MiB and 1 MiB per response.
+func NewCache(name string, ttl time.Duration, maxEntries int, maxSize, maxEntrySize int64) (*Cache, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("negative ttl")
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	if maxSize <= 0 {
+		maxSize = defaultCacheMaxSize
+	}
+	if maxEntrySize <= 0 {
+		maxEntrySize = defaultCacheMaxEntrySize
+	}
+	return &Cache{
+		TTL:          ttl,
+		MaxEntries:   maxEntries,
+		MaxSize:      maxSize,
+		MaxEntrySize: min(maxEntrySize, maxSize),
+		name:         name,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+		bases:        map[string]*cacheBase{},
+		flights:      map[string]chan struct{}{},
+	}, nil
+}
+
+// baseKey returns the key of r without its varying headers.
+func baseKey(r *http.Request) string {
+	return r.Host + " " + r.URL.RequestURI()
+}
+
+// varyKey returns the key of r once the response was found to vary on names.
+func varyKey(base string, names []string, r *http.Request) string {
+	if len(names) == 0 {
+		return base
+	}
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range names {
+		b.WriteString("\n" + name + ":" + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyNames returns the canonical names of the headers in h's Vary header,
+// and false for "Vary: *".
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), true
+}
+
+// cacheControl parses the Cache-Control directives of h into a map from
+// lowercase names to their values, "" for directives without one.
+func cacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// seconds returns the delta-seconds value of directive in cc.
+func seconds(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshness sets the lifetime and stale windows of e from its header.
+func (c *Cache) freshness(e *cacheEntry) {
+	h := e.header
+	cc := cacheControl(h)
+	if d, ok := seconds(cc, "s-maxage"); ok {
+		e.lifetime = d
+	} else if d, ok := seconds(cc, "max-age"); ok {
+		e.lifetime = d
+	} else if exp := h.Get("Expires"); exp != "" {
+		// An invalid Expires, such as "0", means already expired.
+		if t, err := http.ParseTime(exp); err == nil {
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = e.stored
+			}
+			e.lifetime = max(t.Sub(date), 0)
+		}
+	} else {
+		e.lifetime = c.TTL
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+		e.lifetime = max(e.lifetime-time.Duration(age)*time.Second, 0)
+	}
+	if _, ok := cc["no-cache"]; ok {
+		e.lifetime = 0
+	}
+	e.swr, e.sie = c.StaleWhileRevalidate, c.StaleIfError
+	if d, ok := seconds(cc, "stale-while-revalidate"); ok {
+		e.swr = d
+	}
+	if d, ok := seconds(cc, "stale-if-error"); ok {
+		e.sie = d
+	}
+	_, must := cc["must-revalidate"]
+	_, proxy := cc["proxy-revalidate"]
+	if must || proxy {
+		e.swr, e.sie = 0, 0
+	}
+}
+
+// validatable reports whether e can be revalidated.
+func (e *cacheEntry) validatable() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// staleFor returns how long e has been stale at now, negative while fresh.
+func (e *cacheEntry) staleFor(now time.Time) time.Duration {
+	return now.Sub(e.stored) - e.lifetime
+}
+
+// lookup returns the entry for r, if any, fresh or not. Entries too stale
+// to be served or revalidated are removed.
+func (c *Cache) lookup(r *http.Request, now time.Time) *cacheEntry {
+	base := baseKey(r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.bases[base]
+	if !ok {
+		return nil
+	}
+	el, ok := c.entries[varyKey(base, b.vary, r)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if e.staleFor(now) > max(e.swr, e.sie) && !e.validatable() {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// store adds e, the response to r, evicting the least recently used
+// entries to make room.
+func (c *Cache) store(r *http.Request, e *cacheEntry) {
+	e.base = baseKey(r)
+	e.key = varyKey(e.base, e.vary, r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.bases[e.base]; ok && !slices.Equal(b.vary, e.vary) {
+		// The response varies on other headers than before; the entries
+		// keyed the old way can no longer be found.
+		c.purge(e.base)
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	b := c.bases[e.base]
+	if b == nil {
+		b = &cacheBase{vary: e.vary}
+		c.bases[e.base] = b
+	}
+	b.entries++
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += int64(len(e.body))
+	for c.lru.Len() > c.MaxEntries || c.size > c.MaxSize {
+		c.remove(c.lru.Back())
+		tableEvictions.Inc("http_cache", "capacity")
+	}
+	cacheEntries.Set(int64(c.lru.Len()), c.name)
+}
+
+// refresh replaces e, the response to r, by a copy updated with the header
+// of a 304 answer to its revalidation.
+func (c *Cache) refresh(r *http.Request, e *cacheEntry, h http.Header, now time.Time) *cacheEntry {
+	fresh := &cacheEntry{vary: e.vary, status: e.status, header: e.header.Clone(), body: e.body, stored: now}
+	for k, v := range h {
+		if k != "Content-Length" {
+			fresh.header[k] = v
+		}
+	}
+	fresh.header.Del("Age")
+	c.freshness(fresh)
+	c.store(r, fresh)
+	return fresh
+}
+
+// remove removes an entry. Its caller holds mu.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+	if b := c.bases[e.base]; b != nil {
+		if b.entries--; b.entries <= 0 {
+			delete(c.bases, e.base)
+		}
+	}
+	cacheEntries.Set(int64(c.lru.Len()), c.name)
+}
+
+// purge removes the entries of base. Its caller holds mu.
+func (c *Cache) purge(base string) {
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).base == base {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Purge empties the cache.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.bases = map[string]*cacheBase{}
+	c.size = 0
+	cacheEntries.Set(0, c.name)
+}
+
+// bypassesCache reports whether r must not be served from or stored in the
+// cache.
+func bypassesCache(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return noStore
+}
+
+// wantsRevalidation reports whether r asks for a response validated by the
+// backend.
+func wantsRevalidation(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	_, noCache := cc["no-cache"]
+	maxAge, ok := seconds(cc, "max-age")
+	return noCache || ok && maxAge == 0 || r.Header.Get("Pragma") == "no-cache"
+}
+
+// notModified reports whether the conditional headers of r match e.
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// serve answers r with e, marked with the X-Cache value result.
+func (e *cacheEntry) serve(rw http.ResponseWriter, r *http.Request, now time.Time, result string) {
+	h := rw.Header()
+	for k, v := range e.header {
+		h[k] = append(h[k], v...)
+	}
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	h.Set("X-Cache", result)
+	if e.status == http.StatusOK && e.notModified(r) {
+		h.Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if e.status != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	}
+	rw.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		rw.Write(e.body)
+	}
+}
+
+// conditional returns r asking the backend to answer 304 if e is still
+// valid, or r itself if e cannot be revalidated or r is already
+// conditional, in which case the backend answers it.
+func conditional(ctx context.Context, r *http.Request, e *cacheEntry) (*http.Request, bool) {
+	if e == nil || !e.validatable() || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return r, false
+	}
+	r = r.Clone(ctx)
+	if etag := e.header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.header.Get("Last-Modified"); lm != "" {
+		r.Header.Set("If-Modified-Since", lm)
+	}
+	return r, true
+}
+
+// Middleware returns the middleware caching responses.
+func (c *Cache) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if bypassesCache(r) {
+				cacheRequests.Inc(c.name, "bypass")
+				next.ServeHTTP(rw, r)
+				return
+			}
+			now := time.Now()
+			e := c.lookup(r, now)
+			if e != nil && !wantsRevalidation(r) {
+				switch stale := e.staleFor(now); {
+				case stale < 0:
+					cacheRequests.Inc(c.name, "hit")
+					e.serve(rw, r, now, "HIT")
+					return
+				case stale <= e.swr:
+					cacheRequests.Inc(c.name, "stale")
+					e.serve(rw, r, now, "STALE")
+					c.revalidate(next, r, e)
+					return
+				}
+			}
+			if r.Method == http.MethodGet {
+				key, flight, leader := c.join(r)
+				if leader {
+					defer c.leave(key, flight)
+				} else {
+					select {
+					case <-flight:
+					case <-r.Context().Done():
+						return
+					}
+					now = time.Now()
+					if e := c.lookup(r, now); e != nil && e.staleFor(now) < 0 {
+						cacheRequests.Inc(c.name, "coalesced")
+						e.serve(rw, r, now, "HIT")
+						return
+					}
+				}
+			}
+			c.fetch(rw, r, next, e, now)
+		})
+	}
+}
+
+// join returns the flight of the requests identical to r being forwarded,
+// under key, or starts one and reports that r leads it. Requests are
+// identical if they have the same base key and, if the responses to it vary
+// on headers, the same values of those.
+func (c *Cache) join(r *http.Request) (key string, flight chan struct{}, leader bool) {
+	key = baseKey(r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.bases[key]; ok {
+		key = varyKey(key, b.vary, r)
+	}
+	if flight, ok := c.flights[key]; ok {
+		return key, flight, false
+	}
+	flight = make(chan struct{})
+	c.flights[key] = flight
+	return key, flight, true
+}
+
+// leave ends the flight of key, releasing the requests waiting on it.
+func (c *Cache) leave(key string, flight chan struct{}) {
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(flight)
+}
+
+// fetch forwards r to the backend, revalidating the stale entry e if there
+// is one, and caches the response.
+func (c *Cache) fetch(rw http.ResponseWriter, r *http.Request, next http.Handler, e *cacheEntry, now time.Time) {
+	req, cond := conditional(r.Context(), r, e)
+	rec := &cacheRecorder{ResponseWriter: rw, max: c.MaxEntrySize, before: rw.Header().Clone()}
+	rec.hold = func(status int) bool {
+		return cond && status == http.StatusNotModified || e != nil && servesOnError(status) && e.staleFor(time.Now()) <= e.sie
+	}
+	rw.Header().Set("X-Cache", "MISS")
+	next.ServeHTTP(rec, req)
+	switch {
+	case rec.held && rec.status == http.StatusNotModified:
+		cacheRequests.Inc(c.name, "revalidated")
+		c.refresh(r, e, rec.header, time.Now()).serve(rw, r, time.Now(), "REVALIDATED")
+	case rec.held:
+		cacheRequests.Inc(c.name, "stale")
+		e.serve(rw, r, time.Now(), "STALE")
+	default:
+		cacheRequests.Inc(c.name, "miss")
+		if ne, ok := rec.entry(); ok && r.Method == http.MethodGet {
+			c.freshness(ne)
+			if ne.lifetime > 0 || ne.swr > 0 || ne.sie > 0 || ne.validatable() {
+				c.store(r, ne)
+			}
+		}
+	}
+}
+
+// revalidate revalidates e, the response to r, in the background, unless it
+// already is.
+func (c *Cache) revalidate(next http.Handler, r *http.Request, e *cacheEntry) {
+	if !e.revalidating.CompareAndSwap(false, true) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), cacheRevalidateTimeout)
+	r = r.Clone(ctx)
+	r.Method = http.MethodGet
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	go func() {
+		defer cancel()
+		defer e.revalidating.Store(false)
+		req, _ := conditional(ctx, r, e)
+		rec := &cacheRecorder{ResponseWriter: discardResponseWriter{header: http.Header{}}, max: c.MaxEntrySize, before: http.Header{}}
+		next.ServeHTTP(rec, req)
+		if rec.status == http.StatusNotModified {
+			c.refresh(r, e, rec.header, time.Now())
+			return
+		}
+		if ne, ok := rec.entry(); ok {
+			c.freshness(ne)
+			c.store(r, ne)
+		}
+	}()
+}
+
+// servesOnError reports whether a stale response may replace one with
+// status, under stale-if-error.
+func servesOnError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cacheRecorder keeps a copy of a response while it is sent, unless it
+// grows larger than max. If hold returns true for its status, the response
+// is held back instead, for a cached one to be sent in its place.
+type cacheRecorder struct {
+	http.ResponseWriter
+	max int64
+	// before is the header set before the backend answered, by the cache
+	// and middleware run earlier, which is left out of the entry.
+	before http.Header
+	hold   func(status int) bool
+
+	status  int
+	held    bool
+	header  http.Header
+	body    bytes.Buffer
+	tooBig  bool
+	failed  bool
+	started time.Time
+}
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	if w.held {
+		return
+	}
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		w.header = headerAdded(w.before, w.Header())
+		w.started = time.Now()
+		if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && n > w.max {
+			// Large responses stream through without being recorded.
+			w.tooBig = true
+		}
+		if w.hold != nil && w.hold(code) {
+			w.held = true
+			h := w.Header()
+			clear(h)
+			for k, v := range w.before {
+				h[k] = v
+			}
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return len(b), nil
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.failed = true
+	}
+	if !w.tooBig {
+		if int64(w.body.Len()+n) > w.max {
+			w.tooBig = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// headerAdded returns the values of after not in before.
+func headerAdded(before, after http.Header) http.Header {
+	added := http.Header{}
+	for k, v := range after {
+		if prior := before[k]; len(prior) <= len(v) && slices.Equal(prior, v[:len(prior)]) {
+			v = v[len(prior):]
+		}
+		if len(v) > 0 {
+			added[k] = slices.Clone(v)
+		}
+	}
+	return added
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *cacheRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// entry returns the cache entry of the response, if it may be cached.
+func (w *cacheRecorder) entry() (*cacheEntry, bool) {
+	if w.status == 0 || w.held || w.tooBig || w.failed || !slices.Contains(cacheableStatus, w.status) {
+		return nil, false
+	}
+	h := w.header
+	if h.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return nil, false
+	}
+	if _, ok := cc["private"]; ok {
+		return nil, false
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n != w.body.Len() {
+		// The response was cut short.
+		return nil, false
+	}
+	names, ok := varyNames(h)
+	if !ok {
+		return nil, false
+	}
+	return &cacheEntry{vary: names, status: w.status, header: h, body: w.body.Bytes(), stored: w.started}, true
+}
@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// cacheGet sends a GET request for target through h with the headers
+// given, returning the status, the X-Cache result and the body.
+func cacheGet(h http.Handler, target string, header map[string]string) (int, string, string) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Code, rec.Header().Get("X-Cache"), rec.Body.String()
+}
+
+// TestCacheVary checks that a response is only served to the requests
+// with the values of the headers it varies on.
+func TestCacheVary(t *testing.T) {
+	c, err := NewCache("test", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fetches++
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Accept-Language")
+		io.WriteString(rw, "hello in "+r.Header.Get("Accept-Language"))
+	}))
+	for i, tc := range []struct {
+		lang, result string
+	}{
+		{"en", "MISS"},
+		{"en", "HIT"},
+		{"fr", "MISS"},
+		{"fr", "HIT"},
+		{"en", "HIT"},
+		{"", "MISS"},
+	} {
+		_, result, body := cacheGet(h, "/greeting", map[string]string{"Accept-Language": tc.lang})
+		if result != tc.result {
+			t.Errorf("request %d in %q: X-Cache %s, want %s", i, tc.lang, result, tc.result)
+		}
+		if want := "hello in " + tc.lang; body != want {
+			t.Errorf("request %d in %q: body %q, want %q", i, tc.lang, body, want)
+		}
+	}
+	if fetches != 3 {
+		t.Errorf("%d fetches, want 3", fetches)
+	}
+}
+
+// TestCacheVaryStar checks that responses varying on everything are not
+// cached.
+func TestCacheVaryStar(t *testing.T) {
+	c, err := NewCache("test", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "*")
+		io.WriteString(rw, "hello")
+	}))
+	for range 2 {
+		if _, result, _ := cacheGet(h, "/", nil); result != "MISS" {
+			t.Errorf("X-Cache %s, want MISS", result)
+		}
+	}
+}
+
+// ageCache makes the entries of c look stored d earlier.
+func ageCache(c *Cache, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		e.stored = e.stored.Add(-d)
+	}
+}
+
+// TestCacheStaleIfError checks that a stale response replaces the errors
+// of the backend within its stale-if-error window only, and never for
+// must-revalidate.
+func TestCacheStaleIfError(t *testing.T) {
+	for _, tc := range []struct {
+		name, cacheControl string
+		age                time.Duration
+		stale              bool
+	}{
+		{"within the window", "max-age=1, stale-if-error=60", 30 * time.Second, true},
+		{"past the window", "max-age=1, stale-if-error=60", 2 * time.Minute, false},
+		{"must-revalidate", "max-age=1, stale-if-error=60, must-revalidate", 30 * time.Second, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCache("test", 0, 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failing := false
+			h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if failing {
+					http.Error(rw, "down", http.StatusServiceUnavailable)
+					return
+				}
+				rw.Header().Set("Cache-Control", tc.cacheControl)
+				rw.Header().Set("ETag", `"v1"`)
+				io.WriteString(rw, "v1")
+			}))
+			if _, result, _ := cacheGet(h, "/", nil); result != "MISS" {
+				t.Fatalf("X-Cache %s, want MISS", result)
+			}
+			ageCache(c, tc.age)
+			failing = true
+			code, result, body := cacheGet(h, "/", nil)
+			if tc.stale {
+				if code != http.StatusOK || result != "STALE" || body != "v1" {
+					t.Errorf("got %d %s %q, want the stale response", code, result, body)
+				}
+			} else if code != http.StatusServiceUnavailable {
+				t.Errorf("got %d %s %q, want the error", code, result, body)
+			}
+		})
+	}
+}
+
+// TestCacheStaleIfErrorStatuses checks that only server errors are
+// replaced by a stale response.
+func TestCacheStaleIfErrorStatuses(t *testing.T) {
+	c, err := NewCache("test", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StaleIfError = time.Minute
+	status := http.StatusOK
+	h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=1")
+		rw.WriteHeader(status)
+		io.WriteString(rw, strconv.Itoa(status))
+	}))
+	cacheGet(h, "/", nil)
+	for _, tc := range []struct {
+		status int
+		stale  bool
+	}{
+		{http.StatusBadGateway, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusNotFound, false},
+	} {
+		ageCache(c, 5*time.Second)
+		status = tc.status
+		code, _, _ := cacheGet(h, "/", nil)
+		if stale := code == http.StatusOK; stale != tc.stale {
+			t.Errorf("backend answering %d: got %d, want stale %t", tc.status, code, tc.stale)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the address of the client that sent r: the peer address,
+// or the address reported by trusted proxies in front of the LB. It returns
+// the zero Addr if the address cannot be parsed.
+func clientIP(r *http.Request) netip.Addr {
+	if c, ok := r.Context().Value(clientIPKey{}).(*clientIPContext); ok {
+		return c.ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the peer that sent r.
+func peerIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+type clientIPKey struct{}
+
+// clientIPContext carries the client address of a request. It takes one
+// allocation per request where context.WithValue would take two, boxing
+// the address.
+type clientIPContext struct {
+	context.Context
+	ip netip.Addr
+}
+
+func (c *clientIPContext) Value(key any) any {
+	if key == (clientIPKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// Forwarded maintains the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers, and optionally the RFC 7239 Forwarded header,
+// of requests passed to backends.
+//
+// Values received from peers in Trusted, such as a CDN or another balancer
+// in front of the LB, are kept and extended; values from any other peer are
+// dropped, so clients can't spoof their address. The client address used for
+// affinity, GeoIP and experiments is the right-most X-Forwarded-For entry
+// not in Trusted, or the zero Addr if that entry is not an address.
+type Forwarded struct {
+	Trusted []netip.Prefix
+	// Header also emits the standardized Forwarded header.
+	Header bool
+}
+
+// NewForwarded creates a Forwarded trusting the given proxies.
+func NewForwarded(trusted []netip.Prefix, header bool) *Forwarded {
+	return &Forwarded{Trusted: trusted, Header: header}
+}
+
+func (f *Forwarded) trusts(ip netip.Addr) bool {
+	for _, p := range f.Trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrites the forwarding headers of r and records its client address.
+// X-Forwarded-For itself is completed with the peer address by the reverse
+// proxy.
+func (f *Forwarded) apply(r *http.Request) *http.Request {
+	peer := peerIP(r)
+	trusted := peer.IsValid() && f.trusts(peer)
+	h := r.Header
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if !trusted {
+		h.Del("X-Forwarded-For")
+		h.Del("Forwarded")
+		h.Set("X-Forwarded-Proto", proto)
+		h.Set("X-Forwarded-Host", r.Host)
+	} else {
+		if h.Get("X-Forwarded-Proto") == "" {
+			h.Set("X-Forwarded-Proto", proto)
+		}
+		if h.Get("X-Forwarded-Host") == "" {
+			h.Set("X-Forwarded-Host", r.Host)
+		}
+	}
+	if f.Header {
+		elem := "for=" + forwardedNode(peer) + ";proto=" + proto
+		if r.Host != "" {
+			elem += ";host=" + forwardedValue(r.Host)
+		}
+		if prior := h.Values("Forwarded"); len(prior) > 0 {
+			elem = strings.Join(prior, ", ") + ", " + elem
+		}
+		h.Set("Forwarded", elem)
+	}
+
+	client := peer
+	if trusted {
+		// Walk the hops from the last, without splitting the headers.
+		values := h.Values("X-Forwarded-For")
+	hops:
+		for i := len(values) - 1; i >= 0; i-- {
+			for v := values[i]; ; {
+				hop := v
+				j := strings.LastIndexByte(v, ',')
+				if j >= 0 {
+					hop, v = v[j+1:], v[:j]
+				}
+				ip, err := netip.ParseAddr(strings.TrimSpace(hop))
+				if err != nil {
+					// Trusted proxies add addresses, so the client sent
+					// this entry.
+					client = netip.Addr{}
+					break hops
+				}
+				client = ip.Unmap()
+				if !f.trusts(client) {
+					break hops
+				}
+				if j < 0 {
+					break
+				}
+			}
+		}
+	}
+	return r.WithContext(&clientIPContext{Context: r.Context(), ip: client})
+}
+
+// forwardedNode formats ip as a node of the Forwarded header.
+func forwardedNode(ip netip.Addr) string {
+	switch {
+	case !ip.IsValid():
+		return "unknown"
+	case ip.Is6():
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue quotes v for the Forwarded header unless it is a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
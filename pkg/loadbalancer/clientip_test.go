@@ -0,0 +1,38 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	f := NewForwarded([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, false)
+	for _, tc := range []struct {
+		peer string
+		xff  []string
+		want string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		// An entry that is not an address is the client's, never the
+		// trusted proxy's before it.
+		{"10.0.0.1:1234", []string{"garbage"}, "invalid IP"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "invalid IP"},
+		{"10.0.0.1:1234", []string{"198.51.100.1,"}, "invalid IP"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(f.apply(r)).String(); got != tc.want {
+			t.Errorf("from %s with %q: client %s, want %s", tc.peer, tc.xff, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	clusterMembers = metrics.NewGaugeVec("lb_cluster_members",
+		"Replicas of the cluster heard from recently, this one excluded.")
+	clusterHealthUpdates = metrics.NewCounterVec("lb_cluster_health_updates_total",
+		"Changes to the shared health of servers, by source: local for the health checks of this replica, passive for its ejections by failures, gossip for those learned from peers.", "source")
+	clusterRejected = metrics.NewCounterVec("lb_cluster_messages_rejected_total",
+		"Gossip messages dropped for being malformed, failing authentication, or replayed.")
+)
+
+const (
+	defaultClusterInterval      = 500 * time.Millisecond
+	defaultClusterFanout        = 3
+	defaultClusterFailureWindow = 10 * time.Second
+	defaultClusterEjectFor      = 30 * time.Second
+	// clusterMemberTimeout is how many gossip intervals a member may stay
+	// silent before it is forgotten.
+	clusterMemberTimeout = 10
+	// maxClusterMessage bounds a gossip datagram.
+	maxClusterMessage = 65507
+	// clusterMaxSkew bounds how far the time a gossip message was sent
+	// may be from the time it is received, beyond network delays the
+	// clocks of the replicas may differ by.
+	clusterMaxSkew = 30 * time.Second
+)
+
+// ClusterHealth is the shared health of a server, as last observed by the
+// replica Origin. Of two observations, the one with the higher Version
+// wins, then that of the Origin sorting first.
+type ClusterHealth struct {
+	Addr    string    `json:"addr"`
+	Alive   bool      `json:"alive"`
+	Version uint64    `json:"version"`
+	Origin  string    `json:"origin"`
+	Time    time.Time `json:"time"`
+}
+
+func (h ClusterHealth) newer(than ClusterHealth) bool {
+	return h.Version > than.Version || (h.Version == than.Version && h.Origin < than.Origin)
+}
+
+// ClusterMember is a replica of the cluster, at the address it gossips
+// from.
+type ClusterMember struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clusterMessage is the gossip a replica sends: the members it knows, the
+// health of the servers and the failures it saw within the failure window.
+// Seq is the time it was sent, in Unix nanoseconds, increasing with every
+// message of the replica, for its peers to drop those replayed.
+type clusterMessage struct {
+	Name     string          `json:"name"`
+	Seq      int64           `json:"seq"`
+	Members  []ClusterMember `json:"members,omitempty"`
+	Health   []ClusterHealth `json:"health,omitempty"`
+	Failures map[string]int  `json:"failures,omitempty"`
+}
+
+// clusterReport is the failure counts a peer last sent.
+type clusterReport struct {
+	failures map[string]int
+	received time.Time
+}
+
+// Cluster shares the health of servers between the replicas of a load
+// balancer over UDP gossip, so that all of them converge on the same view
+// instead of each finding failures out on its own. Every Interval, and at
+// once on a change, a replica sends what it knows to Fanout members picked
+// at random among those it heard from and its Peers, which it starts from:
+// whenever its health checks find a server alive or dead, every replica
+// marks it so. If FailureThreshold is set, requests that could not be
+// proxied to a server are counted too: once the replicas together counted
+// that many within FailureWindow, the server is marked dead for EjectFor,
+// or until a health check finds it alive again. Servers are told apart by
+// address, across pools. Messages are authenticated with an HMAC keyed
+// with Key, which is required, and those failing are dropped, as are those
+// a replica sent before the last one heard from it, or more than 30s from
+// now by the clock of the receiver.
+type Cluster struct {
+	Name             string
+	Peers            []string
+	Key              []byte
+	Interval         time.Duration
+	Fanout           int
+	FailureThreshold int
+	FailureWindow    time.Duration
+	EjectFor         time.Duration
+
+	bind string
+	// lb returns the load balancer the replica currently runs.
+	lb   func() *LoadBalancer
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	members  map[string]*ClusterMember
+	health   map[string]ClusterHealth
+	failures map[string][]time.Time
+	reports  map[string]clusterReport
+	// seq is the Seq of the last message sent, and seqs that of the last
+	// message heard from each replica.
+	seq  int64
+	seqs map[string]int64
+
+	kick   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCluster creates a replica named name gossiping from the UDP address
+// bind with peers, and marking the servers of the load balancer lb
+// returns.
+func NewCluster(name, bind string, peers []string, lb func() *LoadBalancer) *Cluster {
+	return &Cluster{
+		Name:          name,
+		Peers:         peers,
+		Interval:      defaultClusterInterval,
+		Fanout:        defaultClusterFanout,
+		FailureWindow: defaultClusterFailureWindow,
+		EjectFor:      defaultClusterEjectFor,
+		bind:          bind,
+		lb:            lb,
+		members:       map[string]*ClusterMember{},
+		health:        map[string]ClusterHealth{},
+		failures:      map[string][]time.Time{},
+		reports:       map[string]clusterReport{},
+		seqs:          map[string]int64{},
+		kick:          make(chan struct{}, 1),
+	}
+}
+
+// Start opens the gossip socket and starts gossiping in the background.
+func (c *Cluster) Start() error {
+	if len(c.Key) == 0 {
+		return errors.New("cluster: a key is required")
+	}
+	conn, err := net.ListenPacket("udp", c.bind)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.conn, c.cancel = conn, cancel
+	events, unsubscribe := Subscribe(1024)
+	logf("Cluster: %q gossiping at %q", c.Name, conn.LocalAddr())
+	c.wg.Add(3)
+	go func() {
+		defer c.wg.Done()
+		c.receive()
+	}()
+	go func() {
+		defer c.wg.Done()
+		c.gossip(ctx)
+	}()
+	go func() {
+		defer c.wg.Done()
+		<-ctx.Done()
+		unsubscribe()
+	}()
+	go c.observe(events)
+	return nil
+}
+
+// Stop stops gossiping.
+func (c *Cluster) Stop() {
+	if c == nil || c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.conn.Close()
+	c.wg.Wait()
+}
+
+// Members returns the members heard from recently, by address.
+func (c *Cluster) Members() []ClusterMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make([]ClusterMember, 0, len(c.members))
+	for _, m := range c.members {
+		members = append(members, *m)
+	}
+	slices.SortFunc(members, func(a, b ClusterMember) int { return cmp.Compare(a.Addr, b.Addr) })
+	return members
+}
+
+// Health returns the shared health of the servers, by address.
+func (c *Cluster) Health() []ClusterHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	health := make([]ClusterHealth, 0, len(c.health))
+	for _, h := range c.health {
+		health = append(health, h)
+	}
+	slices.SortFunc(health, func(a, b ClusterHealth) int { return cmp.Compare(a.Addr, b.Addr) })
+	return health
+}
+
+// observe publishes the health check transitions and request failures of
+// the load balancers of the process until events is closed.
+func (c *Cluster) observe(events <-chan Event) {
+	for e := range events {
+		switch e := e.(type) {
+		case BackendUp:
+			c.publish(e.Server.Address(), true, "local")
+		case BackendDown:
+			c.publish(e.Server.Address(), false, "local")
+		case RequestFailed:
+			if c.FailureThreshold > 0 {
+				c.mu.Lock()
+				c.failures[e.Server.Address()] = append(c.failures[e.Server.Address()], e.Time)
+				c.mu.Unlock()
+				c.checkFailures()
+			}
+		}
+	}
+}
+
+// publish records that the replica found the server at addr alive or dead
+// and gossips it at once, unless that is the shared health already.
+func (c *Cluster) publish(addr string, alive bool, source string) {
+	c.mu.Lock()
+	cur, ok := c.health[addr]
+	if ok && cur.Alive == alive {
+		c.mu.Unlock()
+		return
+	}
+	c.health[addr] = ClusterHealth{Addr: addr, Alive: alive, Version: cur.Version + 1, Origin: c.Name, Time: time.Now().UTC()}
+	c.mu.Unlock()
+	clusterHealthUpdates.Inc(source)
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// checkFailures ejects the servers the replicas together saw failing
+// FailureThreshold times within FailureWindow.
+func (c *Cluster) checkFailures() {
+	now := time.Now()
+	c.mu.Lock()
+	counts := c.ownFailures(now)
+	for name, r := range c.reports {
+		if now.Sub(r.received) > c.FailureWindow {
+			delete(c.reports, name)
+			continue
+		}
+		for addr, n := range r.failures {
+			counts[addr] += n
+		}
+	}
+	var ejected []ClusterHealth
+	for addr, n := range counts {
+		if n < c.FailureThreshold {
+			continue
+		}
+		if cur, ok := c.health[addr]; ok && !cur.Alive {
+			continue
+		}
+		h := ClusterHealth{Addr: addr, Version: c.health[addr].Version + 1, Origin: c.Name, Time: now.UTC()}
+		c.health[addr] = h
+		// The failures counted led to this ejection and not to the next.
+		delete(c.failures, addr)
+		ejected = append(ejected, h)
+	}
+	c.mu.Unlock()
+	for _, h := range ejected {
+		logf("Cluster: server %q ejected for %v after %d failures within %v", h.Addr, c.EjectFor, counts[h.Addr], c.FailureWindow)
+		clusterHealthUpdates.Inc("passive")
+		c.apply(h)
+		time.AfterFunc(c.EjectFor, func() { c.readmit(h) })
+	}
+	if len(ejected) > 0 {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// readmit marks the server ejected by h alive again, unless its health
+// changed since.
+func (c *Cluster) readmit(h ClusterHealth) {
+	c.mu.Lock()
+	if c.health[h.Addr] != h {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	logf("Cluster: server %q readmitted", h.Addr)
+	c.publish(h.Addr, true, "passive")
+	c.apply(ClusterHealth{Addr: h.Addr, Alive: true, Origin: c.Name})
+}
+
+// ownFailures returns the failures the replica saw within FailureWindow,
+// forgetting older ones. c.mu must be held.
+func (c *Cluster) ownFailures(now time.Time) map[string]int {
+	counts := map[string]int{}
+	for addr, times := range c.failures {
+		times = slices.DeleteFunc(times, func(t time.Time) bool { return now.Sub(t) > c.FailureWindow })
+		if len(times) == 0 {
+			delete(c.failures, addr)
+			continue
+		}
+		c.failures[addr] = times
+		counts[addr] = len(times)
+	}
+	return counts
+}
+
+// apply marks the servers at the address of h alive or dead in every pool.
+func (c *Cluster) apply(h ClusterHealth) {
+	for _, p := range c.lb().Pools() {
+		if s := p.Server(h.Addr); s != nil && s.IsAlive() != h.Alive {
+			state := "down"
+			if h.Alive {
+				state = "up"
+			}
+			p.logf("server %q is now %s, as %q observed", h.Addr, state, h.Origin)
+			s.SetAlive(h.Alive)
+		}
+	}
+}
+
+// receive merges the messages of the peers until the socket is closed.
+func (c *Cluster) receive() {
+	buf := make([]byte, maxClusterMessage)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var msg clusterMessage
+		if !c.open(buf[:n], &msg) || msg.Name == "" || !c.fresh(&msg, time.Now()) {
+			clusterRejected.Inc()
+			continue
+		}
+		if msg.Name != c.Name {
+			c.merge(&msg, from.String())
+		}
+	}
+}
+
+// fresh reports whether msg was sent within clusterMaxSkew of now and after
+// the last message heard from its replica, and records it as the last one.
+func (c *Cluster) fresh(msg *clusterMessage, now time.Time) bool {
+	if d := now.Sub(time.Unix(0, msg.Seq)); d > clusterMaxSkew || d < -clusterMaxSkew {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Seq <= c.seqs[msg.Name] {
+		return false
+	}
+	c.seqs[msg.Name] = msg.Seq
+	return true
+}
+
+// merge merges msg, received from addr.
+func (c *Cluster) merge(msg *clusterMessage, addr string) {
+	now := time.Now()
+	c.mu.Lock()
+	c.members[addr] = &ClusterMember{Name: msg.Name, Addr: addr, LastSeen: now}
+	for _, m := range msg.Members {
+		if _, ok := c.members[m.Addr]; !ok && m.Name != c.Name {
+			c.members[m.Addr] = &ClusterMember{Name: m.Name, Addr: m.Addr, LastSeen: now}
+		}
+	}
+	var changed []ClusterHealth
+	for _, h := range msg.Health {
+		if cur, ok := c.health[h.Addr]; !ok || h.newer(cur) {
+			c.health[h.Addr] = h
+			if !ok || cur.Alive != h.Alive {
+				changed = append(changed, h)
+			}
+		}
+	}
+	if c.FailureThreshold > 0 {
+		c.reports[msg.Name] = clusterReport{failures: msg.Failures, received: now}
+	}
+	c.mu.Unlock()
+	for _, h := range changed {
+		clusterHealthUpdates.Inc("gossip")
+		c.apply(h)
+	}
+	if len(msg.Failures) > 0 {
+		c.checkFailures()
+	}
+}
+
+// gossip sends what the replica knows to Fanout members every Interval,
+// and at once on a change, until ctx is done.
+func (c *Cluster) gossip(ctx context.Context) {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-c.kick:
+		}
+		msg, targets := c.round(time.Now())
+		b, err := json.Marshal(msg)
+		if err != nil || len(b)+sha256.Size > maxClusterMessage {
+			logf("Cluster: gossip message of %d bytes too large", len(b))
+			continue
+		}
+		b = c.seal(b)
+		for _, addr := range targets {
+			if ua, err := net.ResolveUDPAddr("udp", addr); err == nil {
+				c.conn.WriteTo(b, ua)
+			}
+		}
+	}
+}
+
+// round forgets the members silent for too long and returns the message
+// to gossip and the addresses to send it to.
+func (c *Cluster) round(now time.Time) (*clusterMessage, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = max(c.seq+1, now.UnixNano())
+	msg := &clusterMessage{Name: c.Name, Seq: c.seq}
+	for name, seq := range c.seqs {
+		// Messages as old would be dropped anyway.
+		if now.Sub(time.Unix(0, seq)) > clusterMaxSkew {
+			delete(c.seqs, name)
+		}
+	}
+	var targets []string
+	for addr, m := range c.members {
+		if now.Sub(m.LastSeen) > clusterMemberTimeout*c.Interval {
+			delete(c.members, addr)
+			continue
+		}
+		msg.Members = append(msg.Members, *m)
+		targets = append(targets, addr)
+	}
+	clusterMembers.Set(int64(len(c.members)))
+	for _, peer := range c.Peers {
+		if !slices.Contains(targets, peer) {
+			targets = append(targets, peer)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	for _, h := range c.health {
+		msg.Health = append(msg.Health, h)
+	}
+	if c.FailureThreshold > 0 {
+		if counts := c.ownFailures(now); len(counts) > 0 {
+			msg.Failures = counts
+		}
+	}
+	return msg, targets[:min(c.Fanout, len(targets))]
+}
+
+// seal prefixes b with its HMAC.
+func (c *Cluster) seal(b []byte) []byte {
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(b)
+	return append(mac.Sum(nil), b...)
+}
+
+// open authenticates and decodes the message b into msg.
+func (c *Cluster) open(b []byte, msg *clusterMessage) bool {
+	if len(b) < sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(b[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), b[:sha256.Size]) {
+		return false
+	}
+	return json.Unmarshal(b[sha256.Size:], msg) == nil
+}
+
+// Cluster returns the cluster the replica running the load balancer
+// gossips with, or nil.
+func (lb *LoadBalancer) Cluster() *Cluster { return lb.cluster }
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// clusterDatagram returns the next gossip message of c, sealed.
+func clusterDatagram(t *testing.T, c *Cluster, now time.Time) []byte {
+	t.Helper()
+	msg, _ := c.round(now)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.seal(b)
+}
+
+// accepts reports whether c accepts the message b at now.
+func accepts(c *Cluster, b []byte, now time.Time) bool {
+	var msg clusterMessage
+	return c.open(b, &msg) && c.fresh(&msg, now)
+}
+
+func TestClusterMessages(t *testing.T) {
+	a := NewCluster("a", "127.0.0.1:0", nil, nil)
+	b := NewCluster("b", "127.0.0.1:0", nil, nil)
+	a.Key, b.Key = []byte("secret"), []byte("secret")
+	now := time.Now()
+	first := clusterDatagram(t, a, now)
+	second := clusterDatagram(t, a, now)
+	if !accepts(b, first, now) || !accepts(b, second, now) {
+		t.Fatal("messages of a peer dropped")
+	}
+	if accepts(b, first, now) {
+		t.Error("replayed message accepted")
+	}
+
+	forger := NewCluster("a", "127.0.0.1:0", nil, nil)
+	forger.Key = []byte("guess")
+	if accepts(b, clusterDatagram(t, forger, now.Add(time.Second)), now) {
+		t.Error("message with another key accepted")
+	}
+	c := NewCluster("c", "127.0.0.1:0", nil, nil)
+	c.Key = a.Key
+	if accepts(b, clusterDatagram(t, c, now.Add(-time.Hour)), now) {
+		t.Error("stale message accepted")
+	}
+}
+
+func TestClusterRequiresKey(t *testing.T) {
+	c := NewCluster("a", "127.0.0.1:0", nil, nil)
+	if err := c.Start(); err == nil {
+		c.Stop()
+		t.Error("cluster without a key started")
+	}
+}
@@ -0,0 +1,345 @@
+package loadbalancer
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+const defaultCompressionMinSize = 1024
+
+var (
+	compressedResponses = metrics.NewCounterVec("lb_compressed_responses_total",
+		"Responses compressed by the load balancer.", "encoding")
+	compressionBytes = metrics.NewCounterVec("lb_compression_bytes_total",
+		"Bytes of responses compressed by the load balancer, before and after compression.", "encoding", "stage")
+)
+
+// encoder is a compressing writer that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders builds the encoders of the supported content codings at a
+// compression level. The brotli build tag adds "br".
+var encoders = map[string]func(level int) encoder{
+	"gzip": func(level int) encoder {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	},
+	"deflate": func(level int) encoder {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	},
+}
+
+// defaultCompressibleTypes are the media types compressed unless configured
+// otherwise. An entry ending in "/" matches a whole type, one starting with
+// "+" a structured syntax suffix.
+var defaultCompressibleTypes = []string{
+	"text/", "application/json", "application/javascript", "application/xml",
+	"application/wasm", "image/svg+xml", "+json", "+xml",
+}
+
+// Compression compresses responses with the content coding preferred by the
+// client among Encodings, the first being preferred on a tie. Responses
+// smaller than MinSize, of a media type not in Types, already encoded, or
+// event streams are sent as they are.
+type Compression struct {
+	Encodings []string
+	MinSize   int
+	Types     []string
+
+	pools map[string]*sync.Pool
+}
+
+// NewCompression creates a Compression. Empty encodings mean brotli, if the
+// build supports it, and gzip; a zero minSize means 1 KiB, empty types a list
+// of textual media types and level the gzip and deflate level, zero meaning
+// their default. Brotli uses its default quality.
+func NewCompression(encodings []string, minSize int, types []string, level int) (*Compression, error) {
+	if len(encodings) == 0 {
+		if _, ok := encoders["br"]; ok {
+			encodings = append(encodings, "br")
+		}
+		encodings = append(encodings, "gzip")
+	}
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("level %d out of range %d-%d", level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	c := &Compression{Encodings: encodings, MinSize: minSize, Types: types, pools: map[string]*sync.Pool{}}
+	for _, enc := range encodings {
+		newEncoder, ok := encoders[enc]
+		if !ok {
+			if enc == "br" {
+				return nil, fmt.Errorf("brotli is not supported by this build (rebuild with -tags brotli)")
+			}
+			return nil, fmt.Errorf("unknown encoding %q", enc)
+		}
+		c.pools[enc] = &sync.Pool{New: func() any { return newEncoder(level) }}
+	}
+	return c, nil
+}
+
+// Middleware returns the middleware compressing responses.
+func (c *Compression) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Add("Vary", "Accept-Encoding")
+			encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: rw, c: c, encoding: encoding}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiate returns the encoding to compress a response with for a request
+// with the Accept-Encoding header accept, or "" to send it as it is.
+func (c *Compression) negotiate(accept string) string {
+	best, bestQ := "", 0.0
+	for _, enc := range c.Encodings {
+		if q := acceptQuality(accept, enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality value accept gives encoding, falling back
+// to that of "*".
+func acceptQuality(accept, encoding string) float64 {
+	q, wildcard := -1.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		v := 1.0
+		if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if v, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		switch name = strings.TrimSpace(name); {
+		case strings.EqualFold(name, encoding):
+			q = v
+		case name == "*":
+			wildcard = v
+		}
+	}
+	if q < 0 {
+		return wildcard
+	}
+	return q
+}
+
+// compressible reports whether a response with header h may be compressed.
+func (c *Compression) compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	return slices.ContainsFunc(c.Types, func(t string) bool {
+		switch {
+		case strings.HasSuffix(t, "/"):
+			return strings.HasPrefix(mt, t)
+		case strings.HasPrefix(t, "+"):
+			return strings.HasSuffix(mt, t)
+		}
+		return mt == t
+	})
+}
+
+// compressWriter compresses a response once it is known to be compressible
+// and at least MinSize bytes long, holding back the header and the first
+// bytes of responses of unknown length until then.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *Compression
+	encoding string
+
+	status  int
+	decided bool
+	enc     encoder
+	buf     []byte
+	in, out int64
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	h := w.Header()
+	switch {
+	case code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent:
+		w.passthrough()
+	case h.Get("Content-Type") == "":
+		// Wait for the body to detect its type.
+	case !w.c.compressible(h):
+		w.passthrough()
+	default:
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			if n < w.c.MinSize {
+				w.passthrough()
+			} else {
+				w.compress()
+			}
+		}
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(b))
+		if !w.c.compressible(w.Header()) {
+			w.passthrough()
+		}
+	}
+	switch {
+	case w.enc != nil:
+		w.in += int64(len(b))
+		return w.enc.Write(b)
+	case w.decided:
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.c.MinSize {
+		w.compress()
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// passthrough sends the response as it is.
+func (w *compressWriter) passthrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// compress starts sending the response compressed.
+func (w *compressWriter) compress() {
+	w.decided = true
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.enc = w.c.pools[w.encoding].Get().(encoder)
+	w.enc.Reset(countingWriter{w.ResponseWriter, &w.out})
+	compressedResponses.Inc(w.encoding)
+}
+
+func (w *compressWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if w.enc != nil {
+		w.in += int64(len(buf))
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// FlushError sends what was written so far, compressed if the response is
+// compressible even if it is still shorter than MinSize.
+func (w *compressWriter) FlushError() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		if w.Header().Get("Content-Type") != "" || len(w.buf) > 0 {
+			w.compress()
+		} else {
+			w.passthrough()
+		}
+	}
+	if err := w.flushBuffer(); err != nil {
+		return err
+	}
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher.
+func (w *compressWriter) Flush() { w.FlushError() }
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close sends what is held back and finishes the compressed stream.
+func (w *compressWriter) close() {
+	if w.status == 0 && len(w.buf) == 0 {
+		// Nothing was written; net/http sends an empty 200 response.
+		return
+	}
+	if !w.decided {
+		w.passthrough()
+	}
+	w.flushBuffer()
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		w.c.pools[w.encoding].Put(w.enc)
+		w.enc = nil
+		compressionBytes.Add(w.in, w.encoding, "in")
+		compressionBytes.Add(w.out, w.encoding, "out")
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,9 @@
+//go:build brotli
+
+package loadbalancer
+
+import "github.com/andybalholm/brotli"
+
+func init() {
+	encoders["br"] = func(int) encoder { return brotli.NewWriter(nil) }
+}
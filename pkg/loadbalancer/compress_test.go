@@ -0,0 +1,120 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	c, err := NewCompression([]string{"gzip", "deflate"}, 0, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for accept, want := range map[string]string{
+		"":                           "",
+		"gzip":                       "gzip",
+		"deflate, gzip":              "gzip",
+		"gzip;q=0.5, deflate":        "deflate",
+		"gzip; q=0.8, deflate;q=0.9": "deflate",
+		"gzip;q=0, deflate;q=0":      "",
+		"*":                          "gzip",
+		"*;q=0.5, gzip;q=0":          "deflate",
+		"identity":                   "",
+		"GZIP":                       "gzip",
+		"gzip;q=bad":                 "",
+	} {
+		if got := c.negotiate(accept); got != want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressionResponses(t *testing.T) {
+	c, err := NewCompression([]string{"gzip"}, 100, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("compressible ", 20)
+	for _, tc := range []struct {
+		name, contentType, cacheControl, body string
+		compressed                            bool
+	}{
+		{"long text", "text/plain", "", long, true},
+		{"json suffix", "application/problem+json", "", long, true},
+		{"below MinSize", "text/plain", "", "short", false},
+		{"sniffed type", "", "", "<html>" + long, true},
+		{"no-transform", "text/plain", "public, no-transform", long, false},
+		{"other type", "image/png", "", long, false},
+		{"event stream", "text/event-stream", "", long, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if tc.contentType != "" {
+					rw.Header().Set("Content-Type", tc.contentType)
+				}
+				if tc.cacheControl != "" {
+					rw.Header().Set("Cache-Control", tc.cacheControl)
+				}
+				io.WriteString(rw, tc.body)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tc.compressed {
+				t.Fatalf("compressed %t, want %t", got, tc.compressed)
+			}
+			body := rec.Body.String()
+			if tc.compressed {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+			if body != tc.body {
+				t.Errorf("body %q, want %q", body, tc.body)
+			}
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary %q", rec.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+// TestCompressionContentLength checks that a response declaring its length
+// is compressed or not on the length alone.
+func TestCompressionContentLength(t *testing.T) {
+	c, err := NewCompression([]string{"gzip"}, 100, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{99, 100} {
+		h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.Header().Set("Content-Length", strconv.Itoa(n))
+			rw.Header().Set("ETag", `"v1"`)
+			io.WriteString(rw, strings.Repeat("a", n))
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		compressed := rec.Header().Get("Content-Encoding") == "gzip"
+		if compressed != (n >= 100) {
+			t.Errorf("%d bytes: compressed %t", n, compressed)
+		}
+		if compressed && (rec.Header().Get("Content-Length") != "" || rec.Header().Get("ETag") != `W/"v1"`) {
+			t.Errorf("%d bytes: Content-Length %q, ETag %q", n, rec.Header().Get("Content-Length"), rec.Header().Get("ETag"))
+		}
+	}
+}
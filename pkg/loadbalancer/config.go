@@ -0,0 +1,2208 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+func buildAccessLog(ac *config.AccessLogConfig) (*AccessLog, error) {
+	sample := 1.0
+	if ac.Sample != nil {
+		sample = *ac.Sample
+	}
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("sample %v out of range 0-1", sample)
+	}
+	if ac.File == "" {
+		return NewAccessLog(os.Stdout, sample), nil
+	}
+	return NewAccessLogFile(ac.File, sample)
+}
+
+func buildRecorder(rc *config.RecordConfig) (*Recorder, error) {
+	sample := 1.0
+	if rc.Sample != nil {
+		sample = *rc.Sample
+	}
+	switch {
+	case rc.File == "":
+		return nil, fmt.Errorf("file is required")
+	case sample < 0 || sample > 1:
+		return nil, fmt.Errorf("sample %v out of range 0-1", sample)
+	case rc.MaxBody < 0:
+		return nil, fmt.Errorf("negative max_body")
+	}
+	res := make([]*regexp.Regexp, len(rc.RedactBody))
+	for i, s := range rc.RedactBody {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("redact_body: %w", err)
+		}
+		res[i] = re
+	}
+	rec, err := NewRecorderFile(rc.File, sample)
+	if err != nil {
+		return nil, err
+	}
+	if rc.MaxBody > 0 {
+		rec.MaxBody = rc.MaxBody
+	}
+	if rc.RedactHeaders != nil {
+		rec.RedactHeaders = rc.RedactHeaders
+	}
+	rec.RedactQuery, rec.RedactBody = rc.RedactQuery, res
+	return rec, nil
+}
+
+func buildTagger(tc *config.TagsConfig, routes []config.RouteConfig) (*Tagger, error) {
+	if tc.MaxValues < 0 {
+		return nil, fmt.Errorf("negative max_values")
+	}
+	t := NewTagger(nil)
+	if tc.MaxValues > 0 {
+		t.MaxValues = tc.MaxValues
+	}
+	for i, rc := range tc.Rules {
+		if !tagNameRE.MatchString(rc.Name) {
+			return nil, fmt.Errorf("rule %d: invalid name %q", i, rc.Name)
+		}
+		sources := 0
+		for _, set := range []bool{rc.Value != "", rc.Header != "", rc.APIKey, rc.Experiment} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, fmt.Errorf("rule %d: exactly one of value, header, api_key and experiment must be set", i)
+		}
+		for _, name := range rc.Routes {
+			if !slices.ContainsFunc(routes, func(rc config.RouteConfig) bool { return rc.Name == name }) {
+				return nil, fmt.Errorf("rule %d: unknown route %q", i, name)
+			}
+		}
+		t.Rules = append(t.Rules, TagRule{
+			Name:       rc.Name,
+			Routes:     rc.Routes,
+			Value:      rc.Value,
+			Header:     rc.Header,
+			APIKey:     rc.APIKey,
+			Experiment: rc.Experiment,
+		})
+	}
+	return t, nil
+}
+
+// tagNameRE matches the names of tags, which are keys of the access log.
+var tagNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func buildIPAnonymizer(ac *config.AnonymizeIPsConfig) (*IPAnonymizer, error) {
+	if ac == nil {
+		return nil, nil
+	}
+	if ac.IPv4Prefix < 0 || ac.IPv4Prefix > 32 || ac.IPv6Prefix < 0 || ac.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("ipv4_prefix must be 0-32 and ipv6_prefix 0-128")
+	}
+	if ac.Salt != "" && !ac.Hash {
+		return nil, fmt.Errorf("salt requires hash")
+	}
+	a := NewIPAnonymizer()
+	if ac.IPv4Prefix > 0 {
+		a.IPv4Bits = ac.IPv4Prefix
+	}
+	if ac.IPv6Prefix > 0 {
+		a.IPv6Bits = ac.IPv6Prefix
+	}
+	if ac.Hash {
+		a.Salt = []byte(ac.Salt)
+		if ac.Salt == "" {
+			a.Salt = make([]byte, 32)
+			rand.Read(a.Salt)
+		}
+	}
+	return a, nil
+}
+
+func buildHA(hc *config.HAConfig, lb func() *LoadBalancer) (*HA, error) {
+	if hc == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(hc.Peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("peer must be the http or https URL of the peer's admin API")
+	}
+	if hc.Interval < 0 || hc.DeadAfter < 0 {
+		return nil, fmt.Errorf("interval and dead_after must not be negative")
+	}
+	name := hc.Name
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("name: %w", err)
+		}
+	}
+	ha := NewHA(name, hc.Peer, lb)
+	ha.PeerToken, ha.Priority = hc.PeerToken, hc.Priority
+	ha.OnActive, ha.OnStandby, ha.Webhook = hc.OnActive, hc.OnStandby, hc.Webhook
+	if hc.Interval > 0 {
+		ha.Interval = time.Duration(hc.Interval)
+	}
+	if hc.DeadAfter > 0 {
+		ha.DeadAfter = time.Duration(hc.DeadAfter)
+	}
+	if ha.DeadAfter <= ha.Interval {
+		return nil, fmt.Errorf("dead_after must be longer than interval")
+	}
+	if hc.Webhook != "" {
+		if u, err := url.Parse(hc.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("webhook must be an http or https URL")
+		}
+	}
+	return ha, nil
+}
+
+func buildCluster(cc *config.ClusterConfig, lb func() *LoadBalancer) (*Cluster, error) {
+	if cc == nil {
+		return nil, nil
+	}
+	if cc.Bind == "" || cc.Key == "" {
+		return nil, fmt.Errorf("bind and key must be set")
+	}
+	if cc.Interval < 0 || cc.Fanout < 0 || cc.FailureThreshold < 0 || cc.FailureWindow < 0 || cc.EjectFor < 0 {
+		return nil, fmt.Errorf("interval, fanout, failure_threshold, failure_window and eject_for must not be negative")
+	}
+	for _, peer := range cc.Peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return nil, fmt.Errorf("peer %q: %w", peer, err)
+		}
+	}
+	name := cc.Name
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("name: %w", err)
+		}
+	}
+	c := NewCluster(name, cc.Bind, cc.Peers, lb)
+	c.Key, c.FailureThreshold = []byte(cc.Key), cc.FailureThreshold
+	if cc.Interval > 0 {
+		c.Interval = time.Duration(cc.Interval)
+	}
+	if cc.Fanout > 0 {
+		c.Fanout = cc.Fanout
+	}
+	if cc.FailureWindow > 0 {
+		c.FailureWindow = time.Duration(cc.FailureWindow)
+	}
+	if cc.EjectFor > 0 {
+		c.EjectFor = time.Duration(cc.EjectFor)
+	}
+	return c, nil
+}
+
+func buildFleet(fc *config.FleetConfig, current func() *config.Config, apply func(*config.Config) error) (*Fleet, error) {
+	if fc == nil {
+		return nil, nil
+	}
+	if (fc.Etcd == nil) == (fc.Consul == nil) {
+		return nil, fmt.Errorf("exactly one of etcd or consul must be set")
+	}
+	if fc.TTL < 0 || fc.Interval < 0 {
+		return nil, fmt.Errorf("ttl and interval must not be negative")
+	}
+	var store FleetStore
+	if ec := fc.Etcd; ec != nil {
+		s, err := NewEtcdFleetStore(ec.Endpoints, ec.Prefix, ec.Username, ec.Password)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	} else {
+		cc := fc.Consul
+		s, err := NewConsulFleetStore(cc.Addr, cc.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		s.Datacenter, s.Token = cc.Datacenter, cc.Token
+		store = s
+	}
+	name := fc.Name
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("name: %w", err)
+		}
+	}
+	f := NewFleet(name, store, current, apply)
+	if fc.TTL > 0 {
+		f.TTL = time.Duration(fc.TTL)
+	}
+	f.Interval = time.Duration(fc.Interval)
+	if f.Interval >= f.TTL {
+		return nil, fmt.Errorf("interval must be shorter than ttl")
+	}
+	return f, nil
+}
+
+// buildProber builds the probes of cfg, sent to its listener unless they
+// have an address of their own, or returns nil if it has none.
+func buildProber(cfg *config.Config) (*Prober, error) {
+	if len(cfg.Probes) == 0 {
+		return nil, nil
+	}
+	scheme := "http"
+	if cfg.TLS != nil {
+		scheme = "https"
+	}
+	var probes []*Probe
+	seen := map[string]bool{}
+	for i, pc := range cfg.Probes {
+		if pc.Name == "" {
+			return nil, fmt.Errorf("probe %d: name must be set", i)
+		}
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("duplicate probe %q", pc.Name)
+		}
+		seen[pc.Name] = true
+		if pc.Interval < 0 || pc.Timeout < 0 {
+			return nil, fmt.Errorf("probe %q: interval and timeout must not be negative", pc.Name)
+		}
+		addr := cmp.Or(pc.Addr, net.JoinHostPort("127.0.0.1", cfg.Port))
+		uri := cmp.Or(pc.URI, "/")
+		if !strings.HasPrefix(uri, "/") {
+			return nil, fmt.Errorf("probe %q: uri must start with /", pc.Name)
+		}
+		p := NewProbe(pc.Name, scheme+"://"+addr+uri)
+		if _, err := http.NewRequest(cmp.Or(pc.Method, http.MethodGet), p.URL, nil); err != nil {
+			return nil, fmt.Errorf("probe %q: %w", pc.Name, err)
+		}
+		p.Method, p.Host, p.Body = cmp.Or(pc.Method, p.Method), pc.Host, []byte(pc.Body)
+		for name, value := range pc.Headers {
+			p.Header.Set(name, value)
+		}
+		if pc.Interval > 0 {
+			p.Interval = time.Duration(pc.Interval)
+		}
+		if pc.Timeout > 0 {
+			p.Timeout = time.Duration(pc.Timeout)
+		}
+		for _, status := range pc.ExpectStatus {
+			if status < 100 || status > 599 {
+				return nil, fmt.Errorf("probe %q: expect_status %d out of range", pc.Name, status)
+			}
+		}
+		p.ExpectStatus = pc.ExpectStatus
+		if pc.ExpectBody != "" {
+			re, err := regexp.Compile(pc.ExpectBody)
+			if err != nil {
+				return nil, fmt.Errorf("probe %q: expect_body: %w", pc.Name, err)
+			}
+			p.ExpectBody = re
+		}
+		probes = append(probes, p)
+	}
+	return NewProber(probes), nil
+}
+
+func buildProxyProtocol(pc *config.ProxyProtocolConfig) (*ProxyProtocol, error) {
+	if pc == nil {
+		return nil, nil
+	}
+	if len(pc.Trusted) == 0 {
+		return nil, fmt.Errorf("proxy_protocol: trusted is required")
+	}
+	trusted := make([]netip.Prefix, 0, len(pc.Trusted))
+	for _, s := range pc.Trusted {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_protocol: %w", err)
+		}
+		trusted = append(trusted, p)
+	}
+	return NewProxyProtocol(trusted, time.Duration(pc.Timeout)), nil
+}
+
+// parsePrefix parses a CIDR, or a single address as a full-length prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+func buildStrictParsing(sc *config.StrictParsingConfig) (*StrictParsing, error) {
+	if sc == nil {
+		return nil, nil
+	}
+	if sc.MaxHeaderBytes < 0 || sc.MaxHeaders < 0 {
+		return nil, fmt.Errorf("max_header_bytes and max_headers must not be negative")
+	}
+	s := NewStrictParsing()
+	if sc.MaxHeaderBytes > 0 {
+		s.MaxHeaderBytes = sc.MaxHeaderBytes
+	}
+	if sc.MaxHeaders > 0 {
+		s.MaxHeaders = sc.MaxHeaders
+	}
+	return s, nil
+}
+
+func buildFaults(name string, fc *config.FaultsConfig) (*Faults, error) {
+	if fc == nil {
+		return nil, nil
+	}
+	for _, p := range []float64{fc.DelayPercent, fc.AbortPercent, fc.DropPercent} {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("percents must be between 0 and 100")
+		}
+	}
+	switch {
+	case fc.AbortPercent+fc.DropPercent > 100:
+		return nil, fmt.Errorf("abort_percent and drop_percent add up to more than 100")
+	case fc.Delay < 0 || fc.Jitter < 0:
+		return nil, fmt.Errorf("negative delay or jitter")
+	case fc.AbortStatus != 0 && (fc.AbortStatus < 400 || fc.AbortStatus > 599):
+		return nil, fmt.Errorf("abort_status %d is not an error status", fc.AbortStatus)
+	}
+	f := NewFaults(name)
+	f.Delay, f.Jitter, f.DelayPercent = time.Duration(fc.Delay), time.Duration(fc.Jitter), fc.DelayPercent
+	f.AbortPercent, f.DropPercent = fc.AbortPercent, fc.DropPercent
+	if fc.AbortStatus != 0 {
+		f.AbortStatus = fc.AbortStatus
+	}
+	f.Servers, f.Header = fc.Servers, fc.Header
+	return f, nil
+}
+
+func buildEgress(name string, ec *config.EgressConfig) (*Shaper, error) {
+	if ec == nil {
+		return nil, nil
+	}
+	return NewShaper(name, ec.Rate, ec.Burst)
+}
+
+func buildSocket(sc *config.SocketConfig) (*SocketOptions, error) {
+	if sc == nil {
+		return nil, nil
+	}
+	if sc.KeepAliveIdle < 0 || sc.KeepAliveInterval < 0 || sc.KeepAliveCount < 0 || sc.ReadBuffer < 0 || sc.WriteBuffer < 0 {
+		return nil, fmt.Errorf("socket options must not be negative")
+	}
+	return &SocketOptions{
+		NoDelay:           sc.NoDelay,
+		KeepAliveIdle:     time.Duration(sc.KeepAliveIdle),
+		KeepAliveInterval: time.Duration(sc.KeepAliveInterval),
+		KeepAliveCount:    sc.KeepAliveCount,
+		DisableKeepAlive:  sc.DisableKeepAlive,
+		ReadBuffer:        sc.ReadBuffer,
+		WriteBuffer:       sc.WriteBuffer,
+	}, nil
+}
+
+func buildIPFilter(fc *config.IPFilterConfig) (*IPFilter, error) {
+	if fc == nil {
+		return nil, nil
+	}
+	parse := func(list []string) ([]netip.Prefix, error) {
+		prefixes := make([]netip.Prefix, 0, len(list))
+		for _, s := range list {
+			p, err := parsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p)
+		}
+		return prefixes, nil
+	}
+	allow, err := parse(fc.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parse(fc.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return NewIPFilter(allow, deny), nil
+}
+
+func buildWAF(wc *config.WAFConfig) (*WAF, error) {
+	if wc.RulesFile == "" {
+		return nil, fmt.Errorf("rules_file is required")
+	}
+	rules, err := LoadWAFRules(wc.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewWAF(rules, wc.MaxBody)
+}
+
+func buildFingerprints(fc *config.TLSFingerprintsConfig) (*FingerprintFilter, error) {
+	rules := make([]*FingerprintRule, 0, len(fc.Rules))
+	for i, rc := range fc.Rules {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i)
+		}
+		rules = append(rules, &FingerprintRule{
+			Name:       rc.Name,
+			JA3:        rc.JA3,
+			JA4:        rc.JA4,
+			Action:     rc.Action,
+			Rate:       rc.Rate,
+			Burst:      rc.Burst,
+			MaxTracked: fc.MaxTracked,
+		})
+	}
+	return NewFingerprintFilter(rules, fc.Header)
+}
+
+func buildGeoBlock(gc *config.GeoBlockConfig, db *GeoIP) (*GeoFilter, error) {
+	if len(gc.Countries) > 0 && db == nil {
+		return nil, fmt.Errorf("countries require a geoip database")
+	}
+	if gc.ChallengeTTL < 0 {
+		return nil, fmt.Errorf("challenge_ttl must not be negative")
+	}
+	if gc.ASNDatabase != "" {
+		var err error
+		if db, err = OpenGeoIP(gc.ASNDatabase); err != nil {
+			return nil, err
+		}
+	}
+	f, err := NewGeoFilter(gc.Countries, gc.ASNs, db, gc.Action)
+	if err != nil {
+		return nil, err
+	}
+	f.ChallengeTTL = time.Duration(gc.ChallengeTTL)
+	if gc.ChallengeSecret != "" {
+		f.Secret = []byte(gc.ChallengeSecret)
+	}
+	return f, nil
+}
+
+func buildAbuse(ac *config.AbuseConfig) (*AbuseGuard, error) {
+	switch {
+	case ac.MaxRequests <= 0 && ac.MaxErrorRate <= 0:
+		return nil, fmt.Errorf("max_requests or max_error_rate must be set")
+	case ac.MaxRequests < 0 || ac.MinRequests < 0 || ac.MaxClients < 0:
+		return nil, fmt.Errorf("max_requests, min_requests and max_clients must not be negative")
+	case ac.MaxErrorRate < 0 || ac.MaxErrorRate > 1:
+		return nil, fmt.Errorf("max_error_rate must be between 0 and 1")
+	case ac.Window < 0 || ac.BanDuration < 0 || ac.MaxBanDuration < 0:
+		return nil, fmt.Errorf("window, ban_duration and max_ban_duration must not be negative")
+	case ac.MaxBanDuration > 0 && ac.BanDuration > ac.MaxBanDuration:
+		return nil, fmt.Errorf("ban_duration must not exceed max_ban_duration")
+	}
+	switch ac.Status {
+	case 0, http.StatusTooManyRequests, http.StatusForbidden:
+	default:
+		return nil, fmt.Errorf("status must be 429 or 403")
+	}
+	g := &AbuseGuard{
+		Window:         time.Duration(ac.Window),
+		MaxRequests:    ac.MaxRequests,
+		MaxErrorRate:   ac.MaxErrorRate,
+		MinRequests:    ac.MinRequests,
+		BanDuration:    time.Duration(ac.BanDuration),
+		MaxBanDuration: time.Duration(ac.MaxBanDuration),
+		Status:         ac.Status,
+		MaxClients:     ac.MaxClients,
+	}
+	if ac.Store != nil {
+		store, err := buildSharedStore(*ac.Store)
+		if err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+		g.Store = store
+	}
+	return g, nil
+}
+
+func buildBandwidth(name string, bc *config.BandwidthConfig) (*Bandwidth, error) {
+	if bc.Burst < 0 || bc.MaxClients < 0 {
+		return nil, fmt.Errorf("burst and max_clients must not be negative")
+	}
+	b, err := NewBandwidth(name, bc.Download, bc.Upload)
+	if err != nil {
+		return nil, err
+	}
+	b.Burst, b.Header, b.MaxClients = bc.Burst, bc.Header, bc.MaxClients
+	return b, nil
+}
+
+func buildBots(bc *config.BotsConfig) (*BotFilter, error) {
+	rules := make([]*BotRule, 0, len(bc.Rules))
+	for i, rc := range bc.Rules {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i)
+		}
+		br := &BotRule{Name: rc.Name, MissingHeaders: rc.MissingHeaders, Action: rc.Action, Rate: rc.Rate, Burst: rc.Burst, MaxClients: bc.MaxClients}
+		for _, expr := range rc.UserAgents {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid user agent pattern %q: %w", rc.Name, expr, err)
+			}
+			br.UserAgents = append(br.UserAgents, re)
+		}
+		rules = append(rules, br)
+	}
+	return NewBotFilter(rules, bc.Header)
+}
+
+func buildMaintenance(mc *config.MaintenanceConfig) (*Maintenance, error) {
+	if mc.Body != "" && mc.BodyFile != "" {
+		return nil, fmt.Errorf("body and body_file are mutually exclusive")
+	}
+	if mc.Status != 0 && (mc.Status < 400 || mc.Status > 599) {
+		return nil, fmt.Errorf("status %d is not an error status", mc.Status)
+	}
+	body := []byte(mc.Body)
+	if mc.BodyFile != "" {
+		var err error
+		if body, err = os.ReadFile(mc.BodyFile); err != nil {
+			return nil, err
+		}
+	}
+	allow := make([]netip.Prefix, 0, len(mc.Allow))
+	for _, s := range mc.Allow {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(allow, p)
+	}
+	m := NewMaintenance(mc.Status, body, mc.ContentType, time.Duration(mc.RetryAfter), allow)
+	m.SetRoutes(mc.Routes)
+	m.SetEnabled(mc.Enabled)
+	return m, nil
+}
+
+// BuildAdmin creates the admin API server of lb, or returns nil if it isn't
+// configured. A TLS server has its certificate loaded in its TLSConfig. An
+// API authenticating no clients is refused on other than a loopback address
+// unless the configuration says it is insecure.
+func BuildAdmin(cfg *config.Config, lb *LoadBalancer) (*http.Server, error) {
+	ac := cfg.Admin
+	if ac == nil || ac.Addr == "" {
+		return nil, nil
+	}
+	h := NewAdminHandler(lb)
+	if ac.Token != "" {
+		h.AddToken(ac.Token, RoleWrite)
+	}
+	for _, tc := range ac.Tokens {
+		if tc.Token == "" {
+			return nil, fmt.Errorf("admin: empty token")
+		}
+		role, err := ParseAdminRole(tc.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+		h.AddToken(tc.Token, role)
+	}
+	srv := &http.Server{Addr: ac.Addr, Handler: h}
+	if tc := ac.TLS; tc != nil {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if tc.ClientCAFile != "" {
+			ca, err := os.ReadFile(tc.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("admin: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("admin: no certificates in %s", tc.ClientCAFile)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if !h.authenticates() {
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		for _, cc := range tc.Clients {
+			if tc.ClientCAFile == "" {
+				return nil, fmt.Errorf("admin: clients require client_ca_file")
+			}
+			role, err := ParseAdminRole(cc.Role)
+			if err != nil {
+				return nil, fmt.Errorf("admin: client %q: %w", cc.Name, err)
+			}
+			h.AddClient(cc.Name, role)
+		}
+	}
+	if !h.authenticates() && (ac.TLS == nil || ac.TLS.ClientCAFile == "") {
+		if !loopbackAddr(ac.Addr) {
+			if !ac.Insecure {
+				return nil, fmt.Errorf("admin: no token or client certificates authenticate the clients at %q; set insecure to serve it to anyone", ac.Addr)
+			}
+			logTo(lb.logger, slog.LevelWarn, "The admin API at %q authenticates no clients, letting anyone reaching it change the load balancer", ac.Addr)
+		}
+	}
+	return srv, nil
+}
+
+// loopbackAddr reports whether addr, a listen address, is on a loopback
+// interface only.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+func buildUpstreamHTTP2(hc *config.UpstreamHTTP2Config) (*http.HTTP2Config, error) {
+	if hc == nil {
+		return nil, nil
+	}
+	if hc.MaxReadFrameSize != 0 && (hc.MaxReadFrameSize < 16<<10 || hc.MaxReadFrameSize > 1<<24-1) {
+		return nil, fmt.Errorf("max_read_frame_size %d out of range", hc.MaxReadFrameSize)
+	}
+	return &http.HTTP2Config{
+		StrictMaxConcurrentRequests:   hc.StrictMaxConcurrentStreams,
+		MaxReceiveBufferPerConnection: hc.MaxReceiveBufferPerConnection,
+		MaxReceiveBufferPerStream:     hc.MaxReceiveBufferPerStream,
+		MaxReadFrameSize:              hc.MaxReadFrameSize,
+		PingTimeout:                   time.Duration(hc.PingTimeout),
+		SendPingTimeout:               time.Duration(hc.SendPingTimeout),
+	}, nil
+}
+
+// build returns the transports of tc, the defaults if tc is nil.
+func buildTransport(tc *config.TransportConfig) (*upstream, error) {
+	if tc == nil {
+		return newUpstream(TransportOptions{}), nil
+	}
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("connection limits must not be negative")
+	}
+	socket, err := buildSocket(tc.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	http2, err := buildUpstreamHTTP2(tc.HTTP2)
+	if err != nil {
+		return nil, fmt.Errorf("http2: %w", err)
+	}
+	up := newUpstream(TransportOptions{
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(tc.IdleConnTimeout),
+		DialTimeout:           time.Duration(tc.DialTimeout),
+		KeepAlive:             time.Duration(tc.KeepAlive),
+		TLSHandshakeTimeout:   time.Duration(tc.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(tc.ResponseHeaderTimeout),
+		DisableKeepAlives:     tc.DisableKeepAlives,
+		DNSCacheTTL:           time.Duration(tc.DNSCacheTTL),
+		DNSNegativeTTL:        time.Duration(tc.DNSNegativeTTL),
+		Socket:                socket,
+		DisableHTTP2:          tc.HTTP2 != nil && tc.HTTP2.Disable,
+		HTTP2:                 http2,
+	})
+	up.shared = tc.Shared
+	return up, nil
+}
+
+// buildServer builds a server of the pool pc through the transports of up,
+// or the default ones if up is nil.
+func buildServer(sc config.ServerConfig, pc config.PoolConfig, up *upstream) (backend.Server, error) {
+	switch protocol := pc.Protocol; {
+	case protocol == ProtocolFastCGI:
+		var fcgi FastCGI
+		if fc := pc.FastCGI; fc != nil {
+			fcgi = FastCGI{Root: fc.Root, Index: fc.Index, SplitExt: fc.SplitExt, Params: fc.Params}
+		}
+		return NewFastCGIServer(sc.Addr, fcgi)
+	case protocol == ProtocolTCP:
+		return NewTCPServer(sc.Addr)
+	case protocol == ProtocolUDP:
+		return NewUDPServer(sc.Addr)
+	}
+	if up == nil {
+		up = &upstream{http2: http2Transport, shared: true}
+	}
+	t, own := up.forServer(pc.Protocol == ProtocolGRPC || sc.H2C)
+	var s *SimpleServer
+	var err error
+	switch {
+	case pc.Protocol == ProtocolGRPC:
+		s, err = newGRPCServer(sc.Addr, t)
+	case sc.H2C:
+		s, err = newH2CServer(sc.Addr, t)
+	default:
+		s, err = newSimpleServer(sc.Addr, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.ownTransport = own
+	return s, nil
+}
+
+func buildSharedStore(sc config.AffinityStoreConfig) (SharedStore, error) {
+	if sc.MaxEntries < 0 {
+		return nil, fmt.Errorf("negative max_entries")
+	}
+	switch sc.Type {
+	case "", "memory":
+		s := NewMemorySharedStore()
+		if sc.MaxEntries > 0 {
+			s.MaxEntries = sc.MaxEntries
+		}
+		return s, nil
+	case "redis":
+		if sc.Addr == "" {
+			return nil, fmt.Errorf("redis store requires an addr")
+		}
+		return NewRedisSharedStore(NewRedisClient(sc.Addr, sc.Password, sc.DB)), nil
+	case "etcd":
+		return NewEtcdSharedStore(sc.Endpoints, cmp.Or(sc.Prefix, defaultSharedEtcdPrefix), sc.Username, sc.Password)
+	}
+	return nil, fmt.Errorf("unknown store type %q", sc.Type)
+}
+
+func buildAffinityStore(sc config.AffinityStoreConfig) (AffinityStore, error) {
+	if sc.Type == "" || sc.Type == "memory" {
+		if sc.MaxEntries < 0 {
+			return nil, fmt.Errorf("negative max_entries")
+		}
+		// Pins kept in memory are saved with the runtime state.
+		s := NewMemoryAffinityStore()
+		if sc.MaxEntries > 0 {
+			s.MaxEntries = sc.MaxEntries
+		}
+		return s, nil
+	}
+	store, err := buildSharedStore(sc)
+	if err != nil {
+		return nil, err
+	}
+	return NewSharedAffinityStore(store), nil
+}
+
+func buildAffinity(ac config.AffinityConfig) (*Affinity, error) {
+	a, err := buildAffinityMode(ac)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.SetFailover(ac.Failover, ac.FailoverStatus); err != nil {
+		return nil, err
+	}
+	if ac.ConsistentHash {
+		if a.Mode == AffinityCookie {
+			return nil, fmt.Errorf("consistent_hash does not apply to cookie affinity")
+		}
+		a.Consistent = true
+	}
+	if ac.Store != nil {
+		if a.Mode == AffinityCookie || a.Consistent {
+			return nil, fmt.Errorf("store applies only to table-based client_ip and header affinity")
+		}
+		store, err := buildAffinityStore(*ac.Store)
+		if err != nil {
+			return nil, err
+		}
+		a.Store = store
+	}
+	a.TTL = time.Duration(ac.TTL)
+	a.IdleTimeout = time.Duration(ac.IdleTimeout)
+	return a, nil
+}
+
+func buildAffinityMode(ac config.AffinityConfig) (*Affinity, error) {
+	switch ac.Type {
+	case "", AffinityCookie:
+		return NewCookieAffinity(ac.CookieName, time.Duration(ac.TTL), ac.Secure, ac.HTTPOnly), nil
+	case AffinityClientIP:
+		return NewClientIPAffinity(ac.IPv4Prefix, ac.IPv6Prefix)
+	case AffinityHeader:
+		return NewHeaderAffinity(ac.Header)
+	}
+	return nil, fmt.Errorf("unknown affinity type %q", ac.Type)
+}
+
+func buildPlugin(pc config.PluginConfig) (Middleware, error) {
+	if pc.Name == "" && pc.Path == "" {
+		return nil, fmt.Errorf("name or path is required")
+	}
+	return Transform(pc.Name, pc.Path, pc.Config)
+}
+
+func buildForwardAuth(fc *config.ForwardAuthConfig) (*ForwardAuth, error) {
+	u, err := url.Parse(fc.Address)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("address must be an http or https URL")
+	}
+	if fc.Timeout < 0 {
+		return nil, fmt.Errorf("negative timeout")
+	}
+	fa := NewForwardAuth(fc.Address)
+	fa.RequestHeaders = fc.RequestHeaders
+	fa.ResponseHeaders = fc.ResponseHeaders
+	if fc.Timeout > 0 {
+		fa.Client.Timeout = time.Duration(fc.Timeout)
+	}
+	return fa, nil
+}
+
+func buildSignatures(sc *config.SignaturesConfig) (*SignatureAuth, error) {
+	if sc.MaxSkew < 0 || sc.MaxBody < 0 || sc.MaxReplays < 0 {
+		return nil, fmt.Errorf("max_skew, max_body and max_replays must not be negative")
+	}
+	secrets := make(map[string][]byte, len(sc.Clients))
+	for _, c := range sc.Clients {
+		if _, dup := secrets[c.ID]; dup {
+			return nil, fmt.Errorf("duplicate client %q", c.ID)
+		}
+		secrets[c.ID] = []byte(c.Secret)
+	}
+	a, err := NewSignatureAuth(secrets)
+	if err != nil {
+		return nil, err
+	}
+	a.KeyHeader = cmp.Or(sc.KeyHeader, a.KeyHeader)
+	a.TimestampHeader = cmp.Or(sc.TimestampHeader, a.TimestampHeader)
+	a.SignatureHeader = cmp.Or(sc.SignatureHeader, a.SignatureHeader)
+	a.ClientHeader = sc.ClientHeader
+	a.MaxSkew = cmp.Or(time.Duration(sc.MaxSkew), a.MaxSkew)
+	a.MaxBody = cmp.Or(sc.MaxBody, a.MaxBody)
+	a.MaxReplays = cmp.Or(sc.MaxReplays, a.MaxReplays)
+	return a, nil
+}
+
+func buildAPIKeys(ac *config.APIKeysConfig) (*APIKeyAuth, error) {
+	var store APIKeyStore
+	switch sc := ac.Store; {
+	case sc != nil && len(ac.Keys) > 0:
+		return nil, fmt.Errorf("keys and store are mutually exclusive")
+	case sc != nil:
+		if sc.Type != "redis" || sc.Addr == "" {
+			return nil, fmt.Errorf("store must be of type redis with an addr")
+		}
+		if sc.MaxEntries < 0 {
+			return nil, fmt.Errorf("negative max_entries")
+		}
+		s := NewRedisAPIKeyStore(NewRedisClient(sc.Addr, sc.Password, sc.DB))
+		if sc.MaxEntries > 0 {
+			s.MaxCached = sc.MaxEntries
+		}
+		store = s
+	case len(ac.Keys) > 0:
+		keys := make([]*APIKey, 0, len(ac.Keys))
+		for _, kc := range ac.Keys {
+			if kc.Rate < 0 || kc.Burst < 0 || kc.Quota < 0 || kc.ByteQuota < 0 || kc.QuotaPeriod < 0 {
+				return nil, fmt.Errorf("key %q: negative limit", kc.Name)
+			}
+			switch kc.QuotaCalendar {
+			case "", QuotaDaily, QuotaMonthly:
+			default:
+				return nil, fmt.Errorf("key %q: unknown quota_calendar %q (want day or month)", kc.Name, kc.QuotaCalendar)
+			}
+			keys = append(keys, &APIKey{
+				Key: kc.Key, Name: kc.Name, Tenant: kc.Tenant,
+				Rate: kc.Rate, Burst: kc.Burst,
+				Quota: kc.Quota, ByteQuota: kc.ByteQuota,
+				QuotaPeriod: time.Duration(kc.QuotaPeriod), QuotaCalendar: kc.QuotaCalendar,
+			})
+		}
+		s, err := NewStaticAPIKeyStore(keys)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	default:
+		return nil, fmt.Errorf("keys or store is required")
+	}
+	a := NewAPIKeyAuth(store)
+	if ac.Header != "" {
+		a.Header = ac.Header
+	}
+	if qc := ac.QuotaStore; qc != nil && qc.Type != "" && qc.Type != "memory" {
+		store, err := buildSharedStore(*qc)
+		if err != nil {
+			return nil, fmt.Errorf("quota_store: %w", err)
+		}
+		a.Quotas = NewSharedQuotaStore(store)
+	}
+	if rc := ac.RateStore; rc != nil && rc.Type != "" && rc.Type != "memory" {
+		store, err := buildSharedStore(*rc)
+		if err != nil {
+			return nil, fmt.Errorf("rate_store: %w", err)
+		}
+		a.Rates = store
+	}
+	a.Query = ac.Query
+	a.ConsumerHeader = ac.ConsumerHeader
+	return a, nil
+}
+
+func buildJWT(jc *config.JWTConfig) (*JWT, error) {
+	if jc.Leeway < 0 || jc.Refresh < 0 {
+		return nil, fmt.Errorf("negative leeway or refresh")
+	}
+	j, err := NewJWT(jc.JWKSURL, jc.Issuer, jc.Audiences)
+	if err != nil {
+		return nil, err
+	}
+	j.Cookie = jc.Cookie
+	j.Leeway = time.Duration(jc.Leeway)
+	if jc.Refresh > 0 {
+		j.Refresh = time.Duration(jc.Refresh)
+	}
+	j.Claims = jc.ClaimHeaders
+	return j, nil
+}
+
+func buildBasicAuth(bc *config.BasicAuthConfig) (*BasicAuth, error) {
+	if bc.HtpasswdFile == "" {
+		return nil, fmt.Errorf("htpasswd_file is required")
+	}
+	a, err := NewBasicAuth(bc.HtpasswdFile, bc.Realm)
+	if err != nil {
+		return nil, err
+	}
+	a.UserHeader = bc.UserHeader
+	return a, nil
+}
+
+func buildCORS(cc *config.CORSConfig) (*CORS, error) {
+	if len(cc.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("allowed_origins is required")
+	}
+	if cc.MaxAge < 0 {
+		return nil, fmt.Errorf("negative max_age")
+	}
+	if cc.AllowCredentials && slices.Contains(cc.AllowedOrigins, "*") {
+		// Any site could make credentialed requests and read the answers.
+		return nil, fmt.Errorf("allow_credentials needs the allowed origins listed, not \"*\"")
+	}
+	return NewCORS(cc.AllowedOrigins, cc.AllowedMethods, cc.AllowedHeaders, cc.ExposedHeaders, cc.AllowCredentials, time.Duration(cc.MaxAge)), nil
+}
+
+func buildHeaderOps(hc *config.HeaderOpsConfig) *HeaderOps {
+	if hc == nil {
+		return nil
+	}
+	return &HeaderOps{Remove: hc.Remove, Set: hc.Set, Add: hc.Add}
+}
+
+func buildCompression(cc *config.CompressionConfig) (*Compression, error) {
+	return NewCompression(cc.Encodings, cc.MinSize, cc.Types, cc.Level)
+}
+
+func buildSchedule(sc config.ScheduleConfig) (*Schedule, error) {
+	loc := time.UTC
+	if sc.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sc.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	return NewSchedule(sc.Cron, time.Duration(sc.Duration), loc)
+}
+
+// Build creates a LoadBalancer from the configuration.
+func Build(cfg *config.Config) (*LoadBalancer, error) {
+	for _, path := range cfg.Extensions {
+		if err := LoadExtension(path); err != nil {
+			return nil, fmt.Errorf("extension %q: %w", path, err)
+		}
+	}
+	up, err := buildTransport(cfg.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("transport: %w", err)
+	}
+	pools := make([]*Pool, 0, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		pool, err := buildPool(pc, up)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+		}
+		pools = append(pools, pool)
+	}
+	lb, err := NewLoadBalancer(WithPort(cfg.Port), WithPools(pools...))
+	if err != nil {
+		return nil, err
+	}
+	lb.upstream = up
+	if fc := cfg.Forwarded; fc != nil {
+		trusted := make([]netip.Prefix, 0, len(fc.TrustedProxies))
+		for _, s := range fc.TrustedProxies {
+			p, err := parsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("forwarded: %w", err)
+			}
+			trusted = append(trusted, p)
+		}
+		lb.SetForwarded(NewForwarded(trusted, fc.Header))
+	}
+	lb.SetStateFile(cfg.StateFile)
+	lb.SetSensitiveHeaders(cfg.SensitiveHeaders)
+	if gc := cfg.GeoIP; gc != nil {
+		db, err := OpenGeoIP(gc.Database)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		lb.SetGeoIP(db, gc.Header)
+	}
+	if fc := cfg.IPFilter; fc != nil {
+		f, err := buildIPFilter(fc)
+		if err != nil {
+			return nil, fmt.Errorf("ip_filter: %w", err)
+		}
+		lb.use("ip_filter", f.Middleware("frontend"))
+	}
+	if fc := cfg.TLSFingerprints; fc != nil {
+		f, err := buildFingerprints(fc)
+		if err != nil {
+			return nil, fmt.Errorf("tls_fingerprints: %w", err)
+		}
+		if cfg.TLS == nil {
+			return nil, fmt.Errorf("tls_fingerprints: requires tls")
+		}
+		lb.use("tls_fingerprints", f.Middleware())
+	}
+	if gc := cfg.GeoBlock; gc != nil {
+		f, err := buildGeoBlock(gc, lb.geoIP)
+		if err != nil {
+			return nil, fmt.Errorf("geo_block: %w", err)
+		}
+		lb.use("geo_block", f.Middleware())
+	}
+	if ac := cfg.Abuse; ac != nil {
+		g, err := buildAbuse(ac)
+		if err != nil {
+			return nil, fmt.Errorf("abuse: %w", err)
+		}
+		lb.SetAbuseGuard(g)
+	}
+	if cfg.BodyIdleTimeout > 0 {
+		t := &BodyTimeout{Idle: time.Duration(cfg.BodyIdleTimeout), ReadTimeout: time.Duration(cfg.ReadTimeout)}
+		lb.use("body_idle_timeout", t.Middleware())
+	}
+	if bc := cfg.Bots; bc != nil {
+		f, err := buildBots(bc)
+		if err != nil {
+			return nil, fmt.Errorf("bots: %w", err)
+		}
+		lb.use("bots", f.Middleware())
+	}
+	if wc := cfg.WAF; wc != nil {
+		w, err := buildWAF(wc)
+		if err != nil {
+			return nil, fmt.Errorf("waf: %w", err)
+		}
+		lb.use("waf", w.Middleware())
+	}
+	if cfg.MaxBodySize != 0 {
+		l, err := NewBodyLimit("global", cfg.MaxBodySize, false)
+		if err != nil {
+			return nil, fmt.Errorf("max_body_size: %w", err)
+		}
+		lb.use("max_body_size", l.Middleware())
+	}
+	for _, pc := range cfg.Plugins {
+		mw, err := buildPlugin(pc)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %q: %w", cmp.Or(pc.Name, pc.Path), err)
+		}
+		lb.use("plugin "+cmp.Or(pc.Name, pc.Path), mw)
+	}
+	if bc := cfg.Bandwidth; bc != nil {
+		b, err := buildBandwidth("global", bc)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth: %w", err)
+		}
+		lb.use("bandwidth", b.Middleware())
+	}
+	if cc := cfg.Compression; cc != nil {
+		c, err := buildCompression(cc)
+		if err != nil {
+			return nil, fmt.Errorf("compression: %w", err)
+		}
+		lb.use("compression", c.Middleware())
+	}
+	if ac := cfg.AccessLog; ac != nil {
+		a, err := buildAccessLog(ac)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %w", err)
+		}
+		lb.SetAccessLog(a)
+	}
+	if rc := cfg.Record; rc != nil {
+		rec, err := buildRecorder(rc)
+		if err != nil {
+			return nil, fmt.Errorf("record: %w", err)
+		}
+		lb.SetRecorder(rec)
+	}
+	if tc := cfg.Tags; tc != nil {
+		t, err := buildTagger(tc, cfg.Routes)
+		if err != nil {
+			return nil, fmt.Errorf("tags: %w", err)
+		}
+		lb.SetTagger(t)
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Middleware)) {
+		if n := middlewareKinds(cfg.Middleware[name]); n != 1 {
+			return nil, fmt.Errorf("middleware %q: exactly one middleware must be set, not %d", name, n)
+		}
+	}
+	for _, rc := range cfg.Routes {
+		if rc.CORS == nil {
+			rc.CORS = cfg.CORS
+		}
+		rt, err := buildRoute(rc, cfg.Middleware)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+		}
+		if err := lb.AddRoute(rt); err != nil {
+			return nil, err
+		}
+	}
+	for _, tc := range cfg.TCP {
+		if tc.Name == "" {
+			tc.Name = tc.Addr
+		}
+		pool := lb.Pool(tc.Pool)
+		if pool == nil {
+			return nil, fmt.Errorf("tcp %q: %w %q", tc.Name, ErrPoolNotFound, tc.Pool)
+		}
+		proxy := NewTCPProxy(tc.Name, tc.Addr, pool, time.Duration(tc.DialTimeout), time.Duration(tc.IdleTimeout))
+		if proxy.ProxyProtocol, err = buildProxyProtocol(tc.ProxyProtocol); err != nil {
+			return nil, fmt.Errorf("tcp %q: %w", tc.Name, err)
+		}
+		if proxy.IPFilter, err = buildIPFilter(tc.IPFilter); err != nil {
+			return nil, fmt.Errorf("tcp %q: ip_filter: %w", tc.Name, err)
+		}
+		if proxy.Socket, err = buildSocket(tc.Socket); err != nil {
+			return nil, fmt.Errorf("tcp %q: socket: %w", tc.Name, err)
+		}
+		if proxy.Egress, err = buildEgress(tc.Name, tc.Egress); err != nil {
+			return nil, fmt.Errorf("tcp %q: egress: %w", tc.Name, err)
+		}
+		if err := lb.AddTCPProxy(proxy); err != nil {
+			return nil, err
+		}
+	}
+	for _, uc := range cfg.UDP {
+		if uc.Name == "" {
+			uc.Name = uc.Addr
+		}
+		pool := lb.Pool(uc.Pool)
+		if pool == nil {
+			return nil, fmt.Errorf("udp %q: %w %q", uc.Name, ErrPoolNotFound, uc.Pool)
+		}
+		proxy := NewUDPProxy(uc.Name, uc.Addr, pool, time.Duration(uc.IdleTimeout))
+		if proxy.IPFilter, err = buildIPFilter(uc.IPFilter); err != nil {
+			return nil, fmt.Errorf("udp %q: ip_filter: %w", uc.Name, err)
+		}
+		if err := lb.AddUDPProxy(proxy); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.TLSPassthrough) > 0 && cfg.TLS == nil {
+		return nil, fmt.Errorf("tls_passthrough: requires tls")
+	}
+	for _, pc := range cfg.TLSPassthrough {
+		if len(pc.Hosts) == 0 {
+			return nil, fmt.Errorf("tls_passthrough %q: no hosts", pc.Name)
+		}
+		if pc.Name == "" {
+			pc.Name = pc.Hosts[0]
+		}
+		pool := lb.Pool(pc.Pool)
+		if pool == nil {
+			return nil, fmt.Errorf("tls_passthrough %q: %w %q", pc.Name, ErrPoolNotFound, pc.Pool)
+		}
+		if err := lb.AddPassthrough(NewPassthrough(pc.Name, pc.Hosts, pool)); err != nil {
+			return nil, err
+		}
+	}
+	if mc := cfg.Maintenance; mc != nil {
+		for _, name := range mc.Routes {
+			if lb.Route(name) == nil {
+				return nil, fmt.Errorf("maintenance: unknown route %q", name)
+			}
+		}
+		m, err := buildMaintenance(mc)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance: %w", err)
+		}
+		lb.SetMaintenance(m)
+	}
+	if fc := cfg.Fallback; fc != nil {
+		if fc.Pool != "" && fc.Status != 0 {
+			return nil, fmt.Errorf("fallback: pool and status are mutually exclusive")
+		}
+		if fc.Status != 0 && (fc.Status < 400 || fc.Status > 599) {
+			return nil, fmt.Errorf("fallback: status %d is not an error status", fc.Status)
+		}
+		if err := lb.SetFallback(&Fallback{Pool: fc.Pool, Status: fc.Status, Body: fc.Body}); err != nil {
+			return nil, err
+		}
+	}
+	return lb, nil
+}
+
+// BuildHTTP3 creates the HTTP/3 frontend, or returns nil if it isn't configured.
+func BuildHTTP3(cfg *config.Config) (*HTTP3, error) {
+	hc := cfg.HTTP3
+	if hc == nil {
+		return nil, nil
+	}
+	if cfg.TLS == nil {
+		return nil, fmt.Errorf("http3: requires tls")
+	}
+	if hc.Addr == "" {
+		hc.Addr = ":" + cfg.Port
+	}
+	h3, err := NewHTTP3(hc.Addr, time.Duration(hc.MaxAge))
+	if err != nil {
+		return nil, fmt.Errorf("http3: %w", err)
+	}
+	return h3, nil
+}
+
+// Listen opens the frontend listeners, reading PROXY protocol headers,
+// limiting the connections per client and checking requests strictly if
+// configured.
+func Listen(cfg *config.Config) ([]net.Listener, error) {
+	pp, err := buildProxyProtocol(cfg.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	strict, err := buildStrictParsing(cfg.StrictParsing)
+	if err != nil {
+		return nil, fmt.Errorf("strict_parsing: %w", err)
+	}
+	socket, err := buildSocket(cfg.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	var listeners []net.Listener
+	switch {
+	case cfg.Listeners < 0:
+		return nil, fmt.Errorf("listeners must not be negative")
+	case cfg.ReusePort:
+		listeners, err = DefaultUpgrader.ListenReusePort("tcp", ":"+cfg.Port, max(cfg.Listeners, 1))
+	case cfg.Listeners > 1:
+		return nil, fmt.Errorf("listeners requires reuse_port")
+	default:
+		var ln net.Listener
+		ln, err = listen("tcp", ":"+cfg.Port)
+		listeners = []net.Listener{ln}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, ln := range listeners {
+		listeners[i] = socket.Listen(ln)
+	}
+	egress, err := buildEgress("frontend", cfg.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("egress: %w", err)
+	}
+	if egress != nil {
+		// Shared by the listeners, which serve the same port.
+		for i, ln := range listeners {
+			listeners[i] = egress.Listen(ln)
+		}
+	}
+	switch {
+	case cfg.MaxConns < 0 || cfg.MaxConnsQueueTimeout < 0:
+		return nil, fmt.Errorf("max_conns and max_conns_queue_timeout must not be negative")
+	case cfg.MaxConns > 0:
+		// Connections count from their arrival, before a PROXY protocol
+		// header is read.
+		admission := NewAdmission("frontend", cfg.MaxConns, time.Duration(cfg.MaxConnsQueueTimeout))
+		for i, ln := range listeners {
+			listeners[i] = admission.Listen(ln)
+		}
+	}
+	if pp != nil {
+		for i, ln := range listeners {
+			listeners[i] = pp.Listen(ln)
+		}
+	}
+	switch {
+	case cfg.MaxConnsPerClient < 0:
+		return nil, fmt.Errorf("max_conns_per_client must not be negative")
+	case cfg.MaxConnsPerClient > 0:
+		// Shared by the listeners, which serve the same port.
+		limit := NewConnLimit("frontend", cfg.MaxConnsPerClient)
+		for i, ln := range listeners {
+			listeners[i] = limit.Listen(ln)
+		}
+	}
+	if strict != nil && cfg.TLS == nil {
+		// Outermost, for the server to find the connections checking its
+		// requests; over TLS, it reads them from the connections it decrypts.
+		for i, ln := range listeners {
+			listeners[i] = strict.Listen(ln)
+		}
+	}
+	return listeners, nil
+}
+
+// BuildServer creates the frontend HTTP server serving handler. Over TLS it
+// offers HTTP/2 and HTTP/1.1 through ALPN; in cleartext it accepts HTTP/1.1
+// and HTTP/2 with prior knowledge, which gRPC clients use without TLS.
+func BuildServer(cfg *config.Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		Protocols:         new(http.Protocols),
+	}
+	if srv.ReadHeaderTimeout == 0 && srv.ReadTimeout == 0 {
+		srv.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	srv.Protocols.SetHTTP1(true)
+	if tc := cfg.TLS; tc != nil && (tc.CertFile == "" || tc.KeyFile == "") {
+		return nil, fmt.Errorf("tls: cert_file and key_file are required")
+	}
+	if cfg.TLS != nil {
+		// Handshakes fingerprint their clients for RequestFingerprint.
+		srv.TLSConfig = &tls.Config{GetConfigForClient: recordFingerprint}
+		srv.ConnContext = withFingerprintHolder
+	}
+	strict, err := buildStrictParsing(cfg.StrictParsing)
+	if err != nil {
+		return nil, fmt.Errorf("strict_parsing: %w", err)
+	}
+	if strict != nil {
+		srv.MaxHeaderBytes = strict.MaxHeaderBytes
+		if cfg.TLS == nil {
+			// The listeners of Listen check requests.
+			srv.Handler = strictRejections(handler)
+			srv.ConnContext = withStrictConn
+		}
+	}
+	hc := cfg.HTTP2
+	if hc == nil {
+		hc = &config.HTTP2Config{}
+	}
+	if hc.Disable {
+		return srv, nil
+	}
+	if cfg.TLS != nil {
+		srv.Protocols.SetHTTP2(true)
+	} else {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if hc.MaxReadFrameSize != 0 && (hc.MaxReadFrameSize < 16<<10 || hc.MaxReadFrameSize > 1<<24-1) {
+		return nil, fmt.Errorf("http2: max_read_frame_size %d out of range", hc.MaxReadFrameSize)
+	}
+	srv.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams:          hc.MaxConcurrentStreams,
+		MaxReceiveBufferPerConnection: hc.MaxReceiveBufferPerConnection,
+		MaxReceiveBufferPerStream:     hc.MaxReceiveBufferPerStream,
+		MaxReadFrameSize:              hc.MaxReadFrameSize,
+		PingTimeout:                   time.Duration(hc.PingTimeout),
+		SendPingTimeout:               time.Duration(hc.SendPingTimeout),
+	}
+	return srv, nil
+}
+
+// buildPool builds the pool pc, whose servers share the transports of up
+// unless it has a transport of its own.
+func buildPool(pc config.PoolConfig, up *upstream) (*Pool, error) {
+	if pc.Name == "" {
+		return nil, fmt.Errorf("pool name must not be empty")
+	}
+	if pc.Transport != nil {
+		var err error
+		if up, err = buildTransport(pc.Transport); err != nil {
+			return nil, fmt.Errorf("transport: %w", err)
+		}
+	}
+	strat, err := strategy.New(pc.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	checker, err := health.NewChecker(pc.HealthCheck.Checker, pc.HealthCheck.Config)
+	if err != nil {
+		return nil, fmt.Errorf("health_check: %w", err)
+	}
+	hc := health.Check{
+		Path:     pc.HealthCheck.Path,
+		Interval: time.Duration(pc.HealthCheck.Interval),
+		Timeout:  time.Duration(pc.HealthCheck.Timeout),
+		Checker:  checker,
+	}
+	servers := make([]backend.Server, 0, len(pc.Servers))
+	switch pc.Protocol {
+	case "", ProtocolHTTP, ProtocolGRPC, ProtocolTCP, ProtocolFastCGI:
+	case ProtocolUDP:
+		if pc.HealthCheck.Interval > 0 {
+			return nil, fmt.Errorf("health checks are not supported for udp pools")
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", pc.Protocol)
+	}
+	var proxyProtocol int
+	switch pc.ProxyProtocol {
+	case "":
+	case "v1":
+		proxyProtocol = ProxyProtocolV1
+	case "v2":
+		proxyProtocol = ProxyProtocolV2
+	default:
+		return nil, fmt.Errorf("unknown proxy_protocol %q", pc.ProxyProtocol)
+	}
+	if proxyProtocol != 0 && pc.Protocol != "" && pc.Protocol != ProtocolHTTP && pc.Protocol != ProtocolTCP {
+		return nil, fmt.Errorf("proxy_protocol is only supported for http and tcp pools")
+	}
+	datacenters, err := buildDatacenters(pc)
+	if err != nil {
+		return nil, fmt.Errorf("datacenters: %w", err)
+	}
+	build := func(sc config.ServerConfig) (backend.Server, error) {
+		s, err := buildServer(sc, pc, up)
+		if err != nil {
+			return nil, err
+		}
+		if sc.MaxIdleConns != 0 || sc.IdleConnTimeout != 0 || sc.DisableKeepAlives {
+			ss, ok := s.(*SimpleServer)
+			if !ok {
+				return nil, fmt.Errorf("connection settings are not supported for %s pools", pc.Protocol)
+			}
+			if sc.MaxIdleConns < 0 {
+				return nil, fmt.Errorf("max_idle_conns must not be negative")
+			}
+			ss.SetIdleConns(sc.MaxIdleConns, time.Duration(sc.IdleConnTimeout))
+			if sc.DisableKeepAlives {
+				ss.DisableKeepAlives()
+			}
+		}
+		if proxyProtocol != 0 {
+			switch s := s.(type) {
+			case *NetServer:
+				s.ProxyProtocol = proxyProtocol
+			case *SimpleServer:
+				if sc.H2C {
+					return nil, fmt.Errorf("proxy_protocol is not supported with h2c")
+				}
+				s.SetProxyProtocol(proxyProtocol)
+			}
+		}
+		if w, ok := s.(backend.WeightSetter); ok {
+			if sc.Weight < 0 {
+				return nil, fmt.Errorf("weight must not be negative")
+			}
+			if sc.Weight > 0 {
+				w.SetWeight(sc.Weight)
+			}
+			w.SetTier(sc.Tier)
+		}
+		if len(sc.Maintenance) > 0 {
+			w, ok := s.(Windowed)
+			if !ok {
+				return nil, fmt.Errorf("maintenance windows are not supported for %s pools", pc.Protocol)
+			}
+			windows := make([]*Schedule, len(sc.Maintenance))
+			for i, mc := range sc.Maintenance {
+				if windows[i], err = buildSchedule(mc); err != nil {
+					return nil, fmt.Errorf("maintenance window: %w", err)
+				}
+			}
+			w.SetMaintenanceWindows(windows)
+		}
+		return s, nil
+	}
+	// discovered builds the server of a discovered target from sc.
+	discovered := func(sc config.ServerConfig, t Target) (backend.Server, error) {
+		sc.Addr = t.Addr
+		if t.Weight > 0 {
+			sc.Weight, sc.Tier = t.Weight, t.Tier
+		}
+		s, err := build(sc)
+		if err != nil {
+			return nil, err
+		}
+		if ss, ok := s.(*SimpleServer); ok && t.ServerName != "" {
+			ss.SetTLSServerName(t.ServerName)
+		}
+		if datacenters != nil && sc.Datacenter != "" {
+			// Servers resolved from a hostname are in its data center.
+			datacenters.Assign(s.Address(), sc.Datacenter)
+		}
+		return s, nil
+	}
+	var resolved []config.ServerConfig
+	for _, sc := range pc.Servers {
+		if pc.DNSRefresh > 0 && isHostnameAddr(sc.Addr) {
+			resolved = append(resolved, sc)
+			continue
+		}
+		s, err := build(sc)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %w", sc.Addr, err)
+		}
+		servers = append(servers, s)
+	}
+	pool := NewPool(pc.Name, servers, strat, hc)
+	pool.Protocol = pc.Protocol
+	pool.newServer = build
+	pool.SetMaintenance(pc.Maintenance)
+	var d *Discovery
+	if len(resolved) > 0 {
+		d = NewDiscovery(time.Duration(pc.DNSRefresh), servers)
+		for _, sc := range resolved {
+			dns, err := NewDNSDiscoverer(sc.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("server %q: %w", sc.Addr, err)
+			}
+			d.Add(dns, func(t Target) (backend.Server, error) { return discovered(sc, t) })
+		}
+	}
+	if dc := pc.Discovery; dc != nil {
+		if d == nil {
+			d = NewDiscovery(time.Duration(dc.Interval), servers)
+		} else if dc.Interval > 0 && time.Duration(dc.Interval) < d.Interval {
+			d.Interval = time.Duration(dc.Interval)
+		}
+		if err := buildDiscovery(dc, pc, d, discovered); err != nil {
+			return nil, fmt.Errorf("discovery: %w", err)
+		}
+	}
+	if d != nil {
+		pool.SetDiscovery(d)
+	}
+	if pc.Affinity != nil {
+		a, err := buildAffinity(*pc.Affinity)
+		if err != nil {
+			return nil, fmt.Errorf("affinity: %w", err)
+		}
+		pool.SetAffinity(a)
+	}
+	egress, err := buildEgress(pc.Name, pc.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("egress: %w", err)
+	}
+	pool.SetEgress(egress)
+	faults, err := buildFaults(pc.Name, pc.Faults)
+	if err != nil {
+		return nil, fmt.Errorf("faults: %w", err)
+	}
+	pool.SetFaults(faults)
+	pool.SetDatacenters(datacenters)
+	return pool, nil
+}
+
+// buildDatacenters builds the data center routing of the pool of pc, if
+// it has a datacenters section or a server with a data center.
+func buildDatacenters(pc config.PoolConfig) (*Datacenters, error) {
+	dc := pc.Datacenters
+	if dc == nil && !slices.ContainsFunc(pc.Servers, func(sc config.ServerConfig) bool { return sc.Datacenter != "" }) {
+		return nil, nil
+	}
+	if dc == nil {
+		dc = &config.DatacentersConfig{}
+	}
+	if pc.Protocol == ProtocolUDP {
+		return nil, fmt.Errorf("not supported for udp pools")
+	}
+	if dc.Interval < 0 || dc.Timeout < 0 {
+		return nil, fmt.Errorf("interval and timeout must not be negative")
+	}
+	d := NewDatacenters(pc.Name)
+	if dc.Interval > 0 {
+		d.Interval = time.Duration(dc.Interval)
+	}
+	if dc.Timeout > 0 {
+		d.Timeout = time.Duration(dc.Timeout)
+	}
+	for _, sc := range pc.Servers {
+		d.Assign(sc.Addr, sc.Datacenter)
+	}
+	for name, w := range dc.Weights {
+		if w < 0 {
+			return nil, fmt.Errorf("weight of %q must not be negative", name)
+		}
+		if !d.setWeight(name, &w, true) {
+			return nil, fmt.Errorf("weights: no server in data center %q", name)
+		}
+	}
+	return d, nil
+}
+
+// build adds the configured discoverers to d. Their targets are turned into
+// servers by discovered, from a ServerConfig holding the pool's defaults.
+func buildDiscovery(dc *config.DiscoveryConfig, pc config.PoolConfig, d *Discovery, discovered func(config.ServerConfig, Target) (backend.Server, error)) error {
+	n := len(d.sources)
+	add := func(disc Discoverer) {
+		d.Add(disc, func(t Target) (backend.Server, error) { return discovered(config.ServerConfig{}, t) })
+	}
+	// scheme defaults to http for pools whose servers are URLs.
+	scheme := func(s string) string {
+		if s == "" && (pc.Protocol == "" || pc.Protocol == ProtocolHTTP || pc.Protocol == ProtocolGRPC) {
+			return "http"
+		}
+		return s
+	}
+	if sc := dc.SRV; sc != nil {
+		srv, err := NewSRVDiscoverer(sc.Name, scheme(sc.Scheme))
+		if err != nil {
+			return err
+		}
+		add(srv)
+	}
+	if cc := dc.Consul; cc != nil {
+		consul, err := NewConsulDiscoverer(cc.Addr, cc.Service)
+		if err != nil {
+			return err
+		}
+		consul.Tags = cc.Tags
+		consul.Datacenter = cc.Datacenter
+		consul.Token = cc.Token
+		consul.AllowWarning = cc.AllowWarning
+		consul.Scheme = scheme(cc.Scheme)
+		add(consul)
+	}
+	if ec := dc.Etcd; ec != nil {
+		etcd, err := NewEtcdDiscoverer(ec.Endpoints, ec.Prefix)
+		if err != nil {
+			return err
+		}
+		etcd.Username, etcd.Password = ec.Username, ec.Password
+		add(etcd)
+	}
+	if kc := dc.Kubernetes; kc != nil {
+		k8s, err := NewKubernetesDiscoverer(kc.Kubeconfig, kc.Namespace, kc.Service)
+		if err != nil {
+			return err
+		}
+		k8s.Port = kc.Port
+		k8s.Scheme = scheme(kc.Scheme)
+		add(k8s)
+	}
+	if dk := dc.Docker; dk != nil {
+		name := dk.Pool
+		if name == "" {
+			name = pc.Name
+		}
+		docker, err := NewDockerDiscoverer(dk.Host, name, dk.LabelPrefix)
+		if err != nil {
+			return err
+		}
+		docker.Network = dk.Network
+		docker.Scheme = scheme(dk.Scheme)
+		add(docker)
+	}
+	if sc := dc.Swarm; sc != nil {
+		if sc.DNS {
+			if sc.Service == "" {
+				return fmt.Errorf("swarm service must not be empty")
+			}
+			addr := net.JoinHostPort("tasks."+sc.Service, strconv.Itoa(sc.Port))
+			if s := scheme(sc.Scheme); s != "" {
+				addr = s + "://" + addr
+			}
+			dns, err := NewDNSDiscoverer(addr)
+			if err != nil {
+				return err
+			}
+			add(dns)
+		} else {
+			swarm, err := NewSwarmDiscoverer(sc.Host, sc.Service, sc.Port)
+			if err != nil {
+				return err
+			}
+			swarm.Network = sc.Network
+			swarm.Scheme = scheme(sc.Scheme)
+			add(swarm)
+		}
+	}
+	if nc := dc.Nomad; nc != nil {
+		nomad, err := NewNomadDiscoverer(nc.Addr, nc.Service)
+		if err != nil {
+			return err
+		}
+		nomad.Namespace = nc.Namespace
+		nomad.Tags = nc.Tags
+		nomad.Token = nc.Token
+		nomad.Scheme = scheme(nc.Scheme)
+		add(nomad)
+	}
+	if ec := dc.Eureka; ec != nil {
+		eureka, err := NewEurekaDiscoverer(ec.URLs, ec.App)
+		if err != nil {
+			return err
+		}
+		eureka.UseHostname = ec.UseHostname
+		eureka.Secure = ec.Secure
+		eureka.Scheme = scheme(ec.Scheme)
+		add(eureka)
+	}
+	if zc := dc.ZooKeeper; zc != nil {
+		zk, err := NewZooKeeperDiscoverer(zc.Servers, zc.Path)
+		if err != nil {
+			return err
+		}
+		if zc.SessionTimeout > 0 {
+			zk.Timeout = time.Duration(zc.SessionTimeout)
+		}
+		zk.Scheme = scheme(zc.Scheme)
+		add(zk)
+	}
+	if fc := dc.File; fc != nil {
+		file, err := NewFileDiscoverer(fc.Path)
+		if err != nil {
+			return err
+		}
+		if fc.PollInterval > 0 {
+			file.PollInterval = time.Duration(fc.PollInterval)
+		}
+		add(file)
+	}
+	if ec := dc.EC2; ec != nil {
+		ec2, err := NewEC2Discoverer(ec.Regions, ec.Tags, ec.Port)
+		if err != nil {
+			return err
+		}
+		ec2.Scheme = scheme(ec.Scheme)
+		ec2.Endpoint = ec.Endpoint
+		add(ec2)
+	}
+	if mc := dc.MDNS; mc != nil {
+		mdns, err := NewMDNSDiscoverer(mc.Service)
+		if err != nil {
+			return err
+		}
+		if mc.Domain != "" {
+			mdns.Domain = mc.Domain
+		}
+		if mc.Timeout > 0 {
+			mdns.Timeout = time.Duration(mc.Timeout)
+		}
+		mdns.Scheme = scheme(mc.Scheme)
+		add(mdns)
+	}
+	if rc := dc.Registration; rc != nil {
+		add(NewRegistrar(time.Duration(rc.TTL)))
+	}
+	for _, plc := range dc.Plugins {
+		disc, err := NewDiscoverer(plc.Name, plc.Config)
+		if err != nil {
+			return err
+		}
+		add(disc)
+	}
+	if len(d.sources) == n {
+		return fmt.Errorf("no discovery source configured")
+	}
+	return nil
+}
+
+func buildRoute(rc config.RouteConfig, named map[string]config.MiddlewareConfig) (*Route, error) {
+	rt := NewRoute(rc.Name, rc.Pool)
+	rt.Priority = rc.Priority
+	if rc.Pool != "" && len(rc.Splits) > 0 {
+		return nil, fmt.Errorf("pool and splits are mutually exclusive")
+	}
+	if bc := rc.BlueGreen; bc != nil {
+		if rc.Pool != "" {
+			return nil, fmt.Errorf("pool and blue_green are mutually exclusive")
+		}
+		bg, err := NewBlueGreen(bc.Blue, bc.Green, bc.Active)
+		if err != nil {
+			return nil, fmt.Errorf("blue_green: %w", err)
+		}
+		rt.BlueGreen = bg
+	}
+	splits := make([]Split, len(rc.Splits))
+	for i, sc := range rc.Splits {
+		splits[i] = Split(sc)
+	}
+	if err := rt.SetSplits(splits); err != nil {
+		return nil, err
+	}
+	rt.Methods = rc.Methods
+	rt.Countries = rc.Countries
+	if rc.Schedule != nil {
+		sched, err := buildSchedule(*rc.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+		rt.Schedule = sched
+	}
+	if rc.Path != nil {
+		m, err := buildMatch(*rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("path: %w", err)
+		}
+		rt.Path = &m
+	}
+	for _, h := range rc.Headers {
+		t, err := parseMatchType(h.Type)
+		if err != nil {
+			return nil, err
+		}
+		m, err := NewHeaderMatch(h.Name, t, h.Value)
+		if err != nil {
+			return nil, err
+		}
+		rt.Headers = append(rt.Headers, m)
+	}
+	for _, q := range rc.Query {
+		t, err := parseMatchType(q.Type)
+		if err != nil {
+			return nil, err
+		}
+		m, err := NewQueryMatch(q.Name, t, q.Value)
+		if err != nil {
+			return nil, err
+		}
+		rt.Query = append(rt.Query, m)
+	}
+	if rc.Rewrite != nil {
+		rw := &Rewrite{
+			StripPrefix: rc.Rewrite.StripPrefix,
+			AddPrefix:   rc.Rewrite.AddPrefix,
+			Replacement: rc.Rewrite.Replacement,
+		}
+		if rc.Rewrite.Regex != "" {
+			re, err := regexp.Compile(rc.Rewrite.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite: invalid regex %q: %w", rc.Rewrite.Regex, err)
+			}
+			rw.Regex = re
+		}
+		rt.Rewrite = rw
+	}
+	if mc := rc.Mirror; mc != nil {
+		if mc.Percent < 0 || mc.Percent > 100 {
+			return nil, fmt.Errorf("mirror: percent must be between 0 and 100")
+		}
+		rt.Mirror = NewMirror(mc.Pool, mc.Percent, mc.MaxBody, time.Duration(mc.Timeout), mc.MaxInFlight)
+	}
+	if cc := rc.Canary; cc != nil {
+		if cc.Header == "" && cc.Cookie == "" {
+			return nil, fmt.Errorf("canary: header or cookie is required")
+		}
+		rt.Canary = &Canary{Pool: cc.Pool, Header: cc.Header, Cookie: cc.Cookie, Value: cc.Value}
+	}
+	if rc.Affinity != nil {
+		if rc.DisableAffinity {
+			return nil, fmt.Errorf("affinity and disable_affinity are mutually exclusive")
+		}
+		a, err := buildAffinity(*rc.Affinity)
+		if err != nil {
+			return nil, fmt.Errorf("affinity: %w", err)
+		}
+		rt.SetAffinity(a)
+	}
+	rt.DisableAffinity = rc.DisableAffinity
+	if sc := rc.Stream; sc != nil {
+		if sc.FlushInterval < 0 {
+			return nil, fmt.Errorf("stream: negative flush_interval")
+		}
+		rt.Stream = &Stream{FlushInterval: time.Duration(sc.FlushInterval)}
+	}
+	faults, err := buildFaults(rc.Name, rc.Faults)
+	if err != nil {
+		return nil, fmt.Errorf("faults: %w", err)
+	}
+	rt.Faults = faults
+	var listed Chain
+	var listedNames []string
+	cached := ""
+	for _, name := range rc.Middleware {
+		mc, ok := named[name]
+		if !ok {
+			return nil, fmt.Errorf("middleware: unknown %q", name)
+		}
+		m, kind, err := namedMiddleware(rc.Name, mc)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %q: %w", name, err)
+		}
+		// A cache before authentication would serve the responses it
+		// stored to any client.
+		switch {
+		case kind == "cache":
+			cached = name
+		case cached != "" && authMiddleware[kind]:
+			return nil, fmt.Errorf("middleware %q: listed after the cache %q, which would serve what it authenticates to anyone", name, cached)
+		}
+		listed = append(listed, m)
+		listedNames = append(listedNames, name+" ("+kind+")")
+	}
+	mw, names, err := routeMiddleware(rc, listed, listedNames)
+	if err != nil {
+		return nil, err
+	}
+	rt.Middleware = append(rt.Middleware, mw...)
+	rt.middlewareNames = names
+	if ec := rc.Experiment; ec != nil {
+		buckets := make([]Bucket, len(ec.Buckets))
+		for i, bc := range ec.Buckets {
+			buckets[i] = Bucket(bc)
+		}
+		exp, err := NewExperiment(ec.Name, ec.Cookie, ec.Header, ec.TagHeader, buckets)
+		if err != nil {
+			return nil, err
+		}
+		rt.Experiment = exp
+	}
+	if rc.Redirect != nil {
+		rd, err := NewRedirect(rc.Redirect.Code, rc.Redirect.Target)
+		if err != nil {
+			return nil, err
+		}
+		rt.Redirect = rd
+	}
+	return rt, nil
+}
+
+// authMiddleware are the kinds of middleware authenticating requests, as
+// routeMiddleware names them.
+var authMiddleware = map[string]bool{
+	"basic_auth": true, "jwt": true, "api_keys": true, "signatures": true, "forward_auth": true,
+}
+
+// routeMiddleware builds the middleware of the route, and their names for
+// Explain. Clients are filtered by address first, then preflight requests
+// answered, which carry no credentials, before the bandwidth and rate
+// limits, which still see the API keys authentication removes, the body
+// limit and authentication apply; plugins see authenticated requests, and
+// header rules, cookie rewriting and compression the final responses. The cache,
+// last, holds the responses of backends as they are. The middleware the
+// route lists, named with listedNames, run after the plugins, so that the
+// route's own authentication applies before them and its own cache after.
+func routeMiddleware(rc config.RouteConfig, listed Chain, listedNames []string) (Chain, []string, error) {
+	var mw Chain
+	var names []string
+	add := func(name string, m Middleware) {
+		mw = append(mw, m)
+		names = append(names, name)
+	}
+	if rc.IPFilter != nil {
+		f, err := buildIPFilter(rc.IPFilter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ip_filter: %w", err)
+		}
+		add("ip_filter", f.Middleware(rc.Name))
+	}
+	if cc := rc.CORS; cc != nil {
+		c, err := buildCORS(cc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cors: %w", err)
+		}
+		add("cors", c.Middleware())
+	}
+	if bc := rc.Bandwidth; bc != nil {
+		b, err := buildBandwidth(rc.Name, bc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bandwidth: %w", err)
+		}
+		add("bandwidth", b.Middleware())
+	}
+	if lc := rc.RateLimit; lc != nil {
+		l, err := buildRateLimit(rc.Name, lc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rate_limit: %w", err)
+		}
+		add("rate_limit", l.Middleware())
+	}
+	if rc.MaxBodySize != 0 {
+		l, err := NewBodyLimit(rc.Name, rc.MaxBodySize, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("max_body_size: %w", err)
+		}
+		add("max_body_size", l.Middleware())
+	}
+	if bc := rc.BasicAuth; bc != nil {
+		a, err := buildBasicAuth(bc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("basic_auth: %w", err)
+		}
+		add("basic_auth", a.Middleware())
+	}
+	if jc := rc.JWT; jc != nil {
+		j, err := buildJWT(jc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("jwt: %w", err)
+		}
+		add("jwt", j.Middleware())
+	}
+	if ac := rc.APIKeys; ac != nil {
+		a, err := buildAPIKeys(ac)
+		if err != nil {
+			return nil, nil, fmt.Errorf("api_keys: %w", err)
+		}
+		add("api_keys", a.Middleware())
+	}
+	if sc := rc.Signatures; sc != nil {
+		a, err := buildSignatures(sc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("signatures: %w", err)
+		}
+		add("signatures", a.Middleware())
+	}
+	if fc := rc.ForwardAuth; fc != nil {
+		fa, err := buildForwardAuth(fc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("forward_auth: %w", err)
+		}
+		add("forward_auth", fa.Middleware())
+	}
+	for _, pc := range rc.Plugins {
+		p, err := buildPlugin(pc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("plugin %q: %w", cmp.Or(pc.Name, pc.Path), err)
+		}
+		add("plugin "+cmp.Or(pc.Name, pc.Path), p)
+	}
+	mw = append(mw, listed...)
+	names = append(names, listedNames...)
+	if rc.RequestHeaders != nil || rc.ResponseHeaders != nil {
+		hr := &HeaderRules{Request: buildHeaderOps(rc.RequestHeaders), Response: buildHeaderOps(rc.ResponseHeaders)}
+		add("header_rules", hr.Middleware())
+	}
+	if cc := rc.Cookies; cc != nil {
+		cr := &CookieRewrite{Domains: cc.Domains, Paths: cc.Paths, NamePrefix: cc.NamePrefix}
+		add("cookies", cr.Middleware())
+	}
+	if cc := rc.Compression; cc != nil {
+		c, err := buildCompression(cc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compression: %w", err)
+		}
+		add("compression", c.Middleware())
+	}
+	if cc := rc.Cache; cc != nil {
+		c, err := NewCache(rc.Name, time.Duration(cc.TTL), cc.MaxEntries, cc.MaxSize, cc.MaxEntrySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cache: %w", err)
+		}
+		c.StaleWhileRevalidate = time.Duration(cc.StaleWhileRevalidate)
+		c.StaleIfError = time.Duration(cc.StaleIfError)
+		add("cache", c.Middleware())
+	}
+	return mw, names, nil
+}
+
+// namedMiddleware builds the named middleware mc for the route named route,
+// as routeMiddleware would the same field of the route, and returns its
+// kind, as routeMiddleware names it.
+func namedMiddleware(route string, mc config.MiddlewareConfig) (Middleware, string, error) {
+	rc := config.RouteConfig{
+		Name:            route,
+		IPFilter:        mc.IPFilter,
+		CORS:            mc.CORS,
+		Bandwidth:       mc.Bandwidth,
+		RateLimit:       mc.RateLimit,
+		MaxBodySize:     mc.MaxBodySize,
+		BasicAuth:       mc.BasicAuth,
+		JWT:             mc.JWT,
+		APIKeys:         mc.APIKeys,
+		Signatures:      mc.Signatures,
+		ForwardAuth:     mc.ForwardAuth,
+		RequestHeaders:  mc.RequestHeaders,
+		ResponseHeaders: mc.ResponseHeaders,
+		Cookies:         mc.Cookies,
+		Compression:     mc.Compression,
+		Cache:           mc.Cache,
+	}
+	if mc.Plugin != nil {
+		rc.Plugins = []config.PluginConfig{*mc.Plugin}
+	}
+	mw, names, err := routeMiddleware(rc, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(mw) != 1 {
+		return nil, "", fmt.Errorf("exactly one middleware must be set, not %d", len(mw))
+	}
+	return mw[0], names[0], nil
+}
+
+// middlewareKinds returns how many of the middleware of mc are set.
+func middlewareKinds(mc config.MiddlewareConfig) int {
+	n := 0
+	for _, set := range []bool{
+		mc.IPFilter != nil, mc.CORS != nil, mc.Bandwidth != nil, mc.RateLimit != nil,
+		mc.MaxBodySize != 0, mc.BasicAuth != nil, mc.JWT != nil, mc.APIKeys != nil,
+		mc.Signatures != nil, mc.ForwardAuth != nil, mc.Plugin != nil,
+		mc.RequestHeaders != nil || mc.ResponseHeaders != nil, mc.Cookies != nil,
+		mc.Compression != nil, mc.Cache != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func buildRateLimit(route string, lc *config.RateLimitConfig) (*RateLimit, error) {
+	if lc.MaxClients < 0 {
+		return nil, fmt.Errorf("negative max_clients")
+	}
+	l, err := NewRateLimit(route, lc.Rate, lc.Burst)
+	if err != nil {
+		return nil, err
+	}
+	if lc.MaxClients > 0 {
+		l.MaxClients = lc.MaxClients
+	}
+	return l, nil
+}
+
+func buildMatch(mc config.MatchConfig) (StringMatch, error) {
+	t, err := parseMatchType(mc.Type)
+	if err != nil {
+		return StringMatch{}, err
+	}
+	return NewStringMatch(t, mc.Value)
+}
+
+func parseMatchType(s string) (MatchType, error) {
+	switch s {
+	case "", "exact":
+		return MatchExact, nil
+	case "prefix":
+		return MatchPrefix, nil
+	case "regex":
+		return MatchRegex, nil
+	}
+	return 0, fmt.Errorf("unknown match type %q", s)
+}
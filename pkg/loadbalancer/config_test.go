@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+var testNamedMiddleware = map[string]config.MiddlewareConfig{
+	"keys":  {APIKeys: &config.APIKeysConfig{Header: "X-API-Key", Keys: []config.APIKeyConfig{{Name: "acme", Key: "secret"}}}},
+	"cache": {Cache: &config.CacheConfig{TTL: config.Duration(time.Minute)}},
+}
+
+// TestRouteMiddlewareCacheAfterAuth checks that a route's own cache holds
+// only what the middleware it lists authenticated.
+func TestRouteMiddlewareCacheAfterAuth(t *testing.T) {
+	rc := config.RouteConfig{
+		Name:       "api",
+		Pool:       "api",
+		Cache:      &config.CacheConfig{TTL: config.Duration(time.Minute)},
+		Middleware: []string{"keys"},
+	}
+	rt, err := buildRoute(rc, testNamedMiddleware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"keys (api_keys)", "cache"}; !slices.Equal(rt.middlewareNames, want) {
+		t.Errorf("middleware %v, want %v", rt.middlewareNames, want)
+	}
+	h := rt.Middleware.Then(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("private"))
+	}))
+	for _, tc := range []struct {
+		key  string
+		want int
+	}{{"secret", http.StatusOK}, {"", http.StatusUnauthorized}} {
+		r := httptest.NewRequest(http.MethodGet, "/data", nil)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("key %q: got %d, want %d", tc.key, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestRouteMiddlewareListedCacheBeforeAuth(t *testing.T) {
+	rc := config.RouteConfig{Name: "api", Pool: "api", Middleware: []string{"cache", "keys"}}
+	_, err := buildRoute(rc, testNamedMiddleware)
+	if err == nil || !strings.Contains(err.Error(), `after the cache "cache"`) {
+		t.Errorf("got %v, want an error about the cache", err)
+	}
+	rc.Middleware = []string{"keys", "cache"}
+	if _, err := buildRoute(rc, testNamedMiddleware); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyProtocolRequiresTrusted(t *testing.T) {
+	if _, err := buildProxyProtocol(&config.ProxyProtocolConfig{}); err == nil {
+		t.Error("proxy_protocol without trusted was accepted")
+	}
+}
+
+func TestBuildAdminRequiresCredentials(t *testing.T) {
+	lb, err := NewLoadBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ac config.AdminConfig
+		ok bool
+	}{
+		{config.AdminConfig{Addr: ":9090"}, false},
+		{config.AdminConfig{Addr: "10.0.0.1:9090"}, false},
+		{config.AdminConfig{Addr: ":9090", Insecure: true}, true},
+		{config.AdminConfig{Addr: ":9090", Token: "secret"}, true},
+		{config.AdminConfig{Addr: ":9090", Tokens: []config.AdminTokenConfig{{Token: "secret", Role: "read"}}}, true},
+		{config.AdminConfig{Addr: "127.0.0.1:9090"}, true},
+		{config.AdminConfig{Addr: "[::1]:9090"}, true},
+		{config.AdminConfig{Addr: "localhost:9090"}, true},
+	} {
+		_, err := BuildAdmin(&config.Config{Admin: &tc.ac}, lb)
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: got %v, want accepted %t", tc.ac, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsulAddr = "http://127.0.0.1:8500"
+	// consulWait bounds blocking queries; Consul answers with an unchanged
+	// index when it expires.
+	consulWait = 5 * time.Minute
+)
+
+// ConsulDiscoverer yields the healthy instances of a Consul service. Only
+// instances whose health checks all pass are returned, unless AllowWarning
+// also admits instances with warning checks. An instance's weight is taken
+// from the service's Weights.Passing or Weights.Warning.
+//
+// ConsulDiscoverer is a Watcher: it uses blocking queries to learn about
+// instances registering, deregistering or changing health right away.
+type ConsulDiscoverer struct {
+	// Addr is the URL of the Consul HTTP API.
+	Addr    string
+	Service string
+	// Tags, if set, only admits instances carrying all of them.
+	Tags         []string
+	Datacenter   string
+	Token        string
+	AllowWarning bool
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+	Client *http.Client
+
+	mu    sync.Mutex
+	index uint64
+}
+
+// NewConsulDiscoverer creates a ConsulDiscoverer for service. An empty addr
+// defaults to the local agent.
+func NewConsulDiscoverer(addr, service string) (*ConsulDiscoverer, error) {
+	if service == "" {
+		return nil, fmt.Errorf("consul service must not be empty")
+	}
+	if addr == "" {
+		addr = defaultConsulAddr
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("consul address: %w", err)
+	}
+	return &ConsulDiscoverer{
+		Addr:    strings.TrimSuffix(addr, "/"),
+		Service: service,
+		Client:  &http.Client{Timeout: consulWait + 30*time.Second},
+	}, nil
+}
+
+// consulEntry is an element of Consul's /v1/health/service response.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// Discover implements Discoverer.
+func (c *ConsulDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	targets, index, err := c.query(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.index = index
+	c.mu.Unlock()
+	return targets, nil
+}
+
+// Watch implements Watcher.
+func (c *ConsulDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	for {
+		c.mu.Lock()
+		last := c.index
+		c.mu.Unlock()
+		targets, index, err := c.query(ctx, last)
+		if err != nil {
+			return nil, err
+		}
+		if index < last {
+			// The index went backwards, as after a Consul restore;
+			// start over from it.
+			index = 0
+		}
+		c.mu.Lock()
+		c.index = index
+		c.mu.Unlock()
+		if index != last {
+			return targets, nil
+		}
+	}
+}
+
+// query fetches the service's instances, blocking until the index moves past
+// index if it is non-zero.
+func (c *ConsulDiscoverer) query(ctx context.Context, index uint64) ([]Target, uint64, error) {
+	q := url.Values{}
+	for _, tag := range c.Tags {
+		q.Add("tag", tag)
+	}
+	if c.Datacenter != "" {
+		q.Set("dc", c.Datacenter)
+	}
+	if !c.AllowWarning {
+		q.Set("passing", "true")
+	}
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+	u := c.Addr + "/v1/health/service/" + url.PathEscape(c.Service) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul: %w", err)
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	targets := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		w := e.Service.Weights
+		if w.Passing == 0 && w.Warning == 0 {
+			// Agents before Consul 1.2.3 report no weights.
+			w.Passing, w.Warning = 1, 1
+		}
+		var weight int
+		switch consulStatus(e) {
+		case "passing":
+			weight = w.Passing
+		case "warning":
+			weight = w.Warning
+		}
+		if weight <= 0 {
+			continue
+		}
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		if c.Scheme != "" {
+			addr = c.Scheme + "://" + addr
+		}
+		targets = append(targets, Target{Addr: addr, Weight: weight})
+	}
+	return targets, next, nil
+}
+
+// consulStatus returns the aggregated status of an instance's checks:
+// "passing", "warning" or "critical".
+func consulStatus(e consulEntry) string {
+	status := "passing"
+	for _, check := range e.Checks {
+		switch check.Status {
+		case "passing":
+		case "warning":
+			status = "warning"
+		default:
+			return "critical"
+		}
+	}
+	return status
+}
@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CookieRewrite rewrites the cookies backends set, so that those issued for
+// their internal host names and paths work behind the public ones.
+//
+// Domains maps the Domain attribute of a cookie, compared without case or a
+// leading dot, to its replacement; "*" matches any domain, and an empty
+// replacement removes the attribute, making the cookie host-only. Paths maps
+// a prefix of the Path attribute to its replacement, the longest matching
+// prefix winning. NamePrefix is prepended to the name of every cookie set and
+// removed again from the cookies clients send, so that the cookies of
+// backends sharing a public domain do not collide; cookies without it are
+// forwarded unchanged.
+type CookieRewrite struct {
+	Domains    map[string]string
+	Paths      map[string]string
+	NamePrefix string
+}
+
+// Middleware returns the middleware rewriting cookies.
+func (cr *CookieRewrite) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if cr.NamePrefix != "" && r.Header.Get("Cookie") != "" {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				cookies := r.Header["Cookie"]
+				for i, c := range cookies {
+					cookies[i] = cr.unprefix(c)
+				}
+			}
+			next.ServeHTTP(&cookieWriter{ResponseWriter: rw, rewrite: cr}, r)
+		})
+	}
+}
+
+// unprefix removes NamePrefix from the names of the cookies in a Cookie
+// header.
+func (cr *CookieRewrite) unprefix(header string) string {
+	pairs := strings.Split(header, ";")
+	for i, pair := range pairs {
+		pairs[i] = strings.TrimPrefix(strings.TrimSpace(pair), cr.NamePrefix)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// rewrite returns a Set-Cookie header value rewritten. Attributes are
+// edited in place so that those this package does not know survive.
+func (cr *CookieRewrite) rewrite(setCookie string) string {
+	parts := strings.Split(setCookie, ";")
+	if cr.NamePrefix != "" {
+		parts[0] = cr.NamePrefix + strings.TrimSpace(parts[0])
+	}
+	kept := parts[:1]
+	for _, attr := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch {
+		case strings.EqualFold(name, "Domain") && len(cr.Domains) > 0:
+			domain, ok := cr.domain(value)
+			if !ok {
+				break
+			}
+			if domain == "" {
+				continue
+			}
+			attr = " Domain=" + domain
+		case strings.EqualFold(name, "Path") && len(cr.Paths) > 0:
+			attr = " Path=" + cr.path(value)
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, ";")
+}
+
+// domain returns the replacement of a Domain attribute, if one applies.
+func (cr *CookieRewrite) domain(domain string) (string, bool) {
+	key := strings.ToLower(strings.TrimPrefix(domain, "."))
+	for from, to := range cr.Domains {
+		if strings.EqualFold(strings.TrimPrefix(from, "."), key) {
+			return to, true
+		}
+	}
+	to, ok := cr.Domains["*"]
+	return to, ok
+}
+
+// path returns a Path attribute with its longest matching prefix in Paths
+// replaced.
+func (cr *CookieRewrite) path(path string) string {
+	best := ""
+	found := false
+	for from := range cr.Paths {
+		if strings.HasPrefix(path, from) && (!found || len(from) > len(best)) {
+			best, found = from, true
+		}
+	}
+	if !found {
+		return path
+	}
+	return cr.Paths[best] + path[len(best):]
+}
+
+// cookieWriter rewrites the Set-Cookie headers of a response before it is
+// sent.
+type cookieWriter struct {
+	http.ResponseWriter
+	rewrite *CookieRewrite
+	done    bool
+}
+
+func (w *cookieWriter) WriteHeader(code int) {
+	if !w.done && code >= 200 {
+		w.done = true
+		cookies := w.Header()["Set-Cookie"]
+		for i, c := range cookies {
+			cookies[i] = w.rewrite.rewrite(c)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cookieWriter) Write(b []byte) (int, error) {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *cookieWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
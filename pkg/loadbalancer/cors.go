@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMethods are the methods allowed without a configured list.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORS answers cross-origin preflight requests and adds the CORS headers to
+// the responses to allowed origins, replacing any a backend sent. An origin
+// in Origins may be "*", matching any, or start with "*." to match the
+// subdomains of a domain. Headers lists the request headers allowed, "*"
+// allowing any; Expose the response headers scripts may read. Credentials
+// are not allowed to the origins matched only by "*".
+type CORS struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Expose      []string
+	Credentials bool
+	MaxAge      time.Duration
+}
+
+// NewCORS creates a CORS allowing origins to send requests with methods, GET,
+// HEAD and POST if empty.
+func NewCORS(origins, methods, headers, expose []string, credentials bool, maxAge time.Duration) *CORS {
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	upper := make([]string, len(methods))
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+	}
+	methods = upper
+	return &CORS{Origins: origins, Methods: methods, Headers: headers, Expose: expose, Credentials: credentials, MaxAge: maxAge}
+}
+
+// allowed reports whether requests from origin are allowed.
+func (c *CORS) allowed(origin string) bool {
+	return slices.Contains(c.Origins, "*") || c.listed(origin)
+}
+
+// listed reports whether origin is allowed other than by "*".
+func (c *CORS) listed(origin string) bool {
+	return slices.ContainsFunc(c.Origins, func(o string) bool {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+		if domain, ok := strings.CutPrefix(o, "*."); ok {
+			_, host, ok := strings.Cut(origin, "://")
+			host = strings.ToLower(host)
+			return ok && strings.HasSuffix(host, "."+strings.ToLower(domain))
+		}
+		return false
+	})
+}
+
+// Middleware returns the middleware applying the policy. Preflight requests
+// are answered without reaching a backend.
+func (c *CORS) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			rw.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				c.preflight(rw, r, origin)
+				return
+			}
+			if !c.allowed(origin) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			ops := &HeaderOps{Remove: []string{"Access-Control-*"}, Set: c.originHeaders(origin)}
+			if len(c.Expose) > 0 {
+				ops.Set["Access-Control-Expose-Headers"] = strings.Join(c.Expose, ", ")
+			}
+			next.ServeHTTP(&headerWriter{ResponseWriter: rw, ops: ops}, r)
+		})
+	}
+}
+
+// originHeaders returns the headers allowing origin.
+func (c *CORS) originHeaders(origin string) map[string]string {
+	h := map[string]string{"Access-Control-Allow-Origin": origin}
+	switch {
+	case c.Credentials && c.listed(origin):
+		h["Access-Control-Allow-Credentials"] = "true"
+	case slices.Contains(c.Origins, "*"):
+		h["Access-Control-Allow-Origin"] = "*"
+	}
+	return h
+}
+
+// preflight answers a preflight request, with 204 and the CORS headers if
+// the origin, method and headers requested are allowed, or 403.
+func (c *CORS) preflight(rw http.ResponseWriter, r *http.Request, origin string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !c.allowed(origin) || !slices.Contains(c.Methods, method) && !slices.Contains(c.Methods, "*") {
+		httpError(rw, r, "CORS request not allowed", http.StatusForbidden)
+		return
+	}
+	requested := strings.TrimSpace(r.Header.Get("Access-Control-Request-Headers"))
+	if requested != "" && !slices.Contains(c.Headers, "*") {
+		for _, name := range strings.Split(requested, ",") {
+			if !slices.ContainsFunc(c.Headers, func(h string) bool { return strings.EqualFold(h, strings.TrimSpace(name)) }) {
+				httpError(rw, r, "CORS request not allowed", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	h := rw.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	for k, v := range c.originHeaders(origin) {
+		h.Set(k, v)
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+	if requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+// corsServe serves a request from origin through c, returning the
+// recorded response.
+func corsServe(c *CORS, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	h := c.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	r := httptest.NewRequest(method, "/", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	c := NewCORS([]string{"https://app.example"}, []string{"get", "put"}, []string{"X-Token"}, nil, false, time.Minute)
+	for _, tc := range []struct {
+		name, origin, method, headers string
+		want                          int
+	}{
+		{"allowed", "https://app.example", "PUT", "x-token", http.StatusNoContent},
+		{"other origin", "https://evil.example", "PUT", "", http.StatusForbidden},
+		{"other method", "https://app.example", "DELETE", "", http.StatusForbidden},
+		{"other header", "https://app.example", "PUT", "X-Token, X-Other", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := map[string]string{"Access-Control-Request-Method": tc.method}
+			if tc.headers != "" {
+				header["Access-Control-Request-Headers"] = tc.headers
+			}
+			rec := corsServe(c, http.MethodOptions, tc.origin, header)
+			if rec.Code != tc.want {
+				t.Fatalf("got %d, want %d", rec.Code, tc.want)
+			}
+			if tc.want != http.StatusNoContent {
+				return
+			}
+			h := rec.Header()
+			if got := h.Get("Access-Control-Allow-Origin"); got != tc.origin {
+				t.Errorf("Allow-Origin %q, want %q", got, tc.origin)
+			}
+			if got := h.Get("Access-Control-Allow-Methods"); got != "GET, PUT" {
+				t.Errorf("Allow-Methods %q", got)
+			}
+			if got := h.Get("Access-Control-Allow-Headers"); got != tc.headers {
+				t.Errorf("Allow-Headers %q, want %q", got, tc.headers)
+			}
+			if got := h.Get("Access-Control-Max-Age"); got != "60" {
+				t.Errorf("Max-Age %q, want 60", got)
+			}
+		})
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	c := NewCORS([]string{"https://app.example", "*.example.org"}, nil, nil, []string{"X-Id"}, true, 0)
+	for origin, allowed := range map[string]bool{
+		"https://app.example":     true,
+		"https://APP.example":     true,
+		"https://a.example.org":   true,
+		"https://a.b.example.org": true,
+		"https://example.org":     false,
+		"https://badexample.org":  false,
+		"https://evil.example":    false,
+	} {
+		h := corsServe(c, http.MethodGet, origin, nil).Header()
+		if allowed {
+			if got := h.Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("%s: Allow-Origin %q", origin, got)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("%s: Allow-Credentials %q", origin, got)
+			}
+			if got := h.Get("Access-Control-Expose-Headers"); got != "X-Id" {
+				t.Errorf("%s: Expose-Headers %q", origin, got)
+			}
+		} else if got := h.Get("Access-Control-Allow-Origin"); got != "https://backend.example" {
+			t.Errorf("%s: Allow-Origin %q, want the backend's", origin, got)
+		}
+		if !slices.Contains(h.Values("Vary"), "Origin") {
+			t.Errorf("%s: Vary %q", origin, h.Values("Vary"))
+		}
+	}
+}
+
+// TestCORSWildcardCredentials checks that origins allowed only by "*" are
+// never allowed credentials.
+func TestCORSWildcardCredentials(t *testing.T) {
+	c := NewCORS([]string{"*", "https://app.example"}, nil, nil, nil, true, 0)
+	h := corsServe(c, http.MethodGet, "https://evil.example", nil).Header()
+	if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Allow-Origin %q, want *", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Allow-Credentials %q for an unlisted origin", got)
+	}
+	h = corsServe(c, http.MethodGet, "https://app.example", nil).Header()
+	if h.Get("Access-Control-Allow-Origin") != "https://app.example" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("listed origin got %v", h)
+	}
+
+	if _, err := buildCORS(&config.CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Error(`allow_credentials with "*" was accepted`)
+	}
+}
+
+func TestNewCORSKeepsMethods(t *testing.T) {
+	methods := []string{"get", "put"}
+	c := NewCORS([]string{"*"}, methods, nil, nil, false, 0)
+	if !slices.Equal(methods, []string{"get", "put"}) {
+		t.Errorf("caller's methods changed to %v", methods)
+	}
+	if !slices.Equal(c.Methods, []string{"GET", "PUT"}) {
+		t.Errorf("Methods %v", c.Methods)
+	}
+}
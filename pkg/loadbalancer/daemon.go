@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// envDaemon marks a process started in the background by Daemonize, so that
+// it, and the processes it upgrades to, do not detach again.
+const envDaemon = "LB_DAEMON"
+
+// Daemonize starts this executable again with the same arguments, detached
+// from the terminal in a session of its own, and waits until it serves. Its
+// standard output and error go to logFile, or are discarded if logFile is
+// empty. Daemonize returns false in the detached process, which should go
+// on starting up; the calling process should exit.
+func Daemonize(logFile string) (bool, error) {
+	if os.Getenv(envDaemon) != "" {
+		return false, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return true, err
+	}
+	out, err := openLog(cmp.Or(logFile, os.DevNull))
+	if err != nil {
+		return true, err
+	}
+	defer out.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(), envDaemon+"=1")
+	if err := detach(cmd); err != nil {
+		return true, err
+	}
+	pid, err := startReady(cmd, DefaultUpgrader.Timeout)
+	if err != nil {
+		return true, err
+	}
+	logf("Started in the background as process %d", pid)
+	return true, nil
+}
+
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// LogFile is a log output appending to a file, which Reopen reopens after
+// the file was rotated.
+type LogFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenLogFile opens the file at path for appending, creating it if needed.
+func OpenLogFile(path string) (*LogFile, error) {
+	f, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{path: path, f: f}, nil
+}
+
+// Write implements io.Writer.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes the file and opens the file now at its path. If that fails,
+// logging goes on to the old file.
+func (l *LogFile) Reopen() error {
+	f, err := openLog(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+// PIDFile holds the process ID of the running load balancer, for init
+// scripts and runbooks to signal it.
+type PIDFile struct {
+	path string
+}
+
+// CreatePIDFile checks that no other process holds the PID file at path; it
+// is written by Write once the process serves. The process an upgrade starts
+// takes the file over from the old one.
+func CreatePIDFile(path string) (*PIDFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if !DefaultUpgrader.Upgraded() {
+		if pid, err := readPID(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("already running as process %d (pid file %s)", pid, path)
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return &PIDFile{path: path}, nil
+}
+
+// Write writes the ID of this process to the file, atomically so a reader
+// never sees a partial one.
+func (p *PIDFile) Write() error {
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// Remove removes the file unless another process, such as the one this
+// process upgraded to, has taken it over.
+func (p *PIDFile) Remove() error {
+	if pid, err := readPID(p.path); err != nil || pid != os.Getpid() {
+		return err
+	}
+	return os.Remove(p.path)
+}
+
+// readPID returns the process ID in the file at path. A malformed file is
+// treated as a stale one.
+func readPID(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return 0, nil
+	}
+	return pid, nil
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package loadbalancer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// detach fails: running in the background is only supported on Unix
+// systems.
+func detach(*exec.Cmd) error {
+	return fmt.Errorf("running in the background is not supported on %s", runtime.GOOS)
+}
+
+// processAlive reports whether a process with the given ID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
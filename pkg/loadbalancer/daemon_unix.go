@@ -0,0 +1,24 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// detach makes cmd start in a session of its own, away from the terminal.
+func detach(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return nil
+}
+
+// processAlive reports whether a process with the given ID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,451 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+var (
+	datacenterLatency = metrics.NewGaugeVec("lb_datacenter_latency_milliseconds",
+		"Smoothed latency of connecting to the servers of a data center, from the fastest of them.", "pool", "datacenter")
+	datacenterWeight = metrics.NewGaugeVec("lb_datacenter_weight",
+		"Weight of a data center in the routing of the requests of its pool, manual or derived from its latency.", "pool", "datacenter")
+)
+
+const (
+	defaultDatacenterInterval = 5 * time.Second
+	defaultDatacenterTimeout  = 2 * time.Second
+	// maxDatacenterWeight is the weight derived for the fastest data
+	// center.
+	maxDatacenterWeight = 100
+	// datacenterSmoothing is the weight of the latest probe in the smoothed
+	// latency of a data center.
+	datacenterSmoothing = 0.3
+)
+
+// Datacenters routes the requests of a pool whose servers run in several
+// data centers: each request goes to a data center first, then to one of
+// its servers as the strategy of the pool picks it, among its lowest tier
+// with an available server. Every Interval, the latency to each data center
+// is probed by connecting to its live servers within Timeout, averaged over
+// the recent probes; data centers none of whose servers could be connected
+// to are unhealthy and receive no requests while a healthy one can take
+// them. The others share the requests by weight: either set with SetWeight
+// or in the configuration, or else derived from their latency, 100 for the fastest and less for the
+// others as the square of how much slower they are, so that one twice as
+// slow gets a quarter of its share. Data centers are named after their
+// servers; those given none form the data center "".
+type Datacenters struct {
+	Interval time.Duration
+	Timeout  time.Duration
+
+	pool string
+
+	mu sync.Mutex
+	// of maps the addresses of the servers to their data centers.
+	of    map[string]string
+	sites map[string]*datacenter
+
+	// routing caches the servers of each data center and their weights,
+	// for the members of the pool it was built from; it is rebuilt when they
+	// change or a probe or weight did.
+	routing atomic.Pointer[dcRouting]
+}
+
+// datacenter is what a Datacenters knows of a data center. Its fields are
+// guarded by the mutex of the Datacenters.
+type datacenter struct {
+	latency time.Duration
+	probed  bool
+	healthy bool
+	err     string
+	// configured is the weight of the configuration, and override the
+	// one set with SetWeight, which takes precedence; nil if unset.
+	configured *int
+	override   *int
+}
+
+// dcRouting is a snapshot of the routing of a Datacenters.
+type dcRouting struct {
+	members *poolMembers
+	names   []string
+	sites   []*poolMembers
+	weights []int
+	healthy []bool
+}
+
+// DatacenterStatus is the state of a data center of a pool.
+type DatacenterStatus struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"`
+	Healthy bool     `json:"healthy"`
+	// Latency is the smoothed latency of connecting to the fastest live
+	// server of the data center, in milliseconds; zero before it was
+	// probed.
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+	// Weight is the weight the data center routes with: Override if set,
+	// or else that of the configuration, or else the weight derived from
+	// its latency.
+	Weight   int  `json:"weight"`
+	Override *int `json:"override,omitempty"`
+}
+
+// NewDatacenters creates the data center routing of the pool named pool,
+// probing every 5s with a timeout of 2s.
+func NewDatacenters(pool string) *Datacenters {
+	return &Datacenters{
+		Interval: defaultDatacenterInterval,
+		Timeout:  defaultDatacenterTimeout,
+		pool:     pool,
+		of:       map[string]string{},
+		sites:    map[string]*datacenter{},
+	}
+}
+
+// Assign places the server at addr in the data center name.
+func (d *Datacenters) Assign(addr, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.of[addr] = name
+	d.site(name)
+	d.changed()
+}
+
+// site returns the data center named name, adding it if needed. Its caller
+// holds mu.
+func (d *Datacenters) site(name string) *datacenter {
+	dc, ok := d.sites[name]
+	if !ok {
+		dc = &datacenter{healthy: true}
+		d.sites[name] = dc
+	}
+	return dc
+}
+
+// changed invalidates the routing snapshot. Its caller holds mu.
+func (d *Datacenters) changed() {
+	d.routing.Store(nil)
+}
+
+// SetWeight overrides the weight of the data center name, 0 sending it
+// requests only when no other healthy one can take them; a nil weight
+// restores the configured one, or else the one derived from its latency. It
+// reports whether the data center exists.
+func (d *Datacenters) SetWeight(name string, weight *int) bool {
+	return d.setWeight(name, weight, false)
+}
+
+// setWeight sets the configured weight of the data center name, or its
+// override, as SetWeight does.
+func (d *Datacenters) setWeight(name string, weight *int, configured bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dc, ok := d.sites[name]
+	if !ok {
+		return false
+	}
+	if weight != nil {
+		w := *weight
+		weight = &w
+	}
+	if configured {
+		dc.configured = weight
+	} else {
+		dc.override = weight
+	}
+	d.changed()
+	return true
+}
+
+// Overrides returns the weights set with SetWeight, by data center.
+func (d *Datacenters) Overrides() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out map[string]int
+	for name, dc := range d.sites {
+		if dc.override != nil {
+			if out == nil {
+				out = map[string]int{}
+			}
+			out[name] = *dc.override
+		}
+	}
+	return out
+}
+
+// weights returns the weights of the data centers, by name. Its caller
+// holds mu.
+func (d *Datacenters) weights() map[string]int {
+	var fastest time.Duration
+	for _, dc := range d.sites {
+		if dc.probed && dc.healthy && (fastest == 0 || dc.latency < fastest) {
+			fastest = dc.latency
+		}
+	}
+	out := make(map[string]int, len(d.sites))
+	for name, dc := range d.sites {
+		switch {
+		case dc.override != nil:
+			out[name] = *dc.override
+		case dc.configured != nil:
+			out[name] = *dc.configured
+		case !dc.probed || fastest == 0 || dc.latency <= 0:
+			out[name] = maxDatacenterWeight
+		default:
+			ratio := float64(fastest) / float64(dc.latency)
+			out[name] = max(int(math.Round(maxDatacenterWeight*ratio*ratio)), 1)
+		}
+	}
+	return out
+}
+
+// route returns the routing snapshot for the members m of the pool.
+func (d *Datacenters) route(m *poolMembers) *dcRouting {
+	if r := d.routing.Load(); r != nil && r.members == m {
+		return r
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	groups := map[string][]backend.Server{}
+	for _, s := range m.servers {
+		name := d.of[s.Address()]
+		d.site(name)
+		groups[name] = append(groups[name], s)
+	}
+	weights := d.weights()
+	r := &dcRouting{members: m}
+	for name := range groups {
+		r.names = append(r.names, name)
+	}
+	slices.Sort(r.names)
+	for _, name := range r.names {
+		r.sites = append(r.sites, newPoolMembers(groups[name]))
+		r.weights = append(r.weights, weights[name])
+		r.healthy = append(r.healthy, d.sites[name].healthy)
+	}
+	d.routing.Store(r)
+	return r
+}
+
+// pick returns the members of the data center the next request of the
+// pool with members m goes to, or nil if none has an available server.
+func (d *Datacenters) pick(m *poolMembers) *poolMembers {
+	r := d.route(m)
+	eligible := r.eligible()
+	total := 0
+	for _, i := range eligible {
+		total += max(r.weights[i], 1)
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.IntN(total)
+	for _, i := range eligible {
+		if n -= max(r.weights[i], 1); n < 0 {
+			return r.sites[i]
+		}
+	}
+	return nil
+}
+
+// eligible returns the indexes of the data centers requests may go to:
+// those with an available server that are healthy and have a weight, or
+// else that are healthy, or else all of them.
+func (r *dcRouting) eligible() []int {
+	for _, ok := range []func(i int) bool{
+		func(i int) bool { return r.healthy[i] && r.weights[i] > 0 },
+		func(i int) bool { return r.healthy[i] },
+		func(int) bool { return true },
+	} {
+		var out []int
+		for i, site := range r.sites {
+			if ok(i) && slices.ContainsFunc(site.servers, backend.Available) {
+				out = append(out, i)
+			}
+		}
+		if len(out) > 0 {
+			return out
+		}
+	}
+	return nil
+}
+
+// explain returns the data centers the next request of the pool with
+// members m may go to, and the servers of theirs the strategy of the pool
+// may pick.
+func (d *Datacenters) explain(m *poolMembers) (names []string, servers []backend.Server) {
+	r := d.route(m)
+	for _, i := range r.eligible() {
+		names = append(names, r.names[i])
+		servers = append(servers, r.sites[i].candidates()...)
+	}
+	return names, servers
+}
+
+// Status returns the state of the data centers of the pool with the
+// servers servers, sorted by name.
+func (d *Datacenters) Status(servers []backend.Server) []DatacenterStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	weights := d.weights()
+	byName := map[string]*DatacenterStatus{}
+	for name, dc := range d.sites {
+		st := &DatacenterStatus{Name: name, Servers: []string{}, Healthy: dc.healthy, Error: dc.err, Weight: weights[name], Override: dc.override}
+		if dc.probed {
+			st.Latency = float64(dc.latency.Microseconds()) / 1000
+		}
+		byName[name] = st
+	}
+	for _, s := range servers {
+		if st, ok := byName[d.of[s.Address()]]; ok {
+			st.Servers = append(st.Servers, s.Address())
+		}
+	}
+	out := make([]DatacenterStatus, 0, len(byName))
+	for _, st := range byName {
+		if len(st.Servers) > 0 || st.Override != nil {
+			out = append(out, *st)
+		}
+	}
+	slices.SortFunc(out, func(a, b DatacenterStatus) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
+
+// probe measures the latency to each data center of the servers servers,
+// connecting to their live servers at once.
+func (d *Datacenters) probe(parent context.Context, servers []backend.Server) {
+	ctx, cancel := context.WithTimeout(parent, d.Timeout)
+	defer cancel()
+	d.mu.Lock()
+	of := make(map[backend.Server]string, len(servers))
+	for _, s := range servers {
+		of[s] = d.of[s.Address()]
+	}
+	d.mu.Unlock()
+	type sample struct {
+		site    string
+		latency time.Duration
+		err     error
+	}
+	samples := make(chan sample, len(servers))
+	probed := 0
+	for _, s := range servers {
+		if !s.IsAlive() {
+			continue
+		}
+		probed++
+		go func() {
+			var dialer net.Dialer
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", dialAddr(s.Address()))
+			if err == nil {
+				conn.Close()
+			}
+			samples <- sample{of[s], time.Since(start), err}
+		}()
+	}
+	best := map[string]time.Duration{}
+	errs := map[string]error{}
+	for range probed {
+		sm := <-samples
+		if sm.err != nil {
+			errs[sm.site] = sm.err
+			continue
+		}
+		if l, ok := best[sm.site]; !ok || sm.latency < l {
+			best[sm.site] = sm.latency
+		}
+	}
+	if parent.Err() != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sites := map[string]bool{}
+	for _, site := range of {
+		sites[site] = true
+	}
+	for name := range sites {
+		dc := d.site(name)
+		l, ok := best[name]
+		switch {
+		case ok:
+			if dc.probed {
+				l = time.Duration(datacenterSmoothing*float64(l) + (1-datacenterSmoothing)*float64(dc.latency))
+			}
+			dc.latency, dc.probed, dc.healthy, dc.err = l, true, true, ""
+			datacenterLatency.Set(l.Milliseconds(), d.pool, name)
+		case errs[name] != nil:
+			dc.healthy, dc.err = false, errs[name].Error()
+		default:
+			// No live server to probe: the health checks keep the data
+			// center out of the routing.
+			dc.healthy, dc.err = false, "no live server"
+		}
+	}
+	for name, w := range d.weights() {
+		datacenterWeight.Set(int64(w), d.pool, name)
+	}
+	d.changed()
+}
+
+// dialAddr returns the host:port to connect to for the server at addr,
+// defaulting the port of URLs by scheme.
+func dialAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "grpcs" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// SetDatacenters routes the requests of the pool by data center; nil
+// routes them over all of its servers.
+func (p *Pool) SetDatacenters(d *Datacenters) {
+	p.datacenters = d
+}
+
+// Datacenters returns the data center routing of the pool, or nil.
+func (p *Pool) Datacenters() *Datacenters {
+	return p.datacenters
+}
+
+// StartDatacenterProbes probes the latency to the data centers of the pool
+// in the background, if it routes by data center, until it is closed.
+func (p *Pool) StartDatacenterProbes() {
+	d := p.datacenters
+	if d == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			d.probe(p.ctx, p.Servers())
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
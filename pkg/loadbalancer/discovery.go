@@ -0,0 +1,254 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+const defaultDiscoveryInterval = 30 * time.Second
+
+var poolServers = metrics.NewGaugeVec("lb_pool_servers",
+	"Servers currently in a pool, including discovered ones.", "pool")
+
+// Target is a server found by a Discoverer.
+type Target struct {
+	// Addr is the server address, in the form the pool's servers use.
+	Addr string
+	// ServerName, if set, is the name to verify the server's TLS
+	// certificate against when Addr carries an IP address.
+	ServerName string
+	// Weight, if positive, and Tier override the weight and tier of the
+	// server.
+	Weight int
+	Tier   int
+}
+
+// Discoverer finds the current servers of a pool in some external source.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]Target, error)
+}
+
+// Watcher is implemented by discoverers that learn about changes as they
+// happen. Watch blocks until the targets change or ctx is done and returns
+// the new targets. Watchers are discovered once on start and then watched
+// instead of being polled.
+type Watcher interface {
+	Watch(ctx context.Context) ([]Target, error)
+}
+
+// DiscovererFactory creates a discoverer from its JSON configuration, which
+// is empty if none is given.
+type DiscovererFactory func(config json.RawMessage) (Discoverer, error)
+
+var (
+	discoverersMu sync.RWMutex
+	discoverers   = map[string]DiscovererFactory{}
+)
+
+// RegisterDiscoverer makes a discoverer available under name to
+// NewDiscoverer and the discovery plugins of pools, usually from an init
+// function. It panics if name is empty or already registered.
+func RegisterDiscoverer(name string, factory DiscovererFactory) {
+	discoverersMu.Lock()
+	defer discoverersMu.Unlock()
+	if name == "" || factory == nil {
+		panic("RegisterDiscoverer with an empty name or nil factory")
+	}
+	if _, dup := discoverers[name]; dup {
+		panic("discoverer " + name + " registered twice")
+	}
+	discoverers[name] = factory
+}
+
+// DiscovererNames returns the names of the registered discoverers, sorted.
+func DiscovererNames() []string {
+	discoverersMu.RLock()
+	defer discoverersMu.RUnlock()
+	return slices.Sorted(maps.Keys(discoverers))
+}
+
+// NewDiscoverer returns the discoverer registered under name, configured
+// with config.
+func NewDiscoverer(name string, config json.RawMessage) (Discoverer, error) {
+	discoverersMu.RLock()
+	factory := discoverers[name]
+	discoverersMu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown discoverer %q", name)
+	}
+	return factory(config)
+}
+
+// Discovery keeps a pool's servers in sync with its discoverers: every
+// Interval the targets are rediscovered and the pool's servers become the
+// static servers plus one server per target. Servers whose address is still
+// discovered are kept, with their health state, and take the target's weight
+// and tier. If a discoverer fails, its previous targets are kept.
+type Discovery struct {
+	Interval time.Duration
+
+	static []backend.Server
+	// mu serializes updates of the sources' targets and the pool's servers.
+	mu      sync.Mutex
+	sources []*discoverySource
+}
+
+type discoverySource struct {
+	discoverer Discoverer
+	build      func(Target) (backend.Server, error)
+	targets    []Target
+}
+
+// NewDiscovery creates a Discovery keeping the static servers in the pool.
+// A zero interval means 30 seconds.
+func NewDiscovery(interval time.Duration, static []backend.Server) *Discovery {
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	return &Discovery{Interval: interval, static: static}
+}
+
+// Add adds a discoverer whose targets are turned into servers by build.
+func (d *Discovery) Add(disc Discoverer, build func(Target) (backend.Server, error)) {
+	d.sources = append(d.sources, &discoverySource{discoverer: disc, build: build})
+}
+
+// SetDiscovery makes the pool's servers follow d, started by StartDiscovery.
+func (p *Pool) SetDiscovery(d *Discovery) {
+	p.discovery = d
+}
+
+// StartDiscovery discovers the pool's servers once and then keeps
+// refreshing them in the background. It does nothing without a Discovery.
+func (p *Pool) StartDiscovery() {
+	d := p.discovery
+	if d == nil {
+		return
+	}
+	p.refresh(d, true)
+	for _, src := range d.sources {
+		if w, ok := src.discoverer.(Watcher); ok {
+			go p.watch(p.ctx, d, src, w)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.refresh(d, false)
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// refresh rediscovers the pool's targets and updates its servers. Watched
+// sources are only discovered if all is set.
+func (p *Pool) refresh(d *Discovery, all bool) {
+	ctx, cancel := context.WithTimeout(p.ctx, d.Interval)
+	defer cancel()
+	polled := false
+	for _, src := range d.sources {
+		if _, ok := src.discoverer.(Watcher); ok && !all {
+			continue
+		}
+		polled = true
+		targets, err := src.discoverer.Discover(ctx)
+		if p.ctx.Err() != nil {
+			// The pool was closed.
+			return
+		}
+		d.mu.Lock()
+		if err != nil {
+			p.logf("discovery failed, keeping %d servers: %v", len(src.targets), err)
+		} else {
+			src.targets = targets
+		}
+		d.mu.Unlock()
+	}
+	if polled {
+		p.update(d)
+	}
+}
+
+// watch follows the changes of a watched source, retrying every Interval
+// after failures, until ctx is done.
+func (p *Pool) watch(ctx context.Context, d *Discovery, src *discoverySource, w Watcher) {
+	for {
+		targets, err := w.Watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logf("discovery watch failed: %v", err)
+			select {
+			case <-time.After(d.Interval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		d.mu.Lock()
+		src.targets = targets
+		d.mu.Unlock()
+		p.update(d)
+	}
+}
+
+// update sets the pool's servers to the static servers plus the targets of
+// all sources.
+func (p *Pool) update(d *Discovery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old := p.Servers()
+	existing := make(map[string]backend.Server, len(old))
+	for _, s := range old {
+		existing[s.Address()] = s
+	}
+	servers := slices.Clone(d.static)
+	seen := map[string]bool{}
+	for _, s := range servers {
+		seen[s.Address()] = true
+	}
+	for _, src := range d.sources {
+		for _, t := range src.targets {
+			if seen[t.Addr] {
+				continue
+			}
+			seen[t.Addr] = true
+			s, ok := existing[t.Addr]
+			if !ok {
+				var err error
+				if s, err = src.build(t); err != nil {
+					p.logf("discovered server %q: %v", t.Addr, err)
+					continue
+				}
+				p.logf("server %q added", t.Addr)
+				emit(BackendAdded{Time: time.Now(), Pool: p.Name, Server: s})
+			} else if w, ok := s.(backend.WeightSetter); ok && t.Weight > 0 {
+				w.SetWeight(t.Weight)
+				w.SetTier(t.Tier)
+			}
+			servers = append(servers, s)
+		}
+	}
+	for addr, s := range existing {
+		if !seen[addr] {
+			p.logf("server %q removed", addr)
+			emit(BackendRemoved{Time: time.Now(), Pool: p.Name, Server: s})
+		}
+	}
+	p.SetServers(servers)
+	poolServers.Set(int64(len(servers)), p.Name)
+}
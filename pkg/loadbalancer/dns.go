@@ -0,0 +1,97 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// DNSDiscoverer resolves the hostname of a server address and yields one
+// target per A and AAAA record, so that services scaled through DNS, such
+// as headless Kubernetes services, are balanced per instance.
+type DNSDiscoverer struct {
+	// Addr is the server address with a hostname, as written in the pool.
+	Addr     string
+	Resolver *net.Resolver
+
+	host string
+	// format returns Addr with the host replaced.
+	format func(host string) string
+}
+
+// NewDNSDiscoverer creates a DNSDiscoverer for addr, an http(s) URL or a
+// host:port with an optional scheme.
+func NewDNSDiscoverer(addr string) (*DNSDiscoverer, error) {
+	host, format, err := splitAddrHost(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSDiscoverer{Addr: addr, Resolver: net.DefaultResolver, host: host, format: format}, nil
+}
+
+// Discover implements Discoverer.
+func (d *DNSDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	ips, err := d.Resolver.LookupNetIP(ctx, "ip", d.host)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(ips))
+	for _, ip := range ips {
+		targets = append(targets, Target{Addr: d.format(ip.Unmap().String()), ServerName: d.host})
+	}
+	return targets, nil
+}
+
+// isHostnameAddr reports whether the host of a server address is a name
+// rather than an IP address.
+func isHostnameAddr(addr string) bool {
+	if strings.HasPrefix(addr, "unix://") {
+		return false
+	}
+	host, _, err := splitAddrHost(addr)
+	if err != nil {
+		return false
+	}
+	_, err = netip.ParseAddr(host)
+	return err != nil
+}
+
+// splitAddrHost returns the host of a server address and a function
+// substituting it.
+func splitAddrHost(addr string) (string, func(string) string, error) {
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok && scheme != "tcp" && scheme != "udp" && scheme != "fastcgi" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "", nil, err
+		}
+		if u.Hostname() == "" {
+			return "", nil, fmt.Errorf("address %q has no host", addr)
+		}
+		port := u.Port()
+		return u.Hostname(), func(host string) string {
+			v := *u
+			if port != "" {
+				v.Host = net.JoinHostPort(host, port)
+			} else if strings.Contains(host, ":") {
+				v.Host = "[" + host + "]"
+			} else {
+				v.Host = host
+			}
+			return v.String()
+		}, nil
+	} else if ok {
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			return "", nil, err
+		}
+		return host, func(h string) string { return scheme + "://" + net.JoinHostPort(h, port) }, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	return host, func(h string) string { return net.JoinHostPort(h, port) }, nil
+}
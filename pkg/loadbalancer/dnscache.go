@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+// Defaults of the cache of backend hostname resolutions.
+const (
+	defaultDNSCacheTTL    = 30 * time.Second
+	defaultDNSNegativeTTL = time.Second
+	dnsLookupTimeout      = 10 * time.Second
+)
+
+var dnsLookups = metrics.NewCounterVec("lb_dns_lookups_total",
+	"Resolutions of backend hostnames for new connections, by result: hit, miss or error.", "result")
+
+// dnsCache caches the addresses backend hostnames resolve to, so that new
+// connections to backends named by hostname don't wait on the resolver.
+// Failed resolutions are cached for the shorter negative TTL, so that an
+// unresolvable backend is not looked up on every request either.
+// Concurrent dials of a host share one resolution.
+type dnsCache struct {
+	resolver    *net.Resolver
+	ttl, negTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// dnsEntry is the resolution of a host; addrs and err are set once ready
+// is closed.
+type dnsEntry struct {
+	ready   chan struct{}
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(ttl, negTTL time.Duration) *dnsCache {
+	return &dnsCache{resolver: net.DefaultResolver, ttl: ttl, negTTL: negTTL, entries: map[string]*dnsEntry{}}
+}
+
+// lookup returns the resolution of host, resolving it if it is not cached.
+func (c *dnsCache) lookup(ctx context.Context, host string) (*dnsEntry, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil && isClosed(e.ready) && !now.Before(e.expires) {
+		e = nil
+	}
+	hit := e != nil
+	if e == nil {
+		for h, old := range c.entries {
+			// Hosts no longer dialed would stay forever otherwise.
+			if isClosed(old.ready) && !now.Before(old.expires) {
+				delete(c.entries, h)
+			}
+		}
+		e = &dnsEntry{ready: make(chan struct{})}
+		c.entries[host] = e
+		// The resolution outlives the dial that started it, for the dials
+		// waiting on it.
+		go c.resolve(host, e)
+	}
+	c.mu.Unlock()
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	switch {
+	case e.err != nil:
+		dnsLookups.Inc("error")
+	case hit:
+		dnsLookups.Inc("hit")
+	default:
+		dnsLookups.Inc("miss")
+	}
+	return e, e.err
+}
+
+func (c *dnsCache) resolve(host string, e *dnsEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	e.addrs, e.err = c.resolver.LookupNetIP(ctx, "ip", host)
+	ttl := c.ttl
+	if e.err == nil && len(e.addrs) == 0 {
+		e.err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if e.err != nil {
+		ttl = c.negTTL
+	}
+	c.mu.Lock()
+	e.expires = time.Now().Add(ttl)
+	c.mu.Unlock()
+	close(e.ready)
+}
+
+// forget drops the resolution e of host, once none of its addresses could
+// be dialed, so that the next dial resolves host again.
+func (c *dnsCache) forget(host string, e *dnsEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[host] == e {
+		delete(c.entries, host)
+	}
+}
+
+// dialContext returns a DialContext dialing through d to the cached
+// addresses of hostnames, trying them in turn.
+func (c *dnsCache) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		e, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		var firstErr error
+		for _, ip := range e.addrs {
+			if (network == "tcp4" && !ip.Unmap().Is4()) || (network == "tcp6" && ip.Unmap().Is4()) {
+				continue
+			}
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				return nil, firstErr
+			}
+		}
+		if firstErr == nil {
+			firstErr = &net.OpError{Op: "dial", Net: network, Err: errors.New("no suitable address found for " + host)}
+		}
+		c.forget(host, e)
+		return nil, firstErr
+	}
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
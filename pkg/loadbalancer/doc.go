@@ -0,0 +1,40 @@
+// Package loadbalancer is an HTTP, gRPC and layer-4 load balancer usable as
+// a library. A LoadBalancer is an http.Handler balancing requests over the
+// servers of its pools; NewLoadBalancer configures one in code, Build from a
+// config.Config, and a Service runs one with its listeners, admin API and
+// reloads as the lb command does.
+//
+// # Compatibility
+//
+// The module github.com/javvaji888/golang-load-balancer follows semantic
+// versioning. Its public API is that of the packages under pkg/ and of
+// adminclient, together with the JSON configuration file, the admin API
+// described by its OpenAPI document and the names of the exported metrics.
+// Within a major version, releases only add to it: code compiling against a
+// release keeps compiling and behaving as documented against later ones, and
+// configuration files keep their meaning. Incompatible changes are made in a
+// new major version under a new module path, such as
+// github.com/javvaji888/golang-load-balancer/v2.
+//
+// The packages under internal/ and the commands under cmd/ are not part of
+// the API and change as needed, as do unexported identifiers and what the
+// documentation leaves unspecified, such as log messages.
+//
+// # Deprecation
+//
+// Identifiers and configuration settings due to be replaced are marked with
+// a "Deprecated:" paragraph naming the replacement, in the release adding
+// it. They keep working until the next major version, the earliest they can
+// be removed in.
+//
+// # Build tags
+//
+// Features needing a dependency outside the standard library are built in
+// with a build tag; builds without it report them as not supported:
+//
+//   - brotli: the "br" encoding of response compression, with
+//     github.com/andybalholm/brotli.
+//   - quic: the HTTP/3 listener, with github.com/quic-go/quic-go.
+//   - bcrypt: bcrypt password hashes in basic auth files, with
+//     golang.org/x/crypto/bcrypt.
+package loadbalancer
@@ -0,0 +1,205 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerDiscoverer yields the running containers of the local Docker daemon
+// that are labeled for a pool. A container joins pool web when labeled
+// "<prefix>.pool=web"; "<prefix>.port" gives the port it serves on, and
+// "<prefix>.weight" and "<prefix>.tier" optionally its weight and tier.
+//
+// Containers are reached on their IP address in Network, or in their only
+// network if Network is empty. DockerDiscoverer is a Watcher: it follows the
+// daemon's container events, so containers are added as they start and
+// removed as they stop.
+type DockerDiscoverer struct {
+	Pool        string
+	LabelPrefix string
+	Network     string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+
+	api *dockerAPI
+}
+
+// dockerAPI is a client of the Docker Engine API.
+type dockerAPI struct {
+	url    string
+	client *http.Client
+}
+
+// newDockerAPI creates a client of the daemon at host, a unix:// socket path
+// or a tcp:// address. An empty host defaults to $DOCKER_HOST or the local
+// daemon's socket.
+func newDockerAPI(host string) (*dockerAPI, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	api := &dockerAPI{}
+	transport := &http.Transport{}
+	switch scheme, rest, _ := strings.Cut(host, "://"); scheme {
+	case "unix":
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", rest)
+		}
+		api.url = "http://docker"
+	case "tcp", "http":
+		api.url = "http://" + rest
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+	api.client = &http.Client{Transport: transport}
+	return api, nil
+}
+
+// NewDockerDiscoverer creates a DockerDiscoverer for the containers of pool
+// for the daemon at host, as for the Docker CLI's DOCKER_HOST. An empty
+// label prefix defaults to "lb".
+func NewDockerDiscoverer(host, pool, labelPrefix string) (*DockerDiscoverer, error) {
+	api, err := newDockerAPI(host)
+	if err != nil {
+		return nil, err
+	}
+	if labelPrefix == "" {
+		labelPrefix = "lb"
+	}
+	return &DockerDiscoverer{Pool: pool, LabelPrefix: labelPrefix, api: api}, nil
+}
+
+// dockerContainer is the subset of an entry of /containers/json used.
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Discover implements Discoverer.
+func (d *DockerDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	body, err := d.api.get(ctx, "/containers/json", map[string][]string{
+		"label":  {d.LabelPrefix + ".pool=" + d.Pool},
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("docker: %w", err)
+	}
+	var targets []Target
+	for _, c := range containers {
+		t, err := d.target(c)
+		if err != nil {
+			logf("Docker container %.12s skipped: %v", c.ID, err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// target returns the target serving container c.
+func (d *DockerDiscoverer) target(c dockerContainer) (Target, error) {
+	label := func(name string) string { return c.Labels[d.LabelPrefix+"."+name] }
+	port := label("port")
+	if port == "" {
+		return Target{}, fmt.Errorf("no %s.port label", d.LabelPrefix)
+	}
+	var ip string
+	nets := c.NetworkSettings.Networks
+	if d.Network != "" {
+		ip = nets[d.Network].IPAddress
+	} else if len(nets) == 1 {
+		for _, n := range nets {
+			ip = n.IPAddress
+		}
+	}
+	if ip == "" {
+		return Target{}, fmt.Errorf("no address in network %q", d.Network)
+	}
+	addr := net.JoinHostPort(ip, port)
+	if d.Scheme != "" {
+		addr = d.Scheme + "://" + addr
+	}
+	t := Target{Addr: addr}
+	if w := label("weight"); w != "" {
+		weight, err := strconv.Atoi(w)
+		if err != nil || weight < 1 {
+			return Target{}, fmt.Errorf("invalid %s.weight %q", d.LabelPrefix, w)
+		}
+		t.Weight = weight
+		if tier := label("tier"); tier != "" {
+			if t.Tier, err = strconv.Atoi(tier); err != nil {
+				return Target{}, fmt.Errorf("invalid %s.tier %q", d.LabelPrefix, tier)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Watch implements Watcher.
+func (d *DockerDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body, err := d.api.get(ctx, "/events", map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "stop", "pause", "unpause", "destroy"},
+		"label": {d.LabelPrefix + ".pool=" + d.Pool},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	var event json.RawMessage
+	if err := dec.Decode(&event); err != nil {
+		return nil, fmt.Errorf("docker events: %w", err)
+	}
+	return d.Discover(ctx)
+}
+
+// get sends a GET request with filters to the API and returns the response
+// body.
+func (api *dockerAPI) get(ctx context.Context, path string, filters map[string][]string) (io.ReadCloser, error) {
+	f, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	u := api.url + path + "?filters=" + url.QueryEscape(string(f))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
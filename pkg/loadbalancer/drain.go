@@ -0,0 +1,56 @@
+package loadbalancer
+
+import "sync/atomic"
+
+// adminState holds the operator-controlled state of a server.
+type adminState struct {
+	disabled atomic.Bool
+	draining atomic.Bool
+	// drainSticky lets clients pinned to a draining server keep using it.
+	drainSticky atomic.Bool
+
+	// windows are the maintenance windows of the server; inWindow is set
+	// while one is open and windowDrain while the server is drained by it.
+	windows     []*Schedule
+	inWindow    atomic.Bool
+	windowDrain atomic.Bool
+}
+
+// Draining reports whether the server is being drained.
+func (a *adminState) Draining() bool {
+	return a.draining.Load()
+}
+
+// DrainSticky reports whether pinned clients may keep using the server
+// while it is drained.
+func (a *adminState) DrainSticky() bool {
+	return a.drainSticky.Load()
+}
+
+// Drain stops new requests from being sent to the server while the requests
+// in flight complete. With sticky set, clients pinned to the server by
+// session affinity keep using it until their pins expire.
+func (a *adminState) Drain(sticky bool) {
+	a.windowDrain.Store(false)
+	a.drainSticky.Store(sticky)
+	a.draining.Store(true)
+}
+
+// Undrain returns a drained server to service.
+func (a *adminState) Undrain() {
+	a.windowDrain.Store(false)
+	a.draining.Store(false)
+}
+
+// Disabled reports whether the server was taken out of service.
+func (a *adminState) Disabled() bool {
+	return a.disabled.Load()
+}
+
+// SetDisabled takes the server out of service, or returns it. Unlike a
+// failed health check, disabling also ends sticky sessions, and it is only
+// undone by the operator: health checks keep probing the server but do not
+// return it to service.
+func (a *adminState) SetDisabled(disabled bool) {
+	a.disabled.Store(disabled)
+}
@@ -0,0 +1,271 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ec2APIVersion = "2016-11-15"
+	imdsAddr      = "http://169.254.169.254"
+)
+
+// EC2Discoverer yields the running EC2 instances matching tag filters in a
+// set of regions, addressed by their private IP and a fixed port.
+//
+// Credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN or, if those are not set, from the instance profile of
+// the EC2 instance the LB runs on.
+type EC2Discoverer struct {
+	Regions []string
+	// Tags maps tag keys to the accepted values; an empty value accepts
+	// any instance carrying the tag.
+	Tags map[string]string
+	Port int
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+	// Endpoint, if set, replaces https://ec2.<region>.amazonaws.com, as for
+	// API-compatible services.
+	Endpoint string
+	Client   *http.Client
+
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// NewEC2Discoverer creates an EC2Discoverer for the instances on port.
+func NewEC2Discoverer(regions []string, tags map[string]string, port int) (*EC2Discoverer, error) {
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("ec2 regions must not be empty")
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("ec2 tags must not be empty")
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid ec2 port %d", port)
+	}
+	return &EC2Discoverer{Regions: regions, Tags: tags, Port: port, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// ec2Response is the subset of a DescribeInstances response used.
+type ec2Response struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// Discover implements Discoverer.
+func (e *EC2Discoverer) Discover(ctx context.Context) ([]Target, error) {
+	creds, err := e.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ec2 credentials: %w", err)
+	}
+	var targets []Target
+	for _, region := range e.Regions {
+		for token := ""; ; {
+			resp, err := e.describe(ctx, creds, region, token)
+			if err != nil {
+				return nil, fmt.Errorf("ec2 %s: %w", region, err)
+			}
+			for _, r := range resp.Reservations {
+				for _, inst := range r.Instances {
+					if inst.PrivateIP == "" {
+						continue
+					}
+					addr := net.JoinHostPort(inst.PrivateIP, strconv.Itoa(e.Port))
+					if e.Scheme != "" {
+						addr = e.Scheme + "://" + addr
+					}
+					targets = append(targets, Target{Addr: addr})
+				}
+			}
+			if token = resp.NextToken; token == "" {
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+func (e *EC2Discoverer) describe(ctx context.Context, creds awsCredentials, region, token string) (*ec2Response, error) {
+	q := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {ec2APIVersion},
+		"Filter.1.Name":    {"instance-state-name"},
+		"Filter.1.Value.1": {"running"},
+	}
+	keys := make([]string, 0, len(e.Tags))
+	for k := range e.Tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for i, k := range keys {
+		n := strconv.Itoa(i + 2)
+		if v := e.Tags[k]; v != "" {
+			q.Set("Filter."+n+".Name", "tag:"+k)
+			q.Set("Filter."+n+".Value.1", v)
+		} else {
+			q.Set("Filter."+n+".Name", "tag-key")
+			q.Set("Filter."+n+".Value.1", k)
+		}
+	}
+	if token != "" {
+		q.Set("NextToken", token)
+	}
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = "https://ec2." + region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/?"+awsQuery(q), nil)
+	if err != nil {
+		return nil, err
+	}
+	signAWSv4(req, creds, region, "ec2", time.Now())
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out ec2Response
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// credentials returns the AWS credentials from the environment or the
+// instance profile, caching the latter until shortly before they expire.
+func (e *EC2Discoverer) credentials(ctx context.Context) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.creds.AccessKeyID != "" && time.Until(e.creds.Expiration) > 5*time.Minute {
+		return e.creds, nil
+	}
+	token, err := e.imds(ctx, http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, err := e.imds(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	body, err := e.imds(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	e.creds = creds
+	return creds, nil
+}
+
+// imds sends an IMDSv2 request to the instance metadata service.
+func (e *EC2Discoverer) imds(ctx context.Context, method, path, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, imdsAddr+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	} else {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata %s: %s", path, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return string(b), err
+}
+
+// awsQuery encodes q sorted by key with AWS's URI encoding.
+func awsQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// signAWSv4 signs req, whose query is encoded by awsQuery and which has no
+// body, with AWS Signature Version 4.
+func signAWSv4(req *http.Request, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := "host:" + req.URL.Host + "\nx-amz-date:" + amzDate + "\n"
+	signed := "host;x-amz-date"
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+		headers += "x-amz-security-token:" + creds.Token + "\n"
+		signed += ";x-amz-security-token"
+	}
+	empty := sha256.Sum256(nil)
+	canonical := strings.Join([]string{
+		req.Method,
+		"/",
+		req.URL.RawQuery,
+		headers,
+		signed,
+		hex.EncodeToString(empty[:]),
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
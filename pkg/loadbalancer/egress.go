@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var egressDelayed = metrics.NewCounterVec("lb_egress_delayed_writes_total",
+	"Writes delayed by an egress bandwidth cap, by shaper.", "shaper")
+
+// Shaper caps the bytes per second sent by a listener's connections or in a
+// pool's responses to Rate overall, for links that are metered or slower
+// than the servers behind them. Burst is the bytes that may be sent at once
+// after a quiet while, a tenth of a second of the rate by default.
+//
+// Writes are sent in chunks of at most 16 KiB, each waiting for its turn in
+// the order asked, so that the connections or responses sending at once
+// share the rate evenly whatever the size of their writes.
+type Shaper struct {
+	Rate  int64
+	Burst int64
+	name  string
+
+	bucket bandwidthBucket
+}
+
+// NewShaper creates a Shaper of rate bytes per second, counted in the
+// metrics under name.
+func NewShaper(name string, rate, burst int64) (*Shaper, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("egress rate must be positive")
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("egress burst must not be negative")
+	}
+	return &Shaper{Rate: rate, Burst: burst, name: name}, nil
+}
+
+func (s *Shaper) burst() int64 {
+	if s.Burst > 0 {
+		return s.Burst
+	}
+	return max(s.Rate/10, 1)
+}
+
+// write writes p with write in chunks, each once the rate allows, until
+// done is closed.
+func (s *Shaper) write(p []byte, done <-chan struct{}, write func([]byte) (int, error)) (int, error) {
+	written := 0
+	size := int(min(s.burst(), bandwidthChunk))
+	for len(p) > 0 {
+		n := min(len(p), size)
+		if d := s.bucket.take(n, s.Rate, s.burst(), time.Now()); d > 0 {
+			egressDelayed.Inc(s.name)
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-done:
+				t.Stop()
+				return written, errShaperDone
+			}
+		}
+		n, err := write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+var errShaperDone = errors.New("connection closed while waiting for egress bandwidth")
+
+// Listen wraps ln so that what its connections send shares the rate.
+func (s *Shaper) Listen(ln net.Listener) net.Listener {
+	return &shaperListener{Listener: ln, shaper: s}
+}
+
+// Conn wraps conn so that what it sends shares the rate.
+func (s *Shaper) Conn(conn net.Conn) net.Conn {
+	return &shapedConn{Conn: conn, shaper: s, closed: make(chan struct{})}
+}
+
+// writer wraps rw, the response to r, so that its body shares the rate.
+func (s *Shaper) writer(rw http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	return &shapedWriter{ResponseWriter: rw, shaper: s, r: r}
+}
+
+type shaperListener struct {
+	net.Listener
+	shaper *Shaper
+}
+
+func (l *shaperListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.shaper.Conn(conn), nil
+}
+
+// shapedConn shapes its writes; closing it abandons those waiting.
+type shapedConn struct {
+	net.Conn
+	shaper *Shaper
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	return c.shaper.write(p, c.closed, c.Conn.Write)
+}
+
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection where supported.
+func (c *shapedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// shapedWriter shapes the body of a response until its request is
+// canceled.
+type shapedWriter struct {
+	http.ResponseWriter
+	shaper *Shaper
+	r      *http.Request
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.shaper.write(p, w.r.Context().Done(), w.ResponseWriter.Write)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *shapedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,266 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EtcdDiscoverer reads a pool's servers from the keys under an etcd prefix,
+// through the etcd v3 JSON gateway. Each key holds one server, either as a
+// bare address or as a JSON object with "addr", "weight" and "tier", so that
+// tooling registers a server by putting a key and removes it by deleting it.
+//
+// EtcdDiscoverer is a Watcher: it watches the prefix and rereads all of it
+// on every change, so the pool is replaced as a whole.
+type EtcdDiscoverer struct {
+	// Endpoints are the etcd client URLs, tried in order.
+	Endpoints []string
+	Prefix    string
+	Username  string
+	Password  string
+	Client    *http.Client
+
+	mu       sync.Mutex
+	revision int64
+}
+
+// NewEtcdDiscoverer creates an EtcdDiscoverer for the keys under prefix.
+func NewEtcdDiscoverer(endpoints []string, prefix string) (*EtcdDiscoverer, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcd endpoints must not be empty")
+	}
+	if prefix == "" {
+		return nil, fmt.Errorf("etcd prefix must not be empty")
+	}
+	eps := make([]string, len(endpoints))
+	for i, ep := range endpoints {
+		eps[i] = strings.TrimSuffix(ep, "/")
+	}
+	return &EtcdDiscoverer{Endpoints: eps, Prefix: prefix, Client: &http.Client{}}, nil
+}
+
+// etcdHeader is the response header of the etcd gateway. Revisions are
+// int64 values encoded as JSON strings.
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// etcdKV is a key-value pair in the responses of the etcd gateway.
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+	Lease       int64  `json:"lease,string"`
+}
+
+// Discover implements Discoverer.
+func (e *EtcdDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	var resp struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	body, err := e.call(ctx, "/v3/kv/range", map[string]any{
+		"key":       []byte(e.Prefix),
+		"range_end": etcdPrefixEnd(e.Prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	targets := make([]Target, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		t, err := registryTarget(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("etcd key %q: %w", kv.Key, err)
+		}
+		targets = append(targets, t)
+	}
+	e.mu.Lock()
+	e.revision = resp.Header.Revision
+	e.mu.Unlock()
+	return targets, nil
+}
+
+// Watch implements Watcher.
+func (e *EtcdDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	e.mu.Lock()
+	rev := e.revision
+	e.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body, err := e.call(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(e.Prefix),
+			"range_end":      etcdPrefixEnd(e.Prefix),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(bufio.NewReader(body))
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool              `json:"canceled"`
+				CancelReason string            `json:"cancel_reason"`
+				CompactRev   int64             `json:"compact_revision,string"`
+				Events       []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("etcd watch: %w", err)
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("etcd watch: %s", msg.Error.Message)
+		}
+		if msg.Result.Canceled && msg.Result.CompactRev == 0 {
+			return nil, fmt.Errorf("etcd watch canceled: %s", msg.Result.CancelReason)
+		}
+		// A compacted start revision still calls for a full reread.
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return e.Discover(ctx)
+		}
+	}
+}
+
+// call posts a JSON request to the first endpoint that answers and returns
+// the response body.
+func (e *EtcdDiscoverer) call(ctx context.Context, path string, req any) (io.ReadCloser, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ep := range e.Endpoints {
+		body, err := e.post(ctx, ep, path, b)
+		if err == nil {
+			return body, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// rpc posts req to the etcd gateway and decodes its response into resp.
+func (e *EtcdDiscoverer) rpc(ctx context.Context, path string, req, resp any) error {
+	body, err := e.call(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// Streaming endpoints wrap their responses in "result".
+	var v struct {
+		Result json.RawMessage `json:"result"`
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if json.Unmarshal(b, &v) == nil && v.Result != nil {
+		b = v.Result
+	}
+	if err := json.Unmarshal(b, resp); err != nil {
+		return fmt.Errorf("etcd: %w", err)
+	}
+	return nil
+}
+
+func (e *EtcdDiscoverer) post(ctx context.Context, endpoint, path string, b []byte) (io.ReadCloser, error) {
+	var token string
+	if e.Username != "" {
+		auth, err := json.Marshal(map[string]string{"name": e.Username, "password": e.Password})
+		if err != nil {
+			return nil, err
+		}
+		body, err := e.do(ctx, endpoint+"/v3/auth/authenticate", auth, "")
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		err = json.NewDecoder(body).Decode(&resp)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("etcd auth: %w", err)
+		}
+		token = resp.Token
+	}
+	return e.do(ctx, endpoint+path, b, token)
+}
+
+func (e *EtcdDiscoverer) do(ctx context.Context, url string, b []byte, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Body, nil
+}
+
+// registryTarget parses a server registered in a key-value store: a bare
+// address or a JSON object with "addr", "weight" and "tier".
+func registryTarget(value []byte) (Target, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && value[0] == '{' {
+		var v struct {
+			Addr   string `json:"addr"`
+			Weight int    `json:"weight"`
+			Tier   int    `json:"tier"`
+		}
+		if err := json.Unmarshal(value, &v); err != nil {
+			return Target{}, err
+		}
+		if v.Addr == "" {
+			return Target{}, fmt.Errorf("no addr")
+		}
+		return Target{Addr: v.Addr, Weight: max(v.Weight, 1), Tier: v.Tier}, nil
+	}
+	if len(value) == 0 {
+		return Target{}, fmt.Errorf("empty value")
+	}
+	return Target{Addr: string(value)}, nil
+}
+
+// etcdPrefixEnd returns the range end covering all keys with prefix.
+func etcdPrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
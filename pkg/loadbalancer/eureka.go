@@ -0,0 +1,126 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EurekaDiscoverer yields the instances of an application registered in a
+// Netflix Eureka registry that are UP. Like Eureka's own clients it polls
+// the registry, on the Discovery's interval.
+type EurekaDiscoverer struct {
+	// URLs are the Eureka service URLs, such as
+	// "http://eureka:8761/eureka", tried in order.
+	URLs []string
+	App  string
+	// UseHostname addresses instances by hostname instead of IP address.
+	UseHostname bool
+	// Secure uses the instances' secure port with https.
+	Secure bool
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs. Secure overrides it.
+	Scheme string
+	Client *http.Client
+}
+
+// NewEurekaDiscoverer creates a EurekaDiscoverer for app.
+func NewEurekaDiscoverer(urls []string, app string) (*EurekaDiscoverer, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("eureka urls must not be empty")
+	}
+	if app == "" {
+		return nil, fmt.Errorf("eureka app must not be empty")
+	}
+	us := make([]string, len(urls))
+	for i, u := range urls {
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("eureka url: %w", err)
+		}
+		us[i] = strings.TrimSuffix(u, "/")
+	}
+	return &EurekaDiscoverer{URLs: us, App: app, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// eurekaPort is a port of an instance. Depending on the server version,
+// "$" is a number or a string.
+type eurekaPort struct {
+	Port    json.Number `json:"$"`
+	Enabled string      `json:"@enabled"`
+}
+
+// Discover implements Discoverer.
+func (e *EurekaDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	var errs []error
+	for _, u := range e.URLs {
+		targets, err := e.fetch(ctx, u)
+		if err == nil {
+			return targets, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (e *EurekaDiscoverer) fetch(ctx context.Context, base string) ([]Target, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/apps/"+url.PathEscape(strings.ToUpper(e.App)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Eureka drops applications without instances.
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("eureka: %s", resp.Status)
+	}
+	var body struct {
+		Application struct {
+			Instance []struct {
+				HostName   string     `json:"hostName"`
+				IPAddr     string     `json:"ipAddr"`
+				Status     string     `json:"status"`
+				Port       eurekaPort `json:"port"`
+				SecurePort eurekaPort `json:"securePort"`
+			} `json:"instance"`
+		} `json:"application"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("eureka: %w", err)
+	}
+	var targets []Target
+	for _, inst := range body.Application.Instance {
+		if inst.Status != "UP" {
+			continue
+		}
+		port, scheme := inst.Port, e.Scheme
+		if e.Secure {
+			port, scheme = inst.SecurePort, "https"
+		}
+		if port.Enabled != "true" {
+			continue
+		}
+		host := inst.IPAddr
+		if e.UseHostname || host == "" {
+			host = inst.HostName
+		}
+		addr := net.JoinHostPort(host, port.Port.String())
+		if scheme != "" {
+			addr = scheme + "://" + addr
+		}
+		targets = append(targets, Target{Addr: addr, ServerName: inst.HostName})
+	}
+	return targets, nil
+}
@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+var eventsDropped = metrics.NewCounterVec("lb_events_dropped_total",
+	"Events not delivered to a subscriber whose buffer was full.")
+
+// Event is emitted by the load balancers of the process to the channels of
+// Subscribe. It is one of BackendAdded, BackendRemoved, BackendUp,
+// BackendDown, RequestFailed, ConfigReloaded, ProbeUp and ProbeDown.
+type Event interface {
+	// When returns the time the event occurred.
+	When() time.Time
+}
+
+// BackendAdded is emitted when a server joins a pool, through the admin
+// API, discovery or a call to AddServer.
+type BackendAdded struct {
+	Time   time.Time
+	Pool   string
+	Server backend.Server
+}
+
+// BackendRemoved is emitted when a server leaves a pool.
+type BackendRemoved struct {
+	Time   time.Time
+	Pool   string
+	Server backend.Server
+}
+
+// BackendUp is emitted when a health check finds a server alive again.
+type BackendUp struct {
+	Time   time.Time
+	Pool   string
+	Server backend.Server
+}
+
+// BackendDown is emitted when a health check finds a server dead.
+type BackendDown struct {
+	Time   time.Time
+	Pool   string
+	Server backend.Server
+}
+
+// RequestFailed is emitted when a request could not be proxied to Server,
+// which the client is answered 502 for. Requests the client gave up on are
+// not reported.
+type RequestFailed struct {
+	Time   time.Time
+	Server backend.Server
+	Method string
+	Host   string
+	Path   string
+	Err    error
+}
+
+// ConfigReloaded is emitted when a Service applied a new configuration.
+type ConfigReloaded struct {
+	Time time.Time
+}
+
+// ProbeUp is emitted when a probe that failed succeeds again.
+type ProbeUp struct {
+	Time  time.Time
+	Probe string
+}
+
+// ProbeDown is emitted when a probe fails, the first time or after it
+// succeeded.
+type ProbeDown struct {
+	Time  time.Time
+	Probe string
+	Err   error
+}
+
+func (e BackendAdded) When() time.Time   { return e.Time }
+func (e BackendRemoved) When() time.Time { return e.Time }
+func (e BackendUp) When() time.Time      { return e.Time }
+func (e BackendDown) When() time.Time    { return e.Time }
+func (e RequestFailed) When() time.Time  { return e.Time }
+func (e ConfigReloaded) When() time.Time { return e.Time }
+func (e ProbeUp) When() time.Time        { return e.Time }
+func (e ProbeDown) When() time.Time      { return e.Time }
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   []chan Event
+	// subscribed is set while there are subscribers, so that emitting an
+	// event costs nothing otherwise.
+	subscribed atomic.Bool
+)
+
+// Subscribe returns a channel receiving the events emitted from then on,
+// holding up to buffer of them: events arriving while it is full are
+// dropped and counted in lb_events_dropped_total, so that a slow
+// subscriber never holds up the load balancer. Unsubscribe stops the
+// delivery and closes the channel.
+func Subscribe(buffer int) (events <-chan Event, unsubscribe func()) {
+	c := make(chan Event, buffer)
+	subscribersMu.Lock()
+	subscribers = append(subscribers, c)
+	subscribed.Store(true)
+	subscribersMu.Unlock()
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			subscribersMu.Lock()
+			defer subscribersMu.Unlock()
+			for i, s := range subscribers {
+				if s == c {
+					subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+					break
+				}
+			}
+			subscribed.Store(len(subscribers) > 0)
+			close(c)
+		})
+	}
+}
+
+// requestFailed emits the RequestFailed event of r, which server failed
+// with err.
+func requestFailed(server backend.Server, r *http.Request, err error) {
+	if !subscribed.Load() {
+		return
+	}
+	emit(RequestFailed{Time: time.Now(), Server: server, Method: r.Method, Host: r.Host, Path: r.URL.Path, Err: err})
+}
+
+// emit delivers e to the subscribers with room for it.
+func emit(e Event) {
+	if !subscribed.Load() {
+		return
+	}
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for _, c := range subscribers {
+		select {
+		case c <- e:
+		default:
+			eventsDropped.Inc()
+		}
+	}
+}
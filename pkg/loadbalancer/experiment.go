@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+const defaultExperimentHeader = "X-Experiment-Bucket"
+
+var experimentAssignments = metrics.NewCounterVec("lb_experiment_assignments_total",
+	"Requests assigned to an experiment bucket.", "experiment", "bucket")
+
+// Bucket is one arm of an Experiment.
+type Bucket struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// Experiment assigns clients to buckets by hashing a stable client key, so a
+// client sees the same bucket on every request. The key is taken from Cookie,
+// then Header, falling back to the client IP.
+//
+// The assigned bucket is sent to the backend and returned to the client in
+// the TagHeader header as "<experiment>=<bucket>".
+type Experiment struct {
+	Name      string
+	Cookie    string
+	Header    string
+	TagHeader string
+	Buckets   []Bucket
+
+	total int
+}
+
+// NewExperiment creates an Experiment. An empty tagHeader defaults to X-Experiment-Bucket.
+func NewExperiment(name, cookie, header, tagHeader string, buckets []Bucket) (*Experiment, error) {
+	if name == "" {
+		return nil, fmt.Errorf("experiment name must not be empty")
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("experiment %q has no buckets", name)
+	}
+	total := 0
+	for _, b := range buckets {
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("experiment %q: bucket %q has negative weight", name, b.Name)
+		}
+		total += b.Weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("experiment %q: bucket weights must not all be zero", name)
+	}
+	if tagHeader == "" {
+		tagHeader = defaultExperimentHeader
+	}
+	return &Experiment{
+		Name:      name,
+		Cookie:    cookie,
+		Header:    header,
+		TagHeader: http.CanonicalHeaderKey(tagHeader),
+		Buckets:   buckets,
+		total:     total,
+	}, nil
+}
+
+// key returns the stable client key used for bucketing r.
+func (e *Experiment) key(r *http.Request) string {
+	if e.Cookie != "" {
+		if c, err := r.Cookie(e.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if e.Header != "" {
+		if v := r.Header.Get(e.Header); v != "" {
+			return v
+		}
+	}
+	return clientIP(r).String()
+}
+
+// Assign returns the bucket of the client sending r.
+func (e *Experiment) Assign(r *http.Request) *Bucket {
+	h := fnv.New64a()
+	h.Write([]byte(e.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(e.key(r)))
+	n := int(h.Sum64() % uint64(e.total))
+	for i := range e.Buckets {
+		if n < e.Buckets[i].Weight {
+			return &e.Buckets[i]
+		}
+		n -= e.Buckets[i].Weight
+	}
+	return &e.Buckets[len(e.Buckets)-1]
+}
+
+// assignAndTag assigns r to a bucket and tags the request and response with it.
+func (e *Experiment) assignAndTag(rw http.ResponseWriter, r *http.Request) *Bucket {
+	b := e.Assign(r)
+	tag := e.Name + "=" + b.Name
+	r.Header.Set(e.TagHeader, tag)
+	rw.Header().Set(e.TagHeader, tag)
+	experimentAssignments.Inc(e.Name, b.Name)
+	if t := tagsOf(r); t != nil {
+		t.bucket = b.Name
+	}
+	return b
+}
@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// Explanation is how the load balancer would serve a request, as Explain
+// reports it.
+type Explanation struct {
+	// Middleware names the middleware the request runs through, those of
+	// the load balancer first, then those of its route, as in the
+	// configuration; "custom" is middleware added by other means.
+	Middleware []string `json:"middleware"`
+	// Routes are the routes tried, in order, with the first condition of
+	// each the request does not satisfy; the last has none if it matched.
+	Routes []RouteMatch `json:"routes"`
+	// Route is the route matched, or "" if the fallback serves the request.
+	Route string `json:"route,omitempty"`
+	// Path is the path forwarded, once the route rewrote it.
+	Path string `json:"path"`
+	// Status is the status the load balancer answers with itself: that of
+	// a redirect, to Redirect, or of the fallback response.
+	Status   int    `json:"status,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	// Mirror is the pool the request is mirrored to, if the route mirrors
+	// its requests.
+	Mirror string `json:"mirror,omitempty"`
+	// Pools are the pools that may serve the request: one, or those of a
+	// weighted split.
+	Pools []PoolChoice `json:"pools,omitempty"`
+}
+
+// RouteMatch is a route tried for a request and the first of its
+// conditions, as named in the configuration, the request does not
+// satisfy, or "" if it matched.
+type RouteMatch struct {
+	Name     string `json:"name"`
+	Mismatch string `json:"mismatch,omitempty"`
+}
+
+// PoolChoice is a pool that may serve a request, why, and its servers that
+// may.
+type PoolChoice struct {
+	Name string `json:"name"`
+	// Reason is why the pool serves the request: "route", "fallback",
+	// "canary", "experiment", with Bucket, "split", with Weight, or
+	// "blue_green".
+	Reason string `json:"reason"`
+	Bucket string `json:"bucket,omitempty"`
+	Weight int    `json:"weight,omitempty"`
+	// Maintenance is set if the pool answers with the maintenance page.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Affinity is the affinity mode of the pool for the route, and Pinned
+	// whether it sends the client to Server.
+	Affinity string `json:"affinity,omitempty"`
+	Pinned   bool   `json:"pinned,omitempty"`
+	// Server is the server the request goes to, if affinity or the servers
+	// available decide it; otherwise the strategy of the pool picks one of
+	// Servers.
+	Server  string   `json:"server,omitempty"`
+	Servers []string `json:"servers"`
+	// Datacenters are the data centers the request may go to, by weight,
+	// if the pool routes by data center.
+	Datacenters []string `json:"datacenters,omitempty"`
+	// Error is why no server would serve the request.
+	Error string `json:"error,omitempty"`
+}
+
+// Explain reports how the load balancer would serve r, without serving it
+// or changing anything: the middleware r runs through, the routes tried and
+// the route matched, the pools that may serve it and the server of each it
+// would go to. The middleware may answer r themselves, which Explain does
+// not tell.
+func (lb *LoadBalancer) Explain(r *http.Request) *Explanation {
+	r = lb.prepare(r)
+	ex := &Explanation{Middleware: middlewareNames(lb.middleware, lb.middlewareNames), Routes: []RouteMatch{}, Path: r.URL.Path}
+	var rt *Route
+	for _, candidate := range lb.routes {
+		mismatch := candidate.mismatch(r)
+		ex.Routes = append(ex.Routes, RouteMatch{Name: candidate.Name, Mismatch: mismatch})
+		if mismatch == "" {
+			rt = candidate
+			break
+		}
+	}
+	if rt == nil {
+		switch fb := lb.fallback; {
+		case fb == nil:
+			ex.Status = http.StatusNotFound
+		case fb.Pool != "":
+			ex.Pools = []PoolChoice{lb.explainPool(r, nil, fb.Pool, "fallback")}
+		default:
+			ex.Status = cmp.Or(fb.Status, http.StatusNotFound)
+		}
+		return ex
+	}
+	ex.Route = rt.Name
+	ex.Middleware = append(ex.Middleware, middlewareNames(rt.Middleware, rt.middlewareNames)...)
+	r = rt.rewriteRequest(r)
+	ex.Path = r.URL.Path
+	if rt.Redirect != nil {
+		ex.Status, ex.Redirect = rt.Redirect.Code, rt.Redirect.Location(r)
+		return ex
+	}
+	if rt.Mirror != nil {
+		ex.Mirror = rt.Mirror.Pool
+	}
+	switch splits := rt.Splits(); {
+	case rt.Canary != nil && rt.Canary.Matches(r):
+		ex.Pools = []PoolChoice{lb.explainPool(r, rt, rt.Canary.Pool, "canary")}
+	case rt.Experiment != nil:
+		b := rt.Experiment.Assign(r)
+		pc := lb.explainPool(r, rt, b.Pool, "experiment")
+		pc.Bucket = b.Name
+		ex.Pools = []PoolChoice{pc}
+	case splits != nil:
+		for _, sp := range splits {
+			if sp.Weight == 0 {
+				continue
+			}
+			pc := lb.explainPool(r, rt, sp.Pool, "split")
+			pc.Weight = sp.Weight
+			ex.Pools = append(ex.Pools, pc)
+		}
+	case rt.BlueGreen != nil:
+		ex.Pools = []PoolChoice{lb.explainPool(r, rt, rt.BlueGreen.ActivePool(), "blue_green")}
+	default:
+		ex.Pools = []PoolChoice{lb.explainPool(r, rt, rt.Pool, "route")}
+	}
+	return ex
+}
+
+// explainPool reports how the pool named name would serve r, matched by rt
+// (nil for the fallback), as forward does.
+func (lb *LoadBalancer) explainPool(r *http.Request, rt *Route, name, reason string) PoolChoice {
+	pc := PoolChoice{Name: name, Reason: reason, Servers: []string{}}
+	pool := lb.Pool(name)
+	if pool == nil {
+		pc.Error = ErrPoolNotFound.Error()
+		return pc
+	}
+	if lb.maintenance.blocks(r, rt, pool) {
+		pc.Maintenance = true
+		return pc
+	}
+	var candidates []backend.Server
+	if d := pool.datacenters; d != nil {
+		pc.Datacenters, candidates = d.explain(pool.members.Load())
+	} else {
+		candidates = pool.candidates()
+	}
+	var live []backend.Server
+	for _, s := range candidates {
+		if s.IsAlive() {
+			live = append(live, s)
+			pc.Servers = append(pc.Servers, s.Address())
+		}
+	}
+	if a := rt.affinityFor(pool); a != nil {
+		pc.Affinity = a.Mode
+		if s, err := explainAffinity(a, pool, r); err != nil {
+			pc.Error = err.Error()
+			return pc
+		} else if s != nil {
+			pc.Pinned, pc.Server = true, s.Address()
+			return pc
+		}
+	}
+	switch len(live) {
+	case 0:
+		pc.Error = ErrNoHealthyBackends.Error()
+	case 1:
+		pc.Server = live[0].Address()
+	}
+	return pc
+}
+
+// explainAffinity returns the server a pins the client sending r to in
+// pool, or nil if the strategy of the pool picks one, as pickWithAffinity
+// does without renewing, deleting or adding pins.
+func explainAffinity(a *Affinity, pool *Pool, r *http.Request) (backend.Server, error) {
+	if a.Consistent {
+		key, ok := a.tableKey(r)
+		if !ok {
+			return nil, nil
+		}
+		owner, live := pool.hashRing().lookup(key)
+		if owner != nil && owner != live && a.Failover == FailoverError {
+			return nil, errAffinityBroken
+		}
+		return live, nil
+	}
+	pin, _, ok := a.peek(r, pool.Name)
+	if !ok || a.expired(pin, time.Now()) {
+		return nil, nil
+	}
+	if s := pool.serverByID(pin.ServerID); s != nil && backend.AvailableSticky(s) {
+		return s, nil
+	}
+	if a.Failover == FailoverError {
+		return nil, errAffinityBroken
+	}
+	return nil, nil
+}
+
+// middlewareNames returns the names of the middleware of c, names as built
+// from a configuration, or "custom" for those not named.
+func middlewareNames(c Chain, names []string) []string {
+	out := make([]string, len(c))
+	for i := range c {
+		out[i] = "custom"
+		if i < len(names) && names[i] != "" {
+			out[i] = names[i]
+		}
+	}
+	return out
+}
+
+// ExplainRequest builds the request Explain is asked about: method, GET if
+// empty, host, uri, the path with the query, "/" if empty, header and
+// remote, the client address with or without a port.
+func ExplainRequest(ctx context.Context, method, host, uri string, header http.Header, remote string) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, cmp.Or(method, http.MethodGet), "http://localhost/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.URL, err = url.ParseRequestURI(cmp.Or(uri, "/")); err != nil {
+		return nil, err
+	}
+	r.RequestURI, r.Host, r.RemoteAddr = r.URL.RequestURI(), host, remote
+	if header != nil {
+		r.Header = header.Clone()
+	}
+	return r, nil
+}
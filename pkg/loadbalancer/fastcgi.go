@@ -0,0 +1,295 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolFastCGI pools hold FastCGI application servers such as PHP-FPM.
+const ProtocolFastCGI = "fastcgi"
+
+// FastCGI record types and roles used by the client.
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiMaxRecord = 65535
+)
+
+const defaultFastCGIDialTimeout = 5 * time.Second
+
+// FastCGI describes how requests map onto scripts of a FastCGI application.
+// The script is the request path up to and including the first segment with
+// SplitExt (default ".php"), resolved under Root; the rest of the path is
+// passed as PATH_INFO. Paths ending in a slash get Index (default
+// "index.php") appended.
+type FastCGI struct {
+	Root     string
+	Index    string
+	SplitExt string
+	// Params are extra CGI parameters passed with every request.
+	Params map[string]string
+}
+
+// FastCGIServer is a Server speaking FastCGI to an application server at
+// host:port or on the Unix domain socket unix:///path. It opens one
+// connection per request.
+type FastCGIServer struct {
+	*NetServer
+	fcgi        FastCGI
+	dialTimeout time.Duration
+}
+
+// NewFastCGIServer creates a FastCGIServer for addr.
+func NewFastCGIServer(addr string, fcgi FastCGI) (*FastCGIServer, error) {
+	ns, err := NewTCPServer(strings.TrimPrefix(addr, "fastcgi://"))
+	if err != nil {
+		return nil, err
+	}
+	if fcgi.Index == "" {
+		fcgi.Index = "index.php"
+	}
+	if fcgi.SplitExt == "" {
+		fcgi.SplitExt = ".php"
+	}
+	return &FastCGIServer{NetServer: ns, fcgi: fcgi, dialTimeout: defaultFastCGIDialTimeout}, nil
+}
+
+// Serve runs the request as a FastCGI responder and relays its CGI response.
+func (s *FastCGIServer) Serve(rw http.ResponseWriter, r *http.Request) {
+	s.Start()
+	defer s.Done()
+	conn, err := net.DialTimeout(s.Network(), s.Address(), s.dialTimeout)
+	if err != nil {
+		s.badGateway(rw, r, err)
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(r.Context(), func() { conn.Close() })
+	defer stop()
+
+	if err := s.writeRequest(conn, r); err != nil {
+		s.badGateway(rw, r, err)
+		return
+	}
+	stdout, stdoutW := io.Pipe()
+	go func() {
+		stdoutW.CloseWithError(readFastCGIResponse(conn, stdoutW, s.Address()))
+	}()
+	defer stdout.Close()
+
+	br := bufio.NewReader(stdout)
+	hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		s.badGateway(rw, r, fmt.Errorf("malformed response: %w", err))
+		return
+	}
+	status := http.StatusOK
+	if st := hdr.Get("Status"); st != "" {
+		code, _, _ := strings.Cut(st, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			s.badGateway(rw, r, fmt.Errorf("malformed status %q", st))
+			return
+		}
+		hdr.Del("Status")
+	} else if hdr.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	if status >= http.StatusInternalServerError {
+		s.Fail()
+	}
+	removeHopHeaders(http.Header(hdr))
+	for k, vv := range hdr {
+		rw.Header()[k] = vv
+	}
+	rw.WriteHeader(status)
+	if _, err := io.Copy(rw, br); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		logf("FastCGI %q: %v", s.Address(), err)
+	}
+}
+
+// badGateway logs err, counts r as failed unless the client gave up on it
+// and answers it with 502.
+func (s *FastCGIServer) badGateway(rw http.ResponseWriter, r *http.Request, err error) {
+	logf("FastCGI %q: %v", s.Address(), err)
+	if r.Context().Err() == nil {
+		s.Fail()
+		requestFailed(s, r, err)
+	}
+	http.Error(rw, "bad gateway", http.StatusBadGateway)
+}
+
+// writeRequest sends the begin-request, params and stdin records of r.
+func (s *FastCGIServer) writeRequest(w io.Writer, r *http.Request) error {
+	bw := bufio.NewWriter(w)
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeFastCGIRecord(bw, fcgiBeginRequest, begin); err != nil {
+		return err
+	}
+	var params []byte
+	for k, v := range s.params(r) {
+		params = appendFastCGIPair(params, k, v)
+	}
+	for len(params) > 0 {
+		n := min(len(params), fcgiMaxRecord)
+		if err := writeFastCGIRecord(bw, fcgiParams, params[:n]); err != nil {
+			return err
+		}
+		params = params[n:]
+	}
+	if err := writeFastCGIRecord(bw, fcgiParams, nil); err != nil {
+		return err
+	}
+	if r.Body != nil {
+		buf := copyBuffers.Get()
+		defer copyBuffers.Put(buf)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				if err := writeFastCGIRecord(bw, fcgiStdin, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeFastCGIRecord(bw, fcgiStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// params returns the CGI parameters of r.
+func (s *FastCGIServer) params(r *http.Request) map[string]string {
+	urlPath := r.URL.Path
+	if strings.HasSuffix(urlPath, "/") {
+		urlPath += s.fcgi.Index
+	}
+	script, pathInfo := urlPath, ""
+	if i := strings.Index(urlPath, s.fcgi.SplitExt); i >= 0 {
+		end := i + len(s.fcgi.SplitExt)
+		if end == len(urlPath) || urlPath[end] == '/' {
+			script, pathInfo = urlPath[:end], urlPath[end:]
+		}
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteHost, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "golang-load-balancer",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     s.fcgi.Root,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   path.Join(s.fcgi.Root, script),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+	}
+	if r.ContentLength >= 0 {
+		p["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if r.TLS != nil {
+		p["HTTPS"] = "on"
+	}
+	for k, vv := range r.Header {
+		k = strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if k == "PROXY" {
+			// Never pass the Proxy header as HTTP_PROXY (httpoxy).
+			continue
+		}
+		p["HTTP_"+k] = strings.Join(vv, ", ")
+	}
+	for k, v := range s.fcgi.Params {
+		p[k] = v
+	}
+	return p
+}
+
+func writeFastCGIRecord(w io.Writer, typ byte, content []byte) error {
+	padding := -len(content) & 7
+	hdr := [8]byte{1, typ, 0, 1}
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(content)))
+	hdr[6] = byte(padding)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+func appendFastCGIPair(b []byte, name, value string) []byte {
+	for _, n := range []int{len(name), len(value)} {
+		if n < 128 {
+			b = append(b, byte(n))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+		}
+	}
+	return append(append(b, name...), value...)
+}
+
+// readFastCGIResponse copies the stdout records of the response to w until
+// the end-request record, logging stderr output.
+func readFastCGIResponse(r io.Reader, w io.Writer, addr string) error {
+	br := bufio.NewReader(r)
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return fmt.Errorf("fastcgi: %w", err)
+		}
+		n := int(binary.BigEndian.Uint16(hdr[4:]))
+		content := make([]byte, n+int(hdr[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			return fmt.Errorf("fastcgi: %w", err)
+		}
+		content = content[:n]
+		switch hdr[1] {
+		case fcgiStdout:
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				logf("FastCGI %q: %s", addr, strings.TrimSpace(string(content)))
+			}
+		case fcgiEndRequest:
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+var faultsInjected = metrics.NewCounterVec("lb_faults_injected_total",
+	"Faults injected into requests, by route or pool and kind: delay, abort or drop.", "faults", "kind")
+
+// Faults injects faults into a share of the requests forwarded, for clients
+// to be tested against a failing edge: DelayPercent percent of them wait
+// Delay, plus up to Jitter, before being forwarded; AbortPercent percent
+// are answered AbortStatus, 503 by default, without reaching their server;
+// and DropPercent percent get no response, their connection being closed,
+// or their stream reset over HTTP/2. If Servers is set, only requests sent
+// to those server addresses are affected, and if Header is, only requests
+// carrying it, so that testers may opt their own requests in.
+type Faults struct {
+	Delay        time.Duration
+	Jitter       time.Duration
+	DelayPercent float64
+	AbortStatus  int
+	AbortPercent float64
+	DropPercent  float64
+	Servers      []string
+	Header       string
+
+	name string
+}
+
+// NewFaults creates Faults injecting none, counted under name.
+func NewFaults(name string) *Faults {
+	return &Faults{AbortStatus: http.StatusServiceUnavailable, name: name}
+}
+
+// inject injects the faults of r, about to be forwarded to server, and
+// reports whether it was answered. Nil Faults inject none.
+func (f *Faults) inject(rw http.ResponseWriter, r *http.Request, server backend.Server) bool {
+	if f == nil || (f.Header != "" && r.Header.Get(f.Header) == "") ||
+		(len(f.Servers) > 0 && !slices.Contains(f.Servers, server.Address())) {
+		return false
+	}
+	if f.DelayPercent > 0 && rand.Float64()*100 < f.DelayPercent {
+		faultsInjected.Inc(f.name, "delay")
+		d := f.Delay
+		if f.Jitter > 0 {
+			d += rand.N(f.Jitter)
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	switch p := rand.Float64() * 100; {
+	case p < f.DropPercent:
+		faultsInjected.Inc(f.name, "drop")
+		// The server closes the connection, or resets the stream, without
+		// logging a stack trace.
+		panic(http.ErrAbortHandler)
+	case p < f.DropPercent+f.AbortPercent:
+		faultsInjected.Inc(f.name, "abort")
+		httpError(rw, r, fmt.Sprintf("%d fault injected", f.AbortStatus), f.AbortStatus)
+		return true
+	}
+	return false
+}
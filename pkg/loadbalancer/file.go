@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFilePollInterval = time.Second
+
+// FileDiscoverer reads a pool's servers from a file that external scripts
+// manage by rewriting it. Weights default to 1. The file lists one server per line, as an address
+// optionally followed by a weight and a tier:
+//
+//	# address                weight tier
+//	http://10.0.0.1:8080     3
+//	http://10.0.0.2:8080     1
+//	http://10.0.0.3:8080     1      1
+//
+// Alternatively, it is a YAML list of servers with the keys addr, weight and
+// tier; only this flat form of YAML is understood:
+//
+//   - addr: http://10.0.0.1:8080
+//     weight: 3
+//
+// FileDiscoverer is a Watcher: it polls the file for changes every
+// PollInterval. Write files atomically, by renaming a new file over the old
+// one, so a half-written file is never read.
+type FileDiscoverer struct {
+	Path         string
+	PollInterval time.Duration
+
+	mu   sync.Mutex
+	last []byte
+}
+
+// NewFileDiscoverer creates a FileDiscoverer for the file at path.
+func NewFileDiscoverer(path string) (*FileDiscoverer, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file path must not be empty")
+	}
+	return &FileDiscoverer{Path: path, PollInterval: defaultFilePollInterval}, nil
+}
+
+// Discover implements Discoverer.
+func (f *FileDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.last = b
+	f.mu.Unlock()
+	return f.parse(b)
+}
+
+// Watch implements Watcher.
+func (f *FileDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	ticker := time.NewTicker(f.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		b, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		changed := !bytes.Equal(b, f.last)
+		f.last = b
+		f.mu.Unlock()
+		if changed {
+			return f.parse(b)
+		}
+	}
+}
+
+func (f *FileDiscoverer) parse(b []byte) ([]Target, error) {
+	var targets []Target
+	var err error
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte("-")) {
+		targets, err = parseYAMLTargets(b)
+	} else {
+		targets, err = parseLineTargets(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return targets, nil
+}
+
+// parseLineTargets parses the line format of a servers file.
+func parseLineTargets(b []byte) ([]Target, error) {
+	var targets []Target
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: too many fields", n)
+		}
+		t := Target{Addr: fields[0], Weight: 1}
+		var err error
+		if len(fields) > 1 {
+			if t.Weight, err = strconv.Atoi(fields[1]); err != nil || t.Weight < 1 {
+				return nil, fmt.Errorf("line %d: invalid weight %q", n, fields[1])
+			}
+		}
+		if len(fields) > 2 {
+			if t.Tier, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid tier %q", n, fields[2])
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, sc.Err()
+}
+
+// parseYAMLTargets parses a flat YAML list of servers.
+func parseYAMLTargets(b []byte) ([]Target, error) {
+	var targets []Target
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(trimmed, "-"); ok {
+			targets = append(targets, Target{Weight: 1})
+			trimmed = strings.TrimSpace(rest)
+			if trimmed == "" {
+				continue
+			}
+		} else if len(targets) == 0 || line[0] != ' ' {
+			return nil, fmt.Errorf("line %d: expected a list item", n)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		t := &targets[len(targets)-1]
+		var err error
+		switch strings.TrimSpace(key) {
+		case "addr":
+			t.Addr = value
+		case "weight":
+			if t.Weight, err = strconv.Atoi(value); err != nil || t.Weight < 1 {
+				return nil, fmt.Errorf("line %d: invalid weight %q", n, value)
+			}
+		case "tier":
+			if t.Tier, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid tier %q", n, value)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	for i, t := range targets {
+		if t.Addr == "" {
+			return nil, fmt.Errorf("server %d has no addr", i+1)
+		}
+	}
+	return targets, sc.Err()
+}
@@ -0,0 +1,344 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var fingerprintRequests = metrics.NewCounterVec("lb_tls_fingerprint_requests_total",
+	"Requests matched by a TLS fingerprint rule, by rule and action taken.", "rule", "action")
+
+// TLS fingerprint rule actions.
+const (
+	FingerprintAllow = "allow"
+	FingerprintDeny  = "deny"
+	FingerprintLimit = "limit"
+)
+
+// defaultFingerprintMaxTracked bounds the fingerprints whose rate a limit
+// rule tracks by default.
+const defaultFingerprintMaxTracked = 100000
+
+// TLSFingerprint identifies the TLS stack of a client by its ClientHello:
+// JA3 is the MD5 hash of the JA3 string of the hello and JA4 its JA4
+// fingerprint, such as t13d1516h2_8daaf6152771_e5627efa2ab1.
+type TLSFingerprint struct {
+	JA3 string
+	JA4 string
+}
+
+// fingerprintHolder receives the fingerprint of a connection once its
+// handshake read the ClientHello.
+type fingerprintHolder struct {
+	mu sync.Mutex
+	fp TLSFingerprint
+}
+
+type fingerprintKey struct{}
+
+// withFingerprintHolder is the ConnContext of the frontend server over TLS,
+// giving each connection's handshake a place for its fingerprint.
+func withFingerprintHolder(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, &fingerprintHolder{})
+}
+
+// recordFingerprint is the GetConfigForClient of the frontend server over
+// TLS: it fingerprints hello and keeps the configuration as it is.
+func recordFingerprint(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if h, ok := hello.Context().Value(fingerprintKey{}).(*fingerprintHolder); ok {
+		fp := TLSFingerprint{JA3: ja3(hello), JA4: ja4(hello)}
+		h.mu.Lock()
+		h.fp = fp
+		h.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// RequestFingerprint returns the TLS fingerprint of the client connection
+// r arrived on, if the frontend server built by BuildServer fingerprinted
+// it. Requests over HTTP/3 are not fingerprinted.
+func RequestFingerprint(r *http.Request) (TLSFingerprint, bool) {
+	h, ok := r.Context().Value(fingerprintKey{}).(*fingerprintHolder)
+	if !ok {
+		return TLSFingerprint{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fp, h.fp.JA4 != ""
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// send at random and fingerprints leave out.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(vs), isGREASE)
+}
+
+// ja3 returns the JA3 hash of hello: the MD5 of its version, cipher suites,
+// extensions, curves and point formats, in decimal.
+func ja3(hello *tls.ClientHelloInfo) string {
+	// The legacy version of clients sending supported_versions is TLS 1.2;
+	// without it, the greatest version is the one the client sent.
+	version := uint16(tls.VersionTLS12)
+	if !slices.Contains(hello.Extensions, 43) && len(hello.SupportedVersions) > 0 {
+		version = slices.Max(hello.SupportedVersions)
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinUint16(withoutGREASE(hello.CipherSuites), "-", 10),
+		joinUint16(withoutGREASE(hello.Extensions), "-", 10),
+		joinUint16(withoutGREASE(curves), "-", 10),
+		joinUint16(points, "-", 10),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of hello.
+func ja4(hello *tls.ClientHelloInfo) string {
+	version := "00"
+	if vs := withoutGREASE(hello.SupportedVersions); len(vs) > 0 {
+		switch slices.Max(vs) {
+		case tls.VersionTLS13:
+			version = "13"
+		case tls.VersionTLS12:
+			version = "12"
+		case tls.VersionTLS11:
+			version = "11"
+		case tls.VersionTLS10:
+			version = "10"
+		case 0x0300:
+			version = "s3"
+		}
+	}
+	sni := "i"
+	if slices.Contains(hello.Extensions, 0) {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(hello.CipherSuites)
+	exts := withoutGREASE(hello.Extensions)
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		p := hello.SupportedProtos[0]
+		first, last := p[0], p[len(p)-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			h := hex.EncodeToString([]byte(p))
+			alpn = h[:1] + h[len(h)-1:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min(len(ciphers), 99), min(len(exts), 99), alpn)
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinUint16(ciphers, ",", 16))
+
+	exts = slices.DeleteFunc(exts, func(e uint16) bool { return e == 0 || e == 16 })
+	slices.Sort(exts)
+	c := joinUint16(exts, ",", 16)
+	sigs := make([]uint16, 0, len(hello.SignatureSchemes))
+	for _, s := range hello.SignatureSchemes {
+		if !isGREASE(uint16(s)) {
+			sigs = append(sigs, uint16(s))
+		}
+	}
+	if len(sigs) > 0 {
+		c += "_" + joinUint16(sigs, ",", 16)
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 of s, or zeros if
+// s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// joinUint16 joins vs, in base 10 or as 4 hex digits in base 16.
+func joinUint16(vs []uint16, sep string, base int) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		if base == 16 {
+			s[i] = fmt.Sprintf("%04x", v)
+		} else {
+			s[i] = strconv.Itoa(int(v))
+		}
+	}
+	return strings.Join(s, sep)
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// FingerprintRule matches requests by the TLS fingerprint of their client,
+// its JA3 hash being one of JA3 or its JA4 fingerprint one of JA4; a rule
+// with neither matches every fingerprinted request.
+//
+// Action is what is done with a matching request: FingerprintAllow lets it
+// through without trying further rules; FingerprintDeny answers 403;
+// FingerprintLimit answers 429 once the clients sharing its fingerprint,
+// whatever their addresses, send more than Rate requests a second, with
+// bursts of Burst. A limit rule tracks up to MaxTracked fingerprints,
+// 100000 if zero; past it, arbitrary ones are forgotten.
+type FingerprintRule struct {
+	Name       string
+	JA3        []string
+	JA4        []string
+	Action     string
+	Rate       float64
+	Burst      int
+	MaxTracked int
+
+	limit     *APIKey
+	mu        sync.Mutex
+	tracked   map[string]*apiKeyLimits
+	lastSweep time.Time
+}
+
+// matches reports whether fp matches the rule.
+func (fr *FingerprintRule) matches(fp TLSFingerprint) bool {
+	if len(fr.JA3) == 0 && len(fr.JA4) == 0 {
+		return true
+	}
+	return slices.Contains(fr.JA3, fp.JA3) || slices.Contains(fr.JA4, fp.JA4)
+}
+
+// allow reports whether a request with the fingerprint key is allowed now
+// under the rule's rate, and if it is not, when to retry.
+func (fr *FingerprintRule) allow(key string, now time.Time) (bool, time.Duration) {
+	fr.mu.Lock()
+	if now.Sub(fr.lastSweep) >= botSweepInterval {
+		idle := time.Duration(float64(fr.limit.Burst) / fr.Rate * float64(time.Second))
+		for k, l := range fr.tracked {
+			l.mu.Lock()
+			if now.Sub(l.last) > idle {
+				delete(fr.tracked, k)
+				tableEntries.Dec("fingerprint_limits")
+				tableEvictions.Inc("fingerprint_limits", "expired")
+			}
+			l.mu.Unlock()
+		}
+		fr.lastSweep = now
+	}
+	l := fr.tracked[key]
+	if l == nil {
+		for k := range fr.tracked {
+			if len(fr.tracked) < fr.MaxTracked {
+				break
+			}
+			delete(fr.tracked, k)
+			tableEntries.Dec("fingerprint_limits")
+			tableEvictions.Inc("fingerprint_limits", "capacity")
+		}
+		l = &apiKeyLimits{}
+		fr.tracked[key] = l
+		tableEntries.Inc("fingerprint_limits")
+	}
+	fr.mu.Unlock()
+	ok, retry := l.allow(fr.limit, now)
+	return ok, retry
+}
+
+// FingerprintFilter applies the first of its rules matching the TLS
+// fingerprint of each request, as RequestFingerprint returns it. If Header
+// is set, the JA4 fingerprint is sent to backends in that header,
+// overwriting any the client sent.
+type FingerprintFilter struct {
+	Rules  []*FingerprintRule
+	Header string
+}
+
+// NewFingerprintFilter creates a FingerprintFilter, checking its rules.
+func NewFingerprintFilter(rules []*FingerprintRule, header string) (*FingerprintFilter, error) {
+	for _, fr := range rules {
+		switch fr.Action {
+		case FingerprintAllow, FingerprintDeny:
+		case FingerprintLimit:
+			if fr.Rate <= 0 {
+				return nil, fmt.Errorf("rule %q: limit requires a positive rate", fr.Name)
+			}
+			fr.limit = &APIKey{Rate: fr.Rate, Burst: max(fr.Burst, 1)}
+			fr.tracked = map[string]*apiKeyLimits{}
+			if fr.MaxTracked <= 0 {
+				fr.MaxTracked = defaultFingerprintMaxTracked
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q", fr.Name, fr.Action)
+		}
+	}
+	return &FingerprintFilter{Rules: rules, Header: http.CanonicalHeaderKey(header)}, nil
+}
+
+// Middleware returns the middleware filtering requests by fingerprint.
+func (f *FingerprintFilter) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fp, ok := RequestFingerprint(r)
+			if f.Header != "" && (ok || r.Header.Get(f.Header) != "") {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				r.Header.Del(f.Header)
+				if ok {
+					r.Header.Set(f.Header, fp.JA4)
+				}
+			}
+			if !ok {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			for _, fr := range f.Rules {
+				if !fr.matches(fp) {
+					continue
+				}
+				switch fr.Action {
+				case FingerprintDeny:
+					fingerprintRequests.Inc(fr.Name, "denied")
+					httpError(rw, r, "403 forbidden", http.StatusForbidden)
+					return
+				case FingerprintLimit:
+					if ok, retry := fr.allow(fp.JA4+"|"+fp.JA3, time.Now()); !ok {
+						fingerprintRequests.Inc(fr.Name, "limited")
+						rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+						httpError(rw, r, "429 too many requests", http.StatusTooManyRequests)
+						return
+					}
+					fingerprintRequests.Inc(fr.Name, "allowed")
+				case FingerprintAllow:
+					fingerprintRequests.Inc(fr.Name, "allowed")
+				}
+				break
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
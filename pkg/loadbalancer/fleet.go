@@ -0,0 +1,564 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+var (
+	fleetLeader = metrics.NewGaugeVec("lb_fleet_leader",
+		"Whether the instance is the leader of its fleet, whose configuration the others run.")
+	fleetConfigs = metrics.NewCounterVec("lb_fleet_configs_total",
+		"Configurations published by the instance as leader or applied from the leader, by result: published, applied or failed.", "result")
+)
+
+const defaultFleetTTL = 10 * time.Second
+
+// FleetStore elects the leader of a fleet of load balancers and keeps the
+// configuration it publishes, for the others to run.
+type FleetStore interface {
+	// Campaign makes name the leader for ttl if no instance is, or keeps it
+	// the leader if it is, and returns the name of the leader.
+	Campaign(ctx context.Context, name string, ttl time.Duration) (string, error)
+	// Resign gives the leadership up, if the instance holds it.
+	Resign(ctx context.Context) error
+	// Publish stores config as the configuration of the fleet, failing
+	// unless name is the leader.
+	Publish(ctx context.Context, name string, config []byte) error
+	// Config returns the configuration published last, or nil, and a
+	// version changing with each publication.
+	Config(ctx context.Context) ([]byte, uint64, error)
+}
+
+// FleetStatus is what an instance knows of its fleet.
+type FleetStatus struct {
+	Name   string `json:"name"`
+	Leader string `json:"leader"`
+	// Version is that of the configuration the instance last published or
+	// applied.
+	Version uint64 `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Fleet manages a fleet of load balancers as one: the instances elect a
+// leader through Store, which publishes its configuration there whenever it
+// changes, and the others apply it as their own. An instance keeps its own
+// port, admin address, fleet, ha, cluster and state_file settings; as with
+// any reload, other changes to what it listens on take a restart. Every Interval, a third of
+// TTL by default, an instance campaigns, keeping the leadership it holds
+// or taking it over once the leader missed renewing it for TTL, 10s by
+// default, and a follower looks for a new configuration; a follower whose
+// configuration was reloaded from its file applies the leader's again.
+type Fleet struct {
+	Name     string
+	Store    FleetStore
+	TTL      time.Duration
+	Interval time.Duration
+
+	// current returns the configuration the instance runs and apply
+	// replaces it.
+	current func() *config.Config
+	apply   func(*config.Config) error
+
+	mu     sync.Mutex
+	leader string
+	// version and applied are the version and encoding of the published
+	// configuration last published or applied.
+	version uint64
+	applied []byte
+	err     error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFleet creates the instance name of the fleet whose leader and
+// configuration are in store, running the configuration current returns,
+// and replacing it with apply.
+func NewFleet(name string, store FleetStore, current func() *config.Config, apply func(*config.Config) error) *Fleet {
+	return &Fleet{Name: name, Store: store, TTL: defaultFleetTTL, current: current, apply: apply}
+}
+
+// Start starts campaigning and following the leader in the background.
+func (f *Fleet) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel, f.done = cancel, make(chan struct{})
+	fleetLeader.Set(0)
+	go f.run(ctx)
+}
+
+// Stop stops following the leader and resigns the leadership, if the
+// instance holds it, for another to take it over at once.
+func (f *Fleet) Stop() {
+	if f == nil || f.cancel == nil {
+		return
+	}
+	f.cancel()
+	<-f.done
+	if f.Leader() {
+		ctx, cancel := context.WithTimeout(context.Background(), f.TTL)
+		defer cancel()
+		if err := f.Store.Resign(ctx); err != nil {
+			logf("Fleet: failed to resign the leadership: %v", err)
+		}
+		fleetLeader.Set(0)
+	}
+}
+
+// Leader reports whether the instance is the leader.
+func (f *Fleet) Leader() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leader == f.Name
+}
+
+// Status returns what the instance knows of its fleet.
+func (f *Fleet) Status() FleetStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := FleetStatus{Name: f.Name, Leader: f.leader, Version: f.version}
+	if f.err != nil {
+		st.Error = f.err.Error()
+	}
+	return st
+}
+
+func (f *Fleet) run(ctx context.Context) {
+	defer close(f.done)
+	interval := f.Interval
+	if interval <= 0 {
+		interval = f.TTL / 3
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		err := f.round(ctx, interval)
+		f.mu.Lock()
+		if err != nil && ctx.Err() == nil && (f.err == nil || f.err.Error() != err.Error()) {
+			logf("Fleet: %v", err)
+		}
+		f.err = err
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// round campaigns, then publishes the configuration of the instance if it
+// leads and it changed, or applies the leader's if it follows.
+func (f *Fleet) round(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	leader, err := f.Store.Campaign(ctx, f.Name, f.TTL)
+	f.mu.Lock()
+	was := f.leader
+	if err != nil {
+		// Leading unconfirmed is not leading.
+		leader = ""
+	}
+	f.leader = leader
+	f.mu.Unlock()
+	if leader != was {
+		switch {
+		case leader == f.Name:
+			logf("Fleet: %q is now the leader", f.Name)
+			fleetLeader.Set(1)
+		case was == f.Name:
+			logf("Fleet: %q is no longer the leader", f.Name)
+			fleetLeader.Set(0)
+		case leader != "":
+			logf("Fleet: following %q", leader)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("campaign: %w", err)
+	}
+	if leader == f.Name {
+		return f.publish(ctx, was != f.Name)
+	}
+	return f.follow(ctx)
+}
+
+// publish publishes the configuration of the leader, if it changed since it
+// last did or it just took the leadership.
+func (f *Fleet) publish(ctx context.Context, elected bool) error {
+	b, err := json.Marshal(f.current())
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	unchanged := bytes.Equal(b, f.applied)
+	f.mu.Unlock()
+	if unchanged && !elected {
+		return nil
+	}
+	if err := f.Store.Publish(ctx, f.Name, b); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	_, version, err := f.Store.Config(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.version, f.applied = version, b
+	f.mu.Unlock()
+	logf("Fleet: published configuration version %d", version)
+	fleetConfigs.Inc("published")
+	return nil
+}
+
+// follow applies the configuration published by the leader, if it is not
+// the one the instance runs.
+func (f *Fleet) follow(ctx context.Context) error {
+	b, version, err := f.Store.Config(ctx)
+	if err != nil || b == nil {
+		return err
+	}
+	cur := f.current()
+	local, err := json.Marshal(cur)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	unchanged := version == f.version && bytes.Equal(local, f.applied)
+	f.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	var cfg config.Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		fleetConfigs.Inc("failed")
+		return fmt.Errorf("configuration version %d: %w", version, err)
+	}
+	cfg.Port, cfg.Fleet, cfg.HA, cfg.Cluster, cfg.StateFile = cur.Port, cur.Fleet, cur.HA, cur.Cluster, cur.StateFile
+	if cfg.Admin != nil && cur.Admin != nil {
+		cfg.Admin.Addr = cur.Admin.Addr
+	}
+	applied, err := json.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.version, f.applied = version, applied
+	f.mu.Unlock()
+	if bytes.Equal(local, applied) {
+		return nil
+	}
+	if err := f.apply(&cfg); err != nil {
+		// Not to be tried again before the leader or the file changes it.
+		f.mu.Lock()
+		f.applied = local
+		f.mu.Unlock()
+		fleetConfigs.Inc("failed")
+		return fmt.Errorf("configuration version %d not applied: %w", version, err)
+	}
+	logf("Fleet: applied configuration version %d", version)
+	fleetConfigs.Inc("applied")
+	return nil
+}
+
+// EtcdFleetStore is a FleetStore keeping the leader and configuration of a
+// fleet under an etcd prefix, in the keys "leader", attached to a lease of
+// the leader, and "config".
+type EtcdFleetStore struct {
+	etcd *EtcdDiscoverer
+
+	mu    sync.Mutex
+	lease int64
+}
+
+// NewEtcdFleetStore creates an EtcdFleetStore for the keys under prefix of
+// the etcd cluster at endpoints. Username and Password authenticate to it.
+func NewEtcdFleetStore(endpoints []string, prefix, username, password string) (*EtcdFleetStore, error) {
+	etcd, err := NewEtcdDiscoverer(endpoints, prefix)
+	if err != nil {
+		return nil, err
+	}
+	etcd.Username, etcd.Password = username, password
+	return &EtcdFleetStore{etcd: etcd}, nil
+}
+
+func (s *EtcdFleetStore) key(name string) []byte {
+	return []byte(s.etcd.Prefix + name)
+}
+
+// Campaign implements FleetStore.
+func (s *EtcdFleetStore) Campaign(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease != 0 {
+		var resp struct {
+			TTL int64 `json:"TTL,string"`
+		}
+		if err := s.etcd.rpc(ctx, "/v3/lease/keepalive", map[string]any{"ID": strconv.FormatInt(s.lease, 10)}, &resp); err != nil {
+			return "", err
+		}
+		if resp.TTL <= 0 {
+			// The lease expired, and the leader key with it.
+			s.lease = 0
+		}
+	}
+	if s.lease == 0 {
+		var resp struct {
+			ID int64 `json:"ID,string"`
+		}
+		if err := s.etcd.rpc(ctx, "/v3/lease/grant", map[string]any{"TTL": strconv.FormatInt(int64(max(ttl/time.Second, 1)), 10)}, &resp); err != nil {
+			return "", err
+		}
+		s.lease = resp.ID
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange struct {
+				Kvs []etcdKV `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}
+	err := s.etcd.rpc(ctx, "/v3/kv/txn", map[string]any{
+		"compare": []any{map[string]any{"key": s.key("leader"), "target": "CREATE", "create_revision": "0"}},
+		"success": []any{map[string]any{"request_put": map[string]any{"key": s.key("leader"), "value": []byte(name), "lease": strconv.FormatInt(s.lease, 10)}}},
+		"failure": []any{map[string]any{"request_range": map[string]any{"key": s.key("leader")}}},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Succeeded {
+		return name, nil
+	}
+	if len(resp.Responses) == 0 || len(resp.Responses[0].ResponseRange.Kvs) == 0 {
+		// The leader key expired between the comparison and the range.
+		return "", nil
+	}
+	kv := resp.Responses[0].ResponseRange.Kvs[0]
+	if string(kv.Value) == name && kv.Lease != s.lease {
+		// A previous lease of the instance holds the key until it expires.
+		return "", nil
+	}
+	return string(kv.Value), nil
+}
+
+// Resign implements FleetStore.
+func (s *EtcdFleetStore) Resign(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == 0 {
+		return nil
+	}
+	var resp struct{}
+	err := s.etcd.rpc(ctx, "/v3/lease/revoke", map[string]any{"ID": strconv.FormatInt(s.lease, 10)}, &resp)
+	s.lease = 0
+	return err
+}
+
+// Publish implements FleetStore.
+func (s *EtcdFleetStore) Publish(ctx context.Context, name string, config []byte) error {
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := s.etcd.rpc(ctx, "/v3/kv/txn", map[string]any{
+		"compare": []any{map[string]any{"key": s.key("leader"), "target": "VALUE", "value": []byte(name)}},
+		"success": []any{map[string]any{"request_put": map[string]any{"key": s.key("config"), "value": config}}},
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%q is not the leader", name)
+	}
+	return nil
+}
+
+// Config implements FleetStore.
+func (s *EtcdFleetStore) Config(ctx context.Context) ([]byte, uint64, error) {
+	var resp struct {
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if err := s.etcd.rpc(ctx, "/v3/kv/range", map[string]any{"key": s.key("config")}, &resp); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	return resp.Kvs[0].Value, uint64(resp.Kvs[0].ModRevision), nil
+}
+
+// ConsulFleetStore is a FleetStore keeping the leader and configuration of
+// a fleet under a Consul KV prefix, in the keys "leader" and "config", both
+// locked by a session of the leader.
+type ConsulFleetStore struct {
+	// Addr is the URL of the Consul HTTP API.
+	Addr       string
+	Prefix     string
+	Datacenter string
+	Token      string
+	Client     *http.Client
+
+	mu      sync.Mutex
+	session string
+}
+
+// NewConsulFleetStore creates a ConsulFleetStore for the keys under prefix.
+// An empty addr defaults to the local agent.
+func NewConsulFleetStore(addr, prefix string) (*ConsulFleetStore, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("consul prefix must not be empty")
+	}
+	if addr == "" {
+		addr = defaultConsulAddr
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("consul address: %w", err)
+	}
+	return &ConsulFleetStore{Addr: strings.TrimSuffix(addr, "/"), Prefix: prefix, Client: &http.Client{}}, nil
+}
+
+// do sends a request to the Consul API and decodes its response into resp,
+// if not nil. A 404 response decodes nothing and returns found false.
+func (s *ConsulFleetStore) do(ctx context.Context, method, path string, query url.Values, body []byte, resp any) (found bool, err error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if s.Datacenter != "" {
+		query.Set("dc", s.Datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.Addr+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	r, err := s.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer r.Body.Close()
+	switch {
+	case r.StatusCode == http.StatusNotFound:
+		return false, nil
+	case r.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		return false, fmt.Errorf("consul: %s: %s", r.Status, bytes.TrimSpace(msg))
+	case resp != nil:
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			return false, fmt.Errorf("consul: %w", err)
+		}
+	}
+	return true, nil
+}
+
+func (s *ConsulFleetStore) key(name string) string {
+	return "/v1/kv/" + strings.TrimPrefix(s.Prefix, "/") + name
+}
+
+// consulKV is an element of Consul's /v1/kv responses.
+type consulKV struct {
+	Value       []byte
+	Session     string
+	ModifyIndex uint64
+}
+
+// Campaign implements FleetStore. Consul sessions last at least 10s, and up
+// to twice their TTL once unrenewed.
+func (s *ConsulFleetStore) Campaign(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != "" {
+		found, err := s.do(ctx, http.MethodPut, "/v1/session/renew/"+s.session, nil, nil, nil)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			// The session expired, releasing the leader key.
+			s.session = ""
+		}
+	}
+	if s.session == "" {
+		b, _ := json.Marshal(map[string]string{
+			"Name":      "lb-fleet-" + name,
+			"TTL":       max(ttl, 10*time.Second).String(),
+			"Behavior":  "release",
+			"LockDelay": "0s",
+		})
+		var resp struct{ ID string }
+		if _, err := s.do(ctx, http.MethodPut, "/v1/session/create", nil, b, &resp); err != nil {
+			return "", err
+		}
+		s.session = resp.ID
+	}
+	var acquired bool
+	if _, err := s.do(ctx, http.MethodPut, s.key("leader"), url.Values{"acquire": {s.session}}, []byte(name), &acquired); err != nil {
+		return "", err
+	}
+	if acquired {
+		return name, nil
+	}
+	var kvs []consulKV
+	if _, err := s.do(ctx, http.MethodGet, s.key("leader"), nil, nil, &kvs); err != nil {
+		return "", err
+	}
+	if len(kvs) == 0 || kvs[0].Session == "" {
+		return "", nil
+	}
+	return string(kvs[0].Value), nil
+}
+
+// Resign implements FleetStore.
+func (s *ConsulFleetStore) Resign(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == "" {
+		return nil
+	}
+	_, err := s.do(ctx, http.MethodPut, "/v1/session/destroy/"+s.session, nil, nil, nil)
+	s.session = ""
+	return err
+}
+
+// Publish implements FleetStore.
+func (s *ConsulFleetStore) Publish(ctx context.Context, name string, config []byte) error {
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+	if session == "" {
+		return fmt.Errorf("%q is not the leader", name)
+	}
+	var acquired bool
+	if _, err := s.do(ctx, http.MethodPut, s.key("config"), url.Values{"acquire": {session}}, config, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("%q is not the leader", name)
+	}
+	return nil
+}
+
+// Config implements FleetStore.
+func (s *ConsulFleetStore) Config(ctx context.Context) ([]byte, uint64, error) {
+	var kvs []consulKV
+	found, err := s.do(ctx, http.MethodGet, s.key("config"), nil, nil, &kvs)
+	if err != nil || !found || len(kvs) == 0 {
+		return nil, 0, err
+	}
+	return kvs[0].Value, kvs[0].ModifyIndex, nil
+}
+
+// Fleet returns the fleet the instance running the load balancer belongs
+// to, or nil.
+func (lb *LoadBalancer) Fleet() *Fleet { return lb.fleet }
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	// forwardAuthMaxBody bounds the body of a denial copied to the client.
+	forwardAuthMaxBody = 1 << 20
+)
+
+// ForwardAuth asks an external authentication service whether to let each
+// request through, as Traefik's forwardAuth and nginx's auth_request do. It
+// sends a GET request to Address carrying the client's headers, or only
+// RequestHeaders if set, without a body, and with X-Forwarded-Method,
+// X-Forwarded-Proto, X-Forwarded-Host, X-Forwarded-Uri and X-Forwarded-For
+// describing the original request.
+//
+// A 2xx answer lets the request through, with the headers in
+// ResponseHeaders copied from the answer into it, typically the identity
+// of the user (X-Auth-User, X-Auth-Email). Any other answer, such as a 401
+// or a redirect to a login page, is sent to the client instead. OpenID
+// Connect is supported by pointing Address at a service performing the code
+// flow, such as oauth2-proxy.
+type ForwardAuth struct {
+	Address         string
+	RequestHeaders  []string
+	ResponseHeaders []string
+	Client          *http.Client
+}
+
+// NewForwardAuth creates a ForwardAuth asking the service at address.
+func NewForwardAuth(address string) *ForwardAuth {
+	return &ForwardAuth{
+		Address: address,
+		Client: &http.Client{
+			Timeout: defaultForwardAuthTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// check asks the service about r.
+func (fa *ForwardAuth) check(r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fa.Address, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(fa.RequestHeaders) > 0 {
+		for _, name := range fa.RequestHeaders {
+			if v := r.Header.Values(name); len(v) > 0 {
+				req.Header[textproto.CanonicalMIMEHeaderKey(name)] = v
+			}
+		}
+	} else {
+		req.Header = r.Header.Clone()
+		for _, name := range []string{"Connection", "Upgrade", "Content-Length", "Transfer-Encoding", "Te", "Trailer"} {
+			req.Header.Del(name)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if ip := clientIP(r); ip.IsValid() {
+		req.Header.Set("X-Forwarded-For", ip.String())
+	}
+	return fa.Client.Do(req)
+}
+
+// Middleware returns the middleware asking the service about each request.
+// Requests are answered with 503 if the service cannot be reached.
+func (fa *ForwardAuth) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			resp, err := fa.check(r)
+			if err != nil {
+				logf("Forward auth %s: %v", fa.Address, err)
+				httpError(rw, r, "authentication service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				h := rw.Header()
+				for k, v := range resp.Header {
+					h[k] = v
+				}
+				h.Del("Content-Length")
+				rw.WriteHeader(resp.StatusCode)
+				io.Copy(rw, io.LimitReader(resp.Body, forwardAuthMaxBody))
+				return
+			}
+			if len(fa.ResponseHeaders) > 0 {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				for _, name := range fa.ResponseHeaders {
+					r.Header.Del(name)
+					if v := resp.Header.Values(name); len(v) > 0 {
+						r.Header[textproto.CanonicalMIMEHeaderKey(name)] = v
+					}
+				}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
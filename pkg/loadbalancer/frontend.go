@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+// frontend is a frontend of a configuration besides the main one: a load
+// balancer of its own, with its own server and probes.
+type frontend struct {
+	name   string
+	cfg    *config.Config
+	lb     *LoadBalancer
+	prober *Prober
+	// handler serves with the current load balancer of the frontend, which
+	// Reload replaces, keeping srv.
+	handler *swapHandler
+	srv     *http.Server
+}
+
+// buildFrontends builds the load balancers and probes of the frontends of
+// cfg, and checks that they are apart from one another and from the main
+// frontend: their names, ports, pools and routes.
+func buildFrontends(cfg *config.Config) ([]*frontend, error) {
+	names, ports := map[string]bool{}, map[string]string{cfg.Port: "main"}
+	pools, routes := map[string]string{}, map[string]string{}
+	claim := func(kind string, seen map[string]string, key, fe string) error {
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("frontend %q: %s %q is also that of frontend %q", fe, kind, key, other)
+		}
+		seen[key] = fe
+		return nil
+	}
+	for _, pc := range cfg.Pools {
+		pools[pc.Name] = "main"
+	}
+	for _, rc := range cfg.Routes {
+		routes[rc.Name] = "main"
+	}
+	var frontends []*frontend
+	for _, fc := range cfg.Frontends {
+		if fc.Name == "" || fc.Name == "main" {
+			return nil, fmt.Errorf("frontends: name must be set and not be \"main\"")
+		}
+		if names[fc.Name] {
+			return nil, fmt.Errorf("duplicate frontend %q", fc.Name)
+		}
+		names[fc.Name] = true
+		if err := checkFrontend(&fc.Config); err != nil {
+			return nil, fmt.Errorf("frontend %q: %w", fc.Name, err)
+		}
+		if err := claim("port", ports, fc.Port, fc.Name); err != nil {
+			return nil, err
+		}
+		for _, pc := range fc.Pools {
+			if err := claim("pool", pools, pc.Name, fc.Name); err != nil {
+				return nil, err
+			}
+		}
+		for _, rc := range fc.Routes {
+			if err := claim("route", routes, rc.Name, fc.Name); err != nil {
+				return nil, err
+			}
+		}
+		fe, err := buildFrontend(fc)
+		if err != nil {
+			return nil, fmt.Errorf("frontend %q: %w", fc.Name, err)
+		}
+		frontends = append(frontends, fe)
+	}
+	return frontends, nil
+}
+
+// checkFrontend rejects the settings of the process, or of the main
+// frontend only, in the configuration of another frontend.
+func checkFrontend(cfg *config.Config) error {
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"admin", cfg.Admin != nil},
+		{"state_file", cfg.StateFile != ""},
+		{"ha", cfg.HA != nil},
+		{"cluster", cfg.Cluster != nil},
+		{"fleet", cfg.Fleet != nil},
+		{"log_level", cfg.LogLevel != ""},
+		{"anonymize_ips", cfg.AnonymizeIPs != nil},
+		{"extensions", len(cfg.Extensions) > 0},
+		{"shutdown_timeout", cfg.ShutdownTimeout != 0},
+		{"reload_drain", cfg.ReloadDrain != nil},
+		{"http3", cfg.HTTP3 != nil},
+		{"tcp", len(cfg.TCP) > 0},
+		{"udp", len(cfg.UDP) > 0},
+		{"tls_passthrough", len(cfg.TLSPassthrough) > 0},
+		{"frontends", len(cfg.Frontends) > 0},
+	} {
+		if setting.set {
+			return fmt.Errorf("%s is not allowed in a frontend", setting.name)
+		}
+	}
+	if cfg.Port == "" {
+		return fmt.Errorf("port must be set")
+	}
+	return nil
+}
+
+// buildFrontend builds the load balancer and probes of fc; its server is
+// built once, by listen.
+func buildFrontend(fc config.FrontendConfig) (*frontend, error) {
+	fe := &frontend{name: fc.Name, cfg: &fc.Config}
+	var err error
+	if fe.lb, err = Build(fe.cfg); err != nil {
+		return nil, err
+	}
+	if fe.prober, err = buildProber(fe.cfg); err != nil {
+		return nil, err
+	}
+	fe.lb.prober = fe.prober
+	return fe, nil
+}
+
+// listen builds the server of fe, serving with its load balancer until
+// a reload replaces it.
+func (fe *frontend) listen() error {
+	fe.handler = &swapHandler{}
+	fe.handler.store(fe.lb)
+	var err error
+	if fe.srv, err = BuildServer(fe.cfg, fe.handler); err != nil {
+		return fmt.Errorf("frontend %q: %w", fe.name, err)
+	}
+	fe.srv.ConnContext = fe.handler.connContext(fe.srv.ConnContext)
+	return nil
+}
+
+// serve serves the listeners of fe in the background, reporting the errors
+// of those that stop serving to fail.
+func (fe *frontend) serve(fail func(error)) error {
+	listeners, err := Listen(fe.cfg)
+	if err != nil {
+		return fmt.Errorf("frontend %q: %w", fe.name, err)
+	}
+	fe.lb.logf("Serving requests of frontend %q at 'localhost:%s'", fe.name, fe.lb.Port())
+	for _, ln := range listeners {
+		ln = fe.lb.Listener(ln)
+		go func() {
+			var err error
+			if fe.cfg.TLS != nil {
+				err = fe.srv.ServeTLS(ln, fe.cfg.TLS.CertFile, fe.cfg.TLS.KeyFile)
+			} else {
+				err = fe.srv.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fail(fmt.Errorf("frontend %q: %w", fe.name, err))
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var geoBlocked = metrics.NewCounterVec("lb_geo_blocked_total",
+	"Requests from blocked countries or autonomous systems, by country and outcome: blocked, challenged or passed, for challenges solved.", "country", "outcome")
+
+// GeoIP blocking actions.
+const (
+	GeoBlock     = "block"
+	GeoChallenge = "challenge"
+)
+
+// geoChallengeCookie holds the proof that a client solved the challenge.
+const geoChallengeCookie = "lb_geo_challenge"
+
+// defaultGeoChallengeTTL is how long a solved challenge lasts by default.
+const defaultGeoChallengeTTL = time.Hour
+
+// GeoFilter blocks the requests of clients in Countries, by the ISO 3166-1
+// codes the load balancer's GeoIP database resolves, or in the autonomous
+// systems ASNs, as resolved by ASNDatabase, such as a GeoLite2-ASN file.
+// Every decision is logged and counted by country.
+//
+// Action is GeoBlock, answering 403, or GeoChallenge, answering GET and
+// HEAD requests with a page that sets a cookie from JavaScript and reloads,
+// so that browsers get through while most scripts do not. The cookie is
+// bound to the client's address and lasts ChallengeTTL, an hour by default;
+// other requests without one are answered 403. Cookies are signed with
+// Secret, random if empty, which several load balancers serving the same
+// clients should share.
+type GeoFilter struct {
+	Countries    []string
+	ASNs         []uint
+	ASNDatabase  *GeoIP
+	Action       string
+	ChallengeTTL time.Duration
+	Secret       []byte
+}
+
+// NewGeoFilter creates a GeoFilter, checking its settings.
+func NewGeoFilter(countries []string, asns []uint, asnDB *GeoIP, action string) (*GeoFilter, error) {
+	switch action {
+	case "":
+		action = GeoBlock
+	case GeoBlock, GeoChallenge:
+	default:
+		return nil, fmt.Errorf("unknown action %q (want block or challenge)", action)
+	}
+	if len(countries) == 0 && len(asns) == 0 {
+		return nil, fmt.Errorf("countries or asns must be set")
+	}
+	if len(asns) > 0 && asnDB == nil {
+		return nil, fmt.Errorf("asns require an ASN database")
+	}
+	upper := make([]string, len(countries))
+	for i, c := range countries {
+		upper[i] = strings.ToUpper(c)
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &GeoFilter{Countries: upper, ASNs: asns, ASNDatabase: asnDB, Action: action, Secret: secret}, nil
+}
+
+// Middleware returns the middleware blocking or challenging requests. It
+// must run after the country of requests is resolved, as the middleware of
+// a LoadBalancer does.
+func (f *GeoFilter) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			country := requestCountry(r)
+			if !f.blocks(ip, country) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			if f.Action == GeoChallenge {
+				if f.solved(r, ip, time.Now()) {
+					geoBlocked.Inc(country, "passed")
+					next.ServeHTTP(rw, r)
+					return
+				}
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					geoBlocked.Inc(country, "challenged")
+					logf("GeoIP: challenged %s %s from %s (country %q)", r.Method, r.RequestURI, logIP(ip), country)
+					f.challenge(rw, ip, time.Now())
+					return
+				}
+			}
+			geoBlocked.Inc(country, "blocked")
+			logf("GeoIP: blocked %s %s from %s (country %q)", r.Method, r.RequestURI, logIP(ip), country)
+			httpError(rw, r, "403 forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+// blocks reports whether the client at ip, in country, is to be blocked.
+func (f *GeoFilter) blocks(ip netip.Addr, country string) bool {
+	if country != "" && slices.Contains(f.Countries, country) {
+		return true
+	}
+	if len(f.ASNs) == 0 || !ip.IsValid() {
+		return false
+	}
+	asn := f.ASNDatabase.ASN(ip)
+	return asn != 0 && slices.Contains(f.ASNs, asn)
+}
+
+// sign returns the signature of a challenge solved by the client at ip,
+// lasting until expires.
+func (f *GeoFilter) sign(ip netip.Addr, expires int64) string {
+	h := hmac.New(sha256.New, f.Secret)
+	fmt.Fprintf(h, "%s|%d", ip, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// solved reports whether r carries the cookie of a challenge the client at
+// ip solved that has not expired.
+func (f *GeoFilter) solved(r *http.Request, ip netip.Addr, now time.Time) bool {
+	c, err := r.Cookie(geoChallengeCookie)
+	if err != nil {
+		return false
+	}
+	exp, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(f.sign(ip, expires)))
+}
+
+var geoChallengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body><p>Checking your browser&hellip;</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>document.cookie = {{.Cookie}}; location.reload();</script>
+</body></html>
+`))
+
+// challenge answers with the challenge page of the client at ip.
+func (f *GeoFilter) challenge(rw http.ResponseWriter, ip netip.Addr, now time.Time) {
+	ttl := f.ChallengeTTL
+	if ttl <= 0 {
+		ttl = defaultGeoChallengeTTL
+	}
+	expires := now.Add(ttl).Unix()
+	cookie := fmt.Sprintf("%s=%d.%s; Path=/; Max-Age=%d; SameSite=Lax",
+		geoChallengeCookie, expires, f.sign(ip, expires), int(ttl.Seconds()))
+	h := rw.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	geoChallengePage.Execute(rw, struct{ Cookie string }{cookie})
+}
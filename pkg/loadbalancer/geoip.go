@@ -0,0 +1,294 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+)
+
+// GeoIP resolves client addresses against a MaxMind DB (.mmdb) file such as
+// GeoLite2-Country or GeoIP2-City. The whole file is held in memory.
+type GeoIP struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// OpenGeoIP loads a MaxMind DB file.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metaStart := i + len(mmdbMetadataMarker)
+	d := mmdbDecoder{data: data[metaStart:]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", path)
+	}
+	g := &GeoIP{
+		nodeCount:  uint(toUint(meta["node_count"])),
+		recordSize: uint(toUint(meta["record_size"])),
+		ipVersion:  uint(toUint(meta["ip_version"])),
+	}
+	switch g.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, g.recordSize)
+	}
+	g.treeSize = g.recordSize * 2 / 8 * g.nodeCount
+	if g.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: search tree exceeds file size", path)
+	}
+	g.data = data[:i]
+	if g.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < g.nodeCount; j++ {
+			node = g.readNode(node, 0)
+		}
+		g.ipv4Start = node
+	}
+	return g, nil
+}
+
+// Lookup returns the record stored for ip, or nil if the database has none.
+func (g *GeoIP) Lookup(ip netip.Addr) (map[string]any, error) {
+	ip = ip.Unmap()
+	node := uint(0)
+	var bits []byte
+	if ip.Is4() {
+		if g.ipVersion == 6 {
+			node = g.ipv4Start
+		}
+		b := ip.As4()
+		bits = b[:]
+	} else {
+		if g.ipVersion == 4 {
+			return nil, nil
+		}
+		b := ip.As16()
+		bits = b[:]
+	}
+	for i := 0; i < len(bits)*8 && node < g.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = g.readNode(node, bit)
+	}
+	if node == g.nodeCount {
+		return nil, nil
+	}
+	if node < g.nodeCount {
+		return nil, errors.New("mmdb: search tree too shallow")
+	}
+	offset := node - g.nodeCount - 16
+	d := mmdbDecoder{data: g.data[g.treeSize+16:]}
+	v, _, err := d.decode(int(offset))
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := v.(map[string]any)
+	return rec, nil
+}
+
+// Country returns the ISO 3166-1 country code for ip, or "" if unknown.
+func (g *GeoIP) Country(ip netip.Addr) string {
+	rec, err := g.Lookup(ip)
+	if err != nil || rec == nil {
+		return ""
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// ASN returns the number of the autonomous system announcing ip, as found
+// in ASN databases such as GeoLite2-ASN, or 0 if unknown.
+func (g *GeoIP) ASN(ip netip.Addr) uint {
+	rec, err := g.Lookup(ip)
+	if err != nil || rec == nil {
+		return 0
+	}
+	return uint(toUint(rec["autonomous_system_number"]))
+}
+
+func (g *GeoIP) readNode(node, bit uint) uint {
+	switch g.recordSize {
+	case 24:
+		b := g.data[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := g.data[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(g.data[node*8+bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes the MaxMind DB data section format.
+type mmdbDecoder struct {
+	data []byte
+}
+
+var errMMDBTruncated = errors.New("mmdb: truncated data")
+
+func (d mmdbDecoder) decode(offset int) (any, int, error) {
+	if offset >= len(d.data) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		if offset >= len(d.data) {
+			return nil, 0, errMMDBTruncated
+		}
+		typ = 7 + int(d.data[offset])
+		offset++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.data) {
+			return nil, 0, errMMDBTruncated
+		}
+		v := 0
+		for _, b := range d.data[offset : offset+n] {
+			v = v<<8 | int(b)
+		}
+		size = [...]int{0, 29, 285, 65821}[n] + v
+		offset += n
+	}
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+	if offset+size > len(d.data) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("mmdb: double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return b, offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (truncated to 64 bits)
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("mmdb: float of size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+func (d mmdbDecoder) pointer(ctrl byte, offset int) (int, int, error) {
+	n := int(ctrl>>3)&3 + 1
+	if offset+n > len(d.data) {
+		return 0, 0, errMMDBTruncated
+	}
+	v := 0
+	if n < 4 {
+		v = int(ctrl & 7)
+	}
+	for _, b := range d.data[offset : offset+n] {
+		v = v<<8 | int(b)
+	}
+	v += [...]int{0, 0, 2048, 526336, 0}[n]
+	return v, offset + n, nil
+}
+
+func toUint(v any) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
+
+type countryKey struct{}
+
+// withCountry returns r carrying the client's resolved country.
+func withCountry(r *http.Request, country string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), countryKey{}, country))
+}
+
+// requestCountry returns the country resolved for r, or "" if unknown.
+func requestCountry(r *http.Request) string {
+	c, _ := r.Context().Value(countryKey{}).(string)
+	return c
+}
@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// Pool protocols.
+const (
+	ProtocolHTTP = "http"
+	// ProtocolGRPC speaks HTTP/2 to every server of the pool: over TLS for
+	// https servers and with prior knowledge (h2c) for http servers.
+	ProtocolGRPC = "grpc"
+)
+
+// gRPC status codes, as used when the load balancer answers a call itself.
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+var grpcCalls = metrics.NewCounterVec("lb_grpc_calls_total",
+	"gRPC calls proxied, by final status code.", "pool", "method", "code")
+
+// http2Transport carries gRPC calls and h2c traffic to backends. It speaks
+// HTTP/2 only: over TLS for https servers and with prior knowledge for http
+// servers.
+var http2Transport = newHTTP2Transport(NewTransport(TransportOptions{}))
+
+// newHTTP2Transport returns a copy of base speaking HTTP/2 only.
+func newHTTP2Transport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// NewGRPCServer creates a SimpleServer proxying gRPC calls to addr over
+// HTTP/2. Trailers, which carry the gRPC status, are passed through, and
+// response messages are flushed as soon as they arrive.
+//
+// Calls are balanced individually: every call on a client's HTTP/2
+// connection is a separate request picking its own server, so long-lived
+// clients spread over the whole pool instead of sticking to the backend
+// their connection first reached.
+func NewGRPCServer(addr string) (*SimpleServer, error) {
+	return newGRPCServer(addr, http2Transport)
+}
+
+// newGRPCServer creates a gRPC server proxying through t, which must speak
+// HTTP/2 only.
+func newGRPCServer(addr string, t *http.Transport) (*SimpleServer, error) {
+	s, err := newSimpleServer(addr, t)
+	if err != nil {
+		return nil, err
+	}
+	s.proxy.FlushInterval = -1
+	s.errorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		grpcError(rw, grpcUnavailable, err.Error())
+	}
+	return s, nil
+}
+
+// NewH2CServer creates a SimpleServer speaking cleartext HTTP/2 (h2c) with
+// prior knowledge to addr, which must be an http:// or unix:// URL.
+func NewH2CServer(addr string) (*SimpleServer, error) {
+	return newH2CServer(addr, http2Transport)
+}
+
+func newH2CServer(addr string, t *http.Transport) (*SimpleServer, error) {
+	s, err := newSimpleServer(addr, t)
+	if err != nil {
+		return nil, err
+	}
+	if s.target.Scheme != "http" {
+		return nil, fmt.Errorf("%w %q: h2c requires an http:// or unix:// address", ErrInvalidBackendURL, addr)
+	}
+	return s, nil
+}
+
+// serveGRPC proxies a gRPC call to server and records its status.
+func serveGRPC(rw http.ResponseWriter, r *http.Request, pool *Pool, server backend.Server) {
+	server.Serve(rw, r)
+	// The status arrives in the trailers, or in the headers of a
+	// trailers-only response.
+	h := rw.Header()
+	code := h.Get("Grpc-Status")
+	if code == "" {
+		code = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if code == "" {
+		code = "unknown"
+	}
+	grpcCalls.Inc(pool.Name, r.URL.Path, code)
+}
+
+// isGRPC reports whether r is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") ||
+		strings.HasPrefix(ct, "application/grpc;")
+}
+
+// grpcCode maps an HTTP status to a gRPC status code as the gRPC HTTP/2
+// protocol specification does for clients.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// httpError replies to r with an error, as a gRPC status for gRPC calls and
+// as a plain HTTP error otherwise.
+func httpError(rw http.ResponseWriter, r *http.Request, msg string, status int) {
+	if isGRPC(r) {
+		grpcError(rw, grpcCode(status), msg)
+		return
+	}
+	http.Error(rw, msg, status)
+}
+
+// grpcError answers a gRPC call with a trailers-only response carrying code
+// and msg, which gRPC clients understand where a plain HTTP error would be
+// reported as a protocol failure.
+func grpcError(rw http.ResponseWriter, code int, msg string) {
+	h := rw.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", grpcPercentEncode(msg))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// grpcPercentEncode encodes msg for the grpc-message header.
+func grpcPercentEncode(msg string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
@@ -0,0 +1,323 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	haActive = metrics.NewGaugeVec("lb_ha_active",
+		"Whether the instance is the active one of its HA pair.")
+	haTransitions = metrics.NewCounterVec("lb_ha_transitions_total",
+		"Changes of the HA role of the instance, by role taken: active or standby.", "role")
+	haHeartbeatFailures = metrics.NewCounterVec("lb_ha_heartbeat_failures_total",
+		"Heartbeats to the HA peer that went unanswered.")
+)
+
+const (
+	defaultHAInterval  = time.Second
+	defaultHADeadAfter = 3 * time.Second
+	// haHookTimeout bounds the commands and webhook run on a role change.
+	haHookTimeout = 30 * time.Second
+)
+
+// HARole is the role of an instance of an HA pair.
+type HARole string
+
+const (
+	// HAStandby is the role of the instance waiting to take over.
+	HAStandby HARole = "standby"
+	// HAActive is the role of the instance taking the traffic.
+	HAActive HARole = "active"
+)
+
+// HAStatus is what an instance of an HA pair reports of itself on GET /ha,
+// which the peer heartbeats with. With ?state=1, the active instance also
+// sends its runtime state, for the standby to take over with.
+type HAStatus struct {
+	Name     string        `json:"name"`
+	Role     HARole        `json:"role"`
+	Priority int           `json:"priority"`
+	Since    time.Time     `json:"since"`
+	Peer     *HAPeerStatus `json:"peer,omitempty"`
+	State    *State        `json:"state,omitempty"`
+}
+
+// HAPeerStatus is what an instance knows of its peer: its name and role as
+// of the last heartbeat answered, and the error of the last one if it
+// failed.
+type HAPeerStatus struct {
+	Name     string    `json:"name,omitempty"`
+	Role     HARole    `json:"role,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// HA runs an instance as one of an active-passive pair with the instance
+// whose admin API is at Peer. Every Interval it fetches the peer's status,
+// and the runtime state of the active one: servers added and removed
+// through the admin API, weights, drains and the rest of State. A standby
+// that got no answer for DeadAfter takes over, restoring the last state
+// the active sent. Of two instances both active, after a partition, or both
+// standby, on start, the one with the higher Priority is active, then the
+// one active first, then the one whose Name sorts first; an instance
+// coming back does not take over from an active peer.
+//
+// Both instances serve requests whatever their role: moving traffic to the
+// active one is left to OnActive and OnStandby, commands run when the
+// instance becomes active or standby with LB_HA_ROLE, LB_HA_NAME and
+// LB_HA_PEER set, and to Webhook, a URL sent the same as JSON, for instance
+// to move a floating IP or update a DNS record.
+type HA struct {
+	Name      string
+	Peer      string
+	PeerToken string
+	Priority  int
+	Interval  time.Duration
+	DeadAfter time.Duration
+	OnActive  []string
+	OnStandby []string
+	Webhook   string
+	Client    *http.Client
+
+	// lb returns the load balancer the instance currently runs.
+	lb func() *LoadBalancer
+
+	mu    sync.Mutex
+	role  HARole
+	since time.Time
+	peer  HAPeerStatus
+	// handoff is the last state the active peer sent.
+	handoff *State
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewHA creates an HA instance, standby until it hears from the peer at peer,
+// the base URL of its admin API, taking over the load balancer lb returns.
+func NewHA(name, peer string, lb func() *LoadBalancer) *HA {
+	return &HA{
+		Name:      name,
+		Peer:      strings.TrimSuffix(peer, "/"),
+		Interval:  defaultHAInterval,
+		DeadAfter: defaultHADeadAfter,
+		Client:    http.DefaultClient,
+		lb:        lb,
+		role:      HAStandby,
+	}
+}
+
+// Start starts heartbeating the peer in the background. The peer has
+// DeadAfter from then to answer before the instance takes over.
+func (ha *HA) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ha.mu.Lock()
+	ha.since = time.Now()
+	ha.peer.LastSeen = ha.since
+	ha.cancel, ha.done = cancel, make(chan struct{})
+	ha.mu.Unlock()
+	haActive.Set(0)
+	logf("HA: %q starting as standby of %q", ha.Name, ha.Peer)
+	go ha.run(ctx)
+}
+
+// Stop stops heartbeating the peer, which takes over after DeadAfter if the
+// instance was active.
+func (ha *HA) Stop() {
+	if ha == nil || ha.cancel == nil {
+		return
+	}
+	ha.cancel()
+	<-ha.done
+}
+
+// Active reports whether the instance is the active one. Nil HA is always
+// active.
+func (ha *HA) Active() bool {
+	if ha == nil {
+		return true
+	}
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	return ha.role == HAActive
+}
+
+// Status returns the status of the instance, without its state.
+func (ha *HA) Status() HAStatus {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	peer := ha.peer
+	return HAStatus{Name: ha.Name, Role: ha.role, Priority: ha.Priority, Since: ha.since, Peer: &peer}
+}
+
+func (ha *HA) run(ctx context.Context) {
+	defer close(ha.done)
+	t := time.NewTicker(ha.Interval)
+	defer t.Stop()
+	for {
+		peer, err := ha.heartbeat(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			haHeartbeatFailures.Inc()
+		}
+		if role, reason := ha.observe(peer, err); role != "" {
+			ha.become(ctx, role, reason)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// heartbeat fetches the status of the peer, with its state.
+func (ha *HA) heartbeat(ctx context.Context) (*HAStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, ha.Interval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ha.Peer+"/ha?state=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	if ha.PeerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ha.PeerToken)
+	}
+	resp, err := ha.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /ha: %s", resp.Status)
+	}
+	var st HAStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("GET /ha: %w", err)
+	}
+	if st.Role != HAActive && st.Role != HAStandby {
+		return nil, fmt.Errorf("GET /ha: unknown role %q", st.Role)
+	}
+	return &st, nil
+}
+
+// observe records the outcome of a heartbeat and returns the role the
+// instance must take, and why, or "" to keep its own.
+func (ha *HA) observe(peer *HAStatus, err error) (HARole, string) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	now := time.Now()
+	if err != nil {
+		if ha.peer.Error == "" {
+			logf("HA: heartbeat to %q failed: %v", ha.Peer, err)
+		}
+		ha.peer.Error = err.Error()
+		if ha.role == HAStandby && now.Sub(ha.peer.LastSeen) >= ha.DeadAfter {
+			return HAActive, fmt.Sprintf("peer unreachable for %v", ha.DeadAfter)
+		}
+		return "", ""
+	}
+	if ha.peer.Error != "" {
+		logf("HA: peer %q reachable again", peer.Name)
+	}
+	ha.peer = HAPeerStatus{Name: peer.Name, Role: peer.Role, LastSeen: now}
+	if peer.Role == HAActive && peer.State != nil {
+		ha.handoff = peer.State
+	}
+	switch {
+	case ha.role == HAActive && peer.Role == HAActive && !ha.outranks(peer):
+		return HAStandby, fmt.Sprintf("peer %q is active too and outranks it", peer.Name)
+	case ha.role == HAStandby && peer.Role == HAStandby && ha.outranks(peer):
+		return HAActive, fmt.Sprintf("peer %q is standby too and ranks below it", peer.Name)
+	}
+	return "", ""
+}
+
+// outranks reports whether the instance rather than peer, in the same role,
+// must be active. ha.mu must be held.
+func (ha *HA) outranks(peer *HAStatus) bool {
+	if ha.Priority != peer.Priority {
+		return ha.Priority > peer.Priority
+	}
+	if ha.role == HAActive && !ha.since.Equal(peer.Since) {
+		return ha.since.Before(peer.Since)
+	}
+	return ha.Name < peer.Name
+}
+
+// become switches the instance to role, restoring the state handed off by
+// the peer when taking over, and runs the hooks of role.
+func (ha *HA) become(ctx context.Context, role HARole, reason string) {
+	ha.mu.Lock()
+	ha.role, ha.since = role, time.Now()
+	handoff, peer := ha.handoff, ha.peer.Name
+	ha.mu.Unlock()
+	logf("HA: %q becoming %s: %s", ha.Name, role, reason)
+	haTransitions.Inc(string(role))
+	hook := ha.OnStandby
+	if role == HAActive {
+		haActive.Set(1)
+		hook = ha.OnActive
+		if handoff != nil {
+			lb := ha.lb()
+			lb.logf("HA: restoring the runtime state the peer saved at %v", handoff.Saved)
+			if err := lb.Restore(handoff); err != nil {
+				lb.logf("HA: runtime state not fully restored: %v", err)
+			}
+			if err := lb.SaveState(); err != nil {
+				lb.logf("Failed to save runtime state: %v", err)
+			}
+		}
+	} else {
+		haActive.Set(0)
+	}
+	ctx, cancel := context.WithTimeout(ctx, haHookTimeout)
+	defer cancel()
+	if len(hook) > 0 {
+		cmd := exec.CommandContext(ctx, hook[0], hook[1:]...)
+		cmd.Env = append(os.Environ(), "LB_HA_ROLE="+string(role), "LB_HA_NAME="+ha.Name, "LB_HA_PEER="+peer)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logf("HA: %s command failed: %v: %s", role, err, bytes.TrimSpace(out))
+		}
+	}
+	if ha.Webhook != "" {
+		if err := ha.notify(ctx, role, peer, reason); err != nil {
+			logf("HA: %s webhook failed: %v", role, err)
+		}
+	}
+}
+
+// notify posts the role change to the webhook.
+func (ha *HA) notify(ctx context.Context, role HARole, peer, reason string) error {
+	body, _ := json.Marshal(map[string]string{"name": ha.Name, "role": string(role), "peer": peer, "reason": reason})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ha.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ha.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// HA returns the HA pairing of the instance running the load balancer, or
+// nil.
+func (lb *LoadBalancer) HA() *HA { return lb.ha }
@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// hashRingReplicas is the number of points each server occupies on the ring.
+// More points spread keys more evenly at the cost of memory.
+const hashRingReplicas = 128
+
+// hashRing is a consistent hash ring over a fixed set of servers. Adding or
+// removing a server only remaps the keys owned by its points.
+type hashRing struct {
+	servers []backend.Server
+	points  []uint64
+	owners  []backend.Server
+}
+
+func newHashRing(servers []backend.Server) *hashRing {
+	type point struct {
+		hash  uint64
+		owner backend.Server
+	}
+	pts := make([]point, 0, len(servers)*hashRingReplicas)
+	for _, s := range servers {
+		id := serverID(s)
+		for i := range hashRingReplicas {
+			pts = append(pts, point{hashKey(id + "#" + strconv.Itoa(i)), s})
+		}
+	}
+	slices.SortFunc(pts, func(a, b point) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	ring := &hashRing{servers: servers, points: make([]uint64, len(pts)), owners: make([]backend.Server, len(pts))}
+	for i, p := range pts {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv clusters similar short keys; finalize with a mixer to spread them.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// lookup returns the server owning key and the first live server at or after
+// the owner's point, or nils for an empty ring. The two are equal when the
+// owner is alive. Drained servers count as dead unless they keep their
+// sticky clients.
+func (r *hashRing) lookup(key string) (owner, live backend.Server) {
+	if len(r.points) == 0 {
+		return nil, nil
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for n := range r.points {
+		s := r.owners[(i+n)%len(r.points)]
+		if owner == nil {
+			owner = s
+		}
+		if backend.AvailableSticky(s) {
+			return owner, s
+		}
+	}
+	return owner, nil
+}
@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var sensitiveStripped = metrics.NewCounterVec("lb_sensitive_headers_stripped_total",
+	"Sensitive headers removed from client requests, by configured name.", "header")
+
+// hopHeaders are the hop-by-hop headers, which apply to a single connection
+// and are never forwarded, besides those the Connection header lists.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// hasHopHeaders reports whether h has a hop-by-hop header.
+func hasHopHeaders(h http.Header) bool {
+	for _, name := range hopHeaders {
+		if _, ok := h[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of h and those its
+// Connection header lists.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// matchHeader reports whether the canonical header name matches pattern,
+// a name or, ending in "*", a prefix of names.
+func matchHeader(pattern, name string) bool {
+	if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+		return strings.HasPrefix(name, textproto.CanonicalMIMEHeaderKey(prefix))
+	}
+	return name == textproto.CanonicalMIMEHeaderKey(pattern)
+}
+
+// sanitize returns r without the hop-by-hop headers and sensitive headers
+// of the client, so that none reaches backends whatever the protocol they
+// are forwarded with. The upgrade of a protocol upgrade and the TE of
+// "trailers", which gRPC requires, are kept for the proxy to forward
+// afresh.
+func (lb *LoadBalancer) sanitize(r *http.Request) *http.Request {
+	sensitive := func(name string) string {
+		for _, pattern := range lb.sensitiveHeaders {
+			if matchHeader(pattern, name) {
+				return pattern
+			}
+		}
+		return ""
+	}
+	dirty := hasHopHeaders(r.Header)
+	for name := range r.Header {
+		if dirty {
+			break
+		}
+		dirty = sensitive(name) != ""
+	}
+	if !dirty {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	h := r.Header.Clone()
+	upgrade := ""
+	if headerHasToken(h, "Connection", "upgrade") {
+		upgrade = h.Get("Upgrade")
+	}
+	trailers := headerHasToken(h, "Te", "trailers")
+	removeHopHeaders(h)
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	for name := range h {
+		if pattern := sensitive(name); pattern != "" {
+			delete(h, name)
+			sensitiveStripped.Inc(pattern)
+		}
+	}
+	r.Header = h
+	return r
+}
+
+// HeaderOps edits a header: Remove deletes headers, a name ending in "*"
+// deleting every header with that prefix, then Set replaces headers and Add
+// appends values to them.
+type HeaderOps struct {
+	Remove []string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+// empty reports whether ops changes nothing.
+func (ops *HeaderOps) empty() bool {
+	return ops == nil || len(ops.Remove) == 0 && len(ops.Set) == 0 && len(ops.Add) == 0
+}
+
+// apply edits h.
+func (ops *HeaderOps) apply(h http.Header) {
+	for _, name := range ops.Remove {
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if !wildcard {
+			h.Del(name)
+			continue
+		}
+		prefix = textproto.CanonicalMIMEHeaderKey(prefix)
+		for k := range h {
+			if strings.HasPrefix(textproto.CanonicalMIMEHeaderKey(k), prefix) {
+				delete(h, k)
+			}
+		}
+	}
+	for name, value := range ops.Set {
+		h.Set(name, value)
+	}
+	for name, value := range ops.Add {
+		h.Add(name, value)
+	}
+}
+
+// HeaderRules edits the headers of the requests sent to backends and of the
+// responses sent to clients. Setting the request's Host header changes the
+// host forwarded to the backend.
+type HeaderRules struct {
+	Request  *HeaderOps
+	Response *HeaderOps
+}
+
+// Middleware returns the middleware applying the rules.
+func (hr *HeaderRules) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !hr.Request.empty() {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				hr.Request.apply(r.Header)
+				if host := r.Header.Get("Host"); host != "" {
+					r.Host = host
+					r.Header.Del("Host")
+				}
+			}
+			if !hr.Response.empty() {
+				rw = &headerWriter{ResponseWriter: rw, ops: hr.Response}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// headerWriter edits the header of a response before it is sent.
+type headerWriter struct {
+	http.ResponseWriter
+	ops  *HeaderOps
+	done bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.done && code >= 200 {
+		w.done = true
+		w.ops.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
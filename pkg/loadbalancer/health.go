@@ -0,0 +1,54 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// StartHealthCheck probes every server of the pool in the background and
+// updates its liveness, emitting BackendUp and BackendDown on transitions.
+// It returns immediately.
+func (p *Pool) StartHealthCheck() {
+	c := p.healthCheck
+	change := c.OnChange
+	c.OnChange = func(server backend.Server, alive bool) {
+		if change != nil {
+			change(server, alive)
+		}
+		if alive {
+			emit(BackendUp{Time: time.Now(), Pool: p.Name, Server: server})
+		} else {
+			emit(BackendDown{Time: time.Now(), Pool: p.Name, Server: server})
+		}
+	}
+	c.Start(p.ctx, p.Name, p.Servers)
+}
+
+// Probe implements health.Prober: TCP and UDP servers are alive if they
+// accept connections.
+func (s *NetServer) Probe(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	if s.ProxyProtocol != 0 {
+		writeProxyHeader(conn, s.ProxyProtocol, nil, nil)
+	}
+	conn.Close()
+	return nil
+}
+
+// Transport implements health.Proxied.
+func (s *SimpleServer) Transport() http.RoundTripper {
+	return s.transport
+}
+
+// URL implements health.Proxied.
+func (s *SimpleServer) URL() string {
+	return s.target.String()
+}
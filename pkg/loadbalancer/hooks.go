@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ProxyHooks are functions a pool runs around the requests its servers
+// proxy, at the hook points of httputil.ReverseProxy. Any may be nil.
+//
+// Director edits the outbound request after it was pointed at the server.
+// ModifyResponse edits the server's response before it is copied to the
+// client; an error it returns is handled as a proxy error. ErrorHandler
+// answers the client when the server cannot be reached or ModifyResponse
+// fails, instead of the default 502 Bad Gateway.
+//
+// The hooks apply to servers built with NewSimpleServer, NewGRPCServer and
+// NewH2CServer, including those discovered or added at runtime, but not to
+// WebSocket connections, which are proxied at the connection level.
+type ProxyHooks struct {
+	Director       func(*http.Request)
+	ModifyResponse func(*http.Response) error
+	ErrorHandler   func(http.ResponseWriter, *http.Request, error)
+}
+
+// SetProxyHooks replaces the proxy hooks of the pool; nil removes them.
+func (p *Pool) SetProxyHooks(h *ProxyHooks) {
+	p.hooks.Store(h)
+}
+
+// ProxyHooks returns the proxy hooks of the pool, or nil.
+func (p *Pool) ProxyHooks() *ProxyHooks {
+	return p.hooks.Load()
+}
+
+// SetProxyHooks replaces the proxy hooks of the named pool.
+func (lb *LoadBalancer) SetProxyHooks(pool string, h *ProxyHooks) error {
+	p := lb.Pool(pool)
+	if p == nil {
+		return fmt.Errorf("%w %q", ErrPoolNotFound, pool)
+	}
+	p.SetProxyHooks(h)
+	return nil
+}
+
+type proxyHooksKey struct{}
+
+// withProxyHooks returns r carrying the proxy hooks of pool, if it has any,
+// for the server it is sent to.
+func withProxyHooks(r *http.Request, pool *Pool) *http.Request {
+	h := pool.ProxyHooks()
+	if h == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyHooksKey{}, h))
+}
+
+// proxyHooks returns the proxy hooks carried by ctx, or nil.
+func proxyHooks(ctx context.Context) *ProxyHooks {
+	h, _ := ctx.Value(proxyHooksKey{}).(*ProxyHooks)
+	return h
+}
+
+// installHooks makes the reverse proxy of s run the hooks of the pool a
+// request is served for.
+func (s *SimpleServer) installHooks() {
+	director := s.proxy.Director
+	s.proxy.Director = func(r *http.Request) {
+		director(r)
+		if h := proxyHooks(r.Context()); h != nil && h.Director != nil {
+			h.Director(r)
+		}
+	}
+	s.proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			s.Fail()
+		}
+		if h := proxyHooks(resp.Request.Context()); h != nil && h.ModifyResponse != nil {
+			return h.ModifyResponse(resp)
+		}
+		return nil
+	}
+	s.proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() == nil {
+			// Requests the client gave up on did not fail on the server.
+			s.Fail()
+			requestFailed(s, r, err)
+		}
+		switch h := proxyHooks(r.Context()); {
+		case h != nil && h.ErrorHandler != nil:
+			h.ErrorHandler(rw, r, err)
+		case s.errorHandler != nil:
+			s.errorHandler(rw, r, err)
+		default:
+			logf("http: proxy error: %v", err)
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
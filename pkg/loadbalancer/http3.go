@@ -0,0 +1,74 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// HTTP3Server serves HTTP/3 over QUIC. The standard library has no QUIC
+// implementation, so a server is only available in builds with the quic tag,
+// which provide one backed by quic-go.
+type HTTP3Server interface {
+	ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error
+	Close() error
+}
+
+// newHTTP3Server is set by the QUIC-enabled build.
+var newHTTP3Server func() HTTP3Server
+
+// HTTP3 runs an experimental HTTP/3 frontend next to the TCP listener and
+// advertises it to TCP clients in the Alt-Svc header, so that clients
+// supporting HTTP/3 switch to it on their next connection.
+type HTTP3 struct {
+	Addr   string
+	MaxAge time.Duration
+
+	server HTTP3Server
+	altSvc string
+}
+
+// NewHTTP3 creates an HTTP/3 frontend listening on addr (UDP). A zero maxAge
+// advertises it for 24 hours.
+func NewHTTP3(addr string, maxAge time.Duration) (*HTTP3, error) {
+	if newHTTP3Server == nil {
+		return nil, fmt.Errorf("HTTP/3 is not supported by this build (rebuild with -tags quic)")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if maxAge <= 0 {
+		maxAge = defaultAltSvcMaxAge
+	}
+	return &HTTP3{
+		Addr:   addr,
+		MaxAge: maxAge,
+		server: newHTTP3Server(),
+		altSvc: fmt.Sprintf(`h3=":%s"; ma=%d`, port, int(maxAge/time.Second)),
+	}, nil
+}
+
+// ListenAndServeTLS serves handler over HTTP/3 with the given certificate.
+func (h *HTTP3) ListenAndServeTLS(certFile, keyFile string, handler http.Handler) error {
+	return h.server.ListenAndServeTLS(h.Addr, certFile, keyFile, handler)
+}
+
+// Close stops the HTTP/3 frontend, closing its connections.
+func (h *HTTP3) Close() error {
+	return h.server.Close()
+}
+
+// Advertise wraps handler so that its responses carry the Alt-Svc header
+// announcing the HTTP/3 endpoint.
+func (h *HTTP3) Advertise(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			rw.Header().Set("Alt-Svc", h.altSvc)
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,37 @@
+//go:build quic
+
+package loadbalancer
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	newHTTP3Server = func() HTTP3Server { return &quicServer{} }
+}
+
+// quicServer serves HTTP/3 with quic-go.
+type quicServer struct {
+	mu  sync.Mutex
+	srv *http3.Server
+}
+
+func (s *quicServer) ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
+	srv := &http3.Server{Addr: addr, Handler: handler}
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+func (s *quicServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
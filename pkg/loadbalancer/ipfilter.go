@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var ipDenied = metrics.NewCounterVec("lb_ip_denied_total",
+	"Requests, connections and datagrams refused by an IP filter, by listener or route.", "filter")
+
+// IPFilter allows or denies clients by address. A client in Deny is denied;
+// otherwise it is allowed if Allow is empty or contains it. A nil IPFilter
+// allows every client.
+type IPFilter struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// NewIPFilter creates an IPFilter.
+func NewIPFilter(allow, deny []netip.Prefix) *IPFilter {
+	return &IPFilter{Allow: allow, Deny: deny}
+}
+
+// Allows reports whether the client at ip is allowed. An invalid address is
+// only allowed without an allowlist.
+func (f *IPFilter) Allows(ip netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	contains := func(p netip.Prefix) bool { return p.Contains(ip) }
+	if ip.IsValid() && slices.ContainsFunc(f.Deny, contains) {
+		return false
+	}
+	return len(f.Allow) == 0 || slices.ContainsFunc(f.Allow, contains)
+}
+
+// Middleware returns the middleware answering requests from denied clients,
+// identified by their address after the forwarding headers of trusted
+// proxies are resolved, with 403. Denials are counted under name.
+func (f *IPFilter) Middleware(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !f.Allows(clientIP(r)) {
+				ipDenied.Inc(name)
+				httpError(rw, r, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// addrIP returns the IP address of a TCP or UDP address.
+func addrIP(addr net.Addr) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
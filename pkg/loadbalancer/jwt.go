@@ -0,0 +1,437 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultJWKSRefresh is how often the keys are fetched again.
+	defaultJWKSRefresh = time.Hour
+	// jwksMinRefresh bounds how often the keys are fetched again, when a
+	// token is signed by an unknown key or after failing to.
+	jwksMinRefresh = time.Minute
+)
+
+// JWT requires requests to carry a JSON Web Token signed by one of the keys
+// published at a JWKS URL, and not expired. Tokens are read from the
+// Authorization header as bearer tokens or, if Cookie is set, from that
+// cookie. If Issuer or Audiences are set, the token's iss claim must equal
+// Issuer and its aud claim contain one of Audiences. Leeway allows for
+// clock skew in exp, nbf and iat.
+//
+// Claims maps claim names to headers the claims are forwarded to backends
+// in, replacing any sent by the client; claims that are not strings are
+// sent as JSON.
+//
+// Keys are fetched again every Refresh in the background, requests being
+// verified with those fetched before meanwhile; only requests with tokens
+// signed by an unknown key wait for them to be fetched, once a minute at
+// most.
+type JWT struct {
+	JWKSURL   string
+	Issuer    string
+	Audiences []string
+	Cookie    string
+	Leeway    time.Duration
+	Claims    map[string]string
+	Refresh   time.Duration
+	Client    *http.Client
+
+	keys atomic.Pointer[jwkSet]
+
+	mu sync.Mutex
+	// fetching is closed once the keys being fetched are, if they are.
+	fetching chan struct{}
+	tried    time.Time
+}
+
+// jwkSet is the keys fetched, by ID, the algorithms of those whose JWK
+// names one, and when.
+type jwkSet struct {
+	keys    map[string]crypto.PublicKey
+	algs    map[string]string
+	fetched time.Time
+}
+
+// NewJWT creates a JWT verifying tokens with the keys at jwksURL, which are
+// fetched right away.
+func NewJWT(jwksURL, issuer string, audiences []string) (*JWT, error) {
+	if jwksURL == "" {
+		return nil, fmt.Errorf("jwks_url is required")
+	}
+	j := &JWT{
+		JWKSURL:   jwksURL,
+		Issuer:    issuer,
+		Audiences: audiences,
+		Refresh:   defaultJWKSRefresh,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := j.fetch(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// jwk is a JSON Web Key, of which the RSA, EC and Ed25519 kinds are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch fetches the keys.
+func (j *JWT) fetch() error {
+	resp, err := j.Client.Get(j.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", j.JWKSURL, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("%s: %w", j.JWKSURL, err)
+	}
+	keys, algs := map[string]crypto.PublicKey{}, map[string]string{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logf("JWKS %s: skipping key %q: %v", j.JWKSURL, k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+		if k.Alg != "" {
+			algs[k.Kid] = k.Alg
+		}
+	}
+	j.keys.Store(&jwkSet{keys: keys, algs: algs, fetched: time.Now()})
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the key with ID kid and the algorithm its JWK names, if any,
+// fetching the keys again in the background if they are due for a refresh
+// or, if kid is unknown, waiting for them to be.
+func (j *JWT) key(kid string) (crypto.PublicKey, string, error) {
+	set := j.keys.Load()
+	key, ok := set.keys[kid]
+	since := time.Since(set.fetched)
+	switch {
+	case !ok && since >= jwksMinRefresh:
+		if done := j.refresh(); done != nil {
+			<-done
+			set = j.keys.Load()
+			key, ok = set.keys[kid]
+		}
+	case since >= j.Refresh:
+		j.refresh()
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unknown key %q", kid)
+	}
+	return key, set.algs[kid], nil
+}
+
+// refresh starts fetching the keys again unless they are being fetched, or
+// were tried within jwksMinRefresh, and returns a channel closed once they
+// were, or nil if they are not being fetched.
+func (j *JWT) refresh() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fetching != nil || time.Since(j.tried) < jwksMinRefresh {
+		return j.fetching
+	}
+	done := make(chan struct{})
+	j.fetching, j.tried = done, time.Now()
+	go func() {
+		if err := j.fetch(); err != nil {
+			logf("JWKS %s: keeping the keys fetched before: %v", j.JWKSURL, err)
+		}
+		j.mu.Lock()
+		j.fetching = nil
+		j.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+var errNoToken = errors.New("no token")
+
+// verify returns the claims of token if it is valid.
+func (j *JWT) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, alg, err := j.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if alg != "" && alg != header.Alg {
+		return nil, fmt.Errorf("key %q is for algorithm %q, not %q", header.Kid, alg, header.Alg)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	now := time.Now()
+	if exp, ok := numericClaim(claims, "exp"); !ok || now.After(exp.Add(j.Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(j.Leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if iat, ok := numericClaim(claims, "iat"); ok && now.Add(j.Leeway).Before(iat) {
+		return nil, fmt.Errorf("token issued in the future")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if len(j.Audiences) > 0 && !slices.ContainsFunc(audiences(claims["aud"]), func(aud string) bool {
+		return slices.Contains(j.Audiences, aud)
+	}) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericClaim(claims map[string]any, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// audiences returns the aud claim, a string or an array of them.
+func audiences(aud any) []string {
+	switch aud := aud.(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		var s []string
+		for _, a := range aud {
+			if a, ok := a.(string); ok {
+				s = append(s, a)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// ecdsaCurves are the curves of the ES algorithms, by hash.
+var ecdsaCurves = map[crypto.Hash]string{crypto.SHA256: "P-256", crypto.SHA384: "P-384", crypto.SHA512: "P-521"}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	errMismatch := fmt.Errorf("key does not match algorithm %q", alg)
+	switch {
+	case alg == "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errMismatch
+		}
+		if !ed25519.Verify(k, []byte(signed), sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case hash == 0:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var err error
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errMismatch
+		}
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().Name != ecdsaCurves[hash] {
+			return errMismatch
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			err = errors.New("verification error")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// token returns the token r carries.
+func (j *JWT) token(r *http.Request) (string, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token), nil
+	}
+	if j.Cookie != "" {
+		if c, err := r.Cookie(j.Cookie); err == nil {
+			return c.Value, nil
+		}
+	}
+	return "", errNoToken
+}
+
+// Middleware returns the middleware rejecting requests without a valid
+// token with 401.
+func (j *JWT) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			token, err := j.token(r)
+			var claims map[string]any
+			if err == nil {
+				claims, err = j.verify(token)
+			}
+			if err != nil {
+				challenge := "Bearer"
+				if !errors.Is(err, errNoToken) {
+					challenge = fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", err.Error())
+				}
+				rw.Header().Set("WWW-Authenticate", challenge)
+				httpError(rw, r, "401 unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if len(j.Claims) > 0 {
+				r = r.WithContext(r.Context())
+				r.Header = r.Header.Clone()
+				for claim, header := range j.Claims {
+					r.Header.Del(header)
+					switch v := claims[claim].(type) {
+					case nil:
+					case string:
+						r.Header.Set(header, v)
+					default:
+						b, _ := json.Marshal(v)
+						r.Header.Set(header, string(b))
+					}
+				}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
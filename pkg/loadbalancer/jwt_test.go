@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves the Ed25519 keys of kids, as set, after delay.
+type jwksServer struct {
+	kids    atomic.Pointer[[]string]
+	delay   atomic.Int64
+	fetches atomic.Int32
+}
+
+func (s *jwksServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.fetches.Add(1)
+	time.Sleep(time.Duration(s.delay.Load()))
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for _, kid := range *s.kids.Load() {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		set.Keys = append(set.Keys, jwk{Kty: "OKP", Crv: "Ed25519", Kid: kid, X: base64.RawURLEncoding.EncodeToString(pub)})
+	}
+	json.NewEncoder(rw).Encode(set)
+}
+
+// age makes the keys of j look fetched d ago, and tried as long ago.
+func age(j *JWT, d time.Duration) {
+	set := j.keys.Load()
+	j.keys.Store(&jwkSet{keys: set.keys, algs: set.algs, fetched: set.fetched.Add(-d)})
+	j.mu.Lock()
+	j.tried = j.tried.Add(-d)
+	j.mu.Unlock()
+}
+
+func TestJWTKeyRefresh(t *testing.T) {
+	s := &jwksServer{}
+	s.kids.Store(&[]string{"old"})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	j, err := NewJWT(srv.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refresh due does not hold up requests with known keys.
+	s.kids.Store(&[]string{"old", "new"})
+	s.delay.Store(int64(time.Second))
+	age(j, j.Refresh)
+	start := time.Now()
+	for range 10 {
+		if _, _, err := j.key("old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("requests waited %v for the refresh", d)
+	}
+	// Requests with a key unknown wait for the fetch in flight, only.
+	if _, _, err := j.key("new"); err != nil {
+		t.Errorf("key fetched since: %v", err)
+	}
+	if n := s.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+
+	// Unknown keys are fetched at most every jwksMinRefresh.
+	s.delay.Store(0)
+	for range 5 {
+		if _, _, err := j.key("unknown"); err == nil {
+			t.Error("unknown key found")
+		}
+	}
+	age(j, jwksMinRefresh)
+	j.key("unknown")
+	if n := s.fetches.Load(); n != 3 {
+		t.Errorf("%d fetches, want 3", n)
+	}
+}
+
+// signES returns a token with claims signed by key with alg and hash.
+func signES(t *testing.T, key *ecdsa.PrivateKey, alg, kid string, hash crypto.Hash, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	h := hash.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// TestJWTAlgorithmMatchesKey checks that tokens are only verified with
+// keys of the algorithm their header names.
+func TestJWTAlgorithmMatchesKey(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	j := &JWT{Refresh: time.Hour}
+	j.keys.Store(&jwkSet{
+		keys: map[string]crypto.PublicKey{
+			"p256": &p256.PublicKey, "p384": &p384.PublicKey, "pinned": &p256.PublicKey,
+		},
+		algs:    map[string]string{"pinned": "ES512"},
+		fetched: time.Now(),
+	})
+	claims := map[string]any{"exp": time.Now().Add(time.Minute).Unix()}
+	for _, tc := range []struct {
+		name, alg, kid string
+		key            *ecdsa.PrivateKey
+		hash           crypto.Hash
+		ok             bool
+	}{
+		{"ES256 with P-256", "ES256", "p256", p256, crypto.SHA256, true},
+		{"ES384 with P-384", "ES384", "p384", p384, crypto.SHA384, true},
+		{"ES256 with P-384", "ES256", "p384", p384, crypto.SHA256, false},
+		{"ES384 with P-256", "ES384", "p256", p256, crypto.SHA384, false},
+		{"other than the JWK's", "ES256", "pinned", p256, crypto.SHA256, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := j.verify(signES(t, tc.key, tc.alg, tc.kid, tc.hash, claims))
+			if (err == nil) != tc.ok {
+				t.Errorf("got %v, want valid %t", err, tc.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubeWatchTimeout makes the API server end watches after a while, so
+	// that a silently dropped connection is noticed.
+	kubeWatchTimeout = 5 * time.Minute
+)
+
+// KubernetesDiscoverer yields the ready endpoints of a Kubernetes Service by
+// listing its EndpointSlices, so that pods are balanced directly rather than
+// through the service's cluster IP.
+//
+// KubernetesDiscoverer is a Watcher: it watches the service's EndpointSlices
+// and relists them on every change.
+type KubernetesDiscoverer struct {
+	Namespace string
+	Service   string
+	// Port is the name of the service port to use. It may be empty if the
+	// service has a single port.
+	Port string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+
+	api    string
+	token  func() (string, error)
+	client *http.Client
+
+	mu              sync.Mutex
+	resourceVersion string
+}
+
+// NewKubernetesDiscoverer creates a KubernetesDiscoverer talking to the API
+// server of the cluster it runs in, or, if kubeconfig is set, to the current
+// context of that kubeconfig file. Only kubeconfig files in JSON form are
+// supported, as written by "kubectl config view --raw -o json". An empty
+// namespace defaults to the pod's namespace or the context's namespace.
+func NewKubernetesDiscoverer(kubeconfig, namespace, service string) (*KubernetesDiscoverer, error) {
+	if service == "" {
+		return nil, fmt.Errorf("kubernetes service must not be empty")
+	}
+	k := &KubernetesDiscoverer{Namespace: namespace, Service: service}
+	var err error
+	if kubeconfig != "" {
+		err = k.loadKubeconfig(kubeconfig)
+	} else {
+		err = k.loadInCluster()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.Namespace == "" {
+		k.Namespace = "default"
+	}
+	return k, nil
+}
+
+func (k *KubernetesDiscoverer) loadInCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a kubernetes cluster")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	if k.Namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err == nil {
+			k.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	k.api = "https://" + net.JoinHostPort(host, port)
+	// The token is rotated on disk, so it is reread for every request.
+	k.token = func() (string, error) {
+		b, err := os.ReadFile(serviceAccountDir + "/token")
+		return strings.TrimSpace(string(b)), err
+	}
+	k.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	return nil
+}
+
+// kubeconfig is the subset of a kubeconfig file used to reach the API server.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+func (k *KubernetesDiscoverer) loadKubeconfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var kc kubeconfig
+	if err := json.Unmarshal(b, &kc); err != nil {
+		return fmt.Errorf("kubeconfig %s (only JSON is supported): %w", path, err)
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if k.Namespace == "" {
+				k.Namespace = c.Context.Namespace
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("kubeconfig %s: context %q not found", path, kc.CurrentContext)
+	}
+	tlsConfig := &tls.Config{}
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		k.api = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca := c.Cluster.CertificateAuthorityData
+		if c.Cluster.CertificateAuthority != "" {
+			if ca, err = os.ReadFile(c.Cluster.CertificateAuthority); err != nil {
+				return err
+			}
+		}
+		if len(ca) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return fmt.Errorf("kubeconfig %s: no certificates for cluster %q", path, clusterName)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("kubeconfig %s: cluster %q not found", path, clusterName)
+	}
+	k.token = func() (string, error) { return "", nil }
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		cert, key := u.User.ClientCertificateData, u.User.ClientKeyData
+		if u.User.ClientCertificate != "" {
+			if cert, err = os.ReadFile(u.User.ClientCertificate); err != nil {
+				return err
+			}
+		}
+		if u.User.ClientKey != "" {
+			if key, err = os.ReadFile(u.User.ClientKey); err != nil {
+				return err
+			}
+		}
+		if len(cert) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return fmt.Errorf("kubeconfig %s: user %q: %w", path, userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		token, file := u.User.Token, u.User.TokenFile
+		k.token = func() (string, error) {
+			if file != "" {
+				b, err := os.ReadFile(file)
+				return strings.TrimSpace(string(b)), err
+			}
+			return token, nil
+		}
+	}
+	k.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+	return nil
+}
+
+// endpointSlice is the subset of a discovery.k8s.io/v1 EndpointSlice used.
+type endpointSlice struct {
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+// Discover implements Discoverer.
+func (k *KubernetesDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	body, err := k.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	var targets []Target
+	seen := map[string]bool{}
+	for _, slice := range list.Items {
+		port, ok := k.port(slice)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// A missing ready condition means ready.
+			if r := ep.Conditions.Ready; r != nil && !*r {
+				continue
+			}
+			for _, ip := range ep.Addresses {
+				addr := net.JoinHostPort(ip, strconv.Itoa(port))
+				if k.Scheme != "" {
+					addr = k.Scheme + "://" + addr
+				}
+				if !seen[addr] {
+					seen[addr] = true
+					targets = append(targets, Target{Addr: addr})
+				}
+			}
+		}
+	}
+	k.mu.Lock()
+	k.resourceVersion = list.Metadata.ResourceVersion
+	k.mu.Unlock()
+	return targets, nil
+}
+
+// port returns the number of the configured port in slice.
+func (k *KubernetesDiscoverer) port(slice endpointSlice) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if name == k.Port || k.Port == "" && len(slice.Ports) == 1 {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// Watch implements Watcher.
+func (k *KubernetesDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	for {
+		changed, err := k.watch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			return k.Discover(ctx)
+		}
+	}
+}
+
+// watch watches the EndpointSlices from the last listed version and reports
+// whether they changed before the watch timed out.
+func (k *KubernetesDiscoverer) watch(ctx context.Context) (bool, error) {
+	k.mu.Lock()
+	rv := k.resourceVersion
+	k.mu.Unlock()
+	body, err := k.get(ctx, url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {rv},
+		"timeoutSeconds":  {strconv.Itoa(int(kubeWatchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := dec.Decode(&event); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("kubernetes watch: %w", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED", "ERROR":
+			// Relist on every change, and on errors such as an expired
+			// resource version.
+			return true, nil
+		}
+	}
+}
+
+func (k *KubernetesDiscoverer) get(ctx context.Context, q url.Values) (io.ReadCloser, error) {
+	q.Set("labelSelector", "kubernetes.io/service-name="+k.Service)
+	u := k.api + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(k.Namespace) + "/endpointslices?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := k.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
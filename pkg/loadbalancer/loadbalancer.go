@@ -0,0 +1,992 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// SimpleServer implements the Server interface with a reverse proxy.
+type SimpleServer struct {
+	backend.Weighting
+	backend.Counters
+	adminState
+
+	addr  string
+	proxy *httputil.ReverseProxy
+	dead  atomic.Bool
+
+	// target is the URL requests are proxied to.
+	target *url.URL
+	// transport is the proxy's round tripper when it isn't the default one;
+	// health checks probe the server through it. ownTransport is set if no
+	// other server uses it.
+	transport    http.RoundTripper
+	ownTransport bool
+	// proxyProtocol is the PROXY protocol version sent to the server, or zero.
+	proxyProtocol int
+	// errorHandler answers proxy errors when the pool's hooks do not; nil
+	// answers 502.
+	errorHandler func(http.ResponseWriter, *http.Request, error)
+	// http2 is set if the transport may speak HTTP/2 to the server, whose
+	// connections doing so are conns.
+	http2 bool
+	conns connSet
+}
+
+// NewSimpleServer creates a new instance of SimpleServer. Besides http and
+// https URLs, addr may be unix:///path/to/socket for a server listening on
+// a Unix domain socket. Other addresses return ErrInvalidBackendURL.
+func NewSimpleServer(addr string) (*SimpleServer, error) {
+	return newSimpleServer(addr, nil)
+}
+
+// NewSimpleServerWithTransport creates a SimpleServer proxying to addr
+// through t, such as one made by NewTransport, or through the default
+// transport if t is nil.
+func NewSimpleServerWithTransport(addr string, t *http.Transport) (*SimpleServer, error) {
+	return newSimpleServer(addr, t)
+}
+
+// newSimpleServer creates a SimpleServer proxying through base, or through
+// the default transport if base is nil. Unix socket addresses get a copy of
+// base dialing the socket.
+func newSimpleServer(addr string, base *http.Transport) (*SimpleServer, error) {
+	var target *url.URL
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("%w %q: unix socket address has no path", ErrInvalidBackendURL, addr)
+		}
+		if base == nil {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		base = base.Clone()
+		base.DialContext = trackConns(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		})
+		base.DialTLSContext = nil
+		// The host is only a placeholder; the Host header of the client's
+		// request is passed on.
+		target = &url.URL{Scheme: "http", Host: "unix"}
+	} else {
+		var err error
+		if target, err = url.Parse(addr); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBackendURL, err)
+		}
+		if target.Host == "" {
+			return nil, fmt.Errorf("%w %q: no host", ErrInvalidBackendURL, addr)
+		}
+	}
+	s := &SimpleServer{
+		addr:   addr,
+		proxy:  httputil.NewSingleHostReverseProxy(target),
+		target: target,
+	}
+	s.SetWeight(1)
+	s.proxy.BufferPool = copyBuffers
+	s.installHooks()
+	if base != nil {
+		s.proxy.Transport = base
+		s.transport = base
+		s.http2 = s.mayUseHTTP2()
+	}
+	return s, nil
+}
+
+// Address returns the server address.
+func (s *SimpleServer) Address() string {
+	return s.addr
+}
+
+// IsAlive reports the health of the server as last observed by its pool's health check.
+// Servers are considered alive until a check says otherwise.
+func (s *SimpleServer) IsAlive() bool {
+	return !s.dead.Load()
+}
+
+// SetAlive records the outcome of a health check.
+func (s *SimpleServer) SetAlive(alive bool) {
+	s.dead.Store(!alive)
+}
+
+// Serve proxies the request to the underlying server.
+func (s *SimpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	if s.proxyProtocol != 0 {
+		req = withProxiedClient(req)
+	}
+	if s.http2 {
+		st := &http2Stream{server: s}
+		req = req.WithContext(st.trace(req.Context()))
+		defer st.done()
+	}
+	s.Start()
+	defer s.Done()
+	s.proxy.ServeHTTP(rw, req)
+}
+
+// SetTLSServerName makes the server verify the backend's certificate against
+// name, for servers addressed by IP that present a certificate for a name.
+func (s *SimpleServer) SetTLSServerName(name string) {
+	if s.target.Scheme != "https" {
+		return
+	}
+	t := s.cloneTransport()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.ServerName = name
+	s.setTransport(t)
+}
+
+// SetIdleConns limits the idle connections kept open to the server to max
+// and closes them after timeout; zero values keep those of the pool's
+// transport.
+func (s *SimpleServer) SetIdleConns(max int, timeout time.Duration) {
+	t := s.cloneTransport()
+	if max > 0 {
+		t.MaxIdleConnsPerHost = max
+	}
+	if timeout > 0 {
+		t.IdleConnTimeout = timeout
+	}
+	s.setTransport(t)
+}
+
+// DisableKeepAlives makes the server's connections serve a single request,
+// for servers that mishandle persistent connections.
+func (s *SimpleServer) DisableKeepAlives() {
+	t := s.cloneTransport()
+	t.DisableKeepAlives = true
+	s.setTransport(t)
+}
+
+// setTransport makes the server proxy through t, a transport of its own.
+func (s *SimpleServer) setTransport(t *http.Transport) {
+	s.proxy.Transport = t
+	s.transport = t
+	s.ownTransport = true
+	s.http2 = s.mayUseHTTP2()
+}
+
+// CloseIdleConnections closes the idle connections to the server, if its
+// transport is its own rather than shared with other servers.
+func (s *SimpleServer) CloseIdleConnections() {
+	if t, ok := s.transport.(*http.Transport); ok && s.ownTransport {
+		t.CloseIdleConnections()
+	}
+}
+
+// cloneTransport returns a copy of the server's transport to modify.
+func (s *SimpleServer) cloneTransport() *http.Transport {
+	base, _ := s.transport.(*http.Transport)
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	return base.Clone()
+}
+
+// SetProxyProtocol makes the server's connections start with a PROXY
+// protocol header of the given version carrying the client's address.
+func (s *SimpleServer) SetProxyProtocol(version int) {
+	base, _ := s.transport.(*http.Transport)
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	s.setTransport(proxyProtocolTransport(base, version))
+	s.proxyProtocol = version
+}
+
+// LoadBalancer routes requests to named pools of servers.
+type LoadBalancer struct {
+	port string
+	// poolsMu guards pools, which are added and removed at runtime.
+	poolsMu  sync.RWMutex
+	pools    map[string]*Pool
+	routes   []*Route
+	fallback *Fallback
+
+	geoIP       *GeoIP
+	geoIPHeader string
+
+	forwarded   *Forwarded
+	maintenance *Maintenance
+	accessLog   *AccessLog
+	recorder    *Recorder
+	tagger      *Tagger
+	abuse       *AbuseGuard
+
+	// sensitiveHeaders are the names, or prefixes ending in "*", of the
+	// headers removed from client requests.
+	sensitiveHeaders []string
+
+	// middleware runs for every request before routing; routed is the
+	// handler it wraps.
+	middleware Chain
+	routed     http.Handler
+	// middlewareNames names the middleware, for Explain.
+	middlewareNames []string
+
+	// ready is set while the load balancer serves its listeners.
+	ready atomic.Bool
+
+	// stateFile keeps the runtime state across restarts, with that of
+	// the load balancers of the other frontends of the service; stateMu
+	// serializes writing it.
+	stateFile string
+	stateMu   sync.Mutex
+	frontends map[string]*LoadBalancer
+	// ha pairs the instance running the load balancer with another,
+	// cluster shares the health of servers with its replicas and fleet
+	// runs the configuration of the leader of its fleet; prober probes it.
+	ha      *HA
+	cluster *Cluster
+	fleet   *Fleet
+	prober  *Prober
+
+	tcpProxies   []*TCPProxy
+	udpProxies   []*UDPProxy
+	passthroughs []*Passthrough
+
+	// upstream holds the transports of the pools built from a
+	// configuration, for those added at runtime.
+	upstream *upstream
+
+	// logger logs the changes to pools, routes and proxies; nil means
+	// slog.Default.
+	logger *slog.Logger
+
+	// ctx is canceled once the load balancer stopped, abandoning the
+	// upstream requests still under way; forwarding counts those.
+	ctx        context.Context
+	cancel     context.CancelCauseFunc
+	forwarding atomic.Int64
+}
+
+// ErrStopped is the cause of the cancellation of the requests still
+// forwarded when the load balancer stops.
+var ErrStopped = errors.New("load balancer stopped")
+
+// Errors returned by the constructors and methods of the package, wrapped
+// with details; test for them with errors.Is.
+var (
+	// ErrInvalidBackendURL is returned for server addresses that are not
+	// valid URLs of the kind the server proxies to.
+	ErrInvalidBackendURL = errors.New("invalid backend URL")
+	// ErrNoHealthyBackends is returned when no server of a pool is
+	// available to pick.
+	ErrNoHealthyBackends = errors.New("no healthy backend")
+	// ErrPoolNotFound is returned for names that no pool has.
+	ErrPoolNotFound = errors.New("unknown pool")
+)
+
+// NewLoadBalancer creates a LoadBalancer configured by opts. The servers
+// given by WithServers and WithBackends form the default pool, which serves
+// requests no route matches.
+func NewLoadBalancer(opts ...Option) (*LoadBalancer, error) {
+	o := options{port: DefaultPort}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lb := &LoadBalancer{
+		port:        o.port,
+		pools:       make(map[string]*Pool, len(o.pools)+1),
+		forwarded:   NewForwarded(nil, false),
+		maintenance: NewMaintenance(0, nil, "", 0, nil),
+		accessLog:   NewAccessLog(os.Stdout, 1),
+		logger:      o.logger,
+	}
+	lb.ctx, lb.cancel = context.WithCancelCause(context.Background())
+	if o.transport != nil {
+		lb.upstream = &upstream{http: o.transport, http2: newHTTP2Transport(o.transport)}
+	}
+	pools := o.pools
+	def, err := o.defaultPool(lb.upstream)
+	if err != nil {
+		return nil, err
+	}
+	if def != nil {
+		pools = append(pools, def)
+	}
+	for _, p := range pools {
+		if _, ok := lb.pools[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate pool %q", p.Name)
+		}
+		p.logger = lb.logger
+		lb.pools[p.Name] = p
+	}
+	if def != nil {
+		lb.fallback = &Fallback{Pool: def.Name}
+	}
+	return lb, nil
+}
+
+// logf logs a message about the load balancer at the info level.
+func (lb *LoadBalancer) logf(format string, args ...any) {
+	logTo(lb.logger, slog.LevelInfo, format, args...)
+}
+
+// Port returns the port the load balancer serves HTTP requests on.
+func (lb *LoadBalancer) Port() string {
+	return lb.port
+}
+
+// Pool returns the named pool, or nil if it does not exist.
+func (lb *LoadBalancer) Pool(name string) *Pool {
+	lb.poolsMu.RLock()
+	defer lb.poolsMu.RUnlock()
+	return lb.pools[name]
+}
+
+// Pools returns the pools sorted by name.
+func (lb *LoadBalancer) Pools() []*Pool {
+	lb.poolsMu.RLock()
+	pools := make([]*Pool, 0, len(lb.pools))
+	for _, p := range lb.pools {
+		pools = append(pools, p)
+	}
+	lb.poolsMu.RUnlock()
+	slices.SortFunc(pools, func(a, b *Pool) int { return cmp.Compare(a.Name, b.Name) })
+	return pools
+}
+
+// AddPool adds a pool at runtime and starts its discovery and health checks.
+func (lb *LoadBalancer) AddPool(p *Pool) error {
+	lb.poolsMu.Lock()
+	if _, ok := lb.pools[p.Name]; ok {
+		lb.poolsMu.Unlock()
+		return fmt.Errorf("duplicate pool %q", p.Name)
+	}
+	p.logger = lb.logger
+	lb.pools[p.Name] = p
+	lb.poolsMu.Unlock()
+	p.StartDiscovery()
+	p.StartHealthCheck()
+	p.StartMaintenanceWindows()
+	lb.logf("Pool %q added", p.Name)
+	return nil
+}
+
+// RemovePool removes a pool that no route, fallback or proxy refers to, and
+// stops its discovery and health checks.
+func (lb *LoadBalancer) RemovePool(name string) error {
+	if user := lb.poolUser(name); user != "" {
+		return fmt.Errorf("pool %q is used by %s", name, user)
+	}
+	lb.poolsMu.Lock()
+	p := lb.pools[name]
+	delete(lb.pools, name)
+	lb.poolsMu.Unlock()
+	if p == nil {
+		return fmt.Errorf("%w %q", ErrPoolNotFound, name)
+	}
+	p.Close()
+	lb.logf("Pool %q removed", name)
+	return nil
+}
+
+// poolUser describes what refers to the named pool, or returns "" if nothing
+// does.
+func (lb *LoadBalancer) poolUser(name string) string {
+	for _, rt := range lb.routes {
+		pools := []string{rt.defaultPool()}
+		for _, sp := range rt.Splits() {
+			pools = append(pools, sp.Pool)
+		}
+		if bg := rt.BlueGreen; bg != nil {
+			pools = append(pools, bg.BluePool, bg.GreenPool)
+		}
+		if rt.Canary != nil {
+			pools = append(pools, rt.Canary.Pool)
+		}
+		if rt.Experiment != nil {
+			for _, b := range rt.Experiment.Buckets {
+				pools = append(pools, b.Pool)
+			}
+		}
+		if rt.Mirror != nil {
+			pools = append(pools, rt.Mirror.Pool)
+		}
+		if slices.Contains(pools, name) {
+			return fmt.Sprintf("route %q", rt.Name)
+		}
+	}
+	if lb.fallback != nil && lb.fallback.Pool == name {
+		return "the fallback"
+	}
+	for _, p := range lb.tcpProxies {
+		if p.Pool.Name == name {
+			return fmt.Sprintf("tcp proxy %q", p.Name)
+		}
+	}
+	for _, p := range lb.udpProxies {
+		if p.Pool.Name == name {
+			return fmt.Sprintf("udp proxy %q", p.Name)
+		}
+	}
+	for _, p := range lb.passthroughs {
+		if p.proxy.Pool.Name == name {
+			return fmt.Sprintf("tls_passthrough %q", p.Name)
+		}
+	}
+	return ""
+}
+
+// AddRoute registers a route. Routes are evaluated by descending priority, then
+// descending specificity, then registration order. A route whose conditions and
+// priority are identical to an existing route's is rejected as ambiguous.
+func (lb *LoadBalancer) AddRoute(rt *Route) error {
+	if bg := rt.BlueGreen; bg != nil {
+		if lb.Pool(bg.BluePool) == nil || lb.Pool(bg.GreenPool) == nil {
+			return fmt.Errorf("route %q: blue/green pools %q and %q must both exist", rt.Name, bg.BluePool, bg.GreenPool)
+		}
+	}
+	if len(rt.Countries) > 0 && lb.geoIP == nil {
+		return fmt.Errorf("route %q: country conditions require a GeoIP database", rt.Name)
+	}
+	if rt.Canary != nil && lb.Pool(rt.Canary.Pool) == nil {
+		return fmt.Errorf("route %q: unknown canary pool %q", rt.Name, rt.Canary.Pool)
+	}
+	if rt.Experiment != nil {
+		for _, b := range rt.Experiment.Buckets {
+			if lb.Pool(b.Pool) == nil {
+				return fmt.Errorf("route %q: experiment bucket %q: %w %q", rt.Name, b.Name, ErrPoolNotFound, b.Pool)
+			}
+		}
+	}
+	if rt.Mirror != nil && lb.Pool(rt.Mirror.Pool) == nil {
+		return fmt.Errorf("route %q: unknown mirror pool %q", rt.Name, rt.Mirror.Pool)
+	}
+	if rt.Redirect == nil && rt.Splits() == nil && rt.Experiment == nil && lb.Pool(rt.defaultPool()) == nil {
+		return fmt.Errorf("route %q: %w %q", rt.Name, ErrPoolNotFound, rt.defaultPool())
+	}
+	if err := lb.checkSplits(rt.Splits()); err != nil {
+		return fmt.Errorf("route %q: %w", rt.Name, err)
+	}
+	key := rt.conditionKey()
+	for _, other := range lb.routes {
+		if other.Priority == rt.Priority && other.conditionKey() == key {
+			return fmt.Errorf("route %q is ambiguous with route %q: same priority and conditions", rt.Name, other.Name)
+		}
+	}
+	rt.handler = lb.routeHandler(rt)
+	lb.routes = append(lb.routes, rt)
+	slices.SortStableFunc(lb.routes, func(a, b *Route) int {
+		if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Specificity(), a.Specificity())
+	})
+	return nil
+}
+
+// Route returns the named route, or nil if it does not exist.
+func (lb *LoadBalancer) Route(name string) *Route {
+	for _, rt := range lb.routes {
+		if rt.Name == name {
+			return rt
+		}
+	}
+	return nil
+}
+
+// SetRouteSplits replaces the traffic split of the named route at runtime.
+func (lb *LoadBalancer) SetRouteSplits(name string, splits []Split) error {
+	rt := lb.Route(name)
+	if rt == nil {
+		return fmt.Errorf("unknown route %q", name)
+	}
+	if err := lb.checkSplits(splits); err != nil {
+		return err
+	}
+	if len(splits) == 0 && lb.Pool(rt.defaultPool()) == nil {
+		return fmt.Errorf("route %q has no default pool to fall back to", name)
+	}
+	if err := rt.SetSplits(splits); err != nil {
+		return err
+	}
+	lb.logf("Route %q: traffic split set to %v", name, splits)
+	return nil
+}
+
+// SwitchRoute makes color ("blue" or "green", empty for the inactive one) the
+// active deployment of the named blue/green route.
+func (lb *LoadBalancer) SwitchRoute(name, color string) error {
+	bg, err := lb.blueGreen(name)
+	if err != nil {
+		return err
+	}
+	if err := bg.Switch(color); err != nil {
+		return err
+	}
+	lb.logf("Route %q: switched to %s pool %q", name, bg.Status().Active, bg.ActivePool())
+	return nil
+}
+
+// RollbackRoute restores the previously active deployment of the named blue/green route.
+func (lb *LoadBalancer) RollbackRoute(name string) error {
+	bg, err := lb.blueGreen(name)
+	if err != nil {
+		return err
+	}
+	if err := bg.Rollback(); err != nil {
+		return err
+	}
+	lb.logf("Route %q: rolled back to %s pool %q", name, bg.Status().Active, bg.ActivePool())
+	return nil
+}
+
+func (lb *LoadBalancer) blueGreen(name string) (*BlueGreen, error) {
+	rt := lb.Route(name)
+	if rt == nil {
+		return nil, fmt.Errorf("unknown route %q", name)
+	}
+	if rt.BlueGreen == nil {
+		return nil, fmt.Errorf("route %q is not a blue/green route", name)
+	}
+	return rt.BlueGreen, nil
+}
+
+func (lb *LoadBalancer) checkSplits(splits []Split) error {
+	for _, sp := range splits {
+		if lb.Pool(sp.Pool) == nil {
+			return fmt.Errorf("split: %w %q", ErrPoolNotFound, sp.Pool)
+		}
+	}
+	return nil
+}
+
+// SetFallback designates how requests matching no route are handled. A nil
+// fallback answers them with 404 Not Found.
+func (lb *LoadBalancer) SetFallback(fb *Fallback) error {
+	if fb != nil && fb.Pool != "" && lb.Pool(fb.Pool) == nil {
+		return fmt.Errorf("fallback: %w %q", ErrPoolNotFound, fb.Pool)
+	}
+	lb.fallback = fb
+	return nil
+}
+
+// SetGeoIP enables country resolution of client addresses. The resolved
+// country is available to route conditions and, if header is not empty, sent
+// to backends in that request header (overwriting any client-supplied value).
+func (lb *LoadBalancer) SetGeoIP(db *GeoIP, header string) {
+	lb.geoIP = db
+	lb.geoIPHeader = http.CanonicalHeaderKey(header)
+}
+
+// SetSensitiveHeaders makes the load balancer remove the headers named,
+// or with a prefix ending in "*", from the requests of clients before any
+// middleware sees them, so that clients cannot pass them to backends in
+// place of middleware setting them, such as X-Internal-Auth.
+func (lb *LoadBalancer) SetSensitiveHeaders(names []string) {
+	lb.sensitiveHeaders = names
+}
+
+// SetForwarded configures how forwarding headers are maintained.
+func (lb *LoadBalancer) SetForwarded(f *Forwarded) {
+	lb.forwarded = f
+}
+
+// SetAbuseGuard enables abuse detection with g, whose middleware runs after
+// that added so far. Its bans are listed by the admin API and kept in the
+// runtime state.
+func (lb *LoadBalancer) SetAbuseGuard(g *AbuseGuard) {
+	lb.abuse = g
+	lb.use("abuse", g.Middleware())
+}
+
+// AbuseGuard returns the abuse detection of the load balancer, or nil.
+func (lb *LoadBalancer) AbuseGuard() *AbuseGuard {
+	return lb.abuse
+}
+
+// AddTCPProxy registers a layer-4 proxy, started by ServeL4. Its pool must
+// be a tcp pool of the load balancer.
+func (lb *LoadBalancer) AddTCPProxy(p *TCPProxy) error {
+	if lb.Pool(p.Pool.Name) != p.Pool {
+		return fmt.Errorf("tcp %q: %w %q", p.Name, ErrPoolNotFound, p.Pool.Name)
+	}
+	if p.Pool.Protocol != ProtocolTCP {
+		return fmt.Errorf("tcp %q: pool %q is not a tcp pool", p.Name, p.Pool.Name)
+	}
+	p.logger = lb.logger
+	lb.tcpProxies = append(lb.tcpProxies, p)
+	return nil
+}
+
+// AddUDPProxy registers a UDP proxy, started by ServeL4. Its pool must be a
+// udp pool of the load balancer.
+func (lb *LoadBalancer) AddUDPProxy(p *UDPProxy) error {
+	if lb.Pool(p.Pool.Name) != p.Pool {
+		return fmt.Errorf("udp %q: %w %q", p.Name, ErrPoolNotFound, p.Pool.Name)
+	}
+	if p.Pool.Protocol != ProtocolUDP {
+		return fmt.Errorf("udp %q: pool %q is not a udp pool", p.Name, p.Pool.Name)
+	}
+	p.logger = lb.logger
+	lb.udpProxies = append(lb.udpProxies, p)
+	return nil
+}
+
+// AddPassthrough registers a TLS passthrough route of the frontend listener.
+// Its pool must be a tcp pool of the load balancer.
+func (lb *LoadBalancer) AddPassthrough(p *Passthrough) error {
+	pool := p.proxy.Pool
+	if lb.Pool(pool.Name) != pool {
+		return fmt.Errorf("tls_passthrough %q: %w %q", p.Name, ErrPoolNotFound, pool.Name)
+	}
+	if pool.Protocol != ProtocolTCP {
+		return fmt.Errorf("tls_passthrough %q: pool %q is not a tcp pool", p.Name, pool.Name)
+	}
+	p.proxy.logger = lb.logger
+	lb.passthroughs = append(lb.passthroughs, p)
+	return nil
+}
+
+// Listener wraps the frontend listener ln so that TLS passthrough routes
+// receive their connections before TLS is terminated.
+func (lb *LoadBalancer) Listener(ln net.Listener) net.Listener {
+	if len(lb.passthroughs) == 0 {
+		return ln
+	}
+	return newPassthroughListener(ln, lb.passthroughs)
+}
+
+// ServeL4 starts the TCP and UDP proxies in the background. It returns the
+// error of a proxy failing to listen; failed is called with that of a proxy
+// that stops serving, or the error is logged if failed is nil.
+func (lb *LoadBalancer) ServeL4(failed func(error)) error {
+	if failed == nil {
+		failed = func(err error) { lb.logf("%v", err) }
+	}
+	for _, p := range lb.tcpProxies {
+		ln, err := p.Listen()
+		if err != nil {
+			return fmt.Errorf("TCP proxy %q: %w", p.Name, err)
+		}
+		go func() {
+			lb.logf("Serving TCP connections at %q (pool %q)\n", p.Addr, p.Pool.Name)
+			if err := p.Serve(ln); err != nil && !errors.Is(err, ErrProxyClosed) {
+				failed(fmt.Errorf("TCP proxy %q: %w", p.Name, err))
+			}
+		}()
+	}
+	for _, p := range lb.udpProxies {
+		pc, err := listenPacket("udp", p.Addr)
+		if err != nil {
+			return fmt.Errorf("UDP proxy %q: %w", p.Name, err)
+		}
+		go func() {
+			lb.logf("Serving UDP datagrams at %q (pool %q)\n", p.Addr, p.Pool.Name)
+			if err := p.Serve(pc); err != nil && !errors.Is(err, ErrProxyClosed) {
+				failed(fmt.Errorf("UDP proxy %q: %w", p.Name, err))
+			}
+		}()
+	}
+	return nil
+}
+
+// BaseContext returns the context the requests of the load balancer derive
+// from, for http.Server.BaseContext, so that Stop cancels those still
+// forwarded when it gives up waiting for them.
+func (lb *LoadBalancer) BaseContext(net.Listener) context.Context {
+	return lb.ctx
+}
+
+// stopPollInterval is how often Stop checks whether the forwarded requests
+// finished.
+const stopPollInterval = 10 * time.Millisecond
+
+// Stop stops the layer-4 proxies and waits for their connections, and for
+// the requests being forwarded, to finish until ctx is done. It then
+// cancels the requests still forwarded and the mirrored ones, stops the
+// discovery and health checks of the pools, closes their idle connections
+// and writes the access log lines still queued. The
+// frontend HTTP server is shut down separately, usually first. Stop returns
+// ctx's error if it gave up waiting.
+func (lb *LoadBalancer) Stop(ctx context.Context) error {
+	lb.SetReady(false)
+	var wg sync.WaitGroup
+	errs := make([]error, len(lb.tcpProxies)+len(lb.passthroughs))
+	for i, p := range append(slices.Clone(lb.tcpProxies), lb.passthroughProxies()...) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("tcp %q: %w", p.Name, err)
+			}
+		}()
+	}
+	for _, p := range lb.udpProxies {
+		p.Close()
+	}
+	wg.Wait()
+	ticker := time.NewTicker(stopPollInterval)
+	defer ticker.Stop()
+	for lb.forwarding.Load() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	lb.cancel(ErrStopped)
+	for _, p := range lb.Pools() {
+		p.Close()
+	}
+	lb.accessLog.Close()
+	lb.recorder.Close()
+	return errors.Join(errs...)
+}
+
+func (lb *LoadBalancer) passthroughProxies() []*TCPProxy {
+	proxies := make([]*TCPProxy, len(lb.passthroughs))
+	for i, p := range lb.passthroughs {
+		proxies[i] = p.proxy
+	}
+	return proxies
+}
+
+// StartHealthChecks starts the health checks and maintenance windows of
+// every pool.
+func (lb *LoadBalancer) StartHealthChecks() {
+	for _, p := range lb.Pools() {
+		p.StartHealthCheck()
+		p.StartMaintenanceWindows()
+		p.StartDatacenterProbes()
+	}
+}
+
+// StartDiscovery discovers the servers of pools with a Discovery and keeps
+// them up to date in the background.
+func (lb *LoadBalancer) StartDiscovery() {
+	for _, p := range lb.Pools() {
+		p.StartDiscovery()
+	}
+}
+
+// routeFor returns the first route matching r, or nil if none does.
+func (lb *LoadBalancer) routeFor(r *http.Request) *Route {
+	for _, rt := range lb.routes {
+		if rt.Matches(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler: it forwards requests to the next
+// available server of the pool selected by the matching route, or by the
+// fallback if no route matches, through the middleware of the load balancer
+// and of the route.
+func (lb *LoadBalancer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	r = lb.prepare(r)
+	rw, r, tagged := lb.tagger.wrap(rw, r)
+	if tagged != nil {
+		defer tagged()
+	}
+	if lb.routed != nil {
+		lb.routed.ServeHTTP(rw, r)
+	} else {
+		lb.serveRouted(rw, r)
+	}
+}
+
+// prepare returns r without its sensitive headers, with the forwarding
+// headers of trusted proxies resolved and its GeoIP country.
+func (lb *LoadBalancer) prepare(r *http.Request) *http.Request {
+	r = lb.sanitize(r)
+	r = lb.forwarded.apply(r)
+	if lb.geoIP != nil {
+		country := lb.geoIP.Country(clientIP(r))
+		r = withCountry(r, country)
+		if lb.geoIPHeader != "" {
+			if country != "" {
+				r.Header.Set(lb.geoIPHeader, country)
+			} else {
+				r.Header.Del(lb.geoIPHeader)
+			}
+		}
+	}
+	return r
+}
+
+// serveRouted serves r with its route, or the fallback if none matches.
+func (lb *LoadBalancer) serveRouted(rw http.ResponseWriter, r *http.Request) {
+	rt := lb.routeFor(r)
+	if rt == nil {
+		lb.serveFallback(rw, r)
+		return
+	}
+	if t := tagsOf(r); t != nil {
+		t.route, t.routed = rt.Name, true
+	}
+	rt.handler.ServeHTTP(rw, r)
+}
+
+// serveRoute serves r, matched by rt, once the route's middleware ran.
+func (lb *LoadBalancer) serveRoute(rw http.ResponseWriter, r *http.Request, rt *Route) {
+	r = rt.rewriteRequest(r)
+	if rt.Redirect != nil {
+		rt.Redirect.ServeHTTP(rw, r)
+		return
+	}
+	if rt.Mirror != nil {
+		r = lb.mirror(rt, r)
+	}
+	lb.forward(rw, r, rt, lb.Pool(rt.pickPool(rw, r)))
+}
+
+// Ready reports whether the load balancer serves its listeners and is not
+// shutting down.
+func (lb *LoadBalancer) Ready() bool { return lb.ready.Load() }
+
+// SetReady marks the load balancer as serving, or not.
+func (lb *LoadBalancer) SetReady(ready bool) { lb.ready.Store(ready) }
+
+// Maintenance returns the maintenance settings of the load balancer.
+func (lb *LoadBalancer) Maintenance() *Maintenance {
+	return lb.maintenance
+}
+
+// SetMaintenance replaces the maintenance settings of the load balancer.
+func (lb *LoadBalancer) SetMaintenance(m *Maintenance) {
+	lb.maintenance = m
+}
+
+// AccessLog returns the access log of the load balancer.
+func (lb *LoadBalancer) AccessLog() *AccessLog {
+	return lb.accessLog
+}
+
+// SetAccessLog replaces the access log of the load balancer, closing the
+// previous one.
+func (lb *LoadBalancer) SetAccessLog(a *AccessLog) {
+	if old := lb.accessLog; old != a {
+		old.Close()
+	}
+	lb.accessLog = a
+}
+
+// Recorder returns the recorder of the load balancer, or nil if it records
+// no requests.
+func (lb *LoadBalancer) Recorder() *Recorder {
+	return lb.recorder
+}
+
+// SetRecorder makes the load balancer record requests with rec, closing the
+// previous recorder; nil stops recording.
+func (lb *LoadBalancer) SetRecorder(rec *Recorder) {
+	if old := lb.recorder; old != rec {
+		old.Close()
+	}
+	lb.recorder = rec
+}
+
+// serveFallback handles a request that matched no route.
+func (lb *LoadBalancer) serveFallback(rw http.ResponseWriter, r *http.Request) {
+	switch fb := lb.fallback; {
+	case fb == nil:
+		httpError(rw, r, "404 page not found", http.StatusNotFound)
+	case fb.Pool != "":
+		lb.forward(rw, r, nil, lb.Pool(fb.Pool))
+	default:
+		fb.ServeHTTP(rw, r)
+	}
+}
+
+// forward proxies r, matched by rt (nil for the fallback), to the next
+// available server of pool.
+func (lb *LoadBalancer) forward(rw http.ResponseWriter, r *http.Request, rt *Route, pool *Pool) {
+	if lb.maintenance.blocks(r, rt, pool) {
+		maintenanceResponses.Inc(pool.Name)
+		lb.maintenance.ServeHTTP(rw, r)
+		return
+	}
+	if r.Context().Err() != nil {
+		// The client went away; there is no point in picking a server.
+		return
+	}
+	lb.forwarding.Add(1)
+	defer lb.forwarding.Add(-1)
+	// Stop cancels the requests still forwarded once it gave up waiting for
+	// them, whatever the base of their contexts: that of a service outlives
+	// the load balancers it reloads.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	defer context.AfterFunc(lb.ctx, func() { cancel(context.Cause(lb.ctx)) })()
+	r = r.WithContext(ctx)
+	affinity := rt.affinityFor(pool)
+	targetServer, err := pool.PickWithAffinity(affinity, rw, r)
+	switch {
+	case errors.Is(err, errAffinityBroken):
+		httpError(rw, r, err.Error(), affinity.FailoverStatus)
+		return
+	case err != nil:
+		httpError(rw, r, "no available server", http.StatusServiceUnavailable)
+		return
+	}
+	route := ""
+	if rt != nil {
+		route = rt.Name
+	}
+	var tags []Tag
+	if t := tagsOf(r); t != nil {
+		tags = t.resolve()
+	}
+	rw, logged := lb.accessLog.wrap(rw, r, route, pool.Name, targetServer, tags)
+	if logged != nil {
+		defer logged()
+	}
+	rw, r, recorded := lb.recorder.wrap(rw, r, route, pool.Name)
+	if recorded != nil {
+		defer recorded()
+	}
+	if s := pool.Egress(); s != nil {
+		rw = s.writer(rw, r)
+	}
+	if rt != nil && rt.Faults.inject(rw, r, targetServer) || pool.Faults().inject(rw, r, targetServer) {
+		return
+	}
+	r = withProxyHooks(r, pool)
+	if isWebSocket(r) {
+		serveWebSocket(rw, r, route, pool, targetServer)
+		return
+	}
+	if isGRPC(r) {
+		serveGRPC(rw, r, pool, targetServer)
+		return
+	}
+	var stream *Stream
+	if rt != nil {
+		stream = rt.Stream
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r = r.WithContext(r.Context())
+		r.Body = &countedBody{ReadCloser: r.Body, pool: pool.Name}
+	}
+	sw := newStreamWriter(rw, stream, pool.Name)
+	defer sw.stop()
+	targetServer.Serve(sw, r)
+}
+
+// DefaultShutdownTimeout bounds a graceful shutdown without a configured
+// shutdown_timeout.
+const DefaultShutdownTimeout = 30 * time.Second
@@ -0,0 +1,69 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+)
+
+// TestLoadBalancerHealthChecks checks that servers found down by health
+// checks stop receiving requests until found up again.
+func TestLoadBalancerHealthChecks(t *testing.T) {
+	a, b := lbtest.NewBackend(t, "a"), lbtest.NewBackend(t, "b")
+	clock := lbtest.NewClock(time.Now())
+	lb, err := NewLoadBalancer(
+		WithBackends(a.URL, b.URL),
+		WithHealthChecker(health.Check{Path: "/", Interval: time.Second, Clock: clock}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.SetAccessLog(nil)
+	lb.StartHealthChecks()
+	defer lb.Pools()[0].Close()
+	if !clock.WaitForTicker(time.Second) {
+		t.Fatal("health checks not started")
+	}
+	lbtest.AssertDistribution(t, lbtest.Distribute(lb, 100, nil), map[string]float64{"a": 1, "b": 1}, 0.01)
+
+	b.SetDown(true)
+	// The second advance waits for the round the first started.
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	lbtest.AssertDistribution(t, lbtest.Distribute(lb, 100, nil), map[string]float64{"a": 1}, 0)
+
+	b.SetDown(false)
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	lbtest.AssertDistribution(t, lbtest.Distribute(lb, 100, nil), map[string]float64{"a": 1, "b": 1}, 0.01)
+}
+
+// TestWithLogger checks that the messages about pools and proxies go to
+// the logger of the load balancer.
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	pool := NewPool("tcp", nil, nil, health.Check{})
+	pool.Protocol = ProtocolTCP
+	lb, err := NewLoadBalancer(WithLogger(slog.New(slog.NewTextHandler(&buf, nil))), WithPools(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewTCPProxy("proxy", "", pool, 0, 0)
+	if err := lb.AddTCPProxy(proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AddServer(lbtest.NewServer("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	proxy.logf(slog.LevelInfo, "dial failed")
+	for _, want := range []string{`Pool \"tcp\": server \"a\" added`, `TCP proxy \"proxy\": dial failed`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q lacks %q", buf.String(), want)
+		}
+	}
+}
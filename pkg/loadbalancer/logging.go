@@ -0,0 +1,263 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// logLevel is the minimum level of the messages logged, changed at runtime
+// through the admin API.
+var logLevel = new(slog.LevelVar)
+
+// SetupLogging sends the log, including that of the log package at the info
+// level, to w, dropping messages below the level set by SetLogLevel.
+func SetupLogging(w io.Writer) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// logf logs a message at the info level to slog.Default, for the parts of
+// the package not belonging to a load balancer or logging apart from it.
+func logf(format string, args ...any) {
+	logTo(nil, slog.LevelInfo, format, args...)
+}
+
+// logTo logs the message formatted from format and args at level to l, or
+// to slog.Default if l is nil.
+func logTo(l *slog.Logger, level slog.Level, format string, args ...any) {
+	if l == nil {
+		l = slog.Default()
+	}
+	if l.Enabled(context.Background(), level) {
+		l.Log(context.Background(), level, fmt.Sprintf(format, args...))
+	}
+}
+
+// SetLogLevel sets the minimum level of the messages logged.
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// ParseLogLevel parses "debug", "info", "warn" or "error".
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// defaultAccessLogBuffer is how many access log lines may wait to be
+// written.
+const defaultAccessLogBuffer = 8192
+
+var accessLogDropped = metrics.NewCounterVec("lb_access_log_dropped_total",
+	"Access log lines dropped because writing them fell behind.")
+
+// asyncWriter writes lines to w from a goroutine of its own, so that the
+// requests logging them don't wait on w. Lines arriving while the buffer is
+// full are dropped and counted in dropped.
+type asyncWriter struct {
+	w       io.Writer
+	lines   chan []byte
+	done    chan struct{}
+	dropped *metrics.CounterVec
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncWriter(w io.Writer, buffer int, dropped *metrics.CounterVec) *asyncWriter {
+	aw := &asyncWriter{w: w, lines: make(chan []byte, buffer), done: make(chan struct{}), dropped: dropped}
+	go aw.run()
+	return aw
+}
+
+// Write queues a copy of p. It never fails.
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.dropped.Inc()
+		return len(p), nil
+	}
+	select {
+	case w.lines <- slices.Clone(p):
+	default:
+		w.dropped.Inc()
+	}
+	return len(p), nil
+}
+
+// run writes the queued lines, in batches while they arrive faster than
+// they are written.
+func (w *asyncWriter) run() {
+	defer close(w.done)
+	bw := bufio.NewWriterSize(w.w, 64<<10)
+	for line := range w.lines {
+		bw.Write(line)
+		if len(w.lines) == 0 {
+			bw.Flush()
+		}
+	}
+	bw.Flush()
+}
+
+// Close writes the lines still queued and stops the writer.
+func (w *asyncWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// AccessLog logs a line for a sample of the requests forwarded to backends.
+// Lines are written in the background; Close writes those still queued.
+type AccessLog struct {
+	logger *slog.Logger
+	out    *asyncWriter
+	file   *LogFile
+	// sample holds the bits of the sampled fraction of requests.
+	sample atomic.Uint64
+}
+
+// NewAccessLog creates an AccessLog writing to w and logging the fraction
+// sample, from 0 to 1, of the requests.
+func NewAccessLog(w io.Writer, sample float64) *AccessLog {
+	out := newAsyncWriter(w, defaultAccessLogBuffer, accessLogDropped)
+	a := &AccessLog{out: out, logger: slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.LevelKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))}
+	a.SetSample(sample)
+	return a
+}
+
+// NewAccessLogFile creates an AccessLog appending to the file at path, which
+// Reopen reopens after it was rotated.
+func NewAccessLogFile(path string, sample float64) (*AccessLog, error) {
+	f, err := OpenLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAccessLog(f, sample)
+	a.file = f
+	return a, nil
+}
+
+// Close writes the lines still queued. Lines logged afterwards are
+// dropped.
+func (a *AccessLog) Close() {
+	if a != nil {
+		a.out.Close()
+	}
+}
+
+// Reopen reopens the file of an access log created by NewAccessLogFile.
+func (a *AccessLog) Reopen() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Reopen()
+}
+
+// Sample returns the fraction of the requests logged.
+func (a *AccessLog) Sample() float64 {
+	return math.Float64frombits(a.sample.Load())
+}
+
+// SetSample changes the fraction of the requests logged, clamped to 0-1.
+func (a *AccessLog) SetSample(sample float64) {
+	a.sample.Store(math.Float64bits(min(max(sample, 0), 1)))
+}
+
+// sampled reports whether the next request is logged.
+func (a *AccessLog) sampled() bool {
+	s := a.Sample()
+	return s >= 1 || s > 0 && rand.Float64() < s
+}
+
+// accessRecorder records the status and size of a response for the access
+// log.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if w.status == 0 || w.status < 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wrap returns the ResponseWriter to forward r with and a function logging
+// the request once it was served, with its tags, or rw and nil if r is not
+// sampled.
+func (a *AccessLog) wrap(rw http.ResponseWriter, r *http.Request, route, pool string, server backend.Server, tags []Tag) (http.ResponseWriter, func()) {
+	if a == nil || !a.sampled() {
+		return rw, nil
+	}
+	rec := &accessRecorder{ResponseWriter: rw}
+	start := time.Now()
+	return rec, func() {
+		// Typed attributes spare boxing every value.
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("path", r.URL.RequestURI()),
+			slog.String("client", logIP(clientIP(r))),
+			slog.String("route", route),
+			slog.String("pool", pool),
+			slog.String("backend", server.Address()),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if len(tags) > 0 {
+			attrs = append(attrs, tagsAttr(tags))
+		}
+		a.logger.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+	}
+}
@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+)
+
+// logRequest serves r through the access log a as a request of server.
+func logRequest(a *AccessLog, rw http.ResponseWriter, r *http.Request, server *lbtest.Server) {
+	w, logged := a.wrap(rw, r, "route", "pool", server, nil)
+	w.WriteHeader(http.StatusOK)
+	if logged != nil {
+		logged()
+	}
+}
+
+func TestAccessLogAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	a := NewAccessLog(io.Discard, 1)
+	defer a.Close()
+	server := lbtest.NewServer("a", 1)
+	r := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+	rw := httptest.NewRecorder()
+	// The recorder and the function logging the request, the path and the
+	// client address logged, the attributes slog.Record holds beyond its
+	// first five, and the line queued.
+	const budget = 6
+	if n := testing.AllocsPerRun(100, func() { logRequest(a, rw, r, server) }); n > budget {
+		t.Errorf("access log: %v allocations, want %d at most", n, budget)
+	}
+	a.SetSample(0)
+	if n := testing.AllocsPerRun(100, func() { logRequest(a, rw, r, server) }); n != 0 {
+		t.Errorf("access log not sampling: %v allocations, want 0", n)
+	}
+}
+
+func BenchmarkAccessLog(b *testing.B) {
+	a := NewAccessLog(io.Discard, 1)
+	defer a.Close()
+	server := lbtest.NewServer("a", 1)
+	r := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+	rw := httptest.NewRecorder()
+	b.ReportAllocs()
+	for b.Loop() {
+		logRequest(a, rw, r, server)
+	}
+}
@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+const defaultMaintenanceBody = "The service is down for maintenance.\n"
+
+var maintenanceResponses = metrics.NewCounterVec("lb_maintenance_responses_total",
+	"Requests answered with the maintenance page instead of being forwarded.", "pool")
+
+// Maintenance answers requests with a static page instead of forwarding them
+// while the load balancer or their pool is in maintenance. The global switch
+// covers Routes, or every request if Routes is empty; each pool has its own
+// switch. Clients in Allow still reach the backends, so operators can check
+// their work before ending the maintenance.
+type Maintenance struct {
+	Status      int
+	Body        []byte
+	ContentType string
+	// RetryAfter, if set, is sent in the Retry-After header.
+	RetryAfter time.Duration
+	Allow      []netip.Prefix
+
+	enabled atomic.Bool
+
+	mu     sync.RWMutex
+	routes []string
+}
+
+// NewMaintenance creates a disabled Maintenance. A zero status means 503
+// Service Unavailable, an empty body a short notice, and an empty content
+// type is detected from the body.
+func NewMaintenance(status int, body []byte, contentType string, retryAfter time.Duration, allow []netip.Prefix) *Maintenance {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	if len(body) == 0 {
+		body = []byte(defaultMaintenanceBody)
+	}
+	if contentType == "" {
+		if json.Valid(body) {
+			contentType = "application/json"
+		} else {
+			contentType = http.DetectContentType(body)
+		}
+	}
+	return &Maintenance{Status: status, Body: body, ContentType: contentType, RetryAfter: retryAfter, Allow: allow}
+}
+
+// Enabled reports whether the global maintenance switch is on.
+func (m *Maintenance) Enabled() bool { return m.enabled.Load() }
+
+// SetEnabled turns the global maintenance switch on or off.
+func (m *Maintenance) SetEnabled(enabled bool) { m.enabled.Store(enabled) }
+
+// Routes returns the names of the routes covered by the global switch; nil
+// covers every request.
+func (m *Maintenance) Routes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.routes
+}
+
+// SetRoutes restricts the global switch to the named routes; nil covers
+// every request, including those matching no route.
+func (m *Maintenance) SetRoutes(routes []string) {
+	m.mu.Lock()
+	m.routes = routes
+	m.mu.Unlock()
+}
+
+// blocks reports whether r, matched by rt (nil for the fallback), must be
+// answered with the maintenance page instead of being forwarded to pool.
+func (m *Maintenance) blocks(r *http.Request, rt *Route, pool *Pool) bool {
+	if !pool.InMaintenance() && !(m.Enabled() && m.covers(rt)) {
+		return false
+	}
+	ip := clientIP(r)
+	return !slices.ContainsFunc(m.Allow, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
+
+func (m *Maintenance) covers(rt *Route) bool {
+	routes := m.Routes()
+	return len(routes) == 0 || rt != nil && slices.Contains(routes, rt.Name)
+}
+
+// ServeHTTP writes the maintenance page.
+func (m *Maintenance) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h := rw.Header()
+	h.Set("Content-Type", m.ContentType)
+	h.Set("Cache-Control", "no-store")
+	if m.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Round(time.Second)/time.Second)))
+	}
+	rw.WriteHeader(m.Status)
+	if r.Method != http.MethodHead {
+		rw.Write(m.Body)
+	}
+}
@@ -0,0 +1,267 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMDNSGroup   = "224.0.0.251:5353"
+	defaultMDNSTimeout = time.Second
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+)
+
+// MDNSDiscoverer yields the instances of a DNS-SD service type, such as
+// "_http._tcp", advertised over multicast DNS on the local network. Each
+// discovery sends one query and collects the answers arriving within
+// Timeout; the SRV priority and weight of an instance become its tier and
+// weight, as for SRVDiscoverer. Instances whose responders do not include
+// their addresses alongside the SRV record are skipped.
+type MDNSDiscoverer struct {
+	Service string
+	Domain  string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme  string
+	Timeout time.Duration
+	// Group is the multicast address queries are sent to.
+	Group string
+}
+
+// NewMDNSDiscoverer creates an MDNSDiscoverer for service in the "local"
+// domain.
+func NewMDNSDiscoverer(service string) (*MDNSDiscoverer, error) {
+	if !strings.HasPrefix(service, "_") || !strings.Contains(service, "._") {
+		return nil, fmt.Errorf("mdns service %q is not of the form _name._tcp", service)
+	}
+	return &MDNSDiscoverer{
+		Service: service,
+		Domain:  "local",
+		Timeout: defaultMDNSTimeout,
+		Group:   defaultMDNSGroup,
+	}, nil
+}
+
+// Discover implements Discoverer.
+func (m *MDNSDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	group, err := net.ResolveUDPAddr("udp", m.Group)
+	if err != nil {
+		return nil, err
+	}
+	// Queries from a port other than 5353 are answered by unicast to it.
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	name := strings.TrimSuffix(m.Service, ".") + "." + strings.Trim(m.Domain, ".") + "."
+	if _, err := conn.WriteToUDP(dnsQuery(name, dnsTypePTR), group); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(m.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	instances := map[string]bool{}
+	srvs := map[string]dnsSRV{}
+	addrs := map[string][]netip.Addr{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		records, err := parseDNSRecords(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, rr := range records {
+			switch rr.typ {
+			case dnsTypePTR:
+				if strings.EqualFold(rr.name, name) {
+					instances[strings.ToLower(rr.ptr)] = true
+				}
+			case dnsTypeSRV:
+				srvs[strings.ToLower(rr.name)] = rr.srv
+			case dnsTypeA, dnsTypeAAAA:
+				host := strings.ToLower(rr.name)
+				addrs[host] = append(addrs[host], rr.addr)
+			}
+		}
+	}
+
+	var targets []Target
+	seen := map[string]bool{}
+	for inst := range instances {
+		srv, ok := srvs[inst]
+		if !ok {
+			continue
+		}
+		for _, ip := range addrs[strings.ToLower(srv.target)] {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.port)))
+			if m.Scheme != "" {
+				addr = m.Scheme + "://" + addr
+			}
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			targets = append(targets, Target{
+				Addr:       addr,
+				ServerName: strings.TrimSuffix(srv.target, "."),
+				Weight:     max(int(srv.weight), 1),
+				Tier:       int(srv.priority),
+			})
+		}
+	}
+	return targets, nil
+}
+
+// dnsQuery returns a DNS query message for name.
+func dnsQuery(name string, typ uint16) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN)
+}
+
+type dnsSRV struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// dnsRecord is a resource record of a type used in DNS-SD.
+type dnsRecord struct {
+	name string
+	typ  uint16
+	ptr  string
+	srv  dnsSRV
+	addr netip.Addr
+}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// parseDNSRecords returns the PTR, SRV, A and AAAA records of all sections of
+// a DNS response.
+func parseDNSRecords(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, errDNSMessage
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rrs := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for range qd {
+		_, n, err := dnsName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+	var records []dnsRecord
+	for range rrs {
+		name, n, err := dnsName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rr := dnsRecord{name: name, typ: binary.BigEndian.Uint16(msg[n:])}
+		length := int(binary.BigEndian.Uint16(msg[n+8:]))
+		data := n + 10
+		if data+length > len(msg) {
+			return nil, errDNSMessage
+		}
+		rdata := msg[data : data+length]
+		off = data + length
+		switch rr.typ {
+		case dnsTypePTR:
+			if rr.ptr, _, err = dnsName(msg, data); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, errDNSMessage
+			}
+			rr.srv = dnsSRV{
+				priority: binary.BigEndian.Uint16(rdata),
+				weight:   binary.BigEndian.Uint16(rdata[2:]),
+				port:     binary.BigEndian.Uint16(rdata[4:]),
+			}
+			if rr.srv.target, _, err = dnsName(msg, data+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			var ok bool
+			if rr.addr, ok = netip.AddrFromSlice(rdata); !ok {
+				return nil, errDNSMessage
+			}
+			rr.addr = rr.addr.Unmap()
+		default:
+			continue
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+// dnsName decodes the possibly compressed name at off and returns it with
+// the offset following it.
+func dnsName(msg []byte, off int) (string, int, error) {
+	var b strings.Builder
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			if b.Len() == 0 {
+				b.WriteByte('.')
+			}
+			return b.String(), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			b.Write(msg[off+1 : off+1+l])
+			b.WriteByte('.')
+			off += 1 + l
+		}
+	}
+}
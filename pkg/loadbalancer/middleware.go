@@ -0,0 +1,43 @@
+package loadbalancer
+
+import "net/http"
+
+// Middleware wraps the handling of a request, running before or after next,
+// or answering in its place.
+type Middleware func(next http.Handler) http.Handler
+
+// Chain is an ordered list of middleware, the first running outermost.
+type Chain []Middleware
+
+// Then returns h wrapped by the middleware of the chain.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+	return h
+}
+
+// Use appends mw to the middleware run for every request, after the
+// forwarding headers and GeoIP country are resolved and before the request
+// is routed. Middleware of a route, in Route.Middleware, runs once the route
+// is matched.
+func (lb *LoadBalancer) Use(mw ...Middleware) {
+	lb.use("", mw...)
+}
+
+// use appends mw as Use does, naming it for Explain.
+func (lb *LoadBalancer) use(name string, mw ...Middleware) {
+	lb.middleware = append(lb.middleware, mw...)
+	for range mw {
+		lb.middlewareNames = append(lb.middlewareNames, name)
+	}
+	lb.routed = lb.middleware.Then(http.HandlerFunc(lb.serveRouted))
+}
+
+// routeHandler returns the handler of the requests matched by rt, wrapped
+// by the route's middleware.
+func (lb *LoadBalancer) routeHandler(rt *Route) http.Handler {
+	return rt.Middleware.Then(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lb.serveRoute(rw, r, rt)
+	}))
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+// Mirror defaults.
+const (
+	defaultMirrorMaxBody  = 1 << 20
+	defaultMirrorTimeout  = 10 * time.Second
+	defaultMirrorInFlight = 100
+)
+
+var (
+	mirroredRequests = metrics.NewCounterVec("lb_mirror_requests_total",
+		"Requests copied to a route's shadow pool.", "route", "pool")
+	mirrorDropped = metrics.NewCounterVec("lb_mirror_dropped_total",
+		"Requests that were selected for mirroring but not copied.", "route", "reason")
+)
+
+// Mirror asynchronously copies a percentage of a route's requests to a shadow
+// pool. Shadow responses are discarded and never affect the client.
+//
+// Request bodies are buffered to be sent twice, so requests whose body exceeds
+// MaxBody are not mirrored. At most MaxInFlight copies are outstanding at once;
+// further copies are dropped rather than queued.
+type Mirror struct {
+	Pool        string
+	Percent     float64
+	MaxBody     int64
+	Timeout     time.Duration
+	MaxInFlight int
+
+	inFlight chan struct{}
+}
+
+// NewMirror creates a Mirror sending percent (0-100) of traffic to pool.
+// Zero values for the limits select the defaults.
+func NewMirror(pool string, percent float64, maxBody int64, timeout time.Duration, maxInFlight int) *Mirror {
+	if maxBody <= 0 {
+		maxBody = defaultMirrorMaxBody
+	}
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMirrorInFlight
+	}
+	return &Mirror{
+		Pool:        pool,
+		Percent:     percent,
+		MaxBody:     maxBody,
+		Timeout:     timeout,
+		MaxInFlight: maxInFlight,
+		inFlight:    make(chan struct{}, maxInFlight),
+	}
+}
+
+// mirror sends a copy of r to the route's shadow pool if it is selected. It
+// returns the request to forward to the primary pool, whose body may have been
+// replaced by a buffered copy.
+func (lb *LoadBalancer) mirror(rt *Route, r *http.Request) *http.Request {
+	m := rt.Mirror
+	if m.Percent <= 0 || rand.Float64()*100 >= m.Percent {
+		return r
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > m.MaxBody {
+			mirrorDropped.Inc(rt.Name, "body_too_large")
+			return r
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		// Reading the body has sent the client its 100 Continue already;
+		// the backend's interim response must not be relayed a second time.
+		r.Header.Del("Expect")
+		if int64(len(buf)) > m.MaxBody || err != nil {
+			// Hand the primary request what was read followed by the rest.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			mirrorDropped.Inc(rt.Name, "body_too_large")
+			return r
+		}
+		body = buf
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		mirrorDropped.Inc(rt.Name, "too_many_in_flight")
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(lb.ctx, m.Timeout)
+	shadow := r.Clone(ctx)
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+		pool := lb.Pool(m.Pool)
+		server := pool.GetNextAvailableServer()
+		if server == nil {
+			mirrorDropped.Inc(rt.Name, "no_available_server")
+			return
+		}
+		mirroredRequests.Inc(rt.Name, m.Pool)
+		server.Serve(discardResponseWriter{header: http.Header{}}, withProxyHooks(shadow, pool))
+	}()
+	return r
+}
+
+// discardResponseWriter swallows a shadow response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,213 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	http2Conns = metrics.NewGaugeVec("lb_backend_http2_connections",
+		"Open HTTP/2 connections to backends, which multiplex the requests sent to them as streams.", "server")
+	http2Streams = metrics.NewGaugeVec("lb_backend_http2_streams",
+		"Requests in flight over HTTP/2 connections to backends.", "server")
+)
+
+// upstreamConn is a connection to a backend. Once a request finds it speaks
+// HTTP/2 it is registered with its server, which then counts the streams,
+// that is the requests, multiplexed on it.
+type upstreamConn struct {
+	net.Conn
+	opened   time.Time
+	streams  atomic.Int64
+	requests atomic.Int64
+
+	mu       sync.Mutex
+	server   *SimpleServer
+	protocol string
+	checked  bool
+	closed   bool
+}
+
+// trackConns wraps dial so that its connections can be tracked.
+func trackConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &upstreamConn{Conn: conn, opened: time.Now()}, nil
+	}
+}
+
+// upstreamConnOf returns the tracked connection underlying conn, or nil.
+func upstreamConnOf(conn net.Conn) *upstreamConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*upstreamConn)
+	return c
+}
+
+// register registers c with s if it speaks HTTP/2, which s learns as it
+// gets c for a request, and reports whether it does.
+func (c *upstreamConn) register(s *SimpleServer, conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked {
+		return c.server != nil
+	}
+	c.checked = true
+	if tc, ok := conn.(*tls.Conn); ok {
+		if tc.ConnectionState().NegotiatedProtocol != "h2" {
+			return false
+		}
+		c.protocol = "h2"
+	} else {
+		if !s.prefersH2C() {
+			return false
+		}
+		c.protocol = "h2c"
+	}
+	if c.closed {
+		return false
+	}
+	c.server = s
+	s.conns.add(c)
+	http2Conns.Inc(s.addr)
+	return true
+}
+
+func (c *upstreamConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		if s := c.server; s != nil {
+			s.conns.remove(c)
+			http2Conns.Dec(s.addr)
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// http2Stream follows the request of a server through the connection
+// carrying it.
+type http2Stream struct {
+	server *SimpleServer
+	conn   *upstreamConn
+}
+
+// trace returns the context of a request followed by st.
+func (st *http2Stream) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: st.gotConn})
+}
+
+func (st *http2Stream) gotConn(info httptrace.GotConnInfo) {
+	// A request retried on another connection left the first one.
+	st.done()
+	c := upstreamConnOf(info.Conn)
+	if c == nil || !c.register(st.server, info.Conn) {
+		return
+	}
+	c.streams.Add(1)
+	c.requests.Add(1)
+	http2Streams.Inc(st.server.addr)
+	st.conn = c
+}
+
+// done ends the stream, once the response has been copied.
+func (st *http2Stream) done() {
+	if c := st.conn; c != nil {
+		c.streams.Add(-1)
+		http2Streams.Dec(st.server.addr)
+		st.conn = nil
+	}
+}
+
+// connSet holds the HTTP/2 connections of a server.
+type connSet struct {
+	mu sync.Mutex
+	m  map[*upstreamConn]struct{}
+}
+
+func (cs *connSet) add(c *upstreamConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.m == nil {
+		cs.m = map[*upstreamConn]struct{}{}
+	}
+	cs.m[c] = struct{}{}
+}
+
+func (cs *connSet) remove(c *upstreamConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.m, c)
+}
+
+// HTTP2Conn describes an open HTTP/2 connection to a backend: Streams is
+// the number of requests in flight on it, Requests the number it has
+// carried.
+type HTTP2Conn struct {
+	Local    string
+	Remote   string
+	Protocol string
+	Opened   time.Time
+	Streams  int64
+	Requests int64
+}
+
+// HTTP2Conns returns the open HTTP/2 connections to the server, oldest
+// first.
+func (s *SimpleServer) HTTP2Conns() []HTTP2Conn {
+	s.conns.mu.Lock()
+	conns := make([]HTTP2Conn, 0, len(s.conns.m))
+	for c := range s.conns.m {
+		conns = append(conns, HTTP2Conn{
+			Local:    c.LocalAddr().String(),
+			Remote:   c.RemoteAddr().String(),
+			Protocol: c.protocol,
+			Opened:   c.opened,
+			Streams:  c.streams.Load(),
+			Requests: c.requests.Load(),
+		})
+	}
+	s.conns.mu.Unlock()
+	slices.SortFunc(conns, func(a, b HTTP2Conn) int { return a.Opened.Compare(b.Opened) })
+	return conns
+}
+
+// mayUseHTTP2 reports whether the server's transport may speak HTTP/2 to
+// it, for its requests to be followed onto their connections.
+func (s *SimpleServer) mayUseHTTP2() bool {
+	t, _ := s.transport.(*http.Transport)
+	if t == nil {
+		return false
+	}
+	if s.prefersH2C() {
+		return true
+	}
+	if s.target.Scheme != "https" {
+		return false
+	}
+	if t.Protocols != nil {
+		return t.Protocols.HTTP2()
+	}
+	return t.ForceAttemptHTTP2
+}
+
+// prefersH2C reports whether the server's transport speaks HTTP/2 with
+// prior knowledge to cleartext servers.
+func (s *SimpleServer) prefersH2C() bool {
+	t, _ := s.transport.(*http.Transport)
+	return t != nil && t.Protocols != nil && t.Protocols.UnencryptedHTTP2() && !t.Protocols.HTTP1()
+}
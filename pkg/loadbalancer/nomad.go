@@ -0,0 +1,147 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNomadAddr = "http://127.0.0.1:4646"
+	// nomadWait bounds blocking queries, as consulWait does.
+	nomadWait = 5 * time.Minute
+)
+
+// NomadDiscoverer yields the allocations registered for a service in Nomad's
+// native service catalog. Nomad removes registrations of allocations that
+// stop or fail their checks, so rescheduled allocations are followed.
+//
+// NomadDiscoverer is a Watcher, using blocking queries like
+// ConsulDiscoverer.
+type NomadDiscoverer struct {
+	// Addr is the URL of the Nomad HTTP API.
+	Addr      string
+	Service   string
+	Namespace string
+	// Tags, if set, only admits registrations carrying all of them.
+	Tags  []string
+	Token string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+	Client *http.Client
+
+	mu    sync.Mutex
+	index uint64
+}
+
+// NewNomadDiscoverer creates a NomadDiscoverer for service. An empty addr
+// defaults to the local agent.
+func NewNomadDiscoverer(addr, service string) (*NomadDiscoverer, error) {
+	if service == "" {
+		return nil, fmt.Errorf("nomad service must not be empty")
+	}
+	if addr == "" {
+		addr = defaultNomadAddr
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("nomad address: %w", err)
+	}
+	return &NomadDiscoverer{
+		Addr:    strings.TrimSuffix(addr, "/"),
+		Service: service,
+		Client:  &http.Client{Timeout: nomadWait + 30*time.Second},
+	}, nil
+}
+
+// Discover implements Discoverer.
+func (n *NomadDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	targets, index, err := n.query(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.index = index
+	n.mu.Unlock()
+	return targets, nil
+}
+
+// Watch implements Watcher.
+func (n *NomadDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	for {
+		n.mu.Lock()
+		last := n.index
+		n.mu.Unlock()
+		targets, index, err := n.query(ctx, last)
+		if err != nil {
+			return nil, err
+		}
+		if index < last {
+			index = 0
+		}
+		n.mu.Lock()
+		n.index = index
+		n.mu.Unlock()
+		if index != last {
+			return targets, nil
+		}
+	}
+}
+
+// query fetches the service's registrations, blocking until the index moves
+// past index if it is non-zero.
+func (n *NomadDiscoverer) query(ctx context.Context, index uint64) ([]Target, uint64, error) {
+	q := url.Values{}
+	if n.Namespace != "" {
+		q.Set("namespace", n.Namespace)
+	}
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", nomadWait.String())
+	}
+	u := n.Addr + "/v1/service/" + url.PathEscape(n.Service) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n.Token != "" {
+		req.Header.Set("X-Nomad-Token", n.Token)
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("nomad: %s", resp.Status)
+	}
+	var regs []struct {
+		Address string
+		Port    int
+		Tags    []string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&regs); err != nil {
+		return nil, 0, fmt.Errorf("nomad: %w", err)
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+
+	targets := make([]Target, 0, len(regs))
+	for _, reg := range regs {
+		if !slices.ContainsFunc(n.Tags, func(tag string) bool { return !slices.Contains(reg.Tags, tag) }) {
+			addr := net.JoinHostPort(reg.Address, strconv.Itoa(reg.Port))
+			if n.Scheme != "" {
+				addr = n.Scheme + "://" + addr
+			}
+			targets = append(targets, Target{Addr: addr})
+		}
+	}
+	return targets, next, nil
+}
@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+// DefaultPort is the port a LoadBalancer serves on unless WithPort is given.
+const DefaultPort = "8000"
+
+// DefaultPoolName names the pool of the servers given by WithServers and
+// WithBackends, which serves the requests no route matches.
+const DefaultPoolName = "default"
+
+// Option configures a LoadBalancer created by NewLoadBalancer.
+type Option func(*options)
+
+type options struct {
+	port        string
+	pools       []*Pool
+	servers     []backend.Server
+	backends    []string
+	strategy    strategy.Strategy
+	healthCheck health.Check
+	logger      *slog.Logger
+	transport   *http.Transport
+}
+
+// WithPort sets the port the load balancer serves HTTP requests on.
+func WithPort(port string) Option {
+	return func(o *options) { o.port = port }
+}
+
+// WithPools adds pools to the load balancer. Routes and the fallback refer
+// to them by name.
+func WithPools(pools ...*Pool) Option {
+	return func(o *options) { o.pools = append(o.pools, pools...) }
+}
+
+// WithServers adds servers to the default pool.
+func WithServers(servers ...backend.Server) Option {
+	return func(o *options) { o.servers = append(o.servers, servers...) }
+}
+
+// WithBackends adds servers proxying to the URLs addrs, as accepted by
+// NewSimpleServer, to the default pool.
+func WithBackends(addrs ...string) Option {
+	return func(o *options) { o.backends = append(o.backends, addrs...) }
+}
+
+// WithStrategy sets the strategy balancing the default pool; it defaults to
+// round robin.
+func WithStrategy(s strategy.Strategy) Option {
+	return func(o *options) { o.strategy = s }
+}
+
+// WithHealthChecker sets the health check of the default pool, which is not
+// probed otherwise.
+func WithHealthChecker(c health.Check) Option {
+	return func(o *options) { o.healthCheck = c }
+}
+
+// WithLogger sets the logger of the messages the load balancer logs about
+// its pools, routes and proxies. They go to slog.Default otherwise, as do
+// those of its middleware and of the process, such as upgrades.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithTransport sets the transport the servers of WithBackends, and those
+// of the pools added through the admin API, are proxied through. Each gets
+// a copy of its own, so that their connections are kept apart.
+func WithTransport(t *http.Transport) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// defaultPool returns the pool of the servers of WithServers and
+// WithBackends, or nil if there are none.
+func (o *options) defaultPool(up *upstream) (*Pool, error) {
+	servers := o.servers
+	for _, addr := range o.backends {
+		var t *http.Transport
+		own := false
+		if up != nil {
+			t, own = up.forServer(false)
+		}
+		s, err := newSimpleServer(addr, t)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", addr, err)
+		}
+		s.ownTransport = own
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	s := o.strategy
+	if s == nil {
+		s = &strategy.RoundRobin{}
+	}
+	return NewPool(DefaultPoolName, servers, s, o.healthCheck), nil
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clientHelloTimeout = 5 * time.Second
+
+var errClientHelloRead = errors.New("client hello read")
+
+// Passthrough forwards TLS connections for Hosts straight to the servers of
+// a tcp pool, without terminating TLS: the LB only reads the server name
+// from the unencrypted ClientHello. Hosts are exact names or wildcards of
+// the form *.example.com matching a single label.
+type Passthrough struct {
+	Name  string
+	Hosts []string
+	proxy *TCPProxy
+}
+
+// NewPassthrough creates a Passthrough to pool, which must be a tcp pool.
+func NewPassthrough(name string, hosts []string, pool *Pool) *Passthrough {
+	lower := make([]string, len(hosts))
+	for i, h := range hosts {
+		lower[i] = strings.ToLower(h)
+	}
+	return &Passthrough{Name: name, Hosts: lower, proxy: NewTCPProxy(name, "", pool, 0, 0)}
+}
+
+// Matches reports whether the passthrough applies to serverName.
+func (p *Passthrough) Matches(serverName string) bool {
+	serverName = strings.ToLower(serverName)
+	for _, h := range p.Hosts {
+		if h == serverName {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if label, ok := strings.CutSuffix(serverName, suffix); ok && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passthroughListener sorts the connections of a TLS listener: those whose
+// ClientHello names a passthrough host are forwarded encrypted, the others
+// are returned by Accept for the LB to terminate.
+type passthroughListener struct {
+	net.Listener
+	routes []*Passthrough
+
+	conns     chan net.Conn
+	errOnce   sync.Once
+	err       error
+	errc      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPassthroughListener(ln net.Listener, routes []*Passthrough) *passthroughListener {
+	l := &passthroughListener{Listener: ln, routes: routes, conns: make(chan net.Conn), errc: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.errOnce.Do(func() { l.err = err; close(l.errc) })
+			return
+		}
+		go l.sort(conn)
+	}
+}
+
+// sort reads the ClientHello of conn and either forwards the connection or
+// hands it to Accept with the bytes read replayed.
+func (l *passthroughListener) sort(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	pc := &prefixConn{Conn: conn, prefix: hello}
+	for _, p := range l.routes {
+		if serverName != "" && p.Matches(serverName) {
+			p.proxy.handle(pc)
+			return
+		}
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.errc:
+		conn.Close()
+	}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.errc:
+		return nil, l.err
+	}
+}
+
+// readServerName reads the ClientHello from conn and returns the SNI server
+// name along with the bytes consumed.
+func readServerName(conn net.Conn) (string, []byte) {
+	var buf bytes.Buffer
+	var serverName string
+	tlsConn := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	})
+	if err := tlsConn.Handshake(); err != nil && !errors.Is(err, errClientHelloRead) {
+		logf("Connection from %q: reading ClientHello: %v", logAddr(conn.RemoteAddr()), err)
+	}
+	return serverName, buf.Bytes()
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+
+// prefixConn replays prefix before reading from the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection where supported.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
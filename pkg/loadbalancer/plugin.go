@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"plugin"
+	"sync"
+)
+
+// TransformFactory creates the middleware of a transformation from its JSON
+// configuration. The middleware may inspect and modify the request before
+// calling next, answer it itself, or wrap the ResponseWriter to modify the
+// response.
+//
+// It is a plain function type, rather than one using Middleware, so that Go
+// plugins loaded by Transform can provide one without importing this
+// package.
+type TransformFactory = func(config json.RawMessage) (func(next http.Handler) http.Handler, error)
+
+var (
+	transformsMu sync.Mutex
+	transforms   = map[string]TransformFactory{}
+)
+
+// RegisterTransform makes a transformation available under name to the
+// plugins configuration, for transformations compiled into the load
+// balancer, usually from an init function in a file behind a build tag.
+func RegisterTransform(name string, factory TransformFactory) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if _, dup := transforms[name]; dup {
+		panic("transform " + name + " registered twice")
+	}
+	transforms[name] = factory
+}
+
+// Transform returns the middleware of the transformation name, configured
+// with config. If path is set, the transformation is the Go plugin at path,
+// built with "go build -buildmode=plugin" against the same Go version and
+// module versions as the load balancer, which must export
+//
+//	func New(config json.RawMessage) (func(http.Handler) http.Handler, error)
+//
+// Otherwise it is one registered with RegisterTransform.
+func Transform(name, path string, config json.RawMessage) (Middleware, error) {
+	var factory TransformFactory
+	if path != "" {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		sym, err := p.Lookup("New")
+		if err != nil {
+			return nil, err
+		}
+		fn, ok := sym.(func(json.RawMessage) (func(http.Handler) http.Handler, error))
+		if !ok {
+			return nil, fmt.Errorf("%s: New has type %T, want func(json.RawMessage) (func(http.Handler) http.Handler, error)", path, sym)
+		}
+		factory = fn
+	} else {
+		transformsMu.Lock()
+		factory = transforms[name]
+		transformsMu.Unlock()
+		if factory == nil {
+			return nil, fmt.Errorf("unknown transform %q (set path to load a plugin)", name)
+		}
+	}
+	mw, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+	return Middleware(mw), nil
+}
+
+// LoadExtension opens the Go plugin at path, built as those of Transform
+// are. Its init functions register what it provides, from any of
+// strategy.Register, health.Register, RegisterDiscoverer and
+// RegisterTransform, for the configuration to refer to by name. Loading a
+// plugin again has no effect.
+func LoadExtension(path string) error {
+	_, err := plugin.Open(path)
+	return err
+}
@@ -0,0 +1,306 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+// Pool is a named group of servers sharing a selection strategy and health check settings.
+type Pool struct {
+	Name string
+	// Protocol is the protocol spoken to the servers; empty means HTTP.
+	Protocol string
+
+	// members is replaced as a whole when the servers change and never
+	// modified in place, so that requests select a server without locking
+	// and callers may keep using a slice they obtained.
+	members     atomic.Pointer[poolMembers]
+	strategy    strategy.Strategy
+	healthCheck health.Check
+	affinity    *Affinity
+	ring        atomic.Pointer[hashRing]
+	discovery   *Discovery
+	datacenters *Datacenters
+
+	// logger is that of the load balancer the pool belongs to.
+	logger *slog.Logger
+
+	// newServer builds servers added at runtime.
+	newServer func(config.ServerConfig) (backend.Server, error)
+	// editMu serializes runtime changes of the servers.
+	editMu sync.Mutex
+	// added and removed record the servers added and removed at runtime,
+	// for state snapshots; they are guarded by editMu.
+	added   map[string]config.ServerConfig
+	removed map[string]bool
+	// ctx is canceled by Close, stopping the pool's background work.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	maintenance atomic.Bool
+	hooks       atomic.Pointer[ProxyHooks]
+	egress      *Shaper
+	faults      *Faults
+}
+
+// NewPool creates a Pool. A nil strategy defaults to round robin.
+func NewPool(name string, servers []backend.Server, s strategy.Strategy, healthCheck health.Check) *Pool {
+	if s == nil {
+		s = &strategy.RoundRobin{}
+	}
+	p := &Pool{
+		Name:        name,
+		strategy:    s,
+		healthCheck: healthCheck,
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.members.Store(newPoolMembers(servers))
+	return p
+}
+
+// poolMembers is an immutable snapshot of the servers of a pool.
+type poolMembers struct {
+	servers []backend.Server
+	// tiers groups servers by tier, lowest first; it is nil if they all
+	// share one.
+	tiers [][]backend.Server
+}
+
+func newPoolMembers(servers []backend.Server) *poolMembers {
+	return &poolMembers{servers: servers, tiers: backend.Tiers(servers)}
+}
+
+// Close stops the pool's health checks and discovery, and closes the idle
+// connections to its servers.
+func (p *Pool) Close() {
+	p.cancel()
+	for _, s := range p.Servers() {
+		if c, ok := s.(idleCloser); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// InMaintenance reports whether the pool is in maintenance, its requests
+// being answered with the maintenance page.
+func (p *Pool) InMaintenance() bool { return p.maintenance.Load() }
+
+// SetMaintenance puts the pool in or out of maintenance.
+func (p *Pool) SetMaintenance(on bool) { p.maintenance.Store(on) }
+
+// SetEgress caps the bandwidth of the pool's responses, and of what the TCP
+// proxies of tcp pools send to clients. A nil shaper removes the cap.
+func (p *Pool) SetEgress(s *Shaper) {
+	p.egress = s
+}
+
+// Egress returns the pool's bandwidth cap, or nil if it has none.
+func (p *Pool) Egress() *Shaper {
+	return p.egress
+}
+
+// SetFaults injects faults into the requests forwarded to the pool; nil
+// injects none.
+func (p *Pool) SetFaults(f *Faults) {
+	p.faults = f
+}
+
+// Faults returns the faults injected into the pool's requests, or nil.
+func (p *Pool) Faults() *Faults {
+	return p.faults
+}
+
+// logf logs a message about the pool at the info level.
+func (p *Pool) logf(format string, args ...any) {
+	logTo(p.logger, slog.LevelInfo, "Pool %q: "+format, append([]any{p.Name}, args...)...)
+}
+
+// Servers returns the servers of the pool.
+func (p *Pool) Servers() []backend.Server {
+	return p.members.Load().servers
+}
+
+// SetServers replaces the servers of the pool. Requests already selecting a
+// server keep using the servers they started with. The idle connections to
+// the servers removed are closed.
+func (p *Pool) SetServers(servers []backend.Server) {
+	old := p.members.Swap(newPoolMembers(servers))
+	for _, s := range old.servers {
+		if c, ok := s.(idleCloser); ok && !slices.Contains(servers, s) {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// idleCloser is implemented by servers keeping idle connections.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+// retier regroups the servers of the pool after a change of their tiers.
+func (p *Pool) retier() {
+	for {
+		old := p.members.Load()
+		if p.members.CompareAndSwap(old, newPoolMembers(old.servers)) {
+			return
+		}
+	}
+}
+
+// Server returns the server of the pool with the address addr, or nil.
+func (p *Pool) Server(addr string) backend.Server {
+	for _, s := range p.Servers() {
+		if s.Address() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// NewServer builds a server for the pool from sc, as the pool's configured
+// servers are built.
+func (p *Pool) NewServer(sc config.ServerConfig) (backend.Server, error) {
+	if p.newServer == nil {
+		return nil, fmt.Errorf("pool %q does not support adding servers", p.Name)
+	}
+	return p.newServer(sc)
+}
+
+// AddServer adds a server to the pool at runtime. It is kept across
+// discovery refreshes.
+func (p *Pool) AddServer(s backend.Server) error {
+	p.editMu.Lock()
+	defer p.editMu.Unlock()
+	if d := p.discovery; d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+	if p.Server(s.Address()) != nil {
+		return fmt.Errorf("pool %q already has server %q", p.Name, s.Address())
+	}
+	if d := p.discovery; d != nil {
+		d.static = append(slices.Clip(d.static), s)
+	}
+	p.SetServers(append(slices.Clip(p.Servers()), s))
+	poolServers.Set(int64(len(p.Servers())), p.Name)
+	p.logf("server %q added", s.Address())
+	emit(BackendAdded{Time: time.Now(), Pool: p.Name, Server: s})
+	return nil
+}
+
+// AddServerConfig builds a server from sc with NewServer and adds it with
+// AddServer, recording sc for state snapshots.
+func (p *Pool) AddServerConfig(sc config.ServerConfig) (backend.Server, error) {
+	s, err := p.NewServer(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.AddServer(s); err != nil {
+		return nil, err
+	}
+	p.editMu.Lock()
+	if p.added == nil {
+		p.added = map[string]config.ServerConfig{}
+	}
+	p.added[s.Address()] = sc
+	delete(p.removed, s.Address())
+	p.editMu.Unlock()
+	if d := p.datacenters; d != nil {
+		d.Assign(s.Address(), sc.Datacenter)
+	}
+	return s, nil
+}
+
+// RemoveServer removes the server with the address addr from the pool and
+// reports whether there was one. Discovered servers come back on the next
+// refresh if they are still discovered.
+func (p *Pool) RemoveServer(addr string) bool {
+	p.editMu.Lock()
+	defer p.editMu.Unlock()
+	if _, ok := p.added[addr]; ok {
+		delete(p.added, addr)
+	} else if p.Server(addr) != nil {
+		if p.removed == nil {
+			p.removed = map[string]bool{}
+		}
+		p.removed[addr] = true
+	}
+	if d := p.discovery; d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.static = slices.DeleteFunc(slices.Clone(d.static), func(s backend.Server) bool { return s.Address() == addr })
+	}
+	old := p.Servers()
+	i := slices.IndexFunc(old, func(s backend.Server) bool { return s.Address() == addr })
+	if i < 0 {
+		return false
+	}
+	removed := old[i]
+	servers := slices.Delete(slices.Clone(old), i, i+1)
+	p.SetServers(servers)
+	poolServers.Set(int64(len(servers)), p.Name)
+	p.logf("server %q removed", addr)
+	emit(BackendRemoved{Time: time.Now(), Pool: p.Name, Server: removed})
+	return true
+}
+
+// GetNextAvailableServer retrieves the next server of the pool available for
+// handling requests, or nil if none is alive. Servers of a tier are only used
+// while no lower tier has a live server; drained servers are skipped. Pools
+// routing by data center pick one first, and then a server of it.
+func (p *Pool) GetNextAvailableServer() backend.Server {
+	servers := p.candidates()
+	if len(servers) == 0 {
+		return nil
+	}
+	return p.strategy.Next(servers)
+}
+
+// candidates returns the servers the strategy picks the next server among:
+// those of the first tier with an available server, or else all of them,
+// without those live but unavailable, of the data center picked if the
+// pool routes by data center.
+func (p *Pool) candidates() []backend.Server {
+	m := p.members.Load()
+	if len(m.servers) == 0 {
+		return nil
+	}
+	if d := p.datacenters; d != nil {
+		if site := d.pick(m); site != nil {
+			m = site
+		}
+	}
+	return m.candidates()
+}
+
+// candidates returns the servers of m the strategy picks the next server
+// among, as Pool.candidates does.
+func (m *poolMembers) candidates() []backend.Server {
+	for _, tier := range m.tiers {
+		if slices.ContainsFunc(tier, backend.Available) {
+			return withoutUnavailable(tier)
+		}
+	}
+	return withoutUnavailable(m.servers)
+}
+
+// withoutUnavailable returns servers without the live servers that may not
+// receive new requests, such as drained ones. Strategies skip dead servers
+// themselves.
+func withoutUnavailable(servers []backend.Server) []backend.Server {
+	i := slices.IndexFunc(servers, func(s backend.Server) bool { return s.IsAlive() && !backend.Available(s) })
+	if i < 0 {
+		return servers
+	}
+	return slices.DeleteFunc(slices.Clone(servers), func(s backend.Server) bool { return s.IsAlive() && !backend.Available(s) })
+}
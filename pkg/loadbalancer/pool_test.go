@@ -0,0 +1,73 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+)
+
+// TestPoolConcurrentChanges checks that servers are picked safely while
+// others are added and removed. Run with -race.
+func TestPoolConcurrentChanges(t *testing.T) {
+	p := NewPool("pool", lbtest.Servers("a", "b"), nil, health.Check{})
+	defer p.Close()
+	p.logger = slog.New(slog.DiscardHandler)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				p.AddServer(lbtest.NewServer("c", 1))
+			} else {
+				p.RemoveServer("c")
+			}
+		}
+	})
+	var pickers sync.WaitGroup
+	for range 8 {
+		pickers.Go(func() {
+			for range 1000 {
+				s := p.GetNextAvailableServer()
+				if s == nil {
+					t.Error("no server picked")
+					return
+				}
+				if addr := s.Address(); addr != "a" && addr != "b" && addr != "c" {
+					t.Errorf("picked %q", addr)
+					return
+				}
+			}
+		})
+	}
+	pickers.Wait()
+	close(stop)
+	wg.Wait()
+	if n := len(p.Servers()); n < 2 || n > 3 {
+		t.Errorf("%d servers, want 2 or 3", n)
+	}
+}
+
+func TestPoolPickAllocs(t *testing.T) {
+	p := NewPool("pool", lbtest.Servers("a", "b", "c"), nil, health.Check{})
+	defer p.Close()
+	if n := testing.AllocsPerRun(100, func() { p.GetNextAvailableServer() }); n != 0 {
+		t.Errorf("GetNextAvailableServer: %v allocations, want 0", n)
+	}
+}
+
+func BenchmarkPoolPick(b *testing.B) {
+	p := NewPool("pool", lbtest.Servers("a", "b", "c"), nil, health.Check{})
+	defer p.Close()
+	b.ReportAllocs()
+	for b.Loop() {
+		p.GetNextAvailableServer()
+	}
+}
@@ -0,0 +1,259 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	probeRequests = metrics.NewCounterVec("lb_probe_requests_total",
+		"Synthetic requests sent by probes, by probe and result: success or failure.", "probe", "result")
+	probeUp = metrics.NewGaugeVec("lb_probe_up",
+		"Whether the last synthetic request of a probe succeeded.", "probe")
+	probeLatency = metrics.NewGaugeVec("lb_probe_latency_milliseconds",
+		"Time the last synthetic request of a probe took to be answered.", "probe")
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	// maxProbeBody bounds the part of a response matched against
+	// ExpectBody.
+	maxProbeBody = 1 << 20
+)
+
+// Probe is a synthetic request sent through the load balancer as clients
+// send theirs, to URL, the listener and the URI of the request, so that it
+// takes the whole path to a backend: listener, middleware, routing and
+// proxying. Unlike health checks, which probe servers one by one, it fails
+// on a route, rewrite or middleware sending requests to the wrong place, or
+// nowhere. The request is sent with the Host, Header and Body of the probe,
+// from a new connection, and the certificate of the listener is not
+// verified. It fails if it takes longer than Timeout, if the status of the
+// response is not one of ExpectStatus, or below 400 if empty, or if
+// ExpectBody matches nothing in the first MiB of its body.
+type Probe struct {
+	Name         string
+	Method       string
+	URL          string
+	Host         string
+	Header       http.Header
+	Body         []byte
+	Interval     time.Duration
+	Timeout      time.Duration
+	ExpectStatus []int
+	ExpectBody   *regexp.Regexp
+}
+
+// NewProbe creates a probe named name sending a GET to url every 30s,
+// with a timeout of 5s.
+func NewProbe(name, url string) *Probe {
+	return &Probe{
+		Name:     name,
+		Method:   http.MethodGet,
+		URL:      url,
+		Header:   http.Header{},
+		Interval: defaultProbeInterval,
+		Timeout:  defaultProbeTimeout,
+	}
+}
+
+// ProbeResult is what a probe found so far: whether its last request
+// succeeded, with the status and latency of its response or why it failed,
+// and how many succeeded and failed.
+type ProbeResult struct {
+	Name        string    `json:"name"`
+	Up          bool      `json:"up"`
+	Time        time.Time `json:"time,omitzero"`
+	Status      int       `json:"status,omitempty"`
+	Latency     float64   `json:"latency_ms"`
+	Error       string    `json:"error,omitempty"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+}
+
+// probeTransport sends the requests of probes, each from a new connection
+// so that probes go through the listener every time.
+var probeTransport = &http.Transport{
+	DisableKeepAlives: true,
+	TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+}
+
+// run sends the request of p once and checks its response.
+func (p *Probe) run(ctx context.Context) (status int, latency time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, bytes.NewReader(p.Body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header = p.Header.Clone()
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "lb-probe/"+p.Name)
+	}
+	if p.Host != "" {
+		req.Host = p.Host
+	}
+	start := time.Now()
+	resp, err := probeTransport.RoundTrip(req)
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if p.ExpectBody != nil {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	latency = time.Since(start)
+	switch {
+	case err != nil:
+		return resp.StatusCode, latency, fmt.Errorf("reading body: %w", err)
+	case len(p.ExpectStatus) == 0 && resp.StatusCode >= 400,
+		len(p.ExpectStatus) > 0 && !slices.Contains(p.ExpectStatus, resp.StatusCode):
+		return resp.StatusCode, latency, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	case p.ExpectBody != nil && !p.ExpectBody.Match(body):
+		return resp.StatusCode, latency, fmt.Errorf("body does not match %q", p.ExpectBody)
+	}
+	return resp.StatusCode, latency, nil
+}
+
+// Prober runs probes in the background, each every Interval, and keeps
+// what they found, emitting ProbeUp and ProbeDown when they start
+// succeeding or failing.
+type Prober struct {
+	probes []*Probe
+
+	mu      sync.Mutex
+	results map[string]*ProbeResult
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewProber creates a prober running probes, whose names are unique.
+func NewProber(probes []*Probe) *Prober {
+	pr := &Prober{probes: probes, results: map[string]*ProbeResult{}}
+	for _, p := range probes {
+		pr.results[p.Name] = &ProbeResult{Name: p.Name}
+	}
+	return pr
+}
+
+// Carry takes over the results of the probes of old with the same names,
+// so that they survive a reload.
+func (pr *Prober) Carry(old *Prober) {
+	if pr == nil || old == nil {
+		return
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for name, res := range pr.results {
+		if prev, ok := old.results[name]; ok {
+			*res = *prev
+		}
+	}
+}
+
+// Start runs the probes in the background until Stop, the first at once.
+func (pr *Prober) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr.cancel = cancel
+	for _, p := range pr.probes {
+		pr.wg.Add(1)
+		go func() {
+			defer pr.wg.Done()
+			ticker := time.NewTicker(p.Interval)
+			defer ticker.Stop()
+			for {
+				pr.probe(ctx, p)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the probes, abandoning the requests under way, and waits for
+// them to return. It does nothing on a nil or stopped prober.
+func (pr *Prober) Stop() {
+	if pr == nil || pr.cancel == nil {
+		return
+	}
+	pr.cancel()
+	pr.wg.Wait()
+}
+
+// probe runs p once and records what it found.
+func (pr *Prober) probe(ctx context.Context, p *Probe) {
+	status, latency, err := p.run(ctx)
+	if ctx.Err() != nil {
+		// Stopped, not failed.
+		return
+	}
+	now := time.Now()
+	probeLatency.Set(latency.Milliseconds(), p.Name)
+	pr.mu.Lock()
+	res := pr.results[p.Name]
+	wasUp, first := res.Up, res.Time.IsZero()
+	res.Time, res.Status, res.Latency = now, status, float64(latency.Microseconds())/1000
+	if err != nil {
+		res.Up, res.Error = false, err.Error()
+		res.Failures++
+		res.LastFailure = now
+	} else {
+		res.Up, res.Error = true, ""
+		res.Successes++
+		res.LastSuccess = now
+	}
+	pr.mu.Unlock()
+	if err != nil {
+		probeRequests.Inc(p.Name, "failure")
+		probeUp.Set(0, p.Name)
+		if wasUp || first {
+			logf("Probe %q failing: %v", p.Name, err)
+			emit(ProbeDown{Time: now, Probe: p.Name, Err: err})
+		}
+		return
+	}
+	probeRequests.Inc(p.Name, "success")
+	probeUp.Set(1, p.Name)
+	if !wasUp && !first {
+		logf("Probe %q succeeding again", p.Name)
+		emit(ProbeUp{Time: now, Probe: p.Name})
+	}
+}
+
+// Results returns what the probes found so far, in the order of the
+// configuration.
+func (pr *Prober) Results() []ProbeResult {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	results := make([]ProbeResult, 0, len(pr.probes))
+	for _, p := range pr.probes {
+		results = append(results, *pr.results[p.Name])
+	}
+	return results
+}
+
+// Prober returns the prober sending the probes of the configuration the
+// load balancer runs, or nil.
+func (lb *LoadBalancer) Prober() *Prober { return lb.prober }
@@ -0,0 +1,338 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("proxy protocol: missing header")
+
+// ProxyProtocol accepts connections preceded by a PROXY protocol header
+// (version 1 or 2), as sent by an upstream layer-4 balancer such as HAProxy
+// or an AWS NLB. The header is parsed before the first read and the
+// connection's RemoteAddr becomes the original client's address, so logging,
+// affinity and X-Forwarded-For see the real client.
+//
+// Only peers in Trusted may send a header, and they must; connections from
+// other peers are passed through unchanged, so that clients cannot claim
+// any address they like. An empty Trusted list trusts no peer.
+type ProxyProtocol struct {
+	Trusted []netip.Prefix
+	// Timeout bounds how long reading the header may take.
+	Timeout time.Duration
+}
+
+// NewProxyProtocol creates a ProxyProtocol. A zero timeout means 5 seconds.
+func NewProxyProtocol(trusted []netip.Prefix, timeout time.Duration) *ProxyProtocol {
+	if timeout <= 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	return &ProxyProtocol{Trusted: trusted, Timeout: timeout}
+}
+
+// Listen wraps ln so that its connections are read with a PROXY header.
+func (pp *ProxyProtocol) Listen(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln, pp: pp}
+}
+
+func (pp *ProxyProtocol) trusts(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range pp.Trusted {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyListener struct {
+	net.Listener
+	pp *ProxyProtocol
+}
+
+// Accept waits for the next connection. The PROXY header is read lazily so
+// that a slow peer doesn't hold up the accept loop.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.pp.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.pp.Timeout}, nil
+}
+
+// proxyConn is a connection from a trusted peer that starts with a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.local, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			logf("Connection from %q: %v", logAddr(c.Conn.RemoteAddr()), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer's
+// address if the header doesn't carry one.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the PROXY header, or the
+// connection's local address if the header doesn't carry one.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection where supported.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY header and returns the source
+// and destination addresses it carries. Both are nil for LOCAL (v2) and
+// UNKNOWN (v1) connections, such as the upstream balancer's health checks.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+		return nil, nil, errNoProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// The longest v1 header is 107 bytes including CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("proxy protocol: malformed v1 header")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("proxy protocol: malformed v1 header %q", s)
+	}
+	srcIP, err1 := netip.ParseAddr(fields[2])
+	dstIP, err2 := netip.ParseAddr(fields[3])
+	srcPort, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: malformed v1 header %q", s)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, uint16(srcPort))),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, uint16(dstPort))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxy protocol: unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("proxy protocol: unknown command %d", verCmd&0xf)
+	}
+	var n int
+	switch family >> 4 {
+	case 1: // AF_INET
+		n = 4
+	case 2: // AF_INET6
+		n = 16
+	default:
+		// AF_UNSPEC and AF_UNIX carry no IP address.
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, fmt.Errorf("proxy protocol: short v2 address block")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:n])
+	dstIP, _ := netip.AddrFromSlice(body[n : 2*n])
+	srcPort := binary.BigEndian.Uint16(body[2*n:])
+	dstPort := binary.BigEndian.Uint16(body[2*n+2:])
+	if family&0xf == 2 { // DGRAM
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+			net.UDPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+// PROXY protocol versions sent to backends.
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// writeProxyHeader writes a PROXY protocol header announcing a connection
+// from src to dst. Nil or non-IP addresses produce an UNKNOWN (v1) or LOCAL
+// (v2) header, which backends accept without overriding the peer address.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAP, srcOK := ipAddrPort(src)
+	dstAP, dstOK := ipAddrPort(dst)
+	ok := srcOK && dstOK && srcAP.Addr().Is4() == dstAP.Addr().Is4()
+	if version == ProxyProtocolV1 {
+		line := "PROXY UNKNOWN\r\n"
+		if ok {
+			proto := "TCP6"
+			if srcAP.Addr().Is4() {
+				proto = "TCP4"
+			}
+			line = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcAP.Addr(), dstAP.Addr(), srcAP.Port(), dstAP.Port())
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+	b := append([]byte(nil), proxyV2Signature...)
+	if !ok {
+		b = append(b, 0x20, 0x00, 0, 0)
+		_, err := w.Write(b)
+		return err
+	}
+	family, n := byte(0x11), 12
+	if !srcAP.Addr().Is4() {
+		family, n = 0x21, 36
+	}
+	b = append(b, 0x21, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(n))
+	b = append(b, srcAP.Addr().AsSlice()...)
+	b = append(b, dstAP.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, srcAP.Port())
+	b = binary.BigEndian.AppendUint16(b, dstAP.Port())
+	_, err := w.Write(b)
+	return err
+}
+
+func ipAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+type proxiedClientKey struct{}
+
+// proxiedClient is the connection a request to a PROXY protocol backend
+// arrived on.
+type proxiedClient struct {
+	src, dst net.Addr
+}
+
+// withProxiedClient records the client connection of r in its context, for
+// the dialer of a PROXY protocol backend.
+func withProxiedClient(r *http.Request) *http.Request {
+	var pc proxiedClient
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		pc.src = net.TCPAddrFromAddrPort(ap)
+	}
+	pc.dst, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return r.WithContext(context.WithValue(r.Context(), proxiedClientKey{}, pc))
+}
+
+// proxyProtocolTransport returns a copy of base that sends a PROXY header on
+// every connection it dials. Since the header identifies a single client,
+// connections are never reused across requests.
+func proxyProtocolTransport(base *http.Transport, version int) *http.Transport {
+	t := base.Clone()
+	t.DisableKeepAlives = true
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		pc, _ := ctx.Value(proxiedClientKey{}).(proxiedClient)
+		if err := writeProxyHeader(conn, version, pc.src, pc.dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return t
+}
@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// acceptProxied accepts a connection through pp on which a client wrote
+// header, and returns it.
+func acceptProxied(t *testing.T, pp *ProxyProtocol, header string) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	io.WriteString(client, header)
+	conn, err := pp.Listen(ln).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	pp := NewProxyProtocol([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, 0)
+	conn := acceptProxied(t, pp, "PROXY TCP4 203.0.113.7 192.0.2.1 4000 80\r\n")
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:4000" {
+		t.Errorf("RemoteAddr %s, want 203.0.113.7:4000", got)
+	}
+}
+
+// TestProxyProtocolUntrusted checks that peers cannot claim addresses
+// unless trusted, as none are by default.
+func TestProxyProtocolUntrusted(t *testing.T) {
+	for name, trusted := range map[string][]netip.Prefix{
+		"none":  nil,
+		"other": {netip.MustParsePrefix("10.0.0.0/8")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := acceptProxied(t, NewProxyProtocol(trusted, 0), "PROXY TCP4 203.0.113.7 192.0.2.1 4000 80\r\n")
+			if ip := addrIP(conn.RemoteAddr()); ip != netip.MustParseAddr("127.0.0.1") {
+				t.Errorf("RemoteAddr %s, want the peer's", conn.RemoteAddr())
+			}
+		})
+	}
+}
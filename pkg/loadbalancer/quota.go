@@ -0,0 +1,192 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Quota calendars of API keys.
+const (
+	QuotaDaily   = "day"
+	QuotaMonthly = "month"
+)
+
+// sharedQuotaPrefix prefixes the keys of the counters of a
+// SharedQuotaStore.
+const sharedQuotaPrefix = "quota:"
+
+// QuotaUsage is what a tenant used of its quotas in a quota period.
+type QuotaUsage struct {
+	Requests int64
+	Bytes    int64
+}
+
+// QuotaStore keeps the quota counters of tenants, so that they may be
+// shared by load balancers and outlive them.
+type QuotaStore interface {
+	// Add adds requests and bytes to the usage of tenant in the quota
+	// period starting at start and ending at end, and returns the usage
+	// that results.
+	Add(ctx context.Context, tenant string, start, end time.Time, requests, bytes int64) (QuotaUsage, error)
+}
+
+// MemoryQuotaStore is a QuotaStore keeping the counters of the current
+// periods in memory, for a single load balancer; they are lost when it
+// stops.
+type MemoryQuotaStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryQuota
+}
+
+type memoryQuota struct {
+	start, end time.Time
+	usage      QuotaUsage
+}
+
+// NewMemoryQuotaStore creates an empty MemoryQuotaStore.
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{counters: map[string]*memoryQuota{}}
+}
+
+// Add implements QuotaStore.
+func (s *MemoryQuotaStore) Add(_ context.Context, tenant string, start, end time.Time, requests, bytes int64) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.counters[tenant]
+	if q == nil {
+		q = &memoryQuota{}
+		s.counters[tenant] = q
+		tableEntries.Inc("quota_counters")
+	}
+	if !q.start.Equal(start) {
+		q.start, q.end, q.usage = start, end, QuotaUsage{}
+	}
+	q.usage.Requests += requests
+	q.usage.Bytes += bytes
+	return q.usage, nil
+}
+
+// SharedQuotaStore is a QuotaStore keeping the counters in a SharedStore,
+// shared by the load balancers using it, under
+// "quota:<tenant>:<period start>:requests" and ":bytes", which expire with
+// their period.
+type SharedQuotaStore struct {
+	store SharedStore
+}
+
+// NewSharedQuotaStore creates a store keeping the counters in store.
+func NewSharedQuotaStore(store SharedStore) *SharedQuotaStore {
+	return &SharedQuotaStore{store: store}
+}
+
+// RedisQuotaStore is a SharedQuotaStore backed by Redis.
+//
+// Deprecated: use NewSharedQuotaStore with a RedisSharedStore.
+type RedisQuotaStore = SharedQuotaStore
+
+// NewRedisQuotaStore creates a store backed by client, keeping the counters
+// under "lb:quota:".
+func NewRedisQuotaStore(client *RedisClient) *RedisQuotaStore {
+	return NewSharedQuotaStore(NewRedisSharedStore(client))
+}
+
+// Add implements QuotaStore.
+func (s *SharedQuotaStore) Add(ctx context.Context, tenant string, start, end time.Time, requests, bytes int64) (QuotaUsage, error) {
+	prefix := sharedQuotaPrefix + tenant + ":" + strconv.FormatInt(start.Unix(), 10) + ":"
+	// Counters outlive their period by a minute, for the clocks of load
+	// balancers sharing them to disagree a little.
+	ttl := time.Until(end).Truncate(time.Second) + time.Minute
+	var usage QuotaUsage
+	for _, c := range []struct {
+		name  string
+		delta int64
+		total *int64
+	}{{"requests", requests, &usage.Requests}, {"bytes", bytes, &usage.Bytes}} {
+		n, err := s.store.Incr(ctx, prefix+c.name, c.delta, ttl)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+		*c.total = n
+	}
+	return usage, nil
+}
+
+// quotaPeriod returns the start and end of the quota period of k containing
+// now. Calendar periods are those of UTC.
+func (k *APIKey) quotaPeriod(now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	switch k.QuotaCalendar {
+	case QuotaMonthly:
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	case QuotaDaily:
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+	period := k.QuotaPeriod
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	start = now.Truncate(period)
+	return start, start.Add(period)
+}
+
+// tenant returns the name the quotas of k are counted under.
+func (k *APIKey) tenant() string {
+	switch {
+	case k.Tenant != "":
+		return k.Tenant
+	case k.Name != "":
+		return k.Name
+	}
+	return k.Key
+}
+
+// setQuotaHeaders sets the quota headers of a response to a request of k
+// given its usage, and returns the seconds until the period ends.
+func (k *APIKey) setQuotaHeaders(h http.Header, usage QuotaUsage, end, now time.Time) int {
+	reset := max(int(end.Sub(now).Seconds()+0.999), 0)
+	if k.Quota > 0 {
+		h.Set("X-Quota-Limit", strconv.FormatInt(k.Quota, 10))
+		h.Set("X-Quota-Remaining", strconv.FormatInt(max(k.Quota-usage.Requests, 0), 10))
+	}
+	if k.ByteQuota > 0 {
+		h.Set("X-Quota-Bytes-Limit", strconv.FormatInt(k.ByteQuota, 10))
+		h.Set("X-Quota-Bytes-Remaining", strconv.FormatInt(max(k.ByteQuota-usage.Bytes, 0), 10))
+	}
+	h.Set("X-Quota-Reset", strconv.Itoa(reset))
+	return reset
+}
+
+// quotaBody counts the bytes read of a request body.
+type quotaBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// quotaWriter counts the bytes written of a response body.
+type quotaWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *quotaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriod(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, tc := range []struct {
+		key        APIKey
+		now        string
+		start, end string
+	}{
+		{APIKey{QuotaCalendar: QuotaMonthly}, "2026-01-31T23:59:59Z", "2026-01-01T00:00:00Z", "2026-02-01T00:00:00Z"},
+		{APIKey{QuotaCalendar: QuotaMonthly}, "2026-02-01T00:00:00Z", "2026-02-01T00:00:00Z", "2026-03-01T00:00:00Z"},
+		{APIKey{QuotaCalendar: QuotaMonthly}, "2026-12-15T10:00:00Z", "2026-12-01T00:00:00Z", "2027-01-01T00:00:00Z"},
+		// Calendar periods are those of UTC.
+		{APIKey{QuotaCalendar: QuotaDaily}, "2026-03-10T23:30:00-02:00", "2026-03-11T00:00:00Z", "2026-03-12T00:00:00Z"},
+		{APIKey{QuotaPeriod: time.Hour}, "2026-03-10T10:59:59Z", "2026-03-10T10:00:00Z", "2026-03-10T11:00:00Z"},
+		{APIKey{}, "2026-03-10T10:00:00Z", "2026-03-10T00:00:00Z", "2026-03-11T00:00:00Z"},
+	} {
+		start, end := tc.key.quotaPeriod(at(tc.now))
+		if !start.Equal(at(tc.start)) || !end.Equal(at(tc.end)) {
+			t.Errorf("%+v at %s: period %v-%v, want %s-%s", tc.key, tc.now, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+// TestQuotaStoresRollOver checks that the usage counted in a period is not
+// counted in the next.
+func TestQuotaStoresRollOver(t *testing.T) {
+	k := &APIKey{QuotaCalendar: QuotaDaily}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for name, store := range map[string]QuotaStore{
+		"memory": NewMemoryQuotaStore(),
+		"shared": NewSharedQuotaStore(NewMemorySharedStore()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			start, end := k.quotaPeriod(day.Add(time.Hour))
+			store.Add(ctx, "acme", start, end, 1, 100)
+			usage, err := store.Add(ctx, "acme", start, end, 1, 50)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage != (QuotaUsage{Requests: 2, Bytes: 150}) {
+				t.Errorf("usage %+v, want 2 requests and 150 bytes", usage)
+			}
+			start, end = k.quotaPeriod(day.Add(25 * time.Hour))
+			if usage, _ = store.Add(ctx, "acme", start, end, 1, 10); usage != (QuotaUsage{Requests: 1, Bytes: 10}) {
+				t.Errorf("usage in the next period %+v, want 1 request and 10 bytes", usage)
+			}
+			if usage, _ = store.Add(ctx, "other", start, end, 1, 0); usage.Requests != 1 {
+				t.Errorf("usage of another tenant %+v", usage)
+			}
+		})
+	}
+}
+
+// TestAPIKeyQuotaRollsOver checks that a key over its quota is allowed again
+// once the period ends.
+func TestAPIKeyQuotaRollsOver(t *testing.T) {
+	const period = 200 * time.Millisecond
+	a := newTestAPIKeyAuth(t, &APIKey{Key: "secret", Name: "acme", Quota: 1, QuotaPeriod: period})
+	h := a.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-API-Key", "secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	// Start early in a period, for the first two requests to share it.
+	nextPeriod := func() {
+		now := time.Now()
+		time.Sleep(now.Truncate(period).Add(period + 10*time.Millisecond).Sub(now))
+	}
+	nextPeriod()
+	if rec := send(); rec.Code != http.StatusOK || rec.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("first request: %d, X-Quota-Remaining %q", rec.Code, rec.Header().Get("X-Quota-Remaining"))
+	}
+	if rec := send(); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the quota: %d", rec.Code)
+	}
+	nextPeriod()
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Errorf("request in the next period: %d", rec.Code)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package loadbalancer
+
+// raceEnabled reports whether the tests run under the race detector, which
+// allocates on its own.
+const raceEnabled = true
@@ -0,0 +1,138 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var rateLimitRequests = metrics.NewCounterVec("lb_rate_limit_requests_total",
+	"Requests counted by the rate limits of routes, by route and result: allowed or limited, prefixed by overflow_ for the clients past max_clients sharing a rate.", "route", "result")
+
+// rateLimitSweepInterval is how often the rates of clients gone quiet are
+// forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// defaultRateLimitMaxClients bounds the clients whose rate a limit tracks
+// by default.
+const defaultRateLimitMaxClients = 100000
+
+// RateLimit limits the rate of the requests of each client of a route to
+// Rate a second, with bursts of Burst, answering 429 with Retry-After past
+// it. Clients are told apart by address, as clientIP reports it, IPv6 ones
+// by their /64 as a host usually has all of it. It tracks the rates of up
+// to MaxClients clients, forgetting them once idle long enough to have
+// refilled their burst; while it tracks that many, the clients past them
+// share a single rate, so that they can neither reset the rates of others
+// nor go unlimited.
+type RateLimit struct {
+	Rate       float64
+	Burst      int
+	MaxClients int
+
+	route     string
+	limit     *APIKey
+	mu        sync.Mutex
+	clients   map[netip.Addr]*apiKeyLimits
+	overflow  apiKeyLimits
+	lastSweep time.Time
+}
+
+// NewRateLimit creates a rate limit of Rate requests a second per client
+// of the route named route, with bursts of burst, tracking up to 100000
+// clients.
+func NewRateLimit(route string, rate float64, burst int) (*RateLimit, error) {
+	if rate <= 0 || burst < 0 {
+		return nil, fmt.Errorf("rate must be positive and burst not negative")
+	}
+	return &RateLimit{
+		Rate:       rate,
+		Burst:      max(burst, 1),
+		MaxClients: defaultRateLimitMaxClients,
+		route:      route,
+		limit:      &APIKey{Rate: rate, Burst: max(burst, 1)},
+		clients:    map[netip.Addr]*apiKeyLimits{},
+	}, nil
+}
+
+// client returns the key the rate of the client sending r is tracked by.
+func (l *RateLimit) client(r *http.Request) netip.Addr {
+	ip := clientIP(r)
+	if ip.Is6() {
+		p, _ := ip.Prefix(64)
+		return p.Addr()
+	}
+	return ip
+}
+
+// sweep forgets the clients idle long enough to have refilled their burst,
+// which are as good as new.
+func (l *RateLimit) sweep(now time.Time) {
+	idle := time.Duration(float64(l.limit.Burst) / l.Rate * float64(time.Second))
+	for k, cl := range l.clients {
+		cl.mu.Lock()
+		if now.Sub(cl.last) > idle {
+			delete(l.clients, k)
+			tableEntries.Dec("rate_limit_clients")
+			tableEvictions.Inc("rate_limit_clients", "expired")
+		}
+		cl.mu.Unlock()
+	}
+	l.lastSweep = now
+}
+
+// allow reports whether the client tracked by key may send a request now,
+// and if it may not, when to retry, and whether it was counted by the
+// shared rate of the clients past MaxClients.
+func (l *RateLimit) allow(key netip.Addr, now time.Time) (ok bool, retry time.Duration, overflow bool) {
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	cl := l.clients[key]
+	if cl == nil && len(l.clients) >= l.MaxClients && now.Sub(l.lastSweep) >= time.Second {
+		// Sweeping at most every second bounds the work clients past
+		// the bound make.
+		l.sweep(now)
+	}
+	if cl == nil {
+		if len(l.clients) >= l.MaxClients {
+			l.mu.Unlock()
+			ok, retry = l.overflow.allow(l.limit, now)
+			return ok, retry, true
+		}
+		cl = &apiKeyLimits{}
+		l.clients[key] = cl
+		tableEntries.Inc("rate_limit_clients")
+	}
+	l.mu.Unlock()
+	ok, retry = cl.allow(l.limit, now)
+	return ok, retry, false
+}
+
+// Middleware returns the middleware limiting the rate of clients.
+func (l *RateLimit) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ok, retry, overflow := l.allow(l.client(r), time.Now())
+			prefix := ""
+			if overflow {
+				prefix = "overflow_"
+			}
+			if !ok {
+				rateLimitRequests.Inc(l.route, prefix+"limited")
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				httpError(rw, r, "429 too many requests", http.StatusTooManyRequests)
+				return
+			}
+			rateLimitRequests.Inc(l.route, prefix+"allowed")
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
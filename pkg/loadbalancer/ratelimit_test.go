@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPerClient(t *testing.T) {
+	l, err := NewRateLimit("api", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	serve := func(addr string, header string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		// Headers do not tell clients apart.
+		r.Header.Set("X-Client", header)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	for i, want := range []int{200, 200, 429} {
+		if got := serve("192.0.2.1:1000", string(rune('a'+i))); got != want {
+			t.Errorf("request %d: got %d, want %d", i+1, got, want)
+		}
+	}
+	if got := serve("192.0.2.2:1000", ""); got != http.StatusOK {
+		t.Errorf("other client: got %d, want 200", got)
+	}
+	// The addresses of an IPv6 /64 are one client.
+	serve("[2001:db8::1]:1000", "")
+	serve("[2001:db8::2]:1000", "")
+	if got := serve("[2001:db8::3]:1000", ""); got != http.StatusTooManyRequests {
+		t.Errorf("same /64: got %d, want 429", got)
+	}
+}
+
+// TestRateLimitMaxClients checks that clients past MaxClients neither
+// reset the rates of those tracked nor escape limits.
+func TestRateLimitMaxClients(t *testing.T) {
+	l, err := NewRateLimit("api", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.MaxClients = 2
+	now := time.Now()
+	tracked := netip.MustParseAddr("192.0.2.1")
+	if ok, _, _ := l.allow(tracked, now); !ok {
+		t.Fatal("first request limited")
+	}
+	l.allow(netip.MustParseAddr("192.0.2.2"), now)
+	for i := range 10 {
+		ok, _, overflow := l.allow(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}), now)
+		if !overflow || ok != (i == 0) {
+			t.Errorf("new client %d: allowed %v, overflow %v", i, ok, overflow)
+		}
+	}
+	if ok, _, _ := l.allow(tracked, now); ok {
+		t.Error("tracked client's rate was reset")
+	}
+	// Once idle, tracked clients are forgotten for new ones.
+	later := now.Add(rateLimitSweepInterval)
+	if ok, _, overflow := l.allow(netip.MustParseAddr("198.51.100.200"), later); !ok || overflow {
+		t.Errorf("after sweeping: allowed %v, overflow %v", ok, overflow)
+	}
+}
@@ -0,0 +1,220 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var recordingDropped = metrics.NewCounterVec("lb_recording_dropped_total",
+	"Recorded requests dropped because writing them fell behind.")
+
+const (
+	// defaultRecordBuffer is how many recorded requests may wait to be
+	// written.
+	defaultRecordBuffer = 1024
+	// defaultRecordMaxBody is how much of their bodies requests are
+	// recorded with by default.
+	defaultRecordMaxBody = 64 << 10
+	// Redacted replaces what a Recorder redacts.
+	Redacted = "[REDACTED]"
+)
+
+// defaultRedactedHeaders are the headers a Recorder redacts by default.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// RecordedRequest is a request a Recorder recorded, written as a line of
+// JSON. Body holds up to the recorder's MaxBody bytes of the body;
+// Truncated tells there was more.
+type RecordedRequest struct {
+	Time      time.Time   `json:"time"`
+	Route     string      `json:"route,omitempty"`
+	Pool      string      `json:"pool"`
+	Method    string      `json:"method"`
+	Host      string      `json:"host"`
+	URI       string      `json:"uri"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Status    int         `json:"status"`
+	Duration  float64     `json:"duration_ms"`
+}
+
+// Recorder records a sample of the requests forwarded to backends, as they
+// are forwarded, with up to MaxBody bytes of their bodies, 64 KiB by
+// default, for "lb replay" to send them again. The values of the headers
+// named in RedactHeaders, a name ending in "*" naming every header with
+// that prefix, Authorization, Proxy-Authorization and Cookie by default, and
+// of the query parameters named in RedactQuery are replaced with
+// "[REDACTED]", and so are the matches of RedactBody in bodies. Requests
+// are written in the background; Close writes those still queued.
+type Recorder struct {
+	MaxBody       int64
+	RedactHeaders []string
+	RedactQuery   []string
+	RedactBody    []*regexp.Regexp
+
+	out  *asyncWriter
+	file *LogFile
+	// sample holds the bits of the sampled fraction of requests.
+	sample atomic.Uint64
+}
+
+// NewRecorder creates a Recorder writing to w and recording the fraction
+// sample, from 0 to 1, of the requests.
+func NewRecorder(w io.Writer, sample float64) *Recorder {
+	rec := &Recorder{
+		MaxBody:       defaultRecordMaxBody,
+		RedactHeaders: defaultRedactedHeaders,
+		out:           newAsyncWriter(w, defaultRecordBuffer, recordingDropped),
+	}
+	rec.SetSample(sample)
+	return rec
+}
+
+// NewRecorderFile creates a Recorder appending to the file at path, which
+// Reopen reopens after it was rotated.
+func NewRecorderFile(path string, sample float64) (*Recorder, error) {
+	f, err := OpenLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := NewRecorder(f, sample)
+	rec.file = f
+	return rec, nil
+}
+
+// Close writes the requests still queued. Requests recorded afterwards are
+// dropped.
+func (rec *Recorder) Close() {
+	if rec != nil {
+		rec.out.Close()
+	}
+}
+
+// Reopen reopens the file of a recorder created by NewRecorderFile.
+func (rec *Recorder) Reopen() error {
+	if rec == nil || rec.file == nil {
+		return nil
+	}
+	return rec.file.Reopen()
+}
+
+// Sample returns the fraction of the requests recorded.
+func (rec *Recorder) Sample() float64 {
+	return math.Float64frombits(rec.sample.Load())
+}
+
+// SetSample changes the fraction of the requests recorded, clamped to 0-1.
+func (rec *Recorder) SetSample(sample float64) {
+	rec.sample.Store(math.Float64bits(min(max(sample, 0), 1)))
+}
+
+// recordedBody keeps the start of a request body as it is read.
+type recordedBody struct {
+	io.ReadCloser
+	max       int64
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	keep := min(int64(n), b.max-int64(b.buf.Len()))
+	b.buf.Write(p[:keep])
+	b.truncated = b.truncated || keep < int64(n)
+	return n, err
+}
+
+// wrap returns the ResponseWriter and request to forward r with and a
+// function recording r once it was served, or rw, r and nil if r is not
+// sampled.
+func (rec *Recorder) wrap(rw http.ResponseWriter, r *http.Request, route, pool string) (http.ResponseWriter, *http.Request, func()) {
+	if rec == nil {
+		return rw, r, nil
+	}
+	if s := rec.Sample(); s <= 0 || s < 1 && rand.Float64() >= s {
+		return rw, r, nil
+	}
+	status := &accessRecorder{ResponseWriter: rw}
+	var body *recordedBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &recordedBody{ReadCloser: r.Body, max: rec.MaxBody}
+		r = r.WithContext(r.Context())
+		r.Body = body
+	}
+	start := time.Now()
+	rr := RecordedRequest{
+		Time:   start,
+		Route:  route,
+		Pool:   pool,
+		Method: r.Method,
+		Host:   r.Host,
+		URI:    rec.redactURI(r.URL),
+		Header: rec.redactHeader(r.Header),
+	}
+	return status, r, func() {
+		if body != nil {
+			rr.Body, rr.Truncated = rec.redactBody(body.buf.Bytes()), body.truncated
+		}
+		rr.Status = status.status
+		rr.Duration = float64(time.Since(start).Microseconds()) / 1000
+		line, err := json.Marshal(rr)
+		if err != nil {
+			return
+		}
+		rec.out.Write(append(line, '\n'))
+	}
+}
+
+// redactHeader returns a copy of h with the values of RedactHeaders
+// redacted.
+func (rec *Recorder) redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for name, values := range h {
+		if slices.ContainsFunc(rec.RedactHeaders, func(pattern string) bool { return matchHeader(pattern, name) }) {
+			for i := range values {
+				values[i] = Redacted
+			}
+		}
+	}
+	return h
+}
+
+// redactURI returns the request URI of u with the values of RedactQuery
+// redacted.
+func (rec *Recorder) redactURI(u *url.URL) string {
+	if len(rec.RedactQuery) == 0 || u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		name, _, _ := strings.Cut(p, "=")
+		if n, err := url.QueryUnescape(name); err == nil && slices.Contains(rec.RedactQuery, n) {
+			params[i] = name + "=" + url.QueryEscape(Redacted)
+		}
+	}
+	v := *u
+	v.RawQuery = strings.Join(params, "&")
+	return v.RequestURI()
+}
+
+// redactBody returns body with the matches of RedactBody redacted.
+func (rec *Recorder) redactBody(body []byte) []byte {
+	body = bytes.Clone(body)
+	for _, re := range rec.RedactBody {
+		body = re.ReplaceAll(body, []byte(Redacted))
+	}
+	return body
+}
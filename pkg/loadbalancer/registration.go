@@ -0,0 +1,160 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultRegistrationTTL = 30 * time.Second
+
+// Registrar is a Discoverer of servers that register themselves through the
+// admin API and keep their registration alive with heartbeats. A
+// registration lapses TTL after the last heartbeat unless the server asks
+// for a shorter TTL; registrations can also be removed explicitly.
+//
+// Registrar is a Watcher: registrations and lapses update the pool at once.
+type Registrar struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*registration
+	changed chan struct{}
+}
+
+type registration struct {
+	target  Target
+	expires time.Time
+}
+
+// NewRegistrar creates a Registrar. A zero ttl means 30 seconds.
+func NewRegistrar(ttl time.Duration) *Registrar {
+	if ttl <= 0 {
+		ttl = defaultRegistrationTTL
+	}
+	return &Registrar{TTL: ttl, entries: map[string]*registration{}, changed: make(chan struct{}, 1)}
+}
+
+// Register registers t or renews its registration for ttl, at most TTL; a
+// zero ttl means TTL. It returns the TTL granted.
+func (reg *Registrar) Register(t Target, ttl time.Duration) (time.Duration, error) {
+	if t.Addr == "" {
+		return 0, fmt.Errorf("addr must not be empty")
+	}
+	if t.Weight < 0 {
+		return 0, fmt.Errorf("weight must not be negative")
+	}
+	if ttl <= 0 || ttl > reg.TTL {
+		ttl = reg.TTL
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	e, ok := reg.entries[t.Addr]
+	if !ok || e.target != t {
+		reg.notify()
+	}
+	reg.entries[t.Addr] = &registration{target: t, expires: time.Now().Add(ttl)}
+	return ttl, nil
+}
+
+// Deregister removes the registration of addr and reports whether there
+// was one.
+func (reg *Registrar) Deregister(addr string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.entries[addr]; !ok {
+		return false
+	}
+	delete(reg.entries, addr)
+	reg.notify()
+	return true
+}
+
+// notify signals a change to Watch. reg.mu must be held.
+func (reg *Registrar) notify() {
+	select {
+	case reg.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Discover implements Discoverer.
+func (reg *Registrar) Discover(ctx context.Context) ([]Target, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire(time.Now())
+	return reg.targets(), nil
+}
+
+// Watch implements Watcher.
+func (reg *Registrar) Watch(ctx context.Context) ([]Target, error) {
+	for {
+		reg.mu.Lock()
+		var next time.Time
+		for _, e := range reg.entries {
+			if next.IsZero() || e.expires.Before(next) {
+				next = e.expires
+			}
+		}
+		reg.mu.Unlock()
+		wait := reg.TTL
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-reg.changed:
+			timer.Stop()
+			return reg.Discover(ctx)
+		case <-timer.C:
+		}
+		reg.mu.Lock()
+		lapsed := reg.expire(time.Now())
+		targets := reg.targets()
+		reg.mu.Unlock()
+		if lapsed {
+			return targets, nil
+		}
+	}
+}
+
+// expire removes lapsed registrations and reports whether there were any.
+// reg.mu must be held.
+func (reg *Registrar) expire(now time.Time) bool {
+	lapsed := false
+	for addr, e := range reg.entries {
+		if now.After(e.expires) {
+			logf("Registration of %q lapsed", addr)
+			delete(reg.entries, addr)
+			lapsed = true
+		}
+	}
+	return lapsed
+}
+
+// targets returns the registered targets. reg.mu must be held.
+func (reg *Registrar) targets() []Target {
+	targets := make([]Target, 0, len(reg.entries))
+	for _, e := range reg.entries {
+		targets = append(targets, e.target)
+	}
+	return targets
+}
+
+// Registrar returns the registrar of the pool, or nil if the pool does not
+// accept registrations.
+func (p *Pool) Registrar() *Registrar {
+	if p.discovery == nil {
+		return nil
+	}
+	for _, src := range p.discovery.sources {
+		if reg, ok := src.discoverer.(*Registrar); ok {
+			return reg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package loadbalancer
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound, so that
+// several sockets may listen on the same port, the kernel spreading incoming
+// connections across them.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	return errors.Join(err, serr)
+}
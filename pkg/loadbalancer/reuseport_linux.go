@@ -0,0 +1,4 @@
+package loadbalancer
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define on Linux.
+const soReusePort = 0xf
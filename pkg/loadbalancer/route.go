@@ -0,0 +1,553 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var splitDecisions = metrics.NewCounterVec("lb_route_split_total",
+	"Requests assigned to a pool by a route's weighted traffic split.", "route", "pool")
+
+// MatchType selects how a route condition compares a request value.
+type MatchType int
+
+const (
+	// MatchExact requires the value to equal the pattern.
+	MatchExact MatchType = iota
+	// MatchPrefix requires the value to start with the pattern.
+	MatchPrefix
+	// MatchRegex requires the value to match the pattern as a regular expression.
+	MatchRegex
+)
+
+// StringMatch compares a single request value against a pattern.
+type StringMatch struct {
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewStringMatch creates a StringMatch, compiling the pattern for regex matches.
+func NewStringMatch(matchType MatchType, value string) (StringMatch, error) {
+	m := StringMatch{Type: matchType, Value: value}
+	switch matchType {
+	case MatchExact, MatchPrefix:
+	case MatchRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return StringMatch{}, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		return StringMatch{}, fmt.Errorf("unknown match type %d", matchType)
+	}
+	return m, nil
+}
+
+// Matches reports whether s satisfies the match.
+func (m StringMatch) Matches(s string) bool {
+	switch m.Type {
+	case MatchExact:
+		return s == m.Value
+	case MatchPrefix:
+		return strings.HasPrefix(s, m.Value)
+	case MatchRegex:
+		return m.re != nil && m.re.MatchString(s)
+	}
+	return false
+}
+
+// HeaderMatch matches requests carrying a header whose value satisfies the StringMatch.
+type HeaderMatch struct {
+	Name string
+	StringMatch
+}
+
+// NewHeaderMatch creates a HeaderMatch for the named header.
+func NewHeaderMatch(name string, matchType MatchType, value string) (HeaderMatch, error) {
+	m, err := NewStringMatch(matchType, value)
+	if err != nil {
+		return HeaderMatch{}, fmt.Errorf("header %q: %w", name, err)
+	}
+	return HeaderMatch{Name: http.CanonicalHeaderKey(name), StringMatch: m}, nil
+}
+
+// Matches reports whether any value of the header in r satisfies the match.
+func (m HeaderMatch) Matches(r *http.Request) bool {
+	for _, v := range r.Header.Values(m.Name) {
+		if m.StringMatch.Matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryMatch matches requests carrying a query parameter whose value satisfies the StringMatch.
+type QueryMatch struct {
+	Name string
+	StringMatch
+}
+
+// NewQueryMatch creates a QueryMatch for the named query parameter.
+func NewQueryMatch(name string, matchType MatchType, value string) (QueryMatch, error) {
+	m, err := NewStringMatch(matchType, value)
+	if err != nil {
+		return QueryMatch{}, fmt.Errorf("query parameter %q: %w", name, err)
+	}
+	return QueryMatch{Name: name, StringMatch: m}, nil
+}
+
+// Matches reports whether any value of the query parameter in r satisfies the match.
+// The query is scanned in place rather than parsed, which would allocate
+// for every parameter of every request tried against the route; only
+// escaped names and values are copied, to unescape them.
+func (m QueryMatch) Matches(r *http.Request) bool {
+	for query := r.URL.RawQuery; query != ""; {
+		var pair string
+		pair, query, _ = strings.Cut(query, "&")
+		if strings.Contains(pair, ";") {
+			// As url.ParseQuery, which rejects them.
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil || key != m.Name {
+			continue
+		}
+		if value, err = url.QueryUnescape(value); err == nil && m.StringMatch.Matches(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadMethods and WriteMethods are convenience method sets for splitting
+// read-only traffic from mutating traffic, e.g. between replica and primary pools.
+var (
+	ReadMethods  = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	WriteMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+)
+
+// Rewrite describes how a route alters the request path before forwarding.
+// Steps are applied in order: StripPrefix, then Regex/Replacement, then AddPrefix.
+// StripPrefix only strips whole segments: "/api" strips "/api" and
+// "/api/v1" to "/" and "/v1", but leaves "/apis" alone.
+type Rewrite struct {
+	StripPrefix string
+	AddPrefix   string
+	Regex       *regexp.Regexp
+	Replacement string
+}
+
+// Apply returns path with the rewrite applied.
+func (rw *Rewrite) Apply(path string) string {
+	if p := rw.StripPrefix; p != "" && strings.HasPrefix(path, p) &&
+		(len(path) == len(p) || strings.HasSuffix(p, "/") || path[len(p)] == '/') {
+		path = path[len(p):]
+	}
+	if rw.Regex != nil {
+		path = rw.Regex.ReplaceAllString(path, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Redirect answers matching requests with a redirect instead of proxying them.
+//
+// Target may reference the placeholders {scheme}, {host}, {path}, {query} and
+// {uri}; {path} is the path after the route's Rewrite has been applied, so a
+// regex rewrite with capture groups can feed the redirect target.
+type Redirect struct {
+	Code   int
+	Target string
+}
+
+// NewRedirect creates a Redirect, validating the status code.
+func NewRedirect(code int, target string) (*Redirect, error) {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("unsupported redirect status %d", code)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("redirect target must not be empty")
+	}
+	return &Redirect{Code: code, Target: target}, nil
+}
+
+// Location expands the redirect target for r.
+func (rd *Redirect) Location(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	query := ""
+	if r.URL.RawQuery != "" {
+		query = "?" + r.URL.RawQuery
+	}
+	return strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", r.Host,
+		"{path}", r.URL.EscapedPath(),
+		"{query}", query,
+		"{uri}", r.URL.RequestURI(),
+	).Replace(rd.Target)
+}
+
+// ServeHTTP writes the redirect response.
+func (rd *Redirect) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	http.Redirect(rw, r, rd.Location(r), rd.Code)
+}
+
+// Fallback handles requests that match no route: they are either forwarded to
+// Pool or answered with a static Status and Body.
+type Fallback struct {
+	Pool   string
+	Status int
+	Body   string
+}
+
+// ServeHTTP writes the static fallback response.
+func (fb *Fallback) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	status := fb.Status
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	body := fb.Body
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	http.Error(rw, body, status)
+}
+
+var canaryForced = metrics.NewCounterVec("lb_route_canary_forced_total",
+	"Requests forced onto a route's canary pool by header or cookie.", "route", "pool")
+
+// Split assigns a share of a route's traffic to a pool. Shares are relative:
+// weights 95 and 5 send 95% and 5% of requests to their pools.
+type Split struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// Canary forces requests carrying a header or cookie onto a pool, overriding
+// any weighted split, so developers can pin their own traffic to a new version.
+// An empty Value matches any value of the header or cookie.
+type Canary struct {
+	Pool   string
+	Header string
+	Cookie string
+	Value  string
+}
+
+// Matches reports whether r opts into the canary.
+func (c *Canary) Matches(r *http.Request) bool {
+	if c.Header != "" {
+		for _, v := range r.Header.Values(c.Header) {
+			if c.Value == "" || v == c.Value {
+				return true
+			}
+		}
+	}
+	if c.Cookie != "" {
+		if cookie, err := r.Cookie(c.Cookie); err == nil && (c.Value == "" || cookie.Value == c.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route sends requests matching all of its conditions to a named pool (or the
+// active pool of a BlueGreen pair), divides them across several pools by
+// weighted split, or answers them with a redirect
+// when Redirect is set.
+// A route without conditions matches every request.
+//
+// When several routes match, the one with the highest Priority wins; ties are
+// broken by specificity (see Route.Specificity) and then by registration order.
+type Route struct {
+	Name     string
+	Pool     string
+	Priority int
+	Path     *StringMatch
+	Methods  []string
+	Headers  []HeaderMatch
+	Query    []QueryMatch
+	// Countries restricts the route to clients whose GeoIP country (ISO
+	// 3166-1 code) is listed. It requires the load balancer to have a GeoIP database.
+	Countries []string
+	// Schedule, if set, limits the route to the schedule's time windows.
+	Schedule   *Schedule
+	Rewrite    *Rewrite
+	Redirect   *Redirect
+	BlueGreen  *BlueGreen
+	Mirror     *Mirror
+	Canary     *Canary
+	Experiment *Experiment
+
+	// Affinity overrides the session affinity of the pools the route sends
+	// traffic to; DisableAffinity balances the route statelessly instead.
+	Affinity        *Affinity
+	DisableAffinity bool
+
+	// Stream flushes responses of the route as they arrive.
+	Stream *Stream
+
+	// Faults injects faults into the requests of the route.
+	Faults *Faults
+
+	// Middleware runs for the requests of the route, before they are
+	// rewritten and forwarded. It must be set before the route is added to
+	// a load balancer.
+	Middleware Chain
+
+	// middlewareNames names the middleware of Middleware built from a
+	// configuration, for Explain.
+	middlewareNames []string
+
+	splits atomic.Pointer[[]Split]
+	// handler serves the requests of the route once it is added.
+	handler http.Handler
+}
+
+// NewRoute creates a Route forwarding matching requests to the named pool.
+func NewRoute(name, pool string) *Route {
+	return &Route{
+		Name: name,
+		Pool: pool,
+	}
+}
+
+// Matches reports whether r satisfies every condition of the route.
+func (rt *Route) Matches(r *http.Request) bool {
+	return rt.mismatch(r) == ""
+}
+
+// mismatch returns the first condition of the route r does not satisfy,
+// named as in the configuration: "path", "methods", "headers", "query",
+// "countries" or "schedule", or "" if r satisfies them all.
+func (rt *Route) mismatch(r *http.Request) string {
+	if rt.Path != nil && !rt.Path.Matches(r.URL.Path) {
+		return "path"
+	}
+	if len(rt.Methods) > 0 && !rt.matchesMethod(r.Method) {
+		return "methods"
+	}
+	for _, h := range rt.Headers {
+		if !h.Matches(r) {
+			return "headers"
+		}
+	}
+	for _, q := range rt.Query {
+		if !q.Matches(r) {
+			return "query"
+		}
+	}
+	if len(rt.Countries) > 0 && !slices.Contains(rt.Countries, requestCountry(r)) {
+		return "countries"
+	}
+	if rt.Schedule != nil && !rt.Schedule.Active(time.Now()) {
+		return "schedule"
+	}
+	return ""
+}
+
+func (rt *Route) matchesMethod(method string) bool {
+	for _, m := range rt.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAffinity makes the route pin clients with a, regardless of the
+// affinity configured on its pools.
+func (rt *Route) SetAffinity(a *Affinity) {
+	if a != nil {
+		a.namespace = "route:" + rt.Name + ":"
+	}
+	rt.Affinity = a
+}
+
+// affinityFor returns the affinity applying to requests of the route served by pool.
+func (rt *Route) affinityFor(pool *Pool) *Affinity {
+	switch {
+	case rt == nil:
+		return pool.Affinity()
+	case rt.DisableAffinity:
+		return nil
+	case rt.Affinity != nil:
+		return rt.Affinity
+	}
+	return pool.Affinity()
+}
+
+// Splits returns the route's current traffic split, or nil if it sends all
+// traffic to Pool.
+func (rt *Route) Splits() []Split {
+	if splits := rt.splits.Load(); splits != nil {
+		return *splits
+	}
+	return nil
+}
+
+// SetSplits replaces the route's traffic split. It is safe to call while the
+// route is serving requests. An empty split sends all traffic to Pool again.
+func (rt *Route) SetSplits(splits []Split) error {
+	if len(splits) == 0 {
+		rt.splits.Store(nil)
+		return nil
+	}
+	total := 0
+	for _, sp := range splits {
+		if sp.Weight < 0 {
+			return fmt.Errorf("split for pool %q has negative weight", sp.Pool)
+		}
+		total += sp.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("split weights must not all be zero")
+	}
+	splits = slices.Clone(splits)
+	rt.splits.Store(&splits)
+	return nil
+}
+
+// pickPool returns the name of the pool that should serve r. A canary match
+// wins over an experiment, which wins over a weighted split.
+func (rt *Route) pickPool(rw http.ResponseWriter, r *http.Request) string {
+	if rt.Canary != nil && rt.Canary.Matches(r) {
+		canaryForced.Inc(rt.Name, rt.Canary.Pool)
+		return rt.Canary.Pool
+	}
+	if rt.Experiment != nil {
+		return rt.Experiment.assignAndTag(rw, r).Pool
+	}
+	splits := rt.Splits()
+	if splits == nil {
+		return rt.defaultPool()
+	}
+	total := 0
+	for _, sp := range splits {
+		total += sp.Weight
+	}
+	n := rand.IntN(total)
+	for _, sp := range splits {
+		if n < sp.Weight {
+			splitDecisions.Inc(rt.Name, sp.Pool)
+			return sp.Pool
+		}
+		n -= sp.Weight
+	}
+	return rt.defaultPool()
+}
+
+// defaultPool returns the pool serving the route when no split is in effect.
+func (rt *Route) defaultPool() string {
+	if rt.BlueGreen != nil {
+		return rt.BlueGreen.ActivePool()
+	}
+	return rt.Pool
+}
+
+// Specificity ranks how narrowly the route's conditions select requests. An
+// exact path beats a regex path, which beats a prefix path (longer prefixes
+// first); each method, header and query condition adds to the score.
+func (rt *Route) Specificity() int {
+	score := 0
+	if rt.Path != nil {
+		switch rt.Path.Type {
+		case MatchExact:
+			score += 1 << 20
+		case MatchRegex:
+			score += 1 << 19
+		case MatchPrefix:
+			score += 1<<18 + min(len(rt.Path.Value), 1<<10)<<4
+		}
+	}
+	if len(rt.Methods) > 0 {
+		score++
+	}
+	if len(rt.Countries) > 0 {
+		score++
+	}
+	if rt.Schedule != nil {
+		score++
+	}
+	return score + len(rt.Headers) + len(rt.Query)
+}
+
+// conditionKey returns a canonical description of the route's conditions. Two
+// routes with equal keys match exactly the same requests.
+func (rt *Route) conditionKey() string {
+	var b strings.Builder
+	if rt.Path != nil {
+		fmt.Fprintf(&b, "path:%d:%q;", rt.Path.Type, rt.Path.Value)
+	}
+	methods := make([]string, len(rt.Methods))
+	for i, m := range rt.Methods {
+		methods[i] = strings.ToUpper(m)
+	}
+	slices.Sort(methods)
+	fmt.Fprintf(&b, "methods:%v;", methods)
+	headers := make([]string, len(rt.Headers))
+	for i, h := range rt.Headers {
+		headers[i] = fmt.Sprintf("%s:%d:%q", h.Name, h.Type, h.Value)
+	}
+	slices.Sort(headers)
+	fmt.Fprintf(&b, "headers:%v;", headers)
+	query := make([]string, len(rt.Query))
+	for i, q := range rt.Query {
+		query[i] = fmt.Sprintf("%s:%d:%q", q.Name, q.Type, q.Value)
+	}
+	slices.Sort(query)
+	fmt.Fprintf(&b, "query:%v;", query)
+	countries := slices.Clone(rt.Countries)
+	slices.Sort(countries)
+	fmt.Fprintf(&b, "countries:%v", countries)
+	if sc := rt.Schedule; sc != nil {
+		fmt.Fprintf(&b, ";schedule:%q:%s:%s", sc.Start, sc.Duration, sc.Location)
+	}
+	return b.String()
+}
+
+// rewriteRequest returns r with the route's path rewrite applied. The original
+// request is left untouched. Paths escaped other than by default, such as
+// with "%2F", keep their escaping when rewriting them escaped gives the same
+// path.
+func (rt *Route) rewriteRequest(r *http.Request) *http.Request {
+	if rt.Rewrite == nil {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = rt.Rewrite.Apply(r.URL.Path)
+	r2.URL.RawPath = ""
+	if r.URL.RawPath != "" {
+		// The path is rewritten decoded; the escaped form is only kept if
+		// rewriting it gave the same path, which escapes such as "%69"
+		// for "i" or a regex matching "%" can keep from happening.
+		raw := rt.Rewrite.Apply(r.URL.RawPath)
+		if path, err := url.PathUnescape(raw); err == nil && path == r2.URL.Path {
+			r2.URL.RawPath = raw
+		}
+	}
+	return r2
+}
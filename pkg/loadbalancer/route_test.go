@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/health"
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+)
+
+// benchRoutes returns a load balancer with routes of every kind of
+// condition, the last of which matches benchRequest.
+func benchRoutes(t testing.TB) *LoadBalancer {
+	t.Helper()
+	lb, err := NewLoadBalancer(WithPools(NewPool(DefaultPoolName, lbtest.Servers("a"), nil, health.Check{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(name string, configure func(rt *Route)) {
+		rt := NewRoute(name, DefaultPoolName)
+		configure(rt)
+		if err := lb.AddRoute(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("exact", func(rt *Route) {
+		m, err := NewStringMatch(MatchExact, "/health")
+		must(err)
+		rt.Path = &m
+	})
+	add("regex", func(rt *Route) {
+		m, err := NewStringMatch(MatchRegex, `^/v[0-9]+/users/[0-9]+$`)
+		must(err)
+		rt.Path = &m
+	})
+	add("header", func(rt *Route) {
+		h, err := NewHeaderMatch("X-Version", MatchExact, "beta")
+		must(err)
+		rt.Headers = []HeaderMatch{h}
+	})
+	add("api", func(rt *Route) {
+		m, err := NewStringMatch(MatchPrefix, "/api/")
+		must(err)
+		rt.Path = &m
+		rt.Methods = ReadMethods
+		q, err := NewQueryMatch("region", MatchExact, "eu")
+		must(err)
+		rt.Query = []QueryMatch{q}
+	})
+	return lb
+}
+
+func benchRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/items?page=2&region=eu", nil)
+	r.Header.Set("X-Version", "stable")
+	return r
+}
+
+func TestRouteForAllocs(t *testing.T) {
+	lb := benchRoutes(t)
+	r := benchRequest()
+	if rt := lb.routeFor(r); rt == nil || rt.Name != "api" {
+		t.Fatalf("matched %v, want api", rt)
+	}
+	if n := testing.AllocsPerRun(100, func() { lb.routeFor(r) }); n != 0 {
+		t.Errorf("routeFor: %v allocations, want 0", n)
+	}
+}
+
+func BenchmarkRouteFor(b *testing.B) {
+	lb := benchRoutes(b)
+	r := benchRequest()
+	b.ReportAllocs()
+	for b.Loop() {
+		lb.routeFor(r)
+	}
+}
+
+func TestRewriteApply(t *testing.T) {
+	for _, tc := range []struct {
+		rw         Rewrite
+		path, want string
+	}{
+		{Rewrite{StripPrefix: "/api"}, "/api", "/"},
+		{Rewrite{StripPrefix: "/api"}, "/api/v1/users", "/v1/users"},
+		{Rewrite{StripPrefix: "/api"}, "/apis/v1", "/apis/v1"},
+		{Rewrite{StripPrefix: "/api/"}, "/api/v1", "/v1"},
+		{Rewrite{StripPrefix: "/api", AddPrefix: "/internal"}, "/api/v1", "/internal/v1"},
+		{Rewrite{StripPrefix: "/api", AddPrefix: "/internal"}, "/apiv1", "/internal/apiv1"},
+		{Rewrite{Regex: regexp.MustCompile(`^/users/([0-9]+)$`), Replacement: "/u/$1"}, "/users/42", "/u/42"},
+	} {
+		if got := tc.rw.Apply(tc.path); got != tc.want {
+			t.Errorf("%+v applied to %q: %q, want %q", tc.rw, tc.path, got, tc.want)
+		}
+	}
+}
+
+// TestRewriteRequestEscaped checks that rewritten paths keep their
+// escaping.
+func TestRewriteRequestEscaped(t *testing.T) {
+	rt := NewRoute("files", DefaultPoolName)
+	rt.Rewrite = &Rewrite{StripPrefix: "/files"}
+	for _, tc := range []struct{ target, want string }{
+		{"/files/a%2Fb/c", "/a%2Fb/c"},
+		{"/files/a%20b", "/a%20b"},
+		{"/files/a/b", "/a/b"},
+		// Stripped decoded: the escaped form does not start with the
+		// prefix.
+		{"/fil%65s/a%2Fb", "/a/b"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if got := rt.rewriteRequest(r).URL.EscapedPath(); got != tc.want {
+			t.Errorf("%s rewritten to %q, want %q", tc.target, got, tc.want)
+		}
+		if r.URL.EscapedPath() != tc.target {
+			t.Errorf("%s changed to %q", tc.target, r.URL.EscapedPath())
+		}
+	}
+
+	// A regex matching the decoded path only.
+	rt.Rewrite = &Rewrite{Regex: regexp.MustCompile(`/a/b$`), Replacement: "/c"}
+	r := httptest.NewRequest(http.MethodGet, "/p/a%2Fb", nil)
+	if got := rt.rewriteRequest(r).URL.EscapedPath(); got != "/p/c" {
+		t.Errorf("/p/a%%2Fb rewritten to %q, want /p/c", got)
+	}
+}
@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CronExpr is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week. Fields accept "*", single values, ranges
+// ("1-5"), lists ("1,15") and steps ("*/10", "8-18/2"). Day of week runs from
+// 0 (Sunday) to 6; 7 is accepted as Sunday too.
+type CronExpr struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (*CronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron %q: want %d fields, got %d", expr, len(cronFields), len(fields))
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %s: %w", expr, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &CronExpr{
+		expr:   expr,
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// String returns the expression as it was parsed.
+func (c *CronExpr) String() string {
+	return c.expr
+}
+
+// Matches reports whether the expression fires at the minute containing t.
+func (c *CronExpr) Matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domOK := c.dom&(1<<t.Day()) != 0
+	dowOK := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowOK
+	case c.dowAny:
+		return domOK
+	}
+	// Like cron, restricting both day fields matches either of them.
+	return domOK || dowOK
+}
+
+// Schedule is a recurring time window: it opens whenever Start fires and
+// stays open for Duration.
+type Schedule struct {
+	Start    *CronExpr
+	Duration time.Duration
+	Location *time.Location
+
+	// cache holds the result for the most recently evaluated minute.
+	cache atomic.Pointer[scheduleCache]
+}
+
+type scheduleCache struct {
+	minute int64
+	active bool
+}
+
+// NewSchedule creates a Schedule. A nil location means UTC.
+func NewSchedule(start string, duration time.Duration, loc *time.Location) (*Schedule, error) {
+	expr, err := ParseCron(start)
+	if err != nil {
+		return nil, err
+	}
+	if duration < time.Minute {
+		return nil, fmt.Errorf("schedule duration must be at least one minute")
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &Schedule{Start: expr, Duration: duration, Location: loc}, nil
+}
+
+// Active reports whether t falls inside a window of the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.Location).Truncate(time.Minute)
+	minute := t.Unix() / 60
+	if c := s.cache.Load(); c != nil && c.minute == minute {
+		return c.active
+	}
+	active := false
+	for back := time.Duration(0); back < s.Duration; back += time.Minute {
+		if s.Start.Matches(t.Add(-back)) {
+			active = true
+			break
+		}
+	}
+	s.cache.Store(&scheduleCache{minute: minute, active: active})
+	return active
+}
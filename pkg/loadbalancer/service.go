@@ -0,0 +1,578 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+// ErrRestartRequired is returned by Reload for configurations it cannot
+// apply without reopening the listeners.
+var ErrRestartRequired = errors.New("configuration change requires a restart")
+
+// Service runs the load balancer of a configuration with its frontend,
+// HTTP/3 and admin servers, layer-4 proxies, health checks and discovery,
+// along with the load balancers and servers of its other frontends.
+// Embedders drive it with Start or Run, Reload and Shutdown; failures are
+// returned, never fatal.
+type Service struct {
+	// mu serializes Start, Reload and Shutdown.
+	mu  sync.Mutex
+	cfg *config.Config
+	// listen holds the listener settings of cfg, which Reload keeps.
+	listen []byte
+	lb     *LoadBalancer
+
+	// handler and adminHandler serve with the current load balancer, which
+	// Reload replaces.
+	handler      swapHandler
+	adminHandler swapHandler
+	srv          *http.Server
+	admin        *http.Server
+	h3           *HTTP3
+	ha           *HA
+	cluster      *Cluster
+	fleet        *Fleet
+	prober       *Prober
+	frontends    []*frontend
+
+	// ctx is the base of the frontend requests, canceled by Shutdown once
+	// it gave up waiting for them.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	errc   chan error
+	state  serviceState
+}
+
+type serviceState int
+
+const (
+	serviceNew serviceState = iota
+	serviceStarted
+	serviceStopped
+)
+
+// NewService builds the load balancer and servers of cfg, and applies its
+// log level and anonymization. Nothing is started before Start or Run.
+func NewService(cfg *config.Config) (*Service, error) {
+	listen, err := listenerSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	level, err := ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("log_level: %w", err)
+	}
+	anonymizer, err := buildIPAnonymizer(cfg.AnonymizeIPs)
+	if err != nil {
+		return nil, fmt.Errorf("anonymize_ips: %w", err)
+	}
+	lb, err := Build(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{cfg: cfg, listen: listen, lb: lb, errc: make(chan error, 1)}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	if s.h3, err = BuildHTTP3(cfg); err != nil {
+		return nil, err
+	}
+	var handler http.Handler = &s.handler
+	if s.h3 != nil {
+		handler = s.h3.Advertise(handler)
+	}
+	if s.srv, err = BuildServer(cfg, handler); err != nil {
+		return nil, err
+	}
+	s.srv.BaseContext = func(net.Listener) context.Context { return s.ctx }
+	s.srv.ConnContext = s.handler.connContext(s.srv.ConnContext)
+	if s.frontends, err = buildFrontends(cfg); err != nil {
+		return nil, err
+	}
+	lb.keepFrontendState(s.frontends)
+	for _, fe := range s.frontends {
+		if err := fe.listen(); err != nil {
+			return nil, err
+		}
+		fe.srv.BaseContext = s.srv.BaseContext
+	}
+	if s.admin, err = BuildAdmin(cfg, lb); err != nil {
+		return nil, err
+	}
+	mountFrontends(s.admin, s.frontends)
+	if s.admin != nil {
+		s.adminHandler.store(s.admin.Handler)
+		s.admin.Handler = &s.adminHandler
+	}
+	if cfg.HA != nil && s.admin == nil {
+		return nil, fmt.Errorf("ha: the peer heartbeats the admin API, which is not configured")
+	}
+	if s.ha, err = buildHA(cfg.HA, s.LoadBalancer); err != nil {
+		return nil, fmt.Errorf("ha: %w", err)
+	}
+	if s.cluster, err = buildCluster(cfg.Cluster, s.LoadBalancer); err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+	if s.fleet, err = buildFleet(cfg.Fleet, s.config, s.Reload); err != nil {
+		return nil, fmt.Errorf("fleet: %w", err)
+	}
+	if s.prober, err = buildProber(cfg); err != nil {
+		return nil, err
+	}
+	lb.ha, lb.cluster, lb.fleet, lb.prober = s.ha, s.cluster, s.fleet, s.prober
+	s.handler.store(lb)
+	SetLogLevel(level)
+	SetIPAnonymizer(anonymizer)
+	return s, nil
+}
+
+// LoadBalancer returns the load balancer the service currently runs.
+func (s *Service) LoadBalancer() *LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lb
+}
+
+// Frontend returns the load balancer the service currently runs for the
+// frontend named name, or nil if there is none.
+func (s *Service) Frontend(name string) *LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fe := range s.frontends {
+		if fe.name == name {
+			return fe.lb
+		}
+	}
+	return nil
+}
+
+// mountFrontends serves the admin API of each of frontends under
+// /frontends/<name>/ of admin, if any.
+func mountFrontends(admin *http.Server, frontends []*frontend) {
+	if admin == nil {
+		return
+	}
+	h := admin.Handler.(*AdminHandler)
+	for _, fe := range frontends {
+		h.AddFrontend(fe.name, fe.lb)
+	}
+}
+
+// Start restores the runtime state, starts the discovery and health checks
+// and serves the listeners of the configuration in the background, and then
+// starts probing them. It
+// returns once they are open; a service failing to start should still be
+// shut down. The errors of servers that stop serving later are received from
+// Err.
+func (s *Service) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != serviceNew {
+		return errors.New("service already started")
+	}
+	s.state = serviceStarted
+	lb, cfg := s.lb, s.cfg
+	lb.StartDiscovery()
+	for _, fe := range s.frontends {
+		fe.lb.StartDiscovery()
+	}
+	if err := lb.RestoreState(); err != nil {
+		lb.logf("Failed to restore runtime state: %v", err)
+	}
+	lb.StartHealthChecks()
+	if err := lb.ServeL4(s.fail); err != nil {
+		return err
+	}
+	if s.admin != nil {
+		ln, err := DefaultUpgrader.Listen("tcp", s.admin.Addr)
+		if err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		go func() {
+			lb.logf("Serving admin API at %q", s.admin.Addr)
+			var err error
+			if s.admin.TLSConfig != nil {
+				err = s.admin.ServeTLS(ln, "", "")
+			} else {
+				err = s.admin.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.fail(fmt.Errorf("admin: %w", err))
+			}
+		}()
+	}
+	if s.h3 != nil {
+		go func() {
+			lb.logf("Serving HTTP/3 requests at %q", s.h3.Addr)
+			if err := s.h3.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile, &s.handler); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.fail(fmt.Errorf("http3: %w", err))
+			}
+		}()
+	}
+	listeners, err := Listen(cfg)
+	if err != nil {
+		return err
+	}
+	lb.logf("Serving requests at 'localhost:%s'", lb.Port())
+	for _, ln := range listeners {
+		ln = lb.Listener(ln)
+		go func() {
+			var err error
+			if cfg.TLS != nil {
+				err = s.srv.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			} else {
+				err = s.srv.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.fail(err)
+			}
+		}()
+	}
+	lb.SetReady(true)
+	for _, fe := range s.frontends {
+		fe.lb.StartHealthChecks()
+		if err := fe.serve(s.fail); err != nil {
+			return err
+		}
+		fe.lb.SetReady(true)
+	}
+	if s.cluster != nil {
+		if err := s.cluster.Start(); err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+	}
+	if s.ha != nil {
+		s.ha.Start()
+	}
+	if s.fleet != nil {
+		s.fleet.Start()
+	}
+	if s.prober != nil {
+		s.prober.Start()
+	}
+	for _, fe := range s.frontends {
+		if fe.prober != nil {
+			fe.prober.Start()
+		}
+	}
+	return nil
+}
+
+// config returns the configuration the service runs.
+func (s *Service) config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// fail reports err through Err, unless an error is already waiting there.
+func (s *Service) fail(err error) {
+	select {
+	case s.errc <- err:
+	default:
+	}
+}
+
+// Err returns a channel receiving the error of a server or proxy of the
+// started service that stopped serving.
+func (s *Service) Err() <-chan error {
+	return s.errc
+}
+
+// Run starts the service and serves until ctx is done or a server fails,
+// then shuts it down within the configured shutdown timeout. It returns
+// the error the service failed with, if any, and that of the shutdown.
+func (s *Service) Run(ctx context.Context) error {
+	var err error
+	if err = s.Start(); err == nil {
+		select {
+		case <-ctx.Done():
+		case err = <-s.errc:
+		}
+	}
+	timeout := cmp.Or(time.Duration(s.cfg.ShutdownTimeout), DefaultShutdownTimeout)
+	logf("Shutting down, waiting up to %v for in-flight requests", timeout)
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return errors.Join(err, s.Shutdown(sctx))
+}
+
+// Shutdown stops serving: it closes the listeners, waits for the requests
+// and layer-4 connections under way to finish until ctx is done, and then
+// cancels those left, saves the runtime state and stops the admin server.
+func (s *Service) Shutdown(ctx context.Context) error {
+	// Stop heartbeating first, the peer taking over, gossiping and following
+	// the fleet, without holding s.mu, which a takeover, gossip or reload
+	// under way needs.
+	s.fleet.Stop()
+	s.ha.Stop()
+	s.cluster.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == serviceStopped {
+		return nil
+	}
+	s.state = serviceStopped
+	// Probes would only fail from now on.
+	s.prober.Stop()
+	lb := s.lb
+	lb.SetReady(false)
+	for _, fe := range s.frontends {
+		fe.prober.Stop()
+		fe.lb.SetReady(false)
+	}
+	var errs []error
+	if s.h3 != nil {
+		s.h3.Close()
+	}
+	var wg sync.WaitGroup
+	shutdown := make([]error, len(s.frontends))
+	for i, fe := range s.frontends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fe.srv.Shutdown(ctx); err != nil {
+				shutdown[i] = fmt.Errorf("frontend %q: %w", fe.name, err)
+			}
+		}()
+	}
+	if err := s.srv.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	wg.Wait()
+	errs = append(errs, shutdown...)
+	if err := lb.Stop(ctx); err != nil && !errors.Is(err, ctx.Err()) {
+		errs = append(errs, err)
+	}
+	for _, fe := range s.frontends {
+		if err := fe.lb.Stop(ctx); err != nil && !errors.Is(err, ctx.Err()) {
+			errs = append(errs, fmt.Errorf("frontend %q: %w", fe.name, err))
+		}
+	}
+	s.cancel(ErrStopped)
+	if err := lb.SaveState(); err != nil {
+		errs = append(errs, fmt.Errorf("save state: %w", err))
+	}
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil && !errors.Is(err, ctx.Err()) {
+			errs = append(errs, fmt.Errorf("admin: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reload replaces the load balancer by one built from cfg, carrying the
+// runtime state over, and applies cfg's log level. The requests under way
+// finish on the previous one, which is stopped once they did or the grace
+// period of cfg's reload_drain passed, the shutdown timeout by default,
+// canceling those still under way; with keep_alive, the client connections
+// accepted before the reload are served by the previous one for the grace
+// period first. Changes to what the service listens on are not applied,
+// and neither are configurations with layer-4 proxies, whose connections a
+// reload would cut: both make it return ErrRestartRequired.
+func (s *Service) Reload(cfg *config.Config) error {
+	listen, err := listenerSettings(cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.state == serviceStopped:
+		return errors.New("service stopped")
+	case !bytes.Equal(listen, s.listen):
+		return fmt.Errorf("listener settings changed: %w", ErrRestartRequired)
+	case len(cfg.TCP) > 0 || len(cfg.UDP) > 0 || len(cfg.TLSPassthrough) > 0:
+		return fmt.Errorf("layer-4 proxies: %w", ErrRestartRequired)
+	}
+	level, err := ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log_level: %w", err)
+	}
+	anonymizer, err := buildIPAnonymizer(cfg.AnonymizeIPs)
+	if err != nil {
+		return fmt.Errorf("anonymize_ips: %w", err)
+	}
+	lb, err := Build(cfg)
+	if err != nil {
+		return err
+	}
+	var admin *http.Server
+	if s.admin != nil {
+		if admin, err = BuildAdmin(cfg, lb); err != nil {
+			return err
+		}
+	}
+	prober, err := buildProber(cfg)
+	if err != nil {
+		return err
+	}
+	frontends, err := buildFrontends(cfg)
+	if err != nil {
+		return err
+	}
+	lb.keepFrontendState(frontends)
+	mountFrontends(admin, frontends)
+	lb.ha, lb.cluster, lb.fleet, lb.prober = s.ha, s.cluster, s.fleet, prober
+	// The listener settings being the same, so are the frontends, in the
+	// same order.
+	olds := []*LoadBalancer{s.lb}
+	replaced := []*swapped{s.swap(s.lb, lb, &s.handler, s.prober, prober)}
+	for i, fe := range frontends {
+		old := s.frontends[i]
+		fe.handler, fe.srv = old.handler, old.srv
+		olds = append(olds, old.lb)
+		replaced = append(replaced, s.swap(old.lb, fe.lb, fe.handler, old.prober, fe.prober))
+	}
+	if admin != nil {
+		s.adminHandler.store(admin.Handler)
+	}
+	s.cfg, s.lb, s.prober, s.frontends = cfg, lb, prober, frontends
+	SetLogLevel(level)
+	SetIPAnonymizer(anonymizer)
+	lb.logf("Configuration reloaded")
+	emit(ConfigReloaded{Time: time.Now()})
+	grace := cmp.Or(time.Duration(cfg.ShutdownTimeout), DefaultShutdownTimeout)
+	keepAlive := false
+	if rd := cfg.ReloadDrain; rd != nil {
+		grace = cmp.Or(time.Duration(rd.Grace), grace)
+		keepAlive = rd.KeepAlive
+	}
+	for i, old := range olds {
+		old.SetReady(false)
+		replaced[i].keep.Store(keepAlive)
+		go func() {
+			if keepAlive {
+				select {
+				case <-time.After(grace):
+				case <-s.ctx.Done():
+				}
+				replaced[i].keep.Store(false)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			if n := old.forwarding.Load(); n > 0 {
+				old.logf("Reload: draining %d requests of the previous configuration", n)
+			}
+			if err := old.Stop(ctx); errors.Is(err, context.DeadlineExceeded) {
+				old.logf("Reload: requests of the previous configuration still under way after %v canceled", grace)
+			}
+		}()
+	}
+	return nil
+}
+
+// swap makes handler serve with lb instead of old, which it carries the
+// runtime state and probe results of prevProber over from, starting lb
+// and prober if the service is started, and returns the handler replaced.
+// Its caller holds s.mu.
+func (s *Service) swap(old, lb *LoadBalancer, handler *swapHandler, prevProber, prober *Prober) *swapped {
+	if s.state == serviceStarted {
+		lb.StartDiscovery()
+		if err := lb.Restore(old.Snapshot()); err != nil {
+			lb.logf("Reload: runtime state not restored: %v", err)
+		}
+		lb.StartHealthChecks()
+		lb.SetReady(true)
+	}
+	prev := handler.store(lb)
+	prevProber.Stop()
+	prober.Carry(prevProber)
+	if prober != nil && s.state == serviceStarted {
+		prober.Start()
+	}
+	return prev
+}
+
+// listenerSettings returns the encoded settings of cfg that only take
+// effect when the listeners are opened, for comparing configurations.
+func listenerSettings(cfg *config.Config) ([]byte, error) {
+	ls := listenerConfig(cfg)
+	for _, fc := range cfg.Frontends {
+		ls.Frontends = append(ls.Frontends, config.FrontendConfig{Name: fc.Name, Config: listenerConfig(&fc.Config)})
+	}
+	return json.Marshal(ls)
+}
+
+// listenerConfig returns the settings of cfg listenerSettings compares,
+// those of its frontends excepted.
+func listenerConfig(cfg *config.Config) config.Config {
+	ls := config.Config{
+		Port:                 cfg.Port,
+		ReadTimeout:          cfg.ReadTimeout,
+		WriteTimeout:         cfg.WriteTimeout,
+		IdleTimeout:          cfg.IdleTimeout,
+		ReadHeaderTimeout:    cfg.ReadHeaderTimeout,
+		MaxConnsPerClient:    cfg.MaxConnsPerClient,
+		MaxConns:             cfg.MaxConns,
+		MaxConnsQueueTimeout: cfg.MaxConnsQueueTimeout,
+		Socket:               cfg.Socket,
+		Egress:               cfg.Egress,
+		StrictParsing:        cfg.StrictParsing,
+		ReusePort:            cfg.ReusePort,
+		Listeners:            cfg.Listeners,
+		TLS:                  cfg.TLS,
+		HTTP2:                cfg.HTTP2,
+		HTTP3:                cfg.HTTP3,
+		ProxyProtocol:        cfg.ProxyProtocol,
+		HA:                   cfg.HA,
+		Cluster:              cfg.Cluster,
+		Fleet:                cfg.Fleet,
+	}
+	if ac := cfg.Admin; ac != nil {
+		ls.Admin = &config.AdminConfig{Addr: ac.Addr, TLS: ac.TLS}
+	}
+	return ls
+}
+
+// swapHandler serves requests with a handler that can be replaced while
+// serving. The requests of the connections accepted while a handler was
+// current are served by it still while its keep is set, if the server
+// records it with connContext.
+type swapHandler struct {
+	h atomic.Pointer[swapped]
+}
+
+// swapped is a handler of a swapHandler.
+type swapped struct {
+	http.Handler
+	keep atomic.Bool
+}
+
+// swappedKey is the key of the handler current when a connection was
+// accepted in its context.
+type swappedKey struct{ s *swapHandler }
+
+// store makes h the handler and returns the previous one, or nil.
+func (s *swapHandler) store(h http.Handler) *swapped {
+	return s.h.Swap(&swapped{Handler: h})
+}
+
+// connContext returns the ConnContext of a server serving with s, recording
+// the current handler in the context of each connection after prev, if not
+// nil, built it.
+func (s *swapHandler) connContext(prev func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, c net.Conn) context.Context {
+		if prev != nil {
+			ctx = prev(ctx, c)
+		}
+		return context.WithValue(ctx, swappedKey{s}, s.h.Load())
+	}
+}
+
+func (s *swapHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if h, ok := r.Context().Value(swappedKey{s}).(*swapped); ok && h.keep.Load() {
+		h.ServeHTTP(rw, r)
+		return
+	}
+	s.h.Load().ServeHTTP(rw, r)
+}
@@ -0,0 +1,203 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var signatureRequests = metrics.NewCounterVec("lb_signature_requests_total",
+	"Requests checked for an HMAC signature, by client and result: valid, missing, unknown, expired, invalid, replayed, too_large, or unchecked if too many signatures were remembered to tell replays.", "client", "result")
+
+// Defaults of the SignatureAuth fields.
+const (
+	defaultSignatureKeyHeader       = "X-Signature-Key"
+	defaultSignatureTimestampHeader = "X-Signature-Timestamp"
+	defaultSignatureHeader          = "X-Signature"
+	defaultSignatureMaxSkew         = 5 * time.Minute
+	defaultSignatureMaxBody         = 1 << 20
+	defaultSignatureMaxReplays      = 100000
+)
+
+// SignatureAuth requires requests to be signed with the shared secret of
+// their client, which KeyHeader names. SignatureHeader carries the hex
+// encoded HMAC-SHA256, keyed with the secret, of the Unix time in seconds
+// in TimestampHeader, the method, the request target as sent, path and
+// query, and the body, joined by newlines:
+//
+//	timestamp "\n" method "\n" target "\n" body
+//
+// Requests signed more than MaxSkew away from now, five minutes by default,
+// are refused, and so are those whose signature was already seen within
+// that time, remembering up to MaxReplays signatures, 100000 by default;
+// while it remembers that many, none expired, requests are refused with 503
+// as they could be replays. Bodies are read to be verified
+// before being forwarded, up to MaxBody bytes, 1 MiB by default; larger
+// ones are refused with 413.
+//
+// If ClientHeader is set, the client of requests verified is sent in that
+// header.
+type SignatureAuth struct {
+	Secrets         map[string][]byte
+	KeyHeader       string
+	TimestampHeader string
+	SignatureHeader string
+	ClientHeader    string
+	MaxSkew         time.Duration
+	MaxBody         int64
+	MaxReplays      int
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewSignatureAuth creates a SignatureAuth for the clients of secrets, by
+// name, with the default headers and limits.
+func NewSignatureAuth(secrets map[string][]byte) (*SignatureAuth, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("signature auth requires clients")
+	}
+	for id, secret := range secrets {
+		if id == "" || len(secret) == 0 {
+			return nil, fmt.Errorf("signature clients require an id and a secret")
+		}
+	}
+	return &SignatureAuth{
+		Secrets:         secrets,
+		KeyHeader:       defaultSignatureKeyHeader,
+		TimestampHeader: defaultSignatureTimestampHeader,
+		SignatureHeader: defaultSignatureHeader,
+		MaxSkew:         defaultSignatureMaxSkew,
+		MaxBody:         defaultSignatureMaxBody,
+		MaxReplays:      defaultSignatureMaxReplays,
+	}, nil
+}
+
+// Middleware returns the middleware refusing requests without a valid
+// signature with 401.
+func (a *SignatureAuth) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(a.KeyHeader)
+			ts := r.Header.Get(a.TimestampHeader)
+			sig, err := hex.DecodeString(r.Header.Get(a.SignatureHeader))
+			if id == "" || ts == "" || err != nil || len(sig) == 0 {
+				signatureRequests.Inc("", "missing")
+				httpError(rw, r, "401 unauthorized: request signature required", http.StatusUnauthorized)
+				return
+			}
+			secret, ok := a.Secrets[id]
+			if !ok {
+				signatureRequests.Inc("", "unknown")
+				httpError(rw, r, "401 unauthorized: unknown signature key", http.StatusUnauthorized)
+				return
+			}
+			now := time.Now()
+			unix, err := strconv.ParseInt(ts, 10, 64)
+			signed := time.Unix(unix, 0)
+			if err != nil || signed.Before(now.Add(-a.MaxSkew)) || signed.After(now.Add(a.MaxSkew)) {
+				signatureRequests.Inc(id, "expired")
+				httpError(rw, r, "401 unauthorized: request signature expired", http.StatusUnauthorized)
+				return
+			}
+			var body []byte
+			if r.Body != nil && r.Body != http.NoBody {
+				body, err = io.ReadAll(io.LimitReader(r.Body, a.MaxBody+1))
+				if err != nil {
+					httpError(rw, r, "400 bad request: reading body", http.StatusBadRequest)
+					return
+				}
+				if int64(len(body)) > a.MaxBody {
+					signatureRequests.Inc(id, "too_large")
+					rw.Header().Set("Connection", "close")
+					httpError(rw, r, "413 request body too large to verify", http.StatusRequestEntityTooLarge)
+					return
+				}
+			}
+			target := cmp.Or(r.RequestURI, r.URL.RequestURI())
+			mac := hmac.New(sha256.New, secret)
+			fmt.Fprintf(mac, "%s\n%s\n%s\n", ts, r.Method, target)
+			mac.Write(body)
+			if !hmac.Equal(sig, mac.Sum(nil)) {
+				signatureRequests.Inc(id, "invalid")
+				httpError(rw, r, "401 unauthorized: invalid request signature", http.StatusUnauthorized)
+				return
+			}
+			first, full := a.first(id+":"+hex.EncodeToString(sig), signed.Add(a.MaxSkew), now)
+			if full {
+				signatureRequests.Inc(id, "unchecked")
+				rw.Header().Set("Retry-After", "1")
+				httpError(rw, r, "503 service unavailable: too many signed requests", http.StatusServiceUnavailable)
+				return
+			}
+			if !first {
+				signatureRequests.Inc(id, "replayed")
+				httpError(rw, r, "401 unauthorized: request replayed", http.StatusUnauthorized)
+				return
+			}
+			signatureRequests.Inc(id, "valid")
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			if body != nil {
+				// Reading the body has sent the client its 100 Continue.
+				r.Header.Del("Expect")
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{bytes.NewReader(body), r.Body}
+			}
+			if a.ClientHeader != "" {
+				r.Header.Set(a.ClientHeader, id)
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// first records the signature key, valid until expires, and reports
+// whether it was not seen before, or, if MaxReplays signatures not expired
+// are remembered already, that it could not be told.
+func (a *SignatureAuth) first(key string, expires, now time.Time) (first, full bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = map[string]time.Time{}
+	}
+	if exp, ok := a.seen[key]; ok && now.Before(exp) {
+		return false, false
+	}
+	_, ok := a.seen[key]
+	limit := cmp.Or(a.MaxReplays, defaultSignatureMaxReplays)
+	// Sweeping at most every second when full bounds the work a flood
+	// makes.
+	if now.Sub(a.lastSweep) >= a.MaxSkew || (!ok && len(a.seen) >= limit && now.Sub(a.lastSweep) >= time.Second) {
+		for k, exp := range a.seen {
+			if !now.Before(exp) {
+				delete(a.seen, k)
+				tableEntries.Dec("signature_replays")
+				tableEvictions.Inc("signature_replays", "expired")
+			}
+		}
+		a.lastSweep = now
+		_, ok = a.seen[key]
+	}
+	if !ok {
+		if len(a.seen) >= limit {
+			return false, true
+		}
+		tableEntries.Inc("signature_replays")
+	}
+	a.seen[key] = expires
+	return true, false
+}
@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a GET of target signed by the client id with
+// secret at ts.
+func signedRequest(id string, secret []byte, target string, ts time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", unix, r.Method, target)
+	r.Header.Set(defaultSignatureKeyHeader, id)
+	r.Header.Set(defaultSignatureTimestampHeader, unix)
+	r.Header.Set(defaultSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSignatureAuth(t *testing.T) {
+	secret := []byte("secret")
+	a, err := NewSignatureAuth(map[string][]byte{"acme": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	serve := func(r *http.Request) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	now := time.Now()
+	if got := serve(signedRequest("acme", secret, "/a", now)); got != http.StatusOK {
+		t.Errorf("signed: got %d, want 200", got)
+	}
+	if got := serve(signedRequest("acme", secret, "/a", now)); got != http.StatusUnauthorized {
+		t.Errorf("replayed: got %d, want 401", got)
+	}
+	if got := serve(signedRequest("acme", []byte("guess"), "/b", now)); got != http.StatusUnauthorized {
+		t.Errorf("wrong secret: got %d, want 401", got)
+	}
+	if got := serve(signedRequest("acme", secret, "/c", now.Add(-time.Hour))); got != http.StatusUnauthorized {
+		t.Errorf("expired: got %d, want 401", got)
+	}
+}
+
+// TestSignatureAuthFull checks that signatures are not forgotten before
+// they expire, for replays to pass.
+func TestSignatureAuthFull(t *testing.T) {
+	a, err := NewSignatureAuth(map[string][]byte{"acme": []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.MaxReplays = 2
+	now := time.Now()
+	expires := now.Add(a.MaxSkew)
+	for _, key := range []string{"a", "b"} {
+		if first, full := a.first(key, expires, now); !first || full {
+			t.Fatalf("%s: first %v, full %v", key, first, full)
+		}
+	}
+	if first, full := a.first("c", expires, now.Add(2*time.Second)); first || !full {
+		t.Errorf("past MaxReplays: first %v, full %v", first, full)
+	}
+	if first, _ := a.first("a", expires, now); first {
+		t.Error("replay accepted once full")
+	}
+	// Once expired, signatures make room.
+	if first, full := a.first("c", expires.Add(time.Hour), expires.Add(time.Second)); !first || full {
+		t.Errorf("after expiry: first %v, full %v", first, full)
+	}
+}
@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+// defaultReadHeaderTimeout bounds reading request headers when neither a
+// header nor a whole request read timeout is configured.
+const defaultReadHeaderTimeout = 10 * time.Second
+
+var (
+	connsRefused = metrics.NewCounterVec("lb_client_conns_refused_total",
+		"Connections closed for exceeding the concurrent connections allowed per client, by listener.", "listener")
+	bodyTimeouts = metrics.NewCounterVec("lb_body_idle_timeouts_total",
+		"Requests whose body stalled for longer than the body idle timeout.")
+)
+
+// ConnLimit limits the connections a listener holds at once from a client
+// address to Max, so that a client opening many connections and sending
+// slowly on each cannot take up the whole capacity of the load balancer.
+// Connections over the limit are closed as soon as they are read from.
+//
+// The client is known on the connection's first read, after a PROXY
+// protocol header was read if the listener accepts them, so that the
+// limit applies to the clients of an upstream balancer rather than to the
+// balancer itself.
+type ConnLimit struct {
+	Max  int
+	name string
+
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+// NewConnLimit creates a ConnLimit of max connections per client, counted
+// in the metrics under name.
+func NewConnLimit(name string, max int) *ConnLimit {
+	return &ConnLimit{Max: max, name: name, conns: map[netip.Addr]int{}}
+}
+
+// Listen wraps ln so that its connections count against the limit.
+func (l *ConnLimit) Listen(ln net.Listener) net.Listener {
+	return &connLimitListener{Listener: ln, limit: l}
+}
+
+// acquire counts a connection from ip and reports whether it is allowed.
+func (l *ConnLimit) acquire(ip netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.Max {
+		connsRefused.Inc(l.name)
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ConnLimit) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+type connLimitListener struct {
+	net.Listener
+	limit *ConnLimit
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &connLimitConn{Conn: conn, limit: l.limit}, nil
+}
+
+var errTooManyConns = errors.New("too many connections from client")
+
+// connLimitConn counts against its limit from its first read until it is
+// closed.
+type connLimitConn struct {
+	net.Conn
+	limit *ConnLimit
+
+	once    sync.Once
+	ip      netip.Addr
+	counted bool
+	refused bool
+	release sync.Once
+}
+
+func (c *connLimitConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		// Addresses outside IP, such as Unix sockets, are not limited.
+		c.ip = addrIP(c.Conn.RemoteAddr())
+		if !c.ip.IsValid() {
+			return
+		}
+		if c.counted = c.limit.acquire(c.ip); !c.counted {
+			c.refused = true
+			c.Conn.Close()
+		}
+	})
+	if c.refused {
+		return 0, errTooManyConns
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *connLimitConn) Close() error {
+	c.once.Do(func() {})
+	c.release.Do(func() {
+		if c.counted {
+			c.limit.release(c.ip)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// BodyTimeout fails the read of a request body that receives nothing for
+// Idle, answering 408, so that a client trickling a body cannot hold a
+// connection and a backend request open. ReadTimeout, if set, is the
+// listener's read timeout, which still bounds reading the whole request.
+type BodyTimeout struct {
+	Idle        time.Duration
+	ReadTimeout time.Duration
+}
+
+// Middleware returns the middleware enforcing the timeout.
+func (t *BodyTimeout) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			b := &idleBody{ReadCloser: r.Body, rc: http.NewResponseController(rw), idle: t.Idle}
+			if t.ReadTimeout > 0 {
+				b.deadline = time.Now().Add(t.ReadTimeout)
+			}
+			r = r.WithContext(r.Context())
+			r.Body = b
+			next.ServeHTTP(&bodyTimeoutWriter{ResponseWriter: rw, body: b}, r)
+		})
+	}
+}
+
+// idleBody moves the read deadline of its connection before every read.
+type idleBody struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	idle     time.Duration
+	deadline time.Time
+
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	d := time.Now().Add(b.idle)
+	if !b.deadline.IsZero() && b.deadline.Before(d) {
+		d = b.deadline
+	}
+	// Protocols without read deadlines leave the body unbounded.
+	b.rc.SetReadDeadline(d)
+	n, err := b.ReadCloser.Read(p)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		b.mu.Lock()
+		if !b.timedOut {
+			b.timedOut = true
+			bodyTimeouts.Inc()
+		}
+		b.mu.Unlock()
+	}
+	if err == io.EOF {
+		b.rc.SetReadDeadline(b.deadline)
+	}
+	return n, err
+}
+
+func (b *idleBody) stalled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.timedOut
+}
+
+// bodyTimeoutWriter turns the 502 the proxy answers when it fails to read
+// the request body into a 408 once the body stalled.
+type bodyTimeoutWriter struct {
+	http.ResponseWriter
+	body *idleBody
+}
+
+func (w *bodyTimeoutWriter) WriteHeader(code int) {
+	if code == http.StatusBadGateway && w.body.stalled() {
+		w.Header().Set("Connection", "close")
+		code = http.StatusRequestTimeout
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *bodyTimeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
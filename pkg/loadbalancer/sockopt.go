@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOptions tune the TCP sockets of a listener or of the connections to
+// backends, for links of high latency or high throughput.
+//
+// NoDelay, if set, turns Nagle's algorithm off (true, as Go does by
+// default) or on. Keep-alive probes are sent after KeepAliveIdle without
+// traffic, every KeepAliveInterval, and the connection is closed once
+// KeepAliveCount go unanswered; zero values mean 15 seconds, 15 seconds and
+// 9, and DisableKeepAlive sends none. ReadBuffer and WriteBuffer set the
+// sizes of the kernel's socket buffers; zero keeps the system's.
+type SocketOptions struct {
+	NoDelay           *bool
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	DisableKeepAlive  bool
+	ReadBuffer        int
+	WriteBuffer       int
+}
+
+// keepAlive reports whether o changes the keep-alive settings of sockets.
+func (o *SocketOptions) keepAlive() bool {
+	return o.DisableKeepAlive || o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// apply sets the options on conn, if it is a TCP connection.
+func (o *SocketOptions) apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tc.SetNoDelay(*o.NoDelay); err != nil {
+			return fmt.Errorf("set TCP_NODELAY: %w", err)
+		}
+	}
+	if o.keepAlive() {
+		err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   !o.DisableKeepAlive,
+			Idle:     o.KeepAliveIdle,
+			Interval: o.KeepAliveInterval,
+			Count:    o.KeepAliveCount,
+		})
+		if err != nil {
+			return fmt.Errorf("set keep-alive: %w", err)
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("set SO_SNDBUF: %w", err)
+		}
+	}
+	return nil
+}
+
+// Listen wraps ln so that the options are set on the connections it
+// accepts. Failing to set them is logged and leaves the connection as it
+// is.
+func (o *SocketOptions) Listen(ln net.Listener) net.Listener {
+	if o == nil {
+		return ln
+	}
+	return &sockoptListener{Listener: ln, options: o}
+}
+
+type sockoptListener struct {
+	net.Listener
+	options *SocketOptions
+}
+
+func (l *sockoptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.options.apply(conn); err != nil {
+		logf("Connection from %q: %v", logAddr(conn.RemoteAddr()), err)
+	}
+	return conn, nil
+}
+
+// dialContext wraps dial so that the options are set on the connections it
+// makes.
+func (o *SocketOptions) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.apply(conn); err != nil {
+			logf("Connection to %q: %v", addr, err)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRVDiscoverer looks up a DNS SRV record and yields one target per record.
+// The record's priority becomes the server's tier, so lower-priority records
+// only receive traffic once every higher-priority server is down, and its
+// weight becomes the server's weight.
+type SRVDiscoverer struct {
+	// Name is the full record name, such as "_http._tcp.example.com".
+	Name string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme   string
+	Resolver *net.Resolver
+}
+
+// NewSRVDiscoverer creates an SRVDiscoverer for the record name.
+func NewSRVDiscoverer(name, scheme string) (*SRVDiscoverer, error) {
+	if name == "" {
+		return nil, fmt.Errorf("srv record name must not be empty")
+	}
+	return &SRVDiscoverer{Name: name, Scheme: scheme, Resolver: net.DefaultResolver}, nil
+}
+
+// Discover implements Discoverer.
+func (d *SRVDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(records))
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		if host == "" {
+			// A target of "." means the service is unavailable.
+			continue
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(rec.Port)))
+		if d.Scheme != "" {
+			addr = d.Scheme + "://" + addr
+		}
+		targets = append(targets, Target{
+			Addr:       addr,
+			ServerName: host,
+			// Weight 0 records are meant to be picked rarely, not never.
+			Weight: max(int(rec.Weight), 1),
+			Tier:   int(rec.Priority),
+		})
+	}
+	return targets, nil
+}
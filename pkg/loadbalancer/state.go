@@ -0,0 +1,318 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/config"
+)
+
+// State is a snapshot of the changes made to a load balancer at runtime,
+// saved so that a restart does not lose them: servers added and removed
+// through the admin API, the weights, tiers, drain and disable flags of the
+// servers, maintenance switches, route splits, blue/green deployments, the
+// pins of in-memory affinity stores and the bans of abuse detection. Pools
+// added at runtime are not kept.
+type State struct {
+	Saved       time.Time         `json:"saved"`
+	Maintenance *MaintenanceState `json:"maintenance,omitempty"`
+	Pools       []PoolState       `json:"pools"`
+	Routes      []RouteState      `json:"routes,omitempty"`
+	Bans        []Ban             `json:"bans,omitempty"`
+	// Frontends are the states of the other frontends of a service, by
+	// name, which the state file of the main one keeps.
+	Frontends map[string]*State `json:"frontends,omitempty"`
+}
+
+// MaintenanceState is the state of the global maintenance switch.
+type MaintenanceState struct {
+	Enabled bool     `json:"enabled"`
+	Routes  []string `json:"routes,omitempty"`
+}
+
+// PoolState is the runtime state of a pool.
+type PoolState struct {
+	Name        string                `json:"name"`
+	Maintenance bool                  `json:"maintenance,omitempty"`
+	Added       []config.ServerConfig `json:"added,omitempty"`
+	Removed     []string              `json:"removed,omitempty"`
+	Servers     []ServerState         `json:"servers"`
+	Pins        []StoredPin           `json:"pins,omitempty"`
+	// Datacenters are the weights of data centers set with
+	// Datacenters.SetWeight.
+	Datacenters map[string]int `json:"datacenters,omitempty"`
+}
+
+// ServerState is the runtime state of a server. A drain by a maintenance
+// window is not recorded, the window draining the server again if it is
+// still open.
+type ServerState struct {
+	Addr        string `json:"addr"`
+	Weight      int    `json:"weight"`
+	Tier        int    `json:"tier"`
+	Draining    bool   `json:"draining,omitempty"`
+	DrainSticky bool   `json:"drain_sticky,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+}
+
+// RouteState is the runtime state of a route.
+type RouteState struct {
+	Name      string           `json:"name"`
+	Splits    []Split          `json:"splits,omitempty"`
+	BlueGreen *BlueGreenStatus `json:"bluegreen,omitempty"`
+	Pins      []StoredPin      `json:"pins,omitempty"`
+}
+
+// Snapshot returns the runtime state of the load balancer.
+func (lb *LoadBalancer) Snapshot() *State {
+	st := &State{Saved: time.Now().UTC(), Pools: []PoolState{}}
+	if m := lb.Maintenance(); m.Enabled() {
+		st.Maintenance = &MaintenanceState{Enabled: true, Routes: m.Routes()}
+	}
+	for _, p := range lb.Pools() {
+		st.Pools = append(st.Pools, p.snapshot())
+	}
+	for _, rt := range lb.routes {
+		rs := RouteState{Name: rt.Name, Splits: rt.Splits(), Pins: memoryPins(rt.Affinity)}
+		if bg := rt.BlueGreen; bg != nil {
+			status := bg.Status()
+			rs.BlueGreen = &status
+		}
+		if rs.Splits != nil || rs.BlueGreen != nil || rs.Pins != nil {
+			st.Routes = append(st.Routes, rs)
+		}
+	}
+	if g := lb.abuse; g != nil {
+		if bans := g.Bans(); len(bans) > 0 {
+			st.Bans = bans
+		}
+	}
+	return st
+}
+
+func (p *Pool) snapshot() PoolState {
+	ps := PoolState{Name: p.Name, Maintenance: p.InMaintenance(), Servers: []ServerState{}, Pins: memoryPins(p.Affinity())}
+	p.editMu.Lock()
+	for _, sc := range p.added {
+		ps.Added = append(ps.Added, sc)
+	}
+	for addr := range p.removed {
+		ps.Removed = append(ps.Removed, addr)
+	}
+	p.editMu.Unlock()
+	slices.SortFunc(ps.Added, func(a, b config.ServerConfig) int { return cmp.Compare(a.Addr, b.Addr) })
+	slices.Sort(ps.Removed)
+	for _, s := range p.Servers() {
+		ss := ServerState{Addr: s.Address(), Weight: s.Weight(), Tier: backend.TierOf(s)}
+		if d, ok := s.(backend.Drainable); ok && d.Draining() {
+			if w, ok := s.(Windowed); !ok || !w.drainedByWindow() {
+				ss.Draining, ss.DrainSticky = true, d.DrainSticky()
+			}
+		}
+		if d, ok := s.(backend.Disableable); ok {
+			ss.Disabled = d.Disabled()
+		}
+		ps.Servers = append(ps.Servers, ss)
+	}
+	if d := p.datacenters; d != nil {
+		ps.Datacenters = d.Overrides()
+	}
+	return ps
+}
+
+// memoryPins returns the pins of a, or nil unless a keeps them in memory.
+func memoryPins(a *Affinity) []StoredPin {
+	if a == nil {
+		return nil
+	}
+	if s, ok := a.Store.(*MemoryAffinityStore); ok {
+		if pins := s.Pins(); len(pins) > 0 {
+			return pins
+		}
+	}
+	return nil
+}
+
+// Restore applies st, a snapshot taken by Snapshot, to the load balancer.
+// Pools, routes and servers it mentions that no longer exist are skipped,
+// as the configuration may have changed since the snapshot; their names are
+// returned in the error.
+func (lb *LoadBalancer) Restore(st *State) error {
+	var errs []error
+	if ms := st.Maintenance; ms != nil {
+		m := lb.Maintenance()
+		m.SetRoutes(slices.DeleteFunc(ms.Routes, func(name string) bool { return lb.Route(name) == nil }))
+		m.SetEnabled(ms.Enabled)
+	}
+	for _, ps := range st.Pools {
+		p := lb.Pool(ps.Name)
+		if p == nil {
+			errs = append(errs, fmt.Errorf("%w %q", ErrPoolNotFound, ps.Name))
+			continue
+		}
+		if err := p.restore(ps); err != nil {
+			errs = append(errs, fmt.Errorf("pool %q: %w", ps.Name, err))
+		}
+	}
+	for _, rs := range st.Routes {
+		rt := lb.Route(rs.Name)
+		if rt == nil {
+			errs = append(errs, fmt.Errorf("unknown route %q", rs.Name))
+			continue
+		}
+		if rs.Splits != nil {
+			if err := lb.SetRouteSplits(rs.Name, rs.Splits); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if rs.BlueGreen != nil && rt.BlueGreen != nil {
+			if err := rt.BlueGreen.restore(*rs.BlueGreen); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rs.Name, err))
+			}
+		}
+		restorePins(rt.Affinity, rs.Pins)
+	}
+	if g := lb.abuse; g != nil {
+		g.restore(st.Bans)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) restore(ps PoolState) error {
+	var errs []error
+	p.SetMaintenance(ps.Maintenance)
+	for _, addr := range ps.Removed {
+		p.RemoveServer(addr)
+	}
+	for _, sc := range ps.Added {
+		if p.Server(sc.Addr) != nil {
+			continue
+		}
+		if _, err := p.AddServerConfig(sc); err != nil {
+			errs = append(errs, fmt.Errorf("server %q: %w", sc.Addr, err))
+		}
+	}
+	retier := false
+	for _, ss := range ps.Servers {
+		s := p.Server(ss.Addr)
+		if s == nil {
+			errs = append(errs, fmt.Errorf("unknown server %q", ss.Addr))
+			continue
+		}
+		if w, ok := s.(backend.WeightSetter); ok {
+			if ss.Weight > 0 {
+				w.SetWeight(ss.Weight)
+			}
+			if ss.Tier != backend.TierOf(s) {
+				w.SetTier(ss.Tier)
+				retier = true
+			}
+		}
+		if d, ok := s.(backend.Drainable); ok && ss.Draining {
+			d.Drain(ss.DrainSticky)
+		}
+		if d, ok := s.(backend.Disableable); ok {
+			d.SetDisabled(ss.Disabled)
+		}
+	}
+	if retier {
+		p.retier()
+	}
+	for name, w := range ps.Datacenters {
+		if d := p.datacenters; d == nil || !d.SetWeight(name, &w) {
+			errs = append(errs, fmt.Errorf("unknown data center %q", name))
+		}
+	}
+	restorePins(p.Affinity(), ps.Pins)
+	return errors.Join(errs...)
+}
+
+func restorePins(a *Affinity, pins []StoredPin) {
+	if a == nil || len(pins) == 0 {
+		return
+	}
+	if s, ok := a.Store.(*MemoryAffinityStore); ok {
+		s.RestorePins(pins)
+	}
+}
+
+// SaveState writes a snapshot of the runtime state, and of that of the
+// frontends kept with it, to the state file, if one is configured, replacing
+// it atomically.
+func (lb *LoadBalancer) SaveState() error {
+	if lb.stateFile == "" {
+		return nil
+	}
+	st := lb.Snapshot()
+	for name, fe := range lb.frontends {
+		if st.Frontends == nil {
+			st.Frontends = map[string]*State{}
+		}
+		st.Frontends[name] = fe.Snapshot()
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	tmp := lb.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lb.stateFile)
+}
+
+// RestoreState restores the runtime state from the state file, if one is
+// configured and exists.
+func (lb *LoadBalancer) RestoreState() error {
+	if lb.stateFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(lb.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st State
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("%s: %w", lb.stateFile, err)
+	}
+	lb.logf("Restoring runtime state saved at %v", st.Saved)
+	errs := []error{lb.Restore(&st)}
+	for name, fst := range st.Frontends {
+		fe := lb.frontends[name]
+		if fe == nil {
+			errs = append(errs, fmt.Errorf("unknown frontend %q", name))
+			continue
+		}
+		if err := fe.Restore(fst); err != nil {
+			errs = append(errs, fmt.Errorf("frontend %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StateFile returns the file the runtime state is saved to, if any.
+func (lb *LoadBalancer) StateFile() string { return lb.stateFile }
+
+// SetStateFile sets the file the runtime state is saved to and restored from.
+func (lb *LoadBalancer) SetStateFile(path string) { lb.stateFile = path }
+
+// keepFrontendState has the state file of lb keep the runtime state of the
+// load balancers of frontends.
+func (lb *LoadBalancer) keepFrontendState(frontends []*frontend) {
+	lb.frontends = make(map[string]*LoadBalancer, len(frontends))
+	for _, fe := range frontends {
+		lb.frontends[fe.name] = fe.lb
+	}
+}
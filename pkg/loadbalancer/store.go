@@ -0,0 +1,378 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SharedStore is a key-value store for the state that load balancer
+// instances share: affinity pins, quota counters, rate counters and bans,
+// so that every feature needing it does not integrate a store of its own.
+// Features namespace their keys, such as "affinity:" or "quota:".
+type SharedStore interface {
+	// Get returns the value stored under key and whether one exists.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key. The store may discard it after ttl; a
+	// zero ttl keeps it until it is deleted.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the value stored under key.
+	Delete(ctx context.Context, key string) error
+	// Incr adds delta to the decimal integer stored under key, from zero
+	// if there is none, in which case the store may discard it after ttl,
+	// and returns the result.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// defaultSharedMaxEntries bounds the values of a MemorySharedStore by
+// default.
+const defaultSharedMaxEntries = 100000
+
+// errSharedStoreFull is returned for values of new keys a
+// MemorySharedStore has no room for.
+var errSharedStoreFull = errors.New("shared store full")
+
+// MemorySharedStore is a SharedStore local to one LB instance, for a single
+// instance or tests. It keeps at most MaxEntries values, refusing those of
+// new keys past it until some expire or are deleted: evicting a live
+// counter would reset the quota or rate it counts.
+type MemorySharedStore struct {
+	MaxEntries int
+
+	mu        sync.Mutex
+	values    map[string]memoryValue
+	lastSweep time.Time
+}
+
+type memoryValue struct {
+	value    []byte
+	deadline time.Time
+}
+
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.deadline.IsZero() && now.After(v.deadline)
+}
+
+// NewMemorySharedStore creates an empty in-memory store of up to 100000
+// values.
+func NewMemorySharedStore() *MemorySharedStore {
+	return &MemorySharedStore{MaxEntries: defaultSharedMaxEntries, values: map[string]memoryValue{}}
+}
+
+// Get implements SharedStore.
+func (s *MemorySharedStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok || v.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return v.value, true, nil
+}
+
+// Set implements SharedStore.
+func (s *MemorySharedStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	v := memoryValue{value: value}
+	if ttl > 0 {
+		v.deadline = now.Add(ttl)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(key, v, now)
+}
+
+// Delete implements SharedStore.
+func (s *MemorySharedStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key, "")
+	return nil
+}
+
+// Incr implements SharedStore.
+func (s *MemorySharedStore) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok || v.expired(now) {
+		v = memoryValue{}
+		if ttl > 0 {
+			v.deadline = now.Add(ttl)
+		}
+	}
+	var n int64
+	if v.value != nil {
+		var err error
+		if n, err = strconv.ParseInt(string(v.value), 10, 64); err != nil {
+			return 0, fmt.Errorf("value of %q is not an integer", key)
+		}
+	}
+	n += delta
+	v.value = strconv.AppendInt(nil, n, 10)
+	if err := s.put(key, v, now); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// put adds or replaces a value, purging those expired every minute, or
+// every second while the store is full. Its caller holds mu.
+func (s *MemorySharedStore) put(key string, v memoryValue, now time.Time) error {
+	if s.values == nil {
+		s.values = map[string]memoryValue{}
+	}
+	_, ok := s.values[key]
+	full := !ok && s.MaxEntries > 0 && len(s.values) >= s.MaxEntries
+	// Sweeping at most every second when full bounds the work a flood
+	// makes.
+	if now.Sub(s.lastSweep) >= memoryStoreSweepInterval || full && now.Sub(s.lastSweep) >= time.Second {
+		for k, old := range s.values {
+			if old.expired(now) {
+				s.remove(k, "expired")
+			}
+		}
+		s.lastSweep = now
+		_, ok = s.values[key]
+		full = !ok && s.MaxEntries > 0 && len(s.values) >= s.MaxEntries
+	}
+	if full {
+		return errSharedStoreFull
+	}
+	if !ok {
+		tableEntries.Inc("shared_values")
+	}
+	s.values[key] = v
+	return nil
+}
+
+// remove removes a value. Its caller holds mu.
+func (s *MemorySharedStore) remove(key, reason string) {
+	if _, ok := s.values[key]; !ok {
+		return
+	}
+	delete(s.values, key)
+	tableEntries.Dec("shared_values")
+	if reason != "" {
+		tableEvictions.Inc("shared_values", reason)
+	}
+}
+
+// redisSharedPrefix prefixes every key written by a RedisSharedStore.
+const redisSharedPrefix = "lb:"
+
+// RedisSharedStore is a SharedStore shared by every LB instance using the
+// same Redis server, keeping the values under "lb:<key>".
+type RedisSharedStore struct {
+	client *RedisClient
+}
+
+// NewRedisSharedStore creates a store backed by client.
+func NewRedisSharedStore(client *RedisClient) *RedisSharedStore {
+	return &RedisSharedStore{client: client}
+}
+
+// Get implements SharedStore.
+func (s *RedisSharedStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := s.client.Do(ctx, "GET", redisSharedPrefix+key)
+	if errors.Is(err, errRedisNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	str, _ := v.(string)
+	return []byte(str), true, nil
+}
+
+// Set implements SharedStore.
+func (s *RedisSharedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", redisSharedPrefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := s.client.Do(ctx, args...)
+	return err
+}
+
+// Delete implements SharedStore.
+func (s *RedisSharedStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Do(ctx, "DEL", redisSharedPrefix+key)
+	return err
+}
+
+// redisIncrScript adds ARGV[1] to the counter KEYS[1] and, if it creates
+// it, makes it expire after ARGV[2] milliseconds unless that is zero. Run as
+// one script, no failure between the two commands can leave a new counter
+// without its expiry.
+const redisIncrScript = `local created = redis.call('EXISTS', KEYS[1]) == 0
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if created and ARGV[2] ~= '0' then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// Incr implements SharedStore.
+func (s *RedisSharedStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	var ms int64
+	if ttl > 0 {
+		ms = max(ttl.Milliseconds(), 1)
+	}
+	v, err := s.client.Do(ctx, "EVAL", redisIncrScript, "1", redisSharedPrefix+key, strconv.FormatInt(delta, 10), strconv.FormatInt(ms, 10))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := v.(int64)
+	return n, nil
+}
+
+// defaultSharedEtcdPrefix is the prefix of the keys of an EtcdSharedStore
+// built from a configuration without one.
+const defaultSharedEtcdPrefix = "/lb/"
+
+// etcdIncrAttempts bounds the compare-and-swap rounds of an Incr of an
+// EtcdSharedStore that other instances keep racing.
+const etcdIncrAttempts = 10
+
+// EtcdSharedStore is a SharedStore keeping the values under an etcd prefix,
+// through the etcd v3 JSON gateway. Values with a ttl are attached to a
+// lease of twice the ttl, shared by those set while it has more than ttl
+// left, so that they expire between ttl and twice the ttl after being set
+// without a lease granted for every one.
+type EtcdSharedStore struct {
+	etcd *EtcdDiscoverer
+
+	mu sync.Mutex
+	// leases holds the lease values set with a ttl of a given number of
+	// seconds are attached to.
+	leases map[int64]etcdLease
+}
+
+type etcdLease struct {
+	id      int64
+	granted time.Time
+}
+
+// NewEtcdSharedStore creates an EtcdSharedStore for the keys under prefix
+// of the etcd cluster at endpoints. Username and Password authenticate to
+// it.
+func NewEtcdSharedStore(endpoints []string, prefix, username, password string) (*EtcdSharedStore, error) {
+	etcd, err := NewEtcdDiscoverer(endpoints, prefix)
+	if err != nil {
+		return nil, err
+	}
+	etcd.Username, etcd.Password = username, password
+	return &EtcdSharedStore{etcd: etcd, leases: map[int64]etcdLease{}}, nil
+}
+
+func (s *EtcdSharedStore) key(key string) []byte {
+	return []byte(s.etcd.Prefix + key)
+}
+
+// lease returns the lease to attach a value set with ttl to, or 0 for none.
+func (s *EtcdSharedStore) lease(ctx context.Context, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, nil
+	}
+	secs := int64(max((ttl+time.Second-1)/time.Second, 1))
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[secs]; ok && now.Sub(l.granted) < time.Duration(secs)*time.Second {
+		return l.id, nil
+	}
+	var resp struct {
+		ID int64 `json:"ID,string"`
+	}
+	if err := s.etcd.rpc(ctx, "/v3/lease/grant", map[string]any{"TTL": strconv.FormatInt(2*secs, 10)}, &resp); err != nil {
+		return 0, err
+	}
+	s.leases[secs] = etcdLease{id: resp.ID, granted: now}
+	return resp.ID, nil
+}
+
+// Get implements SharedStore.
+func (s *EtcdSharedStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	kv, err := s.get(ctx, key)
+	if err != nil || kv == nil {
+		return nil, false, err
+	}
+	return kv.Value, true, nil
+}
+
+func (s *EtcdSharedStore) get(ctx context.Context, key string) (*etcdKV, error) {
+	var resp struct {
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if err := s.etcd.rpc(ctx, "/v3/kv/range", map[string]any{"key": s.key(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return &resp.Kvs[0], nil
+}
+
+// Set implements SharedStore.
+func (s *EtcdSharedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	lease, err := s.lease(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	var resp struct{}
+	return s.etcd.rpc(ctx, "/v3/kv/put", map[string]any{"key": s.key(key), "value": value, "lease": strconv.FormatInt(lease, 10)}, &resp)
+}
+
+// Delete implements SharedStore.
+func (s *EtcdSharedStore) Delete(ctx context.Context, key string) error {
+	var resp struct{}
+	return s.etcd.rpc(ctx, "/v3/kv/deleterange", map[string]any{"key": s.key(key)}, &resp)
+}
+
+// Incr implements SharedStore. It reads the counter and writes it back
+// unless another instance changed it in between, in which case it tries
+// again.
+func (s *EtcdSharedStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	for range etcdIncrAttempts {
+		kv, err := s.get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		compare := map[string]any{"key": s.key(key), "target": "CREATE", "create_revision": "0"}
+		put := map[string]any{"key": s.key(key)}
+		if kv != nil {
+			if n, err = strconv.ParseInt(string(kv.Value), 10, 64); err != nil {
+				return 0, fmt.Errorf("value of %q is not an integer", key)
+			}
+			compare = map[string]any{"key": s.key(key), "target": "MOD", "mod_revision": strconv.FormatInt(kv.ModRevision, 10)}
+			put["ignore_lease"] = true
+		} else {
+			lease, err := s.lease(ctx, ttl)
+			if err != nil {
+				return 0, err
+			}
+			put["lease"] = strconv.FormatInt(lease, 10)
+		}
+		n += delta
+		put["value"] = strconv.AppendInt(nil, n, 10)
+		var resp struct {
+			Succeeded bool `json:"succeeded"`
+		}
+		err = s.etcd.rpc(ctx, "/v3/kv/txn", map[string]any{
+			"compare": []any{compare},
+			"success": []any{map[string]any{"request_put": put}},
+		}, &resp)
+		if err != nil {
+			return 0, err
+		}
+		if resp.Succeeded {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("etcd: %q changed by others %d times in a row", key, etcdIncrAttempts)
+}
@@ -0,0 +1,113 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMemorySharedStoreFull checks that a full store refuses new keys
+// rather than evict live counters, and takes them again once some expired.
+func TestMemorySharedStoreFull(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemorySharedStore()
+	s.MaxEntries = 2
+	if _, err := s.Incr(ctx, "a", 1, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Incr(ctx, "b", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Incr(ctx, "c", 1, 0); !errors.Is(err, errSharedStoreFull) {
+		t.Errorf("Incr of a third key: %v, want %v", err, errSharedStoreFull)
+	}
+	if err := s.Set(ctx, "c", []byte("x"), 0); !errors.Is(err, errSharedStoreFull) {
+		t.Errorf("Set of a third key: %v, want %v", err, errSharedStoreFull)
+	}
+	if n, err := s.Incr(ctx, "b", 1, 0); err != nil || n != 2 {
+		t.Errorf("Incr of a live counter: %d, %v; want 2", n, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	// Sweeps run at most every second while the store is full.
+	s.lastSweep = time.Time{}
+	if n, err := s.Incr(ctx, "c", 1, 0); err != nil || n != 1 {
+		t.Errorf("Incr once a counter expired: %d, %v; want 1", n, err)
+	}
+	if n, err := s.Incr(ctx, "b", 1, 0); err != nil || n != 3 {
+		t.Errorf("Incr of b: %d, %v; want 3", n, err)
+	}
+}
+
+// TestRedisSharedStoreIncr checks that Incr counts and sets the expiry of
+// a counter in one script.
+func TestRedisSharedStoreIncr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			args, err := readRESPCommand(r)
+			if err != nil {
+				return
+			}
+			commands <- args
+			fmt.Fprintf(conn, ":5\r\n")
+		}
+	}()
+	s := NewRedisSharedStore(NewRedisClient(ln.Addr().String(), "", 0))
+	n, err := s.Incr(context.Background(), "quota:a", 2, 1500*time.Millisecond)
+	if err != nil || n != 5 {
+		t.Fatalf("Incr: %d, %v; want 5", n, err)
+	}
+	want := []string{"EVAL", redisIncrScript, "1", "lb:quota:a", "2", "1500"}
+	if got := <-commands; !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// readRESPCommand reads a command sent as a RESP array of bulk strings.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
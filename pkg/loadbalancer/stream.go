@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var streamedBytes = metrics.NewCounterVec("lb_streamed_bytes_total",
+	"Bytes of request and response bodies proxied over HTTP, by pool and direction: upload or download.", "pool", "direction")
+
+// Stream marks a route as serving streaming responses, such as chunked
+// streaming APIs: response data is flushed to the client FlushInterval after
+// it arrives from the backend, or immediately if FlushInterval is zero.
+// Request bodies of the route keep streaming to the backend after it has
+// started answering, as bidirectional streaming APIs need.
+//
+// Bodies of every route are streamed through the load balancer rather than
+// held in memory whatever their size; only caches, mirrors and WAF rules
+// inspecting bodies keep a bounded part of them.
+type Stream struct {
+	FlushInterval time.Duration
+}
+
+// isStreamingResponse reports whether a response with header h is an event
+// stream, which is always flushed immediately.
+func isStreamingResponse(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// streamWriter flushes streaming responses as configured and lifts the
+// listener's write deadline for them, so that a write timeout meant for
+// ordinary responses doesn't cut off a long-lived stream. Other responses
+// pass through untouched.
+type streamWriter struct {
+	http.ResponseWriter
+	stream *Stream
+	// rc is held by value, sparing an allocation per request.
+	rc   http.ResponseController
+	pool string
+
+	streaming     bool
+	flushInterval time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+	done  bool
+}
+
+func newStreamWriter(rw http.ResponseWriter, stream *Stream, pool string) *streamWriter {
+	w := &streamWriter{ResponseWriter: rw, stream: stream, rc: *http.NewResponseController(rw), pool: pool}
+	if stream != nil {
+		// HTTP/1.x stops reading the request body once the response starts
+		// otherwise; protocols that can't do both keep doing so.
+		w.rc.EnableFullDuplex()
+	}
+	return w
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if code >= 200 && !w.streaming {
+		switch {
+		case isStreamingResponse(w.Header()):
+			w.streaming = true
+		case w.stream != nil:
+			w.streaming = true
+			w.flushInterval = w.stream.FlushInterval
+		}
+		if w.streaming {
+			w.rc.SetWriteDeadline(time.Time{})
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if !w.streaming {
+		n, err := w.ResponseWriter.Write(b)
+		streamedBytes.Add(int64(n), w.pool, "download")
+		return n, err
+	}
+	// Delayed flushes run on their own goroutine.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.ResponseWriter.Write(b)
+	streamedBytes.Add(int64(n), w.pool, "download")
+	if err != nil {
+		return n, err
+	}
+	if w.flushInterval <= 0 {
+		w.rc.Flush()
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(w.flushInterval, w.delayedFlush)
+	}
+	return n, nil
+}
+
+func (w *streamWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer = nil
+	if !w.done {
+		w.rc.Flush()
+	}
+}
+
+// Flush sends buffered data to the client, or schedules it if the stream
+// has a flush interval.
+func (w *streamWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.streaming && w.flushInterval > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.flushInterval, w.delayedFlush)
+		}
+		return
+	}
+	w.rc.Flush()
+}
+
+// stop cancels a pending delayed flush once the response is complete.
+func (w *streamWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countedBody counts the bytes of a request body read by the proxy as they
+// are uploaded to a server of pool.
+type countedBody struct {
+	io.ReadCloser
+	pool string
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		streamedBytes.Add(int64(n), b.pool, "upload")
+	}
+	return n, err
+}
@@ -0,0 +1,594 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var strictRejected = metrics.NewCounterVec("lb_strict_parsing_rejected_total",
+	"Requests rejected by strict parsing, by reason.", "reason")
+
+// Defaults of the StrictParsing limits.
+const (
+	defaultStrictMaxHeaderBytes = 64 << 10
+	defaultStrictMaxHeaders     = 100
+)
+
+// strictMaxChunkLine bounds the line of a chunk's size and extensions.
+const strictMaxChunkLine = 4096
+
+// strictRejectedHead replaces the head of a rejected request, for the
+// server to hand strictRejections a request to answer.
+const strictRejectedHead = "GET / HTTP/1.1\r\nHost: rejected.invalid\r\nConnection: close\r\n\r\n"
+
+var errStrictBody = errors.New("strict parsing: malformed chunked body")
+
+// StrictParsing checks the HTTP/1 requests of cleartext connections as their
+// bytes arrive, before the server parses them, rejecting those that peers
+// may frame differently, which could smuggle requests past a proxy in front
+// of the load balancer or through it:
+//
+//   - lines not ended by CRLF, header lines folded or with whitespace before
+//     their colon, and control characters in the request line or headers;
+//   - several Content-Length or Transfer-Encoding headers, or both,
+//     Content-Length values that are not plain numbers, transfer codings
+//     other than chunked, and any on HTTP/1.0;
+//   - several Host headers, or none on HTTP/1.1;
+//   - chunk sizes that are not plain hexadecimal, and chunks not ended by
+//     CRLF.
+//
+// Rejected requests are answered 400, or 431 if their head exceeds
+// MaxHeaderBytes, 64 KiB by default, or MaxHeaders headers, 100 by default,
+// and their connection is closed; a malformed chunked body fails the
+// request it belongs to. Connections speaking HTTP/2, or upgraded to
+// another protocol, are passed on unchecked from then on: requests asking
+// for an upgrade, or CONNECT requests, hold up the bytes after them until
+// they were answered 101 or their connection hijacked, and if they were
+// not, those bytes are checked as the next request. Up to MaxHeaderBytes
+// of them are held up; past it, the connection fails. Over TLS the server
+// reads requests itself, rejecting most of the above and normalizing the
+// rest, and only the limits apply.
+//
+// Requests are forwarded as the proxy writes them afresh, whatever framing
+// they arrived with.
+type StrictParsing struct {
+	MaxHeaderBytes int
+	MaxHeaders     int
+}
+
+// NewStrictParsing creates a StrictParsing with the default limits.
+func NewStrictParsing() *StrictParsing {
+	return &StrictParsing{MaxHeaderBytes: defaultStrictMaxHeaderBytes, MaxHeaders: defaultStrictMaxHeaders}
+}
+
+// Listen wraps ln so that the requests of its connections are checked. The
+// server of ln must answer them with strictRejections.
+func (s *StrictParsing) Listen(ln net.Listener) net.Listener {
+	return &strictListener{Listener: ln, strict: s}
+}
+
+type strictListener struct {
+	net.Listener
+	strict *StrictParsing
+}
+
+func (l *strictListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictConn{Conn: conn, strict: l.strict, buf: make([]byte, 4096)}, nil
+}
+
+// Parsing states of a strictConn.
+const (
+	strictHead = iota
+	strictBody
+	strictChunkSize
+	strictChunkData
+	strictChunkEnd
+	strictTrailers
+	strictUpgrade
+	strictPassthrough
+	strictDone
+)
+
+// Outcomes of a request asking for an upgrade, as its handler finds out.
+const (
+	upgradeNone = iota
+	upgradePending
+	upgradeDone
+	upgradeRefused
+)
+
+// strictRejection is the request a strictConn rejected, after the requests
+// it let through.
+type strictRejection struct {
+	after  int64
+	reason string
+	status int
+}
+
+// strictConn checks the requests read from it, passing on only what it
+// checked. Reads happen one at a time, as the server makes them.
+type strictConn struct {
+	net.Conn
+	strict *StrictParsing
+
+	buf       []byte
+	in        []byte // read, not yet checked
+	out       []byte // checked, not yet passed on
+	err       error
+	state     int
+	remaining int64 // of a body or chunk
+	heads     int64 // passed on
+	trailers  int
+
+	rejection atomic.Pointer[strictRejection]
+	served    atomic.Int64
+	// upgrade is the outcome of the request asking for an upgrade the
+	// connection waits on, if any.
+	upgrade atomic.Int32
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.state == strictUpgrade && c.settle() {
+			continue
+		}
+		if c.state == strictPassthrough {
+			if len(c.in) > 0 {
+				c.out, c.in = c.in, nil
+				break
+			}
+			return c.Conn.Read(p)
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		// Errors are the server's to handle, and it makes some on purpose,
+		// with deadlines, to stop reading: they are not kept.
+		n, err := c.Conn.Read(c.buf)
+		if c.state == strictDone {
+			// What follows a rejected request is discarded, until the
+			// server closes the connection.
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.in = append(c.in, c.buf[:n]...)
+		c.check()
+		if c.state == strictUpgrade && len(c.in) > c.strict.MaxHeaderBytes {
+			c.fail("upgrade_early_data")
+			return 0, c.err
+		}
+		if err != nil && len(c.out) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// settle moves on from waiting on the request asking for an upgrade once
+// its handler found out whether it took place, and reports whether it did
+// move on.
+func (c *strictConn) settle() bool {
+	switch c.upgrade.Load() {
+	case upgradeDone:
+		c.state = strictPassthrough
+	case upgradeRefused:
+		c.upgrade.Store(upgradeNone)
+		c.state = strictHead
+		c.check()
+	default:
+		return false
+	}
+	return true
+}
+
+// endRequest moves on to the next request once the one at hand was passed
+// on, or to waiting on it if it asks for an upgrade.
+func (c *strictConn) endRequest() {
+	if c.upgrade.Load() == upgradePending {
+		c.state = strictUpgrade
+	} else {
+		c.state = strictHead
+	}
+}
+
+// pass passes on the next n bytes read.
+func (c *strictConn) pass(n int) {
+	c.out = append(c.out, c.in[:n]...)
+	c.in = c.in[n:]
+}
+
+// check passes on what can be of the bytes read.
+func (c *strictConn) check() {
+	for len(c.in) > 0 {
+		switch c.state {
+		case strictHead:
+			if !c.checkHead() {
+				return
+			}
+		case strictBody, strictChunkData:
+			n := min(int64(len(c.in)), c.remaining)
+			c.pass(int(n))
+			if c.remaining -= n; c.remaining > 0 {
+				return
+			}
+			if c.state == strictBody {
+				c.endRequest()
+			} else {
+				c.state = strictChunkEnd
+			}
+		case strictChunkEnd:
+			if len(c.in) < 2 {
+				return
+			}
+			if c.in[0] != '\r' || c.in[1] != '\n' {
+				c.fail("malformed_chunk")
+				return
+			}
+			c.pass(2)
+			c.state = strictChunkSize
+		case strictChunkSize:
+			n := c.line(strictMaxChunkLine)
+			if n <= 0 {
+				if n < 0 {
+					c.fail("malformed_chunk")
+				}
+				return
+			}
+			size, ok := parseStrictChunkSize(c.in[:n-2])
+			if !ok {
+				c.fail("malformed_chunk")
+				return
+			}
+			c.pass(n)
+			if size == 0 {
+				c.state, c.trailers = strictTrailers, 0
+			} else {
+				c.state, c.remaining = strictChunkData, size
+			}
+		case strictTrailers:
+			n := c.line(c.strict.MaxHeaderBytes)
+			if n <= 0 {
+				if n < 0 {
+					c.fail("malformed_trailer")
+				}
+				return
+			}
+			if n > 2 {
+				c.trailers++
+				if _, _, reason := checkStrictField(c.in[:n-2]); reason != "" || c.trailers > c.strict.MaxHeaders {
+					c.fail("malformed_trailer")
+					return
+				}
+			} else {
+				c.endRequest()
+			}
+			c.pass(n)
+		default:
+			return
+		}
+	}
+}
+
+// line returns the length, CRLF included, of the line starting the bytes
+// read, 0 if it is incomplete, or -1 if it is malformed or longer than
+// limit.
+func (c *strictConn) line(limit int) int {
+	i := bytes.IndexByte(c.in, '\n')
+	switch {
+	case i < 0 && len(c.in) > limit:
+		return -1
+	case i < 0:
+		return 0
+	case i == 0 || c.in[i-1] != '\r' || i >= limit:
+		return -1
+	}
+	return i + 1
+}
+
+// checkHead checks the head of the next request and reports whether it was
+// passed on.
+func (c *strictConn) checkHead() bool {
+	// Some clients end bodies with an extra CRLF, which servers ignore.
+	for len(c.in) >= 2 && c.in[0] == '\r' && c.in[1] == '\n' {
+		c.in = c.in[2:]
+	}
+	end := bytes.Index(c.in, []byte("\r\n\r\n"))
+	if end < 0 {
+		switch {
+		case len(c.in) > c.strict.MaxHeaderBytes:
+			c.reject("header_too_large", http.StatusRequestHeaderFieldsTooLarge)
+		case bareLineEnding(bytes.TrimSuffix(c.in, []byte("\r"))):
+			// The head may never end with CRLF CRLF.
+			c.reject("line_ending", http.StatusBadRequest)
+		}
+		return false
+	}
+	switch {
+	case end+4 > c.strict.MaxHeaderBytes:
+		c.reject("header_too_large", http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	case bareLineEnding(c.in[:end]):
+		c.reject("line_ending", http.StatusBadRequest)
+		return false
+	}
+	lines := bytes.Split(c.in[:end], []byte("\r\n"))
+	if string(lines[0]) == "PRI * HTTP/2.0" {
+		c.state = strictPassthrough
+		return false
+	}
+	method, version, reason := checkStrictRequestLine(lines[0])
+	if reason != "" {
+		c.reject(reason, http.StatusBadRequest)
+		return false
+	}
+	var contentLengths, transferEncodings, hosts int
+	var length int64
+	upgrade, hasUpgrade := false, false
+	for i, line := range lines[1:] {
+		if i >= c.strict.MaxHeaders {
+			c.reject("too_many_headers", http.StatusRequestHeaderFieldsTooLarge)
+			return false
+		}
+		name, value, reason := checkStrictField(line)
+		if reason != "" {
+			c.reject(reason, http.StatusBadRequest)
+			return false
+		}
+		switch http.CanonicalHeaderKey(string(name)) {
+		case "Content-Length":
+			contentLengths++
+			if length, reason = parseStrictContentLength(value); reason != "" {
+				c.reject(reason, http.StatusBadRequest)
+				return false
+			}
+		case "Transfer-Encoding":
+			transferEncodings++
+			if !bytes.EqualFold(value, []byte("chunked")) {
+				c.reject("unsupported_transfer_encoding", http.StatusBadRequest)
+				return false
+			}
+		case "Host":
+			hosts++
+		case "Connection":
+			for _, token := range bytes.Split(value, []byte(",")) {
+				upgrade = upgrade || bytes.EqualFold(bytes.Trim(token, " \t"), []byte("upgrade"))
+			}
+		case "Upgrade":
+			hasUpgrade = true
+		}
+	}
+	switch {
+	case contentLengths > 1:
+		reason = "duplicate_content_length"
+	case transferEncodings > 1:
+		reason = "duplicate_transfer_encoding"
+	case transferEncodings > 0 && contentLengths > 0:
+		reason = "content_length_with_transfer_encoding"
+	case transferEncodings > 0 && version == "HTTP/1.0":
+		reason = "transfer_encoding_http10"
+	case hosts > 1:
+		reason = "duplicate_host"
+	case hosts == 0 && version == "HTTP/1.1":
+		reason = "missing_host"
+	}
+	if reason != "" {
+		c.reject(reason, http.StatusBadRequest)
+		return false
+	}
+	c.pass(end + 4)
+	c.heads++
+	if method == http.MethodConnect || (upgrade && hasUpgrade) {
+		c.upgrade.Store(upgradePending)
+	}
+	switch {
+	case transferEncodings > 0:
+		c.state = strictChunkSize
+	case length > 0:
+		c.state, c.remaining = strictBody, length
+	default:
+		c.endRequest()
+	}
+	return true
+}
+
+// reject replaces the request at hand, and everything after it, with one
+// for strictRejections to answer.
+func (c *strictConn) reject(reason string, status int) {
+	strictRejected.Inc(reason)
+	c.rejection.Store(&strictRejection{after: c.heads, reason: reason, status: status})
+	c.out = append(c.out, strictRejectedHead...)
+	c.in, c.state = nil, strictDone
+}
+
+// fail fails the body at hand.
+func (c *strictConn) fail(reason string) {
+	strictRejected.Inc(reason)
+	c.in, c.state, c.err = nil, strictDone, errStrictBody
+}
+
+// bareLineEnding reports whether b has a CR or LF outside of a CRLF.
+func bareLineEnding(b []byte) bool {
+	crlf := bytes.Count(b, []byte("\r\n"))
+	return bytes.Count(b, []byte("\r")) != crlf || bytes.Count(b, []byte("\n")) != crlf
+}
+
+// checkStrictRequestLine checks a request line, returning its method and
+// version, or the reason it is malformed.
+func checkStrictRequestLine(line []byte) (method, version, reason string) {
+	parts := bytes.Split(line, []byte(" "))
+	if len(parts) != 3 || !isToken(parts[0]) || len(parts[1]) == 0 {
+		return "", "", "malformed_request_line"
+	}
+	for _, b := range parts[1] {
+		if b <= ' ' || b == 0x7f {
+			return "", "", "malformed_request_line"
+		}
+	}
+	version = string(parts[2])
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return "", "", "malformed_request_line"
+	}
+	return string(parts[0]), version, ""
+}
+
+// checkStrictField checks a header line, returning its name and value
+// without surrounding whitespace, or the reason it is malformed.
+func checkStrictField(line []byte) (name, value []byte, reason string) {
+	if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		return nil, nil, "obs_fold"
+	}
+	name, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok || !isToken(name) {
+		return nil, nil, "malformed_header"
+	}
+	for _, b := range value {
+		if (b < ' ' && b != '\t') || b == 0x7f {
+			return nil, nil, "control_character"
+		}
+	}
+	return name, bytes.Trim(value, " \t"), ""
+}
+
+// parseStrictContentLength parses a Content-Length of digits only.
+func parseStrictContentLength(v []byte) (int64, string) {
+	if len(v) == 0 || len(v) > 18 {
+		return 0, "invalid_content_length"
+	}
+	var n int64
+	for _, b := range v {
+		if b < '0' || b > '9' {
+			return 0, "invalid_content_length"
+		}
+		n = n*10 + int64(b-'0')
+	}
+	return n, ""
+}
+
+// parseStrictChunkSize parses the size of a chunk, in hexadecimal directly
+// followed by its extensions, if any.
+func parseStrictChunkSize(line []byte) (int64, bool) {
+	size, ext, _ := bytes.Cut(line, []byte(";"))
+	if len(size) == 0 || len(size) > 15 {
+		return 0, false
+	}
+	var n int64
+	for _, b := range size {
+		switch {
+		case '0' <= b && b <= '9':
+			b -= '0'
+		case 'a' <= b && b <= 'f':
+			b -= 'a' - 10
+		case 'A' <= b && b <= 'F':
+			b -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int64(b)
+	}
+	for _, b := range ext {
+		if (b < ' ' && b != '\t') || b == 0x7f {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// isToken reports whether b is a non-empty token of RFC 9110.
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c <= ' ' || c >= 0x7f || bytes.IndexByte([]byte(`"(),/:;<=>?@[\]{}`), c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type strictConnKey struct{}
+
+// withStrictConn is the ConnContext of a server of StrictParsing
+// listeners, giving requests the connection that checked them.
+func withStrictConn(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*strictConn); ok {
+		return context.WithValue(ctx, strictConnKey{}, c)
+	}
+	return ctx
+}
+
+// strictRejections answers the requests standing for those StrictParsing
+// rejected, passes the others to next, and tells the connections of those
+// asking for an upgrade whether it took place. Requests of connections over
+// HTTP/1 are served one at a time, in order.
+func strictRejections(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(strictConnKey{}).(*strictConn); ok {
+			n := c.served.Add(1)
+			if c.upgrade.Load() == upgradePending {
+				w := &strictUpgradeWriter{ResponseWriter: rw, conn: c}
+				defer w.done()
+				rw = w
+			}
+			if rej := c.rejection.Load(); rej != nil && n > rej.after {
+				logf("strict parsing: rejected request %d from %s: %s", n, logIP(clientIP(r)), rej.reason)
+				rw.Header().Set("Connection", "close")
+				msg := "400 bad request: malformed request"
+				if rej.status == http.StatusRequestHeaderFieldsTooLarge {
+					msg = "431 request header fields too large"
+				}
+				httpError(rw, r, msg, rej.status)
+				return
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// strictUpgradeWriter tells the connection of a request asking for an
+// upgrade whether it took place: once answered 101 or hijacked, or else
+// once served.
+type strictUpgradeWriter struct {
+	http.ResponseWriter
+	conn *strictConn
+}
+
+func (w *strictUpgradeWriter) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols {
+		w.conn.upgrade.Store(upgradeDone)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *strictUpgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.conn.upgrade.Store(upgradeDone)
+	}
+	return conn, brw, err
+}
+
+// done tells the connection the upgrade did not take place unless it did.
+func (w *strictUpgradeWriter) done() {
+	w.conn.upgrade.CompareAndSwap(upgradePending, upgradeRefused)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *strictUpgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
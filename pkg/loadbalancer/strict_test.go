@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveStrict serves h behind strict parsing, returning the address to
+// reach it at.
+func serveStrict(t *testing.T, h http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: strictRejections(h), ConnContext: withStrictConn}
+	go srv.Serve(NewStrictParsing().Listen(ln))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// exchange sends raw on a new connection to addr and reads the responses
+// to n requests from it.
+func exchange(t *testing.T, addr, raw string, n int) (*bufio.Reader, net.Conn, []int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	var codes []int
+	for range n {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("reading response %d: %v", len(codes)+1, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+	}
+	return br, conn, codes
+}
+
+func TestStrictParsingRejectsSmuggling(t *testing.T) {
+	addr := serveStrict(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	for name, raw := range map[string]string{
+		"duplicate content length": "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab",
+		"both framings":            "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"bare LF":                  "GET / HTTP/1.1\nHost: a\r\n\r\n",
+		"obs fold":                 "GET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n",
+		"missing host":             "GET / HTTP/1.1\r\n\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, codes := exchange(t, addr, raw, 1); codes[0] != http.StatusBadRequest {
+				t.Errorf("got %d, want 400", codes[0])
+			}
+		})
+	}
+}
+
+// TestStrictParsingRefusedUpgrade checks that a request asking for an
+// upgrade it is not given does not stop the requests after it from being
+// checked.
+func TestStrictParsingRefusedUpgrade(t *testing.T) {
+	addr := serveStrict(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	raw := "GET / HTTP/1.1\r\nHost: a\r\nConnection: upgrade\r\nUpgrade: websocket\r\n\r\n" +
+		// The server would take it, where peers may not.
+		"GET / HTTP/1.1\nHost: a\n\n"
+	_, _, codes := exchange(t, addr, raw, 2)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusBadRequest {
+		t.Errorf("got %v, want [200 400]", codes)
+	}
+}
+
+// TestStrictParsingUpgrade checks that the bytes after a request that was
+// upgraded are passed on unchecked.
+func TestStrictParsingUpgrade(t *testing.T) {
+	addr := serveStrict(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString(line)
+		brw.Flush()
+	}))
+	raw := "GET / HTTP/1.1\r\nHost: a\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n"
+	br, conn, codes := exchange(t, addr, raw, 1)
+	if codes[0] != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d, want 101", codes[0])
+	}
+	// A bare LF would be rejected as HTTP.
+	io.WriteString(conn, "not\rHTTP\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "not\rHTTP\n" {
+		t.Errorf("got %q, %v", line, err)
+	}
+}
+
+func TestStrictParsingChunked(t *testing.T) {
+	addr := serveStrict(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(rw, strings.ToUpper(string(b)))
+	}))
+	raw := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+	if _, _, codes := exchange(t, addr, raw, 2); codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Errorf("got %v, want [200 200]", codes)
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// SwarmDiscoverer yields the running tasks of a Docker Swarm service from the
+// manager's API, so that tasks are balanced individually instead of through
+// the service's virtual IP and the routing mesh. Tasks are reached on their
+// address in Network, or in their only network if Network is empty.
+//
+// Without access to a manager, the tasks.<service> DNS name served by
+// Swarm's embedded DNS can be used instead, through a DNSDiscoverer.
+type SwarmDiscoverer struct {
+	Service string
+	Port    int
+	Network string
+	// Scheme is prepended to the target addresses, as "<scheme>://host:port";
+	// if empty, targets are bare host:port pairs.
+	Scheme string
+
+	api *dockerAPI
+}
+
+// NewSwarmDiscoverer creates a SwarmDiscoverer for the tasks of service
+// listening on port, asking the manager at host as for NewDockerDiscoverer.
+func NewSwarmDiscoverer(host, service string, port int) (*SwarmDiscoverer, error) {
+	if service == "" {
+		return nil, fmt.Errorf("swarm service must not be empty")
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid swarm port %d", port)
+	}
+	api, err := newDockerAPI(host)
+	if err != nil {
+		return nil, err
+	}
+	return &SwarmDiscoverer{Service: service, Port: port, api: api}, nil
+}
+
+// swarmTask is the subset of an entry of /tasks used.
+type swarmTask struct {
+	Status struct {
+		State string `json:"State"`
+	} `json:"Status"`
+	NetworksAttachments []struct {
+		Network struct {
+			Spec struct {
+				Name string `json:"Name"`
+			} `json:"Spec"`
+		} `json:"Network"`
+		Addresses []string `json:"Addresses"`
+	} `json:"NetworksAttachments"`
+}
+
+// Discover implements Discoverer.
+func (d *SwarmDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	body, err := d.api.get(ctx, "/tasks", map[string][]string{
+		"service":       {d.Service},
+		"desired-state": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var tasks []swarmTask
+	if err := json.NewDecoder(body).Decode(&tasks); err != nil {
+		return nil, fmt.Errorf("swarm: %w", err)
+	}
+	var targets []Target
+	for _, task := range tasks {
+		if task.Status.State != "running" {
+			continue
+		}
+		var addrs []string
+		for _, na := range task.NetworksAttachments {
+			if d.Network == "" && len(task.NetworksAttachments) == 1 || na.Network.Spec.Name == d.Network {
+				addrs = na.Addresses
+			}
+		}
+		for _, a := range addrs {
+			// Task addresses are given in CIDR notation.
+			prefix, err := netip.ParsePrefix(a)
+			if err != nil {
+				continue
+			}
+			addr := net.JoinHostPort(prefix.Addr().String(), strconv.Itoa(d.Port))
+			if d.Scheme != "" {
+				addr = d.Scheme + "://" + addr
+			}
+			targets = append(targets, Target{Addr: addr})
+		}
+	}
+	return targets, nil
+}
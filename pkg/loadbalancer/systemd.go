@@ -0,0 +1,26 @@
+package loadbalancer
+
+import "net"
+
+// boundTo reports whether a socket bound to a serves the configured network
+// address addr. A configured address without a host matches any host.
+func boundTo(a net.Addr, network, addr string) bool {
+	if a.Network() != network {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ahost, aport, err := net.SplitHostPort(a.String())
+	if err != nil || aport != port {
+		return false
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return true
+	}
+	if ip, aip := net.ParseIP(host), net.ParseIP(ahost); ip != nil && aip != nil {
+		return ip.Equal(aip)
+	}
+	return host == ahost
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package loadbalancer
+
+import "net"
+
+// systemdSockets returns no sockets: systemd only runs on Linux.
+func systemdSockets() ([]net.Listener, []net.PacketConn) {
+	return nil, nil
+}
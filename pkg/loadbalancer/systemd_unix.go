@@ -0,0 +1,47 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// systemdSockets returns the sockets passed by systemd socket activation, as
+// listeners and packet connections. They are taken by Listen and
+// ListenPacket for the configured addresses they are bound to, so that the
+// load balancer may serve privileged ports without the privilege to bind
+// them. See sd_listen_fds(3).
+func systemdSockets() ([]net.Listener, []net.PacketConn) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var listeners []net.Listener
+	var packetConns []net.PacketConn
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd-"+strconv.Itoa(fd))
+		if ln, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, ln)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packetConns = append(packetConns, pc)
+		} else {
+			logf("Ignoring unsupported socket %d passed by systemd: %v", fd, err)
+		}
+		f.Close()
+	}
+	return listeners, packetConns
+}
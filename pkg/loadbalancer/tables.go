@@ -0,0 +1,15 @@
+package loadbalancer
+
+import "github.com/javvaji888/golang-load-balancer/internal/metrics"
+
+// Metrics of the tables the load balancer keeps in memory, such as
+// affinity pins, the rate limits of clients and cached API keys, each
+// bounded in entries. Tables of several routes or pools share a series.
+// The HTTP cache reports its entries per route in lb_cache_entries, and its
+// evictions here.
+var (
+	tableEntries = metrics.NewGaugeVec("lb_table_entries",
+		"Entries held by in-memory tables, by table.", "table")
+	tableEvictions = metrics.NewCounterVec("lb_table_evictions_total",
+		"Entries evicted from in-memory tables, by table and reason: expired, or capacity to stay within its bound.", "table", "reason")
+)
@@ -0,0 +1,210 @@
+package loadbalancer
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+var (
+	taggedRequests = metrics.NewCounterVec("lb_tagged_requests_total",
+		"Requests served, by tag, its value and the class of the status of their response: 1xx to 5xx.", "tag", "value", "code")
+	taggedBytes = metrics.NewCounterVec("lb_tagged_response_bytes_total",
+		"Bytes of the bodies of the responses to requests, by tag and value.", "tag", "value")
+	taggedDuration = metrics.NewCounterVec("lb_tagged_request_duration_microseconds_total",
+		"Time spent serving requests, by tag and value; over lb_tagged_requests_total, their mean latency.", "tag", "value")
+)
+
+const (
+	defaultTagMaxValues = 100
+	// otherTagValue labels the metrics of the values of a tag past its
+	// first MaxValues.
+	otherTagValue = "other"
+)
+
+// Tag is a tag a request was given and its value.
+type Tag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TagRule gives the tag Name to the requests of Routes, or of all of them
+// if empty, including those no route matches. Its value is Value, or else
+// that of the header Header, the name of the consumer of the API key
+// authenticating the request if APIKey is set, or the bucket of the
+// experiment of its route it was assigned to if Experiment is set. Requests
+// it finds no value for, such as those without the header, are not given
+// the tag by the rule.
+type TagRule struct {
+	Name       string
+	Routes     []string
+	Value      string
+	Header     string
+	APIKey     bool
+	Experiment bool
+}
+
+// value returns the value the rule gives the tag of the request t is the
+// tags of, or "".
+func (tr *TagRule) value(t *requestTags) string {
+	if len(tr.Routes) > 0 && (!t.routed || !slices.Contains(tr.Routes, t.route)) {
+		return ""
+	}
+	switch {
+	case tr.Value != "":
+		return tr.Value
+	case tr.Header != "":
+		return t.r.Header.Get(tr.Header)
+	case tr.APIKey:
+		return t.consumer
+	case tr.Experiment:
+		return t.bucket
+	}
+	return ""
+}
+
+// Tagger tags requests by rules, for traffic to be broken down by customer,
+// feature or any other tag: the tags of a request label the lb_tagged_*
+// metrics, counting the requests, the bytes of their responses and the time
+// serving them took, and are fields of the access log. The rules are tried
+// in order, the first of those giving a tag a value setting it. Metrics
+// are labeled with the first MaxValues values of each tag only, those past
+// them with "other", so that values from headers do not grow their series
+// without bound; the access log has them all.
+type Tagger struct {
+	Rules     []TagRule
+	MaxValues int
+}
+
+// NewTagger creates a tagger with rules, labeling metrics with up to 100
+// values of each tag.
+func NewTagger(rules []TagRule) *Tagger {
+	return &Tagger{Rules: rules, MaxValues: defaultTagMaxValues}
+}
+
+// tagValues are the values of each tag labeling metrics so far. They
+// outlive the taggers, replaced on reloads, as the series of the metrics
+// do.
+var tagValues = struct {
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}{seen: map[string]map[string]bool{}}
+
+// label returns the value of the tag name labeling metrics for value.
+func (t *Tagger) label(name, value string) string {
+	tagValues.mu.Lock()
+	defer tagValues.mu.Unlock()
+	seen := tagValues.seen[name]
+	if seen[value] {
+		return value
+	}
+	if len(seen) >= t.MaxValues {
+		return otherTagValue
+	}
+	if seen == nil {
+		seen = map[string]bool{}
+		tagValues.seen[name] = seen
+	}
+	seen[value] = true
+	return value
+}
+
+// requestTags is what the rules of a tagger tag a request by, as serving
+// it finds out, and its tags once resolved.
+type requestTags struct {
+	tagger *Tagger
+	r      *http.Request
+	// route is the name of the route matched, if routed.
+	route    string
+	routed   bool
+	consumer string
+	bucket   string
+
+	tags     []Tag
+	resolved bool
+}
+
+type requestTagsKey struct{}
+
+// tagsOf returns the tags of r, or nil unless a tagger tags it.
+func tagsOf(r *http.Request) *requestTags {
+	t, _ := r.Context().Value(requestTagsKey{}).(*requestTags)
+	return t
+}
+
+// resolve returns the tags of the request, applying the rules of the
+// tagger the first time: once the request is forwarded, or else served.
+func (t *requestTags) resolve() []Tag {
+	if !t.resolved {
+		t.resolved = true
+		for _, tr := range t.tagger.Rules {
+			if slices.ContainsFunc(t.tags, func(tag Tag) bool { return tag.Name == tr.Name }) {
+				continue
+			}
+			if v := tr.value(t); v != "" {
+				t.tags = append(t.tags, Tag{Name: tr.Name, Value: v})
+			}
+		}
+	}
+	return t.tags
+}
+
+// wrap returns the ResponseWriter and request to serve r with and a
+// function counting it in the metrics of its tags once it was served, or
+// rw, r and nil if t is nil.
+func (t *Tagger) wrap(rw http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	if t == nil {
+		return rw, r, nil
+	}
+	rt := &requestTags{tagger: t}
+	r = r.WithContext(context.WithValue(r.Context(), requestTagsKey{}, rt))
+	rt.r = r
+	rec := &accessRecorder{ResponseWriter: rw}
+	start := time.Now()
+	return rec, r, func() {
+		tags := rt.resolve()
+		if len(tags) == 0 {
+			return
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status/100) + "xx"
+		us := time.Since(start).Microseconds()
+		for _, tag := range tags {
+			v := t.label(tag.Name, tag.Value)
+			taggedRequests.Inc(tag.Name, v, code)
+			taggedBytes.Add(rec.bytes, tag.Name, v)
+			taggedDuration.Add(us, tag.Name, v)
+		}
+	}
+}
+
+// tagsAttr returns the tags as a group of the access log, such as
+// tags.customer=acme.
+func tagsAttr(tags []Tag) slog.Attr {
+	attrs := make([]any, len(tags))
+	for i, tag := range tags {
+		attrs[i] = slog.String(tag.Name, tag.Value)
+	}
+	return slog.Group("tags", attrs...)
+}
+
+// Tagger returns the tagger of the load balancer, or nil if it tags no
+// requests.
+func (lb *LoadBalancer) Tagger() *Tagger {
+	return lb.tagger
+}
+
+// SetTagger makes the load balancer tag requests with t; nil stops tagging
+// them.
+func (lb *LoadBalancer) SetTagger(t *Tagger) {
+	lb.tagger = t
+}
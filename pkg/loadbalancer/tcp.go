@@ -0,0 +1,366 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// ProtocolTCP pools hold plain TCP servers, forwarded to by TCP proxies
+// without any HTTP parsing.
+const ProtocolTCP = "tcp"
+
+const defaultTCPDialTimeout = 5 * time.Second
+
+var (
+	tcpConnections = metrics.NewGaugeVec("lb_tcp_connections",
+		"TCP connections currently proxied.", "listener", "pool")
+	tcpConnectionsTotal = metrics.NewCounterVec("lb_tcp_connections_total",
+		"TCP connections accepted.", "listener", "pool")
+	tcpDialErrors = metrics.NewCounterVec("lb_tcp_dial_errors_total",
+		"Failed connection attempts to TCP servers.", "pool", "server")
+)
+
+// NetServer is a Server reached over plain TCP or UDP, used by layer-4
+// proxies. Its address is host:port, optionally prefixed with tcp:// or udp://.
+// Stream servers may also listen on a Unix domain socket, unix:///path.
+type NetServer struct {
+	backend.Weighting
+	backend.Counters
+	adminState
+
+	network string
+	addr    string
+	dead    atomic.Bool
+
+	// ProxyProtocol is the PROXY protocol version sent on connections to
+	// the server, or zero.
+	ProxyProtocol int
+}
+
+// NewTCPServer creates a NetServer reached over TCP at addr, or over the
+// Unix domain socket addr names.
+func NewTCPServer(addr string) (*NetServer, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("unix socket address %q has no path", addr)
+		}
+		s := &NetServer{network: "unix", addr: path}
+		s.SetWeight(1)
+		return s, nil
+	}
+	return newNetServer("tcp", addr)
+}
+
+func newNetServer(network, addr string) (*NetServer, error) {
+	hostport := strings.TrimPrefix(addr, network+"://")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return nil, err
+	}
+	s := &NetServer{network: network, addr: hostport}
+	s.SetWeight(1)
+	return s, nil
+}
+
+// Network returns "tcp", "unix" or "udp".
+func (s *NetServer) Network() string {
+	return s.network
+}
+
+// Address returns the server address.
+func (s *NetServer) Address() string {
+	return s.addr
+}
+
+// IsAlive reports the health of the server as last observed by its pool's health check.
+func (s *NetServer) IsAlive() bool {
+	return !s.dead.Load()
+}
+
+// SetAlive records the outcome of a health check.
+func (s *NetServer) SetAlive(alive bool) {
+	s.dead.Store(!alive)
+}
+
+// Serve rejects HTTP requests; layer-4 servers are only used by TCP and UDP proxies.
+func (s *NetServer) Serve(rw http.ResponseWriter, r *http.Request) {
+	http.Error(rw, "pool does not serve HTTP", http.StatusBadGateway)
+}
+
+// TCPProxy forwards every connection accepted on Addr to a server of Pool,
+// chosen by the pool's strategy among the servers passing health checks.
+// If a server can't be reached the next one is tried.
+type TCPProxy struct {
+	Name        string
+	Addr        string
+	Pool        *Pool
+	DialTimeout time.Duration
+	// IdleTimeout closes connections without traffic in either direction
+	// for that long; zero never does.
+	IdleTimeout time.Duration
+	// ProxyProtocol, if set, reads a PROXY header on inbound connections.
+	ProxyProtocol *ProxyProtocol
+	// IPFilter, if set, closes the connections of denied clients.
+	IPFilter *IPFilter
+	// Socket, if set, tunes the sockets of both the client and the server
+	// connections.
+	Socket *SocketOptions
+	// Egress, if set, caps the bandwidth sent to the clients.
+	Egress *Shaper
+
+	// logger is that of the load balancer the proxy was added to.
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	// conns maps the active connections to the cancellation of their
+	// dialing.
+	conns  map[net.Conn]context.CancelFunc
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ErrProxyClosed is returned by the Serve methods of the layer-4 proxies
+// after they have been shut down.
+var ErrProxyClosed = errors.New("proxy closed")
+
+// NewTCPProxy creates a TCPProxy. A zero dialTimeout means 5 seconds.
+func NewTCPProxy(name, addr string, pool *Pool, dialTimeout, idleTimeout time.Duration) *TCPProxy {
+	if dialTimeout <= 0 {
+		dialTimeout = defaultTCPDialTimeout
+	}
+	return &TCPProxy{Name: name, Addr: addr, Pool: pool, DialTimeout: dialTimeout, IdleTimeout: idleTimeout}
+}
+
+// ListenAndServe listens on the proxy's address and forwards connections
+// until the listener fails.
+func (p *TCPProxy) ListenAndServe() error {
+	ln, err := p.Listen()
+	if err != nil {
+		return err
+	}
+	return p.Serve(ln)
+}
+
+// Listen listens on the proxy's address, to be served by Serve.
+func (p *TCPProxy) Listen() (net.Listener, error) {
+	ln, err := listen("tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = p.Socket.Listen(ln)
+	if p.Egress != nil {
+		ln = p.Egress.Listen(ln)
+	}
+	if p.ProxyProtocol != nil {
+		ln = p.ProxyProtocol.Listen(ln)
+	}
+	return ln, nil
+}
+
+// Serve forwards the connections accepted on ln until ln fails or the proxy
+// is shut down.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	defer ln.Close()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProxyClosed
+	}
+	p.listener = ln
+	p.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.shuttingDown() {
+				return ErrProxyClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *TCPProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	if !p.IPFilter.Allows(addrIP(conn.RemoteAddr())) {
+		ipDenied.Inc(p.Name)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !p.track(conn, cancel) {
+		return
+	}
+	defer p.untrack(conn)
+	tcpConnectionsTotal.Inc(p.Name, p.Pool.Name)
+	upstream, server, err := p.dial(ctx)
+	if err != nil {
+		p.logf(slog.LevelInfo, "%v", err)
+		return
+	}
+	defer upstream.Close()
+	defer server.(*NetServer).Done()
+	if v := server.(*NetServer).ProxyProtocol; v != 0 {
+		if err := writeProxyHeader(upstream, v, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			p.logf(slog.LevelInfo, "%v", err)
+			return
+		}
+	}
+	p.logf(slog.LevelDebug, "forwarding connection from %q to %q of pool %q",
+		logAddr(conn.RemoteAddr()), server.Address(), p.Pool.Name)
+
+	tcpConnections.Inc(p.Name, p.Pool.Name)
+	defer tcpConnections.Dec(p.Name, p.Pool.Name)
+	if s := p.Pool.Egress(); s != nil {
+		conn = s.Conn(conn)
+	}
+	splice(conn, upstream, p.IdleTimeout)
+}
+
+// logf logs a message about the proxy at level.
+func (p *TCPProxy) logf(level slog.Level, format string, args ...any) {
+	logTo(p.logger, level, "TCP proxy %q: "+format, append([]any{p.Name}, args...)...)
+}
+
+// track registers conn as active, unless the proxy is shut down. cancel
+// abandons dialing its server.
+func (p *TCPProxy) track(conn net.Conn, cancel context.CancelFunc) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = map[net.Conn]context.CancelFunc{}
+	}
+	p.conns[conn] = cancel
+	p.wg.Add(1)
+	return true
+}
+
+func (p *TCPProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	p.wg.Done()
+}
+
+func (p *TCPProxy) shuttingDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Shutdown stops accepting connections and waits for the active ones to
+// finish. When ctx is done first, the remaining connections are closed and
+// ctx's error is returned.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn, cancel := range p.conns {
+			cancel()
+			conn.Close()
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// dial connects to the next available server of the pool, trying each
+// server at most once, until ctx is done. The connection is counted by the
+// server it returns until Done is called.
+func (p *TCPProxy) dial(ctx context.Context) (net.Conn, backend.Server, error) {
+	dial := p.Socket.dialContext((&net.Dialer{Timeout: p.DialTimeout}).DialContext)
+	for range len(p.Pool.Servers()) {
+		server := p.Pool.GetNextAvailableServer()
+		if server == nil {
+			break
+		}
+		ns := server.(*NetServer)
+		ns.Start()
+		upstream, err := dial(ctx, ns.Network(), ns.Address())
+		if err == nil {
+			return upstream, server, nil
+		}
+		ns.Done()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		ns.Fail()
+		tcpDialErrors.Inc(p.Pool.Name, server.Address())
+		p.logf(slog.LevelInfo, "dial %q: %v", server.Address(), err)
+	}
+	return nil, nil, fmt.Errorf("no available server in pool %q", p.Pool.Name)
+}
+
+// splice copies between a and b in both directions until both sides are
+// done, propagating half-closes.
+func splice(a, b net.Conn, idle time.Duration) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		buf := copyBuffers.Get()
+		defer copyBuffers.Put(buf)
+		// Hiding dst's ReadFrom makes the copy use buf; the idle reader
+		// rules out splicing anyway.
+		io.CopyBuffer(struct{ io.Writer }{dst}, idleReader{src, idle, a, b}, buf)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// idleReader extends the deadlines of both connections on every read, so
+// that they're closed only after idle without traffic in either direction.
+type idleReader struct {
+	net.Conn
+	idle time.Duration
+	a, b net.Conn
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	if r.idle > 0 {
+		deadline := time.Now().Add(r.idle)
+		r.a.SetDeadline(deadline)
+		r.b.SetDeadline(deadline)
+	}
+	return r.Conn.Read(p)
+}
@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults of the transports to backends that differ from those of
+// http.DefaultTransport, which keeps only 2 idle connections per server and
+// makes busy pools open a new connection for most requests.
+const (
+	defaultMaxIdleConns        = 1024
+	defaultMaxIdleConnsPerHost = 64
+)
+
+// TransportOptions tune the connections a pool keeps to its servers. Zero
+// values keep the defaults: 1024 idle connections, 64 per server, no limit
+// on connections per server, and the timeouts of http.DefaultTransport.
+// A negative KeepAlive disables TCP keep-alive probes; DisableKeepAlives
+// closes connections after every request instead.
+//
+// The addresses of backends named by hostname are cached for DNSCacheTTL,
+// 30 seconds by default, and failed resolutions for DNSNegativeTTL, one
+// second by default; a negative DNSCacheTTL resolves on every new
+// connection.
+//
+// Socket, if set, tunes the sockets of the connections; its keep-alive
+// settings replace KeepAlive.
+//
+// HTTP/2 is negotiated with https servers that support it unless
+// DisableHTTP2 is set, multiplexing the requests to a server over a few
+// connections instead of one connection per request in flight; HTTP2, if
+// set, tunes it.
+type TransportOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableKeepAlives     bool
+	DNSCacheTTL           time.Duration
+	DNSNegativeTTL        time.Duration
+	Socket                *SocketOptions
+	DisableHTTP2          bool
+	HTTP2                 *http.HTTP2Config
+}
+
+// NewTransport creates a transport to backends speaking HTTP/1.1, and
+// HTTP/2 when negotiated over TLS, as http.DefaultTransport does.
+func NewTransport(o TransportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = defaultMaxIdleConns
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	t.MaxConnsPerHost = o.MaxConnsPerHost
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	t.DisableKeepAlives = o.DisableKeepAlives
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if o.KeepAlive != 0 {
+		d.KeepAlive = o.KeepAlive
+	}
+	if o.DialTimeout > 0 {
+		d.Timeout = o.DialTimeout
+	}
+	t.DialContext = d.DialContext
+	if o.DNSCacheTTL >= 0 {
+		ttl, negTTL := defaultDNSCacheTTL, defaultDNSNegativeTTL
+		if o.DNSCacheTTL > 0 {
+			ttl = o.DNSCacheTTL
+		}
+		if o.DNSNegativeTTL > 0 {
+			negTTL = o.DNSNegativeTTL
+		}
+		t.DialContext = newDNSCache(ttl, negTTL).dialContext(d)
+	}
+	t.DialContext = trackConns(o.Socket.dialContext(t.DialContext))
+	if o.DisableHTTP2 {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+	}
+	t.HTTP2 = o.HTTP2
+	return t
+}
+
+// upstream holds the transports of the servers of one or more pools: one
+// for HTTP/1.1, and HTTP/2 over TLS, and one speaking HTTP/2 only, for gRPC
+// and h2c servers. Unless shared, every server gets copies of its own, so
+// that the connections to a slow server, and their limits, are kept apart
+// from those of the others.
+type upstream struct {
+	http   *http.Transport
+	http2  *http.Transport
+	shared bool
+}
+
+// forServer returns the transport for a server, speaking HTTP/2 only if
+// http2 is set, and whether it is the server's own.
+func (up *upstream) forServer(http2 bool) (*http.Transport, bool) {
+	t := up.http
+	if http2 {
+		t = up.http2
+	}
+	if up.shared || t == nil {
+		return t, false
+	}
+	return t.Clone(), true
+}
+
+func newUpstream(o TransportOptions) *upstream {
+	t := NewTransport(o)
+	return &upstream{http: t, http2: newHTTP2Transport(t)}
+}
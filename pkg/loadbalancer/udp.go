@@ -0,0 +1,232 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// ProtocolUDP pools hold UDP servers, forwarded to by UDP proxies.
+const ProtocolUDP = "udp"
+
+const (
+	defaultUDPIdleTimeout = 30 * time.Second
+	maxUDPPacket          = 64 << 10
+)
+
+var (
+	udpFlows = metrics.NewGaugeVec("lb_udp_flows",
+		"Client flows currently tracked by UDP proxies.", "listener", "pool")
+	udpPackets = metrics.NewCounterVec("lb_udp_packets_total",
+		"Datagrams forwarded by UDP proxies.", "listener", "direction")
+	udpDropped = metrics.NewCounterVec("lb_udp_dropped_total",
+		"Datagrams dropped because no server was available.", "listener")
+)
+
+// NewUDPServer creates a NetServer reached over UDP at addr.
+func NewUDPServer(addr string) (*NetServer, error) {
+	return newNetServer("udp", addr)
+}
+
+// UDPProxy forwards datagrams received on Addr to the servers of Pool. Each
+// client address is a flow: the first datagram picks a server with the
+// pool's strategy and later datagrams of the flow go to the same server,
+// whose replies are relayed back to the client. A flow expires after
+// IdleTimeout without datagrams in either direction.
+type UDPProxy struct {
+	Name        string
+	Addr        string
+	Pool        *Pool
+	IdleTimeout time.Duration
+	// IPFilter, if set, drops the datagrams of denied clients.
+	IPFilter *IPFilter
+
+	// logger is that of the load balancer the proxy was added to.
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	flows  map[string]*udpFlow
+	conn   net.PacketConn
+	closed bool
+}
+
+type udpFlow struct {
+	upstream *net.UDPConn
+	server   backend.Server
+
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+// NewUDPProxy creates a UDPProxy. A zero idleTimeout means 30 seconds.
+func NewUDPProxy(name, addr string, pool *Pool, idleTimeout time.Duration) *UDPProxy {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	return &UDPProxy{Name: name, Addr: addr, Pool: pool, IdleTimeout: idleTimeout, flows: map[string]*udpFlow{}}
+}
+
+// ListenAndServe listens on the proxy's address and forwards datagrams
+// until the socket fails.
+func (p *UDPProxy) ListenAndServe() error {
+	pc, err := listenPacket("udp", p.Addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(pc)
+}
+
+// Serve forwards the datagrams received on pc until pc fails or the proxy is
+// closed.
+func (p *UDPProxy) Serve(pc net.PacketConn) error {
+	defer pc.Close()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProxyClosed
+	}
+	p.conn = pc
+	p.mu.Unlock()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !p.IPFilter.Allows(addrIP(client)) {
+			ipDenied.Inc(p.Name)
+			continue
+		}
+		flow, err := p.flow(pc, client)
+		if err != nil {
+			udpDropped.Inc(p.Name)
+			p.logf(slog.LevelInfo, "%v", err)
+			continue
+		}
+		flow.touch()
+		if _, err := flow.upstream.Write(buf[:n]); err != nil {
+			p.logf(slog.LevelInfo, "write to %q: %v", flow.server.Address(), err)
+			continue
+		}
+		udpPackets.Inc(p.Name, "upstream")
+	}
+}
+
+// Close stops the proxy and drops its flows. UDP has no connections to
+// drain, so closing does not wait.
+func (p *UDPProxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, f := range p.flows {
+		f.upstream.Close()
+	}
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
+
+func (p *UDPProxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// flow returns the flow of client, creating it if needed.
+func (p *UDPProxy) flow(pc net.PacketConn, client net.Addr) (*udpFlow, error) {
+	key := client.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.flows[key]; ok {
+		return f, nil
+	}
+	server := p.Pool.GetNextAvailableServer()
+	if server == nil {
+		return nil, fmt.Errorf("no available server in pool %q", p.Pool.Name)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", server.Address())
+	if err != nil {
+		return nil, err
+	}
+	ns := server.(*NetServer)
+	ns.Start()
+	upstream, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		ns.Done()
+		ns.Fail()
+		return nil, err
+	}
+	f := &udpFlow{upstream: upstream, server: server, lastSeen: time.Now()}
+	p.flows[key] = f
+	udpFlows.Inc(p.Name, p.Pool.Name)
+	p.logf(slog.LevelDebug, "forwarding flow from %q to %q of pool %q",
+		logAddr(client), server.Address(), p.Pool.Name)
+	go p.relay(pc, client, key, f)
+	return f, nil
+}
+
+// logf logs a message about the proxy at level.
+func (p *UDPProxy) logf(level slog.Level, format string, args ...any) {
+	logTo(p.logger, level, "UDP proxy %q: "+format, append([]any{p.Name}, args...)...)
+}
+
+// relay copies the replies of the flow's server back to client until the
+// flow has been idle for IdleTimeout.
+func (p *UDPProxy) relay(pc net.PacketConn, client net.Addr, key string, f *udpFlow) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.flows, key)
+		p.mu.Unlock()
+		f.upstream.Close()
+		f.server.(*NetServer).Done()
+		udpFlows.Dec(p.Name, p.Pool.Name)
+	}()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		f.upstream.SetReadDeadline(f.idleDeadline(p.IdleTimeout))
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Now().Before(f.idleDeadline(p.IdleTimeout)) {
+				// The client sent datagrams since the deadline was armed.
+				continue
+			}
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				p.logf(slog.LevelInfo, "read from %q: %v", f.server.Address(), err)
+			}
+			return
+		}
+		f.touch()
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			p.logf(slog.LevelInfo, "write to %q: %v", logAddr(client), err)
+			continue
+		}
+		udpPackets.Inc(p.Name, "downstream")
+	}
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.lastSeen = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *udpFlow) idleDeadline(idle time.Duration) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastSeen.Add(idle)
+}
@@ -0,0 +1,303 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// envUpgradeFDs lists the keys of the sockets a process inherits from
+	// the process it upgrades, in the order of their file descriptors
+	// starting at 3.
+	envUpgradeFDs = "LB_UPGRADE_FDS"
+	// envUpgradeReady is the file descriptor of the pipe a new process
+	// writes to once it serves.
+	envUpgradeReady = "LB_UPGRADE_READY"
+
+	defaultUpgradeTimeout = time.Minute
+)
+
+// Upgrader hands the listening sockets of the process over to a new process
+// running the current executable, so that the binary can be replaced without
+// refusing a single connection: the new process accepts on the same sockets
+// while the old one finishes its in-flight requests and exits.
+//
+// Sockets are identified by their network and configured address. A socket
+// the new process does not listen on anymore is closed once it is ready.
+// Sockets passed by systemd socket activation are used the same way.
+type Upgrader struct {
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	inherited   map[string]*os.File
+	activated   []net.Listener
+	activatedPC []net.PacketConn
+	sockets     map[string]filer
+	ready       *os.File
+	upgraded    bool
+	upgrading   bool
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// DefaultUpgrader manages the sockets of this process.
+var DefaultUpgrader = newUpgrader()
+
+func newUpgrader() *Upgrader {
+	u := &Upgrader{
+		Timeout:   defaultUpgradeTimeout,
+		inherited: map[string]*os.File{},
+		sockets:   map[string]filer{},
+	}
+	keys, upgraded := os.LookupEnv(envUpgradeFDs)
+	u.upgraded = upgraded
+	if keys != "" {
+		for i, key := range strings.Split(keys, ",") {
+			u.inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envUpgradeReady)); err == nil {
+		u.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	os.Unsetenv(envUpgradeFDs)
+	os.Unsetenv(envUpgradeReady)
+	u.activated, u.activatedPC = systemdSockets()
+	return u
+}
+
+// listen listens on addr with DefaultUpgrader.
+func listen(network, addr string) (net.Listener, error) {
+	return DefaultUpgrader.Listen(network, addr)
+}
+
+// listenPacket is listen for packet-oriented networks.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	return DefaultUpgrader.ListenPacket(network, addr)
+}
+
+// Listen listens on addr, reusing the socket inherited from an upgraded
+// process or passed by systemd if there is one.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.listen(network+":"+addr, network, addr, &net.ListenConfig{})
+}
+
+// ListenReusePort opens n listeners on addr with SO_REUSEPORT, as Listen.
+func (u *Upgrader) ListenReusePort(network, addr string, n int) ([]net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	lc := &net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, n)
+	for i := range n {
+		key := network + ":" + addr
+		if i > 0 {
+			key += "#" + strconv.Itoa(i)
+		}
+		ln, err := u.listen(key, network, addr, lc)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func (u *Upgrader) listen(key, network, addr string, lc *net.ListenConfig) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			logf("Using inherited socket %q", key)
+		}
+	} else if i := slices.IndexFunc(u.activated, func(ln net.Listener) bool { return boundTo(ln.Addr(), network, addr) }); i >= 0 {
+		ln = u.activated[i]
+		u.activated = slices.Delete(u.activated, i, i+1)
+		logf("Using socket %q passed by systemd", key)
+	} else {
+		ln, err = lc.Listen(context.Background(), network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := ln.(filer); ok {
+		u.sockets[key] = f
+	}
+	return ln, nil
+}
+
+// ListenPacket is Listen for packet-oriented networks.
+func (u *Upgrader) ListenPacket(network, addr string) (net.PacketConn, error) {
+	key := network + ":" + addr
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var pc net.PacketConn
+	var err error
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			logf("Using inherited socket %q", key)
+		}
+	} else if i := slices.IndexFunc(u.activatedPC, func(pc net.PacketConn) bool { return boundTo(pc.LocalAddr(), network, addr) }); i >= 0 {
+		pc = u.activatedPC[i]
+		u.activatedPC = slices.Delete(u.activatedPC, i, i+1)
+		logf("Using socket %q passed by systemd", key)
+	} else {
+		pc, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := pc.(filer); ok {
+		u.sockets[key] = f
+	}
+	return pc, nil
+}
+
+// Upgraded reports whether the process was started by Upgrade.
+func (u *Upgrader) Upgraded() bool { return u.upgraded }
+
+// Ready closes the inherited sockets that were not reused and, if the
+// process was started by Upgrade, tells the old process to hand over; if it
+// was started by Daemonize, it tells the process waiting in the foreground.
+func (u *Upgrader) Ready() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, f := range u.inherited {
+		logf("Closing unused inherited socket %q", key)
+		f.Close()
+	}
+	clear(u.inherited)
+	for _, ln := range u.activated {
+		logf("Closing unused socket %q passed by systemd", ln.Addr())
+		ln.Close()
+	}
+	for _, pc := range u.activatedPC {
+		logf("Closing unused socket %q passed by systemd", pc.LocalAddr())
+		pc.Close()
+	}
+	u.activated, u.activatedPC = nil, nil
+	if u.ready != nil {
+		u.ready.Write([]byte{1})
+		u.ready.Close()
+		u.ready = nil
+	}
+}
+
+// Upgrade starts a new process running the current executable with the same
+// arguments and passes it the sockets of this process. It returns once the
+// new process is ready, after which this process should shut down
+// gracefully; on error this process keeps serving.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return errors.New("an upgrade is already in progress")
+	}
+	u.upgrading = true
+	keys := make([]string, 0, len(u.sockets))
+	for key := range u.sockets {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	files := make([]*os.File, 0, len(keys)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range keys {
+		f, err := u.sockets[key].File()
+		if err != nil {
+			u.upgrading = false
+			u.mu.Unlock()
+			return fmt.Errorf("socket %q: %w", key, err)
+		}
+		files = append(files, f)
+	}
+	u.mu.Unlock()
+
+	child, err := u.start(keys, files)
+	u.mu.Lock()
+	u.upgrading = false
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	logf("Upgraded to process %d", child)
+	return nil
+}
+
+// start runs the new process and waits until it is ready.
+func (u *Upgrader) start(keys []string, files []*os.File) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), envUpgradeFDs+"="+strings.Join(keys, ","))
+	return startReady(cmd, u.Timeout)
+}
+
+// startReady starts cmd, a process of this executable, and waits until it
+// calls Upgrader.Ready, killing it if that takes longer than timeout.
+func startReady(cmd *exec.Cmd, timeout time.Duration) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd.Env = append(cmd.Env, envUpgradeReady+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := r.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-ready:
+		if ok {
+			return cmd.Process.Pid, nil
+		}
+		// The process closed the pipe without being ready: it is exiting.
+		return 0, fmt.Errorf("new process failed: %v", <-exited)
+	case err := <-exited:
+		return 0, fmt.Errorf("new process failed: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process not ready after %v", timeout)
+	}
+}
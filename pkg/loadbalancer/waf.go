@@ -0,0 +1,263 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+)
+
+// defaultWAFMaxBody is how much of a request body WAF rules inspect by
+// default.
+const defaultWAFMaxBody = 64 << 10
+
+var wafHits = metrics.NewCounterVec("lb_waf_hits_total",
+	"Requests matched by a WAF rule, by rule and action.", "rule", "action")
+
+// WAF actions.
+const (
+	WAFBlock = "block"
+	WAFLog   = "log"
+)
+
+// WAFRule matches requests whose every condition holds. Its Action is
+// WAFBlock, answering 403, or WAFLog, only logging the request.
+type WAFRule struct {
+	ID         string
+	Methods    []string
+	Conditions []WAFCondition
+	Action     string
+}
+
+// WAFCondition holds when Regex matches the Target of a request: "method",
+// "path" (decoded), "query" (decoded, keeping invalid escapes), "uri" (as sent), "headers" (any
+// header value), "header:<name>" or "body", of which at most MaxBody bytes
+// are inspected.
+type WAFCondition struct {
+	Target string
+	Regex  *regexp.Regexp
+}
+
+// WAF checks requests against its rules in order. Matching rules are
+// counted and logged, and the first that blocks refuses the request.
+type WAF struct {
+	Rules   []*WAFRule
+	MaxBody int64
+	// body is set if a rule inspects the body.
+	body bool
+}
+
+// NewWAF creates a WAF from rules, inspecting up to maxBody bytes of
+// request bodies; zero means 64 KiB.
+func NewWAF(rules []*WAFRule, maxBody int64) (*WAF, error) {
+	w := &WAF{Rules: rules, MaxBody: maxBody}
+	if w.MaxBody <= 0 {
+		w.MaxBody = defaultWAFMaxBody
+	}
+	for _, rule := range rules {
+		if rule.Action != WAFBlock && rule.Action != WAFLog {
+			return nil, fmt.Errorf("rule %q: unknown action %q", rule.ID, rule.Action)
+		}
+		if len(rule.Conditions) == 0 {
+			return nil, fmt.Errorf("rule %q: no conditions", rule.ID)
+		}
+		for _, c := range rule.Conditions {
+			switch name, isHeader := strings.CutPrefix(c.Target, "header:"); {
+			case isHeader && name != "":
+			case c.Target == "body":
+				w.body = true
+			case slices.Contains([]string{"method", "path", "query", "uri", "headers"}, c.Target):
+			default:
+				return nil, fmt.Errorf("rule %q: unknown target %q", rule.ID, c.Target)
+			}
+		}
+	}
+	return w, nil
+}
+
+// wafRuleFile is the format of a WAF rule file.
+type wafRuleFile struct {
+	Rules []struct {
+		ID         string   `json:"id"`
+		Methods    []string `json:"methods"`
+		Action     string   `json:"action"`
+		Conditions []struct {
+			Target string `json:"target"`
+			Regex  string `json:"regex"`
+		} `json:"conditions"`
+	} `json:"rules"`
+}
+
+// LoadWAFRules reads the rules of a JSON rule file such as
+//
+//	{"rules": [
+//	  {"id": "path-traversal", "action": "block", "conditions": [
+//	    {"target": "uri", "regex": "(?i)(\\.\\.|%2e%2e)(/|%2f|\\\\)"}]},
+//	  {"id": "sqli-union", "action": "block", "conditions": [
+//	    {"target": "query", "regex": "(?i)union\\s+(all\\s+)?select"}]}
+//	]}
+//
+// Methods, if set, limit a rule to requests with those methods.
+func LoadWAFRules(path string) ([]*WAFRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f wafRuleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules := make([]*WAFRule, 0, len(f.Rules))
+	for i, rc := range f.Rules {
+		if rc.ID == "" {
+			return nil, fmt.Errorf("%s: rule %d: id is required", path, i)
+		}
+		rule := &WAFRule{ID: rc.ID, Action: rc.Action}
+		for _, m := range rc.Methods {
+			rule.Methods = append(rule.Methods, strings.ToUpper(m))
+		}
+		for _, cc := range rc.Conditions {
+			re, err := regexp.Compile(cc.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %q: invalid regex %q: %w", path, rc.ID, cc.Regex, err)
+			}
+			target := cc.Target
+			if name, ok := strings.CutPrefix(target, "header:"); ok {
+				target = "header:" + textproto.CanonicalMIMEHeaderKey(name)
+			}
+			rule.Conditions = append(rule.Conditions, WAFCondition{Target: target, Regex: re})
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// wafRequest holds the parts of a request conditions inspect.
+type wafRequest struct {
+	r     *http.Request
+	query string
+	body  []byte
+}
+
+// wafUnescape decodes the escapes of the query s, and its "+" as spaces,
+// keeping invalid escapes as they are: rejecting the whole query for one of
+// them would let it hide the rest from the rules.
+func wafUnescape(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && ishex(s[i+1]) && ishex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func ishex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func (c *WAFCondition) matches(req *wafRequest) bool {
+	r := req.r
+	switch c.Target {
+	case "method":
+		return c.Regex.MatchString(r.Method)
+	case "path":
+		return c.Regex.MatchString(r.URL.Path)
+	case "query":
+		return c.Regex.MatchString(req.query)
+	case "uri":
+		return c.Regex.MatchString(r.RequestURI)
+	case "body":
+		return c.Regex.Match(req.body)
+	case "headers":
+		for _, values := range r.Header {
+			if slices.ContainsFunc(values, c.Regex.MatchString) {
+				return true
+			}
+		}
+		return false
+	}
+	name := strings.TrimPrefix(c.Target, "header:")
+	if name == "Host" {
+		return c.Regex.MatchString(r.Host)
+	}
+	return slices.ContainsFunc(r.Header.Values(name), c.Regex.MatchString)
+}
+
+func (rule *WAFRule) matches(req *wafRequest) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, req.r.Method) {
+		return false
+	}
+	for i := range rule.Conditions {
+		if !rule.Conditions[i].matches(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware returns the middleware checking requests against the rules.
+func (w *WAF) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			req := &wafRequest{r: r, query: wafUnescape(r.URL.RawQuery)}
+			if w.body && r.Body != nil && r.Body != http.NoBody {
+				// A read error shows again to whoever reads the rest of the
+				// body after what was inspected.
+				buf, _ := io.ReadAll(io.LimitReader(r.Body, w.MaxBody))
+				req.body = buf
+				r = r.WithContext(r.Context())
+				if r.Header.Get("Expect") != "" {
+					// Reading the body has sent the client its 100 Continue.
+					r.Header = r.Header.Clone()
+					r.Header.Del("Expect")
+				}
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+				req.r = r
+			}
+			for _, rule := range w.Rules {
+				if !rule.matches(req) {
+					continue
+				}
+				wafHits.Inc(rule.ID, rule.Action)
+				logf("WAF rule %q matched %s %s from %s (%s)", rule.ID, r.Method, r.RequestURI, logIP(clientIP(r)), rule.Action)
+				if rule.Action == WAFBlock {
+					httpError(rw, r, "403 forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
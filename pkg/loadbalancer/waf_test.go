@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newTestWAF(t *testing.T, rules ...*WAFRule) *WAF {
+	t.Helper()
+	w, err := NewWAF(rules, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func blockRule(target, re string) *WAFRule {
+	return &WAFRule{
+		ID:         target,
+		Conditions: []WAFCondition{{Target: target, Regex: regexp.MustCompile(re)}},
+		Action:     WAFBlock,
+	}
+}
+
+// wafStatus serves r through w, returning the status and the body the
+// backend read.
+func wafStatus(w *WAF, r *http.Request) (int, string) {
+	var body string
+	h := w.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Code, body
+}
+
+func TestWAFTargets(t *testing.T) {
+	for _, tc := range []struct {
+		name, target, re string
+		req              func() *http.Request
+		blocked          bool
+	}{
+		{"method", "method", "^DELETE$", func() *http.Request { return httptest.NewRequest("DELETE", "/", nil) }, true},
+		{"path decoded", "path", `^/etc/passwd$`, func() *http.Request { return httptest.NewRequest("GET", "/etc%2Fpasswd", nil) }, true},
+		{"uri as sent", "uri", `%2F`, func() *http.Request { return httptest.NewRequest("GET", "/etc%2Fpasswd", nil) }, true},
+		{"query decoded", "query", `union select`, func() *http.Request { return httptest.NewRequest("GET", "/?q=union+select", nil) }, true},
+		{"query clean", "query", `union select`, func() *http.Request { return httptest.NewRequest("GET", "/?q=union", nil) }, false},
+		{"headers", "headers", `jndi:`, func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Api-Version", "${jndi:ldap://x}")
+			return r
+		}, true},
+		{"named header", "header:User-Agent", `^sqlmap`, func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("User-Agent", "sqlmap/1.0")
+			return r
+		}, true},
+		{"other header", "header:User-Agent", `^sqlmap`, func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Referer", "sqlmap/1.0")
+			return r
+		}, false},
+		{"host", "header:Host", `^evil\.`, func() *http.Request { return httptest.NewRequest("GET", "http://evil.example/", nil) }, true},
+		{"body", "body", `<script>`, func() *http.Request { return httptest.NewRequest("POST", "/", strings.NewReader("a=<script>")) }, true},
+		{"body past the limit", "body", `<script>`, func() *http.Request {
+			return httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 16)+"<script>"))
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := wafStatus(newTestWAF(t, blockRule(tc.target, tc.re)), tc.req())
+			if got := code == http.StatusForbidden; got != tc.blocked {
+				t.Errorf("got %d, want blocked %v", code, tc.blocked)
+			}
+		})
+	}
+}
+
+// TestWAFQueryBadEscape checks that an invalid escape in one parameter
+// does not leave the others undecoded.
+func TestWAFQueryBadEscape(t *testing.T) {
+	w := newTestWAF(t, blockRule("query", `(?i)union\s+select`))
+	for _, target := range []string{
+		"/?q=1%20union%20select%201&x=%zz",
+		"/?x=%&q=1+union+select+1",
+		"/?q=1%20union%20select%201%",
+	} {
+		if code, _ := wafStatus(w, httptest.NewRequest("GET", target, nil)); code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", target, code)
+		}
+	}
+}
+
+func TestWAFUnescape(t *testing.T) {
+	for in, want := range map[string]string{
+		"a=1&b=2":     "a=1&b=2",
+		"a=%41+b":     "a=A b",
+		"a=%zz&b=%42": "a=%zz&b=B",
+		"a=%4":        "a=%4",
+		"a=%%41":      "a=%A",
+		"a=%2526":     "a=%26",
+	} {
+		if got := wafUnescape(in); got != want {
+			t.Errorf("wafUnescape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWAFRules(t *testing.T) {
+	logRule := &WAFRule{
+		ID:         "log",
+		Conditions: []WAFCondition{{Target: "path", Regex: regexp.MustCompile("^/admin")}},
+		Action:     WAFLog,
+	}
+	postOnly := blockRule("body", "drop table")
+	postOnly.Methods = []string{"POST"}
+	both := &WAFRule{
+		ID: "both",
+		Conditions: []WAFCondition{
+			{Target: "path", Regex: regexp.MustCompile("^/login")},
+			{Target: "query", Regex: regexp.MustCompile("debug")},
+		},
+		Action: WAFBlock,
+	}
+	w := newTestWAF(t, logRule, postOnly, both)
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"GET", "/admin", "", http.StatusOK},
+		{"POST", "/", "drop table", http.StatusForbidden},
+		{"PUT", "/", "drop table", http.StatusOK},
+		{"GET", "/login?debug=1", "", http.StatusForbidden},
+		{"GET", "/login", "", http.StatusOK},
+		{"GET", "/?debug=1", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		code, body := wafStatus(w, r)
+		if code != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.target, code, tc.want)
+		}
+		if code == http.StatusOK && body != tc.body {
+			t.Errorf("%s %s: backend read %q, want %q", tc.method, tc.target, body, tc.body)
+		}
+	}
+}
+
+func TestNewWAFErrors(t *testing.T) {
+	re := regexp.MustCompile("x")
+	for name, rule := range map[string]*WAFRule{
+		"unknown target": {ID: "a", Conditions: []WAFCondition{{Target: "cookie", Regex: re}}, Action: WAFBlock},
+		"unknown action": {ID: "a", Conditions: []WAFCondition{{Target: "path", Regex: re}}, Action: "drop"},
+		"no conditions":  {ID: "a", Action: WAFBlock},
+	} {
+		if _, err := NewWAF([]*WAFRule{rule}, 0); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/javvaji888/golang-load-balancer/internal/metrics"
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+var (
+	websocketConnections = metrics.NewGaugeVec("lb_websocket_connections",
+		"WebSocket connections currently proxied.", "pool", "server")
+	websocketUpgrades = metrics.NewCounterVec("lb_websocket_upgrades_total",
+		"WebSocket upgrade requests proxied.", "route", "pool")
+)
+
+// isWebSocket reports whether r asks to upgrade the connection to WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerHasToken reports whether the comma-separated header name contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket proxies a WebSocket upgrade to server. The reverse proxy
+// passes the Upgrade and Connection headers through and splices the two
+// connections once the backend switches protocols; the listener's read and
+// write deadlines are lifted first so that request timeouts meant for
+// ordinary requests don't cut a long-lived stream.
+func serveWebSocket(rw http.ResponseWriter, r *http.Request, route string, pool *Pool, server backend.Server) {
+	rc := http.NewResponseController(rw)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	websocketUpgrades.Inc(route, pool.Name)
+	websocketConnections.Inc(pool.Name, server.Address())
+	defer websocketConnections.Dec(pool.Name, server.Address())
+	server.Serve(rw, r)
+}
@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"time"
+)
+
+// MaintenanceWindows returns the maintenance windows of the server.
+func (a *adminState) MaintenanceWindows() []*Schedule {
+	return a.windows
+}
+
+// SetMaintenanceWindows sets the recurring windows during which the server
+// is drained, before the pool's windows are started.
+func (a *adminState) SetMaintenanceWindows(windows []*Schedule) {
+	a.windows = windows
+}
+
+// InMaintenanceWindow reports whether a maintenance window of the server is
+// open.
+func (a *adminState) InMaintenanceWindow() bool {
+	return a.inWindow.Load()
+}
+
+// drainedByWindow reports whether the server is drained by a maintenance
+// window rather than by the operator.
+func (a *adminState) drainedByWindow() bool {
+	return a.windowDrain.Load()
+}
+
+// checkWindows drains the server when one of its windows opens and returns
+// it to service when the last one closes. A drain or undrain by the operator
+// during a window takes precedence: the server is only returned to service
+// if the window itself drained it. It returns +1 on entering a window, -1 on
+// leaving one and 0 otherwise.
+func (a *adminState) checkWindows(now time.Time) int {
+	active := false
+	for _, w := range a.windows {
+		if w.Active(now) {
+			active = true
+			break
+		}
+	}
+	switch {
+	case active && !a.inWindow.Load():
+		a.inWindow.Store(true)
+		if !a.Draining() {
+			a.Drain(false)
+			a.windowDrain.Store(true)
+		}
+		return 1
+	case !active && a.inWindow.Load():
+		a.inWindow.Store(false)
+		if a.windowDrain.Load() {
+			a.Undrain()
+		}
+		return -1
+	}
+	return 0
+}
+
+// Windowed is implemented by servers with maintenance windows.
+type Windowed interface {
+	MaintenanceWindows() []*Schedule
+	SetMaintenanceWindows(windows []*Schedule)
+	InMaintenanceWindow() bool
+	drainedByWindow() bool
+	checkWindows(now time.Time) int
+}
+
+// StartMaintenanceWindows drains the servers of the pool during their
+// maintenance windows, checking them at the start of every minute.
+func (p *Pool) StartMaintenanceWindows() {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-p.ctx.Done():
+				return
+			}
+			now := time.Now()
+			for _, s := range p.Servers() {
+				w, ok := s.(Windowed)
+				if !ok || len(w.MaintenanceWindows()) == 0 {
+					continue
+				}
+				switch w.checkWindows(now) {
+				case 1:
+					p.logf("server %q entered its maintenance window", s.Address())
+				case -1:
+					p.logf("server %q left its maintenance window", s.Address())
+				}
+			}
+			timer.Reset(now.Truncate(time.Minute).Add(time.Minute).Sub(time.Now()))
+		}
+	}()
+}
@@ -0,0 +1,386 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultZooKeeperTimeout = 10 * time.Second
+
+// ZooKeeper operation codes and special xids.
+const (
+	zkOpGetData     = 4
+	zkOpGetChildren = 8
+	zkOpPing        = 11
+	zkOpClose       = -11
+
+	zkXidWatch = -1
+	zkXidPing  = -2
+)
+
+// ZooKeeperDiscoverer yields the servers registered as children of a znode,
+// typically ephemeral nodes that vanish with the session of the server that
+// created them. A child's data is a bare address, a JSON object as for
+// EtcdDiscoverer, or a Curator ServiceInstance with "address" and "port".
+//
+// ZooKeeperDiscoverer is a Watcher: it sets watches on the znode and its
+// children and rereads them when one fires.
+type ZooKeeperDiscoverer struct {
+	// Servers are the host:port addresses of the ensemble, tried in order.
+	Servers []string
+	Path    string
+	// Scheme is prepended to Curator registrations, as
+	// "<scheme>://host:port"; if empty, they are bare host:port pairs.
+	Scheme  string
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	last []Target
+}
+
+// NewZooKeeperDiscoverer creates a ZooKeeperDiscoverer for the children of
+// path.
+func NewZooKeeperDiscoverer(servers []string, path string) (*ZooKeeperDiscoverer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("zookeeper servers must not be empty")
+	}
+	if len(path) == 0 || path[0] != '/' {
+		return nil, fmt.Errorf("zookeeper path %q must be absolute", path)
+	}
+	return &ZooKeeperDiscoverer{Servers: servers, Path: path, Timeout: defaultZooKeeperTimeout}, nil
+}
+
+// Discover implements Discoverer.
+func (z *ZooKeeperDiscoverer) Discover(ctx context.Context) ([]Target, error) {
+	conn, err := z.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	targets, err := z.read(conn, false)
+	if err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	z.last = targets
+	z.mu.Unlock()
+	return targets, nil
+}
+
+// Watch implements Watcher.
+func (z *ZooKeeperDiscoverer) Watch(ctx context.Context) ([]Target, error) {
+	conn, err := z.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	targets, err := z.read(conn, true)
+	if err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	last := z.last
+	z.mu.Unlock()
+	// Changes made since the last read are only seen by rereading.
+	if !slices.Equal(targets, last) {
+		z.mu.Lock()
+		z.last = targets
+		z.mu.Unlock()
+		return targets, nil
+	}
+	if err := conn.waitWatch(ctx); err != nil {
+		return nil, err
+	}
+	if targets, err = z.read(conn, false); err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	z.last = targets
+	z.mu.Unlock()
+	return targets, nil
+}
+
+// read reads the registered servers, setting watches if watch is set.
+func (z *ZooKeeperDiscoverer) read(conn *zkConn, watch bool) ([]Target, error) {
+	children, err := conn.getChildren(z.Path, watch)
+	if err != nil {
+		return nil, fmt.Errorf("zookeeper %s: %w", z.Path, err)
+	}
+	slices.Sort(children)
+	targets := make([]Target, 0, len(children))
+	for _, child := range children {
+		path := z.Path + "/" + child
+		if z.Path == "/" {
+			path = "/" + child
+		}
+		data, err := conn.getData(path, watch)
+		if errors.Is(err, errZKNoNode) {
+			// The registration vanished while reading.
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("zookeeper %s: %w", path, err)
+		}
+		t, err := z.target(data)
+		if err != nil {
+			return nil, fmt.Errorf("zookeeper %s: %w", path, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// target parses the data of a registration node.
+func (z *ZooKeeperDiscoverer) target(data []byte) (Target, error) {
+	var curator struct {
+		Address string `json:"address"`
+		Port    *int   `json:"port"`
+	}
+	if json.Unmarshal(data, &curator) == nil && curator.Address != "" && curator.Port != nil {
+		addr := net.JoinHostPort(curator.Address, strconv.Itoa(*curator.Port))
+		if z.Scheme != "" {
+			addr = z.Scheme + "://" + addr
+		}
+		return Target{Addr: addr}, nil
+	}
+	return registryTarget(data)
+}
+
+var errZKNoNode = errors.New("no node")
+
+// zkConn is a ZooKeeper client session on one connection. Requests are
+// issued one at a time.
+type zkConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	xid     int32
+}
+
+func (z *ZooKeeperDiscoverer) connect(ctx context.Context) (*zkConn, error) {
+	var errs []error
+	for _, addr := range z.Servers {
+		dialer := net.Dialer{Timeout: z.Timeout}
+		nc, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn := &zkConn{Conn: nc, r: bufio.NewReader(nc), timeout: z.Timeout}
+		if err := conn.handshake(); err != nil {
+			nc.Close()
+			errs = append(errs, fmt.Errorf("zookeeper %s: %w", addr, err))
+			continue
+		}
+		return conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// handshake creates a new session.
+func (c *zkConn) handshake() error {
+	var req zkBuffer
+	req.int32(0) // protocol version
+	req.int64(0) // last zxid seen
+	req.int32(int32(c.timeout / time.Millisecond))
+	req.int64(0)                // session id
+	req.bytes(make([]byte, 16)) // password
+	if err := c.send(req); err != nil {
+		return err
+	}
+	resp, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if len(resp) < 16 {
+		return fmt.Errorf("short connect response")
+	}
+	// A negotiated timeout of zero means the session was refused.
+	if binary.BigEndian.Uint32(resp[4:8]) == 0 {
+		return fmt.Errorf("session refused")
+	}
+	return nil
+}
+
+func (c *zkConn) close() {
+	c.xid++
+	var req zkBuffer
+	req.int32(c.xid)
+	req.int32(zkOpClose)
+	c.send(req)
+	c.Conn.Close()
+}
+
+func (c *zkConn) getChildren(path string, watch bool) ([]string, error) {
+	resp, err := c.call(zkOpGetChildren, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	d := zkDecoder{b: resp}
+	n := d.int32()
+	if n < 0 || int(n) > len(resp) {
+		return nil, fmt.Errorf("bad children count %d", n)
+	}
+	children := make([]string, 0, n)
+	for range n {
+		children = append(children, string(d.bytes()))
+	}
+	return children, d.err
+}
+
+func (c *zkConn) getData(path string, watch bool) ([]byte, error) {
+	resp, err := c.call(zkOpGetData, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	d := zkDecoder{b: resp}
+	data := d.bytes()
+	return data, d.err
+}
+
+// call sends a request taking a path and a watch flag and returns the body
+// of its reply.
+func (c *zkConn) call(op int32, path string, watch bool) ([]byte, error) {
+	c.xid++
+	var req zkBuffer
+	req.int32(c.xid)
+	req.int32(op)
+	req.bytes([]byte(path))
+	req.bool(watch)
+	if err := c.send(req); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 16 {
+			return nil, fmt.Errorf("short reply")
+		}
+		xid := int32(binary.BigEndian.Uint32(resp))
+		if xid != c.xid {
+			// Watch events of earlier requests; not expected before
+			// the reply, but harmless.
+			continue
+		}
+		switch code := int32(binary.BigEndian.Uint32(resp[12:16])); code {
+		case 0:
+			return resp[16:], nil
+		case -101:
+			return nil, errZKNoNode
+		default:
+			return nil, fmt.Errorf("error code %d", code)
+		}
+	}
+}
+
+// waitWatch waits for a watch event, pinging to keep the session alive.
+func (c *zkConn) waitWatch(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { c.Conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	for {
+		c.SetReadDeadline(time.Now().Add(c.timeout / 3))
+		resp, err := c.recvNoDeadline()
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var req zkBuffer
+			req.int32(zkXidPing)
+			req.int32(zkOpPing)
+			if err := c.send(req); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(resp) >= 4 && int32(binary.BigEndian.Uint32(resp)) == zkXidWatch {
+			return nil
+		}
+	}
+}
+
+func (c *zkConn) send(b zkBuffer) error {
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	_, err := c.Write(append(frame, b...))
+	return err
+}
+
+func (c *zkConn) recv() ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.recvNoDeadline()
+}
+
+func (c *zkConn) recvNoDeadline() ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("zookeeper packet too large: %d bytes", size)
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(c.r, b)
+	return b, err
+}
+
+// zkBuffer encodes jute records.
+type zkBuffer []byte
+
+func (b *zkBuffer) int32(v int32) { *b = binary.BigEndian.AppendUint32(*b, uint32(v)) }
+func (b *zkBuffer) int64(v int64) { *b = binary.BigEndian.AppendUint64(*b, uint64(v)) }
+func (b *zkBuffer) bytes(v []byte) {
+	b.int32(int32(len(v)))
+	*b = append(*b, v...)
+}
+func (b *zkBuffer) bool(v bool) {
+	if v {
+		*b = append(*b, 1)
+	} else {
+		*b = append(*b, 0)
+	}
+}
+
+// zkDecoder decodes jute records, recording the first error.
+type zkDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *zkDecoder) int32() int32 {
+	if len(d.b) < 4 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(d.b))
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *zkDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	if int(n) > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
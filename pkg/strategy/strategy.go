@@ -0,0 +1,120 @@
+// Package strategy provides the strategies a pool picks the server of each
+// request with.
+package strategy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// Strategy picks the server that handles the next request of a pool. Next
+// is called from the goroutines of concurrent requests, so strategies keep
+// their state in atomics or under a lock.
+type Strategy interface {
+	// Next returns the next live server among servers, or nil if none is alive.
+	Next(servers []backend.Server) backend.Server
+}
+
+// Factory creates a strategy. Each pool gets its own, so that strategies
+// keep their state per pool.
+type Factory func() Strategy
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{
+		"round_robin":          func() Strategy { return &RoundRobin{} },
+		"least_requests":       func() Strategy { return &LeastRequests{} },
+		"weighted_round_robin": func() Strategy { return &WeightedRoundRobin{} },
+	}
+)
+
+// Register makes a strategy available under name to New and the strategy
+// setting of pools, usually from an init function. It panics if name is
+// empty or already registered.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("strategy: Register with an empty name or nil factory")
+	}
+	if _, dup := registry[name]; dup {
+		panic("strategy " + name + " registered twice")
+	}
+	registry[name] = factory
+}
+
+// Names returns the names of the registered strategies, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return slices.Sorted(maps.Keys(registry))
+}
+
+// New returns a new strategy of those registered under name; the empty name
+// means round_robin.
+func New(name string) (Strategy, error) {
+	if name == "" {
+		name = "round_robin"
+	}
+	registryMu.RLock()
+	factory := registry[name]
+	registryMu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+	return factory(), nil
+}
+
+// RoundRobin cycles through servers in order, skipping dead ones.
+type RoundRobin struct {
+	count atomic.Uint64
+}
+
+// Next implements Strategy.
+func (rr *RoundRobin) Next(servers []backend.Server) backend.Server {
+	n := uint64(len(servers))
+	if n == 0 {
+		return nil
+	}
+	start := rr.count.Add(1) - 1
+	for i := range n {
+		if server := servers[(start+i)%n]; server.IsAlive() {
+			return server
+		}
+	}
+	return nil
+}
+
+// LeastRequests picks the live server with the fewest requests in flight,
+// which balances long-lived calls such as gRPC streams better than
+// round robin. Ties are broken in rotation. Servers that don't report their
+// in-flight requests count as idle.
+type LeastRequests struct {
+	offset atomic.Uint64
+}
+
+// Next implements Strategy.
+func (lr *LeastRequests) Next(servers []backend.Server) backend.Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	start := int(lr.offset.Add(1) % uint64(len(servers)))
+	var best backend.Server
+	var bestN int64
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+		if !server.IsAlive() {
+			continue
+		}
+		n := server.ActiveConnections()
+		if best == nil || n < bestN {
+			best, bestN = server, n
+		}
+	}
+	return best
+}
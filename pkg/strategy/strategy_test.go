@@ -0,0 +1,158 @@
+package strategy_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+	"github.com/javvaji888/golang-load-balancer/pkg/lbtest"
+	"github.com/javvaji888/golang-load-balancer/pkg/strategy"
+)
+
+const (
+	pickers = 8
+	picks   = 1000
+)
+
+// pickConcurrently calls s.Next over servers picks times from each of
+// pickers goroutines, alongside change if not nil, which runs until they
+// are done, and returns how many times each server was picked.
+func pickConcurrently(s strategy.Strategy, servers []backend.Server, change func(stop <-chan struct{})) map[string]int {
+	stop := make(chan struct{})
+	var changing sync.WaitGroup
+	if change != nil {
+		changing.Go(func() { change(stop) })
+	}
+	results := make([]map[string]int, pickers)
+	var wg sync.WaitGroup
+	for i := range pickers {
+		wg.Go(func() { results[i] = lbtest.Pick(s, servers, picks) })
+	}
+	wg.Wait()
+	close(stop)
+	changing.Wait()
+	counts := map[string]int{}
+	for _, r := range results {
+		for addr, n := range r {
+			counts[addr] += n
+		}
+	}
+	return counts
+}
+
+// TestConcurrentNext checks that the strategies spread requests picked
+// concurrently as they would serially. Run with -race.
+func TestConcurrentNext(t *testing.T) {
+	for _, name := range strategy.Names() {
+		t.Run(name, func(t *testing.T) {
+			s, err := strategy.New(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := pickConcurrently(s, lbtest.Servers("a", "b", "c", "d"), nil)
+			lbtest.AssertDistribution(t, counts, map[string]float64{"a": 1, "b": 1, "c": 1, "d": 1}, 0.02)
+		})
+	}
+}
+
+// TestConcurrentRoundRobin checks that no pick is lost or repeated when
+// round robin picks concurrently.
+func TestConcurrentRoundRobin(t *testing.T) {
+	counts := pickConcurrently(&strategy.RoundRobin{}, lbtest.Servers("a", "b", "c", "d"), nil)
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		if counts[addr] != pickers*picks/4 {
+			t.Errorf("%s picked %d times, want %d", addr, counts[addr], pickers*picks/4)
+		}
+	}
+}
+
+func TestConcurrentWeightedRoundRobin(t *testing.T) {
+	servers := []backend.Server{lbtest.NewServer("a", 1), lbtest.NewServer("b", 3)}
+	counts := pickConcurrently(&strategy.WeightedRoundRobin{}, servers, nil)
+	if counts["a"] != pickers*picks/4 || counts["b"] != 3*pickers*picks/4 {
+		t.Errorf("got %v, want a %d and b %d", counts, pickers*picks/4, 3*pickers*picks/4)
+	}
+}
+
+// TestConcurrentChanges checks that strategies pick safely while servers
+// go down and up and change weights.
+func TestConcurrentChanges(t *testing.T) {
+	for _, name := range strategy.Names() {
+		t.Run(name, func(t *testing.T) {
+			s, err := strategy.New(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers := lbtest.Servers("a", "b", "c")
+			counts := pickConcurrently(s, servers, func(stop <-chan struct{}) {
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					server := servers[i%2].(*lbtest.Server)
+					server.SetAlive(i%4 < 2)
+					server.SetWeight(1 + i%3)
+				}
+			})
+			// c never goes down, so some server is always alive.
+			if counts[""] != 0 || counts["c"] == 0 {
+				t.Errorf("got %v", counts)
+			}
+		})
+	}
+}
+
+// TestConcurrentLeastRequests checks that least requests keeps counting
+// the requests in flight it picks by right when they run concurrently.
+func TestConcurrentLeastRequests(t *testing.T) {
+	servers := lbtest.Servers("a", "b", "c", "d")
+	lr := &strategy.LeastRequests{}
+	var wg sync.WaitGroup
+	for range pickers {
+		wg.Go(func() {
+			for range picks {
+				server := lr.Next(servers).(*lbtest.Server)
+				server.Start()
+				server.Done()
+			}
+		})
+	}
+	wg.Wait()
+	for _, s := range servers {
+		if n := s.ActiveConnections(); n != 0 {
+			t.Errorf("%s has %d requests in flight, want 0", s.Address(), n)
+		}
+	}
+}
+
+// TestNextAllocs checks that the strategies pick without allocating.
+func TestNextAllocs(t *testing.T) {
+	servers := lbtest.Servers("a", "b", "c", "d")
+	for _, name := range strategy.Names() {
+		s, err := strategy.New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := testing.AllocsPerRun(100, func() { s.Next(servers) }); n != 0 {
+			t.Errorf("%s: %v allocations, want 0", name, n)
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	servers := lbtest.Servers("a", "b", "c", "d")
+	for _, name := range strategy.Names() {
+		b.Run(name, func(b *testing.B) {
+			s, err := strategy.New(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				s.Next(servers)
+			}
+		})
+	}
+}
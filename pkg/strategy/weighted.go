@@ -0,0 +1,51 @@
+package strategy
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/javvaji888/golang-load-balancer/pkg/backend"
+)
+
+// WeightedRoundRobin spreads requests over live servers in proportion to
+// their weights, interleaving them smoothly rather than in bursts. Servers
+// with a weight of zero or less receive no traffic.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[backend.Server]int
+}
+
+// Next implements Strategy.
+func (wrr *WeightedRoundRobin) Next(servers []backend.Server) backend.Server {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+	if wrr.current == nil {
+		wrr.current = map[backend.Server]int{}
+	}
+	var best backend.Server
+	total, bestCurrent := 0, 0
+	for _, s := range servers {
+		w := s.Weight()
+		if w <= 0 || !s.IsAlive() {
+			continue
+		}
+		total += w
+		current := wrr.current[s] + w
+		wrr.current[s] = current
+		if best == nil || current > bestCurrent {
+			best, bestCurrent = s, current
+		}
+	}
+	if best != nil {
+		wrr.current[best] -= total
+	}
+	if len(wrr.current) > 2*len(servers) {
+		// Forget servers that left the pool.
+		for s := range wrr.current {
+			if !slices.Contains(servers, s) {
+				delete(wrr.current, s)
+			}
+		}
+	}
+	return best
+}